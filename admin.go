@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin dashboard at /admin/ lists requests by status, refreshes every
+// few seconds, shows a request's event timeline and notification state, and
+// can cancel a request or send its notification again. Signing in takes an
+// API key with the admin scope. The session cookie holds the key id and an
+// expiry signed with the key's hash, so deleting or rotating the key ends its
+// sessions. The page talks to JSON endpoints under /admin/api/ that mirror
+// the /v1 API; POSTs must come from the same origin, and the cookie is
+// SameSite=Strict. /admin follows the api_* IP rules.
+
+const (
+	adminCookieName = "ask4me_admin"
+	adminSessionTTL = 12 * time.Hour
+	adminRecentErrs = 20
+)
+
+func adminMAC(keyHash, keyID string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(keyHash))
+	fmt.Fprintf(mac, "admin|%s|%d", keyID, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// adminKeyHash returns the hash session cookies of keyID are signed with.
+func (s *server) adminKeyHash(ctx context.Context, keyID string) (string, error) {
+	if keyID == rootAPIKey.ID {
+		return sha256Hex(s.cfg().APIKey), nil
+	}
+	k, err := s.db.getAPIKey(ctx, keyID)
+	if err != nil {
+		return "", err
+	}
+	if !k.allows(scopeAdmin) {
+		return "", errors.New("key lacks the admin scope")
+	}
+	return k.Hash, nil
+}
+
+// adminSession reports whether r carries a valid session cookie.
+func (s *server) adminSession(r *http.Request) bool {
+	c, err := r.Cookie(adminCookieName)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	hash, err := s.adminKeyHash(r.Context(), parts[0])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(parts[2]), []byte(adminMAC(hash, parts[0], exp))) == 1
+}
+
+func (s *server) setAdminCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    value,
+		Path:     s.cfg().PathPrefix + "/admin/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// handleAdmin serves /admin/: the page, sign-in and sign-out, and the JSON
+// endpoints under /admin/api/.
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	setPageSecurityHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+	path := strings.TrimPrefix(r.URL.Path, "/admin/")
+	if r.Method == http.MethodPost && !s.sameOrigin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case path == "":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.renderAdmin(w, http.StatusOK, s.adminSession(r), "")
+	case path == "login":
+		s.limitIP("admin", http.HandlerFunc(s.handleAdminLogin)).ServeHTTP(w, r)
+	case path == "logout":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.setAdminCookie(w, r, "", -1)
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	case strings.HasPrefix(path, "api/"):
+		if !s.adminSession(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.handleAdminAPI(w, r, strings.TrimPrefix(path, "api/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	k, ok, err := s.lookupAPIKey(r.Context(), strings.TrimSpace(r.PostFormValue("key")))
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok || !k.allows(scopeAdmin) {
+		s.renderAdmin(w, http.StatusUnauthorized, false, "That key is unknown or lacks the admin scope.")
+		return
+	}
+	hash, err := s.adminKeyHash(r.Context(), k.ID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	exp := time.Now().Add(adminSessionTTL).Unix()
+	s.setAdminCookie(w, r, fmt.Sprintf("%s.%d.%s", k.ID, exp, adminMAC(hash, k.ID, exp)), int(adminSessionTTL/time.Second))
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// handleAdminAPI routes /admin/api/{path}:
+//
+//	GET  requests                    same as GET /v1/requests
+//	GET  requests/{id}               same as GET /v1/requests/{id}
+//	GET  requests/{id}/events        the event timeline
+//	POST requests/{id}/cancel        same as POST /v1/requests/{id}/cancel
+//	POST requests/{id}/notify        push the notification again
+//	GET  stats                       counts and recent notification errors
+func (s *server) handleAdminAPI(w http.ResponseWriter, r *http.Request, path string) {
+	if path == "stats" {
+		s.handleAdminStats(w, r)
+		return
+	}
+	rest, ok := strings.CutPrefix(path, "requests")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		s.handleListRequests(w, r)
+		return
+	}
+	requestID, sub, _ := strings.Cut(rest, "/")
+	if !isValidRequestID(requestID) {
+		http.Error(w, "invalid request_id", http.StatusBadRequest)
+		return
+	}
+	switch sub {
+	case "":
+		s.handleGetRequest(w, r, requestID)
+	case "events":
+		s.handleAdminEvents(w, r, requestID)
+	case "cancel":
+		s.handleCancelRequest(w, r, requestID)
+	case "notify":
+		s.handleRenotify(w, r, requestID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type timelineEvent struct {
+	ID        string
+	Type      string
+	Data      json.RawMessage
+	CreatedAt int64
+}
+
+func (s *store) listEventTimeline(ctx context.Context, reqID string) ([]timelineEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT event_id, type, payload_json, payload_encoding, created_at FROM events WHERE request_id=? ORDER BY seq ASC`,
+		reqID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []timelineEvent
+	for rows.Next() {
+		var e timelineEvent
+		var payload string
+		var encoding sql.NullString
+		if err := rows.Scan(&e.ID, &e.Type, &payload, &encoding, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(decodeEventPayload(payload, encoding))
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *server) handleAdminEvents(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := s.db.listEventTimeline(r.Context(), requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, e := range list {
+		out = append(out, map[string]any{
+			"id":         e.ID,
+			"type":       e.Type,
+			"data":       e.Data,
+			"created_at": unixOrNil(e.CreatedAt),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"request_id": requestID, "events": out})
+}
+
+// renotifyNow puts the stored delivery of reqID back in the outbox, due now.
+// ok=false means there is none, or it is being sent right now.
+func (s *store) renotifyNow(ctx context.Context, reqID string) (bool, error) {
+	now := time.Now().Unix()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox SET status=?, attempts=0, next_attempt_at=?, last_error=NULL, updated_at=? WHERE request_id=? AND status<>?`,
+		outboxStatusPending, now, now, reqID, outboxStatusSending,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE requests SET status='created', updated_at=? WHERE request_id=? AND status='delivered'`,
+		now, reqID,
+	)
+	return err == nil, err
+}
+
+// handleRenotify serves POST /admin/api/requests/{id}/notify for open
+// requests. The links sent are the stored ones.
+func (s *server) handleRenotify(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if isTerminalStatus(status) {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request already finished",
+		})
+		return
+	}
+	ok, err := s.db.renotifyNow(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"error":      "no notification to send now",
+		})
+		return
+	}
+	s.wakeOutbox()
+	writeJSON(w, http.StatusAccepted, map[string]any{"request_id": requestID, "status": outboxStatusPending})
+}
+
+func (s *store) countByStatus(ctx context.Context, table string) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT status, COUNT(*) FROM `+table+` GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]int64{}
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		out[status] = n
+	}
+	return out, rows.Err()
+}
+
+// listNotificationErrors returns the latest outbox rows that failed or are
+// waiting for a retry.
+func (s *store) listNotificationErrors(ctx context.Context, limit int) ([]outboxEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		outboxSelect+` WHERE last_error IS NOT NULL AND status IN (?,?) ORDER BY updated_at DESC LIMIT ?`,
+		outboxStatusFailed, outboxStatusPending, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []outboxEntry
+	for rows.Next() {
+		e, err := scanOutboxEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	requests, err := s.db.countByStatus(ctx, "requests")
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	outbox, err := s.db.countByStatus(ctx, "outbox")
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	errs, err := s.db.listNotificationErrors(ctx, adminRecentErrs)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	queue, err := s.notifyQueue(ctx)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(errs))
+	for _, e := range errs {
+		out = append(out, e.view())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"requests":            requests,
+		"notifications":       outbox,
+		"notification_errors": out,
+		"notification_queue":  queue,
+	})
+}
+
+type adminData struct {
+	SignedIn bool
+	Error    string
+}
+
+func (s *server) renderAdmin(w http.ResponseWriter, status int, signedIn bool, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = adminTpl.Execute(w, adminData{SignedIn: signedIn, Error: errMsg})
+}
+
+var adminTpl = template.Must(template.New("admin").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1"/>
+  <title>Ask4Me admin</title>
+  <style>
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:1100px;margin:32px auto;padding:0 16px;color:#24292f;}
+    pre{white-space:pre-wrap;word-break:break-word;background:#f6f8fa;padding:8px;border-radius:8px;margin:4px 0;font-size:12px;}
+    .row{margin-top:16px;}
+    button{padding:8px 12px;border-radius:10px;border:1px solid #d0d7de;background:#fff;cursor:pointer;margin:6px 6px 0 0;}
+    button:hover{background:#f6f8fa;}
+    button.on{background:#24292f;color:#fff;}
+    input[type="password"]{width:100%;padding:10px;border:1px solid #d0d7de;border-radius:10px;box-sizing:border-box;}
+    .err{padding:12px;border:1px solid #d1242f;border-radius:10px;background:#ffebe9;}
+    .stats{display:flex;flex-wrap:wrap;gap:8px;}
+    .stat{border:1px solid #d0d7de;border-radius:10px;padding:8px 12px;font-size:14px;}
+    .stat b{display:block;font-size:20px;}
+    .cols{display:grid;grid-template-columns:1fr 1fr;gap:16px;}
+    @media (max-width:800px){.cols{grid-template-columns:1fr;}}
+    table{width:100%;border-collapse:collapse;font-size:14px;}
+    td,th{text-align:left;padding:6px;border-bottom:1px solid #eaeef2;vertical-align:top;}
+    tr.req{cursor:pointer;}
+    tr.req:hover,tr.sel{background:#f6f8fa;}
+    .muted{color:#57606a;font-size:13px;}
+    .ev{border-left:3px solid #d0d7de;padding:2px 10px;margin:8px 0;}
+    .ev.bad{border-color:#d1242f;}
+  </style>
+</head>
+<body>
+  <h1>Ask4Me admin</h1>
+  {{if .Error}}<div class="err">{{.Error}}</div>{{end}}
+  {{if not .SignedIn}}
+  <div class="row">
+    <form method="post" action="login">
+      <label>API key (admin scope)</label>
+      <div style="height:8px"></div>
+      <input type="password" name="key" autocomplete="off" autofocus/>
+      <div style="height:10px"></div>
+      <button type="submit">Sign in</button>
+    </form>
+  </div>
+  {{else}}
+  <form method="post" action="logout"><button type="submit">Sign out</button></form>
+  <div class="row stats" id="stats"></div>
+  <div class="row" id="errors"></div>
+  <div class="row" id="filters"></div>
+  <div class="row cols">
+    <div><table><thead><tr><th>Request</th><th>Status</th><th>Created</th></tr></thead><tbody id="list"></tbody></table>
+      <button id="more" hidden>Older</button></div>
+    <div id="detail" class="muted">Pick a request to see its timeline.</div>
+  </div>
+  <script>
+  (function(){
+    var statuses = ["", "created", "scheduled", "delivered", "submitted", "expired", "cancelled", "notify_failed"];
+    var filter = "", selected = "", before = 0;
+    function el(tag, text, cls){ var e = document.createElement(tag); if (text != null) e.textContent = text; if (cls) e.className = cls; return e; }
+    function when(t){ return t ? new Date(t).toLocaleString() : ""; }
+    function api(path, opts){
+      return fetch("api/" + path, Object.assign({credentials: "same-origin"}, opts || {})).then(function(res){
+        if (res.status === 401) { location.reload(); throw new Error("signed out"); }
+        return res.json().catch(function(){ return {}; }).then(function(body){ body._status = res.status; return body; });
+      });
+    }
+    function renderFilters(){
+      var box = document.getElementById("filters"); box.textContent = "";
+      statuses.forEach(function(st){
+        var b = el("button", st || "all", st === filter ? "on" : "");
+        b.onclick = function(){ filter = st; before = 0; renderFilters(); loadList(); };
+        box.appendChild(b);
+      });
+    }
+    function loadStats(){
+      api("stats").then(function(d){
+        var box = document.getElementById("stats"); box.textContent = "";
+        Object.keys(d.requests || {}).sort().forEach(function(k){
+          var s = el("div", k, "stat"); s.prepend(el("b", String(d.requests[k]))); box.appendChild(s);
+        });
+        Object.keys(d.notifications || {}).sort().forEach(function(k){
+          var s = el("div", "notify " + k, "stat"); s.prepend(el("b", String(d.notifications[k]))); box.appendChild(s);
+        });
+        var errs = document.getElementById("errors"); errs.textContent = "";
+        if ((d.notification_errors || []).length) {
+          errs.appendChild(el("h3", "Notification errors"));
+          d.notification_errors.forEach(function(n){
+            var e = el("div", null, "ev bad");
+            e.appendChild(el("div", n.request_id + " · " + n.status + " · " + n.attempts + " attempt(s) · " + when(n.updated_at), "muted"));
+            e.appendChild(el("div", n.last_error));
+            e.onclick = function(){ select(n.request_id); };
+            errs.appendChild(e);
+          });
+        }
+      });
+    }
+    function loadList(){
+      var q = "requests?limit=50" + (filter ? "&status=" + encodeURIComponent(filter) : "") + (before ? "&before=" + before : "");
+      api(q).then(function(d){
+        var body = document.getElementById("list");
+        if (!before) body.textContent = "";
+        (d.requests || []).forEach(function(r){
+          var tr = el("tr", null, "req" + (r.request_id === selected ? " sel" : ""));
+          var td = el("td"); td.appendChild(el("div", r.title || r.request_id)); td.appendChild(el("div", r.request_id, "muted"));
+          tr.appendChild(td); tr.appendChild(el("td", r.status)); tr.appendChild(el("td", when(r.created_at)));
+          tr.onclick = function(){ select(r.request_id); };
+          body.appendChild(tr);
+        });
+        var more = document.getElementById("more");
+        more.hidden = !d.next_before;
+        more.onclick = function(){ before = d.next_before; loadList(); };
+      });
+    }
+    function action(id, what){
+      api("requests/" + encodeURIComponent(id) + "/" + what, {method: "POST"}).then(function(d){
+        if (d._status >= 400) alert(d.error || ("failed: " + d._status));
+        refresh();
+      });
+    }
+    function select(id){ selected = id; loadDetail(); loadList(); }
+    function loadDetail(){
+      if (!selected) return;
+      var id = selected;
+      Promise.all([api("requests/" + encodeURIComponent(id)), api("requests/" + encodeURIComponent(id) + "/events")]).then(function(res){
+        if (id !== selected) return;
+        var r = res[0], evs = res[1].events || [];
+        var box = document.getElementById("detail"); box.className = ""; box.textContent = "";
+        box.appendChild(el("h2", r.title || id));
+        box.appendChild(el("div", id + " · " + r.status + " · expires " + when(r.expires_at), "muted"));
+        if (r.body) box.appendChild(el("pre", r.body));
+        if (r.answer) box.appendChild(el("div", "Answer: " + r.answer.action + (r.answer.text ? " — " + r.answer.text : "") + (r.answer.responder ? " (" + r.answer.responder + ")" : "")));
+        var n = r.notification;
+        if (n) box.appendChild(el("div", "Notification: " + n.status + ", " + n.attempts + " attempt(s)" + (n.last_error ? " — " + n.last_error : ""), n.last_error ? "err" : "muted"));
+        if (["submitted", "expired", "cancelled", "notify_failed"].indexOf(r.status) < 0) {
+          var c = el("button", "Cancel"); c.onclick = function(){ if (confirm("Cancel " + id + "?")) action(id, "cancel"); };
+          var rn = el("button", "Notify again"); rn.onclick = function(){ action(id, "notify"); };
+          box.appendChild(c); box.appendChild(rn);
+        }
+        box.appendChild(el("h3", "Timeline"));
+        evs.forEach(function(e){
+          var d = el("div", null, "ev" + (/failed$/.test(e.type) ? " bad" : ""));
+          d.appendChild(el("div", when(e.created_at) + " · " + e.type, "muted"));
+          if (e.data && Object.keys(e.data).length) d.appendChild(el("pre", JSON.stringify(e.data, null, 2)));
+          box.appendChild(d);
+        });
+      });
+    }
+    function refresh(){ loadStats(); if (!before) loadList(); loadDetail(); }
+    renderFilters(); refresh();
+    setInterval(function(){ if (!document.hidden) refresh(); }, 5000);
+  })();
+  </script>
+  {{end}}
+</body>
+</html>`))
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /v1/hooks/agent turns a coding agent's permission hook into an ask.
+// The hook command pipes the tool call the agent proposes to this endpoint,
+// e.g. for Claude Code (PreToolUse or PermissionRequest):
+//
+//	curl -s --data-binary @- -H "Authorization: Bearer $ASK4ME_API_KEY" https://ask.example.com/v1/hooks/agent
+//
+// The ask shows the command, diff or file content with the working
+// directory, and offers Allow and Deny plus a text reply: a new command for
+// Bash (allow, modified), otherwise a message to the agent (deny). The
+// request blocks until the answer and returns the decision in the hook's
+// response format. Query parameters: expires_in_seconds (default
+// agentHookDefaultExpiry), priority, and on_timeout=ask|deny for what to
+// answer when nobody decides (ask falls back to the agent's own prompt).
+
+const (
+	agentHookDefaultExpiry = 600
+	agentHookMaxShown      = 12000
+)
+
+// agentHookInput is the part of the hook payload that is used.
+type agentHookInput struct {
+	SessionID     string                     `json:"session_id"`
+	HookEventName string                     `json:"hook_event_name"`
+	Cwd           string                     `json:"cwd"`
+	ToolName      string                     `json:"tool_name"`
+	ToolInput     map[string]json.RawMessage `json:"tool_input"`
+	ToolUseID     string                     `json:"tool_use_id"`
+}
+
+func (h agentHookInput) str(key string) string {
+	var v string
+	_ = json.Unmarshal(h.ToolInput[key], &v)
+	return v
+}
+
+// agentHookRequestID derives the request ID from the tool call, so that a
+// retried hook waits for the same ask.
+func agentHookRequestID(h agentHookInput) string {
+	if h.ToolUseID == "" {
+		return genID("req_")
+	}
+	return "req_hook_" + sha256Hex(h.SessionID + "\x00" + h.ToolUseID)[:32]
+}
+
+// agentHookAsk builds the ask for a tool call.
+func agentHookAsk(h agentHookInput) askRequest {
+	var b strings.Builder
+	if h.Cwd != "" {
+		fmt.Fprintf(&b, "Directory: %s\n", h.Cwd)
+	}
+	fmt.Fprintf(&b, "Tool: %s\n\n", h.ToolName)
+	switch h.ToolName {
+	case "Bash":
+		fmt.Fprintf(&b, "$ %s\n", h.str("command"))
+		if d := h.str("description"); d != "" {
+			fmt.Fprintf(&b, "\n%s\n", d)
+		}
+	case "Edit":
+		fmt.Fprintf(&b, "File: %s\n\n", h.str("file_path"))
+		writeAgentHookDiff(&b, h.str("old_string"), h.str("new_string"))
+	case "MultiEdit":
+		fmt.Fprintf(&b, "File: %s\n", h.str("file_path"))
+		var edits []struct {
+			OldString string `json:"old_string"`
+			NewString string `json:"new_string"`
+		}
+		_ = json.Unmarshal(h.ToolInput["edits"], &edits)
+		for i, e := range edits {
+			fmt.Fprintf(&b, "\n@@ edit %d @@\n", i+1)
+			writeAgentHookDiff(&b, e.OldString, e.NewString)
+		}
+	case "Write":
+		fmt.Fprintf(&b, "File: %s\n\n", h.str("file_path"))
+		writeAgentHookDiff(&b, "", h.str("content"))
+	default:
+		in, _ := json.MarshalIndent(h.ToolInput, "", "  ")
+		b.Write(in)
+		b.WriteByte('\n')
+	}
+	body := b.String()
+	if len(body) > agentHookMaxShown {
+		body = truncate(body, agentHookMaxShown) + "\n… (truncated)"
+	}
+
+	label := "Or deny with a message to the agent"
+	submit := "Deny with message"
+	if h.ToolName == "Bash" {
+		label = "Or run this command instead"
+		submit = "Run instead"
+	}
+	title := "Allow " + h.ToolName
+	if h.Cwd != "" {
+		title += " in " + path.Base(strings.ReplaceAll(h.Cwd, `\`, "/"))
+	}
+	return askRequest{
+		Title: title + "?",
+		Body:  body,
+		MCD: ":::buttons\n- [Allow](allow)\n- [Deny](deny)\n:::\n\n" +
+			fmt.Sprintf(":::input name=\"text\" label=%q submit=%q\n:::", label, submit),
+	}
+}
+
+// writeAgentHookDiff writes before and after as removed and added lines.
+func writeAgentHookDiff(b *strings.Builder, before, after string) {
+	if before != "" {
+		for _, l := range strings.Split(strings.TrimSuffix(before, "\n"), "\n") {
+			b.WriteString("- " + l + "\n")
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(after, "\n"), "\n") {
+		b.WriteString("+ " + l + "\n")
+	}
+}
+
+// agentHookDecision is the outcome of the ask: "allow", "deny" or "" (no
+// answer), with the reason shown to the agent and the modified tool input.
+type agentHookDecision struct {
+	Behavior     string
+	Reason       string
+	UpdatedInput map[string]json.RawMessage
+}
+
+func agentHookDecide(h agentHookInput, ev Event, onTimeout string) agentHookDecision {
+	if ev.Type != "user.submitted" {
+		if onTimeout == "deny" {
+			return agentHookDecision{Behavior: "deny", Reason: "No answer in ask4me (" + ev.Type + ")."}
+		}
+		return agentHookDecision{}
+	}
+	var d struct {
+		Action    string `json:"action"`
+		Text      string `json:"text"`
+		Responder string `json:"responder"`
+	}
+	_ = json.Unmarshal(ev.Data, &d)
+	by := "in ask4me"
+	if d.Responder != "" {
+		by = "by " + d.Responder + " in ask4me"
+	}
+	text := strings.TrimSpace(d.Text)
+	switch {
+	case d.Action == "allow":
+		return agentHookDecision{Behavior: "allow", Reason: "Approved " + by + "."}
+	case d.Action == "deny":
+		return agentHookDecision{Behavior: "deny", Reason: "Denied " + by + "."}
+	case text != "" && h.ToolName == "Bash":
+		in := make(map[string]json.RawMessage, len(h.ToolInput))
+		for k, v := range h.ToolInput {
+			in[k] = v
+		}
+		in["command"], _ = json.Marshal(text)
+		return agentHookDecision{Behavior: "allow", Reason: "Command changed " + by + ".", UpdatedInput: in}
+	case text != "":
+		return agentHookDecision{Behavior: "deny", Reason: text}
+	}
+	return agentHookDecision{Behavior: "deny", Reason: "Denied " + by + "."}
+}
+
+// agentHookOutput renders d for the hook event that asked.
+func agentHookOutput(event string, d agentHookDecision) map[string]any {
+	if event == "PermissionRequest" {
+		if d.Behavior == "" {
+			// No decision: the agent shows its own permission dialog.
+			return map[string]any{}
+		}
+		decision := map[string]any{"behavior": d.Behavior}
+		if d.Behavior == "deny" {
+			decision["message"] = d.Reason
+		} else if d.UpdatedInput != nil {
+			decision["updatedInput"] = d.UpdatedInput
+		}
+		return map[string]any{"hookSpecificOutput": map[string]any{
+			"hookEventName": event,
+			"decision":      decision,
+		}}
+	}
+	out := map[string]any{
+		"hookEventName":            "PreToolUse",
+		"permissionDecision":       d.Behavior,
+		"permissionDecisionReason": d.Reason,
+	}
+	if d.Behavior == "" {
+		out["permissionDecision"] = "ask"
+		out["permissionDecisionReason"] = "No answer in ask4me."
+	}
+	if d.UpdatedInput != nil {
+		out["updatedInput"] = d.UpdatedInput
+	}
+	return map[string]any{"hookSpecificOutput": out}
+}
+
+func (s *server) handleAgentHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var h agentHookInput
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&h); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	h.ToolName = strings.TrimSpace(h.ToolName)
+	if h.ToolName == "" {
+		http.Error(w, "tool_name is required", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	onTimeout := q.Get("on_timeout")
+	if onTimeout != "" && onTimeout != "ask" && onTimeout != "deny" {
+		http.Error(w, "on_timeout must be ask or deny", http.StatusBadRequest)
+		return
+	}
+
+	requestID := agentHookRequestID(h)
+	_, _, err := s.db.getRequestStatus(ctx, requestID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		ar := agentHookAsk(h)
+		ar.ExpiresInSeconds = agentHookDefaultExpiry
+		if v, err := strconv.Atoi(q.Get("expires_in_seconds")); err == nil && v > 0 {
+			ar.ExpiresInSeconds = v
+		}
+		ar.Priority = q.Get("priority")
+		created, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
+		if dup, ok := duplicateOf(err); ok {
+			requestID = dup
+		} else if err != nil {
+			if isBadAskError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to create request", http.StatusInternalServerError)
+			return
+		} else {
+			s.startAsk(requestID, created)
+		}
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	ev, err := s.waitTerminalEvent(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, errServerStopping) {
+			writeStopping(w, requestID)
+			return
+		}
+		if ctx.Err() != nil {
+			// The agent gave up waiting; nobody will read an answer now.
+			s.cancelAgentHook(requestID)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Ask4Me-Request-Id", requestID)
+	writeJSON(w, http.StatusOK, agentHookOutput(h.HookEventName, agentHookDecide(h, ev, onTimeout)))
+}
+
+// cancelAgentHook closes an ask whose hook stopped waiting.
+func (s *server) cancelAgentHook(requestID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil || isTerminalStatus(status) {
+		return
+	}
+	if err := s.db.updateRequestStatus(ctx, requestID, "cancelled"); err != nil {
+		return
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.cancelled", map[string]any{
+		"previous_status": status,
+		"reason":          "the agent stopped waiting",
+	})
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Editing answers. A mistap on a phone should not have to stand: with
+// answer_edit_seconds set, the page of an answered ask offers "Edit answer"
+// for that long after the answer, until the asker acknowledges it (POST
+// /v1/requests/{id}/ack) or the ask expires. An edit replaces the stored
+// answer and is announced as user.answer_updated with the new and the
+// previous answer; the terminal user.submitted stays as it was, so askers
+// that act on edits follow the event stream or re-read GET
+// /v1/requests/{id}.
+//
+// Only buttons and text answers given on the page can be edited, by the link
+// that gave them; asks with steps, JSON Forms or collect and quorum
+// responders, and answers from other channels, a policy or default_action,
+// cannot.
+
+const maxAnswerEditSeconds = 3600
+
+const answerChangedMessage = "the answer was changed on another device; reload the page to see it"
+
+func (s *store) getAnswer(ctx context.Context, reqID string) (action, text, responder string, err error) {
+	var a, t, who sql.NullString
+	err = s.db.QueryRowContext(ctx, `SELECT action, text, responder FROM answers WHERE request_id=?`, reqID).Scan(&a, &t, &who)
+	return a.String, t.String, who.String, err
+}
+
+// updateAnswer replaces the answer prevAction/prevText. It reports false when
+// the stored answer is no longer that one.
+func (s *store) updateAnswer(ctx context.Context, reqID, prevAction, prevText, action, text string) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE answers SET action=?, text=?, payload_json=NULL
+		 WHERE request_id=? AND COALESCE(action,'')=? AND COALESCE(text,'')=?`,
+		action, text, reqID, prevAction, prevText,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, s.indexAnswer(ctx, reqID, action, text)
+}
+
+// answerEditUntil returns until when responder may still change the answer
+// to requestID, or false when they may not.
+func (s *server) answerEditUntil(ctx context.Context, requestID, responder string) (time.Time, bool) {
+	n := s.cfg().AnswerEditSeconds
+	if n <= 0 {
+		return time.Time{}, false
+	}
+	if mode, _, err := s.db.getRespondersMode(ctx, requestID); err != nil || isMultiAnswerMode(mode) {
+		return time.Time{}, false
+	}
+	if steps, _, err := s.db.getSteps(ctx, requestID); err != nil || len(steps) > 0 {
+		return time.Time{}, false
+	}
+	_, _, who, err := s.db.getAnswer(ctx, requestID)
+	if err != nil || who != responder {
+		return time.Time{}, false
+	}
+	submitted, ok, err := s.db.getLatestEventByTypes(ctx, requestID, []string{"user.submitted"})
+	if err != nil || !ok {
+		return time.Time{}, false
+	}
+	var d struct {
+		Payload    json.RawMessage `json:"payload"`
+		Via        string          `json:"via"`
+		AnsweredBy string          `json:"answered_by"`
+	}
+	if json.Unmarshal(submitted.Data, &d) != nil || d.Via != "" || d.AnsweredBy != "" || len(d.Payload) > 0 {
+		return time.Time{}, false
+	}
+	at, ok, err := s.db.firstEventAt(ctx, requestID, "user.submitted")
+	if err != nil || !ok {
+		return time.Time{}, false
+	}
+	until := time.Unix(at, 0).Add(time.Duration(n) * time.Second)
+	if time.Now().After(until) {
+		return time.Time{}, false
+	}
+	if _, acked, _ := s.db.getLatestEventByTypes(ctx, requestID, []string{"answer.acknowledged"}); acked {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// handleUserEdit serves POST /r/{id}/edit, which replaces the answer within
+// the edit window. The form and its CSRF token were checked by handleUser.
+func (s *server) handleUserEdit(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, status, responder string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	back := "./?k=" + url.QueryEscape(tokenPlain)
+	if status != "submitted" {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if _, ok := s.answerEditUntil(ctx, requestID, responder); !ok {
+		http.Error(w, "this answer can no longer be changed", http.StatusConflict)
+		return
+	}
+	action := strings.TrimSpace(r.FormValue("action"))
+	text := strings.TrimSpace(r.FormValue("text"))
+	if action == "" && text == "" {
+		http.Error(w, "empty submission", http.StatusBadRequest)
+		return
+	}
+	prevAction, prevText, _, err := s.db.getAnswer(ctx, requestID)
+	if err != nil {
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	if v := r.FormValue("version"); v != "" && v != answerVersion(prevAction, prevText) {
+		http.Error(w, answerChangedMessage, http.StatusConflict)
+		return
+	}
+	if action == prevAction && text == prevText {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	hook := s.checkAnswer(ctx, answerHookInput{
+		RequestID: requestID,
+		Action:    action,
+		Text:      text,
+		Responder: responder,
+		Via:       "page",
+	})
+	if hook.Reject != "" {
+		http.Redirect(w, r, back+"&rejected="+url.QueryEscape(truncate(hook.Reject, 500)), http.StatusSeeOther)
+		return
+	}
+	updated, err := s.db.updateAnswer(ctx, requestID, prevAction, prevText, action, text)
+	if err != nil {
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, answerChangedMessage, http.StatusConflict)
+		return
+	}
+	data := map[string]any{
+		"action": action,
+		"text":   text,
+		"previous": map[string]any{
+			"action": prevAction,
+			"text":   prevText,
+		},
+	}
+	if responder != "" {
+		data["responder"] = responder
+	}
+	if hook.Data != nil {
+		data["hook"] = hook.Data
+	}
+	ev := s.mustNewEvent(ctx, requestID, "user.answer_updated", data)
+	_ = s.persistTerminalAware(ctx, ev)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
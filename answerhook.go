@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Answer hooks let a deployment check answers with its own rules, e.g. "a
+// rejection needs a reason". answer_hook is either an http(s) URL, which gets
+// the answer POSTed as JSON (signed like callbacks when webhook_secret is
+// set), or a program, which gets it on stdin:
+//
+//	{"request_id": "...", "action": "...", "text": "...", "payload": ..., "responder": "...", "via": "page"}
+//
+// It answers with JSON on 2xx or stdout (an empty answer accepts):
+//
+//	{"reject": "Please say why."}   the answer is not saved; the page shows the
+//	                                message above the form, which keeps what
+//	                                was typed, and other channels reply with it
+//	{"data": {...}}                 the answer is saved with data as "hook" on
+//	                                user.submitted
+//
+// The hook runs on every submission, each step of a multi-step ask included.
+// A hook that fails, times out or answers something else is logged and the
+// answer is accepted, so a broken hook never blocks a person from answering.
+
+const answerHookTimeout = 10 * time.Second
+
+type answerHookInput struct {
+	RequestID string `json:"request_id"`
+	Action    string `json:"action"`
+	Text      string `json:"text"`
+	Payload   any    `json:"payload,omitempty"`
+	Responder string `json:"responder,omitempty"`
+	Via       string `json:"via"`
+}
+
+type answerHookResult struct {
+	Reject string         `json:"reject"`
+	Data   map[string]any `json:"data"`
+}
+
+// checkAnswer runs answer_hook, if one is configured, on in.
+func (s *server) checkAnswer(ctx context.Context, in answerHookInput) answerHookResult {
+	hook := strings.TrimSpace(s.cfg().AnswerHook)
+	if hook == "" {
+		return answerHookResult{}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return answerHookResult{}
+	}
+	ctx, cancel := context.WithTimeout(ctx, answerHookTimeout)
+	defer cancel()
+	var out []byte
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		out, err = s.postAnswerHook(ctx, hook, body)
+	} else {
+		cmd := exec.CommandContext(ctx, hook)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.WaitDelay = time.Second
+		out, err = cmd.Output()
+	}
+	var res answerHookResult
+	if err == nil && len(bytes.TrimSpace(out)) > 0 {
+		err = json.Unmarshal(out, &res)
+	}
+	if err != nil {
+		slog.Warn("answer hook", "request_id", in.RequestID, "error", err)
+		return answerHookResult{}
+	}
+	res.Reject = strings.TrimSpace(res.Reject)
+	return res
+}
+
+func (s *server) postAnswerHook(ctx context.Context, hookURL string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ask4me-answer-hook")
+	if secret := s.cfg().WebhookSecret; secret != "" {
+		req.Header.Set(signatureHeader, signPayload(secret, time.Now(), body))
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("answer hook answered %d", resp.StatusCode)
+	}
+	return out, nil
+}
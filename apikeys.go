@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API keys. api_key is the admin key and can do everything. Named keys come
+// from the `api_keys` config section (source "config", re-synced at startup
+// and read-only through the API) or from /v1/apikeys (source "api"). Only a
+// key's SHA-256 is stored. Each key has scopes and an optional per-minute
+// rate limit:
+//
+//   - ask: create asks and wait on them (/v1/ask), upload attachments for
+//     them, cancel or acknowledge requests, post custom events to them and
+//     rotate or revoke their links;
+//   - read: GET on the rest of the API;
+//   - admin: everything, including /v1/apikeys and the /v1/events/stream
+//     firehose.
+//
+// Keys without scopes get ask and read. A key with a tenant only sees that
+// tenant's requests; see tenants.go.
+
+const (
+	scopeAsk   = "ask"
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+
+	apiKeySourceConfig = "config"
+	apiKeySourceAPI    = "api"
+
+	// last_used_at is only refreshed this often, so auth does not write on
+	// every call.
+	apiKeyTouchInterval = time.Minute
+)
+
+var defaultAPIKeyScopes = []string{scopeAsk, scopeRead}
+
+// APIKeyConfig is one entry of the `api_keys` config section.
+type APIKeyConfig struct {
+	Name               string   `yaml:"name"`
+	Key                string   `yaml:"key"`
+	Scopes             []string `yaml:"scopes"`
+	RateLimitPerMinute int      `yaml:"rate_limit_per_minute"`
+	Tenant             string   `yaml:"tenant"`
+}
+
+type apiKey struct {
+	ID                 string
+	Name               string
+	Hash               string
+	Prefix             string
+	Scopes             []string
+	RateLimitPerMinute int
+	Tenant             string
+	Source             string
+	CreatedAt          int64
+	UpdatedAt          int64
+	LastUsedAt         int64
+}
+
+// rootAPIKey stands for api_key in rate limiting and logs.
+var rootAPIKey = apiKey{ID: "key_root", Name: "api_key", Scopes: []string{scopeAdmin}}
+
+func (k apiKey) allows(scope string) bool {
+	return slices.Contains(k.Scopes, scopeAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+func (k apiKey) view() map[string]any {
+	return map[string]any{
+		"key_id":                k.ID,
+		"name":                  k.Name,
+		"key_prefix":            k.Prefix,
+		"scopes":                k.Scopes,
+		"rate_limit_per_minute": k.RateLimitPerMinute,
+		"tenant":                nullIfEmpty(k.Tenant),
+		"source":                k.Source,
+		"created_at":            unixOrNil(k.CreatedAt),
+		"updated_at":            unixOrNil(k.UpdatedAt),
+		"last_used_at":          unixOrNil(k.LastUsedAt),
+	}
+}
+
+func isValidAPIKeyID(id string) bool {
+	if !strings.HasPrefix(id, "key_") || len(id) > 128 {
+		return false
+	}
+	return isValidRequestID("req_" + strings.TrimPrefix(id, "key_"))
+}
+
+// normalizeScopes validates scopes, dropping duplicates; none means the
+// default set.
+func normalizeScopes(in []string) ([]string, error) {
+	var out []string
+	for _, sc := range in {
+		sc = strings.ToLower(strings.TrimSpace(sc))
+		switch sc {
+		case scopeAsk, scopeRead, scopeAdmin:
+		default:
+			return nil, fmt.Errorf("unknown scope %q (want ask, read or admin)", sc)
+		}
+		if !slices.Contains(out, sc) {
+			out = append(out, sc)
+		}
+	}
+	if len(out) == 0 {
+		return slices.Clone(defaultAPIKeyScopes), nil
+	}
+	return out, nil
+}
+
+// apiKeyPrefix is the part of a key shown in listings to tell keys apart.
+// Short hand-written keys only show a third of their length.
+func apiKeyPrefix(key string) string {
+	return key[:min(8, len(key)/3)]
+}
+
+// requiredScope is the scope an API call needs.
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/v1/ask" || path == "/v1/hooks/agent" || path == "/v1/bundles" && r.Method == http.MethodPost:
+		return scopeAsk
+	case path == "/v1/apikeys" || strings.HasPrefix(path, "/v1/apikeys/") || path == "/v1/events/stream":
+		return scopeAdmin
+	case strings.HasPrefix(path, "/v1/requests/") && (strings.HasSuffix(path, "/cancel") || strings.HasSuffix(path, "/ack") ||
+		strings.HasSuffix(path, "/tokens/rotate") || strings.HasSuffix(path, "/tokens/revoke")):
+		return scopeAsk
+	case strings.HasPrefix(path, "/v1/requests/") && strings.HasSuffix(path, "/events") && r.Method == http.MethodPost:
+		return scopeAsk
+	case path == "/v1/attachments" && r.Method == http.MethodPost:
+		return scopeAsk
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return scopeRead
+	}
+	return scopeAdmin
+}
+
+const apiKeyColumns = `key_id, name, key_hash, key_prefix, scopes, rate_limit_per_minute, tenant, source, created_at, updated_at, last_used_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (apiKey, error) {
+	var k apiKey
+	var scopes string
+	var tenant sql.NullString
+	var lastUsed sql.NullInt64
+	if err := row.Scan(&k.ID, &k.Name, &k.Hash, &k.Prefix, &scopes, &k.RateLimitPerMinute, &tenant, &k.Source, &k.CreatedAt, &k.UpdatedAt, &lastUsed); err != nil {
+		return apiKey{}, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	k.Tenant = tenant.String
+	k.LastUsedAt = lastUsed.Int64
+	return k, nil
+}
+
+func (s *store) upsertAPIKey(ctx context.Context, k apiKey) error {
+	now := time.Now().Unix()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO api_keys(key_id,name,key_hash,key_prefix,scopes,rate_limit_per_minute,tenant,source,created_at,updated_at)
+		 VALUES(?,?,?,?,?,?,?,?,?,?)
+		 ON CONFLICT(key_id) DO UPDATE SET name=excluded.name, key_hash=excluded.key_hash, key_prefix=excluded.key_prefix,
+		   scopes=excluded.scopes, rate_limit_per_minute=excluded.rate_limit_per_minute, tenant=excluded.tenant,
+		   source=excluded.source, updated_at=excluded.updated_at`,
+		k.ID, k.Name, k.Hash, k.Prefix, strings.Join(k.Scopes, ","), k.RateLimitPerMinute, nullIfEmpty(k.Tenant), k.Source, now, now,
+	)
+	return err
+}
+
+func (s *store) getAPIKey(ctx context.Context, id string) (apiKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE key_id=?`, id))
+}
+
+func (s *store) getAPIKeyByHash(ctx context.Context, hash string) (apiKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash=?`, hash))
+}
+
+func (s *store) listAPIKeys(ctx context.Context) ([]apiKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at ASC, key_id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []apiKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) deleteAPIKey(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM api_keys WHERE key_id=?`, id)
+	return err
+}
+
+func (s *store) deleteConfigAPIKeysExcept(ctx context.Context, keep []string) error {
+	keys, err := s.listAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Source == apiKeySourceConfig && !slices.Contains(keep, k.ID) {
+			if err := s.deleteAPIKey(ctx, k.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *store) touchAPIKey(ctx context.Context, id string, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at=? WHERE key_id=?`, now.Unix(), id)
+	return err
+}
+
+// syncConfigAPIKeys mirrors the api_keys config section into the database.
+func (s *server) syncConfigAPIKeys(ctx context.Context) error {
+	keep := make([]string, 0, len(s.cfg().APIKeys))
+	for _, kc := range s.cfg().APIKeys {
+		id := "key_" + strings.ToLower(kc.Name)
+		k := apiKey{
+			ID:                 id,
+			Name:               kc.Name,
+			Hash:               sha256Hex(kc.Key),
+			Prefix:             apiKeyPrefix(kc.Key),
+			Scopes:             kc.Scopes,
+			RateLimitPerMinute: kc.RateLimitPerMinute,
+			Tenant:             kc.Tenant,
+			Source:             apiKeySourceConfig,
+		}
+		if err := s.db.upsertAPIKey(ctx, k); err != nil {
+			if isUniqueViolation(err) {
+				return fmt.Errorf("api_keys %q: key is already used by another key", kc.Name)
+			}
+			return err
+		}
+		keep = append(keep, id)
+	}
+	return s.db.deleteConfigAPIKeysExcept(ctx, keep)
+}
+
+// validateAPIKeyConfigs checks the api_keys config section and normalizes
+// names and scopes in place.
+func validateAPIKeyConfigs(c *Config) error {
+	seen := map[string]struct{}{}
+	for i := range c.APIKeys {
+		k := &c.APIKeys[i]
+		k.Name = strings.TrimSpace(k.Name)
+		k.Key = strings.TrimSpace(k.Key)
+		if k.Name == "" || !isValidAPIKeyID("key_"+strings.ToLower(k.Name)) {
+			return fmt.Errorf("api_keys %q: name must use only letters, digits and _", k.Name)
+		}
+		if _, dup := seen[strings.ToLower(k.Name)]; dup {
+			return fmt.Errorf("api_keys: duplicate name %q", k.Name)
+		}
+		seen[strings.ToLower(k.Name)] = struct{}{}
+		if k.Key == "" {
+			return fmt.Errorf("api_keys %q: key is required", k.Name)
+		}
+		if k.Key == c.APIKey {
+			return fmt.Errorf("api_keys %q: key must differ from api_key", k.Name)
+		}
+		if k.RateLimitPerMinute < 0 {
+			return fmt.Errorf("api_keys %q: rate_limit_per_minute must not be negative", k.Name)
+		}
+		scopes, err := normalizeScopes(k.Scopes)
+		if err != nil {
+			return fmt.Errorf("api_keys %q: %w", k.Name, err)
+		}
+		k.Scopes = scopes
+		k.Tenant = strings.ToLower(strings.TrimSpace(k.Tenant))
+		if err := c.checkKeyTenant(k.Tenant, k.Scopes); err != nil {
+			return fmt.Errorf("api_keys %q: %w", k.Name, err)
+		}
+	}
+	return nil
+}
+
+// lookupAPIKey resolves a presented key. ok=false means it is unknown.
+func (s *server) lookupAPIKey(ctx context.Context, presented string) (apiKey, bool, error) {
+	if presented == "" {
+		return apiKey{}, false, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(s.cfg().APIKey)) == 1 {
+		return rootAPIKey, true, nil
+	}
+	k, err := s.db.getAPIKeyByHash(ctx, sha256Hex(presented))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apiKey{}, false, nil
+		}
+		return apiKey{}, false, err
+	}
+	now := time.Now()
+	if now.Unix()-k.LastUsedAt >= int64(apiKeyTouchInterval/time.Second) {
+		_ = s.db.touchAPIKey(ctx, k.ID, now)
+	}
+	return k, true, nil
+}
+
+// handleAPIKeys serves /v1/apikeys.
+func (s *server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/apikeys"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListAPIKeys(w, r)
+		case http.MethodPost:
+			s.handleCreateAPIKey(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if !isValidAPIKeyID(id) {
+		http.Error(w, "invalid key_id", http.StatusBadRequest)
+		return
+	}
+	k, err := s.db.getAPIKey(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, k.view())
+	case http.MethodPatch, http.MethodDelete:
+		if k.Source == apiKeySourceConfig {
+			http.Error(w, "key is managed by the config file", http.StatusConflict)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err := s.db.deleteAPIKey(r.Context(), id); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.saveAPIKey(w, r, k, "", http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	list, err := s.db.listAPIKeys(r.Context())
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, k := range list {
+		out = append(out, k.view())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"api_keys": out})
+}
+
+// handleCreateAPIKey generates the key; its plain value is only returned in
+// this response.
+func (s *server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	plain := "ak_" + strings.ToLower(genToken())
+	k := apiKey{
+		ID:     genID("key_"),
+		Hash:   sha256Hex(plain),
+		Prefix: apiKeyPrefix(plain),
+		Scopes: slices.Clone(defaultAPIKeyScopes),
+		Source: apiKeySourceAPI,
+	}
+	s.saveAPIKey(w, r, k, plain, http.StatusCreated)
+}
+
+type apiKeyInput struct {
+	Name               *string  `json:"name"`
+	Scopes             []string `json:"scopes"`
+	RateLimitPerMinute *int     `json:"rate_limit_per_minute"`
+	Tenant             *string  `json:"tenant"`
+}
+
+func (s *server) saveAPIKey(w http.ResponseWriter, r *http.Request, k apiKey, plain string, status int) {
+	var in apiKeyInput
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil || json.Unmarshal(b, &in) != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if in.Name != nil {
+		k.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Scopes != nil {
+		scopes, err := normalizeScopes(in.Scopes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		k.Scopes = scopes
+	}
+	if in.RateLimitPerMinute != nil {
+		k.RateLimitPerMinute = *in.RateLimitPerMinute
+	}
+	if in.Tenant != nil {
+		k.Tenant = strings.ToLower(strings.TrimSpace(*in.Tenant))
+	}
+	if k.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if k.RateLimitPerMinute < 0 {
+		http.Error(w, "rate_limit_per_minute must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := s.cfg().checkKeyTenant(k.Tenant, k.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.db.upsertAPIKey(r.Context(), k); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	saved, err := s.db.getAPIKey(r.Context(), k.ID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := saved.view()
+	if plain != "" {
+		out["key"] = plain
+	}
+	writeJSON(w, status, out)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// approvalPolicy decides quorum-mode requests. A vote is the action a
+// responder submitted; votes equal to ApproveAction count as approvals and
+// every other vote counts as a rejection.
+//
+// The request is approved once Required approvals are in, and rejected once
+// RejectRequired rejections are in (when set) or once approval can no longer
+// be reached with the remaining responders.
+type approvalPolicy struct {
+	Required       int    `json:"required"`
+	ApproveAction  string `json:"approve_action"`
+	RejectRequired int    `json:"reject_required,omitempty"`
+}
+
+func (p *approvalPolicy) normalize(responders int) error {
+	p.ApproveAction = strings.TrimSpace(p.ApproveAction)
+	if p.ApproveAction == "" {
+		p.ApproveAction = "approve"
+	}
+	if p.Required <= 0 {
+		p.Required = responders/2 + 1
+	}
+	if p.Required > responders {
+		return badAskError("responders.approval.required exceeds the number of responders")
+	}
+	if p.RejectRequired < 0 || p.RejectRequired > responders {
+		return badAskError("responders.approval.reject_required is out of range")
+	}
+	return nil
+}
+
+// evaluate returns the outcome ("approved" or "rejected") once the vote is
+// decided.
+func (p approvalPolicy) evaluate(votes []responseRecord, responders int) (string, bool) {
+	approvals, rejections := p.count(votes)
+	if approvals >= p.Required {
+		return "approved", true
+	}
+	if p.RejectRequired > 0 && rejections >= p.RejectRequired {
+		return "rejected", true
+	}
+	if approvals+(responders-len(votes)) < p.Required {
+		return "rejected", true
+	}
+	return "", false
+}
+
+func (p approvalPolicy) count(votes []responseRecord) (approvals, rejections int) {
+	for _, v := range votes {
+		if v.Action == p.ApproveAction {
+			approvals++
+		} else {
+			rejections++
+		}
+	}
+	return approvals, rejections
+}
+
+// summary is merged into the request.completed payload of quorum requests.
+func (p approvalPolicy) summary(outcome string, votes []responseRecord, responders int) map[string]any {
+	approvals, rejections := p.count(votes)
+	tally := map[string]int{}
+	voters := make([]map[string]any, 0, len(votes))
+	for _, v := range votes {
+		tally[v.Action]++
+		voters = append(voters, map[string]any{
+			"responder": v.Responder,
+			"action":    v.Action,
+			"approve":   v.Action == p.ApproveAction,
+		})
+	}
+	sort.Slice(voters, func(i, j int) bool {
+		return voters[i]["responder"].(string) < voters[j]["responder"].(string)
+	})
+	return map[string]any{
+		"outcome":    outcome,
+		"policy":     p,
+		"approvals":  approvals,
+		"rejections": rejections,
+		"pending":    responders - len(votes),
+		"tally":      tally,
+		"voters":     voters,
+	}
+}
+
+func (s *store) getApprovalPolicy(ctx context.Context, reqID string) (approvalPolicy, error) {
+	var raw sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT approval_json FROM requests WHERE request_id=?`, reqID).Scan(&raw); err != nil {
+		return approvalPolicy{}, err
+	}
+	if !raw.Valid || strings.TrimSpace(raw.String) == "" {
+		return approvalPolicy{}, errors.New("request has no approval policy")
+	}
+	var p approvalPolicy
+	if err := json.Unmarshal([]byte(raw.String), &p); err != nil {
+		return approvalPolicy{}, err
+	}
+	return p, nil
+}
+
+func (s *store) countResponders(ctx context.Context, reqID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM tokens WHERE request_id=? AND responder IS NOT NULL`, reqID).Scan(&n)
+	return n, err
+}
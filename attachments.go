@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Attachments are files attached to an ask (uploaded through /v1/attachments
+// and referenced by id in the ask) or to an answer (uploaded on the
+// interaction page when the ask sets allow_uploads). Bytes live in the
+// configured blobStore; the attachments table holds the metadata and ties
+// each file to its request so retention removes both together.
+
+const (
+	attachmentKindAsk    = "ask"
+	attachmentKindAnswer = "answer"
+
+	defaultAttachmentsMaxBytes = 10 << 20
+	maxAttachmentsPerAsk       = 20
+	// Uploads never referenced by an ask are dropped after this long.
+	pendingAttachmentTTL = 24 * time.Hour
+)
+
+type attachment struct {
+	ID          string
+	RequestID   string
+	Kind        string
+	Name        string
+	ContentType string
+	Size        int64
+	StorageKey  string
+	Responder   string
+	CreatedAt   int64
+}
+
+func isValidAttachmentID(id string) bool {
+	if !strings.HasPrefix(id, "att_") || len(id) > 64 {
+		return false
+	}
+	for i := len("att_"); i < len(id); i++ {
+		c := id[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// view renders the attachment for API responses and events. url is the
+// authenticated API download link.
+func (a attachment) view(baseURL string) map[string]any {
+	return map[string]any{
+		"attachment_id": a.ID,
+		"request_id":    nullIfEmpty(a.RequestID),
+		"kind":          a.Kind,
+		"name":          a.Name,
+		"content_type":  a.ContentType,
+		"size":          a.Size,
+		"responder":     nullIfEmpty(a.Responder),
+		"created_at":    unixOrNil(a.CreatedAt),
+		"url":           strings.TrimRight(baseURL, "/") + "/v1/attachments/" + a.ID,
+	}
+}
+
+func attachmentViews(list []attachment, baseURL string) []map[string]any {
+	out := make([]map[string]any, 0, len(list))
+	for _, a := range list {
+		out = append(out, a.view(baseURL))
+	}
+	return out
+}
+
+const attachmentColumns = `attachment_id, request_id, kind, name, content_type, size, storage_key, responder, created_at`
+
+func scanAttachment(row interface{ Scan(...any) error }) (attachment, error) {
+	var a attachment
+	var requestID, responder sql.NullString
+	if err := row.Scan(&a.ID, &requestID, &a.Kind, &a.Name, &a.ContentType, &a.Size, &a.StorageKey, &responder, &a.CreatedAt); err != nil {
+		return attachment{}, err
+	}
+	a.RequestID = requestID.String
+	a.Responder = responder.String
+	return a, nil
+}
+
+func (s *store) insertAttachment(ctx context.Context, a attachment) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO attachments(`+attachmentColumns+`) VALUES(?,?,?,?,?,?,?,?,?)`,
+		a.ID, nullIfEmpty(a.RequestID), a.Kind, a.Name, a.ContentType, a.Size, a.StorageKey, nullIfEmpty(a.Responder), a.CreatedAt,
+	)
+	return err
+}
+
+func (s *store) getAttachment(ctx context.Context, id string) (attachment, error) {
+	return scanAttachment(s.db.QueryRowContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE attachment_id=?`, id))
+}
+
+func (s *store) queryAttachments(ctx context.Context, query string, args ...any) ([]attachment, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) listAttachments(ctx context.Context, reqID string) ([]attachment, error) {
+	return s.queryAttachments(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE request_id=? ORDER BY created_at ASC, attachment_id ASC`, reqID)
+}
+
+// listAttachmentsFor returns the attachments of several requests at once.
+func (s *store) listAttachmentsFor(ctx context.Context, ids []string) ([]attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	return s.queryAttachments(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE request_id IN (`+placeholders+`)`, args...)
+}
+
+// listPendingAttachments returns uploads created before cutoff that no ask
+// ever referenced.
+func (s *store) listPendingAttachments(ctx context.Context, cutoff int64, limit int) ([]attachment, error) {
+	return s.queryAttachments(ctx,
+		`SELECT `+attachmentColumns+` FROM attachments WHERE request_id IS NULL AND created_at<? ORDER BY created_at ASC LIMIT ?`,
+		cutoff, limit,
+	)
+}
+
+// linkAttachment ties a pending upload to reqID. It reports false when the
+// upload is gone or already belongs to a request.
+func (s *store) linkAttachment(ctx context.Context, reqID, id string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE attachments SET request_id=? WHERE attachment_id=? AND request_id IS NULL`, reqID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *store) deleteAttachment(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM attachments WHERE attachment_id=?`, id)
+	return err
+}
+
+func (s *store) getAllowUploads(ctx context.Context, reqID string) (bool, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT allow_uploads FROM requests WHERE request_id=?`, reqID).Scan(&v); err != nil {
+		return false, err
+	}
+	return v.Int64 != 0, nil
+}
+
+// validateAttachments checks the attachment options of an ask before the
+// request is created.
+func (s *server) validateAttachments(ctx context.Context, ar *askRequest) error {
+	if len(ar.Attachments) == 0 && !ar.AllowUploads {
+		return nil
+	}
+	if s.blobs == nil {
+		return badAskError("attachments are disabled on this server (set attachments_driver)")
+	}
+	if ar.AllowUploads {
+		if len(ar.Steps) > 0 {
+			return badAskError("allow_uploads cannot be combined with steps")
+		}
+		if ar.JsonForms != nil && len(strings.TrimSpace(string(ar.JsonForms.Schema))) > 0 {
+			return badAskError("allow_uploads cannot be combined with jsonforms")
+		}
+	}
+	if len(ar.Attachments) > maxAttachmentsPerAsk {
+		return badAskError(fmt.Sprintf("at most %d attachments per ask", maxAttachmentsPerAsk))
+	}
+	seen := map[string]struct{}{}
+	for i, id := range ar.Attachments {
+		id = strings.TrimSpace(id)
+		ar.Attachments[i] = id
+		if _, dup := seen[id]; dup {
+			return badAskError("duplicate attachment " + id)
+		}
+		seen[id] = struct{}{}
+		if !isValidAttachmentID(id) {
+			return badAskError("invalid attachment id " + id)
+		}
+		a, err := s.db.getAttachment(ctx, id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return badAskError("unknown attachment " + id)
+			}
+			return err
+		}
+		if a.RequestID != "" || a.Kind != attachmentKindAsk {
+			return badAskError("attachment " + id + " is already in use")
+		}
+	}
+	return nil
+}
+
+// attachToRequest links the ask's uploads to requestID and returns them.
+func (s *server) attachToRequest(ctx context.Context, requestID string, ids []string) ([]attachment, error) {
+	out := make([]attachment, 0, len(ids))
+	for _, id := range ids {
+		ok, err := s.db.linkAttachment(ctx, requestID, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, badAskError("attachment " + id + " is already in use")
+		}
+		a, err := s.db.getAttachment(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// storeUpload writes one uploaded file to the blob store and records it.
+func (s *server) storeUpload(ctx context.Context, fh *multipart.FileHeader, kind, requestID, responder string) (attachment, error) {
+	if fh.Size > s.cfg().AttachmentsMaxBytes {
+		return attachment{}, errAttachmentTooLarge
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return attachment{}, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, s.cfg().AttachmentsMaxBytes+1))
+	if err != nil {
+		return attachment{}, err
+	}
+	if int64(len(data)) > s.cfg().AttachmentsMaxBytes {
+		return attachment{}, errAttachmentTooLarge
+	}
+	contentType := strings.TrimSpace(fh.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(data)
+	}
+	name := path.Base(strings.ReplaceAll(strings.TrimSpace(fh.Filename), `\`, "/"))
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	a := attachment{
+		ID:          genID("att_"),
+		RequestID:   requestID,
+		Kind:        kind,
+		Name:        truncate(name, 200),
+		ContentType: truncate(contentType, 200),
+		Size:        int64(len(data)),
+		Responder:   responder,
+		CreatedAt:   time.Now().Unix(),
+	}
+	a.StorageKey = "attachments/" + a.ID
+	if err := s.blobs.put(ctx, a.StorageKey, data, a.ContentType); err != nil {
+		return attachment{}, fmt.Errorf("store attachment: %w", err)
+	}
+	if err := s.db.insertAttachment(ctx, a); err != nil {
+		_ = s.blobs.remove(ctx, a.StorageKey)
+		return attachment{}, err
+	}
+	return a, nil
+}
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// parseSubmitForm parses an answer form; multipart bodies (answers with
+// files) are capped at attachments_max_bytes per file.
+func (s *server) parseSubmitForm(w http.ResponseWriter, r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.ParseForm()
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentsPerAsk*s.cfg().AttachmentsMaxBytes+1<<20)
+	return r.ParseMultipartForm(1 << 20)
+}
+
+func uploadedFiles(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	var out []*multipart.FileHeader
+	for _, fh := range r.MultipartForm.File["file"] {
+		if fh.Filename != "" || fh.Size > 0 {
+			out = append(out, fh)
+		}
+	}
+	return out
+}
+
+// storeAnswerUploads saves the files submitted with an answer.
+func (s *server) storeAnswerUploads(ctx context.Context, requestID, responder string, files []*multipart.FileHeader) ([]attachment, error) {
+	if len(files) > maxAttachmentsPerAsk {
+		return nil, fmt.Errorf("at most %d files", maxAttachmentsPerAsk)
+	}
+	out := make([]attachment, 0, len(files))
+	for _, fh := range files {
+		a, err := s.storeUpload(ctx, fh, attachmentKindAnswer, requestID, responder)
+		if err != nil {
+			s.discardAttachments(ctx, out)
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// discardAttachments removes attachments and their blobs, e.g. the files of
+// an answer that lost the race against another one.
+func (s *server) discardAttachments(ctx context.Context, list []attachment) {
+	for _, a := range list {
+		if err := s.blobs.remove(ctx, a.StorageKey); err != nil {
+			slog.Error("attachments: remove", "attachment_id", a.ID, "error", err)
+			continue
+		}
+		_ = s.db.deleteAttachment(ctx, a.ID)
+	}
+}
+
+// removeRequestBlobs deletes the stored files of requests about to be
+// removed. Rows go with the requests themselves.
+func (s *server) removeRequestBlobs(ctx context.Context, ids []string) error {
+	if s.blobs == nil {
+		return nil
+	}
+	list, err := s.db.listAttachmentsFor(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		if err := s.blobs.remove(ctx, a.StorageKey); err != nil {
+			return fmt.Errorf("remove attachment %s: %w", a.ID, err)
+		}
+	}
+	return nil
+}
+
+// prunePendingAttachments drops uploads that no ask picked up in time.
+func (s *server) prunePendingAttachments(ctx context.Context) int {
+	if s.blobs == nil {
+		return 0
+	}
+	cutoff := time.Now().Add(-pendingAttachmentTTL).Unix()
+	list, err := s.db.listPendingAttachments(ctx, cutoff, retentionBatchSize)
+	if err != nil {
+		slog.Error("retention: list pending attachments", "error", err)
+		return 0
+	}
+	s.discardAttachments(ctx, list)
+	return len(list)
+}
+
+// serveAttachment sends the file, redirecting to a presigned URL when the
+// blob store offers one. Only images are shown inline; everything else is a
+// download so uploaded HTML never runs on this origin.
+func (s *server) serveAttachment(w http.ResponseWriter, r *http.Request, a attachment) {
+	dispositionType := "attachment"
+	if strings.HasPrefix(a.ContentType, "image/") && a.ContentType != "image/svg+xml" {
+		dispositionType = "inline"
+	}
+	disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": a.Name})
+	if disposition == "" {
+		disposition = dispositionType
+	}
+	if u, ok := s.blobs.presignGet(a.StorageKey, disposition); ok {
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+	rc, err := s.blobs.open(r.Context(), a.StorageKey)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Length", fmt.Sprint(a.Size))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	_, _ = io.Copy(w, rc)
+}
+
+// handleAttachments serves the authenticated /v1/attachments routes:
+// POST uploads one file (multipart field "file"), GET /{id} downloads and
+// DELETE /{id} removes an upload.
+func (s *server) handleAttachments(w http.ResponseWriter, r *http.Request) {
+	if s.blobs == nil {
+		http.Error(w, "attachments are disabled", http.StatusNotFound)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/attachments"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleUploadAttachment(w, r)
+		return
+	}
+	if !isValidAttachmentID(id) {
+		http.Error(w, "invalid attachment_id", http.StatusBadRequest)
+		return
+	}
+	a, err := s.db.getAttachment(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if ok, err := s.visible(r.Context(), a.RequestID); err != nil || !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if parseBoolQuery(r.URL.Query().Get("meta")) {
+			writeJSON(w, http.StatusOK, a.view(s.cfg().BaseURL))
+			return
+		}
+		s.serveAttachment(w, r, a)
+	case http.MethodDelete:
+		if err := s.blobs.remove(r.Context(), a.StorageKey); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.deleteAttachment(r.Context(), a.ID); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg().AttachmentsMaxBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, errAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "expected multipart/form-data with a file field", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := uploadedFiles(r)
+	if len(files) != 1 {
+		http.Error(w, "expected exactly one file field", http.StatusBadRequest)
+		return
+	}
+	a, err := s.storeUpload(r.Context(), files[0], attachmentKindAsk, "", "")
+	if err != nil {
+		if errors.Is(err, errAttachmentTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.Error("attachments: upload", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, a.view(s.cfg().BaseURL))
+}
+
+// handleUserAttachment serves /r/{id}/attachments/{att}: responders download
+// the files of the request they hold a token for.
+func (s *server) handleUserAttachment(w http.ResponseWriter, r *http.Request, requestID, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.blobs == nil || !isValidAttachmentID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := s.db.getAttachment(r.Context(), id)
+	if err != nil || a.RequestID != requestID {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveAttachment(w, r, a)
+}
+
+// pageAttachments lists the ask's files for the interaction page.
+func (s *server) pageAttachments(ctx context.Context, requestID, token string) []attachmentLink {
+	if s.blobs == nil {
+		return nil
+	}
+	list, err := s.db.listAttachments(ctx, requestID)
+	if err != nil {
+		return nil
+	}
+	var out []attachmentLink
+	for _, a := range list {
+		if a.Kind != attachmentKindAsk {
+			continue
+		}
+		out = append(out, attachmentLink{
+			Name: a.Name,
+			URL:  "./attachments/" + a.ID + "?k=" + url.QueryEscape(token),
+			Size: formatByteSize(a.Size),
+		})
+	}
+	return out
+}
+
+type attachmentLink struct {
+	Name string
+	URL  string
+	Size string
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// Answer attribution. An approval is worth more in an audit trail when it
+// says who gave it. Named links already do: the contact or responder a link
+// was made for is the answer's responder. For a link that was shared instead,
+// an ask with ask_name asks the person answering for their name, which the
+// page remembers in the browser for the next ask. The name is stored with
+// the answer and reported as responder_name in user.submitted, in
+// GET /v1/requests/{id} and on the finished page; on a named link it is the
+// responder's name.
+//
+// The name is what the person typed, not a verified identity; use named
+// responders (to, responders) where that matters.
+
+const maxResponderNameLen = 100
+
+const errResponderNameRequired = "Please enter your name."
+
+func (s *store) getAskName(ctx context.Context, reqID string) (bool, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT ask_name FROM requests WHERE request_id=?`, reqID).Scan(&v); err != nil {
+		return false, err
+	}
+	return v.Int64 != 0, nil
+}
+
+func (s *store) setResponderName(ctx context.Context, reqID, name string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE answers SET responder_name=? WHERE request_id=?`, nullIfEmpty(name), reqID)
+	return err
+}
+
+// responderName returns the name to attribute a page answer to: the
+// responder of a named link, or the name typed into the page when the ask
+// has ask_name. ok=false means the ask wants a name and none was given.
+func (s *server) responderName(r *http.Request, requestID, responder string) (name string, ok bool) {
+	if responder != "" {
+		return responder, true
+	}
+	if asked, _ := s.db.getAskName(r.Context(), requestID); !asked {
+		return "", true
+	}
+	name = strings.Join(strings.Fields(r.FormValue("responder_name")), " ")
+	if rs := []rune(name); len(rs) > maxResponderNameLen {
+		name = string(rs[:maxResponderNameLen])
+	}
+	return name, name != ""
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blob stores hold attachment bytes: a local directory, or an S3-compatible
+// bucket (AWS S3, MinIO, R2, ...) that serves downloads via presigned URLs.
+
+const (
+	attachmentsDriverLocal = "local"
+	attachmentsDriverS3    = "s3"
+)
+
+type blobStore interface {
+	put(ctx context.Context, key string, data []byte, contentType string) error
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+	remove(ctx context.Context, key string) error
+	// presignGet returns a time-limited direct download URL, or ok=false when
+	// the server has to stream the blob itself.
+	presignGet(key, disposition string) (u string, ok bool)
+}
+
+func newBlobStore(cfg Config) (blobStore, error) {
+	switch cfg.AttachmentsDriver {
+	case "":
+		return nil, nil
+	case attachmentsDriverLocal:
+		if err := os.MkdirAll(cfg.AttachmentsDir, 0o700); err != nil {
+			return nil, fmt.Errorf("attachments_dir: %w", err)
+		}
+		return localBlobStore{dir: cfg.AttachmentsDir}, nil
+	case attachmentsDriverS3:
+		return newS3BlobStore(cfg)
+	}
+	return nil, fmt.Errorf("unknown attachments_driver %q (want local or s3)", cfg.AttachmentsDriver)
+}
+
+type localBlobStore struct {
+	dir string
+}
+
+func (b localBlobStore) path(key string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(key))
+}
+
+func (b localBlobStore) put(_ context.Context, key string, data []byte, _ string) error {
+	p := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (b localBlobStore) open(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(b.path(key))
+}
+
+func (b localBlobStore) remove(_ context.Context, key string) error {
+	if err := os.Remove(b.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (localBlobStore) presignGet(string, string) (string, bool) { return "", false }
+
+// s3BlobStore speaks the small part of the S3 API attachments need, signed
+// with AWS Signature Version 4.
+type s3BlobStore struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	presignTTL time.Duration
+	client     *http.Client
+}
+
+func newS3BlobStore(cfg Config) (*s3BlobStore, error) {
+	if cfg.S3Bucket == "" || cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "" {
+		return nil, errors.New("s3_bucket, s3_access_key_id and s3_secret_access_key are required for attachments_driver s3")
+	}
+	endpoint := cfg.S3Endpoint
+	pathStyle := cfg.S3PathStyle
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.S3Region + ".amazonaws.com"
+	} else if !strings.Contains(endpoint, "amazonaws.com") {
+		// Self-hosted stores (MinIO, ...) rarely have wildcard DNS for buckets.
+		pathStyle = true
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3_endpoint %q", endpoint)
+	}
+	return &s3BlobStore{
+		endpoint:   u,
+		region:     cfg.S3Region,
+		bucket:     cfg.S3Bucket,
+		accessKey:  cfg.S3AccessKeyID,
+		secretKey:  cfg.S3SecretAccessKey,
+		pathStyle:  pathStyle,
+		presignTTL: time.Duration(cfg.S3PresignSeconds) * time.Second,
+		client:     &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (b *s3BlobStore) objectURL(key string) *url.URL {
+	u := *b.endpoint
+	if b.pathStyle {
+		u.Path = u.Path + "/" + b.bucket + "/" + key
+	} else {
+		u.Host = b.bucket + "." + u.Host
+		u.Path = u.Path + "/" + key
+	}
+	return &u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func (b *s3BlobStore) signature(date, stringToSign string) string {
+	k := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	k = hmacSHA256(k, b.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(k, stringToSign))
+}
+
+func (b *s3BlobStore) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	u := b.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := method + "\n" + u.EscapedPath() + "\n\n" +
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n\n" +
+		signedHeaders + "\n" + payloadHash
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+b.signature(date, stringToSign))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (b *s3BlobStore) put(ctx context.Context, key string, data []byte, contentType string) error {
+	resp, err := b.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *s3BlobStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3BlobStore) remove(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *s3BlobStore) presignGet(key, disposition string) (string, bool) {
+	return b.presignAt(key, disposition, time.Now()), true
+}
+
+func (b *s3BlobStore) presignAt(key, disposition string, now time.Time) string {
+	u := b.objectURL(key)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", b.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(b.presignTTL/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if disposition != "" {
+		q.Set("response-content-disposition", disposition)
+	}
+	// S3 wants RFC 3986 encoding: spaces as %20, not +.
+	query := strings.ReplaceAll(q.Encode(), "+", "%20")
+	canonical := "GET\n" + u.EscapedPath() + "\n" + query + "\nhost:" + u.Host + "\n\nhost\nUNSIGNED-PAYLOAD"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	u.RawQuery = query + "&X-Amz-Signature=" + b.signature(date, stringToSign)
+	return u.String()
+}
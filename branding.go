@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Branding of the pages people answer on. page_logo_url, page_theme_color
+// and page_footer change the built-in interaction and PIN/TOTP pages. For
+// more, page_template_dir names a directory that may hold:
+//
+//   - page.html, challenge.html and bundle.html, replacing the built-in
+//     templates (they get the same data, see htmlData, challengeData and
+//     bundleData);
+//   - custom.css, linked after the built-in styles;
+//   - anything else (a logo, fonts), served under /branding/.
+//
+// Missing files fall back to the embedded defaults. Templates are parsed when
+// the config loads, so a broken one fails the load (or the reload, which then
+// keeps the running pages); edit them and send SIGHUP to apply.
+
+const brandingPathPrefix = "/branding/"
+
+var themeColorRe = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// pageFuncs are the functions available to the interaction page templates.
+var pageFuncs = template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+	"when": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	},
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"duration": func(seconds int) string {
+		d := time.Duration(seconds) * time.Second
+		switch {
+		case d%time.Hour == 0:
+			return fmt.Sprintf("%dh", d/time.Hour)
+		case d%time.Minute == 0 && d > time.Hour:
+			return fmt.Sprintf("%dh %dm", d/time.Hour, d%time.Hour/time.Minute)
+		case d%time.Minute == 0:
+			return fmt.Sprintf("%dm", d/time.Minute)
+		}
+		return d.String()
+	},
+}
+
+// brandData is passed to the page templates as .Brand.
+type brandData struct {
+	LogoURL string
+	Color   string
+	Footer  string
+	// CSS is set when page_template_dir holds a custom.css.
+	CSS bool
+	// Prefix is path_prefix, for links to the server's own paths.
+	Prefix string
+}
+
+func (c *Config) normalizeBranding() error {
+	c.PageTemplateDir = strings.TrimSpace(c.PageTemplateDir)
+	c.PageLogoURL = strings.TrimSpace(c.PageLogoURL)
+	c.PageThemeColor = strings.TrimSpace(c.PageThemeColor)
+	c.PageFooter = strings.TrimSpace(c.PageFooter)
+	if c.PageThemeColor != "" && !themeColorRe.MatchString(c.PageThemeColor) {
+		return fmt.Errorf("invalid page_theme_color %q (want #rgb, #rrggbb or a color name)", c.PageThemeColor)
+	}
+	if c.PageLogoURL != "" {
+		u, err := url.Parse(c.PageLogoURL)
+		if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid page_logo_url %q (want an http(s) URL or a path like /branding/logo.png)", c.PageLogoURL)
+		}
+	}
+
+	c.pageTpl, c.challengeTpl, c.bundleTpl, c.customCSS = nil, nil, nil, false
+	if c.PageTemplateDir == "" {
+		return nil
+	}
+	if fi, err := os.Stat(c.PageTemplateDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("page_template_dir %q is not a directory", c.PageTemplateDir)
+	}
+	var err error
+	if c.pageTpl, err = loadPageTemplate(c.PageTemplateDir, "page.html"); err != nil {
+		return err
+	}
+	if c.challengeTpl, err = loadPageTemplate(c.PageTemplateDir, "challenge.html"); err != nil {
+		return err
+	}
+	if c.bundleTpl, err = loadPageTemplate(c.PageTemplateDir, "bundle.html"); err != nil {
+		return err
+	}
+	c.customCSS = fileExists(filepath.Join(c.PageTemplateDir, "custom.css"))
+	return nil
+}
+
+// loadPageTemplate parses dir/name, or returns nil if there is no such file.
+func loadPageTemplate(dir, name string) (*template.Template, error) {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("page_template_dir: %w", err)
+	}
+	t, err := template.New(strings.TrimSuffix(name, ".html")).Funcs(pageFuncs).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("page_template_dir: %w", err)
+	}
+	return t, nil
+}
+
+func (c *Config) brand() brandData {
+	return brandData{
+		LogoURL: c.PageLogoURL,
+		Color:   c.PageThemeColor,
+		Footer:  c.PageFooter,
+		CSS:     c.customCSS,
+		Prefix:  c.PathPrefix,
+	}
+}
+
+// renderPage executes the configured template, or def when there is none.
+func renderPage(w http.ResponseWriter, custom, def *template.Template, data any) {
+	t := def
+	if custom != nil {
+		t = custom
+	}
+	if err := t.Execute(w, data); err != nil && custom != nil {
+		slog.Error("render custom page template", "template", t.Name(), "error", err)
+	}
+}
+
+// handleBranding serves the assets in page_template_dir. The templates
+// themselves are not served, and the sandbox policy keeps an SVG or similar
+// opened directly from running script on this origin.
+func (s *server) handleBranding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := s.cfg().PageTemplateDir
+	name := strings.TrimPrefix(r.URL.Path, brandingPathPrefix)
+	ext := strings.ToLower(path.Ext(name))
+	if dir == "" || !fs.ValidPath(name) || name == "." || ext == ".html" || ext == ".htm" {
+		http.NotFound(w, r)
+		return
+	}
+	fsys := os.DirFS(dir)
+	if fi, err := fs.Stat(fsys, name); err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFileFS(w, r, fsys, name)
+}
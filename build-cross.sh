@@ -9,6 +9,11 @@ mkdir -p "$dist_dir"
 
 rm -f "$dist_dir"/ask4me-* "$dist_dir"/checksums.txt 2>/dev/null || true
 
+version="${ASK4ME_VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}"
+commit="$(git rev-parse HEAD 2>/dev/null || true)"
+build_date="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+ldflags="-s -w -X main.version=${version} -X main.commit=${commit} -X main.buildDate=${build_date}"
+
 targets=(
   "darwin/amd64"
   "darwin/arm64"
@@ -26,7 +31,7 @@ for t in "${targets[@]}"; do
     out="${out}.exe"
   fi
   echo "building $out"
-  env CGO_ENABLED=0 GOOS="$os" GOARCH="$arch" go build -trimpath -ldflags "-s -w" -o "$out" .
+  env CGO_ENABLED=0 GOOS="$os" GOARCH="$arch" go build -trimpath -ldflags "$ldflags" -o "$out" .
 done
 
 cd "$dist_dir"
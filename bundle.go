@@ -0,0 +1,622 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Bundled asks. An agent with several questions at once can send them as one
+// bundle, POST /v1/bundles:
+//
+//	{"title": "Release 2.4", "asks": [{"title": "Ship it?", "mcd": "..."}, ...]}
+//
+// Every ask is stored as a request of its own, but only one notification goes
+// out, for the whole bundle, with a link to a page (/b/{bundle_id}) that has a
+// form for each question. Each answer there resolves its own request as
+// user.submitted with via "bundle", so the caller waits for the results one by
+// one as usual: with a callback_url per ask, GET /v1/requests/{id}, or
+// POST /v1/ask?request_id=. The reply is 202 with the request ids in order.
+//
+// The notification goes through the channels of the first ask that a policy
+// does not answer, with the highest priority of the asks; its failure fails
+// them all. Asks in a bundle are buttons and text questions: no steps, JSON
+// Forms, responders, uploads, sessions, PIN, send_at or extend_seconds. They
+// are not deduplicated, and expires_in_seconds on the bundle applies to all of
+// them.
+
+const (
+	maxBundleAsks    = 20
+	bundlePathPrefix = "/b/"
+)
+
+type bundleRequest struct {
+	Title            string       `json:"title"`
+	Body             string       `json:"body"`
+	ExpiresInSeconds int          `json:"expires_in_seconds"`
+	Asks             []askRequest `json:"asks"`
+}
+
+// checkBundleAsk rejects what a bundle page cannot show for an ask of a
+// bundle; other asks pass.
+func checkBundleAsk(ar askRequest) error {
+	if ar.bundleID == "" {
+		return nil
+	}
+	switch {
+	case len(ar.Steps) > 0:
+		return badAskError("asks in a bundle cannot have steps")
+	case ar.JsonForms != nil && len(strings.TrimSpace(string(ar.JsonForms.Schema))) > 0:
+		return badAskError("asks in a bundle cannot use jsonforms")
+	case ar.Responders != nil:
+		return badAskError("asks in a bundle cannot have responders")
+	case ar.To != "":
+		return badAskError("asks in a bundle cannot have to")
+	case ar.NotifyResult:
+		return badAskError("asks in a bundle cannot have notify_result")
+	case ar.VoiceInput:
+		return badAskError("asks in a bundle cannot use voice_input")
+	case ar.AskName:
+		return badAskError("asks in a bundle cannot have ask_name")
+	case ar.AllowUploads:
+		return badAskError("asks in a bundle cannot allow uploads")
+	case ar.SessionID != "":
+		return badAskError("asks in a bundle cannot join a session")
+	case ar.Challenge != "":
+		return badAskError("asks in a bundle cannot have a challenge")
+	case !ar.sendAt.IsZero():
+		return badAskError("asks in a bundle cannot have send_at")
+	case ar.ExtendSeconds > 0:
+		return badAskError("asks in a bundle cannot have extend_seconds")
+	case ar.EscalateTo != "":
+		return badAskError("asks in a bundle cannot have escalate_to")
+	}
+	return nil
+}
+
+func isValidBundleID(id string) bool {
+	if !strings.HasPrefix(id, "bun_") || len(id) > 128 {
+		return false
+	}
+	return isValidRequestID("req_" + strings.TrimPrefix(id, "bun_"))
+}
+
+type bundle struct {
+	ID string
+	// RequestID is the first ask and RequestIDs all of them, in order.
+	RequestID  string
+	RequestIDs []string
+	Title      string
+	Body       string
+	TokenHash  string
+	ExpiresAt  int64
+	CreatedAt  int64
+}
+
+func (s *store) insertBundle(ctx context.Context, b bundle) error {
+	ids, err := json.Marshal(b.RequestIDs)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO bundles(bundle_id,request_id,request_ids,title,body,token_hash,expires_at,created_at) VALUES(?,?,?,?,?,?,?,?)`,
+		b.ID, b.RequestID, string(ids), b.Title, b.Body, b.TokenHash, b.ExpiresAt, b.CreatedAt,
+	)
+	return err
+}
+
+func (s *store) getBundle(ctx context.Context, id string) (bundle, error) {
+	b := bundle{ID: id}
+	var ids string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT request_id, request_ids, title, body, token_hash, expires_at, created_at FROM bundles WHERE bundle_id=?`, id,
+	).Scan(&b.RequestID, &ids, &b.Title, &b.Body, &b.TokenHash, &b.ExpiresAt, &b.CreatedAt)
+	if err != nil {
+		return bundle{}, err
+	}
+	if err := json.Unmarshal([]byte(ids), &b.RequestIDs); err != nil {
+		return bundle{}, err
+	}
+	return b, nil
+}
+
+// bundleOf returns the bundle reqID belongs to, or "".
+func (s *store) bundleOf(ctx context.Context, reqID string) (string, error) {
+	var id sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT bundle_id FROM requests WHERE request_id=?`, reqID).Scan(&id)
+	return id.String, err
+}
+
+// bundleRequests returns the asks of b in the order they were given,
+// leaving out those removed since.
+func (s *store) bundleRequests(ctx context.Context, b bundle) ([]requestSummary, error) {
+	out := make([]requestSummary, 0, len(b.RequestIDs))
+	for _, id := range b.RequestIDs {
+		r, err := s.getRequestSummary(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// handleBundles serves POST /v1/bundles and GET /v1/bundles/{id}.
+func (s *server) handleBundles(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/bundles"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleCreateBundle(w, r)
+		return
+	}
+	if !isValidBundleID(id) {
+		http.Error(w, "invalid bundle_id", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := s.db.getBundle(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if ok, err := s.visible(r.Context(), b.RequestID); err != nil || !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	list, err := s.db.bundleRequests(r.Context(), b)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, req := range list {
+		out = append(out, req.view())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"bundle_id":  b.ID,
+		"title":      b.Title,
+		"created_at": unixOrNil(b.CreatedAt),
+		"expires_at": unixOrNil(b.ExpiresAt),
+		"requests":   out,
+	})
+}
+
+func (s *server) handleCreateBundle(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var in bundleRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&in); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(in.Asks) == 0 || len(in.Asks) > maxBundleAsks {
+		http.Error(w, fmt.Sprintf("a bundle needs 1 to %d asks", maxBundleAsks), http.StatusBadRequest)
+		return
+	}
+	if in.ExpiresInSeconds < 0 {
+		http.Error(w, "expires_in_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	bundleID := genID("bun_")
+	asks := make([]askRequest, len(in.Asks))
+	for i, ar := range in.Asks {
+		// Check every ask before creating any, so a bad one leaves no half
+		// bundle behind.
+		if strings.TrimSpace(ar.Template) != "" {
+			expanded, err := s.expandTemplate(ctx, ar)
+			if err != nil {
+				writeBundleError(w, i, err)
+				return
+			}
+			ar = expanded
+		}
+		ar.bundleID = bundleID
+		ar.DedupWindowSeconds = -1
+		if in.ExpiresInSeconds > 0 {
+			ar.ExpiresInSeconds = in.ExpiresInSeconds
+		}
+		check := ar
+		_, err := normalizeAskRequest(&check)
+		if err == nil {
+			err = checkBundleAsk(check)
+		}
+		if err != nil {
+			writeBundleError(w, i, err)
+			return
+		}
+		asks[i] = ar
+	}
+
+	var created []createdAsk
+	var ids []string
+	for i, ar := range asks {
+		requestID := genID("req_")
+		c, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
+		if err != nil {
+			// Whatever was created of the bundle expires unannounced.
+			writeBundleError(w, i, err)
+			return
+		}
+		created = append(created, c)
+		ids = append(ids, requestID)
+	}
+
+	tokenPlain := genToken()
+	b := bundle{
+		ID:         bundleID,
+		RequestID:  ids[0],
+		RequestIDs: ids,
+		Title:      strings.TrimSpace(in.Title),
+		Body:       strings.TrimSpace(in.Body),
+		TokenHash:  sha256Hex(tokenPlain),
+		CreatedAt:  time.Now().Unix(),
+	}
+	if b.Title == "" {
+		b.Title = fmt.Sprintf("%d questions", len(created))
+	}
+	if b.Body == "" {
+		var lines []string
+		for _, c := range created {
+			lines = append(lines, "- "+c.Ask.Title)
+		}
+		b.Body = strings.Join(lines, "\n")
+	}
+	for _, c := range created {
+		b.ExpiresAt = max(b.ExpiresAt, c.ExpiresAt.Unix())
+	}
+	if err := s.db.insertBundle(ctx, b); err != nil {
+		http.Error(w, "failed to create bundle", http.StatusInternalServerError)
+		return
+	}
+	pageURL := s.cfg().pageBaseURL() + bundlePathPrefix + bundleID + "?k=" + url.QueryEscape(tokenPlain)
+
+	// One notification for all, sent for the first ask a person answers.
+	lead := -1
+	priority := priorityLow
+	for i, c := range created {
+		if c.policy != nil {
+			continue
+		}
+		if lead < 0 {
+			lead = i
+		}
+		if slices.Index(priorityLevels, c.Ask.Priority) > slices.Index(priorityLevels, priority) {
+			priority = c.Ask.Priority
+		}
+	}
+	if lead >= 0 {
+		ar := created[lead].Ask
+		ar.Title, ar.Body, ar.MCD = b.Title, b.Body, ""
+		ar.Priority = priority
+		ar.Attachments, ar.QR, ar.ServerChanActionLinks = nil, false, false
+		d := scheduledDelivery{Ask: ar, InteractionURL: pageURL}
+		if err := s.db.enqueueNotification(ctx, ids[lead], d, time.Now()); err != nil {
+			http.Error(w, "failed to create bundle", http.StatusInternalServerError)
+			return
+		}
+	}
+	for i, c := range created {
+		s.startAsk(ids[i], c)
+	}
+
+	out := make([]map[string]any, 0, len(created))
+	for i, c := range created {
+		out = append(out, map[string]any{
+			"request_id": ids[i],
+			"title":      c.Ask.Title,
+			"expires_at": c.ExpiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"bundle_id":       bundleID,
+		"interaction_url": pageURL,
+		"expires_at":      time.Unix(b.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		"requests":        out,
+	})
+}
+
+func writeBundleError(w http.ResponseWriter, i int, err error) {
+	if isBadAskError(err) {
+		http.Error(w, fmt.Sprintf("asks[%d]: %s", i, err), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "failed to create request", http.StatusInternalServerError)
+}
+
+// settleBundleNotification passes the outcome of a bundle's notification,
+// sent for its lead request, on to the other open asks of the bundle: they
+// are delivered with it, or fail with failed as the notify.failed data.
+func (s *server) settleBundleNotification(ctx context.Context, leadID string, failed map[string]any) {
+	bundleID, err := s.db.bundleOf(ctx, leadID)
+	if err != nil || bundleID == "" {
+		return
+	}
+	b, err := s.db.getBundle(ctx, bundleID)
+	if err != nil {
+		return
+	}
+	list, err := s.db.bundleRequests(ctx, b)
+	if err != nil {
+		return
+	}
+	for _, req := range list {
+		if req.RequestID == leadID || req.Status != "created" {
+			continue
+		}
+		if failed != nil {
+			fields := map[string]any{"bundle_id": bundleID}
+			for k, v := range failed {
+				fields[k] = v
+			}
+			s.failNotify(ctx, req.RequestID, fields)
+			continue
+		}
+		ev := s.mustNewEvent(ctx, req.RequestID, "notify.sent", map[string]any{
+			"channel":   "bundle",
+			"bundle_id": bundleID,
+		})
+		_ = s.persistTerminalAware(ctx, ev)
+		_ = s.db.updateRequestStatus(ctx, req.RequestID, "delivered")
+	}
+}
+
+// bundleData is what the bundle page template gets.
+type bundleData struct {
+	Title     string
+	Body      string
+	Token     string
+	CSRF      string
+	Questions []bundleQuestion
+	ExpiresAt time.Time
+	Brand     brandData
+}
+
+type bundleQuestion struct {
+	RequestID string
+	Title     string
+	Body      string
+	Buttons   []buttonSpec
+	Input     *inputSpec
+	// Suggestions are this question's reply chips (mcdSpec.Suggestions).
+	Suggestions []string
+	// Open is false once the ask was answered, expired or cancelled; Status
+	// then says which, and Answer is the answer given.
+	Open     bool
+	Status   string
+	Answer   string
+	Rejected string
+}
+
+// handleBundlePage serves the bundle page, GET /b/{id}?k=, and the answers
+// posted from it to /b/{id}/answer.
+func (s *server) handleBundlePage(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, bundlePathPrefix), "/")
+	if !isValidBundleID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	tokenPlain := r.URL.Query().Get("k")
+	tokenHash := sha256Hex(tokenPlain)
+	b, err := s.db.getBundle(ctx, id)
+	if err != nil || tokenPlain == "" || subtle.ConstantTimeCompare([]byte(b.TokenHash), []byte(tokenHash)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	setPageSecurityHeaders(w)
+	back := "./?k=" + url.QueryEscape(tokenPlain)
+	switch {
+	case sub == "answer" && r.Method == http.MethodPost:
+		if !s.sameOrigin(r) {
+			http.Error(w, "cross-site request", http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		if !validCSRF(r, id, tokenHash) {
+			http.Error(w, "invalid csrf token, reload the page", http.StatusForbidden)
+			return
+		}
+		requestID := r.PostFormValue("request_id")
+		if member, err := s.db.bundleOf(ctx, requestID); err != nil || member != id {
+			http.Error(w, "not in this bundle", http.StatusBadRequest)
+			return
+		}
+		err := s.answerRemote(ctx, requestID, remoteAnswer{
+			Action: r.PostFormValue("action"),
+			Text:   r.PostFormValue("text"),
+			Via:    "bundle",
+		})
+		switch {
+		case err == nil, errors.Is(err, errAnswerTaken), errors.Is(err, errAnswerNotOpen):
+			http.Redirect(w, r, back+"#"+requestID, http.StatusSeeOther)
+		case errors.Is(err, errAnswerInvalid):
+			msg := strings.TrimPrefix(err.Error(), errAnswerInvalid.Error()+": ")
+			http.Redirect(w, r, back+"&q="+url.QueryEscape(requestID)+"&rejected="+url.QueryEscape(truncate(msg, 500))+"#"+requestID, http.StatusSeeOther)
+		default:
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+		return
+	case sub == "" && r.Method == http.MethodGet:
+	case sub == "" || sub == "answer":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	list, err := s.db.bundleRequests(ctx, b)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	cfg := s.cfg()
+	data := bundleData{
+		Title:     b.Title,
+		Body:      b.Body,
+		Token:     tokenPlain,
+		CSRF:      s.csrfToken(w, r, id, tokenHash),
+		ExpiresAt: time.Unix(b.ExpiresAt, 0),
+		Brand:     cfg.brand(),
+	}
+	now := time.Now().Unix()
+	for _, req := range list {
+		q := bundleQuestion{
+			RequestID: req.RequestID,
+			Title:     req.Title,
+			Body:      req.Body,
+			Status:    req.Status,
+			Open:      !isTerminalStatus(req.Status) && now <= req.ExpiresAt,
+		}
+		if !q.Open && !isTerminalStatus(req.Status) {
+			q.Status = "expired"
+		}
+		if req.Answer != nil {
+			q.Answer = cmp.Or(req.Answer.Text, req.Answer.Action)
+		}
+		if q.Open {
+			if form, err := s.db.getRequestForm(ctx, req.RequestID); err == nil {
+				mcd, _ := form["mcd"].(string)
+				spec := parseMCD(mcd)
+				q.Buttons, q.Input, q.Suggestions = spec.Buttons, spec.Input, spec.Suggestions
+			}
+			if r.URL.Query().Get("q") == req.RequestID {
+				q.Rejected = r.URL.Query().Get("rejected")
+			}
+			ev := s.mustNewEvent(ctx, req.RequestID, "user.page_loaded", receiptData(r, ""))
+			_ = s.persistTerminalAware(ctx, ev)
+		}
+		data.Questions = append(data.Questions, q)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(w, cfg.bundleTpl, bundleTpl, data)
+}
+
+var bundleTpl = template.Must(template.New("bundle").Funcs(pageFuncs).Parse(`<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1,viewport-fit=cover"/>
+  <title>{{.Title}}</title>
+  <style>
+    :root{color-scheme:light dark;--fg:#24292f;--muted:#57606a;--bg:#fff;--subtle:#f6f8fa;--border:#d0d7de;--ok-bg:#dafbe1;--ok-border:#2da44e;--err-bg:#ffebe9;--err-border:#d1242f;}
+    @media (prefers-color-scheme:dark){:root{--fg:#e6edf3;--muted:#8d96a0;--bg:#0d1117;--subtle:#161b22;--border:#30363d;--ok-bg:#12261e;--ok-border:#2ea043;--err-bg:#25171c;--err-border:#f85149;}}
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 max(16px,env(safe-area-inset-right)) 0 max(16px,env(safe-area-inset-left));color:var(--fg);background:var(--bg);}
+    pre{white-space:pre-wrap;word-break:break-word;background:var(--subtle);padding:12px;border-radius:8px;}
+    section{border-top:1px solid var(--border);margin-top:24px;padding-top:8px;}
+    .row{margin-top:16px;}
+    button{min-height:44px;padding:10px 16px;font-size:16px;border-radius:10px;border:1px solid var(--border);background:var(--bg);color:var(--fg);cursor:pointer;margin:6px 6px 0 0;}
+    button:hover{background:var(--subtle);}
+    input[type="text"]{width:100%;padding:10px;font-size:16px;border:1px solid var(--border);border-radius:10px;box-sizing:border-box;background:var(--bg);color:var(--fg);}
+    .actions{display:flex;flex-wrap:wrap;gap:8px;margin-top:16px;}
+    .actions form{display:flex;margin:0;}
+    .actions button{margin:0;}
+    @media (max-width:600px){body{margin-top:16px;}.actions form,.actions button{flex:1 1 40%;}}
+    .ok{padding:12px;border:1px solid var(--ok-border);border-radius:10px;background:var(--ok-bg);white-space:pre-wrap;word-break:break-word;}
+    .err{padding:12px;border:1px solid var(--err-border);border-radius:10px;background:var(--err-bg);color:var(--fg);}
+    .countdown{color:var(--muted);font-size:14px;margin:-8px 0 8px;}
+    .chips{display:flex;flex-wrap:wrap;}
+    .chips button{min-height:36px;padding:6px 12px;font-size:14px;border-radius:18px;}
+    :focus-visible{outline:3px solid #0969da;outline-offset:2px;}
+    @media (prefers-color-scheme:dark){:focus-visible{outline-color:#4493f8;}}
+    @media (prefers-contrast:more){:root{--muted:var(--fg);--border:var(--fg);}button,input{border-width:2px;}}
+    @media (forced-colors:active){button,input,.ok,.err{border:1px solid CanvasText;}:focus-visible{outline-color:Highlight;}}
+    header.brand img{max-height:48px;max-width:100%;}
+    footer.brand{margin-top:32px;padding-bottom:env(safe-area-inset-bottom);color:var(--muted);font-size:13px;}
+  </style>
+  {{with .Brand}}{{if .Color}}
+  <meta name="theme-color" content="{{.Color}}"/>
+  <style>
+    button{background:{{.Color}};border-color:{{.Color}};color:#fff;}
+    button:hover{background:{{.Color}};opacity:.9;}
+    a{color:{{.Color}};}
+  </style>
+  {{end}}{{if .CSS}}<link rel="stylesheet" href="{{.Prefix}}/branding/custom.css"/>{{end}}{{end}}
+</head>
+<body>
+  {{if .Brand.LogoURL}}<header class="brand"><img src="{{.Brand.LogoURL}}" alt=""/></header>{{end}}
+  <main>
+  <h1>{{.Title}}</h1>
+  <div class="countdown">Open until <time datetime="{{rfc3339 .ExpiresAt}}">{{when .ExpiresAt}}</time>.</div>
+  {{range $i, $q := .Questions}}
+  <section id="{{.RequestID}}" aria-labelledby="t-{{.RequestID}}">
+    <h2 id="t-{{.RequestID}}">{{inc $i}}. {{.Title}}</h2>
+    <pre>{{.Body}}</pre>
+    {{if .Open}}
+      {{if .Rejected}}<div class="err" role="alert">{{.Rejected}}</div>{{end}}
+      {{if .Buttons}}
+      <div class="actions" role="group" aria-labelledby="t-{{.RequestID}}">
+        {{range .Buttons}}
+        <form method="post" action="./answer?k={{urlquery $.Token}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}"/>
+          <input type="hidden" name="request_id" value="{{$q.RequestID}}"/>
+          <input type="hidden" name="action" value="{{.Value}}"/>
+          <button type="submit">{{.Label}}</button>
+        </form>
+        {{end}}
+      </div>
+      {{end}}
+      {{if .Input}}
+      <form class="row" method="post" action="./answer?k={{urlquery $.Token}}">
+        <input type="hidden" name="csrf" value="{{$.CSRF}}"/>
+        <input type="hidden" name="request_id" value="{{.RequestID}}"/>
+        <label for="text-{{.RequestID}}">{{.Input.Label}}</label>
+        <div style="height:8px"></div>
+        <input type="text" id="text-{{.RequestID}}" name="text"/>
+        {{if .Suggestions}}<div class="chips" role="group" aria-label="Suggested replies">{{range .Suggestions}}<button type="button" class="chip" data-for="text-{{$q.RequestID}}">{{.}}</button>{{end}}</div>{{end}}
+        <div class="actions">
+          <button type="submit">{{.Input.Submit}}</button>
+        </div>
+      </form>
+      {{end}}
+    {{else if eq .Status "submitted"}}
+      <div class="ok" role="status"><b>Answered</b>{{if .Answer}}: {{.Answer}}{{end}}</div>
+    {{else if eq .Status "cancelled"}}
+      <div class="err" role="status">This question was cancelled.</div>
+    {{else}}
+      <div class="err" role="status">This question {{if eq .Status "notify_failed"}}could not be delivered{{else}}expired without an answer{{end}}.</div>
+    {{end}}
+  </section>
+  {{end}}
+  </main>
+  <script>
+    // A suggested reply fills in its question's text input.
+    document.addEventListener("click", function (e) {
+      var chip = e.target.closest && e.target.closest(".chip");
+      if (!chip) return;
+      var input = document.getElementById(chip.getAttribute("data-for"));
+      if (!input) return;
+      input.value = chip.textContent;
+      input.focus();
+    });
+  </script>
+  {{if .Brand.Footer}}<footer class="brand">{{.Brand.Footer}}</footer>{{end}}
+</body>
+</html>`))
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Business-hours expiry. An approval asked for on Friday night with two
+// hours to answer is dead before anyone is at work. expires_in_business_seconds
+// counts only the time within the server's business_hours calendar, weekly
+// hours in a timezone minus holidays, so "two business hours" from Friday
+// 22:00 runs out on Monday at 11:00 for a mon-fri 09:00-18:00 calendar:
+//
+//	business_hours:
+//	  timezone: Europe/Berlin
+//	  hours: ["mon-fri 09:00-18:00"]
+//	  holidays: ["2026-12-24", "2026-12-25"]
+//
+// The expiry is worked out once, when the ask is made (or for its send_at),
+// and stored as an ordinary expires_at.
+
+// BusinessHoursConfig is the `business_hours` calendar.
+type BusinessHoursConfig struct {
+	Timezone string   `yaml:"timezone"`
+	Hours    []string `yaml:"hours"`
+	// Holidays are YYYY-MM-DD dates in Timezone without business hours.
+	Holidays []string `yaml:"holidays"`
+
+	// Parsed by validateBusinessHours.
+	hours    *weeklyHours
+	holidays map[string]struct{}
+}
+
+// maxBusinessSeconds caps expires_in_business_seconds at 90 business days of
+// eight hours.
+const maxBusinessSeconds = 90 * 8 * 3600
+
+func validateBusinessHours(c *Config) error {
+	b := c.BusinessHours
+	if b == nil {
+		return nil
+	}
+	if len(b.Hours) == 0 {
+		return errors.New("business_hours: hours is required")
+	}
+	loc, err := time.LoadLocation(strings.TrimSpace(b.Timezone))
+	if err != nil {
+		return fmt.Errorf("business_hours: invalid timezone %q", b.Timezone)
+	}
+	if b.hours, err = parseWeeklyHours(b.Hours, loc); err != nil {
+		return fmt.Errorf("business_hours: hours %w", err)
+	}
+	b.holidays = map[string]struct{}{}
+	for _, h := range b.Holidays {
+		d, err := time.Parse(time.DateOnly, strings.TrimSpace(h))
+		if err != nil {
+			return fmt.Errorf("business_hours: holiday %q must be a YYYY-MM-DD date", h)
+		}
+		b.holidays[d.Format(time.DateOnly)] = struct{}{}
+	}
+	return nil
+}
+
+// after returns the time seconds of business time after t, or the zero time
+// when the calendar does not have that much business time in the years
+// ahead.
+func (b *BusinessHoursConfig) after(t time.Time, seconds int) time.Time {
+	return b.hours.add(t, time.Duration(seconds)*time.Second, func(day time.Time) bool {
+		_, off := b.holidays[day.Format(time.DateOnly)]
+		return off
+	})
+}
+
+func normalizeBusinessExpiry(ar *askRequest) error {
+	if ar.ExpiresInBusinessSeconds == 0 {
+		return nil
+	}
+	if ar.ExpiresInBusinessSeconds < 0 || ar.ExpiresInBusinessSeconds > maxBusinessSeconds {
+		return badAskError("expires_in_business_seconds must be between 1 and 2592000")
+	}
+	if ar.ExpiresInSeconds > 0 {
+		return badAskError("expires_in_seconds and expires_in_business_seconds cannot be combined")
+	}
+	return nil
+}
+
+// businessExpiry returns when an ask that starts at start expires by its
+// expires_in_business_seconds.
+func (s *server) businessExpiry(start time.Time, seconds int) (time.Time, error) {
+	b := s.cfg().BusinessHours
+	if b == nil {
+		return time.Time{}, badAskError("expires_in_business_seconds needs business_hours in the server config")
+	}
+	at := b.after(start, seconds)
+	if at.IsZero() {
+		return time.Time{}, badAskError("business_hours has too little business time for expires_in_business_seconds")
+	}
+	return at, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A challenge asks the responder for a code before the interaction page shows
+// or accepts anything, so a leaked link alone is not enough to answer:
+//
+//   - "pin": the pre-shared challenge_pin from the config.
+//   - "totp": a 6-digit RFC 6238 code for challenge_totp_secret (base32, as
+//     shown by authenticator apps); the previous and next 30s windows are
+//     accepted too.
+//
+// A correct code sets a cookie for that link only. After
+// challengeMaxFailures wrong codes the link is locked; rotate it to get a
+// new one (see tokens.go).
+
+const (
+	challengePIN  = "pin"
+	challengeTOTP = "totp"
+
+	challengeCookiePrefix = "ask4me_pass_"
+	challengeMaxFailures  = 5
+	totpPeriod            = 30
+)
+
+func normalizeChallenge(ar *askRequest) error {
+	ar.Challenge = strings.ToLower(strings.TrimSpace(ar.Challenge))
+	switch ar.Challenge {
+	case "":
+		return nil
+	case challengePIN, challengeTOTP:
+		// Action links answer straight from the notification, which would
+		// skip the challenge.
+		ar.ServerChanActionLinks = false
+		return nil
+	}
+	return badAskError("challenge must be pin or totp")
+}
+
+// validateChallenge rejects challenges the server has no secret for.
+func (s *server) validateChallenge(ar askRequest) error {
+	switch ar.Challenge {
+	case challengePIN:
+		if s.cfg().ChallengePIN == "" {
+			return badAskError("challenge pin needs challenge_pin in the server config")
+		}
+	case challengeTOTP:
+		if s.cfg().ChallengeTOTPSecret == "" {
+			return badAskError("challenge totp needs challenge_totp_secret in the server config")
+		}
+	}
+	return nil
+}
+
+// decodeTOTPSecret accepts base32 secrets with or without padding, spaces and
+// in either case.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	s = strings.TrimRight(s, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+func (s *server) checkChallengeCode(kind, code string, now time.Time) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return false
+	}
+	switch kind {
+	case challengePIN:
+		return subtle.ConstantTimeCompare([]byte(code), []byte(s.cfg().ChallengePIN)) == 1
+	case challengeTOTP:
+		key, err := decodeTOTPSecret(s.cfg().ChallengeTOTPSecret)
+		if err != nil {
+			return false
+		}
+		counter := now.Unix() / totpPeriod
+		for d := int64(-1); d <= 1; d++ {
+			if subtle.ConstantTimeCompare([]byte(code), []byte(totpCode(key, counter+d))) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *store) getChallenge(ctx context.Context, reqID string) (string, error) {
+	var v sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT challenge FROM requests WHERE request_id=?`, reqID).Scan(&v)
+	return v.String, err
+}
+
+func (s *store) getChallengeState(ctx context.Context, reqID, tokenHash string) (passHash string, failures int, err error) {
+	var v sql.NullString
+	err = s.db.QueryRowContext(ctx,
+		`SELECT challenge_hash, challenge_failures FROM tokens WHERE request_id=? AND token_hash=?`,
+		reqID, tokenHash,
+	).Scan(&v, &failures)
+	return v.String, failures, err
+}
+
+func (s *store) passChallenge(ctx context.Context, reqID, tokenHash, passHash string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE tokens SET challenge_hash=? WHERE request_id=? AND token_hash=?`,
+		passHash, reqID, tokenHash,
+	)
+	return err
+}
+
+func (s *store) failChallenge(ctx context.Context, reqID, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE tokens SET challenge_failures=challenge_failures+1 WHERE request_id=? AND token_hash=?`,
+		reqID, tokenHash,
+	)
+	return err
+}
+
+// checkChallenge runs before anything else of the interaction page is served.
+// It answers the challenge form and its POST itself and returns false in that
+// case, and whenever the browser has not passed the challenge yet.
+func (s *server) checkChallenge(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, tokenHash, sub string) bool {
+	ctx := r.Context()
+	kind, err := s.db.getChallenge(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if kind == "" {
+		if sub == "challenge" {
+			http.NotFound(w, r)
+			return false
+		}
+		return true
+	}
+	passHash, failures, err := s.db.getChallengeState(ctx, requestID, tokenHash)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	cookieName := challengeCookiePrefix + tokenHash[:16]
+	if passHash != "" {
+		if c, err := r.Cookie(cookieName); err == nil && sha256Hex(c.Value) == passHash {
+			if sub == "challenge" {
+				http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+				return false
+			}
+			return true
+		}
+	}
+	if failures >= challengeMaxFailures {
+		http.Error(w, "too many wrong codes; ask for a new link", http.StatusForbidden)
+		return false
+	}
+
+	switch {
+	case sub == "challenge" && r.Method == http.MethodPost:
+		if !s.checkChallengeCode(kind, r.FormValue("code"), time.Now()) {
+			if err := s.db.failChallenge(ctx, requestID, tokenHash); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return false
+			}
+			ev := s.mustNewEvent(ctx, requestID, "user.challenge_failed", map[string]any{
+				"failures": failures + 1,
+			})
+			_ = s.persistTerminalAware(ctx, ev)
+			s.renderChallenge(w, r, requestID, tokenPlain, kind, http.StatusUnauthorized, challengeMaxFailures-failures-1)
+			return false
+		}
+		// A link shared with several browsers (e.g. phone and laptop) keeps
+		// working in the one that passed last.
+		secret := genToken()
+		if err := s.db.passChallenge(ctx, requestID, tokenHash, sha256Hex(secret)); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return false
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    secret,
+			Path:     s.cfg().PathPrefix + "/",
+			HttpOnly: true,
+			Secure:   s.secureCookies(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		ev := s.mustNewEvent(ctx, requestID, "user.challenge_passed", map[string]any{})
+		_ = s.persistTerminalAware(ctx, ev)
+		http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+	case (sub == "" || sub == "challenge") && r.Method == http.MethodGet:
+		s.renderChallenge(w, r, requestID, tokenPlain, kind, http.StatusOK, -1)
+	default:
+		http.Error(w, "verification required", http.StatusForbidden)
+	}
+	return false
+}
+
+type challengeData struct {
+	Title     string
+	Token     string
+	TOTP      bool
+	Remaining int
+	CSRF      string
+	Brand     brandData
+}
+
+var challengeTpl = template.Must(template.New("challenge").Parse(`<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1,viewport-fit=cover"/>
+  <title>{{.Title}}</title>
+  <style>
+    :root{color-scheme:light dark;--fg:#24292f;--muted:#57606a;--bg:#fff;--subtle:#f6f8fa;--border:#d0d7de;--err-bg:#ffebe9;--err-border:#d1242f;}
+    @media (prefers-color-scheme:dark){:root{--fg:#e6edf3;--muted:#8d96a0;--bg:#0d1117;--subtle:#161b22;--border:#30363d;--err-bg:#25171c;--err-border:#f85149;}}
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 max(16px,env(safe-area-inset-right)) 0 max(16px,env(safe-area-inset-left));color:var(--fg);background:var(--bg);}
+    .row{margin-top:16px;}
+    button{min-height:44px;padding:10px 16px;font-size:16px;border-radius:10px;border:1px solid var(--border);background:var(--bg);color:var(--fg);cursor:pointer;margin:6px 6px 0 0;}
+    button:hover{background:var(--subtle);}
+    input[type="password"],input[type="text"]{width:100%;padding:10px;font-size:16px;border:1px solid var(--border);border-radius:10px;box-sizing:border-box;background:var(--bg);color:var(--fg);}
+    @media (max-width:600px){body{margin-top:16px;}button{width:100%;margin-right:0;}}
+    .err{padding:12px;border:1px solid var(--err-border);border-radius:10px;background:var(--err-bg);color:var(--fg);}
+    :focus-visible{outline:3px solid #0969da;outline-offset:2px;}
+    @media (prefers-color-scheme:dark){:focus-visible{outline-color:#4493f8;}}
+    @media (prefers-contrast:more){:root{--muted:var(--fg);--border:var(--fg);}button,input{border-width:2px;}}
+    @media (forced-colors:active){button,input,.err{border:1px solid CanvasText;}:focus-visible{outline-color:Highlight;}}
+    header.brand img{max-height:48px;max-width:100%;}
+    footer.brand{margin-top:32px;padding-bottom:env(safe-area-inset-bottom);color:var(--muted);font-size:13px;}
+  </style>
+  {{with .Brand}}{{if .Color}}
+  <meta name="theme-color" content="{{.Color}}"/>
+  <style>
+    button{background:{{.Color}};border-color:{{.Color}};color:#fff;}
+    button:hover{background:{{.Color}};opacity:.9;}
+    a{color:{{.Color}};}
+  </style>
+  {{end}}{{if .CSS}}<link rel="stylesheet" href="{{.Prefix}}/branding/custom.css"/>{{end}}{{end}}
+</head>
+<body>
+  {{if .Brand.LogoURL}}<header class="brand"><img src="{{.Brand.LogoURL}}" alt=""/></header>{{end}}
+  <main>
+  <h1>{{.Title}}</h1>
+  {{if ge .Remaining 0}}
+  <div class="err" role="alert" id="code-error">Wrong code. {{.Remaining}} attempt(s) left.</div>
+  {{end}}
+  <div class="row">
+    <form method="post" action="./challenge?k={{urlquery .Token}}">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label for="code">{{if .TOTP}}Enter the code from your authenticator app{{else}}Enter your PIN{{end}}</label>
+      <div style="height:8px"></div>
+      {{if .TOTP}}
+      <input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" autofocus required{{if ge .Remaining 0}} aria-invalid="true" aria-describedby="code-error"{{end}}/>
+      {{else}}
+      <input type="password" id="code" name="code" autocomplete="off" autofocus required{{if ge .Remaining 0}} aria-invalid="true" aria-describedby="code-error"{{end}}/>
+      {{end}}
+      <div style="height:10px"></div>
+      <button type="submit">Continue</button>
+    </form>
+  </div>
+  </main>
+  {{if .Brand.Footer}}<footer class="brand">{{.Brand.Footer}}</footer>{{end}}
+</body>
+</html>`))
+
+// renderChallenge shows the code form; remaining < 0 means no wrong attempt
+// to report.
+func (s *server) renderChallenge(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, kind string, status, remaining int) {
+	var title string
+	if err := s.db.db.QueryRowContext(r.Context(), `SELECT title FROM requests WHERE request_id=?`, requestID).Scan(&title); err != nil {
+		title = "Ask4Me"
+	}
+	cfg := s.cfg()
+	data := challengeData{
+		Title:     title,
+		Token:     tokenPlain,
+		TOTP:      kind == challengeTOTP,
+		Remaining: remaining,
+		CSRF:      s.csrfToken(w, r, requestID, sha256Hex(tokenPlain)),
+		Brand:     cfg.brand(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	renderPage(w, cfg.challengeTpl, challengeTpl, data)
+}
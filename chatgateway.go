@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Chat gateway. Any chat system can become an answering surface through a
+// small bridge (a Matrix or IRC bot, a webhook relay, ...) that POSTs the
+// messages it sees to /chat/{bridge} and posts the reply back:
+//
+//	POST /chat/matrix
+//	Authorization: Bearer <the bridge's token>
+//	{"sender": "@alice:example.org", "text": "answer req_xxx approve \"looks good\""}
+//
+//	{"handled": true, "reply": "Answered req_xxx."}
+//
+// Commands (a leading ! or / is ignored): pending, show <id>,
+// answer <id> <button> [text], answer <id> <text> for asks with an input,
+// and help. Other messages are not commands and get "handled": false. Each
+// bridge has its own token and, optionally, the senders it may answer for;
+// answers carry "via":"chat:<bridge>" and the sender as responder.
+
+const chatListLimit = 10
+
+// ChatBridgeConfig is one entry of the chat_bridges config section.
+type ChatBridgeConfig struct {
+	Name           string   `yaml:"name"`
+	Token          string   `yaml:"token"`
+	AllowedSenders []string `yaml:"allowed_senders"`
+}
+
+var reChatBridgeName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// validateChatBridgeConfigs checks the chat_bridges config section.
+func validateChatBridgeConfigs(c *Config) error {
+	seen := map[string]struct{}{}
+	for i := range c.ChatBridges {
+		b := &c.ChatBridges[i]
+		b.Name = strings.ToLower(strings.TrimSpace(b.Name))
+		b.Token = strings.TrimSpace(b.Token)
+		if !reChatBridgeName.MatchString(b.Name) {
+			return fmt.Errorf("chat_bridges %q: name must use only letters, digits, - and _", b.Name)
+		}
+		if _, dup := seen[b.Name]; dup {
+			return fmt.Errorf("chat_bridges: duplicate name %q", b.Name)
+		}
+		seen[b.Name] = struct{}{}
+		if len(b.Token) < 16 {
+			return fmt.Errorf("chat_bridges %q: token must be at least 16 characters", b.Name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) chatBridge(name string) (ChatBridgeConfig, bool) {
+	for _, b := range c.ChatBridges {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return ChatBridgeConfig{}, false
+}
+
+func (b ChatBridgeConfig) allows(sender string) bool {
+	if len(b.AllowedSenders) == 0 {
+		return true
+	}
+	for _, v := range b.AllowedSenders {
+		if strings.EqualFold(strings.TrimSpace(v), sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitChatCommand splits a message into words, keeping quoted text
+// ("...", '...' or “...”) together.
+func splitChatCommand(text string) []string {
+	var out []string
+	var cur strings.Builder
+	var quote rune
+	inWord := false
+	for _, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote || (quote == '“' && r == '”') {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'' || r == '“':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				out = append(out, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+func (s *server) handleChatGateway(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bridge, ok := s.cfg().chatBridge(strings.Trim(strings.TrimPrefix(r.URL.Path, "/chat/"), "/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(bridge.Token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var in struct {
+		Sender string `json:"sender"`
+		Text   string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in.Sender = strings.TrimSpace(in.Sender)
+	words := splitChatCommand(in.Text)
+	if len(words) == 0 {
+		writeJSON(w, http.StatusOK, map[string]any{"handled": false})
+		return
+	}
+	cmd := strings.ToLower(strings.TrimLeft(words[0], "!/"))
+	switch cmd {
+	case "pending", "show", "answer", "help":
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{"handled": false})
+		return
+	}
+	if !bridge.allows(in.Sender) {
+		writeJSON(w, http.StatusOK, map[string]any{"handled": true, "reply": "You may not answer requests here."})
+		return
+	}
+	reply := s.chatCommand(r.Context(), bridge, in.Sender, cmd, words[1:])
+	writeJSON(w, http.StatusOK, map[string]any{"handled": true, "reply": reply})
+}
+
+func (s *server) chatCommand(ctx context.Context, bridge ChatBridgeConfig, sender, cmd string, args []string) string {
+	switch cmd {
+	case "pending":
+		list, err := s.db.pendingRequests(ctx, chatListLimit)
+		if err != nil {
+			return "Could not list requests."
+		}
+		if len(list) == 0 {
+			return "Nothing is waiting for an answer."
+		}
+		var b strings.Builder
+		for _, req := range list {
+			fmt.Fprintf(&b, "%s · %s%s\n", req.RequestID, oneLine(req.Title, 80), s.chatOptions(ctx, req.RequestID))
+		}
+		return strings.TrimSuffix(b.String(), "\n")
+	case "show":
+		if len(args) == 0 || !isValidRequestID(args[0]) {
+			return "Usage: show <request_id>"
+		}
+		req, err := s.db.getRequestSummary(ctx, args[0])
+		if err != nil {
+			return "No such request."
+		}
+		text := req.Title
+		if body := strings.TrimSpace(req.Body); body != "" {
+			text += "\n" + truncate(body, 2000)
+		}
+		text += fmt.Sprintf("\nStatus: %s · expires %s", req.Status, time.Unix(req.ExpiresAt, 0).UTC().Format("2006-01-02 15:04 UTC"))
+		return text + s.chatOptions(ctx, req.RequestID)
+	case "answer":
+		if len(args) < 2 || !isValidRequestID(args[0]) {
+			return `Usage: answer <request_id> <button> ["text"]`
+		}
+		return s.chatAnswer(ctx, bridge, sender, args[0], args[1:])
+	}
+	return "Commands: pending · show <request_id> · answer <request_id> <button> [\"text\"] · answer <request_id> \"text\""
+}
+
+// chatOptions describes how an ask can be answered from chat.
+func (s *server) chatOptions(ctx context.Context, requestID string) string {
+	form, err := s.db.getRequestForm(ctx, requestID)
+	if err != nil {
+		return ""
+	}
+	_, jsonForms := form["jsonforms_schema"]
+	_, steps := form["steps"]
+	if jsonForms || steps {
+		return " · answer on the page"
+	}
+	mcd, _ := form["mcd"].(string)
+	spec := parseMCD(mcd)
+	var parts []string
+	if len(spec.Buttons) > 0 {
+		values := make([]string, 0, len(spec.Buttons))
+		for _, btn := range spec.Buttons {
+			values = append(values, btn.Value)
+		}
+		parts = append(parts, "buttons: "+strings.Join(values, ", "))
+	}
+	if spec.Input != nil {
+		parts = append(parts, "text: "+spec.Input.Label)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " · " + strings.Join(parts, " · ")
+}
+
+func (s *server) chatAnswer(ctx context.Context, bridge ChatBridgeConfig, sender, requestID string, args []string) string {
+	form, err := s.db.getRequestForm(ctx, requestID)
+	if err != nil {
+		return "No such request."
+	}
+	mcd, _ := form["mcd"].(string)
+	spec := parseMCD(mcd)
+	a := remoteAnswer{Responder: sender, Via: "chat:" + bridge.Name}
+	for _, btn := range spec.Buttons {
+		if strings.EqualFold(args[0], btn.Value) || strings.EqualFold(args[0], btn.Label) {
+			a.Action = btn.Value
+			a.Text = strings.Join(args[1:], " ")
+			break
+		}
+	}
+	if a.Action == "" {
+		if spec.Input == nil {
+			return "Unknown button" + s.chatOptions(ctx, requestID)
+		}
+		a.Text = strings.Join(args, " ")
+	}
+	err = s.answerRemote(ctx, requestID, a)
+	switch {
+	case err == nil:
+		return "Answered " + requestID + "."
+	case errors.Is(err, errAnswerTaken), errors.Is(err, errAnswerNotOpen):
+		return "Already answered or closed."
+	case errors.Is(err, errAnswerNotFound):
+		return "No such request."
+	case errors.Is(err, errAnswerInvalid):
+		return strings.TrimPrefix(err.Error(), errAnswerInvalid.Error()+": ")
+	}
+	return "Could not save the answer."
+}
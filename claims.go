@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Answer claims. When a single-answer ask reaches several people (a link
+// shared in a group chat, responders in first mode) or several devices, two
+// of them may both start writing an answer only for one to be turned away.
+// The first page to start typing claims the ask for claimTTL, renewed while
+// it keeps typing, and every other open page shows "alice is answering this"
+// until the claim runs out. A claim is advisory: the others can still
+// answer, and the first answer wins as always. Taking a claim is recorded as
+// user.claimed (with the responder, for named ones); renewals are not.
+//
+// Pages identify themselves with a random page ID sent with their beacons
+// and stream, so a claim is not shown to the page that holds it.
+//
+// The answer itself is guarded twice: a submission only lands while the ask
+// is open (markSubmitted), and an edit only replaces the answer the page
+// showed (answerVersion); a stale page is told to reload.
+
+const claimTTL = 60 * time.Second
+
+// isValidPageID checks the page ID a page made up for itself.
+func isValidPageID(v string) bool {
+	if len(v) < 8 || len(v) > 64 {
+		return false
+	}
+	for _, c := range v {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// claimAnswer claims or renews reqID for pageID. It reports whether pageID
+// took the claim just now; false means a renewal or someone else's claim.
+func (s *store) claimAnswer(ctx context.Context, reqID, pageID, responder string, now time.Time) (bool, error) {
+	until := now.Add(claimTTL).Unix()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE answer_claims SET until_at=? WHERE request_id=? AND page_id=? AND until_at>?`,
+		until, reqID, pageID, now.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return false, nil
+	}
+	res, err = s.db.ExecContext(ctx,
+		`UPDATE answer_claims SET page_id=?, responder=?, until_at=? WHERE request_id=? AND until_at<=?`,
+		pageID, nullIfEmpty(responder), until, reqID, now.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO answer_claims(request_id,page_id,responder,until_at) VALUES(?,?,?,?)`,
+		reqID, pageID, nullIfEmpty(responder), until,
+	)
+	if isUniqueViolation(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// answerClaim returns the claim on reqID that is still running at now.
+func (s *store) answerClaim(ctx context.Context, reqID string, now time.Time) (pageID, responder string, until time.Time, ok bool, err error) {
+	var who sql.NullString
+	var at int64
+	err = s.db.QueryRowContext(ctx,
+		`SELECT page_id, responder, until_at FROM answer_claims WHERE request_id=? AND until_at>?`, reqID, now.Unix(),
+	).Scan(&pageID, &who, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", "", time.Time{}, false, err
+	}
+	return pageID, who.String, time.Unix(at, 0), true, nil
+}
+
+// claimTyping takes or renews the claim for a page whose responder is
+// typing, and records user.claimed when the claim is new.
+func (s *server) claimTyping(ctx context.Context, requestID, pageID, responder string) {
+	if !isValidPageID(pageID) {
+		return
+	}
+	if mode, _, err := s.db.getRespondersMode(ctx, requestID); err != nil || isMultiAnswerMode(mode) {
+		return
+	}
+	took, err := s.db.claimAnswer(ctx, requestID, pageID, responder, time.Now())
+	if err != nil || !took {
+		return
+	}
+	data := map[string]any{"expires_in_seconds": int(claimTTL / time.Second)}
+	if responder != "" {
+		data["responder"] = responder
+	}
+	ev := s.mustNewEvent(ctx, requestID, "user.claimed", data)
+	_ = s.persistTerminalAware(ctx, ev)
+}
+
+// pageClaim is the page.claimed event telling the page pageID of responder
+// that someone else is answering, or false when nobody else is.
+func (s *server) pageClaim(ctx context.Context, requestID, pageID, responder string) (Event, bool) {
+	now := time.Now()
+	holder, who, until, ok, err := s.db.answerClaim(ctx, requestID, now)
+	if err != nil || !ok || holder == pageID {
+		return Event{}, false
+	}
+	b, _ := json.Marshal(map[string]any{
+		"by":      who,
+		"self":    who != "" && who == responder,
+		"seconds": int(until.Sub(now).Seconds()),
+	})
+	return Event{ID: genID("evt_"), Type: "page.claimed", RequestID: requestID, Data: json.RawMessage(b)}, true
+}
+
+// answerVersion identifies an answer, so an edit can tell whether the
+// answer it replaces is still the stored one.
+func answerVersion(action, text string) string {
+	return sha256Hex(action + "\x00" + text)[:16]
+}
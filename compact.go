@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phone automations. GET /v1/requests/{id}/compact is a small, flat view of
+// an ask for iOS Shortcuts, Android Tasker and the like, with a one-tap
+// answer URL for each button and for the input:
+//
+//	POST /tap/req_xxx?a=approve&k=key_xxx&e=1760000000&sig=...
+//
+// Tap URLs answer without an API key, so like admin sessions they are signed
+// with the hash of the key that fetched the view: deleting or rotating the
+// key, or taking away its admin scope, voids them. Only keys that may answer
+// (admin scope) get them, only for single-responder asks, and they stop
+// working when the ask expires. The input's URL takes the reply in a text
+// form field or query parameter. Taps must be POSTs, so that link previews
+// cannot answer.
+
+const compactBodyMax = 1000
+
+func tapMAC(keyHash, requestID, action, keyID string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(keyHash))
+	fmt.Fprintf(mac, "tap|%s|%s|%s|%d", requestID, action, keyID, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *server) tapURL(k apiKey, keyHash, requestID, action string, exp int64) string {
+	q := url.Values{}
+	if action != "" {
+		q.Set("a", action)
+	}
+	q.Set("k", k.ID)
+	q.Set("e", strconv.FormatInt(exp, 10))
+	q.Set("sig", tapMAC(keyHash, requestID, action, k.ID, exp))
+	return s.cfg().pageBaseURL() + "/tap/" + requestID + "?" + q.Encode()
+}
+
+// handleCompactRequest serves GET /v1/requests/{id}/compact.
+func (s *server) handleCompactRequest(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	req, err := s.db.getRequestSummary(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	form, err := s.db.getRequestForm(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	mode, _, err := s.db.getRespondersMode(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	_, jsonForms := form["jsonforms_schema"]
+	_, steps := form["steps"]
+	open := !isTerminalStatus(req.Status) && req.Status != "scheduled" && time.Now().Unix() <= req.ExpiresAt
+
+	// Tap URLs are signed for the key that asks, when it may answer.
+	keyHash := ""
+	k, ok, err := s.authenticate(r)
+	if err == nil && ok && k.allows(scopeAdmin) && open && !jsonForms && !steps && !isMultiAnswerMode(mode) {
+		keyHash, _ = s.adminKeyHash(ctx, k.ID)
+	}
+	answerURL := func(action string) any {
+		if keyHash == "" {
+			return nil
+		}
+		return s.tapURL(k, keyHash, requestID, action, req.ExpiresAt)
+	}
+
+	mcd, _ := form["mcd"].(string)
+	spec := parseMCD(mcd)
+	buttons := make([]map[string]any, 0, len(spec.Buttons))
+	for _, btn := range spec.Buttons {
+		buttons = append(buttons, map[string]any{
+			"label":      btn.Label,
+			"value":      btn.Value,
+			"answer_url": answerURL(btn.Value),
+		})
+	}
+	var input any
+	if spec.Input != nil {
+		input = map[string]any{
+			"label":      spec.Input.Label,
+			"answer_url": answerURL(""),
+		}
+	}
+	view := req.view()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"request_id":     req.RequestID,
+		"title":          req.Title,
+		"body":           truncate(req.Body, compactBodyMax),
+		"status":         req.Status,
+		"open":           open,
+		"priority":       view["priority"],
+		"expires_at":     view["expires_at"],
+		"answer":         view["answer"],
+		"buttons":        buttons,
+		"input":          input,
+		"answer_on_page": jsonForms || steps || isMultiAnswerMode(mode),
+	})
+}
+
+// handleTap serves the one-tap answer URLs of /v1/requests/{id}/compact.
+func (s *server) handleTap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reply := func(status int, ok bool, requestID, message string) {
+		writeJSON(w, status, map[string]any{"ok": ok, "request_id": nullIfEmpty(requestID), "message": message})
+	}
+	requestID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tap/"), "/")
+	q := r.URL.Query()
+	action, keyID := q.Get("a"), q.Get("k")
+	exp, _ := strconv.ParseInt(q.Get("e"), 10, 64)
+	if !isValidRequestID(requestID) || !isValidAPIKeyID(keyID) {
+		reply(http.StatusForbidden, false, "", "Invalid link.")
+		return
+	}
+	keyHash, err := s.adminKeyHash(r.Context(), keyID)
+	if err != nil || !hmac.Equal([]byte(tapMAC(keyHash, requestID, action, keyID, exp)), []byte(q.Get("sig"))) {
+		reply(http.StatusForbidden, false, requestID, "Invalid link.")
+		return
+	}
+	if time.Now().Unix() > exp {
+		reply(http.StatusGone, false, requestID, "This request has expired.")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := r.ParseForm(); err != nil {
+		reply(http.StatusBadRequest, false, requestID, "Bad form.")
+		return
+	}
+	text := strings.TrimSpace(r.FormValue("text"))
+	if action == "" && text == "" {
+		reply(http.StatusBadRequest, false, requestID, "Nothing to send: add a text field.")
+		return
+	}
+	err = s.answerRemote(r.Context(), requestID, remoteAnswer{Action: action, Text: text, Via: "tap"})
+	switch {
+	case err == nil:
+		msg := "Answered: " + truncate(action, 200)
+		if action == "" {
+			msg = "Answered."
+		}
+		reply(http.StatusOK, true, requestID, msg)
+	case errors.Is(err, errAnswerTaken), errors.Is(err, errAnswerNotOpen):
+		reply(http.StatusConflict, false, requestID, "Already answered or closed.")
+	case errors.Is(err, errAnswerNotFound):
+		reply(http.StatusNotFound, false, requestID, "No such request.")
+	case errors.Is(err, errAnswerInvalid):
+		reply(http.StatusBadRequest, false, requestID, err.Error())
+	default:
+		reply(http.StatusInternalServerError, false, requestID, "Could not save the answer.")
+	}
+}
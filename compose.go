@@ -0,0 +1,194 @@
+package main
+
+import "net/http"
+
+// The compose page. /compose is a small form for a person to ask another
+// one: pick a contact (or rotation), write a title and body, list the
+// buttons, and the ask goes out through that contact's channels like any
+// other. The page then waits for the answer and shows it, and also shows the
+// link, so an ask with no contact can be passed on by hand. It is ask4me as
+// a person-to-person "please confirm" tool.
+//
+// The page holds no secrets and does nothing server-side: it calls POST
+// /v1/ask from the browser with an API key typed into it (the ask scope is
+// enough), so keys, tenants, rate limits and validation apply as for agents.
+// The fields can be filled from the URL, /compose?to=alice&title=...&body=
+// ...&buttons=Yes,No#key=..., for bookmarklets and browser extensions.
+
+const composePage = `<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1,viewport-fit=cover"/>
+  <title>Ask4Me: new ask</title>
+  <link rel="manifest" href="manifest.webmanifest"/>
+  <style>
+    :root{color-scheme:light dark;--fg:#24292f;--muted:#57606a;--bg:#fff;--subtle:#f6f8fa;--border:#d0d7de;--ok-bg:#dafbe1;--ok-border:#2da44e;--err-bg:#ffebe9;--err-border:#d1242f;--pending-bg:#fff8c5;--pending-border:#bf8700;}
+    @media (prefers-color-scheme:dark){:root{--fg:#e6edf3;--muted:#8d96a0;--bg:#0d1117;--subtle:#161b22;--border:#30363d;--ok-bg:#12261e;--ok-border:#2ea043;--err-bg:#25171c;--err-border:#f85149;--pending-bg:#272115;--pending-border:#9e6a03;}}
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 max(16px,env(safe-area-inset-right)) 0 max(16px,env(safe-area-inset-left));color:var(--fg);background:var(--bg);}
+    p{color:var(--muted);}
+    .row{margin-top:16px;}
+    label{display:block;margin-bottom:8px;font-weight:600;}
+    label.check{font-weight:normal;}
+    input,textarea{width:100%;padding:10px;font-size:16px;border:1px solid var(--border);border-radius:10px;box-sizing:border-box;background:var(--bg);color:var(--fg);}
+    input[type=checkbox]{width:auto;margin-right:8px;}
+    textarea{min-height:96px;}
+    button{min-height:44px;padding:10px 16px;font-size:16px;border-radius:10px;border:1px solid var(--border);background:var(--bg);color:var(--fg);cursor:pointer;margin:6px 6px 0 0;}
+    button:hover{background:var(--subtle);}
+    .ok{padding:12px;border:1px solid var(--ok-border);border-radius:10px;background:var(--ok-bg);}
+    .err{padding:12px;border:1px solid var(--err-border);border-radius:10px;background:var(--err-bg);color:var(--fg);}
+    .pending{padding:12px;border:1px solid var(--pending-border);border-radius:10px;background:var(--pending-bg);}
+    .ok,.err,.pending{white-space:pre-wrap;overflow-wrap:anywhere;}
+  </style>
+</head>
+<body>
+  <h1>New ask</h1>
+  <p>Ask someone to confirm or answer something. They get it through their usual channels; the answer shows up here.</p>
+  <form id="compose">
+    <div class="row">
+      <label for="key">API key (ask scope)</label>
+      <input id="key" type="password" autocomplete="off" required/>
+    </div>
+    <div class="row">
+      <label for="to">To</label>
+      <input id="to" autocomplete="off" placeholder="Contact or rotation name; empty for the default channel"/>
+    </div>
+    <div class="row">
+      <label for="title">Title</label>
+      <input id="title" maxlength="200" required/>
+    </div>
+    <div class="row">
+      <label for="body">Details</label>
+      <textarea id="body"></textarea>
+    </div>
+    <div class="row">
+      <label for="buttons">Buttons</label>
+      <input id="buttons" value="Yes, No" placeholder="Comma separated; empty for a text answer only"/>
+    </div>
+    <div class="row">
+      <label class="check"><input id="comment" type="checkbox"/>Let them add a comment</label>
+    </div>
+    <div class="row">
+      <label for="minutes">Expires in (minutes)</label>
+      <input id="minutes" type="number" min="1" max="10080" value="60"/>
+    </div>
+    <div class="row">
+      <button id="send" type="submit">Send</button>
+    </div>
+  </form>
+  <div id="status" class="row" role="status" aria-live="polite" style="display:none"></div>
+  <script>
+    (function () {
+      function $(id) { return document.getElementById(id); }
+      var m = /[#&]key=([^&]+)/.exec(location.hash);
+      if (m) {
+        $("key").value = decodeURIComponent(m[1]);
+        history.replaceState(null, "", location.pathname + location.search);
+      }
+      var q = new URLSearchParams(location.search);
+      ["to", "title", "body", "buttons"].forEach(function (k) {
+        if (q.has(k)) $(k).value = q.get(k);
+      });
+      function status(kind, text) {
+        var el = $("status");
+        el.className = kind + " row";
+        el.textContent = text;
+        el.style.display = "block";
+      }
+      function api(path, body) {
+        return fetch(path, {
+          method: "POST",
+          headers: { "Authorization": "Bearer " + $("key").value.trim(), "Content-Type": "application/json" },
+          body: body ? JSON.stringify(body) : undefined
+        }).then(function (res) {
+          return res.text().then(function (t) {
+            if (!res.ok) {
+              var err = new Error(res.status === 401 || res.status === 403 ? "The API key was refused." : t.trim() || res.statusText);
+              err.status = res.status;
+              throw err;
+            }
+            return t ? JSON.parse(t) : {};
+          });
+        });
+      }
+      // mcd turns the comma-separated button labels into MCD, with values
+      // made from the labels.
+      function mcd(buttons, comment) {
+        var out = "";
+        var labels = buttons.split(",").map(function (l) { return l.replace(/[\[\]()]/g, "").trim(); }).filter(Boolean);
+        if (labels.length) {
+          out += ":::buttons\n";
+          labels.forEach(function (l) {
+            var value = l.toLowerCase().replace(/[^a-z0-9]+/g, "_").replace(/^_+|_+$/g, "") || "option";
+            out += "- [" + l + "](" + value + ")\n";
+          });
+          out += ":::\n";
+        }
+        if (comment || !labels.length) out += ":::input name=\"comment\" label=\"Comment\" submit=\"Send\"\n:::\n";
+        return out;
+      }
+      function describe(res) {
+        var d = res.data || {};
+        switch (res.last_event_type) {
+        case "user.submitted":
+          return "Answered" + (d.responder_name || d.responder ? " by " + (d.responder_name || d.responder) : "") + ": " +
+            (d.action || "") + (d.action && d.text ? ", " : "") + (d.text ? "“" + d.text + "”" : "");
+        case "request.expired":
+          return "Nobody answered in time.";
+        case "request.cancelled":
+          return "The ask was cancelled.";
+        case "notify.failed":
+          return "The ask could not be delivered.";
+        }
+        return res.last_event_type;
+      }
+      // wait long-polls for the answer. Network errors and 5xx (a restart,
+      // a proxy timeout) are retried; any other refusal, such as a bad key or
+      // an unknown request, will not go away and is shown instead.
+      function wait(id) {
+        api("v1/ask?request_id=" + encodeURIComponent(id)).then(function (res) {
+          status(res.last_event_type === "user.submitted" ? "ok" : "err", describe(res));
+          $("send").disabled = false;
+        }, function (err) {
+          if (err.status && err.status < 500) {
+            status("err", err.message);
+            $("send").disabled = false;
+            return;
+          }
+          setTimeout(function () { wait(id); }, 5000);
+        });
+      }
+      $("compose").onsubmit = function (e) {
+        e.preventDefault();
+        var ask = {
+          title: $("title").value.trim(),
+          body: $("body").value,
+          mcd: mcd($("buttons").value, $("comment").checked),
+          expires_in_seconds: Math.max(1, parseInt($("minutes").value, 10) || 60) * 60,
+          delivery: "poll"
+        };
+        if ($("to").value.trim()) ask.to = $("to").value.trim();
+        $("send").disabled = true;
+        status("pending", "Sending...");
+        api("v1/ask", ask).then(function (res) {
+          status("pending", "Sent. Waiting for the answer...\n\nLink: " + res.interaction_url);
+          wait(res.request_id);
+        }).catch(function (err) {
+          $("send").disabled = false;
+          status("err", err && err.message ? err.message : String(err));
+        });
+      };
+    })();
+  </script>
+</body>
+</html>`
+
+func (s *server) handleCompose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	setPageSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(composePage))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Addressing people. Besides forwarding, the contact directory lets an asker
+// name who should answer rather than where to push: an ask with "to": "alice"
+// is sent to alice's channels, and her link is tagged with her name, so
+// user.submitted reports "responder": "alice" as for a delegate. Responders
+// listed without channels of their own are looked up the same way. A contact
+// without channels, like an ask without `to`, falls back to the tenant's or
+// the server's channels.
+//
+// Contacts can also say how they want to be reached: `priorities` picks other
+// channels for asks of a level (say, a phone call for critical ones), and
+// `working_hours` in `timezone` limits when asks addressed to them are pushed.
+// Outside those hours an ask goes out anyway (outside_hours: notify), to the
+// next contact who is working (next: the following members of the rotation
+// it came through, then the `fallback` chain), or waits until the hours begin
+// (queue), as if it had a send_at. Critical asks always go out at once. The
+// decision is recorded as a request.routed event after request.created.
+
+const (
+	outsideHoursNotify = "notify"
+	outsideHoursNext   = "next"
+	outsideHoursQueue  = "queue"
+)
+
+// validateContactConfigs checks the contacts directory and parses working
+// hours.
+func validateContactConfigs(c *Config) error {
+	seen := map[string]struct{}{}
+	for i := range c.Contacts {
+		ct := &c.Contacts[i]
+		ct.Name = strings.TrimSpace(ct.Name)
+		if ct.Name == "" {
+			return errors.New("contacts: name is required")
+		}
+		if _, dup := seen[ct.Name]; dup {
+			return fmt.Errorf("contacts: duplicate name %q", ct.Name)
+		}
+		seen[ct.Name] = struct{}{}
+	}
+	for i := range c.Contacts {
+		ct := &c.Contacts[i]
+		for level := range ct.Priorities {
+			if !isPriorityLevel(level) {
+				return fmt.Errorf("contacts %q: priorities: unknown level %q", ct.Name, level)
+			}
+		}
+		ct.Fallback = strings.TrimSpace(ct.Fallback)
+		if _, ok := seen[ct.Fallback]; ct.Fallback != "" && (!ok || ct.Fallback == ct.Name) {
+			return fmt.Errorf("contacts %q: fallback must name another contact", ct.Name)
+		}
+		ct.OutsideHours = strings.ToLower(strings.TrimSpace(ct.OutsideHours))
+		switch ct.OutsideHours {
+		case "":
+			ct.OutsideHours = outsideHoursNotify
+		case outsideHoursNotify, outsideHoursNext, outsideHoursQueue:
+		default:
+			return fmt.Errorf("contacts %q: outside_hours must be notify, next or queue", ct.Name)
+		}
+		if len(ct.WorkingHours) == 0 {
+			continue
+		}
+		loc, err := time.LoadLocation(strings.TrimSpace(ct.Timezone))
+		if err != nil {
+			return fmt.Errorf("contacts %q: invalid timezone %q", ct.Name, ct.Timezone)
+		}
+		if ct.hours, err = parseWeeklyHours(ct.WorkingHours, loc); err != nil {
+			return fmt.Errorf("contacts %q: working_hours %w", ct.Name, err)
+		}
+	}
+	return nil
+}
+
+// working reports whether the contact takes asks at t.
+func (ct ContactConfig) working(t time.Time) bool {
+	return ct.hours == nil || ct.hours.contains(t)
+}
+
+// resolveTo checks askRequest.To against the contact directory. A rotation
+// name is replaced by the contact on call, see rotations.go, and the
+// contact's working hours may pass the ask on or hold it back.
+func (s *server) resolveTo(ctx context.Context, ar *askRequest) error {
+	ar.To = addressees(strings.TrimSpace(string(ar.To)))
+	if ar.To == "" {
+		return nil
+	}
+	if ar.Responders != nil {
+		return badAskError("to cannot be combined with responders; name the contacts in responders.list")
+	}
+	if rc, ok := s.cfg().rotation(string(ar.To)); ok {
+		contact, _, err := s.onCall(ctx, rc, time.Now())
+		if err != nil {
+			return err
+		}
+		ar.rotation, ar.To = rc.Name, addressees(contact)
+	} else if _, ok := s.cfg().contact(string(ar.To)); !ok {
+		return badAskError("to must name a configured contact or rotation")
+	}
+	s.routeByHours(ar)
+	return nil
+}
+
+// routeByHours applies the working hours of the `to` contact at the time the
+// ask would be pushed, and notes the decision in ar.routed.
+func (s *server) routeByHours(ar *askRequest) {
+	at := time.Now()
+	if !ar.sendAt.IsZero() {
+		at = ar.sendAt
+	}
+	ct, ok := s.cfg().contact(string(ar.To))
+	if !ok || ct.working(at) || ar.Priority == priorityCritical {
+		return
+	}
+	route := map[string]any{"contact": ct.Name, "reason": "outside_working_hours", "decision": outsideHoursNotify}
+	switch ct.OutsideHours {
+	case outsideHoursNext:
+		for _, name := range s.nextContacts(ct.Name, ar.rotation) {
+			if next, ok := s.cfg().contact(name); ok && next.working(at) {
+				route["decision"], route["to"] = outsideHoursNext, name
+				ar.To = addressees(name)
+				break
+			}
+		}
+	case outsideHoursQueue:
+		if start := ct.hours.next(at); !start.IsZero() {
+			route["decision"], route["send_at"] = outsideHoursQueue, start.UTC().Format(time.RFC3339)
+			ar.sendAt = start
+		}
+	}
+	ar.routed = route
+}
+
+// nextContacts lists who an ask for name may pass to, in order: the members
+// of rotation after name, then name's fallback chain.
+func (s *server) nextContacts(name, rotation string) []string {
+	var out []string
+	if rc, ok := s.cfg().rotation(rotation); ok {
+		if i := slices.Index(rc.Contacts, name); i >= 0 {
+			for j := 1; j < len(rc.Contacts); j++ {
+				out = append(out, rc.Contacts[(i+j)%len(rc.Contacts)])
+			}
+		}
+	}
+	for ct, ok := s.cfg().contact(name); ok && ct.Fallback != ""; ct, ok = s.cfg().contact(ct.Fallback) {
+		if ct.Fallback == name || slices.Contains(out, ct.Fallback) {
+			break
+		}
+		out = append(out, ct.Fallback)
+	}
+	return slices.DeleteFunc(out, func(n string) bool { return n == name })
+}
+
+// contactTarget returns the channels of the named contact for asks of level;
+// ok=false means the name is not a contact with channels of their own.
+func (s *server) contactTarget(name, level string) (notifyTarget, bool) {
+	ct, ok := s.cfg().contact(name)
+	if !ok {
+		return notifyTarget{}, false
+	}
+	if pc := ct.Priorities[level]; strings.TrimSpace(pc.ServerChanSendKey) != "" || len(pc.AppriseURLs) > 0 {
+		return notifyTarget{ServerChanSendKey: pc.ServerChanSendKey, AppriseURLs: pc.AppriseURLs}, true
+	}
+	if strings.TrimSpace(ct.ServerChanSendKey) == "" && len(ct.AppriseURLs) == 0 {
+		return notifyTarget{}, false
+	}
+	return notifyTarget{ServerChanSendKey: ct.ServerChanSendKey, AppriseURLs: ct.AppriseURLs}, true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// CORS for the API. A single-page app or a browser extension that calls
+// /v1/* directly is stopped by the browser unless the server allows its
+// origin. cors_allowed_origins lists the origins that may (scheme, host and
+// port, such as https://app.example.com or chrome-extension://<id>; "*" for
+// any). For those, /v1/* answers preflight OPTIONS requests itself, before
+// authentication, and its responses carry the Access-Control-* headers.
+// Authorization and Content-Type are always allowed as request headers;
+// cors_allowed_headers adds more. cors_allow_credentials lets the browser
+// send cookies and HTTP auth along, which "*" cannot be combined with.
+//
+// CORS only decides what the browser lets a page read; every call still
+// needs an API key, so a browser app holds a key of its own (a tenant or
+// read-only one, see apikeys.go).
+
+const corsMaxAgeSeconds = "600"
+
+var (
+	corsDefaultHeaders = []string{"Authorization", "Content-Type"}
+	corsExposedHeaders = "X-Ask4Me-Request-Id, Retry-After"
+	corsMethods        = "GET, POST, PUT, PATCH, DELETE"
+)
+
+func (c *Config) normalizeCORS() error {
+	origins := c.CORSAllowedOrigins[:0]
+	for _, o := range c.CORSAllowedOrigins {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+				return fmt.Errorf("invalid cors_allowed_origins entry %q: must be scheme://host[:port] or *", o)
+			}
+		}
+		origins = append(origins, o)
+	}
+	c.CORSAllowedOrigins = origins
+	headers := c.CORSAllowedHeaders[:0]
+	for _, h := range c.CORSAllowedHeaders {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	c.CORSAllowedHeaders = headers
+	if c.CORSAllowCredentials && c.corsAllows("*") {
+		return errors.New("cors_allow_credentials cannot be combined with cors_allowed_origins *")
+	}
+	return nil
+}
+
+// corsAllows reports whether origin is in cors_allowed_origins, or any
+// origin is allowed.
+func (c *Config) corsAllows(origin string) bool {
+	for _, o := range c.CORSAllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds the CORS headers to /v1/* responses for allowed origins and
+// answers their preflight requests.
+func (s *server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(cfg.CORSAllowedOrigins) == 0 || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !cfg.corsAllows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cfg.corsAllows("*") {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.CORSAllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsMethods)
+			h.Set("Access-Control-Allow-Headers", strings.Join(slices.Concat(corsDefaultHeaders, cfg.CORSAllowedHeaders), ", "))
+			h.Set("Access-Control-Max-Age", corsMaxAgeSeconds)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The link token in ?k= is all a POST to /r/{id}/... needs, so without more
+// checks any site that learns a link could make a visitor's browser answer
+// it. POSTs are therefore only accepted when:
+//
+//   - the Origin (or, without one, the Referer) is base_url's,
+//     public_base_url's or the request's own host. Clients that send
+//     neither, like ServerChan action links, pass.
+//   - the form carries the csrf field rendered into the page (or the
+//     X-Ask4Me-CSRF header). Each render gets a fresh value signed with a
+//     random per-browser secret kept in an HttpOnly cookie, so another site
+//     can neither read nor forge one. Action link callbacks (callback=1) have
+//     no page and skip this; the Origin check still applies to them.
+//
+// Pages are also sent with headers that forbid framing and keep the link out
+// of Referer headers sent to other sites (no-referrer would turn the Origin
+// of our own POSTs into "null").
+
+const (
+	csrfCookieName = "ask4me_csrf"
+	csrfField      = "csrf"
+	csrfHeader     = "X-Ask4Me-CSRF"
+)
+
+func setPageSecurityHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Content-Security-Policy", "frame-ancestors 'none'")
+	h.Set("Referrer-Policy", "same-origin")
+	h.Set("X-Content-Type-Options", "nosniff")
+}
+
+func csrfMAC(secret, requestID, tokenHash, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(requestID + "|" + tokenHash + "|" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// csrfToken returns a fresh token for a page about to be rendered, setting
+// the browser's secret cookie first if it has none. Bundle pages (see
+// bundle.go) get a cookie of their own.
+func (s *server) csrfToken(w http.ResponseWriter, r *http.Request, requestID, tokenHash string) string {
+	secret := ""
+	if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		secret = c.Value
+	} else {
+		cookiePath := s.cfg().PathPrefix + "/r/"
+		if strings.HasPrefix(r.URL.Path, bundlePathPrefix) {
+			cookiePath = s.cfg().PathPrefix + bundlePathPrefix
+		}
+		secret = genToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    secret,
+			Path:     cookiePath,
+			HttpOnly: true,
+			Secure:   s.secureCookies(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	nonce := strings.ToLower(genToken()[:16])
+	return nonce + "." + csrfMAC(secret, requestID, tokenHash, nonce)
+}
+
+// validCSRF checks the token of a POST; the form must already be parsed.
+func validCSRF(r *http.Request, requestID, tokenHash string) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	tok := r.Header.Get(csrfHeader)
+	if tok == "" {
+		tok = r.PostFormValue(csrfField)
+	}
+	nonce, mac, ok := strings.Cut(tok, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(mac), []byte(csrfMAC(c.Value, requestID, tokenHash, nonce))) == 1
+}
+
+// sameOrigin reports whether a POST comes from one of our own pages, as far
+// as the browser tells.
+func (s *server) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		ref := r.Header.Get("Referer")
+		if ref == "" {
+			return true
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	o, err := url.Parse(origin)
+	if err != nil || o.Host == "" {
+		return false
+	}
+	for _, base := range []string{s.cfg().BaseURL, s.cfg().PublicBaseURL} {
+		if b, err := url.Parse(base); err == nil && base != "" && strings.EqualFold(o.Scheme, b.Scheme) && strings.EqualFold(o.Host, b.Host) {
+			return true
+		}
+	}
+	return strings.EqualFold(o.Host, s.requestHost(r))
+}
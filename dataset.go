@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// Dataset export. GET /v1/export?format=dataset turns the answered asks into
+// prompt/response pairs, one JSON object per line, so that the feedback
+// people gave can go straight into a fine-tuning or RLHF pipeline:
+//
+//	{"prompt": "Deploy v1.4?\n\nThe canary is green.", "response": "approve",
+//	 "rejected": ["reject"], "metadata": {"request_id": "req_...", ...}}
+//
+// The prompt is the ask's title and body; the response is the answer's text,
+// or the chosen action when there is none. For button asks, rejected lists
+// the actions that were offered and not chosen, for preference training.
+// Unanswered requests are left out, and so are those a machine answered: an
+// auto-answer policy or a timeout default_action is not human feedback.
+
+type datasetRecord struct {
+	Prompt   string          `json:"prompt"`
+	Response string          `json:"response"`
+	Action   string          `json:"action"`
+	Text     string          `json:"text,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Rejected []string        `json:"rejected,omitempty"`
+	Metadata datasetMetadata `json:"metadata"`
+}
+
+type datasetMetadata struct {
+	RequestID       string   `json:"request_id"`
+	Status          string   `json:"status"`
+	Priority        string   `json:"priority,omitempty"`
+	SessionID       string   `json:"session_id,omitempty"`
+	ParentRequestID string   `json:"parent_request_id,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	Responder       string   `json:"responder,omitempty"`
+	ResponderName   string   `json:"responder_name,omitempty"`
+	CreatedAt       string   `json:"created_at"`
+	AnsweredAt      string   `json:"answered_at"`
+	ResponseSeconds int64    `json:"response_seconds"`
+}
+
+// datasetRecord turns an answered export record into a dataset line;
+// ok=false means rec has no answer from a person.
+func (s *store) datasetRecord(ctx context.Context, rec exportRecord) (datasetRecord, bool, error) {
+	a := rec.Answer
+	if a == nil {
+		return datasetRecord{}, false, nil
+	}
+	submitted, ok, err := s.getLatestEventByTypes(ctx, rec.RequestID, []string{"user.submitted"})
+	if err != nil {
+		return datasetRecord{}, false, err
+	}
+	if ok {
+		var sd struct {
+			AnsweredBy string `json:"answered_by"`
+		}
+		if json.Unmarshal(submitted.Data, &sd) == nil && sd.AnsweredBy != "" {
+			return datasetRecord{}, false, nil
+		}
+	}
+	tags, err := s.requestTags(ctx, rec.RequestID)
+	if err != nil {
+		return datasetRecord{}, false, err
+	}
+	d := datasetRecord{
+		Prompt:   rec.Title,
+		Response: a.Text,
+		Action:   a.Action,
+		Text:     a.Text,
+		Payload:  a.Payload,
+		Metadata: datasetMetadata{
+			RequestID:       rec.RequestID,
+			Status:          rec.Status,
+			Priority:        rec.Priority,
+			SessionID:       rec.SessionID,
+			ParentRequestID: rec.ParentRequestID,
+			Tags:            tags,
+			Responder:       a.Responder,
+			ResponderName:   a.ResponderName,
+			CreatedAt:       rec.CreatedAt,
+			AnsweredAt:      a.CreatedAt,
+		},
+	}
+	if rec.Body != "" {
+		d.Prompt += "\n\n" + rec.Body
+	}
+	if d.Response == "" {
+		d.Response = a.Action
+	}
+	buttons := parseMCD(rec.MCD).Buttons
+	if slices.ContainsFunc(buttons, func(b buttonSpec) bool { return b.Value == a.Action }) {
+		for _, b := range buttons {
+			if b.Value != a.Action && !slices.Contains(d.Rejected, b.Value) {
+				d.Rejected = append(d.Rejected, b.Value)
+			}
+		}
+	}
+	if created, err := time.Parse(time.RFC3339, rec.CreatedAt); err == nil {
+		if answered, err := time.Parse(time.RFC3339, a.CreatedAt); err == nil {
+			d.Metadata.ResponseSeconds = max(int64(answered.Sub(created)/time.Second), 0)
+		}
+	}
+	return d, true, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Ask deduplication. An agent that retries a failed call, or runs the same
+// step twice, would otherwise send the same question twice and could get two
+// conflicting answers. With a dedup window (ask_dedup_window_seconds, or an
+// ask's own dedup_window_seconds), an ask that matches one created within the
+// window is not created again: the caller waits on, or streams, the existing
+// request instead, answered or not. Matching asks have the same title, body,
+// MCD and JSON Forms schema, go to the same people (to, responders and their
+// mode) and expire the same way (expires_in_seconds, default_action). A
+// negative dedup_window_seconds opts an ask out. Scheduled occurrences are
+// never deduplicated.
+
+const maxDedupWindowSeconds = 86400
+
+// duplicateAskError is returned by createAskWithRequestID when the ask
+// repeats requestID.
+type duplicateAskError struct {
+	requestID string
+}
+
+func (e duplicateAskError) Error() string {
+	return "duplicate of " + e.requestID
+}
+
+// duplicateOf returns the request that err says the ask duplicates.
+func duplicateOf(err error) (string, bool) {
+	var de duplicateAskError
+	if errors.As(err, &de) {
+		return de.requestID, true
+	}
+	return "", false
+}
+
+func normalizeDedupWindow(ar *askRequest) error {
+	if ar.DedupWindowSeconds > maxDedupWindowSeconds {
+		return badAskError("dedup_window_seconds must be at most 86400")
+	}
+	return nil
+}
+
+// dedupWindow returns how far back to look for a duplicate of ar; 0 means
+// the ask is not deduplicated.
+func (s *server) dedupWindow(ar askRequest) time.Duration {
+	if ar.scheduleID != "" || ar.DedupWindowSeconds < 0 {
+		return 0
+	}
+	n := ar.DedupWindowSeconds
+	if n == 0 {
+		n = s.cfg().AskDedupWindowSeconds
+	}
+	return time.Duration(n) * time.Second
+}
+
+// askContentHash identifies a normalized ask by what is asked, of whom, and
+// how it ends unanswered. Tenants never share a request.
+func askContentHash(ar askRequest) string {
+	content := struct {
+		Tenant            string          `json:"tenant"`
+		Title             string          `json:"title"`
+		Body              string          `json:"body"`
+		MCD               string          `json:"mcd"`
+		To                addressees      `json:"to"`
+		Responders        *respondersSpec `json:"responders"`
+		Schema            string          `json:"schema"`
+		UISchema          string          `json:"uischema"`
+		ExpiresIn         int             `json:"expires_in"`
+		ExpiresInBusiness int             `json:"expires_in_business"`
+		DefaultAction     string          `json:"default_action"`
+	}{
+		Tenant:            ar.Tenant,
+		Title:             ar.Title,
+		Body:              ar.Body,
+		MCD:               ar.MCD,
+		To:                ar.To,
+		Responders:        ar.Responders,
+		ExpiresIn:         ar.ExpiresInSeconds,
+		ExpiresInBusiness: ar.ExpiresInBusinessSeconds,
+		DefaultAction:     ar.DefaultAction,
+	}
+	if ar.JsonForms != nil {
+		content.Schema = string(bytes.TrimSpace(ar.JsonForms.Schema))
+		content.UISchema = string(bytes.TrimSpace(ar.JsonForms.UISchema))
+	}
+	b, _ := json.Marshal(content)
+	return sha256Hex(string(b))
+}
+
+// findDuplicateAsk returns the newest request with the given content hash
+// created since since.
+func (s *store) findDuplicateAsk(ctx context.Context, hash string, since time.Time) (string, bool, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT request_id FROM requests WHERE content_hash=? AND created_at>=? ORDER BY created_at DESC LIMIT 1`,
+		hash, since.Unix(),
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+// claimAskContent checks ar against recent asks. It returns the hash to store
+// with the new request ("" when ar is not deduplicated) and a func to call
+// once the request and its hash are stored; until then other deduplicated
+// asks wait, so that concurrent retries do not both get through.
+func (s *server) claimAskContent(ctx context.Context, requestID string, ar askRequest) (string, func(), error) {
+	window := s.dedupWindow(ar)
+	if window <= 0 {
+		return "", func() {}, nil
+	}
+	hash := askContentHash(ar)
+	s.dedupMu.Lock()
+	dup, ok, err := s.db.findDuplicateAsk(ctx, hash, time.Now().Add(-window))
+	if err != nil {
+		s.dedupMu.Unlock()
+		return "", nil, err
+	}
+	if ok {
+		s.dedupMu.Unlock()
+		slog.Info("ask deduplicated", "request_id", requestID, "duplicate_of", dup)
+		return "", nil, duplicateAskError{requestID: dup}
+	}
+	return hash, s.dedupMu.Unlock, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// default_action turns expiry into an answer: instead of request.expired the
+// request ends with user.submitted carrying the default action and
+// answered_by "timeout_default", so unattended callers always get a decision.
+
+func normalizeDefaultAction(ar *askRequest) error {
+	ar.DefaultAction = strings.TrimSpace(ar.DefaultAction)
+	if ar.DefaultAction == "" {
+		return nil
+	}
+	if ar.Responders != nil && isMultiAnswerMode(ar.Responders.Mode) {
+		return badAskError("default_action cannot be combined with collect or quorum responders")
+	}
+	if len(ar.Steps) > 0 {
+		return badAskError("default_action cannot be combined with steps")
+	}
+	if ar.JsonForms != nil && len(strings.TrimSpace(string(ar.JsonForms.Schema))) > 0 {
+		return badAskError("default_action cannot be combined with jsonforms")
+	}
+	spec := parseMCD(ar.MCD)
+	if len(spec.Buttons) == 0 {
+		return nil
+	}
+	for _, b := range spec.Buttons {
+		if b.Value == ar.DefaultAction {
+			return nil
+		}
+	}
+	return badAskError("default_action must match one of the mcd buttons")
+}
+
+func (s *store) getDefaultAction(ctx context.Context, reqID string) (string, error) {
+	var action sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT default_action FROM requests WHERE request_id=?`, reqID).Scan(&action); err != nil {
+		return "", err
+	}
+	return action.String, nil
+}
+
+// answerByDefault records the default action as the request's answer. It
+// reports false when the request has no default or was answered meanwhile.
+func (s *server) answerByDefault(ctx context.Context, requestID string) bool {
+	action, err := s.db.getDefaultAction(ctx, requestID)
+	if err != nil || action == "" {
+		return false
+	}
+	if err := s.db.insertAnswer(ctx, requestID, "", action, "", sql.NullString{}); err != nil {
+		// A unique violation means a real answer won the race.
+		return isUniqueViolation(err)
+	}
+	_ = s.db.deleteDrafts(ctx, requestID)
+	_ = s.db.updateRequestStatus(ctx, requestID, "submitted")
+	ev := s.mustNewEvent(ctx, requestID, "user.submitted", map[string]any{
+		"action":      action,
+		"text":        "",
+		"answered_by": "timeout_default",
+	})
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+	return true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Delegation lets the person holding an interaction link hand the request to
+// someone from the configured contact directory. The delegate gets a fresh
+// token (tagged with their name, so user.submitted reports who answered) and
+// the delegator's link stops accepting answers.
+
+// ContactConfig is one entry of the `contacts` directory. The channel and
+// working hours preferences are described in contacts.go.
+type ContactConfig struct {
+	Name              string   `yaml:"name"`
+	ServerChanSendKey string   `yaml:"serverchan_sendkey"`
+	AppriseURLs       []string `yaml:"apprise_urls"`
+	// Priorities replaces the channels above for asks of a level.
+	Priorities   map[string]ContactChannels `yaml:"priorities"`
+	Timezone     string                     `yaml:"timezone"`
+	WorkingHours []string                   `yaml:"working_hours"`
+	// OutsideHours is what an ask does outside WorkingHours: notify (the
+	// default), next or queue.
+	OutsideHours string `yaml:"outside_hours"`
+	Fallback     string `yaml:"fallback"`
+
+	// Parsed by validateContactConfigs from WorkingHours; nil means always.
+	hours *weeklyHours
+}
+
+// ContactChannels are the channels a contact prefers for one priority level.
+type ContactChannels struct {
+	ServerChanSendKey string   `yaml:"serverchan_sendkey"`
+	AppriseURLs       []string `yaml:"apprise_urls"`
+}
+
+func (c *Config) contact(name string) (ContactConfig, bool) {
+	for _, ct := range c.Contacts {
+		if ct.Name == name {
+			return ct, true
+		}
+	}
+	return ContactConfig{}, false
+}
+
+func (c *Config) contactNames() []string {
+	out := make([]string, 0, len(c.Contacts))
+	for _, ct := range c.Contacts {
+		out = append(out, ct.Name)
+	}
+	return out
+}
+
+func (s *store) setTokenDelegate(ctx context.Context, reqID, tokenHash, delegate string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE tokens SET delegated_to=? WHERE request_id=? AND token_hash=?`, delegate, reqID, tokenHash)
+	return err
+}
+
+// getTokenDelegate returns who a token forwarded its request to, if anyone.
+func (s *store) getTokenDelegate(ctx context.Context, reqID, tokenHash string) (string, error) {
+	var delegate sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT delegated_to FROM tokens WHERE request_id=? AND token_hash=?`, reqID, tokenHash).Scan(&delegate)
+	if err != nil {
+		return "", err
+	}
+	return delegate.String, nil
+}
+
+// delegateAsk loads what a notification to a new responder of reqID needs:
+// the question and its priority.
+func (s *store) delegateAsk(ctx context.Context, reqID string) (askRequest, error) {
+	var ar askRequest
+	var priority, bodyEncoding, bodyData sql.NullString
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT r.title, r.body, r.mcd, r.priority, b.encoding, b.data FROM requests r`+bodyJoin+` WHERE r.request_id=?`, reqID,
+	).Scan(&ar.Title, &ar.Body, &ar.MCD, &priority, &bodyEncoding, &bodyData); err != nil {
+		return askRequest{}, err
+	}
+	ar.Body = bodyText(ar.Body, bodyEncoding, bodyData)
+	ar.Priority = priority.String
+	if ar.Priority == "" {
+		ar.Priority = priorityNormal
+	}
+	return ar, nil
+}
+
+// handleUserForward serves POST /r/{id}/forward.
+func (s *server) handleUserForward(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, tokenHash, status, responder string, expiresAtUnix int64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isTerminalStatus(status) {
+		http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+		return
+	}
+	ctx := r.Context()
+	mode, _, err := s.db.getRespondersMode(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if isMultiAnswerMode(mode) {
+		http.Error(w, "forwarding is not available for multi-answer requests", http.StatusConflict)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("contact"))
+	contact, ok := s.cfg().contact(name)
+	if !ok {
+		http.Error(w, "unknown contact", http.StatusBadRequest)
+		return
+	}
+	if name == responder {
+		http.Error(w, "cannot forward to yourself", http.StatusBadRequest)
+		return
+	}
+	note := truncate(strings.TrimSpace(r.FormValue("note")), 500)
+
+	ar, err := s.db.delegateAsk(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if note != "" {
+		ar.Body = ar.Body + "\n\n" + note
+	}
+
+	delegateToken := genToken()
+	if err := s.db.insertToken(ctx, requestID, sha256Hex(delegateToken), contact.Name, time.Unix(expiresAtUnix, 0)); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.setTokenDelegate(ctx, requestID, tokenHash, contact.Name); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	delegateURL := s.makeInteractionURL(requestID, delegateToken)
+	notifyURL := delegateURL
+	if s.cfg().ShortLinks {
+		notifyURL, err = s.shortenURL(ctx, requestID, delegateURL, time.Now(), time.Unix(expiresAtUnix, 0))
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := map[string]any{
+		"to":              contact.Name,
+		"interaction_url": delegateURL,
+	}
+	if notifyURL != delegateURL {
+		data["short_url"] = notifyURL
+	}
+	if responder != "" {
+		data["from"] = responder
+	}
+	if note != "" {
+		data["note"] = note
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.delegated", data)
+	_ = s.persistTerminalAware(ctx, ev)
+
+	go s.notifyDelegate(context.Background(), requestID, ar, contact, notifyURL)
+
+	http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+}
+
+// notifyDelegate pushes the new link to the delegate. A failure is reported as
+// notify.responder_failed; the request stays open for the delegate's link.
+func (s *server) notifyDelegate(ctx context.Context, requestID string, ar askRequest, contact ContactConfig, interactionURL string) {
+	target, ok := s.contactTarget(contact.Name, ar.Priority)
+	if !ok {
+		target = s.notifyTargetFor(ar)
+	}
+	fields, err := s.deliverNotification(ctx, target, ar, interactionURL)
+	if err != nil {
+		fields = notifyErrorFields(err)
+		fields["responder"] = contact.Name
+		ev := s.mustNewEvent(ctx, requestID, "notify.responder_failed", fields)
+		_ = s.persistTerminalAware(ctx, ev)
+		return
+	}
+	fields["responder"] = contact.Name
+	ev := s.mustNewEvent(ctx, requestID, "notify.sent", fields)
+	_ = s.persistTerminalAware(ctx, ev)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Result delivery. By default the caller of POST /v1/ask waits for the result,
+// on the open connection or an SSE stream ("stream"). A fire-and-forget caller
+// sets delivery to "callback" (the result goes to callback_url) or "poll" (the
+// caller checks GET /v1/requests/{id} later): the server answers 202 as soon as
+// the ask is stored and holds neither a connection nor a hub subscription for
+// it. Retrying such an ask with its request_id answers 202 again, with the
+// current status. delivery cannot be combined with stream=true.
+
+const (
+	deliveryStream   = "stream"
+	deliveryCallback = "callback"
+	deliveryPoll     = "poll"
+)
+
+func normalizeDelivery(ar *askRequest) error {
+	switch ar.Delivery {
+	case "", deliveryStream:
+		ar.Delivery = ""
+	case deliveryCallback:
+		if ar.CallbackURL == "" {
+			return badAskError("delivery callback needs callback_url")
+		}
+	case deliveryPoll:
+	default:
+		return badAskError("delivery must be stream, callback or poll")
+	}
+	return nil
+}
+
+// detached reports whether the caller of ar does not wait for its result.
+func (ar askRequest) detached() bool {
+	return ar.Delivery == deliveryCallback || ar.Delivery == deliveryPoll
+}
+
+// writeAskAccepted answers a detached ask with where it stands.
+// interactionURL is only known when this call created the request.
+func (s *server) writeAskAccepted(ctx context.Context, w http.ResponseWriter, requestID, delivery, interactionURL string) {
+	status, expiresAt, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{
+		"request_id": requestID,
+		"status":     status,
+		"delivery":   delivery,
+		"expires_at": time.Unix(expiresAt, 0).UTC().Format(time.RFC3339),
+	}
+	if interactionURL != "" {
+		resp["interaction_url"] = interactionURL
+	}
+	w.Header().Set("X-Ask4Me-Request-Id", requestID)
+	writeJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Storage backends. Queries are written once in SQLite syntax with ?
+// placeholders; each dialect rewrites them for its driver. Schemas come from
+// migrations/<dialect> (see migrate.go).
+
+const (
+	databaseDriverSQLite   = "sqlite"
+	databaseDriverPostgres = "postgres"
+	databaseDriverMySQL    = "mysql"
+	// databaseDriverMemory keeps everything in an in-process SQLite database
+	// that is lost on exit.
+	databaseDriverMemory = "memory"
+)
+
+type dialect interface {
+	name() string
+	driverName() string
+	// migrations names the directory under migrations/ to apply.
+	migrations() string
+	// rebind rewrites a SQLite-flavoured query for this backend.
+	rebind(query string) string
+	// searchMatch returns a condition on requests r with one placeholder
+	// that holds for requests whose request_search row has every term, and
+	// the argument for it (see search.go).
+	searchMatch(terms []string) (cond string, arg string)
+}
+
+func dialectFor(driver string) (dialect, error) {
+	switch driver {
+	case "", databaseDriverSQLite:
+		return sqliteDialect{}, nil
+	case databaseDriverPostgres:
+		return &postgresDialect{}, nil
+	case databaseDriverMySQL:
+		return &mysqlDialect{}, nil
+	case databaseDriverMemory:
+		return memoryDialect{}, nil
+	}
+	return nil, fmt.Errorf("unknown database_driver %q (want sqlite, postgres, mysql or memory)", driver)
+}
+
+// dbConn is a *sql.DB that rebinds every query for its dialect, so store
+// methods stay backend-agnostic. For file SQLite the embedded DB is the
+// single write connection and reads go to a separate pool (see
+// writequeue.go).
+type dbConn struct {
+	*sql.DB
+	dialect dialect
+	read    *sql.DB
+	events  *eventWriter
+}
+
+func (c *dbConn) reader() *sql.DB {
+	if c.read != nil {
+		return c.read
+	}
+	return c.DB
+}
+
+func (c *dbConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.reader().QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.reader().QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+func (c *dbConn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c *dbConn) QueryRow(query string, args ...any) *sql.Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+// execer is a dbConn or a dbTx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// dbTx is a transaction that rebinds its statements like dbConn.
+type dbTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *dbTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, t.dialect.rebind(query), args...)
+}
+
+// inTx runs fn in a transaction on the write connection, which is committed
+// when fn returns nil and rolled back otherwise. fn must not use c itself:
+// for SQLite that connection is the transaction.
+func (c *dbConn) inTx(ctx context.Context, fn func(tx *dbTx) error) error {
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(&dbTx{Tx: tx, dialect: c.dialect}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *dbConn) Close() error {
+	if c.read != nil {
+		_ = c.read.Close()
+	}
+	return c.DB.Close()
+}
+
+// openDatabase opens the configured backend. Callers run migrations.
+func openDatabase(cfg Config) (*dbConn, error) {
+	d, err := dialectFor(cfg.DatabaseDriver)
+	if err != nil {
+		return nil, err
+	}
+	dsn := cfg.DatabaseURL
+	switch d.name() {
+	case databaseDriverSQLite:
+		dsn = sqliteDSN(cfg.SQLitePath, cfg.SQLiteBusyTimeoutMS, "_txlock=immediate")
+	case databaseDriverMemory:
+		dsn = ":memory:"
+	}
+	db, err := sql.Open(d.driverName(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d.driverName() == "sqlite" {
+		// SQLite allows a single writer; serialising writes avoids
+		// SQLITE_BUSY. For :memory: the one connection is the database, so
+		// it must never be recycled (and there is no read pool either).
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect %s: %w", d.name(), err)
+	}
+	conn := &dbConn{DB: db, dialect: d}
+	if d.name() == databaseDriverSQLite {
+		read, err := openSQLiteReader(cfg)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		conn.read = read
+		conn.events = newEventWriter(db)
+	}
+	return conn, nil
+}
+
+// isUniqueViolation reports whether err is a primary key or unique constraint
+// failure on any backend.
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique") || strings.Contains(msg, "duplicate")
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string               { return databaseDriverSQLite }
+func (sqliteDialect) driverName() string         { return "sqlite" }
+func (sqliteDialect) rebind(query string) string { return query }
+func (sqliteDialect) migrations() string         { return "sqlite" }
+
+// searchMatch matches every term as a prefix with FTS5.
+func (sqliteDialect) searchMatch(terms []string) (string, string) {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + t + `"*`
+	}
+	return `r.request_id IN (SELECT request_id FROM request_search WHERE request_search MATCH ?)`, strings.Join(quoted, " ")
+}
+
+type memoryDialect struct{ sqliteDialect }
+
+func (memoryDialect) name() string { return databaseDriverMemory }
+
+type postgresDialect struct {
+	cache sync.Map
+}
+
+func (*postgresDialect) name() string       { return databaseDriverPostgres }
+func (*postgresDialect) driverName() string { return "pgx" }
+func (*postgresDialect) migrations() string { return "postgres" }
+
+// searchMatch matches every term as a prefix in the tsvector column.
+func (*postgresDialect) searchMatch(terms []string) (string, string) {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		parts[i] = t + ":*"
+	}
+	return `r.request_id IN (SELECT request_id FROM request_search WHERE doc @@ to_tsquery('simple', ?))`, strings.Join(parts, " & ")
+}
+
+// rebind numbers ? placeholders as $1, $2, ... outside string literals.
+func (d *postgresDialect) rebind(query string) string {
+	if v, ok := d.cache.Load(query); ok {
+		return v.(string)
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	inQuote := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inQuote = !inQuote
+			b.WriteByte(c)
+		case c == '?' && !inQuote:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	out := b.String()
+	d.cache.Store(query, out)
+	return out
+}
+
+type mysqlDialect struct {
+	cache sync.Map
+}
+
+func (*mysqlDialect) name() string       { return databaseDriverMySQL }
+func (*mysqlDialect) driverName() string { return "mysql" }
+func (*mysqlDialect) migrations() string { return "mysql" }
+
+// searchMatch requires every term as a prefix in boolean mode.
+func (*mysqlDialect) searchMatch(terms []string) (string, string) {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		parts[i] = "+" + t + "*"
+	}
+	return `r.request_id IN (SELECT request_id FROM request_search WHERE MATCH(title, body, answer) AGAINST (? IN BOOLEAN MODE))`, strings.Join(parts, " ")
+}
+
+var (
+	onConflictRe = regexp.MustCompile(`(?i)ON\s+CONFLICT\s*\([^)]*\)\s*DO\s+UPDATE\s+SET`)
+	excludedRe   = regexp.MustCompile(`\bexcluded\.(\w+)`)
+)
+
+// rebind turns SQLite upserts into ON DUPLICATE KEY UPDATE.
+func (d *mysqlDialect) rebind(query string) string {
+	if v, ok := d.cache.Load(query); ok {
+		return v.(string)
+	}
+	out := query
+	if onConflictRe.MatchString(out) {
+		out = onConflictRe.ReplaceAllString(out, "ON DUPLICATE KEY UPDATE")
+		out = excludedRe.ReplaceAllString(out, "VALUES($1)")
+	}
+	d.cache.Store(query, out)
+	return out
+}
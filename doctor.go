@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ask4me doctor (or -check) tests a setup before it goes live: the config
+// loads and validates, the database opens and its schema is current, the
+// notification channel works (a test notification is sent unless -no-send),
+// and base_url resolves and, when the server is already up, answers
+// /healthz. Each check prints one line with a hint on failure; the exit code
+// is 1 if any check failed.
+
+const doctorTimeout = 10 * time.Second
+
+type doctor struct {
+	out    io.Writer
+	failed bool
+}
+
+func (d *doctor) ok(check, detail string) {
+	fmt.Fprintf(d.out, "ok    %-9s %s\n", check, detail)
+}
+
+func (d *doctor) warn(check, detail, hint string) {
+	fmt.Fprintf(d.out, "warn  %-9s %s\n", check, detail)
+	if hint != "" {
+		fmt.Fprintf(d.out, "      %-9s -> %s\n", "", hint)
+	}
+}
+
+func (d *doctor) fail(check, detail, hint string) {
+	d.failed = true
+	fmt.Fprintf(d.out, "FAIL  %-9s %s\n", check, detail)
+	if hint != "" {
+		fmt.Fprintf(d.out, "      %-9s -> %s\n", "", hint)
+	}
+}
+
+// runDoctor runs every check and reports whether all passed.
+func runDoctor(configPath string, send bool) bool {
+	d := &doctor{out: os.Stdout}
+	cfg, used, err := loadConfigAuto(configPath)
+	if err != nil {
+		where := used
+		if where == "" {
+			where = "config"
+		}
+		d.fail("config", where+": "+err.Error(), "fix the file, or point -config at the right one")
+		return false
+	}
+	d.ok("config", used)
+	cfg.resolveSQLitePath()
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	d.checkDatabase(ctx, cfg)
+
+	// The push helpers need a server; the test notification touches no
+	// database.
+	srv := &server{db: newStore(nil)}
+	srv.conf.Store(&cfg)
+	d.checkNotifier(ctx, srv, send)
+	d.checkBaseURL(ctx, cfg.BaseURL)
+	return !d.failed
+}
+
+func (d *doctor) checkDatabase(ctx context.Context, cfg Config) {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		hint := "check database_url and that the database server is reachable"
+		if cfg.DatabaseDriver == databaseDriverSQLite {
+			hint = "check that the directory of sqlite_path exists and is writable"
+		}
+		d.fail("database", err.Error(), hint)
+		return
+	}
+	defer db.Close()
+	migrations, err := loadMigrations(db.dialect.migrations())
+	if err != nil {
+		d.fail("database", err.Error(), "")
+		return
+	}
+	version, err := db.schemaVersion(ctx)
+	if err != nil {
+		d.fail("database", "read schema version: "+err.Error(), "check that the database user may create tables")
+		return
+	}
+	latest := migrations[len(migrations)-1].Version
+	switch {
+	case version < latest:
+		d.warn("database", fmt.Sprintf("%s schema version %d of %d", db.dialect.name(), version, latest),
+			"the server migrates on start; run -migrate up to do it now")
+	case version > latest:
+		d.fail("database", fmt.Sprintf("%s schema version %d is newer than this build (%d)", db.dialect.name(), version, latest),
+			"run the newer ask4me, or -migrate down with it first")
+	default:
+		d.ok("database", fmt.Sprintf("%s schema version %d", db.dialect.name(), version))
+	}
+}
+
+func (d *doctor) checkNotifier(ctx context.Context, srv *server, send bool) {
+	cfg := srv.cfg()
+	target := srv.defaultNotifyTarget()
+	if strings.TrimSpace(target.ServerChanSendKey) == "" {
+		if len(target.AppriseURLs) == 0 {
+			d.fail("notifier", "no serverchan_sendkey or apprise_urls configured", "set one of them (or subscribe a browser at /subscribe), or nobody is told about new asks")
+			return
+		}
+		if _, err := exec.LookPath(cfg.AppriseBin); err != nil {
+			d.fail("notifier", "apprise: "+err.Error(), "pip install apprise, or set apprise_bin to its path")
+			return
+		}
+	}
+	if !send {
+		_, channel := srv.notifierCheck()
+		d.ok("notifier", channel+" configured (test notification not sent)")
+		return
+	}
+	ar := askRequest{Title: "Ask4Me doctor", Body: "Test notification from ask4me doctor. No reply needed."}
+	fields, err := srv.deliverNotification(ctx, target, ar, "")
+	if err != nil {
+		f := notifyErrorFields(err)
+		detail := fmt.Sprint(f["error"])
+		if out, _ := f["output"].(string); out != "" {
+			detail += ": " + truncate(strings.TrimSpace(out), 300)
+		}
+		d.fail("notifier", detail, "check serverchan_sendkey or apprise_urls; run apprise -vv by hand for more detail")
+		return
+	}
+	d.ok("notifier", fmt.Sprintf("test notification sent via %v in %vms", fields["channel"], fields["latency_ms"]))
+}
+
+func (d *doctor) checkBaseURL(ctx context.Context, baseURL string) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		d.fail("base_url", fmt.Sprintf("%q is not an http(s) URL", baseURL), "set base_url to the address phones open links at")
+		return
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" {
+		d.warn("base_url", baseURL+" is local", "links in notifications only open on this machine; use an address your phone can reach")
+	} else if ip == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			d.fail("base_url", "resolve "+host+": "+err.Error(), "check DNS for the base_url host")
+			return
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(baseURL, "/")+"/healthz", nil)
+	if err != nil {
+		d.fail("base_url", err.Error(), "")
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		d.warn("base_url", "no answer from "+req.URL.String()+": "+err.Error(),
+			"expected if ask4me is not running yet; otherwise check the proxy or firewall in front of it")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		d.warn("base_url", fmt.Sprintf("%s answered %s", req.URL, resp.Status),
+			"something other than ask4me may be serving base_url; check the proxy routes")
+		return
+	}
+	d.ok("base_url", baseURL+" reachable")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type draftRecord struct {
+	Text        string
+	PayloadJSON sql.NullString
+	UpdatedAt   int64
+}
+
+func (s *store) saveDraft(ctx context.Context, reqID, tokenHash, text string, payloadJSON sql.NullString) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO drafts(request_id,token_hash,text,payload_json,updated_at) VALUES(?,?,?,?,?)
+		 ON CONFLICT(request_id, token_hash) DO UPDATE SET text=excluded.text, payload_json=excluded.payload_json, updated_at=excluded.updated_at`,
+		reqID, tokenHash, nullIfEmpty(text), payloadJSON, time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *store) getDraft(ctx context.Context, reqID, tokenHash string) (draftRecord, bool, error) {
+	var d draftRecord
+	var text sql.NullString
+	err := s.db.QueryRowContext(ctx,
+		`SELECT text, payload_json, updated_at FROM drafts WHERE request_id=? AND token_hash=?`,
+		reqID, tokenHash,
+	).Scan(&text, &d.PayloadJSON, &d.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return draftRecord{}, false, nil
+		}
+		return draftRecord{}, false, err
+	}
+	d.Text = text.String
+	return d, true, nil
+}
+
+func (s *store) deleteDrafts(ctx context.Context, reqID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM drafts WHERE request_id=?`, reqID)
+	return err
+}
+
+func (s *store) deleteDraft(ctx context.Context, reqID, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM drafts WHERE request_id=? AND token_hash=?`, reqID, tokenHash)
+	return err
+}
+
+// handleUserDraft serves /r/{id}/draft. GET returns the saved draft for the
+// current token as JSON; POST stores the form fields (text / payload_json)
+// and emits a non-terminal user.draft_saved event.
+func (s *server) handleUserDraft(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, tokenHash, status string) {
+	switch r.Method {
+	case http.MethodGet:
+		d, ok, err := s.db.getDraft(r.Context(), requestID, tokenHash)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		type draftResponse struct {
+			Text      string          `json:"text"`
+			Payload   json.RawMessage `json:"payload,omitempty"`
+			UpdatedAt string          `json:"updated_at"`
+		}
+		resp := draftResponse{
+			Text:      d.Text,
+			UpdatedAt: time.Unix(d.UpdatedAt, 0).UTC().Format(time.RFC3339),
+		}
+		if d.PayloadJSON.Valid {
+			resp.Payload = json.RawMessage(d.PayloadJSON.String)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if isTerminalStatus(status) {
+		closedStatusError(w, status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	text := strings.TrimSpace(r.FormValue("text"))
+	payloadJSON := strings.TrimSpace(r.FormValue("payload_json"))
+	var payloadToStore sql.NullString
+	if payloadJSON != "" {
+		var v any
+		if err := json.Unmarshal([]byte(payloadJSON), &v); err != nil {
+			http.Error(w, "invalid payload_json", http.StatusBadRequest)
+			return
+		}
+		payloadToStore = sql.NullString{String: payloadJSON, Valid: true}
+	}
+	if err := s.db.saveDraft(r.Context(), requestID, tokenHash, text, payloadToStore); err != nil {
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+
+	ev := s.mustNewEvent(r.Context(), requestID, "user.draft_saved", map[string]any{
+		"text_length": utf8.RuneCountInString(text),
+		"has_payload": payloadToStore.Valid,
+	})
+	_ = s.persistTerminalAware(r.Context(), ev)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
+		return
+	}
+	http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain)+"&draft_saved=1", http.StatusSeeOther)
+}
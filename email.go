@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Email replies. Email notifications go through apprise (mailto://,
+// mailtos://); with email_reply_address set, each one gets a Reply-To of
+// that address plus a tag naming the request, e.g.
+//
+//	ask+x7k2q3...-9f2c41d0aa@example.com
+//
+// The tag ends with an HMAC, so only someone who received the notification
+// can answer. Mail to that address is handed to POST /email/inbound by an
+// inbound-mail webhook (Mailgun, SendGrid Inbound Parse, ...) or by the mail
+// server itself (e.g. a Postfix pipe to curl), authenticated with
+// email_inbound_token. The reply's first line is matched against the
+// buttons; the rest, or the whole reply when no button matches and the ask
+// has an input, is the text. Quoted text and signatures are cut off.
+//
+// Only single-responder asks get a reply address; email_allowed_senders
+// (addresses or @domains) further limits who may answer.
+
+const emailInboundMaxBytes = 10 << 20
+
+func (c *Config) normalizeEmail() error {
+	c.EmailReplyAddress = strings.TrimSpace(c.EmailReplyAddress)
+	c.EmailInboundToken = strings.TrimSpace(c.EmailInboundToken)
+	senders := c.EmailAllowedSenders[:0]
+	for _, v := range c.EmailAllowedSenders {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			senders = append(senders, v)
+		}
+	}
+	c.EmailAllowedSenders = senders
+	if c.EmailReplyAddress == "" {
+		return nil
+	}
+	a, err := mail.ParseAddress(c.EmailReplyAddress)
+	if err != nil || !strings.Contains(a.Address, "@") {
+		return fmt.Errorf("invalid email_reply_address %q", c.EmailReplyAddress)
+	}
+	c.EmailReplyAddress = a.Address
+	if len(c.EmailInboundToken) < 16 {
+		return errors.New("email_reply_address needs email_inbound_token (at least 16 characters)")
+	}
+	return nil
+}
+
+func (c Config) emailSenderAllowed(addr string) bool {
+	if len(c.EmailAllowedSenders) == 0 {
+		return true
+	}
+	addr = strings.ToLower(addr)
+	for _, v := range c.EmailAllowedSenders {
+		if v == addr || (strings.HasPrefix(v, "@") && strings.HasSuffix(addr, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) emailTagMAC(requestID string) string {
+	key := sha256.Sum256([]byte("ask4me-email:" + c.EmailInboundToken))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(requestID))
+	return hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+// emailReplyAddress returns the reply address for requestID, or "" when
+// replies are off or the address would be too long.
+func (c Config) emailReplyAddress(requestID string) string {
+	if c.EmailReplyAddress == "" {
+		return ""
+	}
+	at := strings.LastIndex(c.EmailReplyAddress, "@")
+	local := c.EmailReplyAddress[:at] + "+" + strings.TrimPrefix(requestID, "req_") + "-" + c.emailTagMAC(requestID)
+	if len(local) > 64 {
+		return ""
+	}
+	return local + c.EmailReplyAddress[at:]
+}
+
+// emailRequestID checks the tag of a reply address and returns its request.
+func (c Config) emailRequestID(addr string) (string, bool) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return "", false
+	}
+	local := addr[:at]
+	plus := strings.LastIndex(local, "+")
+	dash := strings.LastIndex(local, "-")
+	if plus < 0 || dash < plus {
+		return "", false
+	}
+	requestID := "req_" + strings.ToLower(local[plus+1:dash])
+	if !isValidRequestID(requestID) {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(local[dash+1:])), []byte(c.emailTagMAC(requestID))) != 1 {
+		return "", false
+	}
+	return requestID, true
+}
+
+// emailReplyFor returns the Reply-To for a notification of ar, or "".
+func (s *server) emailReplyFor(ar askRequest, interactionURL string) string {
+	cfg := s.cfg()
+	if cfg.EmailReplyAddress == "" || ar.Responders != nil {
+		return ""
+	}
+	u, err := url.Parse(interactionURL)
+	if err != nil {
+		return ""
+	}
+	rest, ok := strings.CutPrefix(u.Path, cfg.PathPrefix+"/r/")
+	if !ok {
+		return ""
+	}
+	requestID, _, _ := strings.Cut(rest, "/")
+	return cfg.emailReplyAddress(requestID)
+}
+
+// withEmailReply adds reply= to apprise email URLs.
+func withEmailReply(appriseURL, reply string) string {
+	low := strings.ToLower(appriseURL)
+	if reply == "" || !(strings.HasPrefix(low, "mailto://") || strings.HasPrefix(low, "mailtos://")) {
+		return appriseURL
+	}
+	sep := "?"
+	if strings.Contains(appriseURL, "?") {
+		sep = "&"
+	}
+	return appriseURL + sep + "reply=" + url.QueryEscape(reply)
+}
+
+// inboundEmail is what is used of a received reply.
+type inboundEmail struct {
+	Recipients []string
+	From       string
+	Text       string
+}
+
+// parseInboundEmail reads the webhook body: form fields as posted by
+// Mailgun and SendGrid, or a raw RFC 822 message.
+func parseInboundEmail(r *http.Request) (inboundEmail, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/x-www-form-urlencoded" {
+		// curl --data-binary @message.eml sends this type too; only a body
+		// with the inbound service's fields is a form.
+		raw, err := io.ReadAll(io.LimitReader(r.Body, emailInboundMaxBytes))
+		if err != nil {
+			return inboundEmail{}, err
+		}
+		form, err := url.ParseQuery(string(raw))
+		if err != nil || (form.Get("email") == "" && form.Get("recipient") == "" && form.Get("to") == "") {
+			return parseRawEmail(bytes.NewReader(raw))
+		}
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+	}
+	if ct == "multipart/form-data" || ct == "application/x-www-form-urlencoded" {
+		if err := r.ParseMultipartForm(emailInboundMaxBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return inboundEmail{}, err
+		}
+		if raw := r.FormValue("email"); raw != "" {
+			return parseRawEmail(strings.NewReader(raw))
+		}
+		var m inboundEmail
+		for _, k := range []string{"recipient", "to"} {
+			if v := r.FormValue(k); v != "" {
+				m.Recipients = append(m.Recipients, emailAddresses(v)...)
+			}
+		}
+		if from := emailAddresses(firstNonEmpty(r.FormValue("sender"), r.FormValue("from"))); len(from) > 0 {
+			m.From = from[0]
+		}
+		m.Text = firstNonEmpty(r.FormValue("stripped-text"), r.FormValue("body-plain"), r.FormValue("text"))
+		return m, nil
+	}
+	return parseRawEmail(io.LimitReader(r.Body, emailInboundMaxBytes))
+}
+
+func firstNonEmpty(vs ...string) string {
+	for _, v := range vs {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func emailAddresses(v string) []string {
+	list, err := mail.ParseAddressList(v)
+	if err != nil {
+		if a, err := mail.ParseAddress(v); err == nil {
+			return []string{a.Address}
+		}
+		return nil
+	}
+	out := make([]string, 0, len(list))
+	for _, a := range list {
+		out = append(out, a.Address)
+	}
+	return out
+}
+
+func parseRawEmail(r io.Reader) (inboundEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return inboundEmail{}, err
+	}
+	var m inboundEmail
+	for _, h := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		for _, v := range msg.Header[h] {
+			m.Recipients = append(m.Recipients, emailAddresses(v)...)
+		}
+	}
+	if from := emailAddresses(msg.Header.Get("From")); len(from) > 0 {
+		m.From = from[0]
+	}
+	m.Text, err = emailText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	return m, err
+}
+
+var (
+	reHTMLTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+	reHTMLQuote = regexp.MustCompile(`(?is)<(blockquote|style|script|head)\b.*?</(blockquote|style|script|head)>`)
+)
+
+// emailHTMLText reduces an HTML body to its text, without quoted mail.
+func emailHTMLText(s string) string {
+	s = reHTMLQuote.ReplaceAllString(s, "")
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n", "</div>", "\n").Replace(s)
+	return html.UnescapeString(reHTMLTag.ReplaceAllString(s, ""))
+}
+
+// emailText returns the text/plain part of a message body, or the text of
+// its HTML part when there is none.
+func emailText(contentType, encoding string, body io.Reader) (string, error) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = "text/plain"
+	}
+	if strings.HasPrefix(mt, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		var htmlText string
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			text, err := emailText(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+			if err != nil {
+				continue
+			}
+			pt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			switch {
+			case pt == "text/html" && htmlText == "":
+				htmlText = text
+			case pt != "text/html" && strings.TrimSpace(text) != "":
+				return text, nil
+			}
+		}
+		return htmlText, nil
+	}
+	if !strings.HasPrefix(mt, "text/") {
+		return "", nil
+	}
+	if strings.EqualFold(strings.TrimSpace(encoding), "quoted-printable") {
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := io.ReadAll(io.LimitReader(body, emailInboundMaxBytes))
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		if b, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(b)), "")); err != nil {
+			return "", err
+		}
+	}
+	if mt == "text/html" {
+		return emailHTMLText(string(b)), nil
+	}
+	return string(b), nil
+}
+
+var reEmailQuoteStart = regexp.MustCompile(`(?i)^(on .*wrote:|-+ ?original message ?-+|_{10,}|from: .*|sent from my .*|在.*写道[:：]|.*于.*写道[:：]|-- ?)$`)
+
+// emailReply cuts quoted text and signatures off a reply.
+func emailReply(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var out []string
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, ">") || reEmailQuoteStart.MatchString(t) {
+			break
+		}
+		// Gmail wraps "On ... <x@y>" / "wrote:" over two lines.
+		if strings.HasPrefix(strings.ToLower(t), "on ") && i+1 < len(lines) && strings.HasSuffix(strings.TrimSpace(lines[i+1]), "wrote:") {
+			break
+		}
+		out = append(out, l)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+func (s *server) handleEmailInbound(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg()
+	if cfg.EmailReplyAddress == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(cfg.EmailInboundToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	m, err := parseInboundEmail(r)
+	if err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	// Problems with the mail itself are answered 200 so that the sender's
+	// webhook does not retry them.
+	skip := func(reason string) {
+		slog.Info("email reply skipped", "from", m.From, "reason", reason)
+		writeJSON(w, http.StatusOK, map[string]any{"handled": false, "reason": reason})
+	}
+	requestID := ""
+	for _, rcpt := range m.Recipients {
+		if id, ok := cfg.emailRequestID(rcpt); ok {
+			requestID = id
+			break
+		}
+	}
+	if requestID == "" {
+		skip("no reply address")
+		return
+	}
+	if m.From == "" || !cfg.emailSenderAllowed(m.From) {
+		skip("sender not allowed")
+		return
+	}
+	text := emailReply(m.Text)
+	if text == "" {
+		skip("empty reply")
+		return
+	}
+	form, err := s.db.getRequestForm(r.Context(), requestID)
+	if err != nil {
+		skip("unknown request")
+		return
+	}
+	mcd, _ := form["mcd"].(string)
+	spec := parseMCD(mcd)
+	a := remoteAnswer{Responder: m.From, Via: "email"}
+	first, rest, _ := strings.Cut(text, "\n")
+	first = strings.Trim(strings.TrimSpace(first), ".!")
+	for _, btn := range spec.Buttons {
+		if strings.EqualFold(first, btn.Value) || strings.EqualFold(first, btn.Label) {
+			a.Action, a.Text = btn.Value, strings.TrimSpace(rest)
+			break
+		}
+	}
+	if a.Action == "" {
+		if spec.Input == nil {
+			skip("no button matches the first line")
+			return
+		}
+		a.Text = text
+	}
+	switch err := s.answerRemote(r.Context(), requestID, a); {
+	case err == nil:
+		writeJSON(w, http.StatusOK, map[string]any{"handled": true, "request_id": requestID})
+	case errors.Is(err, errAnswerTaken), errors.Is(err, errAnswerNotOpen):
+		skip("already answered or closed")
+	case errors.Is(err, errAnswerNotFound):
+		skip("unknown request")
+	case errors.Is(err, errAnswerInvalid):
+		skip(err.Error())
+	default:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Export and import of the Q&A history. GET /v1/export streams requests with
+// their answers (and, for JSONL, events); `ask4me -import file.jsonl` loads
+// such a file — or a retention archive — into the configured database.
+// Tokens are never exported, so imported requests have no working links.
+// format=dataset exports answers as training data instead, see dataset.go.
+
+const exportPageSize = 200
+
+type exportRecord struct {
+	RequestID       string          `json:"request_id"`
+	Title           string          `json:"title"`
+	Body            string          `json:"body"`
+	MCD             string          `json:"mcd"`
+	Status          string          `json:"status"`
+	Priority        string          `json:"priority,omitempty"`
+	SessionID       string          `json:"session_id,omitempty"`
+	ParentRequestID string          `json:"parent_request_id,omitempty"`
+	ScheduleID      string          `json:"schedule_id,omitempty"`
+	CreatedAt       string          `json:"created_at"`
+	UpdatedAt       string          `json:"updated_at"`
+	ExpiresAt       string          `json:"expires_at"`
+	Answer          *exportAnswer   `json:"answer,omitempty"`
+	Events          []exportedEvent `json:"events,omitempty"`
+}
+
+type exportAnswer struct {
+	Action        string          `json:"action"`
+	Text          string          `json:"text"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Responder     string          `json:"responder,omitempty"`
+	ResponderName string          `json:"responder_name,omitempty"`
+	CreatedAt     string          `json:"created_at"`
+}
+
+type exportedEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt string          `json:"created_at"`
+}
+
+type exportFilter struct {
+	Status   string
+	Since    int64
+	Until    int64
+	Tag      string
+	Answered bool
+	IDs      []string
+}
+
+// exportCursor is the keyset position after the last exported request.
+type exportCursor struct {
+	CreatedAt int64
+	RequestID string
+}
+
+func formatUnix(v int64) string {
+	if v == 0 {
+		return ""
+	}
+	return time.Unix(v, 0).UTC().Format(time.RFC3339)
+}
+
+func parseUnix(v string) int64 {
+	t, err := parseSendAt(v)
+	if err != nil || t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// listExportRecords returns the next page of requests after cur, oldest first.
+func (s *store) listExportRecords(ctx context.Context, f exportFilter, cur exportCursor, limit int) ([]exportRecord, exportCursor, error) {
+	where := []string{"(r.created_at>? OR (r.created_at=? AND r.request_id>?))"}
+	args := []any{cur.CreatedAt, cur.CreatedAt, cur.RequestID}
+	if f.Status != "" {
+		where = append(where, "r.status=?")
+		args = append(args, f.Status)
+	}
+	if f.Since > 0 {
+		where = append(where, "r.created_at>=?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "r.created_at<?")
+		args = append(args, f.Until)
+	}
+	if f.Tag != "" {
+		where = append(where, "r.request_id IN (SELECT request_id FROM request_tags WHERE tag=?)")
+		args = append(args, f.Tag)
+	}
+	if f.Answered {
+		where = append(where, "a.request_id IS NOT NULL")
+	}
+	if len(f.IDs) > 0 {
+		where = append(where, "r.request_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(f.IDs)), ",")+")")
+		for _, id := range f.IDs {
+			args = append(args, id)
+		}
+	}
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT r.request_id, r.title, r.body, r.mcd, r.status, r.priority, r.session_id, r.parent_request_id, r.schedule_id,
+			r.created_at, r.updated_at, r.expires_at, a.action, a.text, a.payload_json, a.responder, a.responder_name, a.created_at, b.encoding, b.data
+		 FROM requests r LEFT JOIN answers a ON a.request_id = r.request_id`+bodyJoin+`
+		 WHERE `+strings.Join(where, " AND ")+`
+		 ORDER BY r.created_at ASC, r.request_id ASC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, cur, err
+	}
+	defer rows.Close()
+	var out []exportRecord
+	for rows.Next() {
+		var rec exportRecord
+		var priority, sessionID, parent, scheduleID, action, text, payload, responder, responderName sql.NullString
+		var createdAt, updatedAt, expiresAt int64
+		var answeredAt sql.NullInt64
+		var bodyEncoding, bodyData sql.NullString
+		if err := rows.Scan(&rec.RequestID, &rec.Title, &rec.Body, &rec.MCD, &rec.Status, &priority, &sessionID, &parent, &scheduleID,
+			&createdAt, &updatedAt, &expiresAt, &action, &text, &payload, &responder, &responderName, &answeredAt, &bodyEncoding, &bodyData); err != nil {
+			return nil, cur, err
+		}
+		rec.Body = bodyText(rec.Body, bodyEncoding, bodyData)
+		rec.Priority = priority.String
+		rec.SessionID = sessionID.String
+		rec.ParentRequestID = parent.String
+		rec.ScheduleID = scheduleID.String
+		rec.CreatedAt = formatUnix(createdAt)
+		rec.UpdatedAt = formatUnix(updatedAt)
+		rec.ExpiresAt = formatUnix(expiresAt)
+		if answeredAt.Valid {
+			rec.Answer = &exportAnswer{Action: action.String, Text: text.String, Responder: responder.String, ResponderName: responderName.String, CreatedAt: formatUnix(answeredAt.Int64)}
+			if payload.Valid && payload.String != "" {
+				rec.Answer.Payload = json.RawMessage(payload.String)
+			}
+		}
+		out = append(out, rec)
+		cur = exportCursor{CreatedAt: createdAt, RequestID: rec.RequestID}
+	}
+	return out, cur, rows.Err()
+}
+
+func (s *store) listExportEvents(ctx context.Context, reqID string) ([]exportedEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT event_id, type, payload_json, payload_encoding, created_at FROM events WHERE request_id=? ORDER BY seq ASC`, reqID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []exportedEvent
+	for rows.Next() {
+		var ev exportedEvent
+		var data string
+		var encoding sql.NullString
+		var createdAt int64
+		if err := rows.Scan(&ev.ID, &ev.Type, &data, &encoding, &createdAt); err != nil {
+			return nil, err
+		}
+		ev.Data = json.RawMessage(decodeEventPayload(data, encoding))
+		ev.CreatedAt = formatUnix(createdAt)
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+// eachExportRecord calls fn for every matching request, paging so that no
+// query is open while fn runs.
+func (s *store) eachExportRecord(ctx context.Context, f exportFilter, withEvents bool, fn func(exportRecord) error) error {
+	var cur exportCursor
+	for {
+		page, next, err := s.listExportRecords(ctx, f, cur, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, rec := range page {
+			if withEvents {
+				if rec.Events, err = s.listExportEvents(ctx, rec.RequestID); err != nil {
+					return err
+				}
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+		cur = next
+	}
+}
+
+var exportCSVHeader = []string{
+	"request_id", "title", "body", "status", "priority", "session_id", "parent_request_id", "schedule_id",
+	"created_at", "expires_at", "answer_action", "answer_text", "answer_payload", "answer_responder", "answered_at",
+}
+
+func (rec exportRecord) csvRow() []string {
+	row := []string{
+		rec.RequestID, rec.Title, rec.Body, rec.Status, rec.Priority, rec.SessionID, rec.ParentRequestID, rec.ScheduleID,
+		rec.CreatedAt, rec.ExpiresAt, "", "", "", "", "",
+	}
+	if a := rec.Answer; a != nil {
+		row[10], row[11], row[12], row[13], row[14] = a.Action, a.Text, string(a.Payload), a.Responder, a.CreatedAt
+	}
+	return row
+}
+
+// handleExport serves GET /v1/export?format=jsonl|csv|dataset&status=&since=&until=&tag=&events=0.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	f := exportFilter{Status: strings.TrimSpace(q.Get("status")), Tag: strings.ToLower(strings.TrimSpace(q.Get("tag")))}
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		v := strings.TrimSpace(q.Get(p.name))
+		if v == "" {
+			continue
+		}
+		if *p.dst = parseUnix(v); *p.dst == 0 {
+			http.Error(w, p.name+" must be RFC 3339 or unix seconds", http.StatusBadRequest)
+			return
+		}
+	}
+	format := strings.ToLower(strings.TrimSpace(q.Get("format")))
+	if format == "" {
+		format = "jsonl"
+	}
+	withEvents := format == "jsonl" && (q.Get("events") == "" || parseBoolQuery(q.Get("events")))
+
+	name := "ask4me-export-" + time.Now().UTC().Format("20060102-150405")
+	var write func(exportRecord) error
+	var flush func() error
+	switch format {
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+		enc := json.NewEncoder(w)
+		write = func(rec exportRecord) error { return enc.Encode(rec) }
+		flush = func() error { return nil }
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return
+		}
+		write = func(rec exportRecord) error { return cw.Write(rec.csvRow()) }
+		flush = func() error { cw.Flush(); return cw.Error() }
+	case "dataset":
+		f.Answered = true
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`-dataset.jsonl"`)
+		enc := json.NewEncoder(w)
+		write = func(rec exportRecord) error {
+			d, ok, err := s.db.datasetRecord(r.Context(), rec)
+			if err != nil || !ok {
+				return err
+			}
+			return enc.Encode(d)
+		}
+		flush = func() error { return nil }
+	default:
+		http.Error(w, "format must be jsonl, csv or dataset", http.StatusBadRequest)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err := s.db.eachExportRecord(r.Context(), f, withEvents, func(rec exportRecord) error {
+		if err := write(rec); err != nil {
+			return err
+		}
+		if n++; n%exportPageSize == 0 && flusher != nil {
+			if err := flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil && r.Context().Err() == nil {
+		// Headers are already sent; all we can do is cut the stream short.
+		slog.Error("export", "error", err)
+	}
+}
+
+// importRecords loads a JSONL export into the database. Requests that already
+// exist are skipped.
+func (s *store) importRecords(ctx context.Context, path string) (imported, skipped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 1<<20), 64<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := strings.TrimSpace(sc.Text())
+		if raw == "" {
+			continue
+		}
+		var rec exportRecord
+		if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+			return imported, skipped, fmt.Errorf("line %d: %w", line, err)
+		}
+		if !isValidRequestID(rec.RequestID) {
+			return imported, skipped, fmt.Errorf("line %d: invalid request_id", line)
+		}
+		if _, _, err := s.getRequestStatus(ctx, rec.RequestID); err == nil {
+			skipped++
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return imported, skipped, err
+		}
+		if err := s.importRecord(ctx, rec); err != nil {
+			return imported, skipped, fmt.Errorf("line %d: %w", line, err)
+		}
+		imported++
+	}
+	return imported, skipped, sc.Err()
+}
+
+func (s *store) importRecord(ctx context.Context, rec exportRecord) error {
+	createdAt := parseUnix(rec.CreatedAt)
+	updatedAt := parseUnix(rec.UpdatedAt)
+	if updatedAt == 0 {
+		updatedAt = createdAt
+	}
+	body, bodyHash, err := s.storeBody(ctx, rec.Body)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO requests(request_id,title,body,body_hash,mcd,status,expires_at,created_at,updated_at,priority,session_id,parent_request_id,schedule_id)
+		 VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		rec.RequestID, rec.Title, body, bodyHash, rec.MCD, rec.Status, parseUnix(rec.ExpiresAt), createdAt, updatedAt,
+		nullIfEmpty(rec.Priority), nullIfEmpty(rec.SessionID), nullIfEmpty(rec.ParentRequestID), nullIfEmpty(rec.ScheduleID),
+	); err != nil {
+		return err
+	}
+	if err := indexRequest(ctx, s.db, rec.RequestID, rec.Title, rec.Body); err != nil {
+		return err
+	}
+	if a := rec.Answer; a != nil {
+		if _, err := s.db.ExecContext(ctx,
+			`INSERT INTO answers(request_id,action,text,payload_json,responder,created_at) VALUES(?,?,?,?,?,?)`,
+			rec.RequestID, a.Action, a.Text, nullIfEmpty(string(a.Payload)), nullIfEmpty(a.Responder), parseUnix(a.CreatedAt),
+		); err != nil {
+			return err
+		}
+		if err := s.indexAnswer(ctx, rec.RequestID, a.Action, a.Text); err != nil {
+			return err
+		}
+	}
+	for _, ev := range rec.Events {
+		data := string(ev.Data)
+		if data == "" {
+			data = "{}"
+		}
+		data, encoding := encodeStoredText(data, s.compressBytes)
+		if _, err := s.db.ExecContext(ctx,
+			`INSERT INTO events(request_id,event_id,type,payload_json,payload_encoding,created_at) VALUES(?,?,?,?,?,?)`,
+			rec.RequestID, ev.ID, ev.Type, data, encoding, parseUnix(ev.CreatedAt),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Asking for more time. Someone who opens the page close to the deadline
+// should not be cut off halfway through an answer. An ask with
+// extend_seconds shows a "Need more time" button next to the countdown;
+// pressing it moves expires_at (and the expiry of the ask's links) that much
+// later and emits request.extended. max_extensions (default 1, at most 10)
+// limits how often that can happen. Only an open ask that has not expired yet
+// can be extended, so the button does not stretch answer_grace_seconds.
+
+const (
+	maxExtendSeconds     = 86400
+	defaultMaxExtensions = 1
+	maxMaxExtensions     = 10
+)
+
+func normalizeExtend(ar *askRequest) error {
+	if ar.ExtendSeconds < 0 || ar.ExtendSeconds > maxExtendSeconds {
+		return badAskError("extend_seconds must be between 1 and 86400")
+	}
+	if ar.MaxExtensions < 0 || ar.MaxExtensions > maxMaxExtensions {
+		return badAskError("max_extensions must be between 1 and 10")
+	}
+	if ar.ExtendSeconds == 0 {
+		if ar.MaxExtensions > 0 {
+			return badAskError("max_extensions requires extend_seconds")
+		}
+		return nil
+	}
+	if ar.MaxExtensions == 0 {
+		ar.MaxExtensions = defaultMaxExtensions
+	}
+	return nil
+}
+
+// extensionsLeft returns by how many seconds requestID may be extended and
+// how many more times; zero seconds means it may not.
+func (s *store) extensionsLeft(ctx context.Context, reqID string) (seconds, left int, err error) {
+	var sec, maxExt sql.NullInt64
+	var used int
+	err = s.db.QueryRowContext(ctx,
+		`SELECT extend_seconds, max_extensions, extensions FROM requests WHERE request_id=?`, reqID,
+	).Scan(&sec, &maxExt, &used)
+	if err != nil || sec.Int64 <= 0 || int(maxExt.Int64) <= used {
+		return 0, 0, err
+	}
+	return int(sec.Int64), int(maxExt.Int64) - used, nil
+}
+
+// extendRequest moves the expiry of an open, unexpired request by its
+// extend_seconds, along with that of its links. It returns the new expiry and
+// how many extensions have been used, or false when the request cannot be
+// extended (any more).
+func (s *store) extendRequest(ctx context.Context, reqID string) (time.Time, int, bool, error) {
+	now := time.Now().Unix()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE requests SET expires_at=expires_at+extend_seconds, extensions=extensions+1, updated_at=?
+		 WHERE request_id=? AND extend_seconds>0 AND extensions<max_extensions
+		 AND status IN ('created','delivered') AND expires_at>=?`,
+		now, reqID, now,
+	)
+	if err != nil {
+		return time.Time{}, 0, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return time.Time{}, 0, false, err
+	}
+	var expiresAt int64
+	var used int
+	err = s.db.QueryRowContext(ctx, `SELECT expires_at, extensions FROM requests WHERE request_id=?`, reqID).Scan(&expiresAt, &used)
+	if err != nil {
+		return time.Time{}, 0, false, err
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE tokens SET expires_at=? WHERE request_id=? AND revoked_at IS NULL AND expires_at<?`,
+		expiresAt, reqID, expiresAt,
+	); err != nil {
+		return time.Time{}, 0, false, err
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE short_links SET expires_at=? WHERE request_id=? AND expires_at<?`,
+		expiresAt, reqID, expiresAt,
+	); err != nil {
+		return time.Time{}, 0, false, err
+	}
+	return time.Unix(expiresAt, 0), used, true, nil
+}
+
+// handleUserExtend serves POST /r/{id}/extend, the page's "Need more time"
+// button. The form and its CSRF token were checked by handleUser. The
+// running expireLoop notices the new expires_at when its timer fires.
+func (s *server) handleUserExtend(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, responder string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	by, _, err := s.db.extensionsLeft(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	expiresAt, used, ok, err := s.db.extendRequest(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "this request can no longer be extended", http.StatusConflict)
+		return
+	}
+	data := map[string]any{
+		"expires_at":  expiresAt.UTC().Format(time.RFC3339),
+		"extended_by": by,
+		"extensions":  used,
+	}
+	if responder != "" {
+		data["responder"] = responder
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.extended", data)
+	_ = s.persistTerminalAware(ctx, ev)
+	http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GET /v1/events/stream is a firehose: one SSE stream with the events of all
+// requests, for dashboards and logging pipelines. It needs the admin scope
+// (browsers' EventSource can pass the key as ?key=). types=a,b keeps only
+// those event types. Events from other instances arrive through the hub
+// broker. A consumer that falls behind loses events rather than slowing the
+// server down, and is told so with events.dropped (see sse.go), whatever its
+// types filter; /v1/requests/{id}/events fills the gaps.
+
+const firehoseBuffer = 256
+
+// subscribeAll returns a channel that receives every request event published
+// through the hub, from this instance or, with a broker, from the others.
+func (h *runtimeHub) subscribeAll() (<-chan Event, func()) {
+	sub := newSubscriber(firehoseBuffer, "")
+	h.mu.Lock()
+	if h.firehose == nil {
+		h.firehose = map[*subscriber]struct{}{}
+	}
+	h.firehose[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub.out, func() {
+		h.mu.Lock()
+		delete(h.firehose, sub)
+		h.mu.Unlock()
+		sub.stop()
+	}
+}
+
+func (s *server) handleEventsStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	types := map[string]bool{}
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	ctx := r.Context()
+	ch, unsub := s.hub.subscribeAll()
+	defer unsub()
+
+	sseInit(w)
+	if fl, ok := w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	hb := time.NewTicker(time.Duration(s.cfg().SSEHeartbeatIntervalSeconds) * time.Second)
+	defer hb.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.shutdown.stopping:
+			sendRestarting(w)
+			return
+		case <-hb.C:
+			if err := s.sendEvent(w, Event{Type: "heartbeat", Data: json.RawMessage(`{}`)}); err != nil {
+				return
+			}
+		case ev := <-ch:
+			if len(types) > 0 && !types[ev.Type] && ev.Type != "events.dropped" {
+				continue
+			}
+			if err := s.sendEvent(w, ev); err != nil {
+				return
+			}
+		}
+	}
+}
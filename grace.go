@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Late answers. Someone who opened the page before the request expired may
+// still be filling in a long form when it does. With answer_grace_seconds
+// set, such a request stays open that much longer: the page keeps its
+// buttons, the answer is accepted and sent as user.submitted with
+// "late": true, and request.expired only follows once the grace period is
+// over without an answer. Requests nobody opened in time expire as before.
+//
+// Expiry and answers also settle the request status with conditional
+// updates, so that a request never ends both expired and answered when an
+// answer comes in just as the expiry timer fires.
+
+const maxAnswerGraceSeconds = 3600
+
+// graceLeft returns how much longer requestID, which expires (or expired) at
+// expiresAt, takes answers after expiring: the rest of answer_grace_seconds
+// if the page was opened before expiresAt, else 0.
+func (s *server) graceLeft(ctx context.Context, requestID string, expiresAt time.Time) time.Duration {
+	grace := time.Duration(s.cfg().AnswerGraceSeconds) * time.Second
+	left := time.Until(expiresAt.Add(grace))
+	if grace <= 0 || left <= 0 {
+		return 0
+	}
+	rc, err := s.db.receipts(ctx, requestID, "")
+	if err != nil || rc.SeenAt == 0 || rc.SeenAt > expiresAt.Unix() {
+		return 0
+	}
+	return left
+}
+
+// lateAnswerAllowed reports whether requestID has expired but still takes
+// answers.
+func (s *server) lateAnswerAllowed(ctx context.Context, requestID string) bool {
+	status, expiresAt, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil || isTerminalStatus(status) || time.Now().Unix() <= expiresAt {
+		return false
+	}
+	return s.graceLeft(ctx, requestID, time.Unix(expiresAt, 0)) > 0
+}
+
+// expireUnanswered marks requestID expired unless it was answered or has
+// finished otherwise. It reports whether it did.
+func (s *store) expireUnanswered(ctx context.Context, reqID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE requests SET status='expired', updated_at=? WHERE request_id=?
+		 AND status NOT IN ('submitted','expired','notify_failed','cancelled')
+		 AND NOT EXISTS (SELECT 1 FROM answers WHERE request_id=?)`,
+		time.Now().Unix(), reqID, reqID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// markSubmitted marks an answered request submitted unless it has finished
+// in the meantime. It reports whether it did.
+func (s *store) markSubmitted(ctx context.Context, reqID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE requests SET status='submitted', updated_at=? WHERE request_id=?
+		 AND status NOT IN ('submitted','expired','notify_failed','cancelled')`,
+		time.Now().Unix(), reqID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *store) deleteAnswer(ctx context.Context, reqID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM answers WHERE request_id=?`, reqID)
+	return err
+}
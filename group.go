@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Group asks. `to` may list several contacts (or rotations, which stand for
+// whoever is on call): "to": ["alice", "bob", "carol"], or to=alice,bob,carol
+// in GET requests. Each gets their own link through their own channels, as if
+// they had been written out in responders.list, and the ask collects
+// everyone's answer unless `responders` picks another mode (its list and
+// count are taken from `to`).
+//
+// GET /v1/requests/{id} then reports each recipient's state under
+// "recipients": when they were notified, first opened the page, acknowledged
+// and answered, and what they answered. This works for every ask with named
+// responders, group or not.
+
+// addressees is askRequest.To: one contact or rotation, or several separated
+// by commas. In JSON it may also be a list of names.
+type addressees string
+
+func (a *addressees) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = addressees(one)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("to must be a name or a list of names")
+	}
+	*a = addressees(strings.Join(list, ","))
+	return nil
+}
+
+// names splits the addressees, dropping blanks and repeats.
+func (a addressees) names() []string {
+	var out []string
+	seen := map[string]struct{}{}
+	for n := range strings.SplitSeq(string(a), ",") {
+		n = strings.TrimSpace(n)
+		if _, dup := seen[n]; n == "" || dup {
+			continue
+		}
+		seen[n] = struct{}{}
+		out = append(out, n)
+	}
+	return out
+}
+
+// expandGroup turns a `to` with several names into responders. It runs
+// before normalizeResponders, which checks the result.
+func (s *server) expandGroup(ctx context.Context, ar *askRequest) error {
+	names := ar.To.names()
+	if len(names) < 2 {
+		return nil
+	}
+	rs := ar.Responders
+	if rs == nil {
+		rs = &respondersSpec{}
+	}
+	if len(rs.List) > 0 || rs.Count > 0 {
+		return badAskError("a to list names the responders; leave out responders.list and responders.count")
+	}
+	if rs.Mode == "" {
+		rs.Mode = respondersModeCollect
+	}
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		if rc, ok := s.cfg().rotation(name); ok {
+			contact, _, err := s.onCall(ctx, rc, time.Now())
+			if err != nil {
+				return err
+			}
+			name = contact
+		} else if _, ok := s.cfg().contact(name); !ok {
+			return badAskError("to must name configured contacts or rotations")
+		}
+		if _, dup := seen[name]; dup {
+			continue
+		}
+		seen[name] = struct{}{}
+		rs.List = append(rs.List, responderSpec{Name: name})
+	}
+	ar.Responders = rs
+	ar.To = ""
+	return nil
+}
+
+type recipientState struct {
+	Name           string
+	DelegatedTo    string
+	RevokedAt      int64
+	NotifiedAt     int64
+	NotifyFailed   bool
+	ViewedAt       int64
+	AcknowledgedAt int64
+	AnsweredAt     int64
+	Action         string
+	Text           string
+}
+
+func (rs recipientState) status() string {
+	switch {
+	case rs.AnsweredAt > 0:
+		return "answered"
+	case rs.DelegatedTo != "":
+		return "forwarded"
+	case rs.AcknowledgedAt > 0:
+		return "acknowledged"
+	case rs.ViewedAt > 0:
+		return "viewed"
+	case rs.NotifiedAt > 0:
+		return "notified"
+	case rs.NotifyFailed:
+		return "notify_failed"
+	}
+	return "pending"
+}
+
+func (rs recipientState) view() map[string]any {
+	out := map[string]any{
+		"name":            rs.Name,
+		"status":          rs.status(),
+		"notified_at":     unixOrNil(rs.NotifiedAt),
+		"viewed_at":       unixOrNil(rs.ViewedAt),
+		"acknowledged_at": unixOrNil(rs.AcknowledgedAt),
+		"answered_at":     unixOrNil(rs.AnsweredAt),
+		"action":          nullIfEmpty(rs.Action),
+		"text":            nullIfEmpty(rs.Text),
+	}
+	if rs.DelegatedTo != "" {
+		out["forwarded_to"] = rs.DelegatedTo
+	}
+	if rs.RevokedAt > 0 {
+		out["revoked_at"] = unixOrNil(rs.RevokedAt)
+	}
+	return out
+}
+
+// recipients returns the state of each named responder of reqID, in the
+// order their links were made (by name within a second); nil when the
+// request has none.
+func (s *store) recipients(ctx context.Context, reqID string) ([]recipientState, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT responder, delegated_to, revoked_at FROM tokens
+		 WHERE request_id=? AND responder IS NOT NULL AND responder<>'' ORDER BY created_at ASC, responder ASC`,
+		reqID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var out []recipientState
+	index := map[string]int{}
+	for rows.Next() {
+		var name string
+		var delegated sql.NullString
+		var revoked sql.NullInt64
+		if err := rows.Scan(&name, &delegated, &revoked); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, dup := index[name]; dup {
+			continue
+		}
+		index[name] = len(out)
+		out = append(out, recipientState{Name: name, DelegatedTo: delegated.String, RevokedAt: revoked.Int64})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(out) == 0 {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx,
+		`SELECT type, payload_json, payload_encoding, created_at FROM events
+		 WHERE request_id=? AND type IN ('notify.sent','notify.responder_failed','user.page_loaded','user.viewing','user.acknowledged','user.submitted')
+		 ORDER BY seq ASC`,
+		reqID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var typ, payload string
+		var encoding sql.NullString
+		var at int64
+		if err := rows.Scan(&typ, &payload, &encoding, &at); err != nil {
+			return nil, err
+		}
+		var d struct {
+			Responder string `json:"responder"`
+			Device    string `json:"device"`
+			Action    string `json:"action"`
+			Text      string `json:"text"`
+		}
+		_ = json.Unmarshal(decodeEventPayload(payload, encoding), &d)
+		i, ok := index[d.Responder]
+		if !ok || d.Device == deviceBot {
+			continue
+		}
+		rs := &out[i]
+		switch typ {
+		case "notify.sent":
+			if rs.NotifiedAt == 0 {
+				rs.NotifiedAt = at
+			}
+		case "notify.responder_failed":
+			rs.NotifyFailed = true
+		case "user.page_loaded", "user.viewing":
+			if rs.ViewedAt == 0 {
+				rs.ViewedAt = at
+			}
+		case "user.acknowledged":
+			if rs.AcknowledgedAt == 0 {
+				rs.AcknowledgedAt = at
+			}
+		case "user.submitted":
+			rs.AnsweredAt, rs.Action, rs.Text = at, d.Action, d.Text
+		}
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Probe endpoints, unauthenticated so Docker and Kubernetes can reach them:
+//
+//   - /healthz: the process is up and serving.
+//   - /readyz: the database answers and a notification channel is configured
+//     (and, for apprise, its binary is on PATH); 503 otherwise.
+//   - /version: what is running. Release builds set version, commit and
+//     buildDate with -ldflags "-X main.version=..."; other builds fall back to
+//     the VCS stamp Go embeds.
+
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+const readyTimeout = 2 * time.Second
+
+func buildInfo() map[string]any {
+	c, d := commit, buildDate
+	if c == "" || d == "" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				switch {
+				case s.Key == "vcs.revision" && c == "":
+					c = s.Value
+				case s.Key == "vcs.time" && d == "":
+					d = s.Value
+				}
+			}
+		}
+	}
+	return map[string]any{
+		"version":    version,
+		"commit":     nullIfEmpty(c),
+		"build_date": nullIfEmpty(d),
+		"go":         runtime.Version(),
+	}
+}
+
+// notifierCheck reports whether the default notification target can be used.
+func (s *server) notifierCheck() (bool, string) {
+	target := s.defaultNotifyTarget()
+	if strings.TrimSpace(target.ServerChanSendKey) != "" {
+		return true, "serverchan"
+	}
+	if len(target.AppriseURLs) == 0 {
+		return false, "no serverchan_sendkey or apprise_urls configured"
+	}
+	if _, err := exec.LookPath(s.cfg().AppriseBin); err != nil {
+		return false, "apprise: " + err.Error()
+	}
+	return true, "apprise"
+}
+
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	ready := true
+	checks := map[string]any{}
+	if err := s.db.db.PingContext(ctx); err != nil {
+		ready = false
+		checks["database"] = map[string]any{"ok": false, "error": err.Error()}
+	} else {
+		checks["database"] = map[string]any{"ok": true, "driver": s.db.db.dialect.name()}
+	}
+	ok, detail := s.notifierCheck()
+	if !ok && len(s.defaultNotifyTarget().AppriseURLs) == 0 && s.hasWebPush(ctx) {
+		ok, detail = true, "webpush"
+	}
+	ready = ready && ok
+	if ok {
+		checks["notifier"] = map[string]any{"ok": true, "channel": detail}
+	} else {
+		checks["notifier"] = map[string]any{"ok": false, "error": detail}
+	}
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildInfo())
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// A hub broker relays runtimeHub traffic between ask4me instances that share
+// a database, so an answer submitted on one replica wakes the SSE/nonStream
+// client connected to another. Without a broker the hub is process-local.
+//
+// Without a broker, waiting clients (POST /v1/ask, its SSE stream) also poll
+// the database every hub_poll_interval_seconds, so an answer saved by another
+// process still reaches them, only a little later. Polling is on by default
+// with the memory hub; a negative interval turns it off.
+
+const (
+	hubDriverMemory = "memory"
+	hubDriverRedis  = "redis"
+	hubDriverNATS   = "nats"
+
+	defaultHubChannel = "ask4me.hub"
+
+	defaultHubPollIntervalSeconds = 5
+)
+
+type hubBroker interface {
+	publish(ctx context.Context, payload []byte) error
+	// subscribe calls deliver for every message until ctx is done.
+	subscribe(ctx context.Context, deliver func([]byte)) error
+	close() error
+}
+
+// hubMessage is what instances exchange. Messages carry the sender's origin so
+// an instance ignores its own broadcasts.
+type hubMessage struct {
+	Origin   string `json:"origin"`
+	Key      string `json:"key"`
+	Terminal bool   `json:"terminal,omitempty"`
+	Event    Event  `json:"event"`
+}
+
+func newHubBroker(cfg Config) (hubBroker, error) {
+	switch cfg.HubDriver {
+	case "", hubDriverMemory:
+		return nil, nil
+	case hubDriverRedis:
+		return newRedisBroker(cfg.HubURL, cfg.HubChannel)
+	case hubDriverNATS:
+		return newNATSBroker(cfg.HubURL, cfg.HubChannel)
+	}
+	return nil, fmt.Errorf("unknown hub_driver %q (want memory, redis or nats)", cfg.HubDriver)
+}
+
+// hubPoll returns a channel that ticks every hub_poll_interval_seconds, or a
+// nil channel when polling is off, and a func that stops it.
+func (s *server) hubPoll() (<-chan time.Time, func()) {
+	n := s.cfg().HubPollIntervalSeconds
+	if n <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(time.Duration(n) * time.Second)
+	return t.C, t.Stop
+}
+
+// attachBroker starts relaying through b until ctx is done.
+func (h *runtimeHub) attachBroker(ctx context.Context, b hubBroker) {
+	h.mu.Lock()
+	h.broker = b
+	h.mu.Unlock()
+	go func() {
+		for ctx.Err() == nil {
+			err := b.subscribe(ctx, h.receive)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Error("hub: subscribe", "error", err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// relay forwards a local publish to the other instances.
+func (h *runtimeHub) relay(msg hubMessage) {
+	h.mu.Lock()
+	b := h.broker
+	h.mu.Unlock()
+	if b == nil {
+		return
+	}
+	msg.Origin = h.origin
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := b.publish(ctx, payload); err != nil {
+		slog.Error("hub: publish", "request_id", msg.Event.RequestID, "event", msg.Event.Type, "error", err)
+	}
+}
+
+func (h *runtimeHub) receive(payload []byte) {
+	var msg hubMessage
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Origin == h.origin {
+		return
+	}
+	if msg.Terminal {
+		h.setTerminalLocal(msg.Event)
+		return
+	}
+	h.publishLocal(msg.Key, msg.Event)
+}
+
+type redisBroker struct {
+	client  *redis.Client
+	channel string
+}
+
+func newRedisBroker(rawURL, channel string) (*redisBroker, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("hub_url: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect redis: %w", err)
+	}
+	return &redisBroker{client: client, channel: channel}, nil
+}
+
+func (b *redisBroker) publish(ctx context.Context, payload []byte) error {
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+func (b *redisBroker) subscribe(ctx context.Context, deliver func([]byte)) error {
+	ps := b.client.Subscribe(ctx, b.channel)
+	defer ps.Close()
+	if _, err := ps.Receive(ctx); err != nil {
+		return err
+	}
+	ch := ps.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			deliver([]byte(m.Payload))
+		}
+	}
+}
+
+func (b *redisBroker) close() error { return b.client.Close() }
+
+type natsBroker struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSBroker(rawURL, subject string) (*natsBroker, error) {
+	conn, err := nats.Connect(rawURL, nats.Name("ask4me"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connect nats: %w", err)
+	}
+	return &natsBroker{conn: conn, subject: subject}, nil
+}
+
+func (b *natsBroker) publish(_ context.Context, payload []byte) error {
+	return b.conn.Publish(b.subject, payload)
+}
+
+func (b *natsBroker) subscribe(ctx context.Context, deliver func([]byte)) error {
+	sub, err := b.conn.Subscribe(b.subject, func(m *nats.Msg) { deliver(m.Data) })
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return sub.Unsubscribe()
+}
+
+func (b *natsBroker) close() error {
+	b.conn.Close()
+	return nil
+}
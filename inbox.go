@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ask4me inbox answers asks from a terminal. It lists the pending requests
+// of a running server over the API and answers the one picked: a button by
+// its number, text (and JSON Forms answers) in $VISUAL / $EDITOR, or on the
+// prompt when no editor is set. It works anywhere the API can be reached, so
+// over SSH too.
+//
+// The server and key come from -server / -key, ASK4ME_SERVER /
+// ASK4ME_API_KEY, or else the local config (base_url and api_key). Answers
+// need a key with the admin scope; in multi-responder mode -as names the
+// responder to answer for. Multi-step asks are left to their page.
+
+const inboxTimeout = 15 * time.Second
+
+type inboxClient struct {
+	base string
+	key  string
+	http *http.Client
+}
+
+// call sends a JSON request and decodes the JSON reply into out (if not nil).
+func (c *inboxClient) call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.key)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			msg = e.Error
+		}
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, truncate(msg, 200))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+type inboxItem struct {
+	RequestID       string          `json:"request_id"`
+	Title           string          `json:"title"`
+	Body            string          `json:"body"`
+	Status          string          `json:"status"`
+	Priority        string          `json:"priority"`
+	CreatedAt       string          `json:"created_at"`
+	ExpiresAt       string          `json:"expires_at"`
+	MCD             string          `json:"mcd"`
+	JSONFormsSchema json.RawMessage `json:"jsonforms_schema"`
+	Steps           int             `json:"steps"`
+}
+
+// pending lists the open requests, newest first.
+func (c *inboxClient) pending(ctx context.Context) ([]inboxItem, error) {
+	var out []inboxItem
+	for _, status := range []string{"delivered", "created"} {
+		var resp struct {
+			Requests []inboxItem `json:"requests"`
+		}
+		if err := c.call(ctx, http.MethodGet, "/v1/requests?limit=100&status="+status, nil, &resp); err != nil {
+			return nil, err
+		}
+		out = append(out, resp.Requests...)
+	}
+	now := time.Now()
+	open := out[:0]
+	for _, it := range out {
+		if t, err := time.Parse(time.RFC3339, it.ExpiresAt); err == nil && t.After(now) {
+			open = append(open, it)
+		}
+	}
+	sort.SliceStable(open, func(i, j int) bool { return open[i].CreatedAt > open[j].CreatedAt })
+	return open, nil
+}
+
+type inbox struct {
+	client *inboxClient
+	as     string
+	in     *bufio.Scanner
+	out    io.Writer
+}
+
+func runInbox(args []string, stdin io.Reader, stdout io.Writer) error {
+	var configPath, server, key, as string
+	fs := flag.NewFlagSet("inbox", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "config file to take base_url and api_key from (default: auto-detect)")
+	fs.StringVar(&server, "server", os.Getenv("ASK4ME_SERVER"), "server URL (default: $ASK4ME_SERVER, else base_url from the config)")
+	fs.StringVar(&key, "key", os.Getenv("ASK4ME_API_KEY"), "API key with the admin scope (default: $ASK4ME_API_KEY, else api_key from the config)")
+	fs.StringVar(&as, "as", "", "responder to answer as, for multi-responder asks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if server == "" || key == "" {
+		cfg, used, err := loadConfigAuto(configPath)
+		if err != nil {
+			if used != "" {
+				return fmt.Errorf("load config (%s): %w; or pass -server and -key", used, err)
+			}
+			return fmt.Errorf("%w; or pass -server and -key", err)
+		}
+		if server == "" {
+			server = cfg.BaseURL
+		}
+		if key == "" {
+			key = cfg.APIKey
+		}
+	}
+	u, err := url.Parse(strings.TrimSpace(server))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid server URL %q", server)
+	}
+	if strings.TrimSpace(key) == "" {
+		return errors.New("no API key: pass -key or set ASK4ME_API_KEY")
+	}
+	ib := &inbox{
+		client: &inboxClient{base: strings.TrimRight(u.String(), "/"), key: strings.TrimSpace(key), http: &http.Client{Timeout: inboxTimeout}},
+		as:     strings.TrimSpace(as),
+		in:     bufio.NewScanner(stdin),
+		out:    stdout,
+	}
+	return ib.run()
+}
+
+// prompt prints p and reads one line; ok is false at end of input.
+func (ib *inbox) prompt(p string) (string, bool) {
+	fmt.Fprint(ib.out, p)
+	if !ib.in.Scan() {
+		fmt.Fprintln(ib.out)
+		return "", false
+	}
+	return strings.TrimSpace(ib.in.Text()), true
+}
+
+func (ib *inbox) run() error {
+	for {
+		items, err := ib.client.pending(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(ib.out, "\nPending requests (%d)\n", len(items))
+		for i, it := range items {
+			fmt.Fprintf(ib.out, "  %2d. %s  (%s)\n", i+1, oneLine(it.Title, 60), inboxMeta(it))
+		}
+		choice, ok := ib.prompt("[number] open  [r] refresh  [q] quit > ")
+		if !ok {
+			return nil
+		}
+		switch strings.ToLower(choice) {
+		case "", "r":
+			continue
+		case "q":
+			return nil
+		}
+		n, err := strconv.Atoi(choice)
+		if err != nil || n < 1 || n > len(items) {
+			fmt.Fprintln(ib.out, "No such request.")
+			continue
+		}
+		if !ib.open(items[n-1].RequestID) {
+			return nil
+		}
+	}
+}
+
+// open shows one request and answers it. It returns false at end of input.
+func (ib *inbox) open(requestID string) bool {
+	var it inboxItem
+	if err := ib.client.call(context.Background(), http.MethodGet, "/v1/requests/"+url.PathEscape(requestID), nil, &it); err != nil {
+		fmt.Fprintln(ib.out, err)
+		return true
+	}
+	fmt.Fprintf(ib.out, "\n%s\n%s\n", it.Title, strings.Repeat("-", min(len(it.Title), 60)))
+	if it.Body != "" {
+		fmt.Fprintln(ib.out, it.Body)
+	}
+	fmt.Fprintf(ib.out, "(%s, %s)\n\n", it.RequestID, inboxMeta(it))
+	if it.Steps > 0 {
+		fmt.Fprintf(ib.out, "This request has %d steps; answer it on its page.\n", it.Steps)
+		return true
+	}
+	jsonForms := len(it.JSONFormsSchema) > 0
+	var spec mcdSpec
+	if !jsonForms {
+		spec = parseMCD(it.MCD)
+	}
+	for i, b := range spec.Buttons {
+		fmt.Fprintf(ib.out, "  %d. %s\n", i+1, b.Label)
+	}
+	textLabel := ""
+	switch {
+	case jsonForms:
+		fmt.Fprintln(ib.out, "  e. Edit the answer as JSON")
+	case spec.Input != nil:
+		textLabel = spec.Input.Label
+		fmt.Fprintf(ib.out, "  t. %s\n", textLabel)
+	case len(spec.Buttons) == 0:
+		textLabel = "Reply with text"
+		fmt.Fprintln(ib.out, "  t. Reply with text")
+	}
+	fmt.Fprintln(ib.out, "  b. Back")
+	for {
+		choice, ok := ib.prompt("> ")
+		if !ok {
+			return false
+		}
+		answer := map[string]any{}
+		switch c := strings.ToLower(choice); {
+		case c == "b" || c == "":
+			return true
+		case c == "t" && textLabel != "":
+			text, ok := ib.edit("", "# "+textLabel)
+			if !ok || strings.TrimSpace(text) == "" {
+				fmt.Fprintln(ib.out, "Nothing sent.")
+				continue
+			}
+			answer["text"] = strings.TrimSpace(text)
+		case c == "e" && jsonForms:
+			text, ok := ib.edit("{}\n", schemaComment(it.JSONFormsSchema))
+			if !ok {
+				continue
+			}
+			if !json.Valid([]byte(text)) {
+				fmt.Fprintln(ib.out, "Not valid JSON; nothing sent.")
+				continue
+			}
+			answer["payload"] = json.RawMessage(text)
+		default:
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 1 || n > len(spec.Buttons) {
+				fmt.Fprintln(ib.out, "No such choice.")
+				continue
+			}
+			answer["action"] = spec.Buttons[n-1].Value
+		}
+		if ib.as != "" {
+			answer["responder"] = ib.as
+		}
+		if err := ib.client.call(context.Background(), http.MethodPost, "/v1/requests/"+url.PathEscape(it.RequestID)+"/answer", answer, nil); err != nil {
+			fmt.Fprintln(ib.out, err)
+			return true
+		}
+		fmt.Fprintln(ib.out, "Answered.")
+		return true
+	}
+}
+
+// edit gets a longer answer from $VISUAL / $EDITOR, prefilled with initial
+// and followed by hint lines starting with "#", which are dropped. Without an
+// editor it reads one line from the prompt instead.
+func (ib *inbox) edit(initial, hint string) (string, bool) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		fmt.Fprintln(ib.out, hint)
+		return ib.prompt("answer> ")
+	}
+	f, err := os.CreateTemp("", "ask4me-answer-*.txt")
+	if err != nil {
+		fmt.Fprintln(ib.out, err)
+		return "", false
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(initial + "\n" + hint + "\n# Lines starting with # are ignored. Save and quit to send.\n")
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(ib.out, err)
+		return "", false
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/c", editor+" "+f.Name())
+	} else {
+		cmd = exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(ib.out, "editor:", err)
+		return "", false
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		fmt.Fprintln(ib.out, err)
+		return "", false
+	}
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(l), "#") {
+			lines = append(lines, l)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), true
+}
+
+// schemaComment shows a JSON schema as hint lines for the editor.
+func schemaComment(schema json.RawMessage) string {
+	var b bytes.Buffer
+	if json.Indent(&b, schema, "", "  ") != nil {
+		b.Reset()
+		b.Write(schema)
+	}
+	lines := strings.Split(b.String(), "\n")
+	for i, l := range lines {
+		lines[i] = "# " + l
+	}
+	return "# Answer with JSON matching this schema:\n" + strings.Join(lines, "\n")
+}
+
+func inboxMeta(it inboxItem) string {
+	parts := []string{}
+	if it.Priority != "" && it.Priority != priorityNormal {
+		parts = append(parts, it.Priority)
+	}
+	if t, err := time.Parse(time.RFC3339, it.ExpiresAt); err == nil {
+		parts = append(parts, "expires in "+formatLeft(time.Until(t)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatLeft renders a duration the way the interaction page's countdown
+// does: "2d 3h", "1h 5m", "4m 32s" or "32s".
+func formatLeft(d time.Duration) string {
+	s := int((d + time.Second - 1) / time.Second)
+	if s < 0 {
+		s = 0
+	}
+	days, h, m := s/86400, s%86400/3600, s%3600/60
+	s %= 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, h)
+	case h > 0:
+		return fmt.Sprintf("%dh %dm", h, m)
+	case m > 0:
+		return fmt.Sprintf("%dm %ds", m, s)
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+func oneLine(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ask4me init writes a commented starter config: ask4me.yaml, or .env with
+// -format env. Values come from flags; on a terminal, anything not given is
+// asked for, with the default in brackets (-y accepts every default). The API
+// key is generated unless -api-key is passed. The file is created with mode
+// 0600 since it holds secrets, and is loaded once written to make sure it
+// validates.
+
+type initOptions struct {
+	Format            string
+	Out               string
+	BaseURL           string
+	ListenAddr        string
+	APIKey            string
+	Channel           string
+	ServerChanSendKey string
+	AppriseURLs       string
+	SQLitePath        string
+}
+
+// runInit implements the init command; args are those after "init".
+func runInit(args []string, stdin io.Reader, stdout io.Writer) error {
+	var o initOptions
+	var yes, force bool
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.StringVar(&o.Format, "format", "yaml", "config format: yaml or env")
+	fs.StringVar(&o.Out, "out", "", "file to write (default ./ask4me.yaml, or ./.env for -format env)")
+	fs.StringVar(&o.BaseURL, "base-url", "", "public URL phones open interaction links at")
+	fs.StringVar(&o.ListenAddr, "listen", "", "listen address (default :8080)")
+	fs.StringVar(&o.APIKey, "api-key", "", "API key for agents (default: generated)")
+	fs.StringVar(&o.Channel, "channel", "", "notification channel: serverchan, apprise or none")
+	fs.StringVar(&o.ServerChanSendKey, "serverchan-sendkey", "", "ServerChan SendKey")
+	fs.StringVar(&o.AppriseURLs, "apprise-urls", "", "comma-separated Apprise URLs")
+	fs.StringVar(&o.SQLitePath, "sqlite-path", "", "SQLite database file (default ./ask4me.db)")
+	fs.BoolVar(&yes, "y", false, "do not ask; use flags and defaults")
+	fs.BoolVar(&force, "force", false, "overwrite an existing file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	o.Format = strings.ToLower(strings.TrimSpace(o.Format))
+	switch o.Format {
+	case "yaml", "yml":
+		o.Format = "yaml"
+	case "env":
+	default:
+		return fmt.Errorf("unknown -format %q (want yaml or env)", o.Format)
+	}
+	if o.Out == "" {
+		o.Out = "./ask4me.yaml"
+		if o.Format == "env" {
+			o.Out = "./.env"
+		}
+	}
+	if fileExists(o.Out) && !force {
+		return fmt.Errorf("%s already exists; pass -force to overwrite it", o.Out)
+	}
+	if o.Channel == "" {
+		switch {
+		case o.ServerChanSendKey != "":
+			o.Channel = "serverchan"
+		case o.AppriseURLs != "":
+			o.Channel = "apprise"
+		}
+	}
+
+	interactive := !yes && isTerminal(stdin)
+	p := &prompter{in: bufio.NewReader(stdin), out: stdout, on: interactive}
+	o.BaseURL = p.ask("Public base URL (what phones open)", o.BaseURL, "http://localhost:8080")
+	o.ListenAddr = p.ask("Listen address", o.ListenAddr, ":8080")
+	o.SQLitePath = p.ask("SQLite database file", o.SQLitePath, "./ask4me.db")
+	o.Channel = strings.ToLower(p.ask("Notification channel (serverchan, apprise, none)", o.Channel, "serverchan"))
+	switch o.Channel {
+	case "serverchan":
+		o.ServerChanSendKey = p.ask("ServerChan SendKey (https://sct.ftqq.com)", o.ServerChanSendKey, "")
+	case "apprise":
+		o.AppriseURLs = p.ask("Apprise URLs, comma-separated (https://github.com/caronc/apprise)", o.AppriseURLs, "")
+	case "none":
+	default:
+		return fmt.Errorf("unknown -channel %q (want serverchan, apprise or none)", o.Channel)
+	}
+	generated := o.APIKey == ""
+	if generated {
+		o.APIKey = genToken()
+	}
+
+	var body string
+	if o.Format == "env" {
+		body = renderInitEnv(o)
+	} else {
+		body = renderInitYAML(o)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(o.Out, flags, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if _, err := loadConfigAny(o.Out); err != nil {
+		return fmt.Errorf("wrote %s, but it does not load: %w", o.Out, err)
+	}
+
+	fmt.Fprintf(stdout, "\nWrote %s\n", o.Out)
+	if generated {
+		fmt.Fprintf(stdout, "API key: %s\n", o.APIKey)
+	}
+	if o.Channel == "none" || (o.ServerChanSendKey == "" && o.AppriseURLs == "") {
+		fmt.Fprintln(stdout, "No notification channel is set yet; edit the file before going live.")
+	}
+	fmt.Fprintf(stdout, "Next: ask4me doctor -config %s\n      ask4me -config %s\n", o.Out, o.Out)
+	return nil
+}
+
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	on  bool
+}
+
+// ask returns given if set, else asks (when on) and falls back to def.
+func (p *prompter) ask(question, given, def string) string {
+	if given != "" {
+		return strings.TrimSpace(given)
+	}
+	if !p.on {
+		return def
+	}
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if line = strings.TrimSpace(line); line == "" || (err != nil && !errors.Is(err, io.EOF)) {
+		return def
+	}
+	return line
+}
+
+func renderInitYAML(o initOptions) string {
+	var b strings.Builder
+	b.WriteString("# ask4me config, written by `ask4me init`. See README.md for every option.\n\n")
+	b.WriteString("# Public URL of this server; notification links point here.\n")
+	fmt.Fprintf(&b, "base_url: %s\n", strconv.Quote(o.BaseURL))
+	b.WriteString("# Agents send it as `Authorization: Bearer <api_key>`. Keep it secret.\n")
+	fmt.Fprintf(&b, "api_key: %s\n", strconv.Quote(o.APIKey))
+	fmt.Fprintf(&b, "listen_addr: %s\n", strconv.Quote(o.ListenAddr))
+	fmt.Fprintf(&b, "sqlite_path: %s\n\n", strconv.Quote(o.SQLitePath))
+	b.WriteString("# Notification channel: a ServerChan SendKey, or Apprise URLs (ServerChan wins if both are set).\n")
+	if o.ServerChanSendKey != "" {
+		fmt.Fprintf(&b, "serverchan_sendkey: %s\n", strconv.Quote(o.ServerChanSendKey))
+	} else {
+		b.WriteString("# serverchan_sendkey: \"sctp...\"\n")
+	}
+	if urls := parseCSVStrings(o.AppriseURLs); len(urls) > 0 {
+		b.WriteString("apprise_urls:\n")
+		for _, u := range urls {
+			fmt.Fprintf(&b, "  - %s\n", strconv.Quote(u))
+		}
+	} else {
+		b.WriteString("# apprise_urls: [\"tgram://bottoken/chatid\"]\n")
+	}
+	b.WriteString("apprise_bin: \"apprise\"\n\n")
+	b.WriteString("# How long an ask waits for an answer unless it sets expires_in_seconds.\n")
+	b.WriteString("default_expires_in_seconds: 3600\n")
+	b.WriteString("sse_heartbeat_interval_seconds: 15\n")
+	b.WriteString("terminal_cache_seconds: 60\n\n")
+	b.WriteString("# log_level: info\n")
+	b.WriteString("# tls_mode: acme\n")
+	b.WriteString("# acme_domains: [\"ask.example.com\"]\n")
+	return b.String()
+}
+
+func renderInitEnv(o initOptions) string {
+	var b strings.Builder
+	b.WriteString("# ask4me config, written by `ask4me init`. See .env.example and README.md for every option.\n\n")
+	b.WriteString("# Public URL of this server; notification links point here.\n")
+	fmt.Fprintf(&b, "ASK4ME_BASE_URL=%s\n", strconv.Quote(o.BaseURL))
+	b.WriteString("# Agents send it as `Authorization: Bearer <api_key>`. Keep it secret.\n")
+	fmt.Fprintf(&b, "ASK4ME_API_KEY=%s\n", strconv.Quote(o.APIKey))
+	fmt.Fprintf(&b, "ASK4ME_LISTEN_ADDR=%s\n", strconv.Quote(o.ListenAddr))
+	fmt.Fprintf(&b, "ASK4ME_SQLITE_PATH=%s\n\n", strconv.Quote(o.SQLitePath))
+	b.WriteString("# Notification channel: a ServerChan SendKey, or comma-separated Apprise URLs.\n")
+	if o.ServerChanSendKey != "" {
+		fmt.Fprintf(&b, "ASK4ME_SERVERCHAN_SENDKEY=%s\n", strconv.Quote(o.ServerChanSendKey))
+	} else {
+		b.WriteString("# ASK4ME_SERVERCHAN_SENDKEY=sctp...\n")
+	}
+	if urls := parseCSVStrings(o.AppriseURLs); len(urls) > 0 {
+		fmt.Fprintf(&b, "ASK4ME_APPRISE_URLS=%s\n", strconv.Quote(strings.Join(urls, ",")))
+	} else {
+		b.WriteString("# ASK4ME_APPRISE_URLS=tgram://bottoken/chatid\n")
+	}
+	b.WriteString("ASK4ME_APPRISE_BIN=apprise\n\n")
+	b.WriteString("# How long an ask waits for an answer unless it sets expires_in_seconds.\n")
+	b.WriteString("ASK4ME_DEFAULT_EXPIRES_IN_SECONDS=3600\n")
+	b.WriteString("ASK4ME_SSE_HEARTBEAT_INTERVAL_SECONDS=15\n")
+	b.WriteString("ASK4ME_TERMINAL_CACHE_SECONDS=60\n\n")
+	b.WriteString("# ASK4ME_LOG_LEVEL=info\n")
+	b.WriteString("# ASK4ME_TLS_MODE=acme\n")
+	b.WriteString("# ASK4ME_ACME_DOMAINS=ask.example.com\n")
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IP access rules, kept apart for the API (/v1/* and the /admin dashboard,
+// usually only the agent's host) and the interaction pages (/r/*, short
+// links /s/*, one-tap answers /tap/* and bundle pages /b/*, usually home or
+// phone networks).
+// A client in a deny list is refused; if an allow list is set, a client must
+// also be in it. Refused requests get 403 before authentication. Client IPs
+// are resolved through trusted proxies (see proxy.go).
+
+func (c *Config) parseIPRules() error {
+	var err error
+	lists := []struct {
+		key  string
+		list []string
+		dst  *[]*net.IPNet
+	}{
+		{"trusted_proxies", c.TrustedProxies, &c.trustedNets},
+		{"api_allow_ips", c.APIAllowIPs, &c.apiAllowNets},
+		{"api_deny_ips", c.APIDenyIPs, &c.apiDenyNets},
+		{"page_allow_ips", c.PageAllowIPs, &c.pageAllowNets},
+		{"page_deny_ips", c.PageDenyIPs, &c.pageDenyNets},
+	}
+	for _, l := range lists {
+		if *l.dst, err = parseCIDRs(l.key, l.list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ipAllowed(ip string, allow, deny []*net.IPNet) bool {
+	if ipInNets(ip, deny) {
+		return false
+	}
+	return len(allow) == 0 || ipInNets(ip, allow)
+}
+
+// filterIPs applies the api_* rules to /v1/ and /admin, and the page_* rules
+// to /r/, /s/, /tap/ and /b/.
+func (s *server) filterIPs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		var allow, deny []*net.IPNet
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/"), r.URL.Path == "/admin", strings.HasPrefix(r.URL.Path, "/admin/"):
+			allow, deny = cfg.apiAllowNets, cfg.apiDenyNets
+		case strings.HasPrefix(r.URL.Path, "/r/"), strings.HasPrefix(r.URL.Path, "/s/"), strings.HasPrefix(r.URL.Path, "/tap/"), strings.HasPrefix(r.URL.Path, bundlePathPrefix):
+			allow, deny = cfg.pageAllowNets, cfg.pageDenyNets
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(allow)+len(deny) > 0 && !ipAllowed(s.clientIP(r), allow, deny) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
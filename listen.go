@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Listeners. listen_addr (and tls_http_addr) is a TCP address like ":8080",
+// or "unix:/run/ask4me/ask4me.sock" for a unix socket that a local Caddy or
+// nginx proxies to. The socket file is replaced if stale, created with
+// listen_socket_mode (default 0660, so a proxy in the same group can connect)
+// and removed on shutdown.
+//
+// Under systemd socket activation (LISTEN_FDS / LISTEN_PID) the passed
+// sockets are used instead: the first serves the app, and with TLS a second
+// one serves tls_http_addr. listen_addr is then ignored.
+//
+// Connections over a unix socket can only come from this host, so they count
+// as coming from a trusted proxy and their X-Forwarded-* headers are used.
+
+const (
+	unixAddrPrefix          = "unix:"
+	defaultListenSocketMode = 0o660
+	// sdListenFDsStart is the first file descriptor systemd passes.
+	sdListenFDsStart = 3
+)
+
+func (c *Config) normalizeListen() error {
+	c.ListenAddr = strings.TrimSpace(c.ListenAddr)
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":8080"
+	}
+	if path, ok := strings.CutPrefix(c.ListenAddr, unixAddrPrefix); ok && strings.TrimSpace(path) == "" {
+		return errors.New("listen_addr: unix: needs a socket path")
+	}
+	c.ListenSocketMode = strings.TrimSpace(c.ListenSocketMode)
+	if c.ListenSocketMode == "" {
+		c.socketMode = defaultListenSocketMode
+		return nil
+	}
+	mode, err := strconv.ParseUint(c.ListenSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("invalid listen_socket_mode %q (want octal, like 0660)", c.ListenSocketMode)
+	}
+	c.socketMode = os.FileMode(mode)
+	return nil
+}
+
+// listenAddr listens on a TCP address or a unix: socket path.
+func listenAddr(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixAddrPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen %s: file exists and is not a socket", path)
+		}
+		// A socket nobody answers on is left over from an earlier run.
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen %s: another process is serving this socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// or nil when the process was not socket-activated.
+func systemdListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// Children must not take these sockets for their own.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	out := make([]net.Listener, 0, n)
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range out {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket activation: fd %d: %w", fd, err)
+		}
+		out = append(out, ln)
+	}
+	return out, nil
+}
+
+// openListeners returns the app listener and, under socket activation with
+// a second socket, the listener for tls_http_addr (nil otherwise).
+func openListeners(cfg Config) (app, plain net.Listener, err error) {
+	activated, err := systemdListeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(activated) > 0 {
+		slog.Info("using systemd socket activation", "sockets", len(activated))
+		for _, extra := range activated[min(len(activated), 2):] {
+			extra.Close()
+		}
+		if len(activated) > 1 {
+			plain = activated[1]
+		}
+		return activated[0], plain, nil
+	}
+	app, err = listenAddr(cfg.ListenAddr, cfg.socketMode)
+	return app, nil, err
+}
+
+type unixConnKey struct{}
+
+// markUnixConn is the http.Server ConnContext hook that notes connections
+// made over a unix socket.
+func markUnixConn(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, unixConnKey{}, true)
+	}
+	return ctx
+}
+
+func viaUnixSocket(r *http.Request) bool {
+	v, _ := r.Context().Value(unixConnKey{}).(bool)
+	return v
+}
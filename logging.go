@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logs go through log/slog. log_format picks text (key=value, the default) or
+// json lines; log_level is debug, info (default), warn or error; log_file
+// sends them to a file instead of stderr, rotated at log_max_size_mb and
+// keeping log_max_backups old files (<file>.1 is the newest).
+//
+// Lines about a request carry request_id; event lines add event and, for
+// deliveries, channel and latency_ms; access lines add method, path, status
+// and latency_ms. Query strings are never logged, since ?k= is a bearer token.
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is shared by the handler so a config reload can change it.
+var logLevel = new(slog.LevelVar)
+
+func (c *Config) normalizeLogging() error {
+	c.LogFormat = strings.ToLower(strings.TrimSpace(c.LogFormat))
+	switch c.LogFormat {
+	case "":
+		c.LogFormat = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("unknown log_format %q (want text or json)", c.LogFormat)
+	}
+	c.LogLevel = strings.ToLower(strings.TrimSpace(c.LogLevel))
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("unknown log_level %q (want debug, info, warn or error)", c.LogLevel)
+	}
+	c.LogFile = strings.TrimSpace(c.LogFile)
+	if c.LogMaxSizeMB <= 0 {
+		c.LogMaxSizeMB = 100
+	}
+	if c.LogMaxBackups < 0 {
+		c.LogMaxBackups = 0
+	} else if c.LogMaxBackups == 0 {
+		c.LogMaxBackups = 5
+	}
+	return nil
+}
+
+// setupLogging installs the configured logger as slog's default. It returns
+// the log file, if any, for the caller to close.
+func setupLogging(cfg Config) (io.Closer, error) {
+	var out io.Writer = os.Stderr
+	var closer io.Closer
+	if cfg.LogFile != "" {
+		f, err := openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSizeMB)<<20, cfg.LogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("open log_file: %w", err)
+		}
+		out, closer = f, f
+	}
+	setLogLevel(cfg.LogLevel)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler
+	if cfg.LogFormat == logFormatJSON {
+		h = slog.NewJSONHandler(out, opts)
+	} else {
+		h = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return closer, nil
+}
+
+// setLogLevel applies an already validated log_level.
+func setLogLevel(level string) {
+	var lvl slog.Level
+	_ = lvl.UnmarshalText([]byte(level))
+	logLevel.Set(lvl)
+}
+
+// rotatingFile is an append-only log file that is renamed to <path>.1 (and
+// older backups shifted up) once it would grow past maxBytes.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups == 0 {
+		_ = os.Remove(r.path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		_ = os.Rename(r.path, r.path+".1")
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// logEvent writes one line per stored event. Delivery events carry their
+// channel and latency_ms.
+func logEvent(ev Event) {
+	attrs := []any{"request_id", ev.RequestID, "event", ev.Type, "event_id", ev.ID}
+	var data struct {
+		Channel   string `json:"channel"`
+		LatencyMS *int64 `json:"latency_ms"`
+		Error     string `json:"error"`
+	}
+	if json.Unmarshal(ev.Data, &data) == nil {
+		if data.Channel != "" {
+			attrs = append(attrs, "channel", data.Channel)
+		}
+		if data.LatencyMS != nil {
+			attrs = append(attrs, "latency_ms", *data.LatencyMS)
+		}
+		if data.Error != "" {
+			attrs = append(attrs, "error", data.Error)
+		}
+	}
+	level := slog.LevelInfo
+	if strings.HasSuffix(ev.Type, "_failed") || strings.HasSuffix(ev.Type, ".failed") {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "event", attrs...)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// requestIDFromPath picks the request id out of /v1/requests/{id}/...,
+// /v1/outbox/{id}/... and /r/{id}/... paths, or the request_id query
+// parameter of /v1/ask. New asks are matched by their X-Ask4Me-Request-Id
+// response header instead.
+func requestIDFromPath(r *http.Request) string {
+	for _, prefix := range []string{"/r/", "/v1/requests/", "/v1/outbox/"} {
+		if rest, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+			id, _, _ := strings.Cut(rest, "/")
+			return id
+		}
+	}
+	return r.URL.Query().Get("request_id")
+}
+
+// accessLog logs every HTTP request once it is done, at debug level for
+// static files and health probes.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", time.Since(start).Milliseconds(),
+		}
+		id := requestIDFromPath(r)
+		if id == "" {
+			id = rec.Header().Get("X-Ask4Me-Request-Id")
+		}
+		if id != "" {
+			attrs = append([]any{"request_id", id}, attrs...)
+		}
+		level := slog.LevelInfo
+		if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "http", attrs...)
+	})
+}
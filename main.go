@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
@@ -16,16 +18,21 @@ import (
 	"html/template"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	serverchan_sdk "github.com/easychen/serverchan-sdk-golang"
@@ -38,15 +45,134 @@ var uiDistEmbedFS embed.FS
 
 type Config struct {
 	BaseURL                     string   `yaml:"base_url"`
+	PublicBaseURL               string   `yaml:"public_base_url"`
+	PathPrefix                  string   `yaml:"path_prefix"`
 	APIKey                      string   `yaml:"api_key"`
 	ServerChanSendKey           string   `yaml:"serverchan_sendkey"`
 	AppriseURLs                 []string `yaml:"apprise_urls"`
 	AppriseBin                  string   `yaml:"apprise_bin"`
 	SQLitePath                  string   `yaml:"sqlite_path"`
+	SQLiteReadConns             int      `yaml:"sqlite_read_conns"`
+	SQLiteBusyTimeoutMS         int      `yaml:"sqlite_busy_timeout_ms"`
+	DatabaseDriver              string   `yaml:"database_driver"`
+	DatabaseURL                 string   `yaml:"database_url"`
+	HubDriver                   string   `yaml:"hub_driver"`
+	HubURL                      string   `yaml:"hub_url"`
+	HubChannel                  string   `yaml:"hub_channel"`
+	HubPollIntervalSeconds      int      `yaml:"hub_poll_interval_seconds"`
 	DefaultExpiresInSeconds     int      `yaml:"default_expires_in_seconds"`
 	SSEHeartbeatIntervalSeconds int      `yaml:"sse_heartbeat_interval_seconds"`
+	SSEBufferSize               int      `yaml:"sse_buffer_size"`
+	AnswerGraceSeconds          int      `yaml:"answer_grace_seconds"`
+	AnswerEditSeconds           int      `yaml:"answer_edit_seconds"`
+	NotifyWorkers               int      `yaml:"notify_workers"`
+	NotifyTimeoutSeconds        int      `yaml:"notify_timeout_seconds"`
+	NotifyResult                bool     `yaml:"notify_result"`
+	AskDedupWindowSeconds       int      `yaml:"ask_dedup_window_seconds"`
 	ListenAddr                  string   `yaml:"listen_addr"`
+	ListenSocketMode            string   `yaml:"listen_socket_mode"`
+	LogLevel                    string   `yaml:"log_level"`
+	LogFormat                   string   `yaml:"log_format"`
+	LogFile                     string   `yaml:"log_file"`
+	LogMaxSizeMB                int      `yaml:"log_max_size_mb"`
+	LogMaxBackups               int      `yaml:"log_max_backups"`
+	TrustedProxies              []string `yaml:"trusted_proxies"`
+	APIAllowIPs                 []string `yaml:"api_allow_ips"`
+	APIDenyIPs                  []string `yaml:"api_deny_ips"`
+	PageAllowIPs                []string `yaml:"page_allow_ips"`
+	PageDenyIPs                 []string `yaml:"page_deny_ips"`
+	CORSAllowedOrigins          []string `yaml:"cors_allowed_origins"`
+	CORSAllowedHeaders          []string `yaml:"cors_allowed_headers"`
+	CORSAllowCredentials        bool     `yaml:"cors_allow_credentials"`
+	TLSMode                     string   `yaml:"tls_mode"`
+	TLSCertFile                 string   `yaml:"tls_cert_file"`
+	TLSKeyFile                  string   `yaml:"tls_key_file"`
+	TLSHTTPAddr                 string   `yaml:"tls_http_addr"`
+	ACMEDomains                 []string `yaml:"acme_domains"`
+	ACMECacheDir                string   `yaml:"acme_cache_dir"`
+	ACMEEmail                   string   `yaml:"acme_email"`
+	ACMEDirectoryURL            string   `yaml:"acme_directory_url"`
 	TerminalCacheSeconds        int      `yaml:"terminal_cache_seconds"`
+	ShutdownTimeoutSeconds      int      `yaml:"shutdown_timeout_seconds"`
+	RetentionDays               int      `yaml:"retention_days"`
+	RetentionArchivePath        string   `yaml:"retention_archive_path"`
+	MaxEvents                   int      `yaml:"max_events"`
+	MaxRequests                 int      `yaml:"max_requests"`
+	RedactAnswersAfterDays      int      `yaml:"redact_answers_after_days"`
+	PayloadCompressBytes        int      `yaml:"payload_compress_bytes"`
+	DedupBodies                 bool     `yaml:"dedup_bodies"`
+	NotifyMaxAttempts           int      `yaml:"notify_max_attempts"`
+	RateLimitAskPerMinute       int      `yaml:"rate_limit_ask_per_minute"`
+	RateLimitIPPerMinute        int      `yaml:"rate_limit_ip_per_minute"`
+	ChallengePIN                string   `yaml:"challenge_pin"`
+	ChallengeTOTPSecret         string   `yaml:"challenge_totp_secret"`
+	WebhookSecret               string   `yaml:"webhook_secret"`
+	AnswerHook                  string   `yaml:"answer_hook"`
+	TranscribeURL               string   `yaml:"transcribe_url"`
+	PolicyFile                  string   `yaml:"policy_file"`
+	ShortLinks                  bool     `yaml:"short_links"`
+	ShortLinkTTLSeconds         int      `yaml:"short_link_ttl_seconds"`
+	StatsReportCron             string   `yaml:"stats_report_cron"`
+	StatsReportTimezone         string   `yaml:"stats_report_timezone"`
+	StatsReportDays             int      `yaml:"stats_report_days"`
+	PageTemplateDir             string   `yaml:"page_template_dir"`
+	PageLogoURL                 string   `yaml:"page_logo_url"`
+	PageThemeColor              string   `yaml:"page_theme_color"`
+	PageFooter                  string   `yaml:"page_footer"`
+	WebPushSubject              string   `yaml:"web_push_subject"`
+	WebPushVAPIDPrivateKey      string   `yaml:"web_push_vapid_private_key"`
+	AttachmentsDriver           string   `yaml:"attachments_driver"`
+	AttachmentsDir              string   `yaml:"attachments_dir"`
+	AttachmentsMaxBytes         int64    `yaml:"attachments_max_bytes"`
+	S3Endpoint                  string   `yaml:"s3_endpoint"`
+	S3Region                    string   `yaml:"s3_region"`
+	S3Bucket                    string   `yaml:"s3_bucket"`
+	S3AccessKeyID               string   `yaml:"s3_access_key_id"`
+	S3SecretAccessKey           string   `yaml:"s3_secret_access_key"`
+	S3PathStyle                 bool     `yaml:"s3_path_style"`
+	S3PresignSeconds            int      `yaml:"s3_presign_seconds"`
+	SlackSigningSecret          string   `yaml:"slack_signing_secret"`
+	SlackBotToken               string   `yaml:"slack_bot_token"`
+	SlackAllowedUsers           []string `yaml:"slack_allowed_users"`
+	TelegramBotToken            string   `yaml:"telegram_bot_token"`
+	TelegramAllowedChats        []string `yaml:"telegram_allowed_chats"`
+	EmailReplyAddress           string   `yaml:"email_reply_address"`
+	EmailInboundToken           string   `yaml:"email_inbound_token"`
+	EmailAllowedSenders         []string `yaml:"email_allowed_senders"`
+
+	Priorities map[string]PriorityConfig `yaml:"priorities"`
+
+	// NotifyChannelLimits caps concurrent sends per channel; see
+	// notifypool.go.
+	NotifyChannelLimits map[string]int `yaml:"notify_channel_limits"`
+
+	// Schedules, Contacts, APIKeys, ChatBridges, Tenants, Rotations and
+	// BusinessHours are only read from YAML configs.
+	Schedules     []ScheduleConfig     `yaml:"schedules"`
+	Contacts      []ContactConfig      `yaml:"contacts"`
+	APIKeys       []APIKeyConfig       `yaml:"api_keys"`
+	ChatBridges   []ChatBridgeConfig   `yaml:"chat_bridges"`
+	Tenants       []TenantConfig       `yaml:"tenants"`
+	Rotations     []RotationConfig     `yaml:"rotations"`
+	BusinessHours *BusinessHoursConfig `yaml:"business_hours"`
+
+	// Parsed by normalize from TrustedProxies and the *IPs lists.
+	trustedNets   []*net.IPNet
+	apiAllowNets  []*net.IPNet
+	apiDenyNets   []*net.IPNet
+	pageAllowNets []*net.IPNet
+	pageDenyNets  []*net.IPNet
+	// Parsed by normalize from ListenSocketMode.
+	socketMode os.FileMode
+	// Loaded by normalize from PageTemplateDir; nil means the built-in page.
+	pageTpl      *template.Template
+	challengeTpl *template.Template
+	bundleTpl    *template.Template
+	customCSS    bool
+	// Parsed by normalize from WebPushVAPIDPrivateKey.
+	vapidKey *ecdsa.PrivateKey
+	// Loaded by normalize from PolicyFile.
+	policies []policyRule
 }
 
 func (c *Config) normalize() error {
@@ -57,27 +183,169 @@ func (c *Config) normalize() error {
 	if err != nil {
 		return fmt.Errorf("invalid base_url: %w", err)
 	}
+	if err := validatePublicBaseURL(c); err != nil {
+		return err
+	}
+	if err := normalizePathPrefix(c); err != nil {
+		return err
+	}
 	if strings.TrimSpace(c.APIKey) == "" {
 		return errors.New("api_key is required")
 	}
 	if strings.TrimSpace(c.SQLitePath) == "" {
 		c.SQLitePath = "./ask4me.db"
 	}
+	if c.SQLiteReadConns <= 0 {
+		c.SQLiteReadConns = defaultSQLiteReadConns
+	}
+	if c.SQLiteBusyTimeoutMS <= 0 {
+		c.SQLiteBusyTimeoutMS = defaultSQLiteBusyTimeoutMS
+	}
+	c.DatabaseDriver = strings.ToLower(strings.TrimSpace(c.DatabaseDriver))
+	if c.DatabaseDriver == "" {
+		c.DatabaseDriver = databaseDriverSQLite
+	}
+	if _, err := dialectFor(c.DatabaseDriver); err != nil {
+		return err
+	}
+	if (c.DatabaseDriver == databaseDriverPostgres || c.DatabaseDriver == databaseDriverMySQL) && strings.TrimSpace(c.DatabaseURL) == "" {
+		return fmt.Errorf("database_url is required for database_driver %s", c.DatabaseDriver)
+	}
+	if c.DatabaseDriver == databaseDriverMemory && c.MaxRequests == 0 {
+		c.MaxRequests = defaultMemoryMaxRequests
+	}
+	c.HubDriver = strings.ToLower(strings.TrimSpace(c.HubDriver))
+	switch c.HubDriver {
+	case "":
+		c.HubDriver = hubDriverMemory
+	case hubDriverMemory:
+	case hubDriverRedis, hubDriverNATS:
+		if strings.TrimSpace(c.HubURL) == "" {
+			return fmt.Errorf("hub_url is required for hub_driver %s", c.HubDriver)
+		}
+	default:
+		return fmt.Errorf("unknown hub_driver %q (want memory, redis or nats)", c.HubDriver)
+	}
+	if strings.TrimSpace(c.HubChannel) == "" {
+		c.HubChannel = defaultHubChannel
+	}
+	if c.HubPollIntervalSeconds == 0 && c.HubDriver == hubDriverMemory {
+		c.HubPollIntervalSeconds = defaultHubPollIntervalSeconds
+	}
+	c.AttachmentsDriver = strings.ToLower(strings.TrimSpace(c.AttachmentsDriver))
+	switch c.AttachmentsDriver {
+	case "", attachmentsDriverLocal, attachmentsDriverS3:
+	default:
+		return fmt.Errorf("unknown attachments_driver %q (want local or s3)", c.AttachmentsDriver)
+	}
+	if strings.TrimSpace(c.AttachmentsDir) == "" {
+		c.AttachmentsDir = "./attachments"
+	}
+	if c.AttachmentsMaxBytes <= 0 {
+		c.AttachmentsMaxBytes = defaultAttachmentsMaxBytes
+	}
+	if strings.TrimSpace(c.S3Region) == "" {
+		c.S3Region = "us-east-1"
+	}
+	if c.S3PresignSeconds <= 0 {
+		c.S3PresignSeconds = 300
+	}
 	if strings.TrimSpace(c.AppriseBin) == "" {
 		c.AppriseBin = "apprise"
 	}
+	if c.NotifyMaxAttempts <= 0 {
+		c.NotifyMaxAttempts = defaultNotifyMaxAttempts
+	}
+	c.ChallengePIN = strings.TrimSpace(c.ChallengePIN)
+	if c.ChallengeTOTPSecret = strings.TrimSpace(c.ChallengeTOTPSecret); c.ChallengeTOTPSecret != "" {
+		if _, err := decodeTOTPSecret(c.ChallengeTOTPSecret); err != nil {
+			return fmt.Errorf("invalid challenge_totp_secret: %w", err)
+		}
+	}
 	if c.DefaultExpiresInSeconds <= 0 {
 		c.DefaultExpiresInSeconds = 3600
 	}
 	if c.SSEHeartbeatIntervalSeconds <= 0 {
 		c.SSEHeartbeatIntervalSeconds = 15
 	}
-	if strings.TrimSpace(c.ListenAddr) == "" {
-		c.ListenAddr = ":8080"
+	if c.SSEBufferSize <= 0 {
+		c.SSEBufferSize = defaultSSEBufferSize
+	}
+	c.SSEBufferSize = min(c.SSEBufferSize, maxSSEBufferSize)
+	c.AnswerGraceSeconds = min(max(c.AnswerGraceSeconds, 0), maxAnswerGraceSeconds)
+	c.AnswerEditSeconds = min(max(c.AnswerEditSeconds, 0), maxAnswerEditSeconds)
+	if c.NotifyWorkers <= 0 {
+		c.NotifyWorkers = defaultNotifyWorkers
+	}
+	if c.NotifyTimeoutSeconds <= 0 {
+		c.NotifyTimeoutSeconds = defaultNotifyTimeoutSeconds
+	}
+	c.NotifyTimeoutSeconds = min(c.NotifyTimeoutSeconds, maxNotifyTimeoutSeconds)
+	if c.NotifyChannelLimits == nil {
+		c.NotifyChannelLimits = defaultNotifyChannelLimits
+	}
+	c.AskDedupWindowSeconds = min(max(c.AskDedupWindowSeconds, 0), maxDedupWindowSeconds)
+	if err := c.normalizeListen(); err != nil {
+		return err
+	}
+	if err := c.normalizeLogging(); err != nil {
+		return err
+	}
+	if err := c.normalizeTLS(); err != nil {
+		return err
+	}
+	if err := c.parseIPRules(); err != nil {
+		return err
+	}
+	if err := c.normalizeCORS(); err != nil {
+		return err
+	}
+	if err := c.normalizeStatsReport(); err != nil {
+		return err
+	}
+	if err := c.normalizeBranding(); err != nil {
+		return err
+	}
+	if err := c.normalizePolicies(); err != nil {
+		return err
+	}
+	if err := c.normalizeWebPush(); err != nil {
+		return err
+	}
+	c.normalizeSlack()
+	c.normalizeTelegram()
+	if err := c.normalizeEmail(); err != nil {
+		return err
 	}
 	if c.TerminalCacheSeconds <= 0 {
 		c.TerminalCacheSeconds = 60
 	}
+	if c.ShutdownTimeoutSeconds <= 0 {
+		c.ShutdownTimeoutSeconds = 15
+	}
+	if err := validateContactConfigs(c); err != nil {
+		return err
+	}
+	if err := validateRotationConfigs(c); err != nil {
+		return err
+	}
+	if err := validateBusinessHours(c); err != nil {
+		return err
+	}
+	if err := validateTenantConfigs(c); err != nil {
+		return err
+	}
+	if err := validateAPIKeyConfigs(c); err != nil {
+		return err
+	}
+	if err := validateChatBridgeConfigs(c); err != nil {
+		return err
+	}
+	for level := range c.Priorities {
+		if !isPriorityLevel(level) {
+			return fmt.Errorf("priorities: unknown level %q", level)
+		}
+	}
 	return nil
 }
 
@@ -89,11 +357,33 @@ type Event struct {
 	Data      json.RawMessage `json:"data"`
 }
 
+// eventSchemaVersion is the version of the event data payloads described in
+// events.schema.json (and sdk-go/events.go). It goes up when a payload
+// changes incompatibly; new optional fields do not change it.
+const eventSchemaVersion = 1
+
+// MarshalJSON adds event_schema_version to every event sent out.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+	return json.Marshal(struct {
+		plain
+		SchemaVersion int `json:"event_schema_version"`
+	}{plain(e), eventSchemaVersion})
+}
+
 type runtimeHub struct {
 	mu          sync.Mutex
-	subscribers map[string]map[chan Event]struct{}
+	subscribers map[string]map[*subscriber]struct{}
 	terminal    map[string]terminalCacheEntry
 	ttl         time.Duration
+	// firehose receives the events of all requests; see firehose.go.
+	firehose map[*subscriber]struct{}
+	// buffer is the default size of a subscriber's queue; see sse.go.
+	buffer int
+
+	// origin identifies this instance to a broker; see hub.go.
+	origin string
+	broker hubBroker
 }
 
 type terminalCacheEntry struct {
@@ -101,11 +391,13 @@ type terminalCacheEntry struct {
 	expires time.Time
 }
 
-func newRuntimeHub(ttl time.Duration) *runtimeHub {
+func newRuntimeHub(ttl time.Duration, buffer int) *runtimeHub {
 	h := &runtimeHub{
-		subscribers: map[string]map[chan Event]struct{}{},
+		subscribers: map[string]map[*subscriber]struct{}{},
 		terminal:    map[string]terminalCacheEntry{},
 		ttl:         ttl,
+		buffer:      buffer,
+		origin:      genID("hub_"),
 	}
 	go h.evictLoop()
 	return h
@@ -126,44 +418,76 @@ func (h *runtimeHub) evictLoop() {
 	}
 }
 
-func (h *runtimeHub) subscribe(requestID string) (chan Event, func()) {
-	ch := make(chan Event, 16)
+func (h *runtimeHub) subscribe(requestID string) (<-chan Event, func()) {
+	return h.subscribeSize(requestID, 0)
+}
+
+// subscribeSize is subscribe with a queue of size events, or the hub's
+// default when size is 0.
+func (h *runtimeHub) subscribeSize(requestID string, size int) (<-chan Event, func()) {
+	if size <= 0 {
+		size = h.buffer
+	}
+	sub := newSubscriber(size, requestID)
 	h.mu.Lock()
 	m := h.subscribers[requestID]
 	if m == nil {
-		m = map[chan Event]struct{}{}
+		m = map[*subscriber]struct{}{}
 		h.subscribers[requestID] = m
 	}
-	m[ch] = struct{}{}
+	m[sub] = struct{}{}
 	h.mu.Unlock()
 
 	unsub := func() {
 		h.mu.Lock()
 		if m := h.subscribers[requestID]; m != nil {
-			delete(m, ch)
+			delete(m, sub)
 			if len(m) == 0 {
 				delete(h.subscribers, requestID)
 			}
 		}
 		h.mu.Unlock()
-		close(ch)
+		sub.stop()
 	}
-	return ch, unsub
+	return sub.out, unsub
 }
 
 func (h *runtimeHub) publish(ev Event) {
+	h.publishTo(ev.RequestID, ev)
+}
+
+// publishTo delivers ev to subscribers of key, which need not be the event's
+// own request id (e.g. session channels).
+func (h *runtimeHub) publishTo(key string, ev Event) {
+	h.publishLocal(key, ev)
+	h.relay(hubMessage{Key: key, Event: ev})
+}
+
+func (h *runtimeHub) publishLocal(key string, ev Event) {
 	h.mu.Lock()
-	m := h.subscribers[ev.RequestID]
-	for ch := range m {
-		select {
-		case ch <- ev:
-		default:
+	for sub := range h.subscribers[key] {
+		sub.push(ev)
+	}
+	if key == ev.RequestID {
+		for sub := range h.firehose {
+			sub.push(ev)
 		}
 	}
 	h.mu.Unlock()
 }
 
+func (h *runtimeHub) hasSubscribers(requestID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers[requestID]) > 0
+}
+
 func (h *runtimeHub) setTerminal(ev Event) {
+	h.setTerminalLocal(ev)
+	h.relay(hubMessage{Key: ev.RequestID, Terminal: true, Event: ev})
+}
+
+func (h *runtimeHub) setTerminalLocal(ev Event) {
 	h.mu.Lock()
 	h.terminal[ev.RequestID] = terminalCacheEntry{
 		event:   ev,
@@ -173,6 +497,13 @@ func (h *runtimeHub) setTerminal(ev Event) {
 	h.mu.Unlock()
 }
 
+// forgetTerminal drops the cached final event of requestID on this instance.
+func (h *runtimeHub) forgetTerminal(requestID string) {
+	h.mu.Lock()
+	delete(h.terminal, requestID)
+	h.mu.Unlock()
+}
+
 func (h *runtimeHub) getTerminal(requestID string) (Event, bool) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -188,68 +519,31 @@ func (h *runtimeHub) getTerminal(requestID string) (Event, bool) {
 }
 
 type store struct {
-	db *sql.DB
-}
-
-func newStore(db *sql.DB) (*store, error) {
-	s := &store{db: db}
-	stmts := []string{
-		`PRAGMA journal_mode=WAL;`,
-		`CREATE TABLE IF NOT EXISTS requests (
-			request_id TEXT PRIMARY KEY,
-			title TEXT NOT NULL,
-			body TEXT NOT NULL,
-			mcd TEXT NOT NULL,
-			status TEXT NOT NULL,
-			expires_at INTEGER NOT NULL,
-			created_at INTEGER NOT NULL,
-			updated_at INTEGER NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS tokens (
-			request_id TEXT NOT NULL,
-			token_hash TEXT NOT NULL,
-			expires_at INTEGER NOT NULL,
-			created_at INTEGER NOT NULL,
-			used_at INTEGER,
-			PRIMARY KEY(request_id, token_hash)
-		);`,
-		`CREATE TABLE IF NOT EXISTS answers (
-			request_id TEXT PRIMARY KEY,
-			action TEXT,
-			text TEXT,
-			payload_json TEXT,
-			created_at INTEGER NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS events (
-			seq INTEGER PRIMARY KEY AUTOINCREMENT,
-			request_id TEXT NOT NULL,
-			event_id TEXT NOT NULL,
-			type TEXT NOT NULL,
-			payload_json TEXT NOT NULL,
-			created_at INTEGER NOT NULL
-		);`,
-		`CREATE INDEX IF NOT EXISTS idx_events_request_seq ON events(request_id, seq);`,
-	}
-	for _, st := range stmts {
-		if _, err := db.Exec(st); err != nil {
-			return nil, err
-		}
-	}
-	if err := ensureTableColumns(db, "requests", map[string]string{
+	db *dbConn
+	// compressBytes and dedupBodies control how payloads are stored; see
+	// payload.go.
+	compressBytes int
+	dedupBodies   bool
+}
+
+func newStore(db *dbConn) *store {
+	return &store{db: db}
+}
+
+// legacySQLiteColumns are the columns that the pre-migration bootstrap added
+// with ALTER TABLE; adoptLegacySchema fills them in on old databases so that
+// they match 0001_init. Newer columns come from the numbered migrations.
+var legacySQLiteColumns = map[string]map[string]string{
+	"requests": {
 		"jsonforms_schema_json":   "TEXT",
 		"jsonforms_uischema_json": "TEXT",
 		"jsonforms_data_json":     "TEXT",
 		"jsonforms_submit_label":  "TEXT",
 		"jsonforms_renderer":      "TEXT",
-	}); err != nil {
-		return nil, err
-	}
-	if err := ensureTableColumns(db, "answers", map[string]string{
+	},
+	"answers": {
 		"payload_json": "TEXT",
-	}); err != nil {
-		return nil, err
-	}
-	return s, nil
+	},
 }
 
 func ensureTableColumns(db *sql.DB, table string, columns map[string]string) error {
@@ -287,24 +581,6 @@ func ensureTableColumns(db *sql.DB, table string, columns map[string]string) err
 	return nil
 }
 
-func (s *store) createRequest(
-	ctx context.Context,
-	reqID, title, body, mcd, status string,
-	expiresAt time.Time,
-	jsonformsSchemaJSON, jsonformsUISchemaJSON, jsonformsDataJSON, jsonformsSubmitLabel, jsonformsRenderer sql.NullString,
-) error {
-	now := time.Now().Unix()
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO requests(
-			request_id,title,body,mcd,status,expires_at,created_at,updated_at,
-			jsonforms_schema_json,jsonforms_uischema_json,jsonforms_data_json,jsonforms_submit_label,jsonforms_renderer
-		) VALUES(?,?,?,?,?,?,?, ?,?,?,?,?,?)`,
-		reqID, title, body, mcd, status, expiresAt.Unix(), now, now,
-		jsonformsSchemaJSON, jsonformsUISchemaJSON, jsonformsDataJSON, jsonformsSubmitLabel, jsonformsRenderer,
-	)
-	return err
-}
-
 func (s *store) updateRequestStatus(ctx context.Context, reqID, status string) error {
 	_, err := s.db.ExecContext(ctx, `UPDATE requests SET status=?, updated_at=? WHERE request_id=?`, status, time.Now().Unix(), reqID)
 	return err
@@ -317,10 +593,10 @@ func (s *store) getRequestStatus(ctx context.Context, reqID string) (string, int
 	return status, expiresAt, err
 }
 
-func (s *store) insertToken(ctx context.Context, reqID, tokenHash string, expiresAt time.Time) error {
+func (s *store) insertToken(ctx context.Context, reqID, tokenHash, responder string, expiresAt time.Time) error {
 	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO tokens(request_id,token_hash,expires_at,created_at) VALUES(?,?,?,?)`,
-		reqID, tokenHash, expiresAt.Unix(), time.Now().Unix(),
+		`INSERT INTO tokens(request_id,token_hash,responder,expires_at,created_at) VALUES(?,?,?,?,?)`,
+		reqID, tokenHash, nullIfEmpty(responder), expiresAt.Unix(), time.Now().Unix(),
 	)
 	return err
 }
@@ -330,27 +606,29 @@ func (s *store) markTokenUsed(ctx context.Context, reqID, tokenHash string) erro
 	return err
 }
 
-func (s *store) verifyToken(ctx context.Context, reqID, tokenHash string) (bool, error) {
+// verifyToken reports whether the token belongs to the request and is not
+// revoked, and whether it has expired.
+func (s *store) verifyToken(ctx context.Context, reqID, tokenHash string) (ok, expired bool, err error) {
 	var expiresAt int64
-	err := s.db.QueryRowContext(ctx, `SELECT expires_at FROM tokens WHERE request_id=? AND token_hash=?`, reqID, tokenHash).Scan(&expiresAt)
+	err = s.db.QueryRowContext(ctx, `SELECT expires_at FROM tokens WHERE request_id=? AND token_hash=? AND revoked_at IS NULL`, reqID, tokenHash).Scan(&expiresAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
+			return false, false, nil
 		}
-		return false, err
+		return false, false, err
 	}
-	if time.Now().Unix() > expiresAt {
-		return false, nil
-	}
-	return true, nil
+	return true, time.Now().Unix() > expiresAt, nil
 }
 
-func (s *store) insertAnswer(ctx context.Context, reqID, action, text string, payloadJSON sql.NullString) error {
+func (s *store) insertAnswer(ctx context.Context, reqID, responder, action, text string, payloadJSON sql.NullString) error {
 	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO answers(request_id,action,text,payload_json,created_at) VALUES(?,?,?,?,?)`,
-		reqID, nullIfEmpty(action), nullIfEmpty(text), payloadJSON, time.Now().Unix(),
+		`INSERT INTO answers(request_id,responder,action,text,payload_json,created_at) VALUES(?,?,?,?,?,?)`,
+		reqID, nullIfEmpty(responder), nullIfEmpty(action), nullIfEmpty(text), payloadJSON, time.Now().Unix(),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return s.indexAnswer(ctx, reqID, action, text)
 }
 
 func nullIfEmpty(v string) any {
@@ -373,31 +651,64 @@ func (s *store) hasAnswer(ctx context.Context, reqID string) (bool, error) {
 }
 
 func (s *store) insertEvent(ctx context.Context, reqID, eventID, typ string, payload []byte) error {
+	data, encoding := encodeStoredText(string(payload), s.compressBytes)
+	if s.db.events != nil {
+		return s.db.events.insert(ctx, eventRow{
+			requestID: reqID,
+			eventID:   eventID,
+			typ:       typ,
+			payload:   data,
+			encoding:  encoding,
+			createdAt: time.Now().Unix(),
+		})
+	}
 	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO events(request_id,event_id,type,payload_json,created_at) VALUES(?,?,?,?,?)`,
-		reqID, eventID, typ, string(payload), time.Now().Unix(),
+		`INSERT INTO events(request_id,event_id,type,payload_json,payload_encoding,created_at) VALUES(?,?,?,?,?,?)`,
+		reqID, eventID, typ, data, encoding, time.Now().Unix(),
 	)
 	return err
 }
 
-func (s *store) listEvents(ctx context.Context, reqID string, afterEventID string) ([]Event, error) {
-	var rows *sql.Rows
-	var err error
-	if strings.TrimSpace(afterEventID) == "" {
-		rows, err = s.db.QueryContext(ctx,
-			`SELECT event_id, type, payload_json FROM events WHERE request_id=? ORDER BY seq ASC`,
-			reqID,
-		)
-	} else {
-		rows, err = s.db.QueryContext(ctx,
-			`SELECT e.event_id, e.type, e.payload_json
-			 FROM events e
-			 JOIN events a ON a.request_id=e.request_id AND a.event_id=?
-			 WHERE e.request_id=? AND e.seq > a.seq
-			 ORDER BY e.seq ASC`,
-			afterEventID, reqID,
-		)
+// eventFilter selects stored events of a request: those after the event
+// with ID After (all when empty), of the given Types (any when empty), at
+// most Limit of them (no limit when 0).
+type eventFilter struct {
+	After string
+	Types []string
+	Limit int
+}
+
+var errUnknownEventCursor = errors.New("unknown event cursor")
+
+// listEvents returns the events selected by f in order. An After that names
+// no event of the request (a bad cursor, or an event trimmed by retention)
+// fails with errUnknownEventCursor.
+func (s *store) listEvents(ctx context.Context, reqID string, f eventFilter) ([]Event, error) {
+	q := `SELECT event_id, type, payload_json, payload_encoding, created_at FROM events WHERE request_id=?`
+	args := []any{reqID}
+	if after := strings.TrimSpace(f.After); after != "" {
+		var seq int64
+		err := s.db.QueryRowContext(ctx, `SELECT seq FROM events WHERE request_id=? AND event_id=?`, reqID, after).Scan(&seq)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, errUnknownEventCursor
+			}
+			return nil, err
+		}
+		q += ` AND seq>?`
+		args = append(args, seq)
 	}
+	if len(f.Types) > 0 {
+		q += ` AND type IN (` + strings.TrimSuffix(strings.Repeat("?,", len(f.Types)), ",") + `)`
+		for _, t := range f.Types {
+			args = append(args, t)
+		}
+	}
+	q += ` ORDER BY seq ASC`
+	if f.Limit > 0 {
+		q += fmt.Sprintf(` LIMIT %d`, f.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -405,14 +716,17 @@ func (s *store) listEvents(ctx context.Context, reqID string, afterEventID strin
 	var out []Event
 	for rows.Next() {
 		var id, typ, payload string
-		if err := rows.Scan(&id, &typ, &payload); err != nil {
+		var encoding sql.NullString
+		var createdAt int64
+		if err := rows.Scan(&id, &typ, &payload, &encoding, &createdAt); err != nil {
 			return nil, err
 		}
 		out = append(out, Event{
 			ID:        id,
 			Type:      typ,
+			Time:      time.Unix(createdAt, 0).UTC().Format(time.RFC3339),
 			RequestID: reqID,
-			Data:      json.RawMessage(payload),
+			Data:      json.RawMessage(decodeEventPayload(payload, encoding)),
 		})
 	}
 	if err := rows.Err(); err != nil {
@@ -433,11 +747,12 @@ func (s *store) getLatestEventByTypes(ctx context.Context, reqID string, types [
 		args = append(args, t)
 	}
 	q := fmt.Sprintf(
-		`SELECT event_id, type, payload_json FROM events WHERE request_id=? AND type IN (%s) ORDER BY seq DESC LIMIT 1`,
+		`SELECT event_id, type, payload_json, payload_encoding FROM events WHERE request_id=? AND type IN (%s) ORDER BY seq DESC LIMIT 1`,
 		strings.Join(placeholders, ","),
 	)
 	var id, typ, payload string
-	err := s.db.QueryRowContext(ctx, q, args...).Scan(&id, &typ, &payload)
+	var encoding sql.NullString
+	err := s.db.QueryRowContext(ctx, q, args...).Scan(&id, &typ, &payload, &encoding)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Event{}, false, nil
@@ -448,7 +763,7 @@ func (s *store) getLatestEventByTypes(ctx context.Context, reqID string, types [
 		ID:        id,
 		Type:      typ,
 		RequestID: reqID,
-		Data:      json.RawMessage(payload),
+		Data:      json.RawMessage(decodeEventPayload(payload, encoding)),
 	}, true, nil
 }
 
@@ -463,8 +778,53 @@ type askRequest struct {
 		SubmitLabel string          `json:"submit_label"`
 		Renderer    string          `json:"renderer"`
 	} `json:"jsonforms"`
-	ExpiresInSeconds      int  `json:"expires_in_seconds"`
-	ServerChanActionLinks bool `json:"serverchan_action_links"`
+	ExpiresInSeconds      int               `json:"expires_in_seconds"`
+	ServerChanActionLinks bool              `json:"serverchan_action_links"`
+	Responders            *respondersSpec   `json:"responders"`
+	Steps                 []askStep         `json:"steps"`
+	SessionID             string            `json:"session_id"`
+	SendAt                string            `json:"send_at"`
+	Priority              string            `json:"priority"`
+	DefaultAction         string            `json:"default_action"`
+	ParentRequestID       string            `json:"parent_request_id"`
+	Template              string            `json:"template,omitempty"`
+	Vars                  map[string]string `json:"vars,omitempty"`
+	Attachments           []string          `json:"attachments,omitempty"`
+	AllowUploads          bool              `json:"allow_uploads,omitempty"`
+	VoiceInput            bool              `json:"voice_input,omitempty"`
+	AskName               bool              `json:"ask_name,omitempty"`
+	OneTimeLink           string            `json:"one_time_link,omitempty"`
+	Challenge             string            `json:"challenge,omitempty"`
+	CallbackURL           string            `json:"callback_url,omitempty"`
+	CallbackSecret        string            `json:"callback_secret,omitempty"`
+	QR                    bool              `json:"qr,omitempty"`
+	TerminalEvents        []string          `json:"terminal_events,omitempty"`
+	HeartbeatSeconds      int               `json:"heartbeat_seconds,omitempty"`
+	BufferSize            int               `json:"buffer_size,omitempty"`
+	DedupWindowSeconds    int               `json:"dedup_window_seconds,omitempty"`
+	NotifyTimeoutSeconds  int               `json:"notify_timeout_seconds,omitempty"`
+	NotifyResult          bool              `json:"notify_result,omitempty"`
+	Delivery              string            `json:"delivery,omitempty"`
+	ExtendSeconds         int               `json:"extend_seconds,omitempty"`
+	MaxExtensions         int               `json:"max_extensions,omitempty"`
+	SLASeconds            int               `json:"sla_seconds,omitempty"`
+	EscalateTo            string            `json:"escalate_to,omitempty"`
+	Tenant                string            `json:"tenant,omitempty"`
+	To                    addressees        `json:"to,omitempty"`
+	Tags                  []string          `json:"tags,omitempty"`
+	// ExpiresInBusinessSeconds counts only business_hours, see
+	// businesshours.go.
+	ExpiresInBusinessSeconds int `json:"expires_in_business_seconds,omitempty"`
+
+	sendAt     time.Time
+	scheduleID string
+	// bundleID is set for the asks of a bundle, see bundle.go.
+	bundleID string
+	// rotation is the rotation that `to` named, see rotations.go; To then
+	// holds the contact who was on call.
+	rotation string
+	// routed is the working hours decision for `to`, see contacts.go.
+	routed map[string]any
 }
 
 type buttonSpec struct {
@@ -481,21 +841,42 @@ type inputSpec struct {
 type mcdSpec struct {
 	Buttons []buttonSpec
 	Input   *inputSpec
+	// Suggestions are canned replies the page offers for Input.
+	Suggestions []string
 }
 
+// At most maxSuggestions replies of up to maxSuggestionBytes each are kept
+// from a :::suggestions block.
+const (
+	maxSuggestions     = 10
+	maxSuggestionBytes = 200
+)
+
 var (
-	reButtonsStart = regexp.MustCompile(`^\s*:::\s*buttons\s*$`)
-	reInputStart   = regexp.MustCompile(`^\s*:::\s*input\b(.*)$`)
-	reBlockEnd     = regexp.MustCompile(`^\s*:::\s*$`)
-	reButtonLine   = regexp.MustCompile(`^\s*-\s*\[(.*?)\]\((.*?)\)\s*$`)
-	reAttr         = regexp.MustCompile(`(\w+)\s*=\s*"([^"]*)"`)
+	reButtonsStart     = regexp.MustCompile(`^\s*:::\s*buttons\s*$`)
+	reSuggestionsStart = regexp.MustCompile(`^\s*:::\s*suggestions\s*$`)
+	reInputStart       = regexp.MustCompile(`^\s*:::\s*input\b(.*)$`)
+	reBlockEnd         = regexp.MustCompile(`^\s*:::\s*$`)
+	reButtonLine       = regexp.MustCompile(`^\s*-\s*\[(.*?)\]\((.*?)\)\s*$`)
+	reSuggestionLine   = regexp.MustCompile(`^\s*-\s*(.*?)\s*$`)
+	reAttr             = regexp.MustCompile(`(\w+)\s*=\s*"([^"]*)"`)
 )
 
 func parseMCD(mcd string) mcdSpec {
 	lines := strings.Split(mcd, "\n")
 	var spec mcdSpec
-	inButtons := false
+	inButtons, inSuggestions := false, false
 	for _, ln := range lines {
+		if inSuggestions {
+			if reBlockEnd.MatchString(ln) {
+				inSuggestions = false
+				continue
+			}
+			if m := reSuggestionLine.FindStringSubmatch(ln); m != nil && m[1] != "" && len(spec.Suggestions) < maxSuggestions {
+				spec.Suggestions = append(spec.Suggestions, strings.ToValidUTF8(truncate(m[1], maxSuggestionBytes), ""))
+			}
+			continue
+		}
 		if inButtons {
 			if reBlockEnd.MatchString(ln) {
 				inButtons = false
@@ -515,6 +896,10 @@ func parseMCD(mcd string) mcdSpec {
 			inButtons = true
 			continue
 		}
+		if reSuggestionsStart.MatchString(ln) {
+			inSuggestions = true
+			continue
+		}
 
 		if m := reInputStart.FindStringSubmatch(ln); m != nil {
 			attrs := m[1]
@@ -545,67 +930,327 @@ func parseMCD(mcd string) mcdSpec {
 			continue
 		}
 	}
+	// Suggestions only prefill the input, so they need one.
+	if spec.Input == nil {
+		spec.Suggestions = nil
+	}
 	return spec
 }
 
 type htmlData struct {
-	Title     string
-	Body      string
-	Buttons   []buttonSpec
-	Input     *inputSpec
-	Action    string
-	Text      string
-	Done      bool
-	Token     string
-	RequestID string
-	JsonForms bool
-}
-
-var pageTpl = template.Must(template.New("page").Parse(`<!doctype html>
-<html>
+	Title       string
+	Body        string
+	Buttons     []buttonSpec
+	Input       *inputSpec
+	Action      string
+	Text        string
+	Done        bool
+	Token       string
+	RequestID   string
+	JsonForms   bool
+	DraftSaved  bool
+	Step        int
+	StepCount   int
+	Contacts    []string
+	ForwardedTo string
+	Thread      []threadItem
+	Attachments []attachmentLink
+	Uploads     bool
+	CSRF        string
+	Brand       brandData
+	// Acknowledged is set once the responder pressed "Seen, I'll answer
+	// later", see receipts.go.
+	Acknowledged bool
+	// Recap is set on a finished page, see recap.go.
+	Recap *answerRecap
+	// Progress is the message of the asker's latest custom event, see
+	// progress.go.
+	Progress string
+	// ExpiresAt drives the countdown on an open page; Now is the server
+	// time it counts from.
+	ExpiresAt time.Time
+	Now       time.Time
+	// Grace is answer_grace_seconds, see grace.go.
+	Grace int
+	// Rejected is the message of an answer hook that turned the last
+	// answer down, see answerhook.go.
+	Rejected string
+	// EditUntil is set while the answer can still be changed, see
+	// answeredit.go; AnswerVersion identifies the answer shown.
+	EditUntil     time.Time
+	AnswerVersion string
+	// ExtendSeconds and ExtensionsLeft offer "Need more time", see
+	// extend.go.
+	ExtendSeconds  int
+	ExtensionsLeft int
+	// Suggestions fill the reply chips under the input; see mcdSpec.
+	Suggestions []string
+	// Voice shows the microphone button, Transcribe fills the input from
+	// the recording; see voice.go.
+	Voice      bool
+	Transcribe bool
+	// AskName asks an anonymous link for the responder's name, see
+	// attribution.go.
+	AskName bool
+}
+
+// threadItem is an earlier question of the thread shown above the current one.
+type threadItem struct {
+	Title  string
+	Answer string
+}
+
+var pageTpl = template.Must(template.New("page").Funcs(pageFuncs).Parse(`<!doctype html>
+<html lang="en">
 <head>
   <meta charset="utf-8"/>
-  <meta name="viewport" content="width=device-width,initial-scale=1"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1,viewport-fit=cover"/>
   <title>{{.Title}}</title>
+  <link rel="manifest" href="{{.Brand.Prefix}}/manifest.webmanifest"/>
+  <script src="{{.Brand.Prefix}}/pwa.js" defer></script>
   <style>
-    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 16px;}
-    pre{white-space:pre-wrap;word-break:break-word;background:#f6f8fa;padding:12px;border-radius:8px;}
+    :root{color-scheme:light dark;--fg:#24292f;--muted:#57606a;--bg:#fff;--subtle:#f6f8fa;--border:#d0d7de;--ok-bg:#dafbe1;--ok-border:#2da44e;--err-bg:#ffebe9;--err-border:#d1242f;--pending-bg:#fff8c5;--pending-border:#bf8700;}
+    @media (prefers-color-scheme:dark){:root{--fg:#e6edf3;--muted:#8d96a0;--bg:#0d1117;--subtle:#161b22;--border:#30363d;--ok-bg:#12261e;--ok-border:#2ea043;--err-bg:#25171c;--err-border:#f85149;--pending-bg:#272115;--pending-border:#9e6a03;}}
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 max(16px,env(safe-area-inset-right)) 0 max(16px,env(safe-area-inset-left));color:var(--fg);background:var(--bg);}
+    a{color:#0969da;}
+    @media (prefers-color-scheme:dark){a{color:#4493f8;}}
+    pre{white-space:pre-wrap;word-break:break-word;background:var(--subtle);padding:12px;border-radius:8px;}
     .row{margin-top:16px;}
-    button{padding:10px 14px;border-radius:10px;border:1px solid #d0d7de;background:#fff;cursor:pointer;margin:6px 6px 0 0;}
-    button:hover{background:#f6f8fa;}
-    input[type="text"]{width:100%;padding:10px;border:1px solid #d0d7de;border-radius:10px;}
+    button{min-height:44px;padding:10px 16px;font-size:16px;border-radius:10px;border:1px solid var(--border);background:var(--bg);color:var(--fg);cursor:pointer;margin:6px 6px 0 0;}
+    button:hover{background:var(--subtle);}
+    input[type="text"]{width:100%;padding:10px;font-size:16px;border:1px solid var(--border);border-radius:10px;box-sizing:border-box;background:var(--bg);color:var(--fg);}
+    select{font-size:16px;padding:10px;border:1px solid var(--border);border-radius:10px;background:var(--bg);color:var(--fg);}
     #app label{display:block;margin:12px 0 6px;font-weight:600;}
-    #app input,#app select,#app textarea{width:100%;padding:10px;border:1px solid #d0d7de;border-radius:10px;box-sizing:border-box;}
-    #app input[type="checkbox"],#app input[type="radio"]{width:auto;padding:0;border-radius:0;}
-    .ok{padding:12px;border:1px solid #2da44e;border-radius:10px;background:#dafbe1;}
-    .err{padding:12px;border:1px solid #d1242f;border-radius:10px;background:#ffebe9;color:#24292f;}
+    #app input,#app select,#app textarea{width:100%;padding:10px;font-size:16px;border:1px solid var(--border);border-radius:10px;box-sizing:border-box;background:var(--bg);color:var(--fg);}
+    #app input[type="checkbox"],#app input[type="radio"]{width:auto;min-height:0;padding:0;border-radius:0;}
+    .actions{position:sticky;bottom:0;display:flex;flex-wrap:wrap;gap:8px;margin-top:16px;padding:8px 0 calc(8px + env(safe-area-inset-bottom));background:var(--bg);}
+    .actions form{display:flex;margin:0;}
+    .actions button{margin:0;}
+    .actions.flow{position:static;padding:0;}
+    #submitForm{display:contents;}
+    @media (prefers-color-scheme:dark){#app [style]{color:inherit!important;background:transparent!important;border-color:var(--border)!important;}}
+    @media (max-width:600px){body{margin-top:16px;}.actions form,.actions button{flex:1 1 40%;}}
+    .step{color:var(--muted);font-size:14px;margin-bottom:-8px;}
+    .thread{border-left:3px solid var(--border);padding:4px 12px;margin-bottom:8px;color:var(--muted);font-size:14px;}
+    .thread b{color:var(--fg);}
+    .files{padding-left:20px;}
+    .files li{padding:6px 0;}
+    .files span{color:var(--muted);font-size:14px;}
+    summary{padding:10px 0;cursor:pointer;}
+    .ok{padding:12px;border:1px solid var(--ok-border);border-radius:10px;background:var(--ok-bg);}
+    .err{padding:12px;border:1px solid var(--err-border);border-radius:10px;background:var(--err-bg);color:var(--fg);}
+    .pending{padding:12px;border:1px solid var(--pending-border);border-radius:10px;background:var(--pending-bg);}
+    .countdown{color:var(--muted);font-size:14px;margin:-8px 0 8px;}
+    .countdown.pending,.countdown.err{margin:0 0 8px;color:var(--fg);}
+    .recap time,.recap-ack{color:var(--muted);font-size:14px;}
+    .seen{color:var(--muted);font-size:14px;}
+    .seen button{min-height:36px;padding:6px 12px;font-size:14px;}
+    .chips{display:flex;flex-wrap:wrap;}
+    .chips button{min-height:36px;padding:6px 12px;font-size:14px;border-radius:18px;}
+    .recap .row{white-space:pre-wrap;word-break:break-word;}
+    :focus-visible{outline:3px solid #0969da;outline-offset:2px;}
+    @media (prefers-color-scheme:dark){:focus-visible{outline-color:#4493f8;}}
+    @media (prefers-contrast:more){:root{--muted:var(--fg);--border:var(--fg);}button,input,select,textarea{border-width:2px;}}
+    @media (forced-colors:active){button,input,select,textarea,.ok,.err,.pending{border:1px solid CanvasText;}button:disabled{color:GrayText;}:focus-visible{outline-color:Highlight;}}
+    [tabindex="-1"]:focus{outline:none;}
+    .skip{position:absolute;left:-10000px;top:auto;}
+    .skip:focus{position:static;display:inline-block;padding:8px 0;}
+    .sr-only{position:absolute;width:1px;height:1px;overflow:hidden;clip:rect(0 0 0 0);white-space:nowrap;}
+    header.brand img{max-height:48px;max-width:100%;}
+    footer.brand{margin-top:32px;padding-bottom:env(safe-area-inset-bottom);color:var(--muted);font-size:13px;}
+  </style>
+  {{with .Brand}}{{if .Color}}
+  <meta name="theme-color" content="{{.Color}}"/>
+  <style>
+    button{background:{{.Color}};border-color:{{.Color}};color:#fff;}
+    button:hover{background:{{.Color}};opacity:.9;}
+    a{color:{{.Color}};}
   </style>
+  {{end}}{{if .CSS}}<link rel="stylesheet" href="{{.Prefix}}/branding/custom.css"/>{{end}}{{end}}
 </head>
 <body>
+  <a class="skip" href="#answer">Skip to the answer</a>
+  {{if .Brand.LogoURL}}<header class="brand"><img src="{{.Brand.LogoURL}}" alt=""/></header>{{end}}
+  <main>
+  {{range .Thread}}
+  <div class="thread" role="note" aria-label="Earlier question"><b>{{.Title}}</b><br/>{{if .Answer}}Your answer: {{.Answer}}{{else}}No answer{{end}}</div>
+  {{end}}
+  {{if .StepCount}}{{if not .Done}}
+  <div class="step">Step {{inc .Step}} of {{.StepCount}}</div>
+  {{end}}{{end}}
   <h1>{{.Title}}</h1>
+  {{if not .Done}}{{if not .ExpiresAt.IsZero}}
+  <div id="countdown" class="countdown" role="timer" aria-live="off" data-expires="{{.ExpiresAt.Unix}}" data-now="{{.Now.Unix}}" data-grace="{{.Grace}}">This request expires at <time datetime="{{rfc3339 .ExpiresAt}}">{{when .ExpiresAt}}</time>.</div>
+  {{if .ExtensionsLeft}}
+  <form class="seen" method="post" action="./extend?k={{urlquery .Token}}">
+    <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+    <button type="submit">Need more time (+{{duration .ExtendSeconds}})</button>
+  </form>
+  {{end}}
+  <script>
+    (function () {
+      var el = document.getElementById("countdown");
+      if (!el) return;
+      var expires = Number(el.getAttribute("data-expires")) * 1000;
+      // Count with the server's clock, not the device's.
+      var skew = Number(el.getAttribute("data-now")) * 1000 - Date.now();
+      var grace = Number(el.getAttribute("data-grace")) * 1000;
+      function left(ms) {
+        var s = Math.ceil(ms / 1000), d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+        s = s % 60;
+        if (d) return d + "d " + h + "h";
+        if (h) return h + "h " + m + "m";
+        if (m) return m + "m " + s + "s";
+        return s + "s";
+      }
+      function tick() {
+        var ms = expires - (Date.now() + skew);
+        if (ms <= 0 && ms > -grace) {
+          el.className = "countdown pending";
+          el.textContent = "This request has expired, but your answer is still accepted for " + left(ms + grace) + ".";
+          return;
+        }
+        if (ms <= 0) {
+          clearInterval(timer);
+          el.className = "countdown err";
+          el.setAttribute("role", "alert");
+          el.textContent = "This request has expired.";
+          var buttons = document.querySelectorAll("form button");
+          for (var i = 0; i < buttons.length; i++) buttons[i].disabled = true;
+          return;
+        }
+        el.className = "countdown" + (ms < 60000 ? " pending" : "");
+        el.textContent = "This request expires in " + left(ms) + ".";
+      }
+      var timer = setInterval(tick, 1000);
+      tick();
+    })();
+  </script>
+  {{end}}{{end}}
   <pre>{{.Body}}</pre>
+  {{if .Attachments}}
+  <ul class="files" aria-label="Attachments">
+    {{range .Attachments}}<li><a href="{{.URL}}" target="_blank" rel="noopener">{{.Name}}</a> <span>{{.Size}}</span></li>{{end}}
+  </ul>
+  {{end}}
+
+  {{if .DraftSaved}}{{if not .Done}}
+    <div class="ok" role="status">Draft saved. You can come back to this page later.</div>
+  {{end}}{{end}}
+  {{if .Rejected}}{{if or (not .Done) (not .EditUntil.IsZero)}}
+    <div class="err" role="alert">{{.Rejected}}</div>
+  {{end}}{{end}}
 
+  {{if not .Done}}
+  <p id="progress" class="pending row" role="status" aria-live="polite"{{if not .Progress}} style="display:none"{{end}}>{{.Progress}}</p>
+  <p id="claim" class="pending row" role="status" aria-live="polite" style="display:none"></p>
+  {{end}}
+  <div id="answer" tabindex="-1">
   {{if .Done}}
-    <div class="ok">Submitted.</div>
+    {{if .ForwardedTo}}
+    <div class="ok" role="status">Forwarded to {{.ForwardedTo}}.</div>
+    {{else if .Recap}}{{with .Recap}}
+    {{if eq .State "answered"}}
+    <div class="ok recap" role="status">
+      <div><b>Answered{{if .Responder}} by {{.Responder}}{{end}}</b> <time datetime="{{rfc3339 .AnsweredAt}}">{{when .AnsweredAt}}</time></div>
+      {{if .Answer}}<div class="row">{{.Answer}}</div>{{end}}
+    </div>
+    {{else if eq .State "cancelled"}}
+    <div class="err recap" role="status"><b>This request was cancelled</b>{{if not .ClosedAt.IsZero}} <time datetime="{{rfc3339 .ClosedAt}}">{{when .ClosedAt}}</time>{{end}}. No answer is needed.{{if .Note}} {{.Note}}{{end}}</div>
+    {{else}}
+    <div class="err recap" role="status"><b>This request expired</b> <time datetime="{{rfc3339 .ClosedAt}}">{{when .ClosedAt}}</time> without an answer.</div>
+    {{end}}
+    {{if .Tracked}}{{if eq .State "answered"}}
+    {{if .Continued}}
+    <p class="recap-ack">Your answer was received and the agent continued{{if not .AcknowledgedAt.IsZero}} <time datetime="{{rfc3339 .AcknowledgedAt}}">{{when .AcknowledgedAt}}</time>{{end}}.{{if .Note}} {{.Note}}{{end}}</p>
+    {{else}}
+    <p class="recap-ack">{{if .Acknowledged}}The asker received your answer <time datetime="{{rfc3339 .AcknowledgedAt}}">{{when .AcknowledgedAt}}</time>.{{else}}The asker has not picked up your answer yet.{{end}}</p>
+    {{end}}
+    {{end}}{{end}}
+    {{end}}{{else}}
+    <div class="ok" role="status">Submitted.</div>
+    {{end}}
+    {{if not .EditUntil.IsZero}}
+    <details class="row">
+      <summary>Edit answer</summary>
+      <p class="recap-ack">You can change your answer until <time datetime="{{rfc3339 .EditUntil}}">{{when .EditUntil}}</time>.</p>
+      {{if .Buttons}}
+      <div class="actions{{if .Input}} flow{{end}}" role="group" aria-label="Edit answer">
+        {{range .Buttons}}
+        <form method="post" action="./edit?k={{urlquery $.Token}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}"/>
+          <input type="hidden" name="version" value="{{$.AnswerVersion}}"/>
+          <input type="hidden" name="action" value="{{.Value}}"/>
+          <button type="submit">{{.Label}}</button>
+        </form>
+        {{end}}
+      </div>
+      {{end}}
+      {{if .Input}}
+      <form method="post" action="./edit?k={{urlquery .Token}}">
+        <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+        <input type="hidden" name="version" value="{{.AnswerVersion}}"/>
+        <label for="edit-text">{{.Input.Label}}</label>
+        <div style="height:8px"></div>
+        <input type="text" id="edit-text" name="text" value="{{.Text}}"/>
+        <div class="actions">
+          <button type="submit">{{.Input.Submit}}</button>
+        </div>
+      </form>
+      {{end}}
+    </details>
+    {{end}}
     {{if .JsonForms}}
-    <div class="row">
+    <div class="actions">
       <button type="button" onclick="window.close()">关闭窗口</button>
     </div>
     {{end}}
   {{else}}
+    {{if .AskName}}
+      <div class="row">
+        <label for="responder-name">Your name</label>
+        <div style="height:8px"></div>
+        <input type="text" id="responder-name" maxlength="100" autocomplete="name" required/>
+      </div>
+      <script>
+        (function () {
+          // Every answer form carries the name; the browser remembers it for
+          // the next ask.
+          var input = document.getElementById("responder-name");
+          try { input.value = localStorage.getItem("ask4me.name") || ""; } catch (e) {}
+          document.addEventListener("submit", function (e) {
+            var form = e.target;
+            if (!form.getAttribute("action") || form.getAttribute("action").indexOf("./submit") !== 0) return;
+            var field = form.querySelector("input[name=responder_name]");
+            if (!field) {
+              field = document.createElement("input");
+              field.type = "hidden";
+              field.name = "responder_name";
+              form.appendChild(field);
+            }
+            field.value = input.value;
+            try { localStorage.setItem("ask4me.name", input.value.trim()); } catch (e) {}
+          }, true);
+        })();
+      </script>
+    {{end}}
     {{if .JsonForms}}
       <div class="row">
         <div id="app">Loading...</div>
-        <div id="err" class="row" style="display:none"></div>
+        <div id="err" class="row" role="alert" style="display:none"></div>
         <noscript>
           <div class="err">JavaScript is required to render this form.</div>
         </noscript>
         <form id="submitForm" method="post" action="./submit?k={{urlquery .Token}}">
+          <input type="hidden" name="csrf" value="{{.CSRF}}"/>
           <input type="hidden" name="payload_json" id="payload_json" value=""/>
-          <button id="submitBtn" type="submit">Submit</button>
+          <div class="actions" role="group" aria-label="Answer">
+            <button id="submitBtn" type="submit">Submit</button>
+            <button type="submit" formaction="./draft?k={{urlquery .Token}}" formnovalidate>Save draft</button>
+          </div>
         </form>
       </div>
-      <script src="/static/jsonforms.bundle.js"></script>
+      <script src="{{$.Brand.Prefix}}/static/jsonforms.bundle.js"></script>
       <script>
         (function () {
           var elErr = document.getElementById("err");
@@ -634,12 +1279,107 @@ var pageTpl = template.Must(template.New("page").Parse(`<!doctype html>
           });
         })();
       </script>
+    {{else if .Uploads}}
+      <div class="row">
+        <form method="post" enctype="multipart/form-data" action="./submit?k={{urlquery .Token}}">
+          <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+          {{if .Input}}
+            <label for="answer-text">{{.Input.Label}}</label>
+            <div style="height:8px"></div>
+            <input type="text" id="answer-text" name="text" value="{{.Text}}"/>
+            {{if .Suggestions}}<div class="chips" role="group" aria-label="Suggested replies">{{range .Suggestions}}<button type="button" class="chip" data-for="answer-text">{{.}}</button>{{end}}</div>{{end}}
+            <div style="height:10px"></div>
+          {{end}}
+          <label for="answer-files">Attach files</label>
+          <div style="height:8px"></div>
+          <input type="file" id="answer-files" name="file" multiple/>
+          {{if .Voice}}
+          <div id="voice" class="seen row" hidden>
+            <button type="button" id="voice-record" aria-pressed="false">Record answer</button>
+            <span id="voice-status" role="status" aria-live="polite"></span>
+          </div>
+          <script>
+            (function () {
+              var box = document.getElementById("voice");
+              // Recording needs a secure context and a browser with MediaRecorder.
+              if (!box || !navigator.mediaDevices || !window.MediaRecorder || !window.DataTransfer) return;
+              box.hidden = false;
+              var btn = document.getElementById("voice-record");
+              var status = document.getElementById("voice-status");
+              var files = document.getElementById("answer-files");
+              var text = document.getElementById("answer-text");
+              var transcribe = {{.Transcribe}};
+              var rec = null;
+              function say(msg) { status.textContent = msg; }
+              function attach(blob, type) {
+                var ext = type.indexOf("mp4") >= 0 ? "m4a" : type.indexOf("ogg") >= 0 ? "ogg" : "webm";
+                var dt = new DataTransfer();
+                for (var i = 0; i < files.files.length; i++) dt.items.add(files.files[i]);
+                dt.items.add(new File([blob], "voice-" + Date.now() + "." + ext, { type: type }));
+                files.files = dt.files;
+              }
+              btn.addEventListener("click", function () {
+                if (rec) {
+                  rec.stop();
+                  return;
+                }
+                navigator.mediaDevices.getUserMedia({ audio: true }).then(function (stream) {
+                  var chunks = [];
+                  rec = new MediaRecorder(stream);
+                  rec.ondataavailable = function (e) { if (e.data.size) chunks.push(e.data); };
+                  rec.onstop = function () {
+                    stream.getTracks().forEach(function (t) { t.stop(); });
+                    var type = (rec.mimeType || "audio/webm").split(";")[0];
+                    var blob = new Blob(chunks, { type: type });
+                    rec = null;
+                    btn.textContent = "Record answer";
+                    btn.setAttribute("aria-pressed", "false");
+                    attach(blob, type);
+                    if (!transcribe || !text) {
+                      say("Recording attached.");
+                      return;
+                    }
+                    say("Recording attached. Transcribing...");
+                    fetch("./transcribe?k={{urlquery .Token}}", {
+                      method: "POST",
+                      headers: { "Content-Type": type, "X-Ask4Me-CSRF": "{{.CSRF}}" },
+                      body: blob
+                    }).then(function (res) {
+                      if (!res.ok) throw new Error(res.status);
+                      return res.json();
+                    }).then(function (d) {
+                      text.value = text.value ? text.value + " " + d.text : d.text;
+                      text.dispatchEvent(new Event("input", { bubbles: true }));
+                      say("Recording attached. Check the transcript before sending.");
+                    }).catch(function () {
+                      say("Recording attached; it could not be transcribed.");
+                    });
+                  };
+                  rec.start();
+                  btn.textContent = "Stop recording";
+                  btn.setAttribute("aria-pressed", "true");
+                  say("Recording...");
+                }).catch(function () {
+                  say("The microphone is not available.");
+                });
+              });
+            })();
+          </script>
+          {{end}}
+          <div class="actions" role="group" aria-label="Answer">
+            {{range .Buttons}}<button type="submit" name="action" value="{{.Value}}">{{.Label}}</button>{{end}}
+            {{if .Input}}<button type="submit">{{.Input.Submit}}</button>{{end}}
+          </div>
+        </form>
+      </div>
     {{else}}
       {{if .Buttons}}
-        <div class="row">
+        <div class="actions{{if .Input}} flow{{end}}" role="group" aria-label="Answer">
           {{range .Buttons}}
-            <form method="post" style="display:inline" action="./submit?k={{urlquery $.Token}}">
+            <form method="post" action="./submit?k={{urlquery $.Token}}">
+              <input type="hidden" name="csrf" value="{{$.CSRF}}"/>
               <input type="hidden" name="action" value="{{.Value}}"/>
+              {{if $.StepCount}}<input type="hidden" name="step" value="{{$.Step}}"/>{{end}}
               <button type="submit">{{.Label}}</button>
             </form>
           {{end}}
@@ -649,45 +1389,265 @@ var pageTpl = template.Must(template.New("page").Parse(`<!doctype html>
       {{if .Input}}
         <div class="row">
           <form method="post" action="./submit?k={{urlquery .Token}}">
-            <label>{{.Input.Label}}</label>
+            <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+            {{if .StepCount}}<input type="hidden" name="step" value="{{.Step}}"/>{{end}}
+            <label for="answer-text">{{.Input.Label}}</label>
             <div style="height:8px"></div>
-            <input type="text" name="text" value=""/>
-            <div style="height:10px"></div>
-            <button type="submit">{{.Input.Submit}}</button>
+            <input type="text" id="answer-text" name="text" value="{{.Text}}"/>
+            {{if .Suggestions}}<div class="chips" role="group" aria-label="Suggested replies">{{range .Suggestions}}<button type="button" class="chip" data-for="answer-text">{{.}}</button>{{end}}</div>{{end}}
+            <div class="actions">
+              <button type="submit">{{.Input.Submit}}</button>
+              <button type="submit" formaction="./draft?k={{urlquery .Token}}">Save draft</button>
+            </div>
           </form>
         </div>
       {{end}}
     {{end}}
+    {{if .Suggestions}}
+    <script>
+      // A suggested reply fills in the text input; the responder can still
+      // edit it before sending.
+      document.addEventListener("click", function (e) {
+        var chip = e.target.closest && e.target.closest(".chip");
+        if (!chip) return;
+        var input = document.getElementById(chip.getAttribute("data-for"));
+        if (!input) return;
+        input.value = chip.textContent;
+        input.dispatchEvent(new Event("input", { bubbles: true }));
+        input.focus();
+      });
+    </script>
+    {{end}}
+    {{if .Contacts}}
+      <details class="row">
+        <summary>Forward to someone else</summary>
+        <form method="post" action="./forward?k={{urlquery .Token}}">
+          <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+          <div style="height:8px"></div>
+          <label for="forward-contact" class="sr-only">Forward to</label>
+          <select id="forward-contact" name="contact">
+            {{range .Contacts}}<option value="{{.}}">{{.}}</option>{{end}}
+          </select>
+          <div style="height:8px"></div>
+          <input type="text" name="note" placeholder="Note (optional)" aria-label="Note (optional)"/>
+          <div style="height:10px"></div>
+          <button type="submit">Forward</button>
+        </form>
+      </details>
+    {{end}}
+    {{if .Acknowledged}}
+      <p class="seen row">You marked this as seen; the asker knows you will answer later.</p>
+    {{else}}
+      <form class="seen row" method="post" action="./ack?k={{urlquery .Token}}">
+        <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+        <button type="submit">Seen, I'll answer later</button>
+      </form>
+    {{end}}
+    <script>
+      (function () {
+        var url = "./beacon?k={{urlquery .Token}}";
+        // The page ID tells this page's answer claim from others', see claims.go.
+        var page = "";
+        try {
+          var rnd = new Uint8Array(12);
+          crypto.getRandomValues(rnd);
+          for (var i = 0; i < rnd.length; i++) page += ("0" + rnd[i].toString(16)).slice(-2);
+        } catch (e) {}
+        window.ask4mePage = page;
+        function send(state) {
+          var body = new URLSearchParams({ state: state, csrf: "{{.CSRF}}", page: page });
+          if (navigator.sendBeacon && navigator.sendBeacon(url, body)) return;
+          if (window.fetch) fetch(url, { method: "POST", body: body, keepalive: true }).catch(function () {});
+        }
+        if (document.visibilityState === "visible") send("viewing");
+        document.addEventListener("visibilitychange", function () {
+          if (document.visibilityState === "visible") send("viewing");
+        });
+        var lastTyping = 0;
+        document.addEventListener("input", function () {
+          var now = Date.now();
+          if (now - lastTyping < 10000) return;
+          lastTyping = now;
+          send("typing");
+        }, true);
+      })();
+    </script>
   {{end}}
+  </div>
+  <div id="followup" class="row" role="status" aria-live="polite" tabindex="-1" style="display:none"></div>
+  <script>
+    (function () {
+      var done = {{.Done}};
+      // After a submission, move focus to the result so it is read out.
+      if (done && !location.hash) {
+        var result = document.getElementById("answer");
+        if (result) result.focus();
+      }
+      if (!window.EventSource) return;
+      var submitting = false;
+      var es = new EventSource("./stream?k={{urlquery .Token}}&p=" + encodeURIComponent(window.ask4mePage || ""));
+      function notice(kind, text) {
+        var el = document.getElementById("followup");
+        if (!el) return;
+        el.className = kind + " row";
+        el.textContent = text;
+        el.style.display = "block";
+      }
+      // The request changed elsewhere: stop answering and show the new state.
+      function refresh(reason) {
+        if (done || submitting) return;
+        es.close();
+        var buttons = document.querySelectorAll("form button");
+        for (var i = 0; i < buttons.length; i++) buttons[i].disabled = true;
+        var text = {
+          "request.cancelled": "This request was cancelled.",
+          "request.expired": "This request has expired.",
+          "request.delegated": "This request was forwarded.",
+          "user.step_submitted": "This step was answered elsewhere."
+        }[reason] || "This request was answered elsewhere.";
+        notice("pending", text + " Reloading...");
+        document.getElementById("followup").focus();
+        window.location.reload();
+      }
+      document.addEventListener("submit", function () { submitting = true; }, true);
+      es.onmessage = function (msg) {
+        var ev;
+        try { ev = JSON.parse(msg.data); } catch (e) { return; }
+        if (!ev || !ev.data) return;
+        if (ev.type === "page.state") {
+          var st = ev.data.status;
+          if (st === "submitted" || st === "expired" || st === "cancelled") refresh("request." + st);
+          return;
+        }
+        if (ev.type === "page.claimed") {
+          var c = document.getElementById("claim");
+          if (!c) return;
+          c.textContent = ev.data.self ? "You are answering this on another device." :
+            (ev.data.by || "Someone else") + " is answering this. You can still answer; the first answer counts.";
+          c.style.display = "block";
+          clearTimeout(c.hideTimer);
+          c.hideTimer = setTimeout(function () { c.style.display = "none"; }, (ev.data.seconds || 60) * 1000);
+          return;
+        }
+        if (ev.type === "page.progress") {
+          var p = document.getElementById("progress");
+          if (p && ev.data.message) { p.textContent = ev.data.message; p.style.display = "block"; }
+          if (ev.data.closed) refresh("request.cancelled");
+          return;
+        }
+        if (ev.type === "page.changed") {
+          // The asker acknowledged the answer: show it in the recap.
+          if (ev.data.reason === "answer.acknowledged") {
+            if (done && !submitting) { es.close(); window.location.reload(); }
+            return;
+          }
+          refresh(ev.data.reason);
+          return;
+        }
+        if (ev.type !== "session.question" || !ev.data.interaction_url) return;
+        es.close();
+        notice("ok", "New question: " + (ev.data.title || "") + " - loading...");
+        window.location.href = ev.data.interaction_url;
+      };
+      // A stream that cannot reconnect usually means the request is over.
+      es.onerror = function () {
+        if (es.readyState !== 2 || done || submitting) return;
+        var key = "ask4me.reloaded:" + location.pathname;
+        try {
+          if (Date.now() - Number(sessionStorage.getItem(key) || 0) < 60000) return;
+          sessionStorage.setItem(key, String(Date.now()));
+        } catch (e) { return; }
+        window.location.reload();
+      };
+    })();
+  </script>
+  </main>
+  {{if .Brand.Footer}}<footer class="brand">{{.Brand.Footer}}</footer>{{end}}
 </body>
 </html>`))
 
 type server struct {
-	cfg Config
-	db  *store
-	hub *runtimeHub
+	// conf is swapped as a whole on reload; read it through cfg().
+	conf     atomic.Pointer[Config]
+	db       *store
+	requests requestStore
+	hub      *runtimeHub
+	presence *presenceThrottle
+	blobs    blobStore
+	limiter  *rateLimiter
+
+	// outboxWake nudges outboxLoop; see outbox.go.
+	outboxWake chan struct{}
+	// shutdown tracks graceful shutdown; see shutdown.go.
+	shutdown *shutdownState
+	// vapid caches the stored web push key; see webpush.go.
+	vapid vapidKeys
+	// telegram skips resent bot updates; see telegram.go.
+	telegram telegramUpdates
+	// webhooks caches the webhook subscriptions; see webhooks.go.
+	webhooks webhookCache
+	// dedupMu serializes deduplicated asks; see dedup.go.
+	dedupMu sync.Mutex
+	// notify bounds concurrent notification sends; see notifypool.go.
+	notify *notifyPool
+}
+
+// cfg returns the current configuration. Callers must not modify it.
+func (s *server) cfg() *Config {
+	return s.conf.Load()
 }
 
+// auth checks the API key (Bearer header, or ?key= on GET) against api_key
+// and the named keys, then the key's scope, tenant and rate limit; see
+// apikeys.go and tenants.go.
 func (s *server) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if strings.HasPrefix(auth, "Bearer ") {
-			if strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")) == s.cfg.APIKey {
-				next.ServeHTTP(w, r)
-				return
-			}
+		k, ok, err := s.authenticate(r)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ask4me"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
 		}
-		if r.Method == http.MethodGet {
-			if strings.TrimSpace(r.URL.Query().Get("key")) == s.cfg.APIKey {
-				next.ServeHTTP(w, r)
+		if scope := requiredScope(r); !k.allows(scope) {
+			http.Error(w, "forbidden: key lacks the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		if k.Tenant != "" && !tenantPath(r) {
+			http.Error(w, "forbidden: not available to tenant keys", http.StatusForbidden)
+			return
+		}
+		if allowed, wait := s.limiter.allow("key:"+k.ID, k.RateLimitPerMinute, time.Now()); !allowed {
+			writeRateLimited(w, wait)
+			return
+		}
+		if r.URL.Path == "/v1/ask" {
+			if allowed, wait := s.limiter.allow("ask:"+k.ID, s.cfg().RateLimitAskPerMinute, time.Now()); !allowed {
+				writeRateLimited(w, wait)
 				return
 			}
 		}
-		w.Header().Set("WWW-Authenticate", `Bearer realm="ask4me"`)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		next.ServeHTTP(w, withAPIKey(r, k))
 	})
 }
 
+func (s *server) authenticate(r *http.Request) (apiKey, bool, error) {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		k, ok, err := s.lookupAPIKey(r.Context(), strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+		if ok || err != nil {
+			return k, ok, err
+		}
+	}
+	if r.Method == http.MethodGet {
+		return s.lookupAPIKey(r.Context(), strings.TrimSpace(r.URL.Query().Get("key")))
+	}
+	return apiKey{}, false, nil
+}
+
 func (s *server) routes() http.Handler {
 	mux := http.NewServeMux()
 	if distFS, err := fs.Sub(uiDistEmbedFS, "ui/dist"); err == nil {
@@ -701,9 +1661,53 @@ func (s *server) routes() http.Handler {
 			fsHandler.ServeHTTP(w, r)
 		})))
 	}
-	mux.Handle("/v1/ask", s.auth(http.HandlerFunc(s.handleAsk)))
-	mux.HandleFunc("/r/", s.handleUser)
-	return mux
+	mux.HandleFunc(brandingPathPrefix, s.handleBranding)
+	for _, p := range []string{"/manifest.webmanifest", "/sw.js", "/pwa.js", "/icon.svg", "/app"} {
+		mux.HandleFunc(p, s.handlePWA)
+	}
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.Handle("/v1/ask", s.refuseWhileStopping(s.limitIP("ask", s.auth(http.HandlerFunc(s.handleAsk)))))
+	mux.Handle("/v1/requests", s.auth(http.HandlerFunc(s.handleRequestsAPI)))
+	mux.Handle("/v1/requests/", s.auth(http.HandlerFunc(s.handleRequestsAPI)))
+	mux.Handle("/v1/hooks/agent", s.refuseWhileStopping(s.auth(http.HandlerFunc(s.handleAgentHook))))
+	mux.Handle("/v1/events/stream", s.auth(http.HandlerFunc(s.handleEventsStream)))
+	mux.Handle("/v1/webhooks", s.auth(http.HandlerFunc(s.handleWebhooks)))
+	mux.Handle("/v1/webhooks/", s.auth(http.HandlerFunc(s.handleWebhooks)))
+	mux.Handle("/v1/templates", s.auth(http.HandlerFunc(s.handleTemplates)))
+	mux.Handle("/v1/templates/", s.auth(http.HandlerFunc(s.handleTemplates)))
+	mux.Handle("/v1/schedules", s.auth(http.HandlerFunc(s.handleSchedules)))
+	mux.Handle("/v1/schedules/", s.auth(http.HandlerFunc(s.handleSchedules)))
+	mux.Handle("/v1/export", s.auth(http.HandlerFunc(s.handleExport)))
+	mux.Handle("/v1/stats", s.auth(http.HandlerFunc(s.handleStats)))
+	mux.Handle("/v1/search", s.auth(http.HandlerFunc(s.handleSearch)))
+	mux.Handle("/metrics", s.auth(http.HandlerFunc(s.handleMetrics)))
+	mux.Handle("/v1/attachments", s.auth(http.HandlerFunc(s.handleAttachments)))
+	mux.Handle("/v1/attachments/", s.auth(http.HandlerFunc(s.handleAttachments)))
+	mux.Handle("/v1/outbox", s.auth(http.HandlerFunc(s.handleOutbox)))
+	mux.Handle("/v1/outbox/", s.auth(http.HandlerFunc(s.handleOutbox)))
+	mux.Handle("/v1/apikeys", s.auth(http.HandlerFunc(s.handleAPIKeys)))
+	mux.Handle("/v1/apikeys/", s.auth(http.HandlerFunc(s.handleAPIKeys)))
+	mux.Handle("/v1/push/subscriptions", s.auth(http.HandlerFunc(s.handlePushSubscriptions)))
+	mux.Handle("/v1/push/subscriptions/", s.auth(http.HandlerFunc(s.handlePushSubscriptions)))
+	mux.Handle("/v1/bundles", s.refuseWhileStopping(s.limitIP("ask", s.auth(http.HandlerFunc(s.handleBundles)))))
+	mux.Handle("/v1/bundles/", s.auth(http.HandlerFunc(s.handleBundles)))
+	mux.Handle("/v1/rotations", s.auth(http.HandlerFunc(s.handleRotations)))
+	mux.Handle("/v1/rotations/", s.auth(http.HandlerFunc(s.handleRotations)))
+	mux.HandleFunc("/subscribe", s.handleSubscribe)
+	mux.HandleFunc("/compose", s.handleCompose)
+	mux.HandleFunc("/slack/", s.handleSlack)
+	mux.HandleFunc("/telegram/", s.handleTelegram)
+	mux.HandleFunc("/chat/", s.handleChatGateway)
+	mux.HandleFunc("/email/inbound", s.handleEmailInbound)
+	mux.Handle("/r/", s.limitIP("page", http.HandlerFunc(s.handleUser)))
+	mux.Handle("/s/", s.limitIP("page", http.HandlerFunc(s.handleShortLink)))
+	mux.Handle(bundlePathPrefix, s.limitIP("page", http.HandlerFunc(s.handleBundlePage)))
+	mux.Handle("/tap/", s.limitIP("page", http.HandlerFunc(s.handleTap)))
+	mux.Handle("/admin", http.RedirectHandler("/admin/", http.StatusMovedPermanently))
+	mux.HandleFunc("/admin/", s.handleAdmin)
+	return s.mountPrefix(accessLog(s.filterIPs(s.separateSurfaces(s.cors(mux)))))
 }
 
 func (s *server) handleAsk(w http.ResponseWriter, r *http.Request) {
@@ -723,35 +1727,87 @@ func parseBoolQuery(v string) bool {
 	}
 }
 
-func (s *server) isTerminalEventType(typ string) bool {
-	switch typ {
-	case "user.submitted", "request.expired", "notify.failed":
+var defaultTerminalEventTypes = []string{"user.submitted", "request.expired", "notify.failed", "request.cancelled"}
+
+// isTerminalStatus reports whether a request status is final.
+func isTerminalStatus(status string) bool {
+	switch status {
+	case "submitted", "expired", "notify_failed", "cancelled":
 		return true
 	default:
 		return false
 	}
 }
 
+// closedStatusError rejects a write to a request in a terminal status with a
+// message that says how it ended.
+func closedStatusError(w http.ResponseWriter, status string) {
+	switch status {
+	case "expired":
+		http.Error(w, "expired", http.StatusGone)
+	case "cancelled":
+		http.Error(w, "cancelled", http.StatusGone)
+	case "notify_failed":
+		http.Error(w, "notification failed", http.StatusConflict)
+	default:
+		http.Error(w, "already submitted", http.StatusConflict)
+	}
+}
+
+// terminalEventTypes returns the event types that end the given request.
+// Collect- and quorum-mode multi-responder asks finish with request.completed
+// instead of the first user.submitted, and an ask's terminal_events add to
+// the list (see progress.go).
+func (s *server) terminalEventTypes(ctx context.Context, requestID string) []string {
+	types := defaultTerminalEventTypes
+	mode, _, err := s.db.getRespondersMode(ctx, requestID)
+	if err == nil && isMultiAnswerMode(mode) {
+		types = []string{"request.completed", "request.expired", "notify.failed", "request.cancelled"}
+	}
+	if custom, err := s.db.getTerminalEvents(ctx, requestID); err == nil && len(custom) > 0 {
+		types = append(slices.Clone(types), custom...)
+	}
+	return types
+}
+
+func isTerminalEventType(types []string, typ string) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
 type askWaitResponse struct {
 	RequestID     string          `json:"request_id"`
 	LastEventType string          `json:"last_event_type"`
 	LastEventID   string          `json:"last_event_id"`
 	Data          json.RawMessage `json:"data"`
+	// EventSchemaVersion versions Data, see eventSchemaVersion.
+	EventSchemaVersion int `json:"event_schema_version"`
+	// SeenAt and AcknowledgedAt are the read receipts, see receipts.go.
+	SeenAt         any `json:"seen_at"`
+	AcknowledgedAt any `json:"acknowledged_at"`
 }
 
-func (s *server) writeAskWaitResponse(w http.ResponseWriter, requestID string, ev Event) {
+func (s *server) writeAskWaitResponse(ctx context.Context, w http.ResponseWriter, requestID string, ev Event) {
+	rc, _ := s.db.receipts(ctx, requestID, "")
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Ask4Me-Request-Id", requestID)
 	_ = json.NewEncoder(w).Encode(askWaitResponse{
-		RequestID:     requestID,
-		LastEventType: ev.Type,
-		LastEventID:   ev.ID,
-		Data:          ev.Data,
+		RequestID:          requestID,
+		LastEventType:      ev.Type,
+		LastEventID:        ev.ID,
+		Data:               ev.Data,
+		EventSchemaVersion: eventSchemaVersion,
+		SeenAt:             unixOrNil(rc.SeenAt),
+		AcknowledgedAt:     unixOrNil(rc.AcknowledgedAt),
 	})
 }
 
 func (s *server) getTerminalEventFromDB(ctx context.Context, requestID string) (Event, bool, error) {
-	return s.db.getLatestEventByTypes(ctx, requestID, []string{"user.submitted", "request.expired", "notify.failed"})
+	return s.db.getLatestEventByTypes(ctx, requestID, s.terminalEventTypes(ctx, requestID))
 }
 
 func (s *server) waitTerminalEvent(ctx context.Context, requestID string) (Event, error) {
@@ -764,18 +1820,34 @@ func (s *server) waitTerminalEvent(ctx context.Context, requestID string) (Event
 		return ev, nil
 	}
 
+	terminal := s.terminalEventTypes(ctx, requestID)
 	ch, unsub := s.hub.subscribe(requestID)
 	defer unsub()
+	poll, stopPoll := s.hubPoll()
+	defer stopPoll()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return Event{}, ctx.Err()
+		case <-s.shutdown.stopping:
+			return Event{}, errServerStopping
+		case <-poll:
+			if tev, ok, err := s.getTerminalEventFromDB(ctx, requestID); err == nil && ok {
+				return tev, nil
+			}
 		case ev, ok := <-ch:
 			if !ok {
 				return Event{}, context.Canceled
 			}
-			if !s.isTerminalEventType(ev.Type) {
+			if ev.Type == "events.dropped" {
+				// The final event may be among the dropped ones.
+				if tev, ok, err := s.getTerminalEventFromDB(ctx, requestID); err == nil && ok {
+					return tev, nil
+				}
+				continue
+			}
+			if !isTerminalEventType(terminal, ev.Type) {
 				continue
 			}
 			return ev, nil
@@ -830,7 +1902,44 @@ func parseAskRequestFromHTTP(r *http.Request) (askRequest, error) {
 		ar.Body = q.Get("body")
 		ar.MCD = q.Get("mcd")
 		ar.ExpiresInSeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("expires_in_seconds")))
+		ar.ExpiresInBusinessSeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("expires_in_business_seconds")))
+		ar.SendAt = q.Get("send_at")
+		ar.Priority = q.Get("priority")
+		ar.DefaultAction = q.Get("default_action")
+		ar.ParentRequestID = q.Get("parent_request_id")
 		ar.ServerChanActionLinks = parseBoolQuery(q.Get("serverchan_action_links"))
+		ar.OneTimeLink = q.Get("one_time_link")
+		ar.Challenge = q.Get("challenge")
+		ar.CallbackURL = q.Get("callback_url")
+		ar.CallbackSecret = q.Get("callback_secret")
+		ar.QR = parseBoolQuery(q.Get("qr"))
+		if v := q.Get("terminal_events"); v != "" {
+			ar.TerminalEvents = strings.Split(v, ",")
+		}
+		ar.HeartbeatSeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("heartbeat_seconds")))
+		ar.BufferSize, _ = strconv.Atoi(strings.TrimSpace(q.Get("buffer_size")))
+		ar.DedupWindowSeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("dedup_window_seconds")))
+		ar.NotifyTimeoutSeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("notify_timeout_seconds")))
+		ar.NotifyResult = parseBoolQuery(q.Get("notify_result"))
+		ar.AskName = parseBoolQuery(q.Get("ask_name"))
+		ar.Tenant = q.Get("tenant")
+		ar.To = addressees(strings.Join(q["to"], ","))
+		if v := q.Get("tags"); v != "" {
+			ar.Tags = strings.Split(v, ",")
+		}
+		ar.Delivery = strings.TrimSpace(q.Get("delivery"))
+		ar.ExtendSeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("extend_seconds")))
+		ar.MaxExtensions, _ = strconv.Atoi(strings.TrimSpace(q.Get("max_extensions")))
+		ar.SLASeconds, _ = strconv.Atoi(strings.TrimSpace(q.Get("sla_seconds")))
+		ar.EscalateTo = strings.TrimSpace(q.Get("escalate_to"))
+		ar.Template = q.Get("template")
+		if ar.Template != "" {
+			vars, err := parseTemplateVars(q)
+			if err != nil {
+				return askRequest{}, err
+			}
+			ar.Vars = vars
+		}
 	default:
 		return askRequest{}, errors.New("method not allowed")
 	}
@@ -853,10 +1962,10 @@ func normalizeAskRequest(ar *askRequest) (int, error) {
 	if ar.JsonForms != nil && len(bytes.TrimSpace(ar.JsonForms.Schema)) > 0 {
 		var v any
 		if err := json.Unmarshal(ar.JsonForms.Schema, &v); err != nil {
-			return 0, errors.New("invalid jsonforms.schema")
+			return 0, badAskError("invalid jsonforms.schema")
 		}
 		if _, ok := v.(map[string]any); !ok {
-			return 0, errors.New("jsonforms.schema must be an object")
+			return 0, badAskError("jsonforms.schema must be an object")
 		}
 		ar.JsonForms.SubmitLabel = strings.TrimSpace(ar.JsonForms.SubmitLabel)
 		if ar.JsonForms.SubmitLabel == "" {
@@ -867,6 +1976,62 @@ func normalizeAskRequest(ar *askRequest) (int, error) {
 			ar.JsonForms.Renderer = "vanilla"
 		}
 	}
+	if err := normalizeResponders(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeSteps(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizePriority(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeDefaultAction(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeOneTimeLink(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeChallenge(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeCallback(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeDelivery(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeTerminalEvents(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeTags(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeStreamTuning(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeDedupWindow(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeNotifyTimeout(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeExtend(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeSLA(ar); err != nil {
+		return 0, err
+	}
+	if err := normalizeBusinessExpiry(ar); err != nil {
+		return 0, err
+	}
+	normalizeVoiceInput(ar)
+	sendAt, err := parseSendAt(ar.SendAt)
+	if err != nil {
+		return 0, err
+	}
+	if sendAt.After(time.Now().Add(time.Second)) {
+		ar.sendAt = sendAt
+	}
 	expiresIn := ar.ExpiresInSeconds
 	if expiresIn <= 0 {
 		expiresIn = 0
@@ -874,58 +2039,304 @@ func normalizeAskRequest(ar *askRequest) (int, error) {
 	return expiresIn, nil
 }
 
-func (s *server) createAskWithRequestID(ctx context.Context, requestID string, ar askRequest, sendTo http.ResponseWriter) (askRequest, time.Time, string, string, error) {
-	expiresIn, err := normalizeAskRequest(&ar)
-	if err != nil {
-		return askRequest{}, time.Time{}, "", "", err
-	}
-	if expiresIn <= 0 {
-		expiresIn = s.cfg.DefaultExpiresInSeconds
-	}
-	expiresAt := time.Now().Add(time.Duration(expiresIn) * time.Second)
+// badAskError marks validation failures in an ask payload; handlers map it to
+// 400 Bad Request.
+type badAskError string
 
-	var schemaJSON, uiSchemaJSON, dataJSON, submitLabel, renderer sql.NullString
-	if ar.JsonForms != nil && len(bytes.TrimSpace(ar.JsonForms.Schema)) > 0 {
-		schemaJSON = sql.NullString{String: string(bytes.TrimSpace(ar.JsonForms.Schema)), Valid: true}
-		if len(bytes.TrimSpace(ar.JsonForms.UISchema)) > 0 {
-			uiSchemaJSON = sql.NullString{String: string(bytes.TrimSpace(ar.JsonForms.UISchema)), Valid: true}
-		}
-		if len(bytes.TrimSpace(ar.JsonForms.Data)) > 0 {
-			dataJSON = sql.NullString{String: string(bytes.TrimSpace(ar.JsonForms.Data)), Valid: true}
-		}
-		if strings.TrimSpace(ar.JsonForms.SubmitLabel) != "" {
-			submitLabel = sql.NullString{String: strings.TrimSpace(ar.JsonForms.SubmitLabel), Valid: true}
-		}
-		if strings.TrimSpace(ar.JsonForms.Renderer) != "" {
-			renderer = sql.NullString{String: strings.TrimSpace(ar.JsonForms.Renderer), Valid: true}
-		}
+func (e badAskError) Error() string {
+	return string(e)
+}
+
+func isBadAskError(err error) bool {
+	var be badAskError
+	return errors.As(err, &be)
+}
+
+// createdAsk is the result of createAskWithRequestID. Links holds one entry
+// per responder; single-responder asks have exactly one link whose URL equals
+// InteractionURL.
+type createdAsk struct {
+	Ask       askRequest
+	ExpiresAt time.Time
+	// SLAAt is when the ask breaches its sla_seconds, see sla.go.
+	SLAAt          time.Time
+	InteractionURL string
+	Links          []responderLink
+	FirstEventID   string
+	// policy is the rule that answers the ask instead of a person, see
+	// policy.go.
+	policy *policyRule
+}
+
+func (s *server) createAskWithRequestID(ctx context.Context, requestID string, ar askRequest, sendTo http.ResponseWriter) (createdAsk, error) {
+	if strings.TrimSpace(ar.Template) != "" {
+		expanded, err := s.expandTemplate(ctx, ar)
+		if err != nil {
+			return createdAsk{}, err
+		}
+		ar = expanded
+	}
+	if err := s.expandGroup(ctx, &ar); err != nil {
+		return createdAsk{}, err
+	}
+	expiresIn, err := normalizeAskRequest(&ar)
+	if err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.resolveTenant(ctx, &ar); err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.resolveTo(ctx, &ar); err != nil {
+		return createdAsk{}, err
 	}
+	if expiresIn <= 0 {
+		expiresIn = s.defaultExpiresFor(ar.Tenant, ar.Priority)
+	}
+	// Scheduled asks get their full answering window after delivery.
+	start := time.Now()
+	if !ar.sendAt.IsZero() {
+		start = ar.sendAt
+	}
+	expiresAt := start.Add(time.Duration(expiresIn) * time.Second)
+	if ar.ExpiresInBusinessSeconds > 0 {
+		if expiresAt, err = s.businessExpiry(start, ar.ExpiresInBusinessSeconds); err != nil {
+			return createdAsk{}, err
+		}
+		expiresIn = int(expiresAt.Sub(start) / time.Second)
+	}
+	if err := s.checkSLA(ar, expiresIn); err != nil {
+		return createdAsk{}, err
+	}
+	if err := checkBundleAsk(ar); err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.resolveSession(ctx, &ar); err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.validateParent(ctx, &ar); err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.validateAttachments(ctx, &ar); err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.validateChallenge(ar); err != nil {
+		return createdAsk{}, err
+	}
+	contentHash, release, err := s.claimAskContent(ctx, requestID, ar)
+	if err != nil {
+		return createdAsk{}, err
+	}
+	defer release()
 
-	if err := s.db.createRequest(ctx, requestID, ar.Title, ar.Body, ar.MCD, "created", expiresAt, schemaJSON, uiSchemaJSON, dataJSON, submitLabel, renderer); err != nil {
-		return askRequest{}, time.Time{}, "", "", err
+	var slaAt time.Time
+	if ar.SLASeconds > 0 {
+		// Counted from delivery, like the expiry.
+		slaAt = start.Add(time.Duration(ar.SLASeconds) * time.Second)
+	}
+	if err := s.requests.createRequest(ctx, newRequest{
+		ID:          requestID,
+		Ask:         ar,
+		ExpiresAt:   expiresAt,
+		SLAAt:       slaAt,
+		ContentHash: contentHash,
+	}); err != nil {
+		return createdAsk{}, err
+	}
+	ok := false
+	defer func() {
+		if ok {
+			return
+		}
+		if err := s.requests.discardRequest(context.WithoutCancel(ctx), requestID); err != nil {
+			slog.Error("discard request", "request_id", requestID, "error", err)
+		}
+	}()
+	attached, err := s.attachToRequest(ctx, requestID, ar.Attachments)
+	if err != nil {
+		return createdAsk{}, err
 	}
 
-	tokenPlain := genToken()
-	tokenHash := sha256Hex(tokenPlain)
-	if err := s.db.insertToken(ctx, requestID, tokenHash, expiresAt); err != nil {
-		return askRequest{}, time.Time{}, "", "", err
+	links, err := s.issueResponderTokens(ctx, requestID, ar, expiresAt)
+	if err != nil {
+		return createdAsk{}, err
+	}
+	if err := s.shortenLinks(ctx, requestID, links, ar.sendAt, expiresAt); err != nil {
+		return createdAsk{}, err
 	}
 
-	interactionURL := s.makeInteractionURL(requestID, tokenPlain)
-	ev := s.mustNewEvent(ctx, requestID, "request.created", map[string]any{
+	interactionURL := links[0].URL
+	evData := map[string]any{
 		"interaction_url": interactionURL,
 		"expires_at":      expiresAt.UTC().Format(time.RFC3339),
-	})
+	}
+	if links[0].ShortURL != "" {
+		evData["short_url"] = links[0].ShortURL
+	}
+	if len(ar.Steps) > 0 {
+		evData["steps"] = len(ar.Steps)
+	}
+	if ar.SessionID != "" {
+		evData["session_id"] = ar.SessionID
+	}
+	if ar.scheduleID != "" {
+		evData["schedule_id"] = ar.scheduleID
+	}
+	if ar.bundleID != "" {
+		evData["bundle_id"] = ar.bundleID
+	}
+	if ar.Priority != priorityNormal {
+		evData["priority"] = ar.Priority
+	}
+	if ar.DefaultAction != "" {
+		evData["default_action"] = ar.DefaultAction
+	}
+	if ar.ParentRequestID != "" {
+		evData["parent_request_id"] = ar.ParentRequestID
+	}
+	if s.db.dedupBodies && len(ar.Body) >= minDedupBodyBytes {
+		evData["body_sha256"] = sha256Hex(ar.Body)
+	}
+	if len(attached) > 0 {
+		evData["attachments"] = attachmentViews(attached, s.cfg().BaseURL)
+	}
+	if ar.AllowUploads {
+		evData["allow_uploads"] = true
+	}
+	if ar.VoiceInput {
+		evData["voice_input"] = true
+	}
+	if ar.NotifyResult {
+		evData["notify_result"] = true
+	}
+	if ar.AskName {
+		evData["ask_name"] = true
+	}
+	if ar.Tenant != "" {
+		evData["tenant"] = ar.Tenant
+	}
+	if ar.To != "" {
+		evData["to"] = ar.To
+	}
+	if ar.rotation != "" {
+		evData["rotation"] = ar.rotation
+	}
+	if ar.OneTimeLink != "" {
+		evData["one_time_link"] = ar.OneTimeLink
+	}
+	if ar.Challenge != "" {
+		evData["challenge"] = ar.Challenge
+	}
+	if ar.CallbackURL != "" {
+		evData["callback_url"] = ar.CallbackURL
+	}
+	if ar.Delivery != "" {
+		evData["delivery"] = ar.Delivery
+	}
+	if ar.ExtendSeconds > 0 {
+		evData["extend_seconds"] = ar.ExtendSeconds
+		evData["max_extensions"] = ar.MaxExtensions
+	}
+	if ar.ExpiresInBusinessSeconds > 0 {
+		evData["expires_in_business_seconds"] = ar.ExpiresInBusinessSeconds
+	}
+	if ar.SLASeconds > 0 {
+		evData["sla_seconds"] = ar.SLASeconds
+		evData["sla_at"] = slaAt.UTC().Format(time.RFC3339)
+		if ar.EscalateTo != "" {
+			evData["escalate_to"] = ar.EscalateTo
+		}
+	}
+	if len(ar.TerminalEvents) > 0 {
+		evData["terminal_events"] = ar.TerminalEvents
+	}
+	if len(ar.Tags) > 0 {
+		evData["tags"] = ar.Tags
+	}
+	if ar.QR {
+		if code, err := qrDataURL(links[0].notifyURL()); err == nil {
+			evData["qr_code"] = code
+			evData["qr_url"] = qrImageURL(interactionURL)
+		}
+	}
+	if ar.Responders != nil {
+		evData["responders"] = responderLinksData(links)
+		evData["responders_mode"] = ar.Responders.Mode
+		if isMultiAnswerMode(ar.Responders.Mode) {
+			evData["min_answers"] = ar.Responders.MinAnswers
+		}
+		if ar.Responders.Approval != nil {
+			evData["approval"] = ar.Responders.Approval
+		}
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.created", evData)
+	events := []Event{ev}
+	if ar.routed != nil {
+		events = append(events, s.mustNewEvent(ctx, requestID, "request.routed", ar.routed))
+	}
+	for _, ev := range events {
+		if sendTo != nil {
+			if err := s.persistAndSendEvent(ctx, sendTo, ev); err != nil {
+				return createdAsk{}, err
+			}
+		} else {
+			_ = s.persistTerminalAware(ctx, ev)
+		}
+	}
 
-	if sendTo != nil {
-		if err := s.persistAndSendEvent(ctx, sendTo, ev); err != nil {
-			return askRequest{}, time.Time{}, "", "", err
+	c := createdAsk{
+		Ask:            ar,
+		ExpiresAt:      expiresAt,
+		SLAAt:          slaAt,
+		InteractionURL: interactionURL,
+		Links:          links,
+		FirstEventID:   ev.ID,
+	}
+	// An ask that a policy answers is answered by startAsk, and nobody is
+	// notified. The asks of a bundle share its notification.
+	c.policy = s.matchPolicy(ar)
+	if !ar.sendAt.IsZero() {
+		if err := s.scheduleAsk(ctx, requestID, c); err != nil {
+			return createdAsk{}, err
+		}
+	} else if c.policy == nil && ar.bundleID == "" {
+		if err := s.db.enqueueNotification(ctx, requestID, c.delivery(), time.Now()); err != nil {
+			return createdAsk{}, err
 		}
-	} else {
-		_ = s.persistTerminalAware(ctx, ev)
 	}
+	ok = true
+	return c, nil
+}
 
-	return ar, expiresAt, interactionURL, ev.ID, nil
+// startAsk kicks off notification delivery (or its schedule) and the expiry
+// timer for a freshly created ask. The delivery itself is already in the
+// outbox or scheduled_asks.
+func (s *server) startAsk(requestID string, c createdAsk) {
+	switch {
+	case !c.Ask.sendAt.IsZero():
+		go s.scheduleLoop(context.Background(), requestID, c.Ask.sendAt)
+	case c.policy != nil:
+		s.answerByPolicy(context.Background(), requestID, c.policy)
+	default:
+		s.wakeOutbox()
+	}
+	go s.expireLoop(context.Background(), requestID, c.ExpiresAt)
+	if !c.SLAAt.IsZero() {
+		go s.slaLoop(context.Background(), requestID, c.SLAAt)
+	}
+}
+
+// dispatchNotifications makes one delivery attempt for an ask. An error means
+// nobody was notified; the outbox decides whether to retry or fail the
+// request.
+func (s *server) dispatchNotifications(ctx context.Context, requestID string, ar askRequest, interactionURL string, links []responderLink) error {
+	switch {
+	case ar.Responders != nil:
+		return s.sendResponderNotifications(ctx, requestID, ar, links)
+	case ar.SessionID != "":
+		return s.sendSessionNotification(ctx, requestID, ar, interactionURL)
+	default:
+		return s.sendNotification(ctx, requestID, ar, interactionURL)
+	}
 }
 
 func (s *server) handleAskJSON(w http.ResponseWriter, r *http.Request) {
@@ -935,6 +2346,10 @@ func (s *server) handleAskJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request_id", http.StatusBadRequest)
 		return
 	}
+	if ok, err := s.visible(ctx, requestID); requestID != "" && (err != nil || !ok) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
 	if requestID == "" {
 		requestID = genID("req_")
 		ar, err := parseAskRequestFromHTTP(r)
@@ -943,31 +2358,44 @@ func (s *server) handleAskJSON(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 				return
 			}
+			if isBadAskError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		ar2, expiresAt, interactionURL, _, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
-		if err != nil {
-			if strings.Contains(err.Error(), "jsonforms") {
+		created, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
+		if dup, ok := duplicateOf(err); ok {
+			requestID = dup
+		} else if err != nil {
+			if isBadAskError(err) {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, "failed to create request", http.StatusInternalServerError)
 			return
+		} else {
+			s.startAsk(requestID, created)
+		}
+		if ar.Delivery = cmp.Or(created.Ask.Delivery, ar.Delivery); ar.detached() {
+			s.writeAskAccepted(ctx, w, requestID, ar.Delivery, created.InteractionURL)
+			return
 		}
-
-		go s.sendNotification(context.Background(), requestID, ar2, interactionURL)
-		go s.expireLoop(context.Background(), requestID, expiresAt)
 
 		tev, err := s.waitTerminalEvent(ctx, requestID)
 		if err != nil {
+			if errors.Is(err, errServerStopping) {
+				writeStopping(w, requestID)
+				return
+			}
 			if ctx.Err() != nil {
 				return
 			}
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		s.writeAskWaitResponse(w, requestID, tev)
+		s.writeAskWaitResponse(ctx, w, requestID, tev)
 		return
 	}
 
@@ -975,7 +2403,7 @@ func (s *server) handleAskJSON(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			if tev, ok := s.hub.getTerminal(requestID); ok {
-				s.writeAskWaitResponse(w, requestID, tev)
+				s.writeAskWaitResponse(ctx, w, requestID, tev)
 				return
 			}
 			ar, err := parseAskRequestFromHTTP(r)
@@ -984,43 +2412,63 @@ func (s *server) handleAskJSON(w http.ResponseWriter, r *http.Request) {
 					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 					return
 				}
+				if isBadAskError(err) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 				http.Error(w, "bad request", http.StatusBadRequest)
 				return
 			}
-			ar2, expiresAt, interactionURL, _, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
-			if err != nil {
-				if strings.Contains(err.Error(), "jsonforms") {
+			created, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
+			if dup, ok := duplicateOf(err); ok {
+				requestID = dup
+			} else if err != nil {
+				if isBadAskError(err) {
 					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
 				http.Error(w, "failed to create request", http.StatusInternalServerError)
 				return
+			} else {
+				s.startAsk(requestID, created)
+			}
+			if ar.Delivery = cmp.Or(created.Ask.Delivery, ar.Delivery); ar.detached() {
+				s.writeAskAccepted(ctx, w, requestID, ar.Delivery, created.InteractionURL)
+				return
 			}
-			go s.sendNotification(context.Background(), requestID, ar2, interactionURL)
-			go s.expireLoop(context.Background(), requestID, expiresAt)
 
 			tev, err := s.waitTerminalEvent(ctx, requestID)
 			if err != nil {
+				if errors.Is(err, errServerStopping) {
+					writeStopping(w, requestID)
+					return
+				}
 				if ctx.Err() != nil {
 					return
 				}
 				http.Error(w, "internal error", http.StatusInternalServerError)
 				return
 			}
-			s.writeAskWaitResponse(w, requestID, tev)
+			s.writeAskWaitResponse(ctx, w, requestID, tev)
 			return
 		}
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	if status == "submitted" || status == "expired" || status == "notify_failed" {
+	// A retried fire-and-forget ask does not wait either.
+	if ar, err := parseAskRequestFromHTTP(r); err == nil && ar.detached() {
+		s.writeAskAccepted(ctx, w, requestID, ar.Delivery, "")
+		return
+	}
+
+	if isTerminalStatus(status) {
 		if tev, ok := s.hub.getTerminal(requestID); ok {
-			s.writeAskWaitResponse(w, requestID, tev)
+			s.writeAskWaitResponse(ctx, w, requestID, tev)
 			return
 		}
 		if tev, ok, err := s.getTerminalEventFromDB(ctx, requestID); err == nil && ok {
-			s.writeAskWaitResponse(w, requestID, tev)
+			s.writeAskWaitResponse(ctx, w, requestID, tev)
 			return
 		}
 		http.Error(w, "not found", http.StatusNotFound)
@@ -1029,13 +2477,17 @@ func (s *server) handleAskJSON(w http.ResponseWriter, r *http.Request) {
 
 	tev, err := s.waitTerminalEvent(ctx, requestID)
 	if err != nil {
+		if errors.Is(err, errServerStopping) {
+			writeStopping(w, requestID)
+			return
+		}
 		if ctx.Err() != nil {
 			return
 		}
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	s.writeAskWaitResponse(w, requestID, tev)
+	s.writeAskWaitResponse(ctx, w, requestID, tev)
 }
 
 func (s *server) handleAskSSE(w http.ResponseWriter, r *http.Request) {
@@ -1046,6 +2498,10 @@ func (s *server) handleAskSSE(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request_id", http.StatusBadRequest)
 		return
 	}
+	if ok, err := s.visible(ctx, requestID); requestID != "" && (err != nil || !ok) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
 
 	if requestID == "" {
 		requestID = genID("req_")
@@ -1055,9 +2511,17 @@ func (s *server) handleAskSSE(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 				return
 			}
+			if isBadAskError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		if ar.detached() {
+			http.Error(w, "delivery "+ar.Delivery+" cannot be combined with stream=true", http.StatusBadRequest)
+			return
+		}
 
 		sseInit(w)
 		w.Header().Set("X-Ask4Me-Request-Id", requestID)
@@ -1066,20 +2530,21 @@ func (s *server) handleAskSSE(w http.ResponseWriter, r *http.Request) {
 			fl.Flush()
 		}
 
-		ar2, expiresAt, interactionURL, firstEventID, err := s.createAskWithRequestID(ctx, requestID, ar, w)
-		if err != nil {
-			if strings.Contains(err.Error(), "jsonforms") {
+		created, err := s.createAskWithRequestID(ctx, requestID, ar, w)
+		if dup, ok := duplicateOf(err); ok {
+			requestID = dup
+		} else if err != nil {
+			if isBadAskError(err) {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, "failed to create request", http.StatusInternalServerError)
 			return
+		} else {
+			s.startAsk(requestID, created)
 		}
 
-		go s.sendNotification(context.Background(), requestID, ar2, interactionURL)
-		go s.expireLoop(context.Background(), requestID, expiresAt)
-
-		s.streamUntilDone(ctx, w, requestID, firstEventID)
+		s.streamUntilDone(ctx, w, requestID, created.FirstEventID)
 		return
 	}
 
@@ -1104,34 +2569,45 @@ func (s *server) handleAskSSE(w http.ResponseWriter, r *http.Request) {
 					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 					return
 				}
+				if isBadAskError(err) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 				http.Error(w, "bad request", http.StatusBadRequest)
 				return
 			}
-			ar2, expiresAt, interactionURL, firstEventID, err := s.createAskWithRequestID(ctx, requestID, ar, w)
-			if err != nil {
-				if strings.Contains(err.Error(), "jsonforms") {
+			if ar.detached() {
+				http.Error(w, "delivery "+ar.Delivery+" cannot be combined with stream=true", http.StatusBadRequest)
+				return
+			}
+			created, err := s.createAskWithRequestID(ctx, requestID, ar, w)
+			if dup, ok := duplicateOf(err); ok {
+				requestID = dup
+			} else if err != nil {
+				if isBadAskError(err) {
 					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
 				http.Error(w, "failed to create request", http.StatusInternalServerError)
 				return
+			} else {
+				s.startAsk(requestID, created)
 			}
-			go s.sendNotification(context.Background(), requestID, ar2, interactionURL)
-			go s.expireLoop(context.Background(), requestID, expiresAt)
 
-			s.streamUntilDone(ctx, w, requestID, firstEventID)
+			s.streamUntilDone(ctx, w, requestID, created.FirstEventID)
 			return
 		}
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	s.replayEvents(ctx, w, requestID, lastEventID)
-	if status == "submitted" || status == "expired" {
+	if isTerminalStatus(status) {
+		s.replayEvents(ctx, w, requestID, lastEventID)
 		s.sendDone(w)
 		return
 	}
 
+	// streamUntilDone replays what came after lastEventID itself.
 	s.streamUntilDone(ctx, w, requestID, lastEventID)
 }
 
@@ -1144,7 +2620,7 @@ func sseInit(w http.ResponseWriter) {
 }
 
 func (s *server) makeInteractionURL(requestID, tokenPlain string) string {
-	base := strings.TrimRight(s.cfg.BaseURL, "/")
+	base := s.cfg().pageBaseURL()
 	return fmt.Sprintf("%s/r/%s/?k=%s", base, url.PathEscape(requestID), url.QueryEscape(tokenPlain))
 }
 
@@ -1168,7 +2644,9 @@ func (s *server) persistAndSendEvent(ctx context.Context, w http.ResponseWriter,
 	if err := s.db.insertEvent(ctx, ev.RequestID, ev.ID, ev.Type, payload); err != nil {
 		return err
 	}
+	logEvent(ev)
 	s.hub.publish(ev)
+	s.dispatchWebhooks(ctx, ev)
 	return s.sendEvent(w, ev)
 }
 
@@ -1204,44 +2682,66 @@ func (s *server) sendDone(w http.ResponseWriter) {
 }
 
 func (s *server) replayEvents(ctx context.Context, w http.ResponseWriter, requestID, afterEventID string) {
-	evs, err := s.db.listEvents(ctx, requestID, afterEventID)
+	evs, err := s.db.listEvents(ctx, requestID, eventFilter{After: afterEventID})
 	if err != nil {
 		return
 	}
 	for _, ev := range evs {
-		ev.Time = time.Now().UTC().Format(time.RFC3339)
 		_ = s.sendEvent(w, ev)
 	}
 }
 
 func (s *server) streamUntilDone(ctx context.Context, w http.ResponseWriter, requestID, lastEventID string) {
-	ch, unsub := s.hub.subscribe(requestID)
+	terminal := s.terminalEventTypes(ctx, requestID)
+	interval, buffer := s.streamTuning(ctx, requestID)
+	ch, unsub := s.hub.subscribeSize(requestID, buffer)
 	defer unsub()
 
 	seen := map[string]struct{}{}
 	if strings.TrimSpace(lastEventID) != "" {
 		seen[lastEventID] = struct{}{}
 	}
-	evs, err := s.db.listEvents(ctx, requestID, lastEventID)
-	if err == nil && len(evs) > 0 {
+	// catchUp sends the stored events after lastEventID that were not sent
+	// yet, and reports whether one of them ended the request.
+	catchUp := func() bool {
+		evs, err := s.db.listEvents(ctx, requestID, eventFilter{After: lastEventID})
+		if err != nil {
+			return false
+		}
 		for _, ev := range evs {
-			seen[ev.ID] = struct{}{}
 			lastEventID = ev.ID
+			if _, ok := seen[ev.ID]; ok {
+				continue
+			}
+			seen[ev.ID] = struct{}{}
 			_ = s.sendEvent(w, ev)
-			if s.isTerminalEventType(ev.Type) {
+			if isTerminalEventType(terminal, ev.Type) {
 				s.sendDone(w)
-				return
+				return true
 			}
 		}
+		return false
+	}
+	if catchUp() {
+		return
 	}
 
-	hb := time.NewTicker(time.Duration(s.cfg.SSEHeartbeatIntervalSeconds) * time.Second)
+	hb := time.NewTicker(interval)
 	defer hb.Stop()
+	poll, stopPoll := s.hubPoll()
+	defer stopPoll()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-s.shutdown.stopping:
+			sendRestarting(w)
+			return
+		case <-poll:
+			if catchUp() {
+				return
+			}
 		case <-hb.C:
 			ev := Event{
 				ID:        "",
@@ -1255,6 +2755,14 @@ func (s *server) streamUntilDone(ctx context.Context, w http.ResponseWriter, req
 			if !ok {
 				return
 			}
+			if ev.Type == "events.dropped" {
+				// Events dropped for this stream are sent again from the
+				// database.
+				if s.sendEvent(w, ev) != nil || catchUp() {
+					return
+				}
+				continue
+			}
 			if ev.ID != "" {
 				if _, ok := seen[ev.ID]; ok {
 					continue
@@ -1268,7 +2776,7 @@ func (s *server) streamUntilDone(ctx context.Context, w http.ResponseWriter, req
 				return
 			}
 			lastEventID = ev.ID
-			if s.isTerminalEventType(ev.Type) {
+			if isTerminalEventType(terminal, ev.Type) {
 				s.sendDone(w)
 				return
 			}
@@ -1301,13 +2809,100 @@ func formatShellCommand(bin string, args []string) string {
 	return strings.Join(parts, " ")
 }
 
-func (s *server) sendNotification(ctx context.Context, requestID string, ar askRequest, interactionURL string) {
+// notifyTarget is the set of channels one notification is delivered to.
+type notifyTarget struct {
+	ServerChanSendKey string   `json:"serverchan_sendkey,omitempty"`
+	AppriseURLs       []string `json:"apprise_urls,omitempty"`
+	// WebPush also notifies the browsers subscribed at /subscribe.
+	WebPush bool `json:"web_push,omitempty"`
+}
+
+func (s *server) defaultNotifyTarget() notifyTarget {
+	return notifyTarget{
+		ServerChanSendKey: s.cfg().ServerChanSendKey,
+		AppriseURLs:       s.cfg().AppriseURLs,
+		WebPush:           true,
+	}
+}
+
+// notifyError is returned by deliverNotification; fields are recorded as the
+// notify.failed event payload.
+type notifyError struct {
+	fields map[string]any
+}
+
+func (e *notifyError) Error() string {
+	return fmt.Sprint(e.fields["error"])
+}
+
+func notifyErrorFields(err error) map[string]any {
+	var ne *notifyError
+	if errors.As(err, &ne) {
+		return ne.fields
+	}
+	return map[string]any{"error": err.Error()}
+}
+
+func (s *server) sendNotification(ctx context.Context, requestID string, ar askRequest, interactionURL string) error {
+	fields, err := s.deliverNotification(ctx, s.notifyTargetFor(ar), ar, interactionURL)
+	if err != nil {
+		return err
+	}
+	if ar.To != "" {
+		fields["responder"] = string(ar.To)
+	}
+	ev := s.mustNewEvent(ctx, requestID, "notify.sent", fields)
+	_ = s.persistTerminalAware(ctx, ev)
+	_ = s.db.updateRequestStatus(ctx, requestID, "delivered")
+	return nil
+}
+
+func (s *server) failNotify(ctx context.Context, requestID string, fields map[string]any) {
+	ev := s.mustNewEvent(ctx, requestID, "notify.failed", fields)
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+	_ = s.db.updateRequestStatus(ctx, requestID, "notify_failed")
+}
+
+// deliverNotification pushes one interaction link to target and returns the
+// notify.sent payload. Both it and the error fields carry latency_ms.
+func (s *server) deliverNotification(ctx context.Context, target notifyTarget, ar askRequest, interactionURL string) (map[string]any, error) {
+	start := time.Now()
+	timeout := s.notifyTimeout(ar)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var fields map[string]any
+	var err error
+	if target.WebPush && strings.TrimSpace(target.ServerChanSendKey) == "" && len(target.AppriseURLs) == 0 && s.hasWebPush(ctx) {
+		fields, err = s.webPushOnly(ctx, ar, interactionURL)
+	} else {
+		fields, err = s.pushNotification(ctx, target, ar, interactionURL)
+		if target.WebPush {
+			s.alsoWebPush(ctx, ar, interactionURL, fields, err)
+		}
+	}
+	latency := time.Since(start).Milliseconds()
+	if err != nil {
+		err = timedOut(ctx, err, timeout)
+		var ne *notifyError
+		if errors.As(err, &ne) {
+			ne.fields["latency_ms"] = latency
+		}
+		return nil, err
+	}
+	fields["latency_ms"] = latency
+	return fields, nil
+}
+
+// pushNotification makes the push itself. ServerChan is preferred when a
+// sendkey is set; otherwise apprise is exec'd.
+func (s *server) pushNotification(ctx context.Context, target notifyTarget, ar askRequest, interactionURL string) (map[string]any, error) {
 	msg := strings.TrimSpace(ar.Body)
 	if msg == "" {
 		msg = "Please respond."
 	}
 
-	sendkey := strings.TrimSpace(s.cfg.ServerChanSendKey)
+	sendkey := strings.TrimSpace(target.ServerChanSendKey)
 	if sendkey != "" {
 		if ar.ServerChanActionLinks {
 			spec := parseMCD(ar.MCD)
@@ -1332,88 +2927,81 @@ func (s *server) sendNotification(ctx context.Context, requestID string, ar askR
 			msg = msg + "\n\n" + fmt.Sprintf("[%s](<%s>)", interactionURL, interactionURL)
 		}
 
-		resp, err := serverchan_sdk.ScSend(sendkey, ar.Title, msg, &serverchan_sdk.ScSendOptions{
+		release, err := s.notify.acquire(ctx, "serverchan")
+		if err != nil {
+			return nil, err
+		}
+		resp, err := scSend(ctx, sendkey, ar.Title, msg, &serverchan_sdk.ScSendOptions{
 			Tags: "ask4me",
 		})
+		release()
 		if err != nil {
-			ev := s.mustNewEvent(ctx, requestID, "notify.failed", map[string]any{
+			return nil, &notifyError{fields: map[string]any{
 				"channel": "serverchan",
 				"error":   err.Error(),
-			})
-			_ = s.persistTerminalAware(ctx, ev)
-			s.hub.setTerminal(ev)
-			_ = s.db.updateRequestStatus(ctx, requestID, "notify_failed")
-			return
+			}}
 		}
 		if resp != nil && resp.Code != 0 {
 			output, _ := json.Marshal(resp)
-			ev := s.mustNewEvent(ctx, requestID, "notify.failed", map[string]any{
+			return nil, &notifyError{fields: map[string]any{
 				"channel": "serverchan",
 				"error":   fmt.Sprintf("serverchan code %d: %s", resp.Code, resp.Message),
 				"output":  truncate(string(output), 2000),
-			})
-			_ = s.persistTerminalAware(ctx, ev)
-			s.hub.setTerminal(ev)
-			_ = s.db.updateRequestStatus(ctx, requestID, "notify_failed")
-			return
+			}}
 		}
-
-		ev := s.mustNewEvent(ctx, requestID, "notify.sent", map[string]any{
+		return map[string]any{
 			"channel": "serverchan",
-		})
-		_ = s.persistTerminalAware(ctx, ev)
-		_ = s.db.updateRequestStatus(ctx, requestID, "delivered")
-		return
+		}, nil
 	}
 
 	if interactionURL != "" {
 		msg = msg + "\n\n" + fmt.Sprintf("[%s](<%s>)", interactionURL, interactionURL)
 	}
 
-	if len(s.cfg.AppriseURLs) == 0 {
-		ev := s.mustNewEvent(ctx, requestID, "notify.failed", map[string]any{
+	if len(target.AppriseURLs) == 0 {
+		return nil, &notifyError{fields: map[string]any{
 			"error": "no serverchan_sendkey or apprise_urls configured",
-		})
-		_ = s.persistTerminalAware(ctx, ev)
-		s.hub.setTerminal(ev)
-		_ = s.db.updateRequestStatus(ctx, requestID, "notify_failed")
-		return
+		}}
 	}
 
 	args := []string{"-vv", "--title", ar.Title, "--body", msg}
-	for _, u := range s.cfg.AppriseURLs {
-		v := normalizeAppriseURL(u)
+	reply := s.emailReplyFor(ar, interactionURL)
+	for _, u := range target.AppriseURLs {
+		v := withEmailReply(s.withPriorityFlag(normalizeAppriseURL(u), ar.Priority), reply)
 		if v != "" {
 			args = append(args, v)
 		}
 	}
-	cmdlineSh := formatShellCommand(s.cfg.AppriseBin, args)
+	loggedArgs := s.db.withBodyRefs(args, strings.TrimSpace(ar.Body))
+	cmdlineSh := formatShellCommand(s.cfg().AppriseBin, loggedArgs)
 
-	cmd := exec.CommandContext(ctx, s.cfg.AppriseBin, args...)
+	release, err := s.notify.acquire(ctx, "apprise")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, s.cfg().AppriseBin, args...)
+	// Children of a killed apprise may hold the output pipe open; do not
+	// wait for them past the timeout.
+	cmd.WaitDelay = time.Second
 	out, err := cmd.CombinedOutput()
+	release()
 	if err != nil {
-		ev := s.mustNewEvent(ctx, requestID, "notify.failed", map[string]any{
+		return nil, &notifyError{fields: map[string]any{
 			"channel":      "apprise",
 			"error":        err.Error(),
 			"command":      cmdlineSh,
 			"command_sh":   cmdlineSh,
-			"command_args": args,
+			"command_args": loggedArgs,
 			"output":       truncate(string(out), 2000),
-		})
-		_ = s.persistTerminalAware(ctx, ev)
-		s.hub.setTerminal(ev)
-		_ = s.db.updateRequestStatus(ctx, requestID, "notify_failed")
-		return
+		}}
 	}
 
-	ev := s.mustNewEvent(ctx, requestID, "notify.sent", map[string]any{
+	return map[string]any{
 		"channel":      "apprise",
 		"command":      cmdlineSh,
 		"command_sh":   cmdlineSh,
-		"command_args": args,
-	})
-	_ = s.persistTerminalAware(ctx, ev)
-	_ = s.db.updateRequestStatus(ctx, requestID, "delivered")
+		"command_args": loggedArgs,
+	}, nil
 }
 
 func makeServerChanActionLink(interactionURL, actionValue string) (string, bool) {
@@ -1466,7 +3054,9 @@ func (s *server) persistTerminalAware(ctx context.Context, ev Event) error {
 	if err := s.db.insertEvent(ctx, ev.RequestID, ev.ID, ev.Type, payload); err != nil {
 		return err
 	}
+	logEvent(ev)
 	s.hub.publish(ev)
+	s.dispatchWebhooks(ctx, ev)
 	return nil
 }
 
@@ -1478,21 +3068,60 @@ func truncate(s string, n int) string {
 }
 
 func (s *server) expireLoop(ctx context.Context, requestID string, expiresAt time.Time) {
-	timer := time.NewTimer(time.Until(expiresAt))
-	defer timer.Stop()
-	select {
-	case <-ctx.Done():
+	for {
+		timer := time.NewTimer(time.Until(expiresAt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// The responder may have asked for more time; see extend.go.
+		_, at, err := s.db.getRequestStatus(ctx, requestID)
+		if err != nil || at <= expiresAt.Unix() {
+			break
+		}
+		expiresAt = time.Unix(at, 0)
+	}
+	if d := s.graceLeft(ctx, requestID, expiresAt); d > 0 {
+		// The page was open: wait for a late answer; see grace.go.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+	has, err := s.db.hasAnswer(ctx, requestID)
+	if err != nil || has {
 		return
-	case <-timer.C:
-		has, err := s.db.hasAnswer(ctx, requestID)
-		if err != nil || has {
+	}
+	if status, _, err := s.db.getRequestStatus(ctx, requestID); err != nil || isTerminalStatus(status) {
+		return
+	}
+	// A scheduled ask that expires before delivery is never sent.
+	_, _ = s.db.deleteScheduled(ctx, requestID)
+	if s.answerByDefault(ctx, requestID) {
+		return
+	}
+	if mode, need, err := s.db.getRespondersMode(ctx, requestID); err == nil && isMultiAnswerMode(mode) {
+		if responses, err := s.db.listResponses(ctx, requestID); err == nil && len(responses) > 0 {
+			var extra map[string]any
+			if mode == respondersModeQuorum {
+				if policy, err := s.db.getApprovalPolicy(ctx, requestID); err == nil {
+					total, _ := s.db.countResponders(ctx, requestID)
+					extra = policy.summary("expired", responses, total)
+				}
+			}
+			s.completeCollect(ctx, requestID, responses, need, false, extra)
 			return
 		}
-		_ = s.db.updateRequestStatus(ctx, requestID, "expired")
-		ev := s.mustNewEvent(ctx, requestID, "request.expired", map[string]any{})
-		_ = s.persistTerminalAware(ctx, ev)
-		s.hub.setTerminal(ev)
 	}
+	if ok, err := s.db.expireUnanswered(ctx, requestID); err != nil || !ok {
+		return
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.expired", map[string]any{})
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
 }
 
 func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
@@ -1509,21 +3138,96 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tokenHash := sha256Hex(tokenPlain)
-	ok, err := s.db.verifyToken(r.Context(), requestID, tokenHash)
-	if err != nil || !ok {
+	// An expired link still opens its page, which then shows the recap.
+	ok, expired, err := s.db.verifyToken(r.Context(), requestID, tokenHash)
+	// An open page may still answer for a while after expiry; see grace.go.
+	late := ok && expired && s.lateAnswerAllowed(r.Context(), requestID)
+	if err != nil || !ok || (expired && !late && (r.Method != http.MethodGet || len(parts) == 2 && parts[1] != "")) {
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
+	sub := ""
+	if len(parts) == 2 {
+		sub = parts[1]
+	}
+	// The QR code only shows the link itself, so fetching it (say, from the
+	// screen that displays it) neither uses up the link nor needs the PIN.
+	if sub == "qr.png" {
+		s.handleUserQR(w, r, requestID, tokenPlain)
+		return
+	}
+	if !s.checkLinkUse(w, r, requestID, tokenHash) {
+		return
+	}
+	setPageSecurityHeaders(w)
+	if r.Method == http.MethodPost {
+		if !s.sameOrigin(r) {
+			http.Error(w, "cross-site request", http.StatusForbidden)
+			return
+		}
+		// submit may be multipart and checks after parsing the form itself.
+		if sub != "submit" {
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "bad form", http.StatusBadRequest)
+				return
+			}
+			if !validCSRF(r, requestID, tokenHash) {
+				http.Error(w, "invalid csrf token, reload the page", http.StatusForbidden)
+				return
+			}
+		}
+	}
+	if !s.checkChallenge(w, r, requestID, tokenPlain, tokenHash, sub) {
+		return
+	}
 
 	status, expiresAtUnix, err := s.db.getRequestStatus(r.Context(), requestID)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
-	if time.Now().Unix() > expiresAtUnix {
+	if (time.Now().Unix() > expiresAtUnix || status == "cancelled") && r.Method == http.MethodGet && sub == "" {
+		s.handleClosedPage(w, r, requestID, tokenHash, status, expiresAtUnix)
+		return
+	}
+	if time.Now().Unix() > expiresAtUnix && !late {
 		http.Error(w, "expired", http.StatusGone)
 		return
 	}
+	switch status {
+	case "cancelled":
+		http.Error(w, "cancelled", http.StatusGone)
+		return
+	case "scheduled":
+		http.Error(w, "not available yet", http.StatusTooEarly)
+		return
+	}
+	respondersMode, _, err := s.db.getRespondersMode(r.Context(), requestID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	responder, err := s.db.getTokenResponder(r.Context(), requestID, tokenHash)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// In collect mode each responder is done once they answered, even though
+	// the request itself stays open for the others.
+	responderDone := false
+	if isMultiAnswerMode(respondersMode) && responder != "" {
+		responderDone, _ = s.db.hasResponse(r.Context(), requestID, responder)
+	}
+	// A forwarded link only shows who the request went to.
+	delegatedTo, err := s.db.getTokenDelegate(r.Context(), requestID, tokenHash)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if delegatedTo != "" && len(parts) == 2 && parts[1] != "" && parts[1] != "stream" {
+		http.Error(w, "forwarded to "+delegatedTo, http.StatusConflict)
+		return
+	}
 
 	if len(parts) == 2 && parts[1] == "spec" {
 		if r.Method != http.MethodGet {
@@ -1559,6 +3263,9 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 		if dataJSON.Valid && strings.TrimSpace(dataJSON.String) != "" {
 			resp.Data = json.RawMessage(dataJSON.String)
 		}
+		if d, ok, err := s.db.getDraft(r.Context(), requestID, tokenHash); err == nil && ok && d.PayloadJSON.Valid {
+			resp.Data = json.RawMessage(d.PayloadJSON.String)
+		}
 		if submitLabel.Valid {
 			resp.SubmitLabel = submitLabel.String
 		}
@@ -1571,13 +3278,58 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) == 2 && parts[1] == "draft" {
+		s.handleUserDraft(w, r, requestID, tokenPlain, tokenHash, status)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "stream" {
+		s.handleUserStream(w, r, requestID, status, responder, isMultiAnswerMode(respondersMode))
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "forward" {
+		s.handleUserForward(w, r, requestID, tokenPlain, tokenHash, status, responder, expiresAtUnix)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "ack" {
+		s.handleUserAck(w, r, requestID, tokenPlain, status, responder)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "edit" {
+		s.handleUserEdit(w, r, requestID, tokenPlain, status, responder)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "extend" {
+		s.handleUserExtend(w, r, requestID, tokenPlain, responder)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "transcribe" {
+		s.handleUserTranscribe(w, r, requestID, status)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "beacon" {
+		s.handleUserBeacon(w, r, requestID, status, responder)
+		return
+	}
+
+	if len(parts) == 2 && strings.HasPrefix(parts[1], "attachments/") {
+		s.handleUserAttachment(w, r, requestID, strings.TrimPrefix(parts[1], "attachments/"))
+		return
+	}
+
 	if len(parts) == 2 && parts[1] == "submit" {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		callbackMode := parseBoolQuery(r.URL.Query().Get("callback"))
-		if status == "submitted" || status == "expired" {
+		if status == "submitted" || status == "expired" || responderDone {
 			if callbackMode {
 				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 				if status == "expired" {
@@ -1592,14 +3344,22 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
 			return
 		}
-		if err := r.ParseForm(); err != nil {
-			if callbackMode {
-				http.Error(w, "bad form", http.StatusBadRequest)
+		if err := s.parseSubmitForm(w, r); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, errAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
 				return
 			}
 			http.Error(w, "bad form", http.StatusBadRequest)
 			return
 		}
+		if r.MultipartForm != nil {
+			defer r.MultipartForm.RemoveAll()
+		}
+		if !callbackMode && !validCSRF(r, requestID, tokenHash) {
+			http.Error(w, "invalid csrf token, reload the page", http.StatusForbidden)
+			return
+		}
 		action := strings.TrimSpace(r.FormValue("action"))
 		text := strings.TrimSpace(r.FormValue("text"))
 		payloadJSON := strings.TrimSpace(r.FormValue("payload_json"))
@@ -1610,16 +3370,144 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-		if action == "" && text == "" && payloadJSON == "" {
+		files := uploadedFiles(r)
+		if action == "" && text == "" && payloadJSON == "" && len(files) == 0 {
 			http.Error(w, "empty submission", http.StatusBadRequest)
 			return
 		}
+		if len(files) > 0 {
+			if allowed, _ := s.db.getAllowUploads(r.Context(), requestID); !allowed || s.blobs == nil {
+				http.Error(w, "uploads are not allowed for this request", http.StatusBadRequest)
+				return
+			}
+		}
 		var payloadToStore sql.NullString
 		if payloadJSON != "" {
 			payloadToStore = sql.NullString{String: payloadJSON, Valid: true}
 		}
-		if err := s.db.insertAnswer(r.Context(), requestID, action, text, payloadToStore); err != nil {
-			if strings.Contains(strings.ToLower(err.Error()), "unique") {
+		responderName, named := s.responderName(r, requestID, responder)
+		if !named {
+			if callbackMode {
+				http.Error(w, errResponderNameRequired, http.StatusBadRequest)
+				return
+			}
+			_ = s.db.saveDraft(r.Context(), requestID, tokenHash, text, payloadToStore)
+			http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain)+"&rejected="+url.QueryEscape(errResponderNameRequired), http.StatusSeeOther)
+			return
+		}
+		hook := s.checkAnswer(r.Context(), answerHookInput{
+			RequestID: requestID,
+			Action:    action,
+			Text:      text,
+			Payload:   payload,
+			Responder: responder,
+			Via:       "page",
+		})
+		if hook.Reject != "" {
+			if callbackMode {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = io.WriteString(w, hook.Reject)
+				return
+			}
+			// Keep what was typed for the page that shows the message.
+			_ = s.db.saveDraft(r.Context(), requestID, tokenHash, text, payloadToStore)
+			http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain)+"&rejected="+url.QueryEscape(truncate(hook.Reject, 500)), http.StatusSeeOther)
+			return
+		}
+		data := map[string]any{
+			"action": action,
+			"text":   text,
+		}
+		if payloadJSON != "" {
+			data["payload"] = payload
+		}
+		if responder != "" {
+			data["responder"] = responder
+		}
+		if responderName != "" {
+			data["responder_name"] = responderName
+		}
+		if late {
+			data["late"] = true
+		}
+		if hook.Data != nil {
+			data["hook"] = hook.Data
+		}
+		var uploads []attachment
+		if len(files) > 0 {
+			uploads, err = s.storeAnswerUploads(r.Context(), requestID, responder, files)
+			if err != nil {
+				if errors.Is(err, errAttachmentTooLarge) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				slog.Error("attachments: answer upload", "request_id", requestID, "error", err)
+				http.Error(w, "failed", http.StatusInternalServerError)
+				return
+			}
+			data["attachments"] = attachmentViews(uploads, s.cfg().BaseURL)
+		}
+		steps, currentStep, err := s.db.getSteps(r.Context(), requestID)
+		if err != nil {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		if len(steps) > 0 {
+			combined, final, ok, err := s.submitStep(r.Context(), requestID, steps, currentStep, r.FormValue("step"), action, text, payloadToStore, payload)
+			if err != nil && !ok {
+				http.Error(w, "failed", http.StatusInternalServerError)
+				return
+			}
+			if !ok || !final {
+				if callbackMode {
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					if !ok {
+						w.WriteHeader(http.StatusConflict)
+						_, _ = io.WriteString(w, "Step already submitted.")
+						return
+					}
+					_, _ = io.WriteString(w, fmt.Sprintf("Step %d of %d submitted.", currentStep+1, len(steps)))
+					return
+				}
+				http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+				return
+			}
+			data = combined
+			if responderName != "" {
+				data["responder_name"] = responderName
+			}
+			if late {
+				data["late"] = true
+			}
+			if hook.Data != nil {
+				data["hook"] = hook.Data
+			}
+			stepsAnswered, _ := json.Marshal(combined["steps"])
+			payloadToStore = sql.NullString{String: string(stepsAnswered), Valid: true}
+		}
+		if isMultiAnswerMode(respondersMode) {
+			accepted, err := s.submitCollect(r.Context(), requestID, responder, action, text, payloadToStore, data)
+			if err != nil && !accepted {
+				http.Error(w, "failed", http.StatusInternalServerError)
+				return
+			}
+			if !accepted {
+				s.discardAttachments(r.Context(), uploads)
+				if callbackMode {
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					w.WriteHeader(http.StatusConflict)
+					_, _ = io.WriteString(w, "Already submitted.")
+					return
+				}
+				http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+				return
+			}
+			_ = s.db.markTokenUsed(r.Context(), requestID, tokenHash)
+			_ = s.db.deleteDraft(r.Context(), requestID, tokenHash)
+		} else if err := s.db.insertAnswer(r.Context(), requestID, responder, action, text, payloadToStore); err != nil {
+			s.discardAttachments(r.Context(), uploads)
+			if isUniqueViolation(err) {
 				if callbackMode {
 					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 					w.WriteHeader(http.StatusConflict)
@@ -1631,19 +3519,23 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 			}
 			http.Error(w, "failed", http.StatusInternalServerError)
 			return
+		} else if won, err := s.db.markSubmitted(r.Context(), requestID); err != nil || !won {
+			// The request expired or was cancelled while the answer was
+			// being saved.
+			_ = s.db.deleteAnswer(r.Context(), requestID)
+			s.discardAttachments(r.Context(), uploads)
+			http.Error(w, "expired", http.StatusGone)
+			return
+		} else {
+			if responderName != "" {
+				_ = s.db.setResponderName(r.Context(), requestID, responderName)
+			}
+			_ = s.db.markTokenUsed(r.Context(), requestID, tokenHash)
+			_ = s.db.deleteDrafts(r.Context(), requestID)
+			ev := s.mustNewEvent(r.Context(), requestID, "user.submitted", data)
+			_ = s.persistTerminalAware(r.Context(), ev)
+			s.setTerminal(ev)
 		}
-		_ = s.db.markTokenUsed(r.Context(), requestID, tokenHash)
-		_ = s.db.updateRequestStatus(r.Context(), requestID, "submitted")
-		data := map[string]any{
-			"action": action,
-			"text":   text,
-		}
-		if payloadJSON != "" {
-			data["payload"] = payload
-		}
-		ev := s.mustNewEvent(r.Context(), requestID, "user.submitted", data)
-		_ = s.persistTerminalAware(r.Context(), ev)
-		s.hub.setTerminal(ev)
 		if callbackMode {
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
@@ -1658,6 +3550,12 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 			_, _ = io.WriteString(w, "Submitted.")
 			return
 		}
+		if !isMultiAnswerMode(respondersMode) {
+			if next, ok := s.followUpURL(r.Context(), requestID); ok {
+				http.Redirect(w, r, next, http.StatusSeeOther)
+				return
+			}
+		}
 		http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
 		return
 	}
@@ -1668,40 +3566,100 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var title, body, mcd string
-	var schemaJSON sql.NullString
+	var schemaJSON, bodyEncoding, bodyData sql.NullString
 	err = s.db.db.QueryRowContext(
 		r.Context(),
-		`SELECT title, body, mcd, jsonforms_schema_json FROM requests WHERE request_id=?`,
+		`SELECT r.title, r.body, r.mcd, r.jsonforms_schema_json, b.encoding, b.data FROM requests r`+bodyJoin+` WHERE r.request_id=?`,
 		requestID,
-	).Scan(&title, &body, &mcd, &schemaJSON)
+	).Scan(&title, &body, &mcd, &schemaJSON, &bodyEncoding, &bodyData)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	body = bodyText(body, bodyEncoding, bodyData)
 	useJSONForms := schemaJSON.Valid && strings.TrimSpace(schemaJSON.String) != ""
+	steps, currentStep, _ := s.db.getSteps(r.Context(), requestID)
+	if len(steps) > 0 && currentStep < len(steps) {
+		st := steps[currentStep]
+		mcd = st.MCD
+		if st.Title != "" {
+			title = st.Title
+		}
+		if st.Body != "" {
+			body = st.Body
+		}
+	}
 	var spec mcdSpec
 	if !useJSONForms {
 		spec = parseMCD(mcd)
 	}
-	done := status == "submitted" || status == "expired"
+	done := status == "submitted" || status == "expired" || responderDone || delegatedTo != ""
 
-	if status != "submitted" && status != "expired" {
-		ev := s.mustNewEvent(r.Context(), requestID, "user.page_loaded", map[string]any{})
+	if status != "submitted" && status != "expired" && delegatedTo == "" {
+		ev := s.mustNewEvent(r.Context(), requestID, "user.page_loaded", receiptData(r, responder))
 		_ = s.persistTerminalAware(r.Context(), ev)
 	}
 
+	cfg := s.cfg()
 	data := htmlData{
-		Title:     title,
-		Body:      body,
-		Buttons:   spec.Buttons,
-		Input:     spec.Input,
-		Done:      done,
-		Token:     tokenPlain,
-		RequestID: requestID,
-		JsonForms: useJSONForms,
+		Title:      title,
+		Body:       body,
+		Buttons:    spec.Buttons,
+		Input:      spec.Input,
+		Done:       done,
+		Token:      tokenPlain,
+		RequestID:  requestID,
+		JsonForms:  useJSONForms,
+		DraftSaved: parseBoolQuery(r.URL.Query().Get("draft_saved")),
+		Rejected:   r.URL.Query().Get("rejected"),
+		Step:       currentStep,
+		StepCount:  len(steps),
+
+		ForwardedTo: delegatedTo,
+		Thread:      s.pageThread(r.Context(), requestID),
+		CSRF:        s.csrfToken(w, r, requestID, tokenHash),
+		Brand:       cfg.brand(),
+		ExpiresAt:   time.Unix(expiresAtUnix, 0),
+		Now:         time.Now(),
+		Grace:       cfg.AnswerGraceSeconds,
+	}
+	if !isMultiAnswerMode(respondersMode) {
+		data.Contacts = cfg.contactNames()
+	}
+	data.Attachments = s.pageAttachments(r.Context(), requestID, tokenPlain)
+	if !useJSONForms && len(steps) == 0 && s.blobs != nil {
+		data.Uploads, _ = s.db.getAllowUploads(r.Context(), requestID)
+		data.Voice, _ = s.db.getVoiceInput(r.Context(), requestID)
+		data.Transcribe = data.Voice && cfg.TranscribeURL != ""
+	}
+	if responder == "" {
+		data.AskName, _ = s.db.getAskName(r.Context(), requestID)
+	}
+	if !done {
+		if d, ok, err := s.db.getDraft(r.Context(), requestID, tokenHash); err == nil && ok {
+			data.Text = d.Text
+		}
+		if rc, err := s.db.receipts(r.Context(), requestID, responder); err == nil {
+			data.Acknowledged = rc.AcknowledgedAt != 0
+		}
+		if ev, _, ok, err := s.db.latestCustomEvent(r.Context(), requestID); err == nil && ok {
+			data.Progress = customMessage(ev)
+		}
+		data.ExtendSeconds, data.ExtensionsLeft, _ = s.db.extensionsLeft(r.Context(), requestID)
+		data.Suggestions = spec.Suggestions
+	} else if delegatedTo == "" {
+		data.Recap = s.answerRecap(r.Context(), requestID, status, responder, isMultiAnswerMode(respondersMode), expiresAtUnix)
+		if status == "submitted" && !useJSONForms {
+			if until, ok := s.answerEditUntil(r.Context(), requestID, responder); ok {
+				data.EditUntil = until
+				var action string
+				action, data.Text, _, _ = s.db.getAnswer(r.Context(), requestID)
+				data.AnswerVersion = answerVersion(action, data.Text)
+			}
+		}
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_ = pageTpl.Execute(w, data)
+	renderPage(w, cfg.pageTpl, pageTpl, data)
 }
 
 func genID(prefix string) string {
@@ -1729,6 +3687,16 @@ func sha256Hex(s string) string {
 	return string(out)
 }
 
+// resolveSQLitePath makes sqlite_path absolute, relative to the working
+// directory.
+func (c *Config) resolveSQLitePath() {
+	if !filepath.IsAbs(c.SQLitePath) {
+		if abs, err := filepath.Abs(c.SQLitePath); err == nil {
+			c.SQLitePath = abs
+		}
+	}
+}
+
 func loadConfigYAML(path string) (Config, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
@@ -1752,16 +3720,107 @@ func loadConfigFromDotenv(path string) (Config, error) {
 
 	cfg := Config{
 		BaseURL:                     strings.TrimSpace(envFirst("ASK4ME_BASE_URL", "BASE_URL")),
+		PublicBaseURL:               strings.TrimSpace(envFirst("ASK4ME_PUBLIC_BASE_URL", "PUBLIC_BASE_URL")),
+		PathPrefix:                  strings.TrimSpace(envFirst("ASK4ME_PATH_PREFIX", "PATH_PREFIX")),
 		APIKey:                      strings.TrimSpace(envFirst("ASK4ME_API_KEY", "API_KEY")),
 		ServerChanSendKey:           strings.TrimSpace(envFirst("ASK4ME_SERVERCHAN_SENDKEY", "SERVERCHAN_SENDKEY")),
 		AppriseURLs:                 parseCSVStrings(envFirst("ASK4ME_APPRISE_URLS", "APPRISE_URLS")),
 		AppriseBin:                  strings.TrimSpace(envFirst("ASK4ME_APPRISE_BIN", "APPRISE_BIN")),
 		SQLitePath:                  strings.TrimSpace(envFirst("ASK4ME_SQLITE_PATH", "SQLITE_PATH")),
+		SQLiteReadConns:             parseEnvInt(envFirst("ASK4ME_SQLITE_READ_CONNS", "SQLITE_READ_CONNS")),
+		SQLiteBusyTimeoutMS:         parseEnvInt(envFirst("ASK4ME_SQLITE_BUSY_TIMEOUT_MS", "SQLITE_BUSY_TIMEOUT_MS")),
+		DatabaseDriver:              strings.TrimSpace(envFirst("ASK4ME_DATABASE_DRIVER", "DATABASE_DRIVER")),
+		DatabaseURL:                 strings.TrimSpace(envFirst("ASK4ME_DATABASE_URL", "DATABASE_URL")),
+		HubDriver:                   strings.TrimSpace(envFirst("ASK4ME_HUB_DRIVER", "HUB_DRIVER")),
+		HubURL:                      strings.TrimSpace(envFirst("ASK4ME_HUB_URL", "HUB_URL")),
+		HubChannel:                  strings.TrimSpace(envFirst("ASK4ME_HUB_CHANNEL", "HUB_CHANNEL")),
+		HubPollIntervalSeconds:      parseEnvInt(envFirst("ASK4ME_HUB_POLL_INTERVAL_SECONDS", "HUB_POLL_INTERVAL_SECONDS")),
 		DefaultExpiresInSeconds:     parseEnvInt(envFirst("ASK4ME_DEFAULT_EXPIRES_IN_SECONDS", "DEFAULT_EXPIRES_IN_SECONDS")),
 		SSEHeartbeatIntervalSeconds: parseEnvInt(envFirst("ASK4ME_SSE_HEARTBEAT_INTERVAL_SECONDS", "SSE_HEARTBEAT_INTERVAL_SECONDS")),
+		SSEBufferSize:               parseEnvInt(envFirst("ASK4ME_SSE_BUFFER_SIZE", "SSE_BUFFER_SIZE")),
+		AnswerGraceSeconds:          parseEnvInt(envFirst("ASK4ME_ANSWER_GRACE_SECONDS", "ANSWER_GRACE_SECONDS")),
+		AnswerEditSeconds:           parseEnvInt(envFirst("ASK4ME_ANSWER_EDIT_SECONDS", "ANSWER_EDIT_SECONDS")),
+		NotifyWorkers:               parseEnvInt(envFirst("ASK4ME_NOTIFY_WORKERS", "NOTIFY_WORKERS")),
+		NotifyTimeoutSeconds:        parseEnvInt(envFirst("ASK4ME_NOTIFY_TIMEOUT_SECONDS", "NOTIFY_TIMEOUT_SECONDS")),
+		NotifyResult:                parseBoolQuery(envFirst("ASK4ME_NOTIFY_RESULT", "NOTIFY_RESULT")),
+		AskDedupWindowSeconds:       parseEnvInt(envFirst("ASK4ME_ASK_DEDUP_WINDOW_SECONDS", "ASK_DEDUP_WINDOW_SECONDS")),
 		ListenAddr:                  strings.TrimSpace(envFirst("ASK4ME_LISTEN_ADDR", "LISTEN_ADDR")),
+		ListenSocketMode:            strings.TrimSpace(envFirst("ASK4ME_LISTEN_SOCKET_MODE", "LISTEN_SOCKET_MODE")),
+		LogLevel:                    strings.TrimSpace(envFirst("ASK4ME_LOG_LEVEL", "LOG_LEVEL")),
+		LogFormat:                   strings.TrimSpace(envFirst("ASK4ME_LOG_FORMAT", "LOG_FORMAT")),
+		LogFile:                     strings.TrimSpace(envFirst("ASK4ME_LOG_FILE", "LOG_FILE")),
+		LogMaxSizeMB:                parseEnvInt(envFirst("ASK4ME_LOG_MAX_SIZE_MB", "LOG_MAX_SIZE_MB")),
+		LogMaxBackups:               parseEnvInt(envFirst("ASK4ME_LOG_MAX_BACKUPS", "LOG_MAX_BACKUPS")),
+		TrustedProxies:              parseCSVStrings(envFirst("ASK4ME_TRUSTED_PROXIES", "TRUSTED_PROXIES")),
+		APIAllowIPs:                 parseCSVStrings(envFirst("ASK4ME_API_ALLOW_IPS", "API_ALLOW_IPS")),
+		APIDenyIPs:                  parseCSVStrings(envFirst("ASK4ME_API_DENY_IPS", "API_DENY_IPS")),
+		PageAllowIPs:                parseCSVStrings(envFirst("ASK4ME_PAGE_ALLOW_IPS", "PAGE_ALLOW_IPS")),
+		PageDenyIPs:                 parseCSVStrings(envFirst("ASK4ME_PAGE_DENY_IPS", "PAGE_DENY_IPS")),
+		CORSAllowedOrigins:          parseCSVStrings(envFirst("ASK4ME_CORS_ALLOWED_ORIGINS", "CORS_ALLOWED_ORIGINS")),
+		CORSAllowedHeaders:          parseCSVStrings(envFirst("ASK4ME_CORS_ALLOWED_HEADERS", "CORS_ALLOWED_HEADERS")),
+		CORSAllowCredentials:        parseBoolQuery(envFirst("ASK4ME_CORS_ALLOW_CREDENTIALS", "CORS_ALLOW_CREDENTIALS")),
+		TLSMode:                     strings.TrimSpace(envFirst("ASK4ME_TLS_MODE", "TLS_MODE")),
+		TLSCertFile:                 strings.TrimSpace(envFirst("ASK4ME_TLS_CERT_FILE", "TLS_CERT_FILE")),
+		TLSKeyFile:                  strings.TrimSpace(envFirst("ASK4ME_TLS_KEY_FILE", "TLS_KEY_FILE")),
+		TLSHTTPAddr:                 strings.TrimSpace(envFirst("ASK4ME_TLS_HTTP_ADDR", "TLS_HTTP_ADDR")),
+		ACMEDomains:                 parseCSVStrings(envFirst("ASK4ME_ACME_DOMAINS", "ACME_DOMAINS")),
+		ACMECacheDir:                strings.TrimSpace(envFirst("ASK4ME_ACME_CACHE_DIR", "ACME_CACHE_DIR")),
+		ACMEEmail:                   strings.TrimSpace(envFirst("ASK4ME_ACME_EMAIL", "ACME_EMAIL")),
+		ACMEDirectoryURL:            strings.TrimSpace(envFirst("ASK4ME_ACME_DIRECTORY_URL", "ACME_DIRECTORY_URL")),
 		TerminalCacheSeconds:        parseEnvInt(envFirst("ASK4ME_TERMINAL_CACHE_SECONDS", "TERMINAL_CACHE_SECONDS")),
+		ShutdownTimeoutSeconds:      parseEnvInt(envFirst("ASK4ME_SHUTDOWN_TIMEOUT_SECONDS", "SHUTDOWN_TIMEOUT_SECONDS")),
+		RetentionDays:               parseEnvInt(envFirst("ASK4ME_RETENTION_DAYS", "RETENTION_DAYS")),
+		RetentionArchivePath:        strings.TrimSpace(envFirst("ASK4ME_RETENTION_ARCHIVE_PATH", "RETENTION_ARCHIVE_PATH")),
+		MaxEvents:                   parseEnvInt(envFirst("ASK4ME_MAX_EVENTS", "MAX_EVENTS")),
+		MaxRequests:                 parseEnvInt(envFirst("ASK4ME_MAX_REQUESTS", "MAX_REQUESTS")),
+		RedactAnswersAfterDays:      parseEnvInt(envFirst("ASK4ME_REDACT_ANSWERS_AFTER_DAYS", "REDACT_ANSWERS_AFTER_DAYS")),
+		PayloadCompressBytes:        parseEnvInt(envFirst("ASK4ME_PAYLOAD_COMPRESS_BYTES", "PAYLOAD_COMPRESS_BYTES")),
+		DedupBodies:                 parseBoolQuery(envFirst("ASK4ME_DEDUP_BODIES", "DEDUP_BODIES")),
+		NotifyMaxAttempts:           parseEnvInt(envFirst("ASK4ME_NOTIFY_MAX_ATTEMPTS", "NOTIFY_MAX_ATTEMPTS")),
+		RateLimitAskPerMinute:       parseEnvInt(envFirst("ASK4ME_RATE_LIMIT_ASK_PER_MINUTE", "RATE_LIMIT_ASK_PER_MINUTE")),
+		RateLimitIPPerMinute:        parseEnvInt(envFirst("ASK4ME_RATE_LIMIT_IP_PER_MINUTE", "RATE_LIMIT_IP_PER_MINUTE")),
+		ChallengePIN:                strings.TrimSpace(envFirst("ASK4ME_CHALLENGE_PIN", "CHALLENGE_PIN")),
+		ChallengeTOTPSecret:         strings.TrimSpace(envFirst("ASK4ME_CHALLENGE_TOTP_SECRET", "CHALLENGE_TOTP_SECRET")),
+		WebhookSecret:               strings.TrimSpace(envFirst("ASK4ME_WEBHOOK_SECRET", "WEBHOOK_SECRET")),
+		AnswerHook:                  strings.TrimSpace(envFirst("ASK4ME_ANSWER_HOOK", "ANSWER_HOOK")),
+		TranscribeURL:               strings.TrimSpace(envFirst("ASK4ME_TRANSCRIBE_URL", "TRANSCRIBE_URL")),
+		PolicyFile:                  strings.TrimSpace(envFirst("ASK4ME_POLICY_FILE", "POLICY_FILE")),
+		ShortLinks:                  parseBoolQuery(envFirst("ASK4ME_SHORT_LINKS", "SHORT_LINKS")),
+		ShortLinkTTLSeconds:         parseEnvInt(envFirst("ASK4ME_SHORT_LINK_TTL_SECONDS", "SHORT_LINK_TTL_SECONDS")),
+		StatsReportCron:             strings.TrimSpace(envFirst("ASK4ME_STATS_REPORT_CRON", "STATS_REPORT_CRON")),
+		StatsReportTimezone:         strings.TrimSpace(envFirst("ASK4ME_STATS_REPORT_TIMEZONE", "STATS_REPORT_TIMEZONE")),
+		StatsReportDays:             parseEnvInt(envFirst("ASK4ME_STATS_REPORT_DAYS", "STATS_REPORT_DAYS")),
+		PageTemplateDir:             strings.TrimSpace(envFirst("ASK4ME_PAGE_TEMPLATE_DIR", "PAGE_TEMPLATE_DIR")),
+		PageLogoURL:                 strings.TrimSpace(envFirst("ASK4ME_PAGE_LOGO_URL", "PAGE_LOGO_URL")),
+		PageThemeColor:              strings.TrimSpace(envFirst("ASK4ME_PAGE_THEME_COLOR", "PAGE_THEME_COLOR")),
+		PageFooter:                  strings.TrimSpace(envFirst("ASK4ME_PAGE_FOOTER", "PAGE_FOOTER")),
+		WebPushSubject:              strings.TrimSpace(envFirst("ASK4ME_WEB_PUSH_SUBJECT", "WEB_PUSH_SUBJECT")),
+		WebPushVAPIDPrivateKey:      strings.TrimSpace(envFirst("ASK4ME_WEB_PUSH_VAPID_PRIVATE_KEY", "WEB_PUSH_VAPID_PRIVATE_KEY")),
+		AttachmentsDriver:           strings.TrimSpace(envFirst("ASK4ME_ATTACHMENTS_DRIVER", "ATTACHMENTS_DRIVER")),
+		AttachmentsDir:              strings.TrimSpace(envFirst("ASK4ME_ATTACHMENTS_DIR", "ATTACHMENTS_DIR")),
+		AttachmentsMaxBytes:         int64(parseEnvInt(envFirst("ASK4ME_ATTACHMENTS_MAX_BYTES", "ATTACHMENTS_MAX_BYTES"))),
+		S3Endpoint:                  strings.TrimSpace(envFirst("ASK4ME_S3_ENDPOINT", "S3_ENDPOINT")),
+		S3Region:                    strings.TrimSpace(envFirst("ASK4ME_S3_REGION", "S3_REGION")),
+		S3Bucket:                    strings.TrimSpace(envFirst("ASK4ME_S3_BUCKET", "S3_BUCKET")),
+		S3AccessKeyID:               strings.TrimSpace(envFirst("ASK4ME_S3_ACCESS_KEY_ID", "S3_ACCESS_KEY_ID")),
+		S3SecretAccessKey:           strings.TrimSpace(envFirst("ASK4ME_S3_SECRET_ACCESS_KEY", "S3_SECRET_ACCESS_KEY")),
+		S3PathStyle:                 parseBoolQuery(envFirst("ASK4ME_S3_PATH_STYLE", "S3_PATH_STYLE")),
+		S3PresignSeconds:            parseEnvInt(envFirst("ASK4ME_S3_PRESIGN_SECONDS", "S3_PRESIGN_SECONDS")),
+		SlackSigningSecret:          strings.TrimSpace(envFirst("ASK4ME_SLACK_SIGNING_SECRET", "SLACK_SIGNING_SECRET")),
+		SlackBotToken:               strings.TrimSpace(envFirst("ASK4ME_SLACK_BOT_TOKEN", "SLACK_BOT_TOKEN")),
+		SlackAllowedUsers:           parseCSVStrings(envFirst("ASK4ME_SLACK_ALLOWED_USERS", "SLACK_ALLOWED_USERS")),
+		TelegramBotToken:            strings.TrimSpace(envFirst("ASK4ME_TELEGRAM_BOT_TOKEN", "TELEGRAM_BOT_TOKEN")),
+		TelegramAllowedChats:        parseCSVStrings(envFirst("ASK4ME_TELEGRAM_ALLOWED_CHATS", "TELEGRAM_ALLOWED_CHATS")),
+		EmailReplyAddress:           strings.TrimSpace(envFirst("ASK4ME_EMAIL_REPLY_ADDRESS", "EMAIL_REPLY_ADDRESS")),
+		EmailInboundToken:           strings.TrimSpace(envFirst("ASK4ME_EMAIL_INBOUND_TOKEN", "EMAIL_INBOUND_TOKEN")),
+		EmailAllowedSenders:         parseCSVStrings(envFirst("ASK4ME_EMAIL_ALLOWED_SENDERS", "EMAIL_ALLOWED_SENDERS")),
+		Priorities:                  priorityConfigFromEnv(),
+	}
+	limits, err := parseChannelLimits(envFirst("ASK4ME_NOTIFY_CHANNEL_LIMITS", "NOTIFY_CHANNEL_LIMITS"))
+	if err != nil {
+		return Config{}, err
 	}
+	cfg.NotifyChannelLimits = limits
 	if cfg.BaseURL == "" {
 		return Config{}, errors.New("ASK4ME_BASE_URL is required")
 	}
@@ -1951,9 +4010,56 @@ func parseDotenvLine(line string) (key, value string, ok bool, err error) {
 
 func main() {
 	var configPath string
+	var migrateCmd string
+	var migrateTo int
+	var importPath string
+	var showVersion bool
+	var check, noSend bool
 	flag.StringVar(&configPath, "config", "", "config file path (.env or .yml/.yaml). If empty, auto-detect: .env then ask4me.yaml")
+	flag.StringVar(&migrateCmd, "migrate", "", "run schema migrations and exit: status, up or down")
+	flag.IntVar(&migrateTo, "migrate-to", -1, "target schema version for -migrate (default: latest for up, previous for down)")
+	flag.StringVar(&importPath, "import", "", "import a JSONL export (or retention archive) into the database and exit")
+	flag.BoolVar(&showVersion, "version", false, "print version information and exit")
+	flag.BoolVar(&check, "check", false, "check the config, database, notification channel and base_url, then exit (same as the doctor command)")
+	flag.BoolVar(&noSend, "no-send", false, "with -check: do not send a test notification")
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := runInit(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inbox" {
+		if err := runInbox(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		check = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
+	if showVersion {
+		b, _ := json.MarshalIndent(buildInfo(), "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	if check {
+		if !runDoctor(configPath, !noSend) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	cfg, used, err := loadConfigAuto(configPath)
 	if err != nil {
 		if used != "" {
@@ -1964,41 +4070,136 @@ func main() {
 		os.Exit(1)
 	}
 
-	sqlitePath := cfg.SQLitePath
-	if !filepath.IsAbs(sqlitePath) {
-		if abs, err := filepath.Abs(sqlitePath); err == nil {
-			sqlitePath = abs
-		}
-	}
-
-	db, err := sql.Open("sqlite", sqlitePath)
+	logFile, err := setupLogging(cfg)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
-	defer db.Close()
+	if logFile != nil {
+		defer logFile.Close()
+	}
 
-	db.SetMaxOpenConns(1)
-	st, err := newStore(db)
+	cfg.resolveSQLitePath()
+
+	db, err := openDatabase(cfg)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		fatal(err)
+	}
+	defer db.Close()
+	if migrateCmd != "" {
+		if err := runMigrateCommand(context.Background(), db, migrateCmd, migrateTo); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if err := db.migrateUp(context.Background(), 0); err != nil {
+		fatal(err)
+	}
+	st := newStore(db)
+	st.compressBytes = cfg.PayloadCompressBytes
+	st.dedupBodies = cfg.DedupBodies
+	if importPath != "" {
+		imported, skipped, err := st.importRecords(context.Background(), importPath)
+		fmt.Printf("imported %d requests, skipped %d existing\n", imported, skipped)
+		if err != nil {
+			fatal(err)
+		}
+		return
 	}
 
-	hub := newRuntimeHub(time.Duration(cfg.TerminalCacheSeconds) * time.Second)
-	srv := &server{cfg: cfg, db: st, hub: hub}
+	hub := newRuntimeHub(time.Duration(cfg.TerminalCacheSeconds)*time.Second, cfg.SSEBufferSize)
+	broker, err := newHubBroker(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	if broker != nil {
+		defer broker.close()
+		hub.attachBroker(context.Background(), broker)
+	}
+	blobs, err := newBlobStore(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	srv := &server{db: st, requests: st, hub: hub, presence: newPresenceThrottle(), blobs: blobs, limiter: newRateLimiter(), outboxWake: make(chan struct{}, 1), shutdown: newShutdownState()}
+	srv.notify = newNotifyPool(cfg.NotifyWorkers, cfg.NotifyChannelLimits)
+	srv.conf.Store(&cfg)
+	if err := srv.syncConfigTables(context.Background()); err != nil {
+		fatal(err)
+	}
+	srv.resumePending(context.Background())
+	loopsCtx, cancelLoops := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	watchConfig := func(ctx context.Context) { srv.watchConfig(ctx, used) }
+	for _, loop := range []func(context.Context){srv.outboxLoop, srv.recurringLoop, srv.retentionLoop, watchConfig, srv.telegramSetup} {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			loop(loopsCtx)
+		}()
+	}
+	stopLoops := func() {
+		cancelLoops()
+		loops.Wait()
+	}
 
 	httpSrv := &http.Server{
 		Addr:              cfg.ListenAddr,
 		Handler:           srv.routes(),
 		ReadHeaderTimeout: 5 * time.Second,
+		ConnContext:       markUnixConn,
 	}
+	servers := []*http.Server{httpSrv}
 
-	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	tlsConfig, httpHandler, err := tlsSetup(cfg)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		fatal(err)
+	}
+	ln, plainLn, err := openListeners(cfg)
+	if err != nil {
+		fatal(err)
 	}
-	fmt.Fprintf(os.Stdout, "listening on %s\n", ln.Addr().String())
-	_ = httpSrv.Serve(ln)
+
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	serveErr := make(chan error, 1)
+	if tlsConfig == nil {
+		slog.Info("listening", "addr", ln.Addr().String())
+		go func() { serveErr <- httpSrv.Serve(ln) }()
+	} else {
+		httpSrv.TLSConfig = tlsConfig
+		if plainLn == nil && cfg.TLSHTTPAddr != "" {
+			if plainLn, err = listenAddr(cfg.TLSHTTPAddr, cfg.socketMode); err != nil {
+				fatal(err)
+			}
+		}
+		if plainLn != nil {
+			plain := &http.Server{Handler: httpHandler, ReadHeaderTimeout: 5 * time.Second, ConnContext: markUnixConn}
+			servers = append(servers, plain)
+			go func() {
+				if err := plain.Serve(plainLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("tls: http listener", "addr", plainLn.Addr().String(), "error", err)
+				}
+			}()
+		}
+		slog.Info("listening", "addr", ln.Addr().String(), "tls", cfg.TLSMode)
+		go func() { serveErr <- httpSrv.ServeTLS(ln, "", "") }()
+	}
+
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(err)
+		}
+	case <-sigCtx.Done():
+		// Restore default handling so a second signal exits at once.
+		stopSignals()
+		slog.Info("shutting down", "timeout_seconds", cfg.ShutdownTimeoutSeconds)
+		srv.gracefulShutdown(servers, stopLoops)
+	}
+}
+
+// fatal logs err and exits. Deferred calls do not run.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /metrics serves the answer statistics of GET /v1/stats in the
+// Prometheus text format: per channel and per tag, how many requests there
+// were, how many were answered and expired, and a histogram of the time to
+// the first answer. Like /v1/stats the numbers come from the database on
+// every scrape, over the requests of the last `days` days (default 30, a
+// sliding window rather than whole days), so every instance reports the same
+// values. They are not counters and can go down as old requests leave the
+// window: use them without rate(), e.g. histogram_quantile(0.9,
+// ask4me_answer_seconds_bucket{tag="deploy"}).
+//
+// Each metric has one unlabelled series for all requests, then one per
+// channel and one per tag; a request sent through two channels or with two
+// tags is in each of them, so do not sum the labelled series.
+
+// metricsGroup is the label and outcome of one series set.
+type metricsGroup struct {
+	label, value string
+	o            *outcomeStats
+}
+
+// handleMetrics serves GET /metrics?days=.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	days, tenant, err := statsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	st, err := s.db.requestStatsSince(r.Context(), from, time.UTC, tenant)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	groups := []metricsGroup{{o: &st.All}}
+	for _, name := range slices.Sorted(maps.Keys(st.ByChannel)) {
+		groups = append(groups, metricsGroup{"channel", name, &st.ByChannel[name].outcomeStats})
+	}
+	for _, tag := range slices.Sorted(maps.Keys(st.ByTag)) {
+		groups = append(groups, metricsGroup{"tag", tag, st.ByTag[tag]})
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, st, groups)
+}
+
+func writeMetrics(w io.Writer, st requestStats, groups []metricsGroup) {
+	gauge := func(name, help string, value func(o *outcomeStats) int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, g := range groups {
+			fmt.Fprintf(w, "%s%s %d\n", name, metricLabels(g, ""), value(g.o))
+		}
+	}
+	gauge("ask4me_requests", "Requests created in the window.", func(o *outcomeStats) int { return o.Requests })
+	gauge("ask4me_requests_answered", "Requests of the window that were answered.", func(o *outcomeStats) int { return o.Answered })
+	gauge("ask4me_requests_finished", "Requests of the window that finished.", func(o *outcomeStats) int { return o.Finished })
+	gauge("ask4me_requests_expired", "Requests of the window that expired.", func(o *outcomeStats) int { return o.Expired })
+
+	const hist = "ask4me_answer_seconds"
+	fmt.Fprintf(w, "# HELP %s Time from a request's creation to its first answer.\n# TYPE %s histogram\n", hist, hist)
+	for _, g := range groups {
+		counts, sum := g.o.histogram()
+		for i, n := range counts {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hist, metricLabels(g, strconv.FormatInt(answerBuckets[i], 10)), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hist, metricLabels(g, "+Inf"), g.o.Answered)
+		fmt.Fprintf(w, "%s_sum%s %d\n", hist, metricLabels(g, ""), sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", hist, metricLabels(g, ""), g.o.Answered)
+	}
+
+	for _, m := range []struct {
+		name, help string
+		value      func(c *channelStats) int
+	}{
+		{"ask4me_notifications_sent", "Notifications sent in the window.", func(c *channelStats) int { return c.Sent }},
+		{"ask4me_notifications_failed", "Notifications that failed in the window.", func(c *channelStats) int { return c.Failed }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, name := range slices.Sorted(maps.Keys(st.ByChannel)) {
+			fmt.Fprintf(w, "%s{channel=\"%s\"} %d\n", m.name, escapeLabel(name), m.value(st.ByChannel[name]))
+		}
+	}
+}
+
+// metricLabels formats the labels of g's series, with le for a histogram
+// bucket.
+func metricLabels(g metricsGroup, le string) string {
+	var parts []string
+	if g.label != "" {
+		parts = append(parts, g.label+`="`+escapeLabel(g.value)+`"`)
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
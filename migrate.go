@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema migrations live in migrations/<dialect>/NNNN_name.up.sql with a
+// matching .down.sql. Applied versions are recorded in schema_version; the
+// server migrates up to the latest version on startup, and -migrate runs
+// status/up/down by hand.
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations returns the dialect's migrations ordered by version.
+func loadMigrations(set string) ([]migration, error) {
+	dir := path.Join("migrations", set)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		file := e.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or .down.sql", file)
+		}
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: bad version", file)
+		}
+		b, err := migrationsFS.ReadFile(path.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+	out := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s: missing up.sql", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// splitSQL splits a migration script into statements. Only a ";" that ends
+// a line ends a statement, so one inside a line (in a string literal, say)
+// is kept; see migrations/README.md.
+func splitSQL(script string) []string {
+	var out []string
+	var st strings.Builder
+	flush := func() {
+		if s := strings.TrimSuffix(strings.TrimSpace(st.String()), ";"); s != "" {
+			out = append(out, s)
+		}
+		st.Reset()
+	}
+	for _, line := range strings.SplitAfter(script, "\n") {
+		st.WriteString(line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+func (c *dbConn) ensureSchemaVersionTable(ctx context.Context) error {
+	_, err := c.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(191) NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`)
+	return err
+}
+
+// appliedMigrations returns the recorded versions and when they were applied.
+func (c *dbConn) appliedMigrations(ctx context.Context) (map[int]int64, error) {
+	rows, err := c.QueryContext(ctx, `SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int]int64{}
+	for rows.Next() {
+		var v int
+		var at int64
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		out[v] = at
+	}
+	return out, rows.Err()
+}
+
+// runMigration executes one script and records the new state in the same
+// transaction. Backends without transactional DDL (MySQL) commit each
+// statement as it runs.
+func (c *dbConn) runMigration(ctx context.Context, m migration, up bool) error {
+	script := m.Up
+	if !up {
+		script = m.Down
+	}
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, st := range splitSQL(script) {
+		if _, err := tx.ExecContext(ctx, st); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, c.dialect.rebind(`INSERT INTO schema_version(version, name, applied_at) VALUES(?,?,?)`),
+			m.Version, m.Name, time.Now().Unix())
+	} else {
+		_, err = tx.ExecContext(ctx, c.dialect.rebind(`DELETE FROM schema_version WHERE version=?`), m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies pending migrations up to target (0 means latest).
+func (c *dbConn) migrateUp(ctx context.Context, target int) error {
+	migrations, err := loadMigrations(c.dialect.migrations())
+	if err != nil {
+		return err
+	}
+	if err := c.ensureSchemaVersionTable(ctx); err != nil {
+		return err
+	}
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		if err := c.adoptLegacySchema(ctx); err != nil {
+			return err
+		}
+	}
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := c.runMigration(ctx, m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown reverts applied migrations above target, newest first.
+func (c *dbConn) migrateDown(ctx context.Context, target int) error {
+	migrations, err := loadMigrations(c.dialect.migrations())
+	if err != nil {
+		return err
+	}
+	if err := c.ensureSchemaVersionTable(ctx); err != nil {
+		return err
+	}
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return fmt.Errorf("migration %04d_%s has no down.sql", m.Version, m.Name)
+		}
+		if err := c.runMigration(ctx, m, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the highest applied migration.
+func (c *dbConn) schemaVersion(ctx context.Context) (int, error) {
+	if err := c.ensureSchemaVersionTable(ctx); err != nil {
+		return 0, err
+	}
+	var v sql.NullInt64
+	if err := c.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// migrationStatus lists every known migration and whether it is applied.
+func (c *dbConn) migrationStatus(ctx context.Context) ([]string, error) {
+	migrations, err := loadMigrations(c.dialect.migrations())
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ensureSchemaVersionTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		state := "pending"
+		if at, ok := applied[m.Version]; ok {
+			state = "applied " + time.Unix(at, 0).UTC().Format(time.RFC3339)
+		}
+		out = append(out, fmt.Sprintf("%04d_%s\t%s", m.Version, m.Name, state))
+	}
+	return out, nil
+}
+
+// adoptLegacySchema prepares SQLite databases created before versioned
+// migrations: their tables exist but may lack later columns, which 0001's
+// CREATE TABLE IF NOT EXISTS would not add.
+func (c *dbConn) adoptLegacySchema(ctx context.Context) error {
+	if c.dialect.name() != databaseDriverSQLite {
+		return nil
+	}
+	var n int
+	if err := c.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='requests'`).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	for table, columns := range legacySQLiteColumns {
+		if err := ensureTableColumns(c.DB, table, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMigrateCommand implements the -migrate flag.
+func runMigrateCommand(ctx context.Context, c *dbConn, cmd string, target int) error {
+	switch cmd {
+	case "status":
+	case "up":
+		if err := c.migrateUp(ctx, max(target, 0)); err != nil {
+			return err
+		}
+	case "down":
+		if target < 0 {
+			current, err := c.schemaVersion(ctx)
+			if err != nil {
+				return err
+			}
+			target = max(current-1, 0)
+		}
+		if err := c.migrateDown(ctx, target); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown -migrate command %q (want status, up or down)", cmd)
+	}
+	version, err := c.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	lines, err := c.migrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s schema version %d\n", c.dialect.name(), version)
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS requests (
+	request_id VARCHAR(128) PRIMARY KEY,
+	title MEDIUMTEXT NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	mcd MEDIUMTEXT NOT NULL,
+	status VARCHAR(32) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL,
+	jsonforms_schema_json MEDIUMTEXT,
+	jsonforms_uischema_json MEDIUMTEXT,
+	jsonforms_data_json MEDIUMTEXT,
+	jsonforms_submit_label MEDIUMTEXT,
+	jsonforms_renderer MEDIUMTEXT
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS tokens (
+	request_id VARCHAR(128) NOT NULL,
+	token_hash VARCHAR(64) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL,
+	used_at BIGINT,
+	PRIMARY KEY(request_id, token_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS answers (
+	request_id VARCHAR(128) PRIMARY KEY,
+	action MEDIUMTEXT,
+	text MEDIUMTEXT,
+	payload_json MEDIUMTEXT,
+	created_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS events (
+	seq BIGINT AUTO_INCREMENT PRIMARY KEY,
+	request_id VARCHAR(128) NOT NULL,
+	event_id VARCHAR(64) NOT NULL,
+	type VARCHAR(128) NOT NULL,
+	payload_json MEDIUMTEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	INDEX idx_events_request_seq (request_id, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,19 @@
+DROP TABLE IF EXISTS scheduled_asks;
+DROP TABLE IF EXISTS templates;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS step_answers;
+DROP TABLE IF EXISTS responses;
+DROP TABLE IF EXISTS drafts;
+ALTER TABLE answers DROP COLUMN responder;
+ALTER TABLE tokens DROP COLUMN delegated_to;
+ALTER TABLE tokens DROP COLUMN responder;
+ALTER TABLE requests DROP COLUMN parent_request_id;
+ALTER TABLE requests DROP COLUMN default_action;
+ALTER TABLE requests DROP COLUMN priority;
+ALTER TABLE requests DROP COLUMN schedule_id;
+ALTER TABLE requests DROP COLUMN session_id;
+ALTER TABLE requests DROP COLUMN current_step;
+ALTER TABLE requests DROP COLUMN steps_json;
+ALTER TABLE requests DROP COLUMN approval_json;
+ALTER TABLE requests DROP COLUMN responders_min;
+ALTER TABLE requests DROP COLUMN responders_mode;
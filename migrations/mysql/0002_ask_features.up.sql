@@ -0,0 +1,75 @@
+ALTER TABLE requests ADD COLUMN responders_mode VARCHAR(16);
+ALTER TABLE requests ADD COLUMN responders_min BIGINT;
+ALTER TABLE requests ADD COLUMN approval_json MEDIUMTEXT;
+ALTER TABLE requests ADD COLUMN steps_json MEDIUMTEXT;
+ALTER TABLE requests ADD COLUMN current_step BIGINT;
+ALTER TABLE requests ADD COLUMN session_id VARCHAR(128);
+ALTER TABLE requests ADD COLUMN schedule_id VARCHAR(128);
+ALTER TABLE requests ADD COLUMN priority VARCHAR(16);
+ALTER TABLE requests ADD COLUMN default_action MEDIUMTEXT;
+ALTER TABLE requests ADD COLUMN parent_request_id VARCHAR(128);
+
+ALTER TABLE tokens ADD COLUMN responder VARCHAR(191);
+ALTER TABLE tokens ADD COLUMN delegated_to VARCHAR(191);
+
+ALTER TABLE answers ADD COLUMN responder VARCHAR(191);
+
+CREATE TABLE IF NOT EXISTS drafts (
+	request_id VARCHAR(128) NOT NULL,
+	token_hash VARCHAR(64) NOT NULL,
+	text MEDIUMTEXT,
+	payload_json MEDIUMTEXT,
+	updated_at BIGINT NOT NULL,
+	PRIMARY KEY(request_id, token_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS responses (
+	request_id VARCHAR(128) NOT NULL,
+	responder VARCHAR(191) NOT NULL,
+	action MEDIUMTEXT,
+	text MEDIUMTEXT,
+	payload_json MEDIUMTEXT,
+	created_at BIGINT NOT NULL,
+	PRIMARY KEY(request_id, responder)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS step_answers (
+	request_id VARCHAR(128) NOT NULL,
+	step BIGINT NOT NULL,
+	action MEDIUMTEXT,
+	text MEDIUMTEXT,
+	payload_json MEDIUMTEXT,
+	created_at BIGINT NOT NULL,
+	PRIMARY KEY(request_id, step)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS schedules (
+	schedule_id VARCHAR(128) PRIMARY KEY,
+	name VARCHAR(191) NOT NULL,
+	cron MEDIUMTEXT NOT NULL,
+	timezone VARCHAR(64),
+	ask_json MEDIUMTEXT NOT NULL,
+	source VARCHAR(16) NOT NULL,
+	enabled BIGINT NOT NULL DEFAULT 1,
+	next_run_at BIGINT,
+	last_run_at BIGINT,
+	last_request_id VARCHAR(128),
+	last_error MEDIUMTEXT,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS templates (
+	name VARCHAR(64) PRIMARY KEY,
+	description MEDIUMTEXT,
+	ask_json MEDIUMTEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS scheduled_asks (
+	request_id VARCHAR(128) PRIMARY KEY,
+	send_at BIGINT NOT NULL,
+	payload_json MEDIUMTEXT NOT NULL,
+	created_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
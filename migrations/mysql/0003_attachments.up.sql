@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS attachments (
+	attachment_id VARCHAR(64) PRIMARY KEY,
+	request_id VARCHAR(128),
+	kind VARCHAR(16) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	size BIGINT NOT NULL,
+	storage_key VARCHAR(255) NOT NULL,
+	responder VARCHAR(191),
+	created_at BIGINT NOT NULL,
+	INDEX idx_attachments_request (request_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE requests ADD COLUMN allow_uploads BIGINT;
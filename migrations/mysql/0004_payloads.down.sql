@@ -0,0 +1,4 @@
+ALTER TABLE events DROP COLUMN payload_encoding;
+DROP INDEX idx_requests_body_hash ON requests;
+ALTER TABLE requests DROP COLUMN body_hash;
+DROP TABLE IF EXISTS bodies;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS bodies (
+	hash VARCHAR(64) PRIMARY KEY,
+	encoding VARCHAR(16),
+	data LONGTEXT NOT NULL,
+	size BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE requests ADD COLUMN body_hash VARCHAR(64);
+
+CREATE INDEX idx_requests_body_hash ON requests(body_hash);
+
+ALTER TABLE events ADD COLUMN payload_encoding VARCHAR(16);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS outbox (
+	request_id VARCHAR(128) PRIMARY KEY,
+	payload_json MEDIUMTEXT NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	attempts BIGINT NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL,
+	last_error MEDIUMTEXT,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL,
+	INDEX idx_outbox_due (status, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	key_id VARCHAR(128) PRIMARY KEY,
+	name VARCHAR(191) NOT NULL,
+	key_hash VARCHAR(64) NOT NULL UNIQUE,
+	key_prefix VARCHAR(16) NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	rate_limit_per_minute BIGINT NOT NULL DEFAULT 0,
+	source VARCHAR(16) NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL,
+	last_used_at BIGINT
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
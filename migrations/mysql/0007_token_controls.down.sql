@@ -0,0 +1,3 @@
+ALTER TABLE tokens DROP COLUMN revoked_at;
+ALTER TABLE tokens DROP COLUMN bound_hash;
+ALTER TABLE requests DROP COLUMN one_time_link;
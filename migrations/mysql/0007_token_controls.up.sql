@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN one_time_link VARCHAR(16);
+
+ALTER TABLE tokens ADD COLUMN bound_hash VARCHAR(64);
+
+ALTER TABLE tokens ADD COLUMN revoked_at BIGINT;
@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN challenge VARCHAR(16);
+
+ALTER TABLE tokens ADD COLUMN challenge_hash VARCHAR(64);
+
+ALTER TABLE tokens ADD COLUMN challenge_failures BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS short_links (
+	code_hash VARCHAR(64) PRIMARY KEY,
+	request_id VARCHAR(128) NOT NULL,
+	sealed TEXT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL,
+	INDEX idx_short_links_request (request_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS reports (
+	name VARCHAR(64) PRIMARY KEY,
+	cron VARCHAR(255) NOT NULL,
+	next_run_at BIGINT NOT NULL,
+	last_run_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS push_vapid_keys;
+DROP TABLE IF EXISTS push_subscriptions;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	id VARCHAR(128) PRIMARY KEY,
+	endpoint VARCHAR(700) NOT NULL UNIQUE,
+	p256dh VARCHAR(128) NOT NULL,
+	auth VARCHAR(64) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	created_at BIGINT NOT NULL,
+	last_sent_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS push_vapid_keys (
+	id INT PRIMARY KEY,
+	private_key VARCHAR(128) NOT NULL,
+	created_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
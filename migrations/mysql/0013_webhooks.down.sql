@@ -0,0 +1,2 @@
+DROP INDEX idx_requests_updated ON requests;
+DROP TABLE IF EXISTS webhooks;
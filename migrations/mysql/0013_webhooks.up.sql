@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+	id VARCHAR(128) PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret VARCHAR(255),
+	events TEXT NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	created_at BIGINT NOT NULL,
+	last_status INT,
+	last_error TEXT,
+	last_sent_at BIGINT
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE INDEX idx_requests_updated ON requests(updated_at);
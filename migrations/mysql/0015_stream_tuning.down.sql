@@ -0,0 +1,2 @@
+ALTER TABLE requests DROP COLUMN buffer_size;
+ALTER TABLE requests DROP COLUMN heartbeat_seconds;
@@ -0,0 +1,3 @@
+ALTER TABLE requests ADD COLUMN heartbeat_seconds INTEGER;
+
+ALTER TABLE requests ADD COLUMN buffer_size INTEGER;
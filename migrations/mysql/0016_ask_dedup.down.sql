@@ -0,0 +1,2 @@
+DROP INDEX idx_requests_content_hash ON requests;
+ALTER TABLE requests DROP COLUMN content_hash;
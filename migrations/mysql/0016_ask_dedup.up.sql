@@ -0,0 +1,3 @@
+ALTER TABLE requests ADD COLUMN content_hash VARCHAR(64);
+
+CREATE INDEX idx_requests_content_hash ON requests(content_hash);
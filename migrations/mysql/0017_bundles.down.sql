@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS bundles;
+DROP INDEX idx_requests_bundle ON requests;
+ALTER TABLE requests DROP COLUMN bundle_id;
@@ -0,0 +1,16 @@
+ALTER TABLE requests ADD COLUMN bundle_id VARCHAR(128);
+
+CREATE INDEX idx_requests_bundle ON requests(bundle_id);
+
+CREATE TABLE IF NOT EXISTS bundles (
+	bundle_id VARCHAR(128) PRIMARY KEY,
+	request_id VARCHAR(128) NOT NULL,
+	request_ids TEXT NOT NULL,
+	title TEXT NOT NULL,
+	body TEXT NOT NULL,
+	token_hash VARCHAR(64) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE INDEX idx_bundles_request ON bundles(request_id);
@@ -0,0 +1,3 @@
+ALTER TABLE requests DROP COLUMN extensions;
+ALTER TABLE requests DROP COLUMN max_extensions;
+ALTER TABLE requests DROP COLUMN extend_seconds;
@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN extend_seconds INTEGER;
+
+ALTER TABLE requests ADD COLUMN max_extensions INTEGER;
+
+ALTER TABLE requests ADD COLUMN extensions INTEGER NOT NULL DEFAULT 0;
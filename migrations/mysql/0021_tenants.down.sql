@@ -0,0 +1,3 @@
+ALTER TABLE api_keys DROP COLUMN tenant;
+DROP INDEX idx_requests_tenant ON requests;
+ALTER TABLE requests DROP COLUMN tenant;
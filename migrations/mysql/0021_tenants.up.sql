@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN tenant VARCHAR(128);
+
+CREATE INDEX idx_requests_tenant ON requests(tenant, created_at);
+
+ALTER TABLE api_keys ADD COLUMN tenant VARCHAR(128);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS rotation_overrides (
+	rotation VARCHAR(64) PRIMARY KEY,
+	contact VARCHAR(255) NOT NULL,
+	until_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS answer_claims (
+	request_id VARCHAR(128) PRIMARY KEY,
+	page_id VARCHAR(64) NOT NULL,
+	responder VARCHAR(255),
+	until_at BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
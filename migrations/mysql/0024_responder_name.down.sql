@@ -0,0 +1,2 @@
+ALTER TABLE answers DROP COLUMN responder_name;
+ALTER TABLE requests DROP COLUMN ask_name;
@@ -0,0 +1,2 @@
+ALTER TABLE requests ADD COLUMN ask_name INTEGER;
+ALTER TABLE answers ADD COLUMN responder_name VARCHAR(255);
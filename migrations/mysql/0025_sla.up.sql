@@ -0,0 +1,4 @@
+ALTER TABLE requests ADD COLUMN sla_seconds INTEGER;
+ALTER TABLE requests ADD COLUMN sla_at BIGINT;
+ALTER TABLE requests ADD COLUMN escalate_to VARCHAR(128);
+ALTER TABLE requests ADD COLUMN sla_breached_at BIGINT;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS request_tags (
+	request_id VARCHAR(128) NOT NULL,
+	tag VARCHAR(64) NOT NULL,
+	PRIMARY KEY (request_id, tag)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE INDEX idx_request_tags_tag ON request_tags(tag);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS request_search (
+	request_id VARCHAR(128) PRIMARY KEY,
+	title TEXT NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	answer TEXT NOT NULL,
+	FULLTEXT INDEX idx_request_search (title, body, answer)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO request_search(request_id, title, body, answer)
+SELECT r.request_id, r.title,
+	CASE WHEN b.data IS NOT NULL AND b.encoding IS NULL THEN b.data ELSE COALESCE(r.body, '') END,
+	TRIM(CONCAT(COALESCE(a.action, ''), ' ', COALESCE(a.text, '')))
+FROM requests r
+LEFT JOIN bodies b ON b.hash = r.body_hash
+LEFT JOIN answers a ON a.request_id = r.request_id;
@@ -0,0 +1,2 @@
+ALTER TABLE requests DROP COLUMN allow_uploads;
+DROP TABLE IF EXISTS attachments;
@@ -0,0 +1,4 @@
+ALTER TABLE events DROP COLUMN payload_encoding;
+DROP INDEX IF EXISTS idx_requests_body_hash;
+ALTER TABLE requests DROP COLUMN body_hash;
+DROP TABLE IF EXISTS bodies;
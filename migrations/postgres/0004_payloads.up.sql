@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS bodies (
+	hash TEXT PRIMARY KEY,
+	encoding TEXT,
+	data TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+
+ALTER TABLE requests ADD COLUMN body_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_requests_body_hash ON requests(body_hash);
+
+ALTER TABLE events ADD COLUMN payload_encoding TEXT;
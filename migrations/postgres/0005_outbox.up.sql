@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbox (
+	request_id TEXT PRIMARY KEY,
+	payload_json TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts BIGINT NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL,
+	last_error TEXT,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox(status, next_attempt_at);
@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN one_time_link TEXT;
+
+ALTER TABLE tokens ADD COLUMN bound_hash TEXT;
+
+ALTER TABLE tokens ADD COLUMN revoked_at BIGINT;
@@ -0,0 +1,3 @@
+ALTER TABLE tokens DROP COLUMN challenge_failures;
+ALTER TABLE tokens DROP COLUMN challenge_hash;
+ALTER TABLE requests DROP COLUMN challenge;
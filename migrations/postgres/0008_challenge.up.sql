@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN challenge TEXT;
+
+ALTER TABLE tokens ADD COLUMN challenge_hash TEXT;
+
+ALTER TABLE tokens ADD COLUMN challenge_failures BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE requests DROP COLUMN callback_secret;
+ALTER TABLE requests DROP COLUMN callback_url;
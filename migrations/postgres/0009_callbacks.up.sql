@@ -0,0 +1,3 @@
+ALTER TABLE requests ADD COLUMN callback_url TEXT;
+
+ALTER TABLE requests ADD COLUMN callback_secret TEXT;
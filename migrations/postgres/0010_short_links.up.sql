@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS short_links (
+	code_hash TEXT PRIMARY KEY,
+	request_id TEXT NOT NULL,
+	sealed TEXT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_short_links_request ON short_links(request_id);
@@ -0,0 +1 @@
+ALTER TABLE requests ADD COLUMN terminal_events TEXT;
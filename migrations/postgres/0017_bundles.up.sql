@@ -0,0 +1,16 @@
+ALTER TABLE requests ADD COLUMN bundle_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_requests_bundle ON requests(bundle_id);
+
+CREATE TABLE IF NOT EXISTS bundles (
+	bundle_id TEXT PRIMARY KEY,
+	request_id TEXT NOT NULL,
+	request_ids TEXT NOT NULL,
+	title TEXT NOT NULL,
+	body TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_bundles_request ON bundles(request_id);
@@ -0,0 +1,5 @@
+ALTER TABLE requests ADD COLUMN tenant TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_requests_tenant ON requests(tenant, created_at);
+
+ALTER TABLE api_keys ADD COLUMN tenant TEXT;
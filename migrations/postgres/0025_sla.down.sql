@@ -0,0 +1,4 @@
+ALTER TABLE requests DROP COLUMN sla_breached_at;
+ALTER TABLE requests DROP COLUMN escalate_to;
+ALTER TABLE requests DROP COLUMN sla_at;
+ALTER TABLE requests DROP COLUMN sla_seconds;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS request_search (
+	request_id TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	body TEXT NOT NULL,
+	answer TEXT NOT NULL,
+	doc tsvector GENERATED ALWAYS AS (to_tsvector('simple', title || ' ' || body || ' ' || answer)) STORED
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_search_doc ON request_search USING GIN (doc);
+
+INSERT INTO request_search(request_id, title, body, answer)
+SELECT r.request_id, r.title,
+	CASE WHEN b.data IS NOT NULL AND b.encoding IS NULL THEN b.data ELSE COALESCE(r.body, '') END,
+	TRIM(COALESCE(a.action, '') || ' ' || COALESCE(a.text, ''))
+FROM requests r
+LEFT JOIN bodies b ON b.hash = r.body_hash
+LEFT JOIN answers a ON a.request_id = r.request_id
+ON CONFLICT (request_id) DO NOTHING;
@@ -0,0 +1 @@
+ALTER TABLE answers ADD COLUMN redacted_at BIGINT;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS events;
+DROP TABLE IF EXISTS answers;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS requests;
@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS requests (
+	request_id TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	body TEXT NOT NULL,
+	mcd TEXT NOT NULL,
+	status TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	jsonforms_schema_json TEXT,
+	jsonforms_uischema_json TEXT,
+	jsonforms_data_json TEXT,
+	jsonforms_submit_label TEXT,
+	jsonforms_renderer TEXT
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	request_id TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	used_at INTEGER,
+	PRIMARY KEY(request_id, token_hash)
+);
+
+CREATE TABLE IF NOT EXISTS answers (
+	request_id TEXT PRIMARY KEY,
+	action TEXT,
+	text TEXT,
+	payload_json TEXT,
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS events (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	request_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	payload_json TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_request_seq ON events(request_id, seq);
@@ -0,0 +1,75 @@
+ALTER TABLE requests ADD COLUMN responders_mode TEXT;
+ALTER TABLE requests ADD COLUMN responders_min INTEGER;
+ALTER TABLE requests ADD COLUMN approval_json TEXT;
+ALTER TABLE requests ADD COLUMN steps_json TEXT;
+ALTER TABLE requests ADD COLUMN current_step INTEGER;
+ALTER TABLE requests ADD COLUMN session_id TEXT;
+ALTER TABLE requests ADD COLUMN schedule_id TEXT;
+ALTER TABLE requests ADD COLUMN priority TEXT;
+ALTER TABLE requests ADD COLUMN default_action TEXT;
+ALTER TABLE requests ADD COLUMN parent_request_id TEXT;
+
+ALTER TABLE tokens ADD COLUMN responder TEXT;
+ALTER TABLE tokens ADD COLUMN delegated_to TEXT;
+
+ALTER TABLE answers ADD COLUMN responder TEXT;
+
+CREATE TABLE IF NOT EXISTS drafts (
+	request_id TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	text TEXT,
+	payload_json TEXT,
+	updated_at INTEGER NOT NULL,
+	PRIMARY KEY(request_id, token_hash)
+);
+
+CREATE TABLE IF NOT EXISTS responses (
+	request_id TEXT NOT NULL,
+	responder TEXT NOT NULL,
+	action TEXT,
+	text TEXT,
+	payload_json TEXT,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY(request_id, responder)
+);
+
+CREATE TABLE IF NOT EXISTS step_answers (
+	request_id TEXT NOT NULL,
+	step INTEGER NOT NULL,
+	action TEXT,
+	text TEXT,
+	payload_json TEXT,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY(request_id, step)
+);
+
+CREATE TABLE IF NOT EXISTS schedules (
+	schedule_id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	cron TEXT NOT NULL,
+	timezone TEXT,
+	ask_json TEXT NOT NULL,
+	source TEXT NOT NULL,
+	enabled INTEGER NOT NULL DEFAULT 1,
+	next_run_at INTEGER,
+	last_run_at INTEGER,
+	last_request_id TEXT,
+	last_error TEXT,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS templates (
+	name TEXT PRIMARY KEY,
+	description TEXT,
+	ask_json TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_asks (
+	request_id TEXT PRIMARY KEY,
+	send_at INTEGER NOT NULL,
+	payload_json TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS attachments (
+	attachment_id TEXT PRIMARY KEY,
+	request_id TEXT,
+	kind TEXT NOT NULL,
+	name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	storage_key TEXT NOT NULL,
+	responder TEXT,
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_request ON attachments(request_id);
+
+ALTER TABLE requests ADD COLUMN allow_uploads INTEGER;
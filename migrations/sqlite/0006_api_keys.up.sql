@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	key_id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	key_prefix TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	rate_limit_per_minute INTEGER NOT NULL DEFAULT 0,
+	source TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	last_used_at INTEGER
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS reports (
+	name TEXT PRIMARY KEY,
+	cron TEXT NOT NULL,
+	next_run_at INTEGER NOT NULL,
+	last_run_at INTEGER NOT NULL
+);
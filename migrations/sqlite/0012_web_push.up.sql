@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	id TEXT PRIMARY KEY,
+	endpoint TEXT NOT NULL UNIQUE,
+	p256dh TEXT NOT NULL,
+	auth TEXT NOT NULL,
+	name TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	last_sent_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS push_vapid_keys (
+	id INTEGER PRIMARY KEY,
+	private_key TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
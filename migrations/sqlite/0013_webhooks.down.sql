@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_requests_updated;
+DROP TABLE IF EXISTS webhooks;
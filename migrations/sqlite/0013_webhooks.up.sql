@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+	id TEXT PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret TEXT,
+	events TEXT NOT NULL,
+	name TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	last_status INTEGER,
+	last_error TEXT,
+	last_sent_at INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_requests_updated ON requests(updated_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_requests_content_hash;
+ALTER TABLE requests DROP COLUMN content_hash;
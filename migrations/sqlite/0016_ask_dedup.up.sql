@@ -0,0 +1,3 @@
+ALTER TABLE requests ADD COLUMN content_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_requests_content_hash ON requests(content_hash);
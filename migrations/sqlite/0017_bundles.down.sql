@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS bundles;
+DROP INDEX IF EXISTS idx_requests_bundle;
+ALTER TABLE requests DROP COLUMN bundle_id;
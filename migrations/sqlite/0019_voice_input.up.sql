@@ -0,0 +1 @@
+ALTER TABLE requests ADD COLUMN voice_input INTEGER;
@@ -0,0 +1,3 @@
+ALTER TABLE api_keys DROP COLUMN tenant;
+DROP INDEX IF EXISTS idx_requests_tenant;
+ALTER TABLE requests DROP COLUMN tenant;
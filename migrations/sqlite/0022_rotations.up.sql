@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS rotation_overrides (
+	rotation TEXT PRIMARY KEY,
+	contact TEXT NOT NULL,
+	until_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);
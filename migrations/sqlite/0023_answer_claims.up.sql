@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS answer_claims (
+	request_id TEXT PRIMARY KEY,
+	page_id TEXT NOT NULL,
+	responder TEXT,
+	until_at INTEGER NOT NULL
+);
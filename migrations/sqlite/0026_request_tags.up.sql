@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS request_tags (
+	request_id TEXT NOT NULL,
+	tag TEXT NOT NULL,
+	PRIMARY KEY (request_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_tags_tag ON request_tags(tag);
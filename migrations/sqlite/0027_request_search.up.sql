@@ -0,0 +1,9 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS request_search USING fts5(request_id UNINDEXED, title, body, answer);
+
+INSERT INTO request_search(request_id, title, body, answer)
+SELECT r.request_id, r.title,
+	CASE WHEN b.data IS NOT NULL AND b.encoding IS NULL THEN b.data ELSE r.body END,
+	TRIM(COALESCE(a.action, '') || ' ' || COALESCE(a.text, ''))
+FROM requests r
+LEFT JOIN bodies b ON b.hash = r.body_hash
+LEFT JOIN answers a ON a.request_id = r.request_id;
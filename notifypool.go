@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The outbox sends through a fixed number of workers (notify_workers, 8 by
+// default) rather than one goroutine per due row, and each channel has its
+// own limit on top (notify_channel_limits): by default at most 4 apprise
+// processes run at once, so a burst of asks does not fork hundreds of them.
+// Rows that find no free worker stay pending, unclaimed, until one is free.
+// GET /v1/outbox and the admin stats report the queue: due rows waiting for
+// a worker and sends in progress.
+
+const defaultNotifyWorkers = 8
+
+var defaultNotifyChannelLimits = map[string]int{"apprise": 4}
+
+type notifyPool struct {
+	slots   chan struct{}
+	limits  map[string]chan struct{}
+	sending atomic.Int64
+}
+
+func newNotifyPool(workers int, limits map[string]int) *notifyPool {
+	p := &notifyPool{slots: make(chan struct{}, workers), limits: map[string]chan struct{}{}}
+	for ch, n := range limits {
+		if n > 0 {
+			p.limits[ch] = make(chan struct{}, n)
+		}
+	}
+	return p
+}
+
+// tryStart takes a worker, or reports false when all are busy.
+func (p *notifyPool) tryStart() bool {
+	select {
+	case p.slots <- struct{}{}:
+		p.sending.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *notifyPool) done() {
+	p.sending.Add(-1)
+	<-p.slots
+}
+
+// acquire waits for a free slot of channel and returns the func that frees
+// it. Channels without a limit, and a nil pool, never wait.
+func (p *notifyPool) acquire(ctx context.Context, channel string) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	sem, ok := p.limits[channel]
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// parseChannelLimits parses "apprise=4,serverchan=8".
+func parseChannelLimits(s string) (map[string]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	out := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		ch, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid notify_channel_limits entry %q (want channel=n)", part)
+		}
+		out[strings.ToLower(strings.TrimSpace(ch))] = n
+	}
+	return out, nil
+}
+
+func (s *store) countDueNotifications(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM outbox WHERE status=? AND next_attempt_at<=?`,
+		outboxStatusPending, time.Now().Unix(),
+	).Scan(&n)
+	return n, err
+}
+
+// notifyQueue is the queue summary in GET /v1/outbox and the admin stats.
+func (s *server) notifyQueue(ctx context.Context) (map[string]any, error) {
+	due, err := s.db.countDueNotifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"due":     due,
+		"sending": s.notify.sending.Load(),
+		"workers": cap(s.notify.slots),
+	}, nil
+}
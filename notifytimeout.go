@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	serverchan_sdk "github.com/easychen/serverchan-sdk-golang"
+)
+
+// Notification timeouts. Each send (one outbox attempt, a delegate or a
+// doctor test) gets notify_timeout_seconds (60 by default), and an ask can
+// set its own. A slow apprise plugin is killed and an unreachable chat API is
+// given up on when time runs out; the attempt fails with reason "timeout"
+// and is retried like any other failure, ending in notify.failed once
+// notify_max_attempts is reached.
+
+const (
+	defaultNotifyTimeoutSeconds = 60
+	maxNotifyTimeoutSeconds     = 600
+)
+
+func normalizeNotifyTimeout(ar *askRequest) error {
+	if ar.NotifyTimeoutSeconds < 0 || ar.NotifyTimeoutSeconds > maxNotifyTimeoutSeconds {
+		return badAskError("notify_timeout_seconds must be between 1 and 600")
+	}
+	return nil
+}
+
+// notifyTimeout returns how long one send for ar may take.
+func (s *server) notifyTimeout(ar askRequest) time.Duration {
+	n := ar.NotifyTimeoutSeconds
+	if n <= 0 {
+		n = s.cfg().NotifyTimeoutSeconds
+	}
+	return time.Duration(n) * time.Second
+}
+
+// timedOut rewrites a send error caused by the deadline of ctx into a
+// notifyError with reason "timeout", keeping the channel and output.
+func timedOut(ctx context.Context, err error, timeout time.Duration) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	var ne *notifyError
+	if !errors.As(err, &ne) {
+		ne = &notifyError{fields: map[string]any{}}
+	}
+	ne.fields["error"] = fmt.Sprintf("notification timed out after %s", timeout)
+	ne.fields["reason"] = "timeout"
+	return ne
+}
+
+// scSend is serverchan_sdk.ScSend bounded by ctx. The SDK has no context of
+// its own, so on timeout the request is abandoned rather than cancelled.
+func scSend(ctx context.Context, sendkey, title, desp string, options *serverchan_sdk.ScSendOptions) (*serverchan_sdk.ScSendResponse, error) {
+	type result struct {
+		resp *serverchan_sdk.ScSendResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := serverchan_sdk.ScSend(sendkey, title, desp, options)
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifications go through an outbox: creating an ask writes its delivery to
+// the outbox table in the same request that stores the ask, and a worker
+// pushes due rows. A crash before the push therefore only delays it until the
+// next start (or until another instance picks the row up), and a failed push
+// is retried with backoff before the request ends as notify_failed. Delivery is
+// at least once: a process that dies mid-push may repeat it.
+
+const (
+	outboxStatusPending = "pending"
+	outboxStatusSending = "sending"
+	outboxStatusSent    = "sent"
+	outboxStatusFailed  = "failed"
+	// outboxStatusSkipped marks rows whose request finished (answered,
+	// cancelled, expired) before the push went out.
+	outboxStatusSkipped = "skipped"
+
+	defaultNotifyMaxAttempts = 3
+	outboxPollInterval       = time.Second
+	outboxBatch              = 100
+	outboxFirstRetry         = 5 * time.Second
+	outboxMaxRetry           = 5 * time.Minute
+	// A row stuck in sending this long belongs to a process that died; it is
+	// claimed again.
+	outboxLease = 5 * time.Minute
+)
+
+type outboxEntry struct {
+	RequestID     string
+	Status        string
+	Attempts      int
+	NextAttemptAt int64
+	LastError     string
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+func (e outboxEntry) view() map[string]any {
+	m := map[string]any{
+		"request_id": e.RequestID,
+		"status":     e.Status,
+		"attempts":   e.Attempts,
+		"last_error": nullIfEmpty(e.LastError),
+		"created_at": unixOrNil(e.CreatedAt),
+		"updated_at": unixOrNil(e.UpdatedAt),
+	}
+	if e.Status == outboxStatusPending {
+		m["next_attempt_at"] = unixOrNil(e.NextAttemptAt)
+	}
+	return m
+}
+
+// enqueueNotification adds the delivery for reqID. Enqueueing the same
+// request twice keeps the first row.
+func (s *store) enqueueNotification(ctx context.Context, reqID string, d scheduledDelivery, at time.Time) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO outbox(request_id,payload_json,status,attempts,next_attempt_at,created_at,updated_at) VALUES(?,?,?,0,?,?,?)`,
+		reqID, string(b), outboxStatusPending, at.Unix(), now, now,
+	)
+	if err != nil && !isUniqueViolation(err) {
+		return err
+	}
+	return nil
+}
+
+// listDueNotifications returns rows ready to be claimed.
+func (s *store) listDueNotifications(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT request_id FROM outbox WHERE (status=? AND next_attempt_at<=?) OR (status=? AND updated_at<?) ORDER BY next_attempt_at ASC LIMIT ?`,
+		outboxStatusPending, now.Unix(), outboxStatusSending, now.Add(-outboxLease).Unix(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// claimNotification atomically moves a due row to sending and counts the
+// attempt. ok=false means another worker got it first.
+func (s *store) claimNotification(ctx context.Context, reqID string, now time.Time) (d scheduledDelivery, attempts int, ok bool, err error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox SET status=?, attempts=attempts+1, updated_at=? WHERE request_id=? AND ((status=? AND next_attempt_at<=?) OR (status=? AND updated_at<?))`,
+		outboxStatusSending, now.Unix(), reqID,
+		outboxStatusPending, now.Unix(), outboxStatusSending, now.Add(-outboxLease).Unix(),
+	)
+	if err != nil {
+		return scheduledDelivery{}, 0, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return scheduledDelivery{}, 0, false, nil
+	}
+	var raw string
+	if err := s.db.QueryRowContext(ctx, `SELECT payload_json, attempts FROM outbox WHERE request_id=?`, reqID).Scan(&raw, &attempts); err != nil {
+		return scheduledDelivery{}, 0, false, err
+	}
+	if err := json.Unmarshal([]byte(raw), &d); err != nil {
+		return scheduledDelivery{}, 0, false, err
+	}
+	return d, attempts, true, nil
+}
+
+// finishNotification records a final outcome. The payload is kept so that a
+// link rotation can send the delivery again (see tokens.go).
+func (s *store) finishNotification(ctx context.Context, reqID, status, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox SET status=?, last_error=?, updated_at=? WHERE request_id=?`,
+		status, nullIfEmpty(lastError), time.Now().Unix(), reqID,
+	)
+	return err
+}
+
+func (s *store) deferNotification(ctx context.Context, reqID string, at time.Time, lastError string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox SET status=?, next_attempt_at=?, last_error=?, updated_at=? WHERE request_id=?`,
+		outboxStatusPending, at.Unix(), nullIfEmpty(lastError), time.Now().Unix(), reqID,
+	)
+	return err
+}
+
+// retryNotificationNow makes a pending row due immediately. ok=false means
+// the row is not waiting for a retry.
+func (s *store) retryNotificationNow(ctx context.Context, reqID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox SET next_attempt_at=?, updated_at=? WHERE request_id=? AND status=?`,
+		time.Now().Unix(), time.Now().Unix(), reqID, outboxStatusPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const outboxSelect = `SELECT request_id, status, attempts, next_attempt_at, last_error, created_at, updated_at FROM outbox`
+
+func scanOutboxEntry(row interface{ Scan(...any) error }) (outboxEntry, error) {
+	var e outboxEntry
+	var lastError sql.NullString
+	if err := row.Scan(&e.RequestID, &e.Status, &e.Attempts, &e.NextAttemptAt, &lastError, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return outboxEntry{}, err
+	}
+	e.LastError = lastError.String
+	return e, nil
+}
+
+func (s *store) getNotification(ctx context.Context, reqID string) (outboxEntry, error) {
+	return scanOutboxEntry(s.db.QueryRowContext(ctx, outboxSelect+` WHERE request_id=?`, reqID))
+}
+
+func (s *store) listNotifications(ctx context.Context, status string, before int64, limit int) ([]outboxEntry, error) {
+	var where []string
+	var args []any
+	if status != "" {
+		where = append(where, "status=?")
+		args = append(args, status)
+	}
+	if before > 0 {
+		where = append(where, "created_at<?")
+		args = append(args, before)
+	}
+	q := outboxSelect
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY created_at DESC, request_id DESC LIMIT ?"
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []outboxEntry
+	for rows.Next() {
+		e, err := scanOutboxEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// releaseScheduledStatus moves a scheduled request back to created once its
+// delivery is being sent; any other status is left alone.
+func (s *store) releaseScheduledStatus(ctx context.Context, reqID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE requests SET status='created', updated_at=? WHERE request_id=? AND status='scheduled'`,
+		time.Now().Unix(), reqID,
+	)
+	return err
+}
+
+// outboxRetryDelay is the wait after the given failed attempt: 5s, 20s, 80s,
+// ... capped at outboxMaxRetry.
+func outboxRetryDelay(attempt int) time.Duration {
+	d := outboxFirstRetry
+	for i := 1; i < attempt && d < outboxMaxRetry; i++ {
+		d *= 4
+	}
+	return min(d, outboxMaxRetry)
+}
+
+// wakeOutbox nudges the worker so fresh rows go out without waiting for the
+// next poll.
+func (s *server) wakeOutbox() {
+	if s.outboxWake == nil {
+		return
+	}
+	select {
+	case s.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *server) outboxLoop(ctx context.Context) {
+	t := time.NewTicker(outboxPollInterval)
+	defer t.Stop()
+	for {
+		s.drainOutbox(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-s.outboxWake:
+		}
+	}
+}
+
+func (s *server) drainOutbox(ctx context.Context) {
+	now := time.Now()
+	ids, err := s.db.listDueNotifications(ctx, now, outboxBatch)
+	if err != nil {
+		slog.Error("outbox", "error", err)
+		return
+	}
+	for _, id := range ids {
+		// With all workers busy the rest stays pending; a finishing send
+		// wakes the loop again (see notifypool.go).
+		if !s.notify.tryStart() {
+			return
+		}
+		d, attempts, ok, err := s.db.claimNotification(ctx, id, now)
+		if err != nil {
+			slog.Error("outbox: claim", "request_id", id, "error", err)
+		}
+		if err != nil || !ok {
+			s.notify.done()
+			continue
+		}
+		// Sends outlive the loop's context so shutdown can let them finish.
+		s.goInflight(func() {
+			defer s.wakeOutbox()
+			defer s.notify.done()
+			s.sendFromOutbox(context.WithoutCancel(ctx), id, d, attempts)
+		})
+	}
+}
+
+// sendFromOutbox performs one delivery attempt for a claimed row.
+func (s *server) sendFromOutbox(ctx context.Context, requestID string, d scheduledDelivery, attempt int) {
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = s.db.finishNotification(ctx, requestID, outboxStatusSkipped, "request not found")
+			return
+		}
+		_ = s.db.deferNotification(ctx, requestID, time.Now().Add(outboxRetryDelay(attempt)), err.Error())
+		return
+	}
+	switch status {
+	case "scheduled":
+		_ = s.db.releaseScheduledStatus(ctx, requestID)
+	case "created":
+	case "delivered":
+		// The push went out before the sender died. Requeueing a
+		// notification (renotify, rotated links) therefore also sets the
+		// request back to created.
+		_ = s.db.finishNotification(ctx, requestID, outboxStatusSent, "")
+		return
+	default:
+		_ = s.db.finishNotification(ctx, requestID, outboxStatusSkipped, "request "+status)
+		return
+	}
+
+	err = s.dispatchNotifications(ctx, requestID, d.Ask, d.InteractionURL, d.responderLinks())
+	if err == nil {
+		_ = s.db.finishNotification(ctx, requestID, outboxStatusSent, "")
+		s.settleBundleNotification(ctx, requestID, nil)
+		return
+	}
+	if attempt < s.cfg().NotifyMaxAttempts {
+		_ = s.db.deferNotification(ctx, requestID, time.Now().Add(outboxRetryDelay(attempt)), err.Error())
+		return
+	}
+	_ = s.db.finishNotification(ctx, requestID, outboxStatusFailed, err.Error())
+	fields := notifyErrorFields(err)
+	fields["attempts"] = attempt
+	s.failNotify(ctx, requestID, fields)
+	s.settleBundleNotification(ctx, requestID, fields)
+}
+
+// handleOutbox serves GET /v1/outbox and POST /v1/outbox/{request_id}/retry.
+func (s *server) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/outbox"), "/")
+	if rest == "" {
+		s.handleListOutbox(w, r)
+		return
+	}
+	requestID, action, _ := strings.Cut(rest, "/")
+	if !isValidRequestID(requestID) {
+		http.Error(w, "invalid request_id", http.StatusBadRequest)
+		return
+	}
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		e, err := s.db.getNotification(r.Context(), requestID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, e.view())
+	case "retry":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ok, err := s.db.retryNotificationNow(r.Context(), requestID)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusConflict, map[string]any{
+				"request_id": requestID,
+				"error":      "notification is not waiting for a retry",
+			})
+			return
+		}
+		s.wakeOutbox()
+		writeJSON(w, http.StatusAccepted, map[string]any{"request_id": requestID, "status": outboxStatusPending})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) handleListOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := 50
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		limit = min(v, 500)
+	}
+	var before int64
+	if v, err := strconv.ParseInt(q.Get("before"), 10, 64); err == nil && v > 0 {
+		before = v
+	}
+	list, err := s.db.listNotifications(r.Context(), strings.TrimSpace(q.Get("status")), before, limit)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, e := range list {
+		out = append(out, e.view())
+	}
+	queue, err := s.notifyQueue(r.Context())
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"notifications": out, "queue": queue}
+	if len(list) == limit {
+		resp["next_before"] = list[len(list)-1].CreatedAt
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Agents tend to send long bodies (diffs, logs) and often the same one across
+// a session. With dedup_bodies, bodies of minDedupBodyBytes or more are kept
+// once in the bodies table, keyed by their SHA-256, and requests (and the
+// request.created event, as body_sha256) reference them. Independently,
+// payload_compress_bytes gzips event payloads and stored bodies from that
+// size on. Both only affect rows written after they are turned on.
+
+const (
+	payloadEncodingGzip = "gzip"
+	minDedupBodyBytes   = 1024
+	// Bodies are written before their request row; the sweep leaves fresh
+	// ones alone so it never races a request being created.
+	orphanBodyGrace = time.Hour
+)
+
+// encodeStoredText gzips s (base64 so it fits TEXT columns) when it is at
+// least threshold bytes and compression actually helps. encoding is empty for
+// plain text.
+func encodeStoredText(s string, threshold int) (data string, encoding sql.NullString) {
+	if threshold <= 0 || len(s) < threshold {
+		return s, sql.NullString{}
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		return s, sql.NullString{}
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(s) {
+		return s, sql.NullString{}
+	}
+	return encoded, sql.NullString{String: payloadEncodingGzip, Valid: true}
+}
+
+func decodeStoredText(data string, encoding sql.NullString) (string, error) {
+	switch encoding.String {
+	case "":
+		return data, nil
+	case payloadEncodingGzip:
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	}
+	return "", fmt.Errorf("unknown payload encoding %q", encoding.String)
+}
+
+// decodeEventPayload returns an event's JSON payload; undecodable rows come
+// back as an empty object rather than breaking a whole replay.
+func decodeEventPayload(data string, encoding sql.NullString) []byte {
+	out, err := decodeStoredText(data, encoding)
+	if err != nil {
+		return []byte("{}")
+	}
+	return []byte(out)
+}
+
+// storeBody returns what goes into requests.body and requests.body_hash: the
+// body itself, or an empty string and the hash of the shared copy.
+func (s *store) storeBody(ctx context.Context, body string) (string, sql.NullString, error) {
+	if !s.dedupBodies || len(body) < minDedupBodyBytes {
+		return body, sql.NullString{}, nil
+	}
+	hash := sha256Hex(body)
+	var exists int
+	err := s.db.QueryRowContext(ctx, `SELECT 1 FROM bodies WHERE hash=?`, hash).Scan(&exists)
+	if err == nil {
+		return "", sql.NullString{String: hash, Valid: true}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", sql.NullString{}, err
+	}
+	data, encoding := encodeStoredText(body, s.compressBytes)
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO bodies(hash,encoding,data,size,created_at) VALUES(?,?,?,?,?)`,
+		hash, encoding, data, len(body), time.Now().Unix(),
+	); err != nil && !isUniqueViolation(err) {
+		return "", sql.NullString{}, err
+	}
+	return "", sql.NullString{String: hash, Valid: true}, nil
+}
+
+// withBodyRefs returns args for notify events: with dedup_bodies, a long body
+// inside an argument is replaced by a reference to its shared copy instead of
+// being repeated in every event.
+func (s *store) withBodyRefs(args []string, body string) []string {
+	if !s.dedupBodies || len(body) < minDedupBodyBytes {
+		return args
+	}
+	ref := "<body sha256:" + sha256Hex(body) + ">"
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = strings.Replace(a, body, ref, 1)
+	}
+	return out
+}
+
+// bodyJoin is added to queries that read requests.body (aliased r); bodyText
+// turns b.encoding and b.data back into the body.
+const bodyJoin = ` LEFT JOIN bodies b ON b.hash = r.body_hash`
+
+func bodyText(inline string, encoding, data sql.NullString) string {
+	if !data.Valid {
+		return inline
+	}
+	out, err := decodeStoredText(data.String, encoding)
+	if err != nil {
+		return inline
+	}
+	return out
+}
+
+// pruneOrphanBodies deletes shared bodies no request references anymore.
+func (s *store) pruneOrphanBodies(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM bodies WHERE created_at<? AND hash NOT IN (SELECT body_hash FROM requests WHERE body_hash IS NOT NULL)`,
+		time.Now().Add(-orphanBodyGrace).Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Auto-approval policies. policy_file names a YAML file of rules; an ask that
+// matches one is answered by it at once, without notifying anybody, and ends
+// with user.submitted carrying answered_by "policy" and the rule's name.
+// That keeps routine questions, such as an agent asking to run a read-only
+// command, from paging a person:
+//
+//	rules:
+//	  - name: read-only commands
+//	    title: '^Allow Bash\b'
+//	    body: '(?m)^\$ (ls|pwd|git (status|diff|log))( [^;&|<>$]*)?$'
+//	    action: allow
+//
+// title and body are regular expressions, priority an exact level; a rule
+// matches when all the conditions it sets hold, and the first matching rule
+// wins. A rule answers with action (which must be one of the ask's buttons,
+// if it has any) and/or text. Asks with steps, JSON Forms, collect or quorum
+// responders, or a later send_at are always left to people. The file is read
+// at start and with every config reload.
+
+type policyRule struct {
+	Name     string `yaml:"name"`
+	Title    string `yaml:"title"`
+	Body     string `yaml:"body"`
+	Priority string `yaml:"priority"`
+	Action   string `yaml:"action"`
+	Text     string `yaml:"text"`
+
+	title, body *regexp.Regexp
+}
+
+func (c *Config) normalizePolicies() error {
+	c.PolicyFile = strings.TrimSpace(c.PolicyFile)
+	c.policies = nil
+	if c.PolicyFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(c.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("policy_file: %w", err)
+	}
+	var f struct {
+		Rules []policyRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("policy_file: %w", err)
+	}
+	for i := range f.Rules {
+		p := &f.Rules[i]
+		p.Name = strings.TrimSpace(p.Name)
+		p.Action = strings.TrimSpace(p.Action)
+		p.Priority = strings.TrimSpace(p.Priority)
+		if p.Name == "" {
+			return fmt.Errorf("policy_file: rule %d has no name", i+1)
+		}
+		if p.Title == "" && p.Body == "" && p.Priority == "" {
+			return fmt.Errorf("policy_file: rule %q has no conditions", p.Name)
+		}
+		if p.Action == "" && p.Text == "" {
+			return fmt.Errorf("policy_file: rule %q has neither action nor text", p.Name)
+		}
+		if p.title, err = compilePolicyRe(p.Title); err != nil {
+			return fmt.Errorf("policy_file: rule %q: title: %w", p.Name, err)
+		}
+		if p.body, err = compilePolicyRe(p.Body); err != nil {
+			return fmt.Errorf("policy_file: rule %q: body: %w", p.Name, err)
+		}
+	}
+	c.policies = f.Rules
+	return nil
+}
+
+func compilePolicyRe(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func (p *policyRule) matches(ar askRequest) bool {
+	if p.title != nil && !p.title.MatchString(ar.Title) {
+		return false
+	}
+	if p.body != nil && !p.body.MatchString(ar.Body) {
+		return false
+	}
+	if p.Priority != "" && p.Priority != ar.Priority {
+		return false
+	}
+	if p.Action == "" {
+		return true
+	}
+	buttons := parseMCD(ar.MCD).Buttons
+	if len(buttons) == 0 {
+		return true
+	}
+	for _, b := range buttons {
+		if b.Value == p.Action {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPolicy returns the rule that answers ar, if any.
+func (s *server) matchPolicy(ar askRequest) *policyRule {
+	if len(ar.Steps) > 0 || !ar.sendAt.IsZero() {
+		return nil
+	}
+	if ar.JsonForms != nil && len(strings.TrimSpace(string(ar.JsonForms.Schema))) > 0 {
+		return nil
+	}
+	if ar.Responders != nil && isMultiAnswerMode(ar.Responders.Mode) {
+		return nil
+	}
+	policies := s.cfg().policies
+	for i := range policies {
+		if policies[i].matches(ar) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// answerByPolicy records rule's answer to requestID.
+func (s *server) answerByPolicy(ctx context.Context, requestID string, rule *policyRule) {
+	if err := s.db.insertAnswer(ctx, requestID, "", rule.Action, rule.Text, sql.NullString{}); err != nil {
+		return
+	}
+	if won, err := s.db.markSubmitted(ctx, requestID); err != nil || !won {
+		_ = s.db.deleteAnswer(ctx, requestID)
+		return
+	}
+	ev := s.mustNewEvent(ctx, requestID, "user.submitted", map[string]any{
+		"action":      rule.Action,
+		"text":        rule.Text,
+		"answered_by": "policy",
+		"policy":      rule.Name,
+	})
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+}
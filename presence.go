@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// presenceMinInterval bounds how often the same presence state is recorded
+// for one responder of a request, so a chatty page cannot flood the events
+// table.
+const presenceMinInterval = 10 * time.Second
+
+type presenceThrottle struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newPresenceThrottle() *presenceThrottle {
+	return &presenceThrottle{last: map[string]time.Time{}}
+}
+
+func (p *presenceThrottle) allow(requestID, responder, state string) bool {
+	key := requestID + "|" + responder + "|" + state
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.last[key]; ok && now.Sub(t) < presenceMinInterval {
+		return false
+	}
+	p.last[key] = now
+	if len(p.last) > 4096 {
+		for k, t := range p.last {
+			if now.Sub(t) >= presenceMinInterval {
+				delete(p.last, k)
+			}
+		}
+	}
+	return true
+}
+
+// handleUserBeacon serves POST /r/{id}/beacon, used by the interaction page
+// to report that the responder is looking at the page (state=viewing) or
+// typing an answer (state=typing).
+func (s *server) handleUserBeacon(w http.ResponseWriter, r *http.Request, requestID, status, responder string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	state := strings.ToLower(strings.TrimSpace(r.FormValue("state")))
+	var typ string
+	switch state {
+	case "viewing":
+		typ = "user.viewing"
+	case "typing":
+		typ = "user.typing"
+	default:
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	if status == "submitted" || status == "expired" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if state == "typing" {
+		s.claimTyping(r.Context(), requestID, r.FormValue("page"), responder)
+	}
+	if s.presence.allow(requestID, responder, state) {
+		data := map[string]any{}
+		if responder != "" {
+			data["responder"] = responder
+		}
+		ev := s.mustNewEvent(r.Context(), requestID, typ, data)
+		_ = s.persistTerminalAware(r.Context(), ev)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
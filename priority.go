@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Priority levels an ask can carry. The level picks the default expiry and
+// channels configured under `priorities`, and is translated into the native
+// priority flag of apprise services that have one.
+const (
+	priorityLow      = "low"
+	priorityNormal   = "normal"
+	priorityHigh     = "high"
+	priorityCritical = "critical"
+)
+
+var priorityLevels = []string{priorityLow, priorityNormal, priorityHigh, priorityCritical}
+
+// PriorityConfig overrides defaults for one priority level. Empty fields fall
+// back to the top-level settings.
+type PriorityConfig struct {
+	DefaultExpiresInSeconds int      `yaml:"default_expires_in_seconds"`
+	ServerChanSendKey       string   `yaml:"serverchan_sendkey"`
+	AppriseURLs             []string `yaml:"apprise_urls"`
+	// PushFlags controls whether apprise URLs get the level's native priority
+	// parameter (default true).
+	PushFlags *bool `yaml:"push_flags"`
+}
+
+func isPriorityLevel(level string) bool {
+	for _, l := range priorityLevels {
+		if level == l {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizePriority(ar *askRequest) error {
+	p := strings.ToLower(strings.TrimSpace(ar.Priority))
+	if p == "" {
+		p = priorityNormal
+	}
+	if !isPriorityLevel(p) {
+		return badAskError("priority must be one of low, normal, high, critical")
+	}
+	ar.Priority = p
+	return nil
+}
+
+func (c *Config) priority(level string) PriorityConfig {
+	if c.Priorities == nil {
+		return PriorityConfig{}
+	}
+	return c.Priorities[level]
+}
+
+// defaultExpiresFor returns the expiry used when an ask has no
+// expires_in_seconds: its level's, else its tenant's, else the server's.
+func (s *server) defaultExpiresFor(tenant, level string) int {
+	if v := s.cfg().priority(level).DefaultExpiresInSeconds; v > 0 {
+		return v
+	}
+	if t, ok := s.cfg().tenant(tenant); ok && t.DefaultExpiresInSeconds > 0 {
+		return t.DefaultExpiresInSeconds
+	}
+	return s.cfg().DefaultExpiresInSeconds
+}
+
+// priorityNotifyTarget returns the channels for asks without their own
+// responder targets. A level that configures channels replaces the defaults.
+func (s *server) priorityNotifyTarget(level string) notifyTarget {
+	pc := s.cfg().priority(level)
+	if strings.TrimSpace(pc.ServerChanSendKey) != "" || len(pc.AppriseURLs) > 0 {
+		return notifyTarget{ServerChanSendKey: pc.ServerChanSendKey, AppriseURLs: pc.AppriseURLs, WebPush: true}
+	}
+	return s.defaultNotifyTarget()
+}
+
+// appriseParamsByPriority maps apprise schemes to the query parameter and
+// values that express each level. Normal priority leaves URLs untouched.
+var appriseParamsByPriority = map[string]struct {
+	param  string
+	values map[string]string
+}{
+	"ntfy":  {"priority", map[string]string{priorityLow: "low", priorityHigh: "high", priorityCritical: "max"}},
+	"ntfys": {"priority", map[string]string{priorityLow: "low", priorityHigh: "high", priorityCritical: "max"}},
+	"bark":  {"level", map[string]string{priorityLow: "passive", priorityHigh: "timeSensitive", priorityCritical: "critical"}},
+	"barks": {"level", map[string]string{priorityLow: "passive", priorityHigh: "timeSensitive", priorityCritical: "critical"}},
+	"pover": {"priority", map[string]string{priorityLow: "low", priorityHigh: "high", priorityCritical: "emergency"}},
+}
+
+// withPriorityFlag adds the level's priority parameter to an apprise URL of a
+// known service. URLs that already set the parameter are left alone.
+func (s *server) withPriorityFlag(appriseURL, level string) string {
+	if pf := s.cfg().priority(level).PushFlags; pf != nil && !*pf {
+		return appriseURL
+	}
+	scheme, _, ok := strings.Cut(appriseURL, "://")
+	if !ok {
+		return appriseURL
+	}
+	spec, ok := appriseParamsByPriority[strings.ToLower(scheme)]
+	if !ok {
+		return appriseURL
+	}
+	value, ok := spec.values[level]
+	if !ok {
+		return appriseURL
+	}
+	u, err := url.Parse(appriseURL)
+	if err != nil {
+		return appriseURL
+	}
+	q := u.Query()
+	if q.Has(spec.param) {
+		return appriseURL
+	}
+	q.Set(spec.param, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// priorityConfigFromEnv reads ASK4ME_PRIORITY_<LEVEL>_DEFAULT_EXPIRES_IN_SECONDS,
+// _SERVERCHAN_SENDKEY, _APPRISE_URLS and _PUSH_FLAGS for dotenv configs.
+func priorityConfigFromEnv() map[string]PriorityConfig {
+	var out map[string]PriorityConfig
+	for _, level := range priorityLevels {
+		prefix := "ASK4ME_PRIORITY_" + strings.ToUpper(level) + "_"
+		pc := PriorityConfig{
+			DefaultExpiresInSeconds: parseEnvInt(envFirst(prefix + "DEFAULT_EXPIRES_IN_SECONDS")),
+			ServerChanSendKey:       strings.TrimSpace(envFirst(prefix + "SERVERCHAN_SENDKEY")),
+			AppriseURLs:             parseCSVStrings(envFirst(prefix + "APPRISE_URLS")),
+		}
+		if v := strings.TrimSpace(envFirst(prefix + "PUSH_FLAGS")); v != "" {
+			b := parseBoolQuery(v)
+			pc.PushFlags = &b
+		}
+		if pc.DefaultExpiresInSeconds == 0 && pc.ServerChanSendKey == "" && len(pc.AppriseURLs) == 0 && pc.PushFlags == nil {
+			continue
+		}
+		if out == nil {
+			out = map[string]PriorityConfig{}
+		}
+		out[level] = pc
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Custom events. The asker can post its own events to an ask with
+//
+//	POST /v1/requests/{id}/events {"type":"agent.still_working","message":"Running the tests"}
+//
+// They are stored and delivered like the server's events (SSE, webhooks,
+// the firehose), and an open interaction page shows the latest message, so
+// the person knows the agent is still busy. Custom types are dotted names
+// outside the server's own namespaces (request., user., notify., ...).
+//
+// An ask created with terminal_events lists custom types that end it: posting
+// one closes the ask as cancelled, and whoever waits on it (the blocking
+// POST /v1/ask, SSE, callback_url) gets that event as the final one instead
+// of request.cancelled.
+
+const (
+	maxTerminalEvents   = 8
+	customMessageMax    = 500
+	customEventTypeMax  = 64
+	customEventDataSize = 16 << 10
+)
+
+var reCustomEventType = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)+$`)
+
+// reservedEventNamespaces are the prefixes of the server's own event types.
+var reservedEventNamespaces = []string{"request", "user", "notify", "callback", "answer", "webhook", "page", "session", "events"}
+
+// isCustomEventType reports whether typ may be posted by the asker.
+func isCustomEventType(typ string) bool {
+	if len(typ) > customEventTypeMax || !reCustomEventType.MatchString(typ) {
+		return false
+	}
+	ns, _, _ := strings.Cut(typ, ".")
+	for _, r := range reservedEventNamespaces {
+		if ns == r {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeTerminalEvents(ar *askRequest) error {
+	if len(ar.TerminalEvents) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	out := make([]string, 0, len(ar.TerminalEvents))
+	for _, t := range ar.TerminalEvents {
+		t = strings.TrimSpace(t)
+		if !isCustomEventType(t) {
+			return badAskError("terminal_events: " + truncate(t, customEventTypeMax) + " is not a custom event type (e.g. agent.done)")
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxTerminalEvents {
+		return badAskError("terminal_events: too many event types")
+	}
+	ar.TerminalEvents = out
+	return nil
+}
+
+// getTerminalEvents returns the custom event types that end the request.
+func (s *store) getTerminalEvents(ctx context.Context, reqID string) ([]string, error) {
+	var v sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT terminal_events FROM requests WHERE request_id=?`, reqID).Scan(&v); err != nil {
+		return nil, err
+	}
+	if v.String == "" {
+		return nil, nil
+	}
+	return strings.Split(v.String, ","), nil
+}
+
+// latestCustomEvent returns the request's most recent custom event and when
+// it was recorded.
+func (s *store) latestCustomEvent(ctx context.Context, reqID string) (Event, int64, bool, error) {
+	var where strings.Builder
+	args := []any{reqID}
+	for _, ns := range reservedEventNamespaces {
+		where.WriteString(` AND type NOT LIKE ?`)
+		args = append(args, ns+".%")
+	}
+	var id, typ, payload string
+	var encoding sql.NullString
+	var at int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT event_id, type, payload_json, payload_encoding, created_at FROM events WHERE request_id=?`+where.String()+` ORDER BY seq DESC LIMIT 1`,
+		args...,
+	).Scan(&id, &typ, &payload, &encoding, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Event{}, 0, false, nil
+	}
+	if err != nil {
+		return Event{}, 0, false, err
+	}
+	return Event{ID: id, Type: typ, RequestID: reqID, Data: json.RawMessage(decodeEventPayload(payload, encoding))}, at, true, nil
+}
+
+// customMessage is the text the page shows for a custom event: its message,
+// or else its type.
+func customMessage(ev Event) string {
+	var d struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(ev.Data, &d) == nil && d.Message != "" {
+		return d.Message
+	}
+	return ev.Type
+}
+
+// pageProgress turns a custom event into the page.progress event sent to an
+// open page. closed is set when the event ended the request.
+func pageProgress(ev Event, terminal []string) Event {
+	b, _ := json.Marshal(map[string]any{
+		"type":    ev.Type,
+		"message": customMessage(ev),
+		"closed":  isTerminalEventType(terminal, ev.Type),
+	})
+	return Event{ID: ev.ID, Type: "page.progress", RequestID: ev.RequestID, Data: json.RawMessage(b)}
+}
+
+// handlePostRequestEvent serves POST /v1/requests/{id}/events. The body is
+// {"type": "...", "message": "...", "data": {...}}; message is shown on the
+// page and data is passed through to consumers.
+func (s *server) handlePostRequestEvent(w http.ResponseWriter, r *http.Request, requestID string) {
+	ctx := r.Context()
+	var body struct {
+		Type    string          `json:"type"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	typ := strings.TrimSpace(body.Type)
+	if !isCustomEventType(typ) {
+		http.Error(w, "type must be a dotted custom event type outside request., user., notify., callback., answer., webhook., page., session. and events.", http.StatusBadRequest)
+		return
+	}
+	data := map[string]any{}
+	if len(body.Data) > 0 && string(body.Data) != "null" {
+		if len(body.Data) > customEventDataSize || json.Unmarshal(body.Data, &data) != nil {
+			http.Error(w, "data must be a JSON object of at most 16 KiB", http.StatusBadRequest)
+			return
+		}
+	}
+	if msg := strings.TrimSpace(body.Message); msg != "" {
+		data["message"] = truncate(msg, customMessageMax)
+	}
+
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if isTerminalStatus(status) {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request already finished",
+		})
+		return
+	}
+
+	terminal := isTerminalEventType(s.terminalEventTypes(ctx, requestID), typ)
+	if terminal {
+		if _, err := s.db.deleteScheduled(ctx, requestID); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.updateRequestStatus(ctx, requestID, "cancelled"); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		status = "cancelled"
+	}
+	ev := s.mustNewEvent(ctx, requestID, typ, data)
+	if err := s.persistTerminalAware(ctx, ev); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if terminal {
+		s.setTerminal(ev)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"request_id": requestID,
+		"event_id":   ev.ID,
+		"terminal":   terminal,
+		"status":     status,
+	})
+}
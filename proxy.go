@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Behind nginx, Caddy or Cloudflare every connection comes from the proxy.
+// trusted_proxies lists the proxy addresses (CIDRs or single IPs); only for
+// connections from those are X-Forwarded-For / X-Real-IP, X-Forwarded-Proto
+// and X-Forwarded-Host believed. The client IP is the right-most
+// X-Forwarded-For entry that is not itself a trusted proxy, so a client cannot
+// pick its own IP by sending the header.
+
+// parseCIDRs parses a config list of CIDRs or single IPs; key names the
+// option in errors.
+func parseCIDRs(key string, list []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s entry %q", key, v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", key, v)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func ipInNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) isTrustedProxy(ip string) bool {
+	return ipInNets(ip, s.cfg().trustedNets)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// viaTrustedProxy reports whether the connection comes from a trusted proxy,
+// i.e. whether its X-Forwarded-* headers count. Unix socket peers are local
+// and always count (see listen.go).
+func (s *server) viaTrustedProxy(r *http.Request) bool {
+	if viaUnixSocket(r) {
+		return true
+	}
+	return len(s.cfg().trustedNets) > 0 && s.isTrustedProxy(remoteIP(r))
+}
+
+// clientIP is the address of the client, looking through trusted proxies.
+func (s *server) clientIP(r *http.Request) string {
+	remote := remoteIP(r)
+	if !s.viaTrustedProxy(r) {
+		return remote
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				hops = append(hops, p)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := hops[i]
+		if net.ParseIP(ip) == nil {
+			// Anything unparseable may be forged; stop at the last good hop.
+			break
+		}
+		if !s.isTrustedProxy(ip) || i == 0 {
+			return ip
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return remote
+}
+
+// requestScheme is "https" when the client used TLS, to us or to a trusted
+// proxy.
+func (s *server) requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if s.viaTrustedProxy(r) {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// requestHost is the host the client asked for, looking through trusted
+// proxies.
+func (s *server) requestHost(r *http.Request) string {
+	if s.viaTrustedProxy(r) {
+		host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// secureCookies reports whether cookies for r should be marked Secure.
+func (s *server) secureCookies(r *http.Request) bool {
+	return strings.HasPrefix(s.cfg().pageBaseURL(), "https://") || s.requestScheme(r) == "https"
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Public page URL. base_url is where agents reach the API, which is often
+// an internal address. public_base_url, when set, is where responders open
+// their pages instead: interaction links, short links, bundle pages, one-tap
+// answers and the Slack and Telegram entry points are built on it, and page
+// forms posted from it pass the CSRF origin check. A proxy can then publish
+// only the public host, for instance ask.example.com in front of /r/*,
+// while /v1/* stays on ask4me.internal:8080.
+//
+// When the two URLs name different hosts, requests that arrive for the
+// public host are refused the API (/v1/*), /admin, /metrics and the /compose
+// page that calls the API with 404, so a proxy that forwards everything does
+// not publish them by accident.
+//
+// path_prefix mounts the whole app under a path, for proxies that route by
+// path (https://example.com/ask4me/ in front of the server). It defaults to
+// the path of public_base_url, or of base_url. Paths are served with or
+// without the prefix, whichever way the proxy passes them on, and pages and
+// redirects point back under it.
+
+func validatePublicBaseURL(c *Config) error {
+	c.PublicBaseURL = strings.TrimSpace(c.PublicBaseURL)
+	if c.PublicBaseURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.PublicBaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid public_base_url %q: must be an http(s) URL", c.PublicBaseURL)
+	}
+	return nil
+}
+
+// pageBaseURL is the base of the links responders open, without a trailing
+// slash.
+func (c *Config) pageBaseURL() string {
+	if c.PublicBaseURL != "" {
+		return strings.TrimRight(c.PublicBaseURL, "/")
+	}
+	return strings.TrimRight(c.BaseURL, "/")
+}
+
+// publicHost returns the host of public_base_url when it differs from
+// base_url's, and "" when the two surfaces share a host.
+func (c *Config) publicHost() string {
+	if c.PublicBaseURL == "" {
+		return ""
+	}
+	p, err := url.Parse(c.PublicBaseURL)
+	if err != nil {
+		return ""
+	}
+	if b, err := url.Parse(c.BaseURL); err == nil && strings.EqualFold(p.Host, b.Host) {
+		return ""
+	}
+	return p.Host
+}
+
+func isPrivatePath(path string) bool {
+	return strings.HasPrefix(path, "/v1/") || path == "/admin" || strings.HasPrefix(path, "/admin/") || path == "/metrics" || path == "/compose"
+}
+
+// separateSurfaces refuses the API, dashboard, metrics and compose page on
+// the public host.
+func (s *server) separateSurfaces(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host := s.cfg().publicHost(); host != "" && isPrivatePath(r.URL.Path) && strings.EqualFold(s.requestHost(r), host) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// normalizePathPrefix cleans path_prefix, which defaults to the path of
+// public_base_url (or base_url).
+func normalizePathPrefix(c *Config) error {
+	p := strings.TrimSpace(c.PathPrefix)
+	if p == "" {
+		if u, err := url.Parse(c.pageBaseURL()); err == nil {
+			p = u.Path
+		}
+	}
+	p = strings.TrimRight(p, "/")
+	if p != "" && (!strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#% ") || strings.Contains(p, "//")) {
+		return fmt.Errorf("invalid path_prefix %q: must be a path such as /ask4me", c.PathPrefix)
+	}
+	c.PathPrefix = p
+	return nil
+}
+
+// mountPrefix serves the app under path_prefix. Requests that still carry
+// the prefix have it removed, and those a proxy already stripped pass as
+// they are, so both kinds of path-routing proxy work. Redirects to paths on
+// this server get the prefix back.
+func (s *server) mountPrefix(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := s.cfg().PathPrefix
+		if prefix == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rest, ok := strings.CutPrefix(r.URL.Path, prefix); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+			if rest == "" {
+				rest = "/"
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path, r2.URL.RawPath = rest, ""
+			r = r2
+		}
+		next.ServeHTTP(&prefixWriter{ResponseWriter: w, prefix: prefix}, r)
+	})
+}
+
+// prefixWriter puts the path prefix in front of Location headers that name
+// a path on this server.
+type prefixWriter struct {
+	http.ResponseWriter
+	prefix string
+}
+
+func (w *prefixWriter) WriteHeader(code int) {
+	if loc := w.Header().Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		w.Header().Set("Location", w.prefix+loc)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *prefixWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (w *prefixWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
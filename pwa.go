@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// The interaction page can be installed as a PWA. /manifest.webmanifest
+// describes the app (start page /app, colors from page_theme_color) and
+// /sw.js is its service worker: it keeps the last copy of every page opened
+// so one can be reopened without network, caches the static assets and
+// shows web push notifications (see webpush.go).
+//
+// /pwa.js, loaded by the page, registers the worker and sends the page's
+// forms with fetch. When the network is down the answer is kept in
+// localStorage, the page says it is pending, and it is sent again when the
+// browser is back online (or any ask4me page or /app is opened). An entry is
+// dropped once the server answers it with anything but a 5xx, so an ask
+// that expired or was answered elsewhere does not retry forever. File
+// uploads are not queued.
+
+const (
+	pwaName         = "Ask4Me"
+	pwaDefaultColor = "#24292f"
+)
+
+const pwaIconSVG = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 512 512">
+<rect width="512" height="512" rx="96" fill="#24292f"/>
+<path d="M136 160h240a40 40 0 0 1 40 40v112a40 40 0 0 1-40 40H248l-72 56v-56h-40a40 40 0 0 1-40-40V200a40 40 0 0 1 40-40z" fill="#fff"/>
+<text x="256" y="306" font-family="system-ui,sans-serif" font-size="120" font-weight="700" text-anchor="middle" fill="#24292f">?</text>
+</svg>`
+
+const pwaServiceWorker = `"use strict";
+var CACHE = "ask4me-v1";
+var MAX_PAGES = 50;
+// BASE is the server's path_prefix: the worker is served at BASE + "/sw.js".
+var BASE = self.location.pathname.replace(/\/sw\.js$/, "");
+
+self.addEventListener("install", function (e) {
+  self.skipWaiting();
+  e.waitUntil(caches.open(CACHE).then(function (c) {
+    return c.addAll([BASE + "/app", BASE + "/pwa.js", BASE + "/icon.svg"]);
+  }));
+});
+
+self.addEventListener("activate", function (e) {
+  e.waitUntil(caches.keys().then(function (keys) {
+    return Promise.all(keys.filter(function (k) { return k !== CACHE; }).map(function (k) { return caches.delete(k); }));
+  }).then(function () { return self.clients.claim(); }));
+});
+
+function trimPages(cache) {
+  return cache.keys().then(function (keys) {
+    var pages = keys.filter(function (r) { return new URL(r.url).pathname.indexOf(BASE + "/r/") === 0; });
+    return Promise.all(pages.slice(0, Math.max(0, pages.length - MAX_PAGES)).map(function (r) { return cache.delete(r); }));
+  });
+}
+
+// Pages: network first, falling back to the last copy.
+function networkFirst(req) {
+  return fetch(req).then(function (res) {
+    if (res.ok && !res.redirected && res.type === "basic") {
+      var copy = res.clone();
+      caches.open(CACHE).then(function (c) { return c.put(req, copy).then(function () { return trimPages(c); }); });
+    }
+    return res;
+  }, function (err) {
+    return caches.match(req).then(function (hit) { if (hit) return hit; throw err; });
+  });
+}
+
+// Assets: cache first.
+function cacheFirst(req) {
+  return caches.match(req).then(function (hit) {
+    return hit || fetch(req).then(function (res) {
+      if (res.ok) {
+        var copy = res.clone();
+        caches.open(CACHE).then(function (c) { return c.put(req, copy); });
+      }
+      return res;
+    });
+  });
+}
+
+// Web push: show the ask, and open its page on click.
+self.addEventListener("push", function (e) {
+  var msg = {};
+  try { msg = e.data ? e.data.json() : {}; } catch (err) {}
+  e.waitUntil(self.registration.showNotification(msg.title || "Ask4Me", {
+    body: msg.body || "",
+    icon: BASE + "/icon.svg",
+    tag: msg.url || undefined,
+    data: { url: msg.url || BASE + "/app" }
+  }));
+});
+
+self.addEventListener("notificationclick", function (e) {
+  e.notification.close();
+  var url = (e.notification.data && e.notification.data.url) || BASE + "/app";
+  e.waitUntil(self.clients.matchAll({ type: "window", includeUncontrolled: true }).then(function (list) {
+    for (var i = 0; i < list.length; i++) {
+      if (list[i].url === url && "focus" in list[i]) return list[i].focus();
+    }
+    return self.clients.openWindow(url);
+  }));
+});
+
+self.addEventListener("fetch", function (e) {
+  var req = e.request;
+  if (req.method !== "GET") return;
+  var url = new URL(req.url);
+  if (url.origin !== self.location.origin || url.pathname.indexOf(BASE + "/") !== 0) return;
+  var p = url.pathname.slice(BASE.length);
+  if (p === "/app" || (p.indexOf("/r/") === 0 && (req.mode === "navigate" || /\/spec$/.test(p)))) {
+    e.respondWith(networkFirst(req));
+  } else if (p.indexOf("/static/") === 0 || p.indexOf("/branding/") === 0 || p === "/icon.svg") {
+    e.respondWith(cacheFirst(req));
+  }
+});
+`
+
+const pwaScript = `(function () {
+  "use strict";
+  var KEY = "ask4me.outbox";
+  var RETRY_MS = 15000;
+  // BASE is the server's path_prefix: this script is served at BASE + "/pwa.js".
+  var BASE = document.currentScript ? new URL(document.currentScript.src).pathname.replace(/\/pwa\.js$/, "") : "";
+
+  if ("serviceWorker" in navigator) {
+    window.addEventListener("load", function () {
+      navigator.serviceWorker.register(BASE + "/sw.js").catch(function () {});
+    });
+  }
+  if (!window.fetch || !window.localStorage || !window.URLSearchParams) return;
+
+  function load() {
+    try { return JSON.parse(localStorage.getItem(KEY)) || []; } catch (e) { return []; }
+  }
+  function save(q) {
+    try { localStorage.setItem(KEY, JSON.stringify(q)); } catch (e) {}
+  }
+  // requestPath is BASE + "/r/{id}/" for a page or form URL.
+  function requestPath(u) {
+    var p = new URL(u, location.href).pathname;
+    var m = p.indexOf(BASE + "/") === 0 && /^\/r\/[^\/]+\//.exec(p.slice(BASE.length));
+    return m ? BASE + m[0] : "";
+  }
+  var here = requestPath(location.href);
+
+  function status(kind, text) {
+    var el = document.getElementById("ask4me-status");
+    if (!el) {
+      el = document.createElement("div");
+      el.id = "ask4me-status";
+      el.setAttribute("role", "status");
+      el.setAttribute("aria-live", "polite");
+      var h1 = document.querySelector("h1");
+      if (h1) h1.parentNode.insertBefore(el, h1.nextSibling); else document.body.appendChild(el);
+    }
+    el.className = kind + " row";
+    el.textContent = text;
+  }
+  function setForms(disabled) {
+    var buttons = document.querySelectorAll("form button");
+    for (var i = 0; i < buttons.length; i++) buttons[i].disabled = disabled;
+  }
+  function post(url, body) {
+    return fetch(url, {
+      method: "POST",
+      body: body,
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/x-www-form-urlencoded" }
+    });
+  }
+
+  function showQueued() {
+    var q = load();
+    var mine = q.filter(function (it) { return requestPath(it.url) === here; });
+    if (here && mine.length) {
+      setForms(true);
+      status("pending", "Pending: your answer is saved on this device and will be sent when you are back online.");
+    } else if (!here && document.getElementById("ask4me-app")) {
+      status(q.length ? "pending" : "ok", q.length ? q.length + " answer(s) waiting to be sent." : "Nothing waiting to be sent.");
+    }
+  }
+
+  var flushing = false;
+  function flush() {
+    var q = load();
+    if (flushing || !q.length || navigator.onLine === false) return;
+    flushing = true;
+    var item = q[0];
+    post(item.url, item.body).then(function (res) {
+      flushing = false;
+      if (res.status >= 500) return;
+      save(load().filter(function (it) { return it.url !== item.url || it.body !== item.body; }));
+      if (here && requestPath(item.url) === here) {
+        location.replace(res.ok ? res.url : location.href);
+        return;
+      }
+      showQueued();
+      flush();
+    }, function () {
+      flushing = false;
+    });
+  }
+
+  document.addEventListener("submit", function (e) {
+    var form = e.target;
+    if (e.defaultPrevented || !form || (form.method || "").toLowerCase() !== "post") return;
+    if ((form.enctype || "").indexOf("multipart/") === 0) return;
+    var sub = e.submitter;
+    var url = sub && sub.hasAttribute("formaction") ? sub.formAction : form.action;
+    var data;
+    try {
+      data = new FormData(form, sub);
+    } catch (err) {
+      data = new FormData(form);
+      if (sub && sub.name) data.append(sub.name, sub.value);
+    }
+    var body = new URLSearchParams(data).toString();
+    e.preventDefault();
+    setForms(true);
+    status("pending", "Sending...");
+    post(url, body).then(function (res) {
+      if (res.ok) {
+        location.replace(res.url);
+        return;
+      }
+      return res.text().then(function (text) {
+        setForms(false);
+        status("err", text.trim() || res.statusText);
+      });
+    }, function () {
+      var q = load().filter(function (it) { return it.url !== url; });
+      q.push({ url: url, body: body, at: Date.now() });
+      save(q);
+      showQueued();
+    });
+  });
+
+  window.addEventListener("online", flush);
+  setInterval(flush, RETRY_MS);
+  showQueued();
+  flush();
+})();
+`
+
+var pwaAppTpl = template.Must(template.New("app").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1,viewport-fit=cover"/>
+  <meta name="theme-color" content="{{.Color}}"/>
+  <title>Ask4Me</title>
+  <link rel="manifest" href="manifest.webmanifest"/>
+  <style>
+    :root{color-scheme:light dark;--fg:#24292f;--muted:#57606a;--bg:#fff;--ok-bg:#dafbe1;--ok-border:#2da44e;--pending-bg:#fff8c5;--pending-border:#bf8700;}
+    @media (prefers-color-scheme:dark){:root{--fg:#e6edf3;--muted:#8d96a0;--bg:#0d1117;--ok-bg:#12261e;--ok-border:#2ea043;--pending-bg:#272115;--pending-border:#9e6a03;}}
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 max(16px,env(safe-area-inset-right)) 0 max(16px,env(safe-area-inset-left));color:var(--fg);background:var(--bg);}
+    p{color:var(--muted);}
+    .row{margin-top:16px;}
+    .ok{padding:12px;border:1px solid var(--ok-border);border-radius:10px;background:var(--ok-bg);}
+    .pending{padding:12px;border:1px solid var(--pending-border);border-radius:10px;background:var(--pending-bg);}
+    header.brand img{max-height:48px;max-width:100%;}
+  </style>
+</head>
+<body id="ask4me-app">
+  {{if .LogoURL}}<header class="brand"><img src="{{.LogoURL}}" alt=""/></header>{{end}}
+  <h1>Ask4Me</h1>
+  <p>New questions arrive as notifications; open them from there. Answers given here while offline are sent as soon as the connection is back.</p>
+  <script src="pwa.js"></script>
+</body>
+</html>`))
+
+func (s *server) handlePWA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	brand := s.cfg().brand()
+	color := brand.Color
+	if color == "" {
+		color = pwaDefaultColor
+	}
+	switch r.URL.Path {
+	case "/manifest.webmanifest":
+		w.Header().Set("Content-Type", "application/manifest+json")
+		w.Header().Set("Cache-Control", "no-cache")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"name":             pwaName,
+			"short_name":       pwaName,
+			"start_url":        brand.Prefix + "/app",
+			"scope":            brand.Prefix + "/",
+			"display":          "standalone",
+			"theme_color":      color,
+			"background_color": "#ffffff",
+			"icons": []map[string]string{
+				{"src": brand.Prefix + "/icon.svg", "sizes": "any", "type": "image/svg+xml", "purpose": "any"},
+			},
+		})
+	case "/sw.js":
+		// The worker must be revalidated so that updates reach installs.
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte(pwaServiceWorker))
+	case "/pwa.js":
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte(pwaScript))
+	case "/icon.svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		_, _ = w.Write([]byte(pwaIconSVG))
+	case "/app":
+		setPageSecurityHeaders(w)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = pwaAppTpl.Execute(w, brandData{LogoURL: brand.LogoURL, Color: color})
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+// QR codes of interaction links, for showing an ask on a TV or terminal and
+// answering it from a phone. An ask with "qr": true gets qr_code (a PNG data
+// URL of its link, the short link when there is one) and qr_url in its
+// request.created event; /r/{id}/qr.png?k=<token> serves the same image for
+// any link.
+//
+// The encoder below covers what links need: byte mode at error correction
+// level M, versions 1 to 40, with the mask picked by the usual penalty rules.
+
+const (
+	qrModuleSize = 8
+	qrQuietZone  = 4
+)
+
+var errQRTooLong = errors.New("qr: text too long")
+
+// Per version (index 1 to 40), for error correction level M.
+var (
+	qrECCodewordsPerBlock = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrECBlocks            = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// qrRawModules is the number of modules of a version that carry data or
+// error correction bits.
+func qrRawModules(ver int) int {
+	n := (16*ver+128)*ver + 64
+	if ver >= 2 {
+		align := ver/7 + 2
+		n -= (25*align-10)*align - 55
+		if ver >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(ver int) int {
+	return qrRawModules(ver)/8 - qrECCodewordsPerBlock[ver]*qrECBlocks[ver]
+}
+
+func qrAlignmentPositions(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	n := ver/7 + 2
+	step := (ver*4 + n*2 + 1) / (n*2 - 2) * 2
+	if ver == 32 {
+		step = 26
+	}
+	out := make([]int, n)
+	out[0] = 6
+	for i, pos := n-1, ver*4+10; i >= 1; i, pos = i-1, pos-step {
+		out[i] = pos
+	}
+	return out
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrRSDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range out {
+			out[j] = qrMultiply(out[j], root)
+			if j+1 < len(out) {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = qrMultiply(root, 2)
+	}
+	return out
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+	out := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i, c := range divisor {
+			out[i] ^= qrMultiply(c, factor)
+		}
+	}
+	return out
+}
+
+// qrCodewords encodes data in byte mode and returns the interleaved data and
+// error correction codewords of the smallest version that fits.
+func qrCodewords(data []byte) (int, []byte, error) {
+	ver := 1
+	for ; ver <= 40; ver++ {
+		ccBits := 8
+		if ver >= 10 {
+			ccBits = 16
+		}
+		if len(data) < 1<<ccBits && 4+ccBits+8*len(data) <= qrDataCodewords(ver)*8 {
+			break
+		}
+	}
+	if ver > 40 {
+		return 0, nil, errQRTooLong
+	}
+	capBytes := qrDataCodewords(ver)
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>i)&1 != 0)
+		}
+	}
+	put(0b0100, 4)
+	if ver >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	put(0, min(4, capBytes*8-len(bits)))
+	put(0, (8-len(bits)%8)%8)
+	for pad := 0xec; len(bits) < capBytes*8; pad ^= 0xec ^ 0x11 {
+		put(pad, 8)
+	}
+	codewords := make([]byte, capBytes)
+	for i, b := range bits {
+		if b {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	nBlocks := qrECBlocks[ver]
+	ecLen := qrECCodewordsPerBlock[ver]
+	raw := qrRawModules(ver) / 8
+	nShort := nBlocks - raw%nBlocks
+	shortLen := raw / nBlocks
+	divisor := qrRSDivisor(ecLen)
+	blocks := make([][]byte, 0, nBlocks)
+	for i, k := 0, 0; i < nBlocks; i++ {
+		n := shortLen - ecLen
+		if i >= nShort {
+			n++
+		}
+		dat := codewords[k : k+n]
+		k += n
+		block := append(append([]byte{}, dat...), qrRSRemainder(dat, divisor)...)
+		if i < nShort {
+			// Short blocks get a gap so that all blocks line up.
+			block = append(block[:n], append([]byte{0}, block[n:]...)...)
+		}
+		blocks = append(blocks, block)
+	}
+	out := make([]byte, 0, raw)
+	for i := 0; i <= shortLen; i++ {
+		for j, b := range blocks {
+			if i != shortLen-ecLen || j >= nShort {
+				out = append(out, b[i])
+			}
+		}
+	}
+	return ver, out, nil
+}
+
+type qrMatrix struct {
+	size     int
+	dark     [][]bool
+	function [][]bool
+}
+
+func (m *qrMatrix) setFunction(x, y int, dark bool) {
+	m.dark[y][x] = dark
+	m.function[y][x] = true
+}
+
+func qrMask(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (m *qrMatrix) applyMask(mask int) {
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if !m.function[y][x] && qrMask(mask, x, y) {
+				m.dark[y][x] = !m.dark[y][x]
+			}
+		}
+	}
+}
+
+// drawFormat writes the format information for level M and mask.
+func (m *qrMatrix) drawFormat(mask int) {
+	data := mask // level M is 0b00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		m.setFunction(8, i, bit(i))
+	}
+	m.setFunction(8, 7, bit(6))
+	m.setFunction(8, 8, bit(7))
+	m.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		m.setFunction(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.setFunction(8, m.size-15+i, bit(i))
+	}
+	m.setFunction(8, m.size-8, true)
+}
+
+func (m *qrMatrix) drawFunctionPatterns(ver int) {
+	for i := 0; i < m.size; i++ {
+		m.setFunction(6, i, i%2 == 0)
+		m.setFunction(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {m.size - 4, 3}, {3, m.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= m.size || y >= m.size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				m.setFunction(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	pos := qrAlignmentPositions(ver)
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					m.setFunction(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	m.drawFormat(0) // reserves the area; redrawn once the mask is known
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := m.size-11+i%3, i/3
+			m.setFunction(a, b, dark)
+			m.setFunction(b, a, dark)
+		}
+	}
+}
+
+func (m *qrMatrix) drawCodewords(data []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < m.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if upward {
+					y = m.size - 1 - vert
+				}
+				if !m.function[y][x] && i < len(data)*8 {
+					m.dark[y][x] = (data[i/8]>>(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan; the mask with the lowest
+// score is used.
+func (m *qrMatrix) penalty() int {
+	score := 0
+	line := func(get func(i int) bool) {
+		run := 1
+		for i := 1; i <= m.size; i++ {
+			if i < m.size && get(i) == get(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				score += 3 + run - 5
+			}
+			run = 1
+		}
+		// Finder-like 1:1:3:1:1 patterns with light space on one side.
+		for i := 0; i+11 <= m.size; i++ {
+			a := get(i) && !get(i+1) && get(i+2) && get(i+3) && get(i+4) && !get(i+5) && get(i+6) &&
+				!get(i+7) && !get(i+8) && !get(i+9) && !get(i+10)
+			b := !get(i) && !get(i+1) && !get(i+2) && !get(i+3) && get(i+4) && !get(i+5) &&
+				get(i+6) && get(i+7) && get(i+8) && !get(i+9) && get(i+10)
+			if a || b {
+				score += 40
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < m.size; y++ {
+		line(func(i int) bool { return m.dark[y][i] })
+		line(func(i int) bool { return m.dark[i][y] })
+		for x := 0; x < m.size; x++ {
+			if m.dark[y][x] {
+				dark++
+			}
+			if x+1 < m.size && y+1 < m.size {
+				c := m.dark[y][x]
+				if c == m.dark[y][x+1] && c == m.dark[y+1][x] && c == m.dark[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	total := m.size * m.size
+	score += ((abs(dark*20-total*10)+total-1)/total - 1) * 10
+	return score
+}
+
+// encodeQR returns the modules of a QR code for text, true for dark.
+func encodeQR(text string) ([][]bool, error) {
+	ver, data, err := qrCodewords([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	size := ver*4 + 17
+	m := &qrMatrix{size: size, dark: make([][]bool, size), function: make([][]bool, size)}
+	for i := range m.dark {
+		m.dark[i] = make([]bool, size)
+		m.function[i] = make([]bool, size)
+	}
+	m.drawFunctionPatterns(ver)
+	m.drawCodewords(data)
+	best, bestScore := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		m.applyMask(mask)
+		m.drawFormat(mask)
+		if s := m.penalty(); bestScore < 0 || s < bestScore {
+			best, bestScore = mask, s
+		}
+		m.applyMask(mask) // XOR again to undo
+	}
+	m.applyMask(best)
+	m.drawFormat(best)
+	return m.dark, nil
+}
+
+// qrPNG renders text as a black-on-white PNG with the standard quiet zone.
+func qrPNG(text string) ([]byte, error) {
+	modules, err := encodeQR(text)
+	if err != nil {
+		return nil, err
+	}
+	n := len(modules) + 2*qrQuietZone
+	img := image.NewPaletted(image.Rect(0, 0, n*qrModuleSize, n*qrModuleSize), color.Palette{color.White, color.Black})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			x0, y0 := (x+qrQuietZone)*qrModuleSize, (y+qrQuietZone)*qrModuleSize
+			for dy := 0; dy < qrModuleSize; dy++ {
+				for dx := 0; dx < qrModuleSize; dx++ {
+					img.SetColorIndex(x0+dx, y0+dy, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func qrDataURL(text string) (string, error) {
+	b, err := qrPNG(text)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// qrImageURL turns an interaction link into the link of its QR image.
+func qrImageURL(interactionURL string) string {
+	return strings.Replace(interactionURL, "/?k=", "/qr.png?k=", 1)
+}
+
+// handleUserQR serves GET /r/{id}/qr.png, the QR code of the link used to
+// fetch it.
+func (s *server) handleUserQR(w http.ResponseWriter, r *http.Request, requestID, tokenPlain string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := qrPNG(s.makeInteractionURL(requestID, tokenPlain))
+	if err != nil {
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	_, _ = w.Write(b)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps one token bucket per key. A bucket holds up to perMinute
+// tokens and refills continuously, so short bursts are allowed while the
+// average stays within the limit. Any bucket refills completely within a
+// minute, so buckets idle for longer are dropped to keep the map small.
+//
+// Limits apply per API key (rate_limit_per_minute on every call, see
+// apikeys.go, and rate_limit_ask_per_minute on /v1/ask) and per client IP
+// (rate_limit_ip_per_minute on /v1/ask and the interaction pages under /r/,
+// in separate buckets; see proxy.go for how the IP is found).
+
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until the next token.
+func (l *rateLimiter) allow(key string, perMinute int, now time.Time) (bool, time.Duration) {
+	if l == nil || perMinute <= 0 {
+		return true, 0
+	}
+	capacity := float64(perMinute)
+	rate := capacity / 60 // tokens per second
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > rateLimitSweepInterval {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// writeRateLimited answers 429 with a Retry-After in whole seconds.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// limitIP applies rate_limit_ip_per_minute to next; bucket keeps the buckets
+// of different endpoint groups apart.
+func (s *server) limitIP(bucket string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := s.limiter.allow(bucket+"-ip:"+s.clientIP(r), s.cfg().RateLimitIPPerMinute, time.Now()); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Answer recap. People often reopen a link after the ask is over, so a
+// finished page shows the question again with what was answered, by whom
+// and when, and whether the answer reached the asker, instead of a bare
+// "expired" error or "Submitted.". Expired and cancelled asks get the same
+// page (with status 410); the form routes keep their plain errors.
+//
+// "Reached the asker" is known when the asker confirms it with POST
+// /v1/requests/{id}/ack (an answer.acknowledged event, optionally with a
+// note such as "Deployed"), or when the ask has a callback_url: the answer
+// then counts as picked up once the callback was delivered.
+
+// answerRecap is passed to the page template as .Recap.
+type answerRecap struct {
+	// State is "answered", "expired" or "cancelled".
+	State      string
+	Answer     string
+	Responder  string
+	AnsweredAt time.Time
+	// ClosedAt is when an unanswered ask expired or was cancelled.
+	ClosedAt time.Time
+	// Tracked is set when the ask has a callback, so Acknowledged means
+	// something.
+	Tracked        bool
+	Acknowledged   bool
+	AcknowledgedAt time.Time
+	// Continued is set when the asker acknowledged the answer through the
+	// API, with its note. A cancelled ask that was closed by a custom event
+	// carries that event's message as Note.
+	Continued bool
+	Note      string
+}
+
+// recapAnswer is the answer shown on the page for responder, or for the
+// request when it takes a single answer.
+func (s *store) recapAnswer(ctx context.Context, reqID, responder string, multi bool) (answer, by string, at int64, ok bool, err error) {
+	var action, text, payload, who sql.NullString
+	if multi {
+		err = s.db.QueryRowContext(ctx,
+			`SELECT action, text, payload_json, responder, created_at FROM responses WHERE request_id=? AND responder=?`,
+			reqID, responder,
+		).Scan(&action, &text, &payload, &who, &at)
+	} else {
+		err = s.db.QueryRowContext(ctx,
+			`SELECT action, text, payload_json, COALESCE(responder_name, responder), created_at FROM answers WHERE request_id=?`,
+			reqID,
+		).Scan(&action, &text, &payload, &who, &at)
+	}
+	if err == sql.ErrNoRows {
+		return "", "", 0, false, nil
+	}
+	if err != nil {
+		return "", "", 0, false, err
+	}
+	parts := make([]string, 0, 2)
+	if action.String != "" {
+		parts = append(parts, action.String)
+	}
+	if text.String != "" {
+		parts = append(parts, text.String)
+	}
+	if len(parts) == 0 && strings.TrimSpace(payload.String) != "" {
+		parts = append(parts, "Form submitted")
+	}
+	return strings.Join(parts, " · "), who.String, at, true, nil
+}
+
+// firstEventAt returns when the request's first event of type typ was
+// recorded.
+func (s *store) firstEventAt(ctx context.Context, reqID, typ string) (int64, bool, error) {
+	var at int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT created_at FROM events WHERE request_id=? AND type=? ORDER BY seq ASC LIMIT 1`,
+		reqID, typ,
+	).Scan(&at)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return at, err == nil, err
+}
+
+// answerRecap builds the recap for a finished page, or nil when there is
+// nothing to recap yet.
+func (s *server) answerRecap(ctx context.Context, reqID, status, responder string, multi bool, expiresAt int64) *answerRecap {
+	answer, by, at, ok, err := s.db.recapAnswer(ctx, reqID, responder, multi && responder != "")
+	if err != nil {
+		return nil
+	}
+	rc := &answerRecap{}
+	switch {
+	case ok:
+		rc.State = "answered"
+		rc.Answer, rc.Responder, rc.AnsweredAt = answer, by, time.Unix(at, 0)
+	case status == "cancelled":
+		rc.State = "cancelled"
+		if at, ok, _ := s.db.firstEventAt(ctx, reqID, "request.cancelled"); ok {
+			rc.ClosedAt = time.Unix(at, 0)
+		} else if ev, at, ok, _ := s.db.latestCustomEvent(ctx, reqID); ok {
+			// Closed by one of the ask's terminal_events.
+			rc.ClosedAt, rc.Note = time.Unix(at, 0), customMessage(ev)
+		}
+	case status == "expired" || time.Now().Unix() > expiresAt:
+		rc.State = "expired"
+		rc.ClosedAt = time.Unix(expiresAt, 0)
+	default:
+		return nil
+	}
+	if ack, ok, _ := s.db.getLatestEventByTypes(ctx, reqID, []string{"answer.acknowledged"}); ok {
+		var d struct {
+			Note string `json:"note"`
+		}
+		_ = json.Unmarshal(ack.Data, &d)
+		rc.Tracked, rc.Acknowledged, rc.Continued, rc.Note = true, true, true, d.Note
+		if at, ok, _ := s.db.firstEventAt(ctx, reqID, "answer.acknowledged"); ok {
+			rc.AcknowledgedAt = time.Unix(at, 0)
+		}
+		return rc
+	}
+	if cb, _, err := s.db.getCallback(ctx, reqID); err == nil && cb != "" {
+		rc.Tracked = true
+		if at, ok, _ := s.db.firstEventAt(ctx, reqID, "callback.sent"); ok {
+			rc.Acknowledged, rc.AcknowledgedAt = true, time.Unix(at, 0)
+		}
+	}
+	return rc
+}
+
+// handleClosedPage renders the recap page for an ask that expired or was
+// cancelled.
+func (s *server) handleClosedPage(w http.ResponseWriter, r *http.Request, requestID, tokenHash, status string, expiresAt int64) {
+	ctx := r.Context()
+	req, err := s.db.getRequestSummary(ctx, requestID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	respondersMode, _, _ := s.db.getRespondersMode(ctx, requestID)
+	responder, _ := s.db.getTokenResponder(ctx, requestID, tokenHash)
+	rc := s.answerRecap(ctx, requestID, status, responder, isMultiAnswerMode(respondersMode), expiresAt)
+	cfg := s.cfg()
+	data := htmlData{
+		Title:     req.Title,
+		Body:      req.Body,
+		Done:      true,
+		RequestID: requestID,
+		Thread:    s.pageThread(ctx, requestID),
+		Brand:     cfg.brand(),
+		Recap:     rc,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if rc == nil || rc.State != "answered" {
+		w.WriteHeader(http.StatusGone)
+	}
+	renderPage(w, cfg.pageTpl, pageTpl, data)
+}
+
+// handleAckRequest serves POST /v1/requests/{id}/ack, with which the asker
+// confirms that it received the answer and went on. The page's recap then
+// tells the person so. The first ack is recorded; later ones return it.
+func (s *server) handleAckRequest(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var body struct {
+		Note string `json:"note"`
+	}
+	if b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16)); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		if err := json.Unmarshal(b, &body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	}
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if status != "submitted" {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request has no answer to acknowledge",
+		})
+		return
+	}
+	at, ok, err := s.db.firstEventAt(ctx, requestID, "answer.acknowledged")
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		ev := s.mustNewEvent(ctx, requestID, "answer.acknowledged", map[string]any{
+			"note": truncate(strings.TrimSpace(body.Note), 500),
+		})
+		if err := s.persistTerminalAware(ctx, ev); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		at = time.Now().Unix()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"request_id":      requestID,
+		"acknowledged_at": unixOrNil(at),
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Read receipts. An agent that gets no answer wants to know whether the
+// question was never seen or is being ignored. user.page_loaded (the page was
+// opened) carries the client's user agent and a rough device kind, and the
+// page has a "Seen, I'll answer later" button that records
+// user.acknowledged. Both reach stream clients like any other event.
+//
+// The terminal JSON response sums this up as seen_at (first time a person
+// opened the page; link previews of chat apps do not count) and
+// acknowledged_at, both null when it did not happen.
+
+// Device kinds recorded with receipts.
+const (
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+	deviceDesktop = "desktop"
+	deviceBot     = "bot"
+	deviceOther   = "other"
+)
+
+// botUserAgents mark crawlers and the link preview fetchers of chat apps.
+var botUserAgents = []string{
+	"bot", "crawl", "spider", "preview", "facebookexternalhit", "whatsapp", "embedly", "vkshare", "skypeuripreview",
+}
+
+// deviceKind guesses the kind of client from its user agent.
+func deviceKind(ua string) string {
+	low := strings.ToLower(ua)
+	for _, b := range botUserAgents {
+		if strings.Contains(low, b) {
+			return deviceBot
+		}
+	}
+	switch {
+	case strings.Contains(low, "ipad") || strings.Contains(low, "tablet") ||
+		(strings.Contains(low, "android") && !strings.Contains(low, "mobile")):
+		return deviceTablet
+	case strings.Contains(low, "mobi") || strings.Contains(low, "iphone") || strings.Contains(low, "android"):
+		return deviceMobile
+	case strings.HasPrefix(low, "mozilla/"):
+		return deviceDesktop
+	}
+	return deviceOther
+}
+
+// receiptData is the payload of user.page_loaded and user.acknowledged.
+func receiptData(r *http.Request, responder string) map[string]any {
+	ua := strings.TrimSpace(r.UserAgent())
+	data := map[string]any{
+		"user_agent": truncate(ua, 300),
+		"device":     deviceKind(ua),
+	}
+	if responder != "" {
+		data["responder"] = responder
+	}
+	return data
+}
+
+type receiptSummary struct {
+	SeenAt         int64
+	AcknowledgedAt int64
+}
+
+// receipts summarizes when requestID was first seen and acknowledged. With
+// responder set, only that responder's acknowledgment counts.
+func (s *store) receipts(ctx context.Context, reqID, responder string) (receiptSummary, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT type, payload_json, payload_encoding, created_at FROM events
+		 WHERE request_id=? AND type IN ('user.page_loaded','user.viewing','user.acknowledged') ORDER BY seq ASC`,
+		reqID,
+	)
+	if err != nil {
+		return receiptSummary{}, err
+	}
+	defer rows.Close()
+	var out receiptSummary
+	for rows.Next() {
+		var typ, payload string
+		var encoding sql.NullString
+		var at int64
+		if err := rows.Scan(&typ, &payload, &encoding, &at); err != nil {
+			return receiptSummary{}, err
+		}
+		var d struct {
+			Device    string `json:"device"`
+			Responder string `json:"responder"`
+		}
+		_ = json.Unmarshal(decodeEventPayload(payload, encoding), &d)
+		if d.Device == deviceBot {
+			continue
+		}
+		if out.SeenAt == 0 {
+			out.SeenAt = at
+		}
+		if typ == "user.acknowledged" && out.AcknowledgedAt == 0 && (responder == "" || d.Responder == responder) {
+			out.AcknowledgedAt = at
+		}
+	}
+	return out, rows.Err()
+}
+
+// handleUserAck serves POST /r/{id}/ack, the page's "Seen, I'll answer later"
+// button. It is recorded once per responder.
+func (s *server) handleUserAck(w http.ResponseWriter, r *http.Request, requestID, tokenPlain, status, responder string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isTerminalStatus(status) {
+		rc, err := s.db.receipts(r.Context(), requestID, responder)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if rc.AcknowledgedAt == 0 {
+			ev := s.mustNewEvent(r.Context(), requestID, "user.acknowledged", receiptData(r, responder))
+			_ = s.persistTerminalAware(r.Context(), ev)
+		}
+	}
+	http.Redirect(w, r, "./?k="+url.QueryEscape(tokenPlain), http.StatusSeeOther)
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurring asks are cron schedules that create a normal request at every
+// occurrence. They come from the `schedules` config section (source "config",
+// re-synced at startup and read-only through the API) or from /v1/schedules
+// (source "api"). Requests remember the schedule that created them, which is
+// what the schedule's answer history is built from.
+
+const recurringTickInterval = 20 * time.Second
+
+// ScheduleConfig is one entry of the `schedules` config section. Ask holds the
+// same fields as a POST /v1/ask body.
+type ScheduleConfig struct {
+	Name     string         `yaml:"name"`
+	Cron     string         `yaml:"cron"`
+	Timezone string         `yaml:"timezone"`
+	Ask      map[string]any `yaml:"ask"`
+}
+
+type recurringSchedule struct {
+	ID            string
+	Name          string
+	Cron          string
+	Timezone      string
+	AskJSON       string
+	Source        string
+	Enabled       bool
+	NextRunAt     int64
+	LastRunAt     int64
+	LastRequestID string
+	LastError     string
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+type scheduleOccurrence struct {
+	RequestID  string
+	Status     string
+	CreatedAt  int64
+	Action     sql.NullString
+	Text       sql.NullString
+	Responder  sql.NullString
+	AnsweredAt sql.NullInt64
+}
+
+func isValidScheduleID(id string) bool {
+	if !strings.HasPrefix(id, "sch_") || len(id) > 128 {
+		return false
+	}
+	return isValidRequestID("req_" + strings.TrimPrefix(id, "sch_"))
+}
+
+// validateSchedule checks the cron expression, timezone and ask template.
+func validateSchedule(cronExpr, timezone string, askJSON []byte) error {
+	spec, err := parseCron(cronExpr)
+	if err != nil {
+		return badAskError("invalid cron: " + err.Error())
+	}
+	loc := time.Local
+	if tz := strings.TrimSpace(timezone); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return badAskError("invalid timezone: " + tz)
+		}
+		loc = l
+	}
+	var ar askRequest
+	if err := json.Unmarshal(askJSON, &ar); err != nil {
+		return badAskError("invalid ask: " + err.Error())
+	}
+	if strings.TrimSpace(ar.SendAt) != "" {
+		return badAskError("ask.send_at is not allowed in a schedule")
+	}
+	if strings.TrimSpace(ar.SessionID) != "" {
+		return badAskError("ask.session_id is not allowed in a schedule")
+	}
+	if len(ar.Attachments) > 0 {
+		// An upload belongs to exactly one request.
+		return badAskError("ask.attachments is not allowed in a schedule")
+	}
+	if _, err := normalizeAskRequest(&ar); err != nil {
+		return err
+	}
+	if spec.next(time.Now().In(loc)).IsZero() {
+		return badAskError("cron never fires")
+	}
+	return nil
+}
+
+// nextUnix returns the next occurrence after t as unix seconds, or 0 when the
+// schedule never fires again.
+func (sch recurringSchedule) nextUnix(t time.Time) int64 {
+	spec, err := parseCron(sch.Cron)
+	if err != nil {
+		return 0
+	}
+	loc := time.Local
+	if sch.Timezone != "" {
+		if l, err := time.LoadLocation(sch.Timezone); err == nil {
+			loc = l
+		}
+	}
+	next := spec.next(t.In(loc))
+	if next.IsZero() {
+		return 0
+	}
+	return next.Unix()
+}
+
+func nullIfZero(v int64) any {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+func unixOrNil(v int64) any {
+	if v == 0 {
+		return nil
+	}
+	return time.Unix(v, 0).UTC().Format(time.RFC3339)
+}
+
+func (sch recurringSchedule) view() map[string]any {
+	return map[string]any{
+		"schedule_id":     sch.ID,
+		"name":            sch.Name,
+		"cron":            sch.Cron,
+		"timezone":        sch.Timezone,
+		"ask":             json.RawMessage(sch.AskJSON),
+		"source":          sch.Source,
+		"enabled":         sch.Enabled,
+		"next_run_at":     unixOrNil(sch.NextRunAt),
+		"last_run_at":     unixOrNil(sch.LastRunAt),
+		"last_request_id": sch.LastRequestID,
+		"last_error":      sch.LastError,
+		"created_at":      unixOrNil(sch.CreatedAt),
+		"updated_at":      unixOrNil(sch.UpdatedAt),
+	}
+}
+
+func (o scheduleOccurrence) view() map[string]any {
+	m := map[string]any{
+		"request_id": o.RequestID,
+		"status":     o.Status,
+		"created_at": unixOrNil(o.CreatedAt),
+	}
+	if o.AnsweredAt.Valid {
+		m["answer"] = map[string]any{
+			"action":      o.Action.String,
+			"text":        o.Text.String,
+			"responder":   o.Responder.String,
+			"answered_at": unixOrNil(o.AnsweredAt.Int64),
+		}
+	}
+	return m
+}
+
+const scheduleColumns = `schedule_id, name, cron, timezone, ask_json, source, enabled, next_run_at, last_run_at, last_request_id, last_error, created_at, updated_at`
+
+func scanSchedule(row interface{ Scan(...any) error }) (recurringSchedule, error) {
+	var sch recurringSchedule
+	var tz, lastReq, lastErr sql.NullString
+	var next, last sql.NullInt64
+	var enabled int
+	if err := row.Scan(&sch.ID, &sch.Name, &sch.Cron, &tz, &sch.AskJSON, &sch.Source, &enabled, &next, &last, &lastReq, &lastErr, &sch.CreatedAt, &sch.UpdatedAt); err != nil {
+		return recurringSchedule{}, err
+	}
+	sch.Timezone = tz.String
+	sch.Enabled = enabled != 0
+	sch.NextRunAt = next.Int64
+	sch.LastRunAt = last.Int64
+	sch.LastRequestID = lastReq.String
+	sch.LastError = lastErr.String
+	return sch, nil
+}
+
+func (s *store) upsertSchedule(ctx context.Context, sch recurringSchedule) error {
+	now := time.Now().Unix()
+	enabled := 0
+	if sch.Enabled {
+		enabled = 1
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO schedules(schedule_id,name,cron,timezone,ask_json,source,enabled,next_run_at,created_at,updated_at)
+		 VALUES(?,?,?,?,?,?,?,?,?,?)
+		 ON CONFLICT(schedule_id) DO UPDATE SET name=excluded.name, cron=excluded.cron, timezone=excluded.timezone,
+		   ask_json=excluded.ask_json, source=excluded.source, enabled=excluded.enabled,
+		   next_run_at=excluded.next_run_at, updated_at=excluded.updated_at`,
+		sch.ID, sch.Name, sch.Cron, nullIfEmpty(sch.Timezone), sch.AskJSON, sch.Source, enabled, nullIfZero(sch.NextRunAt), now, now,
+	)
+	return err
+}
+
+func (s *store) getSchedule(ctx context.Context, id string) (recurringSchedule, error) {
+	return scanSchedule(s.db.QueryRowContext(ctx, `SELECT `+scheduleColumns+` FROM schedules WHERE schedule_id=?`, id))
+}
+
+func (s *store) listSchedules(ctx context.Context) ([]recurringSchedule, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scheduleColumns+` FROM schedules ORDER BY created_at ASC, schedule_id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []recurringSchedule
+	for rows.Next() {
+		sch, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sch)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) listDueSchedules(ctx context.Context, now time.Time) ([]recurringSchedule, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+scheduleColumns+` FROM schedules WHERE enabled=1 AND next_run_at IS NOT NULL AND next_run_at<=?`,
+		now.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []recurringSchedule
+	for rows.Next() {
+		sch, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sch)
+	}
+	return out, rows.Err()
+}
+
+// claimScheduleRun moves next_run_at forward; ok=false means another run
+// already claimed this occurrence.
+func (s *store) claimScheduleRun(ctx context.Context, id string, due, next int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE schedules SET next_run_at=?, last_run_at=?, updated_at=? WHERE schedule_id=? AND next_run_at=?`,
+		nullIfZero(next), time.Now().Unix(), time.Now().Unix(), id, due,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *store) recordScheduleRun(ctx context.Context, id, requestID, runErr string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE schedules SET last_request_id=?, last_error=?, updated_at=? WHERE schedule_id=?`,
+		nullIfEmpty(requestID), nullIfEmpty(runErr), time.Now().Unix(), id,
+	)
+	return err
+}
+
+func (s *store) deleteSchedule(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM schedules WHERE schedule_id=?`, id)
+	return err
+}
+
+// deleteConfigSchedulesExcept drops config-sourced schedules that are no
+// longer present in the config file.
+func (s *store) deleteConfigSchedulesExcept(ctx context.Context, keep []string) error {
+	existing, err := s.listSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	keepSet := map[string]struct{}{}
+	for _, id := range keep {
+		keepSet[id] = struct{}{}
+	}
+	for _, sch := range existing {
+		if sch.Source != "config" {
+			continue
+		}
+		if _, ok := keepSet[sch.ID]; ok {
+			continue
+		}
+		if err := s.deleteSchedule(ctx, sch.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) listScheduleOccurrences(ctx context.Context, scheduleID string, limit int) ([]scheduleOccurrence, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT r.request_id, r.status, r.created_at, a.action, a.text, a.responder, a.created_at
+		 FROM requests r LEFT JOIN answers a ON a.request_id = r.request_id
+		 WHERE r.schedule_id=? ORDER BY r.created_at DESC, r.request_id DESC LIMIT ?`,
+		scheduleID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []scheduleOccurrence
+	for rows.Next() {
+		var o scheduleOccurrence
+		if err := rows.Scan(&o.RequestID, &o.Status, &o.CreatedAt, &o.Action, &o.Text, &o.Responder, &o.AnsweredAt); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// syncConfigSchedules mirrors the `schedules` config section into the
+// schedules table. Existing rows keep their run history.
+func (s *server) syncConfigSchedules(ctx context.Context) error {
+	keep := make([]string, 0, len(s.cfg().Schedules))
+	for _, sc := range s.cfg().Schedules {
+		name := strings.TrimSpace(sc.Name)
+		id := "sch_" + strings.ToLower(name)
+		if name == "" || !isValidScheduleID(id) {
+			return fmt.Errorf("schedule %q: name must use only letters, digits and _", sc.Name)
+		}
+		askJSON, err := json.Marshal(sc.Ask)
+		if err != nil {
+			return fmt.Errorf("schedule %q: %w", name, err)
+		}
+		if err := validateSchedule(sc.Cron, sc.Timezone, askJSON); err != nil {
+			return fmt.Errorf("schedule %q: %w", name, err)
+		}
+		sch := recurringSchedule{
+			ID:       id,
+			Name:     name,
+			Cron:     strings.TrimSpace(sc.Cron),
+			Timezone: strings.TrimSpace(sc.Timezone),
+			AskJSON:  string(askJSON),
+			Source:   "config",
+			Enabled:  true,
+		}
+		sch.NextRunAt = sch.nextUnix(time.Now())
+		if err := s.db.upsertSchedule(ctx, sch); err != nil {
+			return err
+		}
+		keep = append(keep, id)
+	}
+	return s.db.deleteConfigSchedulesExcept(ctx, keep)
+}
+
+// recurringLoop fires due schedules and the stats report. Occurrences missed
+// while the server was down are not replayed; the schedule simply moves on to
+// its next time.
+func (s *server) recurringLoop(ctx context.Context) {
+	t := time.NewTicker(recurringTickInterval)
+	defer t.Stop()
+	for {
+		s.runDueSchedules(ctx)
+		s.runStatsReport(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *server) runDueSchedules(ctx context.Context) {
+	now := time.Now()
+	due, err := s.db.listDueSchedules(ctx, now)
+	if err != nil {
+		slog.Error("list due schedules", "error", err)
+		return
+	}
+	for _, sch := range due {
+		ok, err := s.db.claimScheduleRun(ctx, sch.ID, sch.NextRunAt, sch.nextUnix(now))
+		if err != nil || !ok {
+			continue
+		}
+		_, _, _ = s.fireSchedule(ctx, sch)
+	}
+}
+
+// fireSchedule creates one occurrence of sch as a normal request.
+func (s *server) fireSchedule(ctx context.Context, sch recurringSchedule) (string, createdAsk, error) {
+	var ar askRequest
+	err := json.Unmarshal([]byte(sch.AskJSON), &ar)
+	if err != nil {
+		_ = s.db.recordScheduleRun(ctx, sch.ID, "", err.Error())
+		return "", createdAsk{}, err
+	}
+	ar.scheduleID = sch.ID
+	requestID := genID("req_")
+	created, err := s.createAskWithRequestID(ctx, requestID, ar, nil)
+	if err != nil {
+		slog.Error("schedule run", "schedule_id", sch.ID, "request_id", requestID, "error", err)
+		_ = s.db.recordScheduleRun(ctx, sch.ID, "", err.Error())
+		return "", createdAsk{}, err
+	}
+	_ = s.db.recordScheduleRun(ctx, sch.ID, requestID, "")
+	s.startAsk(requestID, created)
+	return requestID, created, nil
+}
+
+// handleSchedules serves /v1/schedules and /v1/schedules/{id}[/run].
+func (s *server) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/schedules"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListSchedules(w, r)
+		case http.MethodPost:
+			s.handleCreateSchedule(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, sub, _ := strings.Cut(path, "/")
+	if !isValidScheduleID(id) {
+		http.Error(w, "invalid schedule_id", http.StatusBadRequest)
+		return
+	}
+	sch, err := s.db.getSchedule(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		s.handleGetSchedule(w, r, sch)
+	case sub == "" && (r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+		if sch.Source == "config" {
+			http.Error(w, "schedule is managed by the config file", http.StatusConflict)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err := s.db.deleteSchedule(r.Context(), id); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.handleUpdateSchedule(w, r, sch)
+	case sub == "run" && r.Method == http.MethodPost:
+		requestID, created, err := s.fireSchedule(r.Context(), sch)
+		if err != nil {
+			if isBadAskError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"schedule_id":     id,
+			"request_id":      requestID,
+			"interaction_url": created.InteractionURL,
+		})
+	case sub == "" || sub == "run":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	list, err := s.db.listSchedules(r.Context())
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, sch := range list {
+		out = append(out, sch.view())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"schedules": out})
+}
+
+func (s *server) handleGetSchedule(w http.ResponseWriter, r *http.Request, sch recurringSchedule) {
+	limit := 20
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, 200)
+	}
+	occ, err := s.db.listScheduleOccurrences(r.Context(), sch.ID, limit)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	history := make([]map[string]any, 0, len(occ))
+	for _, o := range occ {
+		history = append(history, o.view())
+	}
+	out := sch.view()
+	out["history"] = history
+	writeJSON(w, http.StatusOK, out)
+}
+
+type scheduleInput struct {
+	Name     *string         `json:"name"`
+	Cron     *string         `json:"cron"`
+	Timezone *string         `json:"timezone"`
+	Ask      json.RawMessage `json:"ask"`
+	Enabled  *bool           `json:"enabled"`
+}
+
+func readScheduleInput(r *http.Request) (scheduleInput, error) {
+	var in scheduleInput
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return in, err
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return in, badAskError("invalid json")
+	}
+	return in, nil
+}
+
+// applyInput merges in into sch, validates the result and recomputes the
+// next run.
+func (sch *recurringSchedule) applyInput(in scheduleInput) error {
+	if in.Name != nil {
+		sch.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Cron != nil {
+		sch.Cron = strings.TrimSpace(*in.Cron)
+	}
+	if in.Timezone != nil {
+		sch.Timezone = strings.TrimSpace(*in.Timezone)
+	}
+	if len(in.Ask) > 0 {
+		sch.AskJSON = string(in.Ask)
+	}
+	if in.Enabled != nil {
+		sch.Enabled = *in.Enabled
+	}
+	if sch.Name == "" {
+		return badAskError("name is required")
+	}
+	if sch.Cron == "" {
+		return badAskError("cron is required")
+	}
+	if sch.AskJSON == "" {
+		return badAskError("ask is required")
+	}
+	if err := validateSchedule(sch.Cron, sch.Timezone, []byte(sch.AskJSON)); err != nil {
+		return err
+	}
+	sch.NextRunAt = sch.nextUnix(time.Now())
+	return nil
+}
+
+func (s *server) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	s.saveSchedule(w, r, recurringSchedule{ID: genID("sch_"), Source: "api", Enabled: true}, http.StatusCreated)
+}
+
+func (s *server) handleUpdateSchedule(w http.ResponseWriter, r *http.Request, sch recurringSchedule) {
+	s.saveSchedule(w, r, sch, http.StatusOK)
+}
+
+func (s *server) saveSchedule(w http.ResponseWriter, r *http.Request, sch recurringSchedule, status int) {
+	in, err := readScheduleInput(r)
+	if err == nil {
+		err = sch.applyInput(in)
+	}
+	if err != nil {
+		if isBadAskError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := s.db.upsertSchedule(r.Context(), sch); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	saved, err := s.db.getSchedule(r.Context(), sch.ID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, saved.view())
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Answer redaction. People write things into free-text answers that should
+// not be kept forever. Redacting a request blanks the text and form payload
+// of its answer everywhere the server keeps them (the answer, collected
+// responses, step answers, drafts, the answer events and the search index)
+// and keeps the chosen action, who answered and when, and the rest of its
+// history. Redacted answer events say "redacted": true; answers.redacted_at
+// records when it happened.
+//
+// POST /v1/requests/{id}/redact (admin scope) redacts a finished request at
+// once; with redact_answers_after_days the retention janitor redacts every
+// answer once it is that many days old. Attachments are not touched; they
+// go with the request under retention_days.
+
+// redactedEventTypes are the events whose data carries answer text.
+var redactedEventTypes = []string{"user.submitted", "user.step_submitted", "user.answer_updated", "request.completed"}
+
+// redactEventData blanks every "text" and drops every "payload" in an
+// event's data, at any depth.
+func redactEventData(raw []byte) ([]byte, error) {
+	var data map[string]any
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	redactValue(data)
+	data["redacted"] = true
+	return json.Marshal(data)
+}
+
+func redactValue(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, c := range v {
+			switch k {
+			case "text":
+				if _, ok := c.(string); ok {
+					v[k] = ""
+				}
+			case "payload":
+				delete(v, k)
+			default:
+				redactValue(c)
+			}
+		}
+	case []any:
+		for _, c := range v {
+			redactValue(c)
+		}
+	}
+}
+
+// redactAnswers redacts the answer text of reqID.
+func (s *store) redactAnswers(ctx context.Context, reqID string, now time.Time) error {
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE answers SET text=NULL, payload_json=NULL, redacted_at=? WHERE request_id=?`, now.Unix(), reqID,
+	); err != nil {
+		return err
+	}
+	for _, table := range []string{"responses", "step_answers"} {
+		if _, err := s.db.ExecContext(ctx, `UPDATE `+table+` SET text=NULL, payload_json=NULL WHERE request_id=?`, reqID); err != nil {
+			return err
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM drafts WHERE request_id=?`, reqID); err != nil {
+		return err
+	}
+	if err := s.redactEvents(ctx, reqID); err != nil {
+		return err
+	}
+	action, _, _, err := s.getAnswer(ctx, reqID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return s.indexAnswer(ctx, reqID, action, "")
+}
+
+func (s *store) redactEvents(ctx context.Context, reqID string) error {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT seq, payload_json, payload_encoding FROM events WHERE request_id=? AND type IN (?,?,?,?)`,
+		reqID, redactedEventTypes[0], redactedEventTypes[1], redactedEventTypes[2], redactedEventTypes[3],
+	)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		seq  int64
+		data []byte
+	}
+	var redacted []row
+	for rows.Next() {
+		var seq int64
+		var payload string
+		var encoding sql.NullString
+		if err := rows.Scan(&seq, &payload, &encoding); err != nil {
+			rows.Close()
+			return err
+		}
+		data, err := redactEventData(decodeEventPayload(payload, encoding))
+		if err != nil {
+			continue
+		}
+		redacted = append(redacted, row{seq, data})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range redacted {
+		data, encoding := encodeStoredText(string(r.data), s.compressBytes)
+		if _, err := s.db.ExecContext(ctx, `UPDATE events SET payload_json=?, payload_encoding=? WHERE seq=?`, data, encoding, r.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listRedactableAnswers returns up to limit requests answered before cutoff
+// whose answers are not redacted yet.
+func (s *store) listRedactableAnswers(ctx context.Context, cutoff int64, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT request_id FROM answers WHERE created_at<? AND redacted_at IS NULL ORDER BY created_at ASC LIMIT ?`,
+		cutoff, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// redactOldAnswers redacts the answers older than redact_answers_after_days
+// and reports how many it redacted.
+func (s *server) redactOldAnswers(ctx context.Context) int {
+	days := s.cfg().RedactAnswersAfterDays
+	if days <= 0 {
+		return 0
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	redacted := 0
+	for {
+		ids, err := s.db.listRedactableAnswers(ctx, cutoff, retentionBatchSize)
+		if err != nil {
+			slog.Error("retention: list answers to redact", "error", err)
+			return redacted
+		}
+		for _, id := range ids {
+			if err := s.db.redactAnswers(ctx, id, time.Now()); err != nil {
+				slog.Error("retention: redact answer", "request_id", id, "error", err)
+				return redacted
+			}
+			s.hub.forgetTerminal(id)
+			redacted++
+		}
+		if len(ids) < retentionBatchSize {
+			return redacted
+		}
+	}
+}
+
+// handleRedactRequest serves POST /v1/requests/{id}/redact.
+func (s *server) handleRedactRequest(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isTerminalStatus(status) {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request is still open",
+		})
+		return
+	}
+	now := time.Now()
+	if err := s.db.redactAnswers(ctx, requestID, now); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.hub.forgetTerminal(requestID)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"request_id":  requestID,
+		"redacted_at": now.UTC().Format(time.RFC3339),
+	})
+}
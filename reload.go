@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The config file is read again on SIGHUP and when it changes on disk (checked
+// every few seconds), without dropping connections. The new file must load and
+// validate as a whole, or the running config stays. Notifier settings,
+// priorities, contacts, rate limits, IP rules, secrets, API keys, schedules,
+// page branding and log_level apply at once; keys in restartOnlyKeys keep
+// their old value, with a warning, until the next start. Ask templates live in
+// the database and need no reload.
+
+const configWatchInterval = 3 * time.Second
+
+// restartOnlyKeys are the settings bound at startup: listeners, storage,
+// the hub, log output and the retention loop.
+var restartOnlyKeys = map[string]bool{
+	"listen_addr":            true,
+	"listen_socket_mode":     true,
+	"sqlite_path":            true,
+	"sqlite_read_conns":      true,
+	"sqlite_busy_timeout_ms": true,
+	"database_driver":        true,
+	"database_url":           true,
+	"hub_driver":             true,
+	"hub_url":                true,
+	"hub_channel":            true,
+	"terminal_cache_seconds": true,
+	"sse_buffer_size":        true,
+	"notify_workers":         true,
+	"notify_channel_limits":  true,
+	"tls_mode":               true,
+	"tls_cert_file":          true,
+	"tls_key_file":           true,
+	"tls_http_addr":          true,
+	"acme_domains":           true,
+	"acme_cache_dir":         true,
+	"acme_email":             true,
+	"acme_directory_url":     true,
+	"log_format":             true,
+	"log_file":               true,
+	"log_max_size_mb":        true,
+	"log_max_backups":        true,
+	"payload_compress_bytes": true,
+	"dedup_bodies":           true,
+	"retention_days":         true,
+	"retention_archive_path": true,
+	"max_events":             true,
+	"max_requests":           true,
+	"attachments_driver":     true,
+	"attachments_dir":        true,
+	"s3_endpoint":            true,
+	"s3_region":              true,
+	"s3_bucket":              true,
+	"s3_access_key_id":       true,
+	"s3_secret_access_key":   true,
+	"s3_path_style":          true,
+	"s3_presign_seconds":     true,
+	"telegram_bot_token":     true,
+	// Like retention_days, this decides whether the janitor runs at all.
+	"redact_answers_after_days": true,
+}
+
+// keepRestartOnly copies the restart-only settings of old into next and
+// returns the keys whose value had changed.
+func keepRestartOnly(old, next *Config) []string {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	t := ov.Type()
+	var changed []string
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if !restartOnlyKeys[key] {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			changed = append(changed, key)
+			nv.Field(i).Set(ov.Field(i))
+		}
+	}
+	return changed
+}
+
+// syncConfigTables writes the config's schedules and API keys to the
+// database.
+func (s *server) syncConfigTables(ctx context.Context) error {
+	if err := s.syncConfigSchedules(ctx); err != nil {
+		return err
+	}
+	return s.syncConfigAPIKeys(ctx)
+}
+
+func (s *server) reloadConfig(ctx context.Context, path string) error {
+	next, err := loadConfigAny(path)
+	if err != nil {
+		return err
+	}
+	next.resolveSQLitePath()
+	old := s.cfg()
+	kept := keepRestartOnly(old, &next)
+	s.conf.Store(&next)
+	if err := s.syncConfigTables(ctx); err != nil {
+		s.conf.Store(old)
+		_ = s.syncConfigTables(ctx)
+		return err
+	}
+	setLogLevel(next.LogLevel)
+	if len(kept) > 0 {
+		slog.Warn("config: changes need a restart", "keys", strings.Join(kept, ","))
+	}
+	slog.Info("config reloaded", "path", path)
+	return nil
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, false
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, true
+}
+
+// watchConfig reloads path on SIGHUP or when its mtime or size changes.
+func (s *server) watchConfig(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	t := time.NewTicker(configWatchInterval)
+	defer t.Stop()
+
+	last, _ := statFile(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last, _ = statFile(path)
+		case <-t.C:
+			cur, ok := statFile(path)
+			if !ok || cur == last {
+				continue
+			}
+			last = cur
+		}
+		if err := s.reloadConfig(ctx, path); err != nil {
+			slog.Error("config reload failed, keeping the running config", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleRequestsAPI dispatches the authenticated /v1/requests routes.
+func (s *server) handleRequestsAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/requests"), "/")
+	if path == "" {
+		s.handleListRequests(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	requestID := parts[0]
+	if !isValidRequestID(requestID) {
+		http.Error(w, "invalid request_id", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.visible(r.Context(), requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	sub := ""
+	if len(parts) > 1 {
+		sub = strings.Join(parts[1:], "/")
+	}
+	switch sub {
+	case "":
+		s.handleGetRequest(w, r, requestID)
+	case "cancel":
+		s.handleCancelRequest(w, r, requestID)
+	case "ack":
+		s.handleAckRequest(w, r, requestID)
+	case "answer":
+		s.handleAnswerRequest(w, r, requestID)
+	case "compact":
+		s.handleCompactRequest(w, r, requestID)
+	case "redact":
+		s.handleRedactRequest(w, r, requestID)
+	case "events":
+		if r.Method == http.MethodPost {
+			s.handlePostRequestEvent(w, r, requestID)
+			return
+		}
+		s.handleRequestEvents(w, r, requestID)
+	case "tokens/rotate", "tokens/revoke":
+		s.handleTokens(w, r, requestID, strings.TrimPrefix(sub, "tokens/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRequestEvents serves GET /v1/requests/{id}/events, the stored events
+// of a request in order. after is the ID of the last event the client has
+// (as in SSE last_event_id) and types a comma-separated list of event types
+// to return. next_after is always present, so a client can keep polling with it
+// after long offline periods without replaying what it already has.
+func (s *server) handleRequestEvents(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	q := r.URL.Query()
+	f := eventFilter{After: strings.TrimSpace(q.Get("after")), Limit: 100}
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		f.Limit = min(v, 1000)
+	}
+	for _, t := range strings.Split(q.Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.Types = append(f.Types, t)
+		}
+	}
+	if _, _, err := s.db.getRequestStatus(ctx, requestID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// One more than asked tells whether there is another page.
+	f.Limit++
+	evs, err := s.db.listEvents(ctx, requestID, f)
+	if err != nil {
+		if errors.Is(err, errUnknownEventCursor) {
+			http.Error(w, "after names no event of this request", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	hasMore := len(evs) == f.Limit
+	if hasMore {
+		evs = evs[:len(evs)-1]
+	}
+	next := f.After
+	if len(evs) > 0 {
+		next = evs[len(evs)-1].ID
+	}
+	if evs == nil {
+		evs = []Event{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"request_id": requestID,
+		"events":     evs,
+		"next_after": nullIfEmpty(next),
+		"has_more":   hasMore,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// handleCancelRequest serves POST /v1/requests/{id}/cancel. Scheduled asks
+// are cancelled before their notification goes out; open asks are closed
+// with a terminal request.cancelled event.
+func (s *server) handleCancelRequest(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16)); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		if err := json.Unmarshal(b, &body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if isTerminalStatus(status) {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request already finished",
+		})
+		return
+	}
+
+	wasScheduled, err := s.db.deleteScheduled(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.updateRequestStatus(ctx, requestID, "cancelled"); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"previous_status": status,
+		"before_delivery": wasScheduled,
+	}
+	if reason := strings.TrimSpace(body.Reason); reason != "" {
+		data["reason"] = truncate(reason, 500)
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.cancelled", data)
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"request_id": requestID,
+		"status":     "cancelled",
+	})
+}
+
+// handleAnswerRequest serves POST /v1/requests/{id}/answer, which answers an
+// open ask without its link (ask4me inbox uses it). The body carries what the
+// page would submit: action, text and/or payload, plus responder in
+// multi-responder mode. Multi-step asks can only be answered on the page.
+func (s *server) handleAnswerRequest(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Action    string          `json:"action"`
+		Text      string          `json:"text"`
+		Payload   json.RawMessage `json:"payload"`
+		Responder string          `json:"responder"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	err := s.answerRemote(r.Context(), requestID, remoteAnswer{
+		Action:    body.Action,
+		Text:      body.Text,
+		Payload:   body.Payload,
+		Responder: body.Responder,
+		Via:       "api",
+	})
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, map[string]any{
+			"request_id": requestID,
+			"status":     "submitted",
+		})
+	case errors.Is(err, errAnswerNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, errAnswerNotOpen):
+		status, _, _ := s.db.getRequestStatus(r.Context(), requestID)
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request is not open",
+		})
+	case errors.Is(err, errAnswerTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errAnswerInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// remoteAnswer is an answer given somewhere other than the interaction page.
+// Via names where ("api", "slack", ...) and is recorded on user.submitted.
+type remoteAnswer struct {
+	Action    string
+	Text      string
+	Payload   json.RawMessage
+	Responder string
+	Via       string
+}
+
+var (
+	errAnswerNotFound = errors.New("not found")
+	errAnswerNotOpen  = errors.New("request is not open")
+	errAnswerTaken    = errors.New("already answered")
+	errAnswerInvalid  = errors.New("invalid answer")
+)
+
+// answerRemote records a as the answer to requestID, like a submit from the
+// page. Its errors wrap the errAnswer* values.
+func (s *server) answerRemote(ctx context.Context, requestID string, a remoteAnswer) error {
+	action := strings.TrimSpace(a.Action)
+	text := strings.TrimSpace(a.Text)
+	responder := strings.TrimSpace(a.Responder)
+	var payload any
+	var payloadToStore sql.NullString
+	if len(a.Payload) > 0 && string(a.Payload) != "null" {
+		if err := json.Unmarshal(a.Payload, &payload); err != nil {
+			return fmt.Errorf("%w: invalid payload", errAnswerInvalid)
+		}
+		payloadToStore = sql.NullString{String: string(a.Payload), Valid: true}
+	}
+	if action == "" && text == "" && !payloadToStore.Valid {
+		return fmt.Errorf("%w: empty answer", errAnswerInvalid)
+	}
+
+	status, expiresAt, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errAnswerNotFound
+		}
+		return err
+	}
+	if isTerminalStatus(status) || time.Now().Unix() > expiresAt || status == "scheduled" {
+		return errAnswerNotOpen
+	}
+	if steps, _, err := s.db.getSteps(ctx, requestID); err != nil {
+		return err
+	} else if len(steps) > 0 {
+		return fmt.Errorf("%w: multi-step requests can only be answered on the page", errAnswerInvalid)
+	}
+	mode, _, err := s.db.getRespondersMode(ctx, requestID)
+	if err != nil {
+		return err
+	}
+
+	hook := s.checkAnswer(ctx, answerHookInput{
+		RequestID: requestID,
+		Action:    action,
+		Text:      text,
+		Payload:   payload,
+		Responder: responder,
+		Via:       a.Via,
+	})
+	if hook.Reject != "" {
+		return fmt.Errorf("%w: %s", errAnswerInvalid, hook.Reject)
+	}
+
+	data := map[string]any{
+		"action": action,
+		"text":   text,
+		"via":    a.Via,
+	}
+	if payload != nil {
+		data["payload"] = payload
+	}
+	if responder != "" {
+		data["responder"] = responder
+	}
+	if hook.Data != nil {
+		data["hook"] = hook.Data
+	}
+	if isMultiAnswerMode(mode) {
+		if ok, err := s.db.isResponder(ctx, requestID, responder); err != nil || !ok {
+			return fmt.Errorf("%w: responder must name one of the request's responders", errAnswerInvalid)
+		}
+		accepted, err := s.submitCollect(ctx, requestID, responder, action, text, payloadToStore, data)
+		if err != nil && !accepted {
+			return err
+		}
+		if !accepted {
+			return errAnswerTaken
+		}
+		return nil
+	}
+	if err := s.db.insertAnswer(ctx, requestID, responder, action, text, payloadToStore); err != nil {
+		if isUniqueViolation(err) {
+			return errAnswerTaken
+		}
+		return err
+	}
+	if won, err := s.db.markSubmitted(ctx, requestID); err != nil || !won {
+		// The request expired meanwhile; see grace.go.
+		_ = s.db.deleteAnswer(ctx, requestID)
+		if err != nil {
+			return err
+		}
+		return errAnswerNotOpen
+	}
+	_ = s.db.deleteDrafts(ctx, requestID)
+	ev := s.mustNewEvent(ctx, requestID, "user.submitted", data)
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Request storage. A new ask is handed to the store as a whole: the request
+// row carries every per-feature column (steps, session, priority, callback,
+// responders, SLA, ...) in one INSERT, and its tags and search entry are
+// written in the same transaction, so a failure part way leaves no request
+// behind rather than one with some of its settings. Tokens, attachments and
+// short links follow once the row exists; when one of them fails, the
+// request is discarded again.
+
+// requestStore keeps new asks; *store implements it on every database
+// driver.
+type requestStore interface {
+	createRequest(ctx context.Context, nr newRequest) error
+	discardRequest(ctx context.Context, reqID string) error
+}
+
+var _ requestStore = (*store)(nil)
+
+// newRequest is a normalised ask ready to be stored.
+type newRequest struct {
+	ID          string
+	Ask         askRequest
+	ExpiresAt   time.Time
+	SLAAt       time.Time
+	ContentHash string
+}
+
+func (s *store) createRequest(ctx context.Context, nr newRequest) error {
+	ar := nr.Ask
+	storedBody, bodyHash, err := s.storeBody(ctx, ar.Body)
+	if err != nil {
+		return err
+	}
+	var schemaJSON, uiSchemaJSON, dataJSON, submitLabel, renderer sql.NullString
+	if ar.JsonForms != nil && len(bytes.TrimSpace(ar.JsonForms.Schema)) > 0 {
+		schemaJSON = nullTrimmed(string(ar.JsonForms.Schema))
+		uiSchemaJSON = nullTrimmed(string(ar.JsonForms.UISchema))
+		dataJSON = nullTrimmed(string(ar.JsonForms.Data))
+		submitLabel = nullTrimmed(ar.JsonForms.SubmitLabel)
+		renderer = nullTrimmed(ar.JsonForms.Renderer)
+	}
+	var respondersMode, respondersMin, approvalJSON any
+	if ar.Responders != nil {
+		respondersMode, respondersMin = ar.Responders.Mode, ar.Responders.MinAnswers
+		if ar.Responders.Approval != nil {
+			b, err := json.Marshal(ar.Responders.Approval)
+			if err != nil {
+				return err
+			}
+			approvalJSON = string(b)
+		}
+	}
+	var stepsJSON, currentStep any
+	if len(ar.Steps) > 0 {
+		b, err := json.Marshal(ar.Steps)
+		if err != nil {
+			return err
+		}
+		stepsJSON, currentStep = string(b), 0
+	}
+	var priority any
+	if ar.Priority != priorityNormal {
+		priority = nullIfEmpty(ar.Priority)
+	}
+	var extendSeconds, maxExtensions any
+	if ar.ExtendSeconds > 0 {
+		extendSeconds, maxExtensions = ar.ExtendSeconds, ar.MaxExtensions
+	}
+	var slaSeconds, slaAt, escalateTo any
+	if ar.SLASeconds > 0 {
+		slaSeconds, slaAt, escalateTo = ar.SLASeconds, nr.SLAAt.Unix(), nullIfEmpty(ar.EscalateTo)
+	}
+	var callbackSecret any
+	if ar.CallbackURL != "" {
+		callbackSecret = nullIfEmpty(ar.CallbackSecret)
+	}
+
+	now := time.Now().Unix()
+	return s.db.inTx(ctx, func(tx *dbTx) error {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO requests(
+				request_id,title,body,body_hash,mcd,status,expires_at,created_at,updated_at,
+				jsonforms_schema_json,jsonforms_uischema_json,jsonforms_data_json,jsonforms_submit_label,jsonforms_renderer,
+				responders_mode,responders_min,approval_json,steps_json,current_step,
+				session_id,schedule_id,priority,default_action,parent_request_id,
+				allow_uploads,one_time_link,challenge,callback_url,callback_secret,
+				terminal_events,heartbeat_seconds,buffer_size,content_hash,bundle_id,
+				extend_seconds,max_extensions,voice_input,notify_result,tenant,
+				ask_name,sla_seconds,sla_at,escalate_to
+			) VALUES(?,?,?,?,?,?,?,?,?, ?,?,?,?,?, ?,?,?,?,?, ?,?,?,?,?, ?,?,?,?,?, ?,?,?,?,?, ?,?,?,?,?, ?,?,?,?)`,
+			nr.ID, ar.Title, storedBody, bodyHash, ar.MCD, "created", nr.ExpiresAt.Unix(), now, now,
+			schemaJSON, uiSchemaJSON, dataJSON, submitLabel, renderer,
+			respondersMode, respondersMin, approvalJSON, stepsJSON, currentStep,
+			nullIfEmpty(ar.SessionID), nullIfEmpty(ar.scheduleID), priority, nullIfEmpty(ar.DefaultAction), nullIfEmpty(ar.ParentRequestID),
+			nullIfFalse(ar.AllowUploads), nullIfEmpty(ar.OneTimeLink), nullIfEmpty(ar.Challenge),
+			nullIfEmpty(ar.CallbackURL), callbackSecret, nullIfEmpty(strings.Join(ar.TerminalEvents, ",")),
+			sql.NullInt64{Int64: int64(ar.HeartbeatSeconds), Valid: ar.HeartbeatSeconds > 0},
+			sql.NullInt64{Int64: int64(ar.BufferSize), Valid: ar.BufferSize > 0}, nullIfEmpty(nr.ContentHash),
+			nullIfEmpty(ar.bundleID), extendSeconds, maxExtensions, nullIfFalse(ar.VoiceInput),
+			nullIfFalse(ar.NotifyResult), nullIfEmpty(ar.Tenant), nullIfFalse(ar.AskName),
+			slaSeconds, slaAt, escalateTo,
+		); err != nil {
+			return err
+		}
+		for _, t := range ar.Tags {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO request_tags(request_id,tag) VALUES(?,?)`, nr.ID, t); err != nil {
+				return err
+			}
+		}
+		return indexRequest(ctx, tx, nr.ID, ar.Title, ar.Body)
+	})
+}
+
+// discardRequest removes a request whose creation failed after
+// createRequest. Its attachments become unused uploads again, so that a retry
+// can link them.
+func (s *store) discardRequest(ctx context.Context, reqID string) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE attachments SET request_id=NULL WHERE request_id=?`, reqID); err != nil {
+		return err
+	}
+	return s.deleteRequests(ctx, []string{reqID})
+}
+
+// nullTrimmed is v without surrounding space, or NULL when that is empty.
+func nullTrimmed(v string) sql.NullString {
+	v = strings.TrimSpace(v)
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+func nullIfFalse(v bool) any {
+	if !v {
+		return nil
+	}
+	return 1
+}
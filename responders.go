@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	respondersModeFirst   = "first"
+	respondersModeCollect = "collect"
+	respondersModeQuorum  = "quorum"
+
+	maxResponders = 50
+)
+
+// responderSpec is one entry of askRequest.Responders.List. Channel fields are
+// optional; when empty the server's configured channels are used.
+type responderSpec struct {
+	Name              string   `json:"name"`
+	ServerChanSendKey string   `json:"serverchan_sendkey"`
+	AppriseURLs       []string `json:"apprise_urls"`
+}
+
+// respondersSpec enables multi-responder mode: every responder gets its own
+// token and link. In "first" mode the first submission resolves the request
+// (the default single-responder behaviour); in "collect" mode submissions are
+// gathered until MinAnswers is reached or the request expires, then a
+// request.completed event carries all of them. "quorum" mode works like
+// "collect" but finishes as soon as Approval decides the outcome.
+type respondersSpec struct {
+	Mode       string          `json:"mode"`
+	Count      int             `json:"count"`
+	MinAnswers int             `json:"min_answers"`
+	List       []responderSpec `json:"list"`
+	Approval   *approvalPolicy `json:"approval"`
+}
+
+type responderLink struct {
+	Name     string
+	URL      string
+	ShortURL string
+	Target   notifyTarget
+}
+
+// notifyURL is the link to put in notifications: the short link when there
+// is one.
+func (l responderLink) notifyURL() string {
+	if l.ShortURL != "" {
+		return l.ShortURL
+	}
+	return l.URL
+}
+
+type responseRecord struct {
+	Responder   string
+	Action      string
+	Text        string
+	PayloadJSON sql.NullString
+	CreatedAt   int64
+}
+
+func normalizeResponders(ar *askRequest) error {
+	rs := ar.Responders
+	if rs == nil {
+		return nil
+	}
+	rs.Mode = strings.ToLower(strings.TrimSpace(rs.Mode))
+	switch rs.Mode {
+	case "":
+		rs.Mode = respondersModeFirst
+	case respondersModeFirst, respondersModeCollect, respondersModeQuorum:
+	default:
+		return badAskError("responders.mode must be first, collect or quorum")
+	}
+	if len(rs.List) == 0 {
+		if rs.Count <= 1 && rs.Mode == respondersModeFirst {
+			ar.Responders = nil
+			return nil
+		}
+		if rs.Count <= 0 {
+			return badAskError("responders.count or responders.list is required")
+		}
+		if rs.Count > maxResponders {
+			return badAskError(fmt.Sprintf("responders.count must be <= %d", maxResponders))
+		}
+		for i := 0; i < rs.Count; i++ {
+			rs.List = append(rs.List, responderSpec{})
+		}
+	}
+	if len(rs.List) > maxResponders {
+		return badAskError(fmt.Sprintf("responders.list must have <= %d entries", maxResponders))
+	}
+	seen := map[string]struct{}{}
+	for i := range rs.List {
+		name := strings.TrimSpace(rs.List[i].Name)
+		if name == "" {
+			name = fmt.Sprintf("responder%d", i+1)
+		}
+		if len(name) > 64 {
+			return badAskError("responders.list[].name is too long")
+		}
+		if _, ok := seen[name]; ok {
+			return badAskError("responders.list[].name must be unique")
+		}
+		seen[name] = struct{}{}
+		rs.List[i].Name = name
+		rs.List[i].ServerChanSendKey = strings.TrimSpace(rs.List[i].ServerChanSendKey)
+	}
+	rs.Count = len(rs.List)
+	switch rs.Mode {
+	case respondersModeCollect:
+		if rs.MinAnswers <= 0 || rs.MinAnswers > rs.Count {
+			rs.MinAnswers = rs.Count
+		}
+	case respondersModeQuorum:
+		if rs.Approval == nil {
+			rs.Approval = &approvalPolicy{}
+		}
+		if err := rs.Approval.normalize(rs.Count); err != nil {
+			return err
+		}
+		rs.MinAnswers = rs.Approval.Required
+	default:
+		rs.MinAnswers = 1
+		rs.Approval = nil
+	}
+	return nil
+}
+
+// isMultiAnswerMode reports whether a responders mode keeps the request open
+// after the first submission.
+func isMultiAnswerMode(mode string) bool {
+	return mode == respondersModeCollect || mode == respondersModeQuorum
+}
+
+// issueResponderTokens mints one token per responder (or a single anonymous
+// token when multi-responder mode is off) and returns the matching links.
+func (s *server) issueResponderTokens(ctx context.Context, requestID string, ar askRequest, expiresAt time.Time) ([]responderLink, error) {
+	if ar.Responders == nil {
+		tokenPlain := genToken()
+		if err := s.db.insertToken(ctx, requestID, sha256Hex(tokenPlain), string(ar.To), expiresAt); err != nil {
+			return nil, err
+		}
+		return []responderLink{{URL: s.makeInteractionURL(requestID, tokenPlain)}}, nil
+	}
+
+	links := make([]responderLink, 0, len(ar.Responders.List))
+	for _, r := range ar.Responders.List {
+		tokenPlain := genToken()
+		if err := s.db.insertToken(ctx, requestID, sha256Hex(tokenPlain), r.Name, expiresAt); err != nil {
+			return nil, err
+		}
+		target := notifyTarget{ServerChanSendKey: r.ServerChanSendKey, AppriseURLs: r.AppriseURLs}
+		if target.ServerChanSendKey == "" && len(target.AppriseURLs) == 0 {
+			// A responder named after a contact gets the contact's channels.
+			if ct, ok := s.contactTarget(r.Name, ar.Priority); ok {
+				target = ct
+			}
+		}
+		links = append(links, responderLink{
+			Name:   r.Name,
+			URL:    s.makeInteractionURL(requestID, tokenPlain),
+			Target: target,
+		})
+	}
+	return links, nil
+}
+
+func responderLinksData(links []responderLink) []map[string]any {
+	out := make([]map[string]any, 0, len(links))
+	for _, l := range links {
+		m := map[string]any{
+			"name":            l.Name,
+			"interaction_url": l.URL,
+		}
+		if l.ShortURL != "" {
+			m["short_url"] = l.ShortURL
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// sendResponderNotifications delivers every responder's link in parallel.
+// Individual failures are reported as notify.responder_failed; it returns an
+// error only when no responder could be notified.
+func (s *server) sendResponderNotifications(ctx context.Context, requestID string, ar askRequest, links []responderLink) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	for _, l := range links {
+		wg.Add(1)
+		go func(l responderLink) {
+			defer wg.Done()
+			target := l.Target
+			if target.ServerChanSendKey == "" && len(target.AppriseURLs) == 0 {
+				target = s.notifyTargetFor(ar)
+			}
+			fields, err := s.deliverNotification(ctx, target, ar, l.URL)
+			if err != nil {
+				fields = notifyErrorFields(err)
+				fields["responder"] = l.Name
+				ev := s.mustNewEvent(ctx, requestID, "notify.responder_failed", fields)
+				_ = s.persistTerminalAware(ctx, ev)
+				return
+			}
+			fields["responder"] = l.Name
+			ev := s.mustNewEvent(ctx, requestID, "notify.sent", fields)
+			_ = s.persistTerminalAware(ctx, ev)
+			mu.Lock()
+			sent++
+			mu.Unlock()
+		}(l)
+	}
+	wg.Wait()
+
+	if sent == 0 {
+		return &notifyError{fields: map[string]any{
+			"error":      "notification failed for every responder",
+			"responders": len(links),
+		}}
+	}
+	_ = s.db.updateRequestStatus(ctx, requestID, "delivered")
+	return nil
+}
+
+// submitCollect records one responder's answer for a collect- or quorum-mode
+// request and completes the request once enough answers are in (or, for
+// quorum, once the vote is decided). It returns false when the responder
+// already answered.
+func (s *server) submitCollect(ctx context.Context, requestID, responder, action, text string, payloadJSON sql.NullString, data map[string]any) (bool, error) {
+	if err := s.db.insertResponse(ctx, requestID, responder, action, text, payloadJSON); err != nil {
+		if isUniqueViolation(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	ev := s.mustNewEvent(ctx, requestID, "user.submitted", data)
+	_ = s.persistTerminalAware(ctx, ev)
+
+	mode, need, err := s.db.getRespondersMode(ctx, requestID)
+	if err != nil {
+		return true, err
+	}
+	responses, err := s.db.listResponses(ctx, requestID)
+	if err != nil {
+		return true, err
+	}
+	if mode == respondersModeQuorum {
+		policy, err := s.db.getApprovalPolicy(ctx, requestID)
+		if err != nil {
+			return true, err
+		}
+		total, err := s.db.countResponders(ctx, requestID)
+		if err != nil {
+			return true, err
+		}
+		if outcome, decided := policy.evaluate(responses, total); decided {
+			s.completeCollect(ctx, requestID, responses, need, true, policy.summary(outcome, responses, total))
+		}
+		return true, nil
+	}
+	if len(responses) >= need {
+		s.completeCollect(ctx, requestID, responses, need, true, nil)
+	}
+	return true, nil
+}
+
+// completeCollect emits the aggregate request.completed event. The answers
+// row doubles as a completion guard so concurrent submissions complete the
+// request only once.
+func (s *server) completeCollect(ctx context.Context, requestID string, responses []responseRecord, need int, complete bool, extra map[string]any) {
+	answers := make([]map[string]any, 0, len(responses))
+	for _, r := range responses {
+		a := map[string]any{
+			"responder":    r.Responder,
+			"action":       r.Action,
+			"text":         r.Text,
+			"submitted_at": time.Unix(r.CreatedAt, 0).UTC().Format(time.RFC3339),
+		}
+		if r.PayloadJSON.Valid {
+			a["payload"] = json.RawMessage(r.PayloadJSON.String)
+		}
+		answers = append(answers, a)
+	}
+	b, _ := json.Marshal(answers)
+	if err := s.db.insertAnswer(ctx, requestID, "", "", "", sql.NullString{String: string(b), Valid: true}); err != nil {
+		// A unique violation means another submission completed it first.
+		if !isUniqueViolation(err) {
+			slog.Error("complete responses", "request_id", requestID, "error", err)
+		}
+		return
+	}
+	if won, err := s.db.markSubmitted(ctx, requestID); err != nil || !won {
+		// The request expired or was cancelled meanwhile, as in handleUser.
+		_ = s.db.deleteAnswer(ctx, requestID)
+		if err != nil {
+			slog.Error("complete responses", "request_id", requestID, "error", err)
+		}
+		return
+	}
+	data := map[string]any{
+		"complete":      complete,
+		"min_answers":   need,
+		"answers_count": len(answers),
+		"answers":       answers,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.completed", data)
+	_ = s.persistTerminalAware(ctx, ev)
+	s.setTerminal(ev)
+}
+
+// getRespondersMode returns the multi-responder mode and required answer
+// count; single-responder requests report ("", 1).
+func (s *store) getRespondersMode(ctx context.Context, reqID string) (string, int, error) {
+	var mode sql.NullString
+	var need sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT responders_mode, responders_min FROM requests WHERE request_id=?`, reqID).Scan(&mode, &need)
+	if err != nil {
+		return "", 0, err
+	}
+	if !need.Valid || need.Int64 <= 0 {
+		need.Int64 = 1
+	}
+	return mode.String, int(need.Int64), nil
+}
+
+func (s *store) getTokenResponder(ctx context.Context, reqID, tokenHash string) (string, error) {
+	var responder sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT responder FROM tokens WHERE request_id=? AND token_hash=?`, reqID, tokenHash).Scan(&responder)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return responder.String, nil
+}
+
+func (s *store) insertResponse(ctx context.Context, reqID, responder, action, text string, payloadJSON sql.NullString) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO responses(request_id,responder,action,text,payload_json,created_at) VALUES(?,?,?,?,?,?)`,
+		reqID, responder, nullIfEmpty(action), nullIfEmpty(text), payloadJSON, time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *store) hasResponse(ctx context.Context, reqID, responder string) (bool, error) {
+	var x int
+	err := s.db.QueryRowContext(ctx, `SELECT 1 FROM responses WHERE request_id=? AND responder=?`, reqID, responder).Scan(&x)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isResponder reports whether name is one of the request's responders.
+func (s *store) isResponder(ctx context.Context, reqID, name string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	var x int
+	err := s.db.QueryRowContext(ctx, `SELECT 1 FROM tokens WHERE request_id=? AND responder=? LIMIT 1`, reqID, name).Scan(&x)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *store) listResponses(ctx context.Context, reqID string) ([]responseRecord, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT responder, action, text, payload_json, created_at FROM responses WHERE request_id=? ORDER BY created_at ASC, responder ASC`,
+		reqID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []responseRecord
+	for rows.Next() {
+		var r responseRecord
+		var action, text sql.NullString
+		if err := rows.Scan(&r.Responder, &action, &text, &r.PayloadJSON, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.Action = action.String
+		r.Text = text.String
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Result pushes. A person who answered from a notification, or never got to
+// it, hears nothing more once the ask is over. With notify_result (for every
+// ask, or per ask), the end of an ask is pushed as a second notification
+// through the same channels as the first: "You answered: Approve", "Expired
+// without an answer", and so on, linking to the page with the recap. It is
+// recorded as notify.result_sent or notify.result_failed and never retried.
+//
+// Only asks whose notification went out get a follow-up: not those answered
+// by a policy before anyone was notified, not those whose push failed, and not
+// the asks of a bundle, which share one notification.
+
+func (s *store) getNotifyResult(ctx context.Context, reqID string) (bool, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT notify_result FROM requests WHERE request_id=?`, reqID).Scan(&v); err != nil {
+		return false, err
+	}
+	return v.Int64 != 0, nil
+}
+
+// pushResult sends the follow-up for the final event ev, if one is wanted.
+func (s *server) pushResult(ev Event) {
+	if ev.Type == "notify.failed" {
+		return
+	}
+	ctx := context.Background()
+	on, err := s.db.getNotifyResult(ctx, ev.RequestID)
+	if err != nil || !on && !s.cfg().NotifyResult {
+		return
+	}
+	if _, ok, err := s.db.getLatestEventByTypes(ctx, ev.RequestID, []string{"notify.sent"}); err != nil || !ok {
+		return
+	}
+	if bundleID, err := s.db.bundleOf(ctx, ev.RequestID); err != nil || bundleID != "" {
+		return
+	}
+	req, err := s.db.getRequestSummary(ctx, ev.RequestID)
+	if err != nil {
+		return
+	}
+	var labels []buttonSpec
+	if form, err := s.db.getRequestForm(ctx, ev.RequestID); err == nil {
+		mcd, _ := form["mcd"].(string)
+		labels = parseMCD(mcd).Buttons
+	}
+	title, body := resultMessage(ev, req.Title, labels)
+	var created struct {
+		InteractionURL string `json:"interaction_url"`
+		ShortURL       string `json:"short_url"`
+		To             string `json:"to"`
+	}
+	if cev, ok, err := s.db.getLatestEventByTypes(ctx, ev.RequestID, []string{"request.created"}); err == nil && ok {
+		_ = json.Unmarshal(cev.Data, &created)
+	}
+	link := cmp.Or(created.ShortURL, created.InteractionURL)
+	target := s.notifyTargetFor(askRequest{Priority: req.Priority, Tenant: req.Tenant, To: addressees(created.To)})
+	ar := askRequest{Title: title, Body: body}
+	fields, err := s.deliverNotification(ctx, target, ar, link)
+	typ := "notify.result_sent"
+	if err != nil {
+		fields = notifyErrorFields(err)
+		typ = "notify.result_failed"
+	}
+	fields["result"] = ev.Type
+	out := s.mustNewEvent(ctx, ev.RequestID, typ, fields)
+	_ = s.persistTerminalAware(ctx, out)
+}
+
+// resultMessage words the follow-up for the final event ev of the ask
+// titled title. buttons turn an action back into its label.
+func resultMessage(ev Event, title string, buttons []buttonSpec) (string, string) {
+	var d struct {
+		Action       string `json:"action"`
+		Text         string `json:"text"`
+		Responder    string `json:"responder"`
+		AnsweredBy   string `json:"answered_by"`
+		Complete     bool   `json:"complete"`
+		AnswersCount int    `json:"answers_count"`
+		Reason       string `json:"reason"`
+	}
+	_ = json.Unmarshal(ev.Data, &d)
+	answer := d.Action
+	for _, b := range buttons {
+		if b.Value == d.Action {
+			answer = b.Label
+			break
+		}
+	}
+	if d.Text != "" {
+		answer = strings.TrimSpace(answer + "\n\n" + d.Text)
+	}
+	switch ev.Type {
+	case "user.submitted":
+		switch {
+		case d.AnsweredBy == "timeout_default":
+			return "Expired: " + title, "Nobody answered in time, so the default was used: " + answer
+		case d.AnsweredBy != "":
+			return "Answered: " + title, "Answered automatically: " + answer
+		case d.Responder != "":
+			return "Answered: " + title, fmt.Sprintf("%s answered: %s", d.Responder, answer)
+		case answer == "":
+			return "Answered: " + title, "Your answer was received."
+		}
+		return "Answered: " + title, "You answered: " + answer
+	case "request.completed":
+		if !d.Complete {
+			return "Expired: " + title, fmt.Sprintf("Expired with %d answers, fewer than needed.", d.AnswersCount)
+		}
+		return "Completed: " + title, fmt.Sprintf("Completed with %d answers.", d.AnswersCount)
+	case "request.cancelled":
+		body := "The asker cancelled this request; no answer is needed."
+		if d.Reason != "" {
+			body += "\n\n" + d.Reason
+		}
+		return "Cancelled: " + title, body
+	}
+	return "Expired: " + title, "This request expired without an answer."
+}
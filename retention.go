@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// The retention janitor keeps the database from growing forever: requests
+// whose expiry lies more than retention_days in the past are removed with
+// everything attached to them (optionally appended to a JSONL archive
+// first), max_requests drops the oldest finished requests beyond a count,
+// and max_events caps the events table. Attachment files go with their
+// requests; uploads no ask referenced within a day are dropped.
+// redact_answers_after_days blanks old answer text (see redaction.go).
+
+const (
+	retentionTickInterval = time.Hour
+	// The in-memory backend has no disk to spill to, so it is pruned often.
+	memoryRetentionTickInterval = time.Minute
+	retentionBatchSize          = 200
+	defaultMemoryMaxRequests    = 1000
+)
+
+// requestTables lists every table keyed by request_id, children first.
+var requestTables = []string{"events", "tokens", "answers", "drafts", "responses", "step_answers", "scheduled_asks", "outbox", "attachments", "short_links", "bundles", "answer_claims", "request_tags", "request_search", "requests"}
+
+// listExpiredRequests returns up to limit requests that expired and were last
+// touched before cutoff.
+func (s *store) listExpiredRequests(ctx context.Context, cutoff int64, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT request_id FROM requests WHERE expires_at<? AND updated_at<? ORDER BY created_at ASC LIMIT ?`,
+		cutoff, cutoff, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// listOverflowRequests returns up to limit of the oldest finished requests
+// when more than maxRequests are stored. Open requests are never listed.
+func (s *store) listOverflowRequests(ctx context.Context, maxRequests, limit int) ([]string, error) {
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM requests`).Scan(&total); err != nil {
+		return nil, err
+	}
+	if total <= maxRequests {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT request_id FROM requests
+		 WHERE expires_at<? OR status IN ('submitted','expired','notify_failed','cancelled')
+		 ORDER BY created_at ASC LIMIT ?`,
+		time.Now().Unix(), min(total-maxRequests, limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// deleteRequests removes requests and all their rows.
+func (s *store) deleteRequests(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	for _, table := range requestTables {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE request_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimEvents deletes the oldest events beyond maxEvents and reports how many
+// went.
+func (s *store) trimEvents(ctx context.Context, maxEvents int) (int64, error) {
+	var keepFrom int64
+	err := s.db.QueryRowContext(ctx, `SELECT seq FROM events ORDER BY seq DESC LIMIT 1 OFFSET ?`, maxEvents-1).Scan(&keepFrom)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM events WHERE seq<?`, keepFrom)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// archiveRequests appends the requests to path in the /v1/export JSONL
+// format, so archives can be loaded back with -import.
+func (s *server) archiveRequests(ctx context.Context, path string, ids []string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	if err := s.db.eachExportRecord(ctx, exportFilter{IDs: ids}, true, func(rec exportRecord) error {
+		return enc.Encode(rec)
+	}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// removeRequests archives (when configured) and deletes one batch.
+func (s *server) removeRequests(ctx context.Context, ids []string) error {
+	if path := s.cfg().RetentionArchivePath; path != "" {
+		// Keep the rows rather than lose data that was meant to be archived.
+		if err := s.archiveRequests(ctx, path, ids); err != nil {
+			return fmt.Errorf("archive: %w", err)
+		}
+	}
+	if err := s.removeRequestBlobs(ctx, ids); err != nil {
+		return err
+	}
+	if err := s.db.deleteRequests(ctx, ids); err != nil {
+		return fmt.Errorf("delete requests: %w", err)
+	}
+	return nil
+}
+
+// pruneRequests removes batches returned by list until it runs dry.
+func (s *server) pruneRequests(ctx context.Context, list func() ([]string, error)) int {
+	removed := 0
+	for {
+		ids, err := list()
+		if err != nil {
+			slog.Error("retention: list requests", "error", err)
+			return removed
+		}
+		if len(ids) == 0 {
+			return removed
+		}
+		if err := s.removeRequests(ctx, ids); err != nil {
+			slog.Error("retention", "error", err)
+			return removed
+		}
+		removed += len(ids)
+		if len(ids) < retentionBatchSize {
+			return removed
+		}
+	}
+}
+
+// runRetention performs one janitor pass.
+func (s *server) runRetention(ctx context.Context) {
+	var removed int
+	if days := s.cfg().RetentionDays; days > 0 {
+		cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+		removed += s.pruneRequests(ctx, func() ([]string, error) {
+			return s.db.listExpiredRequests(ctx, cutoff, retentionBatchSize)
+		})
+	}
+	if s.cfg().MaxRequests > 0 {
+		removed += s.pruneRequests(ctx, func() ([]string, error) {
+			return s.db.listOverflowRequests(ctx, s.cfg().MaxRequests, retentionBatchSize)
+		})
+	}
+	var trimmed int64
+	if s.cfg().MaxEvents > 0 {
+		n, err := s.db.trimEvents(ctx, s.cfg().MaxEvents)
+		if err != nil {
+			slog.Error("retention: trim events", "error", err)
+		}
+		trimmed = n
+	}
+	redacted := s.redactOldAnswers(ctx)
+	dropped := s.prunePendingAttachments(ctx)
+	if _, err := s.db.pruneOrphanBodies(ctx); err != nil {
+		slog.Error("retention: prune bodies", "error", err)
+	}
+	if removed > 0 || trimmed > 0 || redacted > 0 || dropped > 0 {
+		slog.Info("retention", "removed_requests", removed, "trimmed_events", trimmed, "redacted_answers", redacted, "dropped_uploads", dropped)
+	}
+}
+
+func (s *server) retentionLoop(ctx context.Context) {
+	if s.cfg().RetentionDays <= 0 && s.cfg().MaxEvents <= 0 && s.cfg().MaxRequests <= 0 && s.cfg().RedactAnswersAfterDays <= 0 &&
+		s.blobs == nil && !s.cfg().DedupBodies {
+		return
+	}
+	interval := retentionTickInterval
+	if s.cfg().DatabaseDriver == databaseDriverMemory {
+		interval = memoryRetentionTickInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.runRetention(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
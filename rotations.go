@@ -0,0 +1,384 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// On-call rotations. An entry of the `rotations` config section is a weekly
+// rota over contacts from the directory: the shift changes hands every week
+// at `handoff` ("mon 09:00" in `timezone`), and the first contact takes the
+// shift that starts on or after `start`. An ask with "to" naming a rotation
+// goes to whoever is on call when it is made, as if it had named them.
+//
+// The schedule itself is config; what changes at runtime is stored as one
+// override per rotation: POST /v1/rotations/{name}/override puts a contact on
+// call until a given time, and POST /v1/rotations/{name}/handoff hands the
+// current shift to someone else (by default the next contact) until the next
+// scheduled handoff. DELETE .../override returns to the schedule.
+
+const (
+	defaultRotationHandoff = "mon 09:00"
+	maxRotationOverride    = 366 * 24 * time.Hour
+)
+
+// RotationConfig is one entry of the `rotations` config section.
+type RotationConfig struct {
+	Name     string   `yaml:"name"`
+	Contacts []string `yaml:"contacts"`
+	Timezone string   `yaml:"timezone"`
+	Handoff  string   `yaml:"handoff"`
+	Start    string   `yaml:"start"`
+
+	// Parsed by validateRotationConfigs.
+	loc        *time.Location
+	handoffDay time.Weekday
+	handoffMin int
+	// first is the start of the first contact's first shift.
+	first time.Time
+}
+
+// parseHandoff reads "<weekday> HH:MM".
+func parseHandoff(v string) (time.Weekday, int, error) {
+	day, clock, ok := strings.Cut(strings.ToLower(strings.TrimSpace(v)), " ")
+	d, known := cronDayNames[strings.TrimSpace(day)]
+	if !ok || !known {
+		return 0, 0, errors.New(`handoff must look like "mon 09:00"`)
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, 0, errors.New(`handoff must look like "mon 09:00"`)
+	}
+	return time.Weekday(d), t.Hour()*60 + t.Minute(), nil
+}
+
+// validateRotationConfigs checks the rotations config section against the
+// contact directory and parses its times.
+func validateRotationConfigs(c *Config) error {
+	seen := map[string]struct{}{}
+	for i := range c.Rotations {
+		rc := &c.Rotations[i]
+		rc.Name = strings.ToLower(strings.TrimSpace(rc.Name))
+		if !isValidName(rc.Name) {
+			return fmt.Errorf("rotations %q: name must use only letters, digits, _ and -", rc.Name)
+		}
+		if _, dup := seen[rc.Name]; dup {
+			return fmt.Errorf("rotations: duplicate name %q", rc.Name)
+		}
+		seen[rc.Name] = struct{}{}
+		if _, ok := c.contact(rc.Name); ok {
+			return fmt.Errorf("rotations %q: name is already a contact", rc.Name)
+		}
+		if len(rc.Contacts) == 0 {
+			return fmt.Errorf("rotations %q: contacts is required", rc.Name)
+		}
+		for j, name := range rc.Contacts {
+			rc.Contacts[j] = strings.TrimSpace(name)
+			if _, ok := c.contact(rc.Contacts[j]); !ok {
+				return fmt.Errorf("rotations %q: unknown contact %q", rc.Name, name)
+			}
+		}
+		rc.Timezone = strings.TrimSpace(rc.Timezone)
+		loc, err := time.LoadLocation(rc.Timezone)
+		if err != nil {
+			return fmt.Errorf("rotations %q: invalid timezone %q", rc.Name, rc.Timezone)
+		}
+		rc.loc = loc
+		rc.Handoff = cmp.Or(strings.TrimSpace(rc.Handoff), defaultRotationHandoff)
+		if rc.handoffDay, rc.handoffMin, err = parseHandoff(rc.Handoff); err != nil {
+			return fmt.Errorf("rotations %q: %w", rc.Name, err)
+		}
+		start, err := time.ParseInLocation(time.DateOnly, strings.TrimSpace(rc.Start), loc)
+		if err != nil {
+			return fmt.Errorf("rotations %q: start must be a date like 2026-01-05", rc.Name)
+		}
+		rc.first = rc.handoffAt(start, (int(rc.handoffDay)-int(start.Weekday())+7)%7)
+	}
+	return nil
+}
+
+func (c *Config) rotation(name string) (RotationConfig, bool) {
+	for _, rc := range c.Rotations {
+		if rc.Name == name {
+			return rc, true
+		}
+	}
+	return RotationConfig{}, false
+}
+
+// handoffAt is the handoff time days days after the date of t.
+func (rc RotationConfig) handoffAt(t time.Time, days int) time.Time {
+	y, m, d := t.In(rc.loc).Date()
+	return time.Date(y, m, d+days, rc.handoffMin/60, rc.handoffMin%60, 0, 0, rc.loc)
+}
+
+type rotationShift struct {
+	Contact string
+	Start   time.Time
+	End     time.Time
+}
+
+// shift returns the scheduled shift n weeks after the one running at now.
+func (rc RotationConfig) shift(now time.Time, n int) rotationShift {
+	local := now.In(rc.loc)
+	start := rc.handoffAt(local, -((int(local.Weekday()) - int(rc.handoffDay) + 7) % 7))
+	if start.After(now) {
+		start = rc.handoffAt(start, -7)
+	}
+	start = rc.handoffAt(start, 7*n)
+	// Count whole weeks by calendar date, so DST changes do not shift them.
+	days := dayNumber(start) - dayNumber(rc.first)
+	week := days / 7
+	if days < 0 && days%7 != 0 {
+		week--
+	}
+	idx := int(week % int64(len(rc.Contacts)))
+	if idx < 0 {
+		idx += len(rc.Contacts)
+	}
+	return rotationShift{Contact: rc.Contacts[idx], Start: start, End: rc.handoffAt(start, 7)}
+}
+
+func dayNumber(t time.Time) int64 {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+func (s *store) setRotationOverride(ctx context.Context, rotation, contact string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO rotation_overrides(rotation,contact,until_at,created_at) VALUES(?,?,?,?)
+		 ON CONFLICT(rotation) DO UPDATE SET contact=excluded.contact, until_at=excluded.until_at, created_at=excluded.created_at`,
+		rotation, contact, until.Unix(), time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *store) clearRotationOverride(ctx context.Context, rotation string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM rotation_overrides WHERE rotation=?`, rotation)
+	return err
+}
+
+// rotationOverride returns the override of a rotation that is still running
+// at now; ok=false means none.
+func (s *store) rotationOverride(ctx context.Context, rotation string, now time.Time) (string, time.Time, bool, error) {
+	var contact string
+	var until int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT contact, until_at FROM rotation_overrides WHERE rotation=? AND until_at>?`, rotation, now.Unix(),
+	).Scan(&contact, &until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	return contact, time.Unix(until, 0), true, nil
+}
+
+// onCall returns who is on call for rc at now and until when.
+func (s *server) onCall(ctx context.Context, rc RotationConfig, now time.Time) (string, time.Time, error) {
+	contact, until, ok, err := s.db.rotationOverride(ctx, rc.Name, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if ok {
+		return contact, until, nil
+	}
+	sh := rc.shift(now, 0)
+	return sh.Contact, sh.End, nil
+}
+
+func (s *server) rotationView(ctx context.Context, rc RotationConfig) (map[string]any, error) {
+	now := time.Now()
+	onCall, until, err := s.onCall(ctx, rc, now)
+	if err != nil {
+		return nil, err
+	}
+	var override any
+	if contact, oUntil, ok, err := s.db.rotationOverride(ctx, rc.Name, now); err != nil {
+		return nil, err
+	} else if ok {
+		override = map[string]any{"contact": contact, "until": unixOrNil(oUntil.Unix())}
+	}
+	shifts := make([]map[string]any, 0, len(rc.Contacts))
+	for i := range len(rc.Contacts) {
+		sh := rc.shift(now, i)
+		shifts = append(shifts, map[string]any{
+			"contact":   sh.Contact,
+			"starts_at": unixOrNil(sh.Start.Unix()),
+			"ends_at":   unixOrNil(sh.End.Unix()),
+		})
+	}
+	return map[string]any{
+		"name":          rc.Name,
+		"contacts":      rc.Contacts,
+		"timezone":      rc.loc.String(),
+		"handoff":       rc.Handoff,
+		"on_call":       onCall,
+		"on_call_until": unixOrNil(until.Unix()),
+		"override":      override,
+		"shifts":        shifts,
+	}, nil
+}
+
+// handleRotations serves /v1/rotations, /v1/rotations/{name} and its
+// override and handoff endpoints.
+func (s *server) handleRotations(w http.ResponseWriter, r *http.Request) {
+	name, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/rotations"), "/"), "/")
+	ctx := r.Context()
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out := make([]map[string]any, 0, len(s.cfg().Rotations))
+		for _, rc := range s.cfg().Rotations {
+			v, err := s.rotationView(ctx, rc)
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, v)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"rotations": out})
+		return
+	}
+	rc, ok := s.cfg().rotation(name)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+	case sub == "override" && r.Method == http.MethodPost:
+		if !s.overrideRotation(w, r, rc) {
+			return
+		}
+	case sub == "override" && r.Method == http.MethodDelete:
+		if err := s.db.clearRotationOverride(ctx, rc.Name); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("rotation override cleared", "rotation", rc.Name)
+	case sub == "handoff" && r.Method == http.MethodPost:
+		if !s.handoffRotation(w, r, rc) {
+			return
+		}
+	case sub == "" || sub == "override" || sub == "handoff":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	v, err := s.rotationView(ctx, rc)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+type rotationInput struct {
+	Contact string `json:"contact"`
+	Until   string `json:"until"`
+	Hours   int    `json:"hours"`
+}
+
+func readRotationInput(w http.ResponseWriter, r *http.Request) (rotationInput, bool) {
+	var in rotationInput
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		err = json.Unmarshal(b, &in)
+	}
+	if err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return rotationInput{}, false
+	}
+	in.Contact = strings.TrimSpace(in.Contact)
+	return in, true
+}
+
+// overrideRotation serves POST /v1/rotations/{name}/override with
+// {"contact": "...", "until": "<RFC 3339>"} or {"contact": "...", "hours": n}.
+func (s *server) overrideRotation(w http.ResponseWriter, r *http.Request, rc RotationConfig) bool {
+	in, ok := readRotationInput(w, r)
+	if !ok {
+		return false
+	}
+	if _, ok := s.cfg().contact(in.Contact); !ok {
+		http.Error(w, "contact must name a configured contact", http.StatusBadRequest)
+		return false
+	}
+	now := time.Now()
+	var until time.Time
+	switch {
+	case in.Until != "" && in.Hours == 0:
+		t, err := time.Parse(time.RFC3339, in.Until)
+		if err != nil {
+			http.Error(w, "until must be an RFC 3339 time", http.StatusBadRequest)
+			return false
+		}
+		until = t
+	case in.Until == "" && in.Hours > 0:
+		until = now.Add(time.Duration(in.Hours) * time.Hour)
+	default:
+		http.Error(w, "give either until or hours", http.StatusBadRequest)
+		return false
+	}
+	if !until.After(now) || until.Sub(now) > maxRotationOverride {
+		http.Error(w, "until must be in the next 366 days", http.StatusBadRequest)
+		return false
+	}
+	if err := s.db.setRotationOverride(r.Context(), rc.Name, in.Contact, until); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	slog.Info("rotation override", "rotation", rc.Name, "contact", in.Contact, "until", until.UTC().Format(time.RFC3339))
+	return true
+}
+
+// handoffRotation serves POST /v1/rotations/{name}/handoff: the current shift
+// goes to contact (default: the one after whoever is on call) until the next
+// scheduled handoff.
+func (s *server) handoffRotation(w http.ResponseWriter, r *http.Request, rc RotationConfig) bool {
+	in, ok := readRotationInput(w, r)
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	ctx := r.Context()
+	current, _, err := s.onCall(ctx, rc, now)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	to := in.Contact
+	if to == "" {
+		to = rc.shift(now, 1).Contact
+		if i := slices.Index(rc.Contacts, current); i >= 0 {
+			to = rc.Contacts[(i+1)%len(rc.Contacts)]
+		}
+	}
+	if _, ok := s.cfg().contact(to); !ok {
+		http.Error(w, "contact must name a configured contact", http.StatusBadRequest)
+		return false
+	}
+	until := rc.shift(now, 0).End
+	if err := s.db.setRotationOverride(ctx, rc.Name, to, until); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	slog.Info("rotation handoff", "rotation", rc.Name, "from", current, "to", to)
+	return true
+}
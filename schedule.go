@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduled asks are stored immediately (so the asker gets a request_id and
+// can wait on it) but their notification is held back until send_at. The
+// pending delivery lives in scheduled_asks so it survives restarts; at send_at
+// it moves to the outbox (see outbox.go), and it is dropped if the request is
+// cancelled first. scheduledDelivery is also the outbox payload.
+
+type scheduledDelivery struct {
+	Ask            askRequest      `json:"ask"`
+	InteractionURL string          `json:"interaction_url"`
+	Links          []scheduledLink `json:"links"`
+}
+
+type scheduledLink struct {
+	Name   string       `json:"name"`
+	URL    string       `json:"url"`
+	Target notifyTarget `json:"target"`
+}
+
+// parseSendAt accepts RFC 3339 timestamps or unix seconds.
+func parseSendAt(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, badAskError("send_at must be RFC 3339 or unix seconds")
+	}
+	return t, nil
+}
+
+func (s *store) insertScheduled(ctx context.Context, reqID string, sendAt time.Time, d scheduledDelivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO scheduled_asks(request_id,send_at,payload_json,created_at) VALUES(?,?,?,?)`,
+		reqID, sendAt.Unix(), string(b), time.Now().Unix(),
+	)
+	return err
+}
+
+// releaseScheduled hands a due scheduled delivery to the outbox. The outbox
+// row is written before the scheduled one is removed, so a crash in between
+// only repeats the (idempotent) hand-off on restart. ok=false means it was
+// already released or cancelled.
+func (s *store) releaseScheduled(ctx context.Context, reqID string) (bool, error) {
+	var raw string
+	err := s.db.QueryRowContext(ctx, `SELECT payload_json FROM scheduled_asks WHERE request_id=?`, reqID).Scan(&raw)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	var d scheduledDelivery
+	if err := json.Unmarshal([]byte(raw), &d); err != nil {
+		return false, err
+	}
+	if err := s.enqueueNotification(ctx, reqID, d, time.Now()); err != nil {
+		return false, err
+	}
+	return s.deleteScheduled(ctx, reqID)
+}
+
+func (s *store) deleteScheduled(ctx context.Context, reqID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_asks WHERE request_id=?`, reqID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+type scheduledRow struct {
+	RequestID string
+	SendAt    time.Time
+}
+
+func (s *store) listScheduled(ctx context.Context) ([]scheduledRow, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT request_id, send_at FROM scheduled_asks ORDER BY send_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []scheduledRow
+	for rows.Next() {
+		var r scheduledRow
+		var sendAt int64
+		if err := rows.Scan(&r.RequestID, &sendAt); err != nil {
+			return nil, err
+		}
+		r.SendAt = time.Unix(sendAt, 0)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+type pendingRow struct {
+	RequestID string
+	ExpiresAt time.Time
+}
+
+// listPending returns requests that have not reached a terminal status.
+func (s *store) listPending(ctx context.Context) ([]pendingRow, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT request_id, expires_at FROM requests WHERE status IN ('created','delivered','scheduled')`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pendingRow
+	for rows.Next() {
+		var r pendingRow
+		var expiresAt int64
+		if err := rows.Scan(&r.RequestID, &expiresAt); err != nil {
+			return nil, err
+		}
+		r.ExpiresAt = time.Unix(expiresAt, 0)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (c createdAsk) delivery() scheduledDelivery {
+	d := scheduledDelivery{Ask: c.Ask, InteractionURL: c.InteractionURL}
+	if len(c.Links) > 0 {
+		d.InteractionURL = c.Links[0].notifyURL()
+	}
+	for _, l := range c.Links {
+		d.Links = append(d.Links, scheduledLink{Name: l.Name, URL: l.notifyURL(), Target: l.Target})
+	}
+	return d
+}
+
+func (d scheduledDelivery) responderLinks() []responderLink {
+	links := make([]responderLink, 0, len(d.Links))
+	for _, l := range d.Links {
+		links = append(links, responderLink{Name: l.Name, URL: l.URL, Target: l.Target})
+	}
+	return links
+}
+
+// scheduleAsk persists the delivery of c for later and emits
+// request.scheduled.
+func (s *server) scheduleAsk(ctx context.Context, requestID string, c createdAsk) error {
+	if err := s.db.insertScheduled(ctx, requestID, c.Ask.sendAt, c.delivery()); err != nil {
+		return err
+	}
+	if err := s.db.updateRequestStatus(ctx, requestID, "scheduled"); err != nil {
+		return err
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.scheduled", map[string]any{
+		"send_at": c.Ask.sendAt.UTC().Format(time.RFC3339),
+	})
+	return s.persistTerminalAware(ctx, ev)
+}
+
+// scheduleLoop waits until sendAt and then releases the held-back
+// notification to the outbox, unless the request was cancelled in the
+// meantime.
+func (s *server) scheduleLoop(ctx context.Context, requestID string, sendAt time.Time) {
+	timer := time.NewTimer(time.Until(sendAt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	ok, err := s.db.releaseScheduled(ctx, requestID)
+	if err != nil {
+		slog.Error("release scheduled ask", "request_id", requestID, "error", err)
+		return
+	}
+	if ok {
+		s.wakeOutbox()
+	}
+}
+
+// resumePending re-arms timers lost on restart: scheduled deliveries and the
+// expiry and SLA of every request that is still open. Undelivered outbox rows need no
+// help; the worker finds them.
+func (s *server) resumePending(ctx context.Context) {
+	scheduled, err := s.db.listScheduled(ctx)
+	if err != nil {
+		slog.Error("resume scheduled asks", "error", err)
+	}
+	for _, r := range scheduled {
+		go s.scheduleLoop(context.Background(), r.RequestID, r.SendAt)
+	}
+	pending, err := s.db.listPending(ctx)
+	if err != nil {
+		slog.Error("resume pending requests", "error", err)
+	}
+	for _, r := range pending {
+		go s.expireLoop(context.Background(), r.RequestID, r.ExpiresAt)
+	}
+	sla, err := s.db.listSLAPending(ctx)
+	if err != nil {
+		slog.Error("resume sla timers", "error", err)
+	}
+	for _, r := range sla {
+		go s.slaLoop(context.Background(), r.RequestID, r.ExpiresAt)
+	}
+}
@@ -0,0 +1,321 @@
+// Package ask4me is a small client for an ask4me server, with a HumanInput
+// tool for agent frameworks (see tool.go).
+//
+// Ask blocks until the person answers or the request expires. For agents
+// that must not block, Start creates the request and returns at once, and
+// Check or Wait pick up the answer later by request ID.
+package ask4me
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to one ask4me server.
+type Client struct {
+	// Endpoint is the server's base URL, e.g. "http://localhost:8080".
+	Endpoint string
+	// APIKey is sent as a Bearer token.
+	APIKey string
+	// HTTPClient defaults to a client without a timeout; the blocking
+	// calls are bounded by their context instead.
+	HTTPClient *http.Client
+}
+
+// Ask is the body of POST /v1/ask. Fields the struct does not cover can be
+// set through Extra.
+type Ask struct {
+	RequestID        string         `json:"request_id,omitempty"`
+	Title            string         `json:"title,omitempty"`
+	Body             string         `json:"body,omitempty"`
+	MCD              string         `json:"mcd,omitempty"`
+	ExpiresInSeconds int            `json:"expires_in_seconds,omitempty"`
+	DefaultAction    string         `json:"default_action,omitempty"`
+	Priority         string         `json:"priority,omitempty"`
+	TerminalEvents   []string       `json:"terminal_events,omitempty"`
+	Extra            map[string]any `json:"-"`
+}
+
+func (a Ask) MarshalJSON() ([]byte, error) {
+	type plain Ask
+	b, err := json.Marshal(plain(a))
+	if err != nil || len(a.Extra) == 0 {
+		return b, err
+	}
+	m := map[string]any{}
+	for k, v := range a.Extra {
+		m[k] = v
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Result is the final event of a request.
+type Result struct {
+	RequestID string `json:"request_id"`
+	// Type is "user.submitted", "request.completed", "request.expired",
+	// "request.cancelled" or "notify.failed".
+	Type    string          `json:"last_event_type"`
+	EventID string          `json:"last_event_id"`
+	Data    json.RawMessage `json:"data"`
+	SeenAt  *time.Time      `json:"seen_at"`
+	// SchemaVersion is the server's event_schema_version (see events.go).
+	SchemaVersion int `json:"event_schema_version"`
+}
+
+// Answered reports whether a person answered the request.
+func (r *Result) Answered() bool {
+	return r.Type == "user.submitted" || r.Type == "request.completed"
+}
+
+// Answer returns the action and text of a user.submitted result.
+func (r *Result) Answer() (action, text string) {
+	var d struct {
+		Action string `json:"action"`
+		Text   string `json:"text"`
+	}
+	_ = json.Unmarshal(r.Data, &d)
+	return d.Action, d.Text
+}
+
+// Started is a request created by Start.
+type Started struct {
+	RequestID      string
+	InteractionURL string
+	ExpiresAt      time.Time
+}
+
+// Status is a request as returned by Check.
+type Status struct {
+	RequestID string    `json:"request_id"`
+	Title     string    `json:"title"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// SLABreachedAt is set once the request outlived its sla_seconds.
+	SLABreachedAt *time.Time `json:"sla_breached_at"`
+	Answer        *struct {
+		Action     string    `json:"action"`
+		Text       string    `json:"text"`
+		Responder  string    `json:"responder"`
+		AnsweredAt time.Time `json:"answered_at"`
+	} `json:"answer"`
+}
+
+// Done reports whether the request is finished.
+func (s *Status) Done() bool {
+	switch s.Status {
+	case "submitted", "expired", "cancelled", "notify_failed":
+		return true
+	}
+	return false
+}
+
+// HTTPError is a non-2xx answer from the server.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("ask4me: HTTP %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Ask creates a request and waits for its final event. A request ID is
+// generated when a.RequestID is empty, so that a dropped connection is
+// resumed instead of asking twice.
+func (c *Client) Ask(ctx context.Context, a Ask) (*Result, error) {
+	if a.RequestID == "" {
+		a.RequestID = NewRequestID()
+	}
+	return c.wait(ctx, a.RequestID, &a)
+}
+
+// Wait waits for the final event of an existing request.
+func (c *Client) Wait(ctx context.Context, requestID string) (*Result, error) {
+	return c.wait(ctx, requestID, nil)
+}
+
+func (c *Client) wait(ctx context.Context, requestID string, a *Ask) (*Result, error) {
+	backoff := 200 * time.Millisecond
+	for {
+		var body io.Reader
+		if a != nil {
+			b, err := json.Marshal(a)
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.NewReader(b)
+		}
+		resp, err := c.do(ctx, http.MethodPost, "/v1/ask?request_id="+url.QueryEscape(requestID), body)
+		if err == nil {
+			var res Result
+			err = json.NewDecoder(resp.Body).Decode(&res)
+			resp.Body.Close()
+			if err == nil {
+				return &res, nil
+			}
+		}
+		var he *HTTPError
+		if errors.As(err, &he) && he.StatusCode != http.StatusServiceUnavailable {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// The server restarted or a proxy cut the long wait: resume with
+		// the request ID (the request exists once it was sent).
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*time.Second, backoff*2)
+	}
+}
+
+// Start creates a request and returns once it exists, with its link.
+func (c *Client) Start(ctx context.Context, a Ask) (*Started, error) {
+	if a.RequestID == "" {
+		a.RequestID = NewRequestID()
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodPost, "/v1/ask?stream=true", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		line, ok := strings.CutPrefix(sc.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var ev struct {
+			Type      string `json:"type"`
+			RequestID string `json:"request_id"`
+			Data      struct {
+				InteractionURL string    `json:"interaction_url"`
+				ExpiresAt      time.Time `json:"expires_at"`
+			} `json:"data"`
+		}
+		if json.Unmarshal([]byte(strings.TrimSpace(line)), &ev) != nil {
+			continue
+		}
+		if ev.Type == "request.created" {
+			// Closing the stream leaves the request open.
+			return &Started{RequestID: ev.RequestID, InteractionURL: ev.Data.InteractionURL, ExpiresAt: ev.Data.ExpiresAt}, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("ask4me: stream ended before request.created")
+}
+
+// Check returns a request's status and answer without waiting.
+func (c *Client) Check(ctx context.Context, requestID string) (*Status, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/requests/"+url.PathEscape(requestID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Cancel closes an open request.
+func (c *Client) Cancel(ctx context.Context, requestID, reason string) error {
+	b, _ := json.Marshal(map[string]string{"reason": reason})
+	resp, err := c.do(ctx, http.MethodPost, "/v1/requests/"+url.PathEscape(requestID)+"/cancel", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Ack tells the server that the answer to requestID was received and acted
+// on; the person who answered sees it on the page, with note.
+func (c *Client) Ack(ctx context.Context, requestID, note string) error {
+	b, _ := json.Marshal(map[string]string{"note": note})
+	resp, err := c.do(ctx, http.MethodPost, "/v1/requests/"+url.PathEscape(requestID)+"/ack", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PostEvent posts a custom event such as "agent.still_working" to an open
+// request; the interaction page shows message. data may be nil.
+func (c *Client) PostEvent(ctx context.Context, requestID, eventType, message string, data any) error {
+	b, err := json.Marshal(map[string]any{"type": eventType, "message": message, "data": data})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/v1/requests/"+url.PathEscape(requestID)+"/events", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	if c.Endpoint == "" {
+		return nil, errors.New("ask4me: Endpoint is required")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.Endpoint, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+	return resp, nil
+}
+
+// NewRequestID returns a random request ID in the server's format.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "req_" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
@@ -0,0 +1,406 @@
+package ask4me
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The types below are the data payloads of the server's events, as sent on
+// SSE streams, to callbacks and webhooks, and by /v1/requests/{id}/events.
+// events.schema.json at the repository root describes the same payloads as
+// JSON Schema. Fields that an event does not carry are left zero.
+
+// EventSchemaVersion is the payload version these types describe. The server
+// sends its own as event_schema_version; it only changes when a payload
+// changes incompatibly.
+const EventSchemaVersion = 1
+
+// Event is one server event.
+type Event struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Time          time.Time       `json:"time"`
+	RequestID     string          `json:"request_id"`
+	Data          json.RawMessage `json:"data"`
+	SchemaVersion int             `json:"event_schema_version"`
+}
+
+// Payload decodes Data into the type for e.Type, e.g. *UserSubmitted for
+// "user.submitted". Custom events (see Client.PostEvent) and unknown types
+// decode into a map[string]any.
+func (e Event) Payload() (any, error) {
+	return decodePayload(e.Type, e.Data)
+}
+
+// Payload decodes the final event's data, like Event.Payload.
+func (r *Result) Payload() (any, error) {
+	return decodePayload(r.Type, r.Data)
+}
+
+func decodePayload(typ string, data json.RawMessage) (any, error) {
+	var v any
+	switch typ {
+	case "request.created":
+		v = &RequestCreated{}
+	case "request.scheduled":
+		v = &RequestScheduled{}
+	case "notify.sent", "notify.failed", "notify.responder_failed", "notify.result_sent", "notify.result_failed":
+		v = &Notification{}
+	case "user.submitted":
+		v = &UserSubmitted{}
+	case "user.step_submitted":
+		v = &UserStepSubmitted{}
+	case "user.answer_updated":
+		v = &AnswerUpdated{}
+	case "request.extended":
+		v = &RequestExtended{}
+	case "request.completed":
+		v = &RequestCompleted{}
+	case "request.expired", "user.challenge_passed", "heartbeat":
+		v = &struct{}{}
+	case "user.viewing", "user.typing":
+		v = &Presence{}
+	case "user.claimed":
+		v = &Claimed{}
+	case "request.cancelled":
+		v = &RequestCancelled{}
+	case "request.delegated":
+		v = &RequestDelegated{}
+	case "request.routed":
+		v = &RequestRouted{}
+	case "request.sla_breached":
+		v = &SLABreached{}
+	case "request.tokens_rotated":
+		v = &TokensRotated{}
+	case "request.tokens_revoked":
+		v = &TokensRevoked{}
+	case "user.page_loaded", "user.acknowledged":
+		v = &Receipt{}
+	case "user.draft_saved":
+		v = &DraftSaved{}
+	case "user.challenge_failed":
+		v = &ChallengeFailed{}
+	case "callback.sent", "callback.failed":
+		v = &CallbackResult{}
+	case "answer.acknowledged":
+		v = &AnswerAcknowledged{}
+	case "webhook.test":
+		v = &WebhookTest{}
+	case "events.dropped":
+		v = &EventsDropped{}
+	default:
+		m := map[string]any{}
+		v = &m
+	}
+	if len(data) > 0 && string(data) != "null" {
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+	}
+	if m, ok := v.(*map[string]any); ok {
+		return *m, nil
+	}
+	return v, nil
+}
+
+// RequestCreated is the data of request.created.
+type RequestCreated struct {
+	InteractionURL  string          `json:"interaction_url"`
+	ShortURL        string          `json:"short_url"`
+	ExpiresAt       time.Time       `json:"expires_at"`
+	Steps           int             `json:"steps"`
+	SessionID       string          `json:"session_id"`
+	ScheduleID      string          `json:"schedule_id"`
+	BundleID        string          `json:"bundle_id"`
+	Priority        string          `json:"priority"`
+	DefaultAction   string          `json:"default_action"`
+	ParentRequestID string          `json:"parent_request_id"`
+	BodySHA256      string          `json:"body_sha256"`
+	Attachments     []Attachment    `json:"attachments"`
+	AllowUploads    bool            `json:"allow_uploads"`
+	VoiceInput      bool            `json:"voice_input"`
+	AskName         bool            `json:"ask_name"`
+	OneTimeLink     string          `json:"one_time_link"`
+	Challenge       string          `json:"challenge"`
+	CallbackURL     string          `json:"callback_url"`
+	Delivery        string          `json:"delivery"`
+	ExtendSeconds   int             `json:"extend_seconds"`
+	MaxExtensions   int             `json:"max_extensions"`
+	SLASeconds      int             `json:"sla_seconds"`
+	SLAAt           time.Time       `json:"sla_at"`
+	EscalateTo      string          `json:"escalate_to"`
+	NotifyResult    bool            `json:"notify_result"`
+	Tenant          string          `json:"tenant"`
+	To              string          `json:"to"`
+	Rotation        string          `json:"rotation"`
+	TerminalEvents  []string        `json:"terminal_events"`
+	Tags            []string        `json:"tags"`
+	QRCode          string          `json:"qr_code"`
+	QRURL           string          `json:"qr_url"`
+	Responders      []ResponderLink `json:"responders"`
+	RespondersMode  string          `json:"responders_mode"`
+	MinAnswers      int             `json:"min_answers"`
+	Approval        *ApprovalPolicy `json:"approval"`
+	// ExpiresInBusinessSeconds is set when the expiry counts only the
+	// server's business hours.
+	ExpiresInBusinessSeconds int `json:"expires_in_business_seconds"`
+}
+
+// RequestScheduled is the data of request.scheduled.
+type RequestScheduled struct {
+	SendAt time.Time `json:"send_at"`
+}
+
+// Notification is the data of notify.sent, notify.failed,
+// notify.responder_failed and the notify.result_sent / notify.result_failed
+// follow-ups. Which fields are set depends on the channel
+// ("serverchan", "apprise", "webpush", "session" or "bundle").
+type Notification struct {
+	Channel       string   `json:"channel"`
+	Error         string   `json:"error"`
+	Reason        string   `json:"reason"` // "timeout" when the send ran out of time
+	Output        string   `json:"output"`
+	Command       string   `json:"command"`
+	CommandSh     string   `json:"command_sh"`
+	CommandArgs   []string `json:"command_args"`
+	LatencyMS     int64    `json:"latency_ms"`
+	Attempts      int      `json:"attempts"`
+	Responder     string   `json:"responder"`
+	Responders    int      `json:"responders"`
+	SessionID     string   `json:"session_id"`
+	BundleID      string   `json:"bundle_id"`
+	WebPushSent   int      `json:"web_push_sent"`
+	WebPushFailed int      `json:"web_push_failed"`
+	Result        string   `json:"result"` // the final event a notify.result_* follow-up reported
+}
+
+// UserSubmitted is the data of user.submitted. Via names where an answer
+// given outside the page came from ("api", "slack", "email", ...);
+// AnsweredBy is "timeout_default" when default_action applied, and "policy"
+// when a server policy answered (Policy names the rule). ResponderName is
+// who answered on the page: the name typed for an ask with ask_name, or the
+// named responder.
+type UserSubmitted struct {
+	Action        string          `json:"action"`
+	Text          string          `json:"text"`
+	Payload       json.RawMessage `json:"payload"`
+	Responder     string          `json:"responder"`
+	ResponderName string          `json:"responder_name"`
+	Via           string          `json:"via"`
+	AnsweredBy    string          `json:"answered_by"`
+	Policy        string          `json:"policy"`
+	Attachments   []Attachment    `json:"attachments"`
+	Steps         []StepAnswer    `json:"steps"`
+	// Late is set on answers that came in during the server's grace period
+	// after the request expired.
+	Late bool `json:"late"`
+	// Hook is what the server's answer hook added to the answer.
+	Hook map[string]any `json:"hook"`
+	// Redacted is set once the server blanked Text and dropped Payload.
+	Redacted bool `json:"redacted"`
+}
+
+// StepAnswer is one step of a multi-step answer.
+type StepAnswer struct {
+	Step    int             `json:"step"`
+	Title   string          `json:"title"`
+	Action  string          `json:"action"`
+	Text    string          `json:"text"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// UserStepSubmitted is the data of user.step_submitted.
+type UserStepSubmitted struct {
+	Step    int             `json:"step"`
+	Steps   int             `json:"steps"`
+	Title   string          `json:"title"`
+	Action  string          `json:"action"`
+	Text    string          `json:"text"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// RequestExtended is the data of request.extended: the responder asked for
+// more time on the page and ExpiresAt is the new deadline.
+type RequestExtended struct {
+	ExpiresAt  time.Time `json:"expires_at"`
+	ExtendedBy int       `json:"extended_by"`
+	Extensions int       `json:"extensions"`
+	Responder  string    `json:"responder"`
+}
+
+// AnswerUpdated is the data of user.answer_updated: the responder changed
+// their answer from Previous while the server's edit window was open.
+type AnswerUpdated struct {
+	Action    string         `json:"action"`
+	Text      string         `json:"text"`
+	Responder string         `json:"responder"`
+	Previous  PreviousAnswer `json:"previous"`
+	Hook      map[string]any `json:"hook"`
+}
+
+// PreviousAnswer is the answer that an edit replaced.
+type PreviousAnswer struct {
+	Action string `json:"action"`
+	Text   string `json:"text"`
+}
+
+// RequestCompleted is the data of request.completed, the end of a collect
+// or quorum request. The quorum fields (Outcome to Voters) are only set in
+// quorum mode.
+type RequestCompleted struct {
+	Complete     bool              `json:"complete"`
+	MinAnswers   int               `json:"min_answers"`
+	AnswersCount int               `json:"answers_count"`
+	Answers      []CollectedAnswer `json:"answers"`
+	Outcome      string            `json:"outcome"`
+	Policy       *ApprovalPolicy   `json:"policy"`
+	Approvals    int               `json:"approvals"`
+	Rejections   int               `json:"rejections"`
+	Pending      int               `json:"pending"`
+	Tally        map[string]int    `json:"tally"`
+	Voters       []Vote            `json:"voters"`
+}
+
+// CollectedAnswer is one responder's answer in request.completed.
+type CollectedAnswer struct {
+	Responder   string          `json:"responder"`
+	Action      string          `json:"action"`
+	Text        string          `json:"text"`
+	Payload     json.RawMessage `json:"payload"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+}
+
+// Vote is one responder's vote in a quorum.
+type Vote struct {
+	Responder string `json:"responder"`
+	Action    string `json:"action"`
+	Approve   bool   `json:"approve"`
+}
+
+// ApprovalPolicy is the quorum policy of a request.
+type ApprovalPolicy struct {
+	Required       int    `json:"required"`
+	ApproveAction  string `json:"approve_action"`
+	RejectRequired int    `json:"reject_required"`
+}
+
+// RequestCancelled is the data of request.cancelled.
+type RequestCancelled struct {
+	PreviousStatus string `json:"previous_status"`
+	BeforeDelivery bool   `json:"before_delivery"`
+	Reason         string `json:"reason"`
+}
+
+// RequestDelegated is the data of request.delegated.
+type RequestDelegated struct {
+	To             string `json:"to"`
+	From           string `json:"from"`
+	Note           string `json:"note"`
+	InteractionURL string `json:"interaction_url"`
+	ShortURL       string `json:"short_url"`
+}
+
+// RequestRouted is the data of request.routed.
+type RequestRouted struct {
+	Contact  string    `json:"contact"`
+	Reason   string    `json:"reason"`
+	Decision string    `json:"decision"`
+	To       string    `json:"to"`
+	SendAt   time.Time `json:"send_at"`
+}
+
+// SLABreached is the data of request.sla_breached. EscalatedTo is the
+// contact that escalate_to brought in, with their own link.
+type SLABreached struct {
+	SLASeconds     int    `json:"sla_seconds"`
+	EscalatedTo    string `json:"escalated_to"`
+	Rotation       string `json:"rotation"`
+	InteractionURL string `json:"interaction_url"`
+	ShortURL       string `json:"short_url"`
+}
+
+// TokensRotated is the data of request.tokens_rotated.
+type TokensRotated struct {
+	InteractionURL string          `json:"interaction_url"`
+	ShortURL       string          `json:"short_url"`
+	Resent         bool            `json:"resent"`
+	Responders     []ResponderLink `json:"responders"`
+}
+
+// TokensRevoked is the data of request.tokens_revoked.
+type TokensRevoked struct {
+	Revoked   int    `json:"revoked"`
+	Responder string `json:"responder"`
+}
+
+// Receipt is the data of user.page_loaded and user.acknowledged.
+type Receipt struct {
+	UserAgent string `json:"user_agent"`
+	Device    string `json:"device"`
+	Responder string `json:"responder"`
+}
+
+// Presence is the data of user.viewing and user.typing.
+type Presence struct {
+	Responder string `json:"responder"`
+}
+
+// Claimed is the data of user.claimed.
+type Claimed struct {
+	Responder        string `json:"responder"`
+	ExpiresInSeconds int    `json:"expires_in_seconds"`
+}
+
+// DraftSaved is the data of user.draft_saved.
+type DraftSaved struct {
+	TextLength int  `json:"text_length"`
+	HasPayload bool `json:"has_payload"`
+}
+
+// ChallengeFailed is the data of user.challenge_failed.
+type ChallengeFailed struct {
+	Failures int `json:"failures"`
+}
+
+// CallbackResult is the data of callback.sent and callback.failed.
+type CallbackResult struct {
+	Status   int    `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// AnswerAcknowledged is the data of answer.acknowledged.
+type AnswerAcknowledged struct {
+	Note string `json:"note"`
+}
+
+// WebhookTest is the data of webhook.test.
+type WebhookTest struct {
+	WebhookID string `json:"webhook_id"`
+}
+
+// EventsDropped is the data of events.dropped, which marks where a stream
+// that was too slow lost Dropped events.
+type EventsDropped struct {
+	Dropped int `json:"dropped"`
+}
+
+// ResponderLink is one responder's link.
+type ResponderLink struct {
+	Name           string `json:"name"`
+	InteractionURL string `json:"interaction_url"`
+	ShortURL       string `json:"short_url"`
+}
+
+// Attachment is a file attached to a request or an answer.
+type Attachment struct {
+	AttachmentID string    `json:"attachment_id"`
+	RequestID    string    `json:"request_id"`
+	Kind         string    `json:"kind"`
+	Name         string    `json:"name"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Responder    string    `json:"responder"`
+	CreatedAt    time.Time `json:"created_at"`
+	URL          string    `json:"url"`
+}
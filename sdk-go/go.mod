@@ -0,0 +1,3 @@
+module github.com/easychen/ask4me/sdk-go
+
+go 1.25.0
@@ -0,0 +1,162 @@
+package ask4me
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The tools below have the method set of langchaingo's tools.Tool (Name,
+// Description, Call), so they can be passed to its agents as they are, and
+// are easy to wrap for other frameworks. The input is the question as plain
+// text, or a JSON object with title, body, options (button labels) and
+// expires_in_seconds.
+
+// HumanInput asks a person and blocks until they answer.
+type HumanInput struct {
+	Client *Client
+	// Title is used when the input has none.
+	Title string
+	// ExpiresInSeconds bounds the wait; the server default applies when 0.
+	ExpiresInSeconds int
+}
+
+func (t HumanInput) Name() string { return "human_input" }
+
+func (t HumanInput) Description() string {
+	return "Ask a human a question and wait for the answer. Input: the question, " +
+		`or JSON {"title": "...", "body": "...", "options": ["Yes", "No"]}.`
+}
+
+func (t HumanInput) Call(ctx context.Context, input string) (string, error) {
+	a, err := toolAsk(input, t.Title, t.ExpiresInSeconds)
+	if err != nil {
+		return "", err
+	}
+	res, err := t.Client.Ask(ctx, a)
+	if err != nil {
+		return "", err
+	}
+	return resultText(res), nil
+}
+
+// HumanInputStart asks a person without waiting; it returns the request ID
+// for HumanInputCheck.
+type HumanInputStart struct {
+	Client           *Client
+	Title            string
+	ExpiresInSeconds int
+}
+
+func (t HumanInputStart) Name() string { return "human_input_start" }
+
+func (t HumanInputStart) Description() string {
+	return "Send a question to a human without waiting. Returns a request ID to check later " +
+		`with human_input_check. Input: the question, or JSON {"title": "...", "body": "...", "options": ["Yes", "No"]}.`
+}
+
+func (t HumanInputStart) Call(ctx context.Context, input string) (string, error) {
+	a, err := toolAsk(input, t.Title, t.ExpiresInSeconds)
+	if err != nil {
+		return "", err
+	}
+	st, err := t.Client.Start(ctx, a)
+	if err != nil {
+		return "", err
+	}
+	return "Question sent. Request ID: " + st.RequestID, nil
+}
+
+// HumanInputCheck returns the answer to a question sent by HumanInputStart,
+// or says that it is still open.
+type HumanInputCheck struct {
+	Client *Client
+}
+
+func (t HumanInputCheck) Name() string { return "human_input_check" }
+
+func (t HumanInputCheck) Description() string {
+	return "Check whether a human answered a question sent with human_input_start. Input: the request ID."
+}
+
+func (t HumanInputCheck) Call(ctx context.Context, input string) (string, error) {
+	st, err := t.Client.Check(ctx, strings.TrimSpace(input))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case st.Answer != nil:
+		return answerText(st.Answer.Action, st.Answer.Text), nil
+	case st.Done():
+		return "No answer: the request is " + st.Status + ".", nil
+	}
+	return "Not answered yet.", nil
+}
+
+func toolAsk(input, title string, expires int) (Ask, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return Ask{}, fmt.Errorf("ask4me: empty question")
+	}
+	if title == "" {
+		title = "Question from your agent"
+	}
+	a := Ask{Title: title, Body: input, MCD: toolMCD(nil), ExpiresInSeconds: expires}
+	if !strings.HasPrefix(input, "{") {
+		return a, nil
+	}
+	var in struct {
+		Title            string   `json:"title"`
+		Body             string   `json:"body"`
+		Options          []string `json:"options"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}
+	if err := json.Unmarshal([]byte(input), &in); err != nil {
+		return a, nil
+	}
+	if in.Title != "" {
+		a.Title = in.Title
+	}
+	a.Body = in.Body
+	if in.ExpiresInSeconds > 0 {
+		a.ExpiresInSeconds = in.ExpiresInSeconds
+	}
+	a.MCD = toolMCD(in.Options)
+	return a, nil
+}
+
+// toolMCD offers the options as buttons next to a free-text reply.
+func toolMCD(options []string) string {
+	var b strings.Builder
+	if len(options) > 0 {
+		b.WriteString(":::buttons\n")
+		for _, o := range options {
+			o = strings.NewReplacer("[", "(", "]", ")", "\n", " ").Replace(strings.TrimSpace(o))
+			if o != "" {
+				fmt.Fprintf(&b, "- [%s](%s)\n", o, o)
+			}
+		}
+		b.WriteString(":::\n\n")
+	}
+	b.WriteString(":::input name=\"answer\" label=\"Answer\" submit=\"Send\"\n:::")
+	return b.String()
+}
+
+func resultText(res *Result) string {
+	if !res.Answered() {
+		return "No answer: " + res.Type + "."
+	}
+	action, text := res.Answer()
+	return answerText(action, text)
+}
+
+func answerText(action, text string) string {
+	switch {
+	case action != "" && text != "":
+		return action + ": " + text
+	case action != "":
+		return action
+	}
+	return text
+}
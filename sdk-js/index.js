@@ -1,3 +1,5 @@
+import { createHmac, timingSafeEqual } from "node:crypto";
+
 function sleep(ms) {
   return new Promise((resolve) => setTimeout(resolve, ms));
 }
@@ -109,16 +111,37 @@ export async function ask({
       last_event_id: lastEventId ?? undefined
     });
 
-    const res = await fetchImpl(url, {
-      method: "POST",
-      headers: {
-        Accept: "text/event-stream",
-        "Content-Type": "application/json",
-        Authorization: `Bearer ${apiKey}`
-      },
-      body: requestId ? null : JSON.stringify(payload ?? {}),
-      signal
-    });
+    let res;
+    try {
+      res = await fetchImpl(url, {
+        method: "POST",
+        headers: {
+          Accept: "text/event-stream",
+          "Content-Type": "application/json",
+          Authorization: `Bearer ${apiKey}`
+        },
+        body: requestId ? null : JSON.stringify(payload ?? {}),
+        signal
+      });
+    } catch (err) {
+      // Once the request exists, a refused connection usually means the
+      // server is restarting; keep resuming with request_id.
+      if (!requestId || signal?.aborted) throw err;
+      attempt += 1;
+      await sleep(backoff);
+      backoff = Math.min(maxBackoffMs, Math.floor(backoff * 1.6));
+      continue;
+    }
+
+    if (res.status === 503 && requestId) {
+      // Shutting down: wait as told by Retry-After, then resume.
+      await res.text().catch(() => "");
+      const retryAfter = Number(res.headers.get("retry-after"));
+      attempt += 1;
+      await sleep(Number.isFinite(retryAfter) && retryAfter > 0 ? retryAfter * 1000 : backoff);
+      backoff = Math.min(maxBackoffMs, Math.floor(backoff * 1.6));
+      continue;
+    }
 
     if (!res.ok) {
       const text = await res.text().catch(() => "");
@@ -180,3 +203,23 @@ export async function ask({
     result: finalEvent
   };
 }
+
+// verifySignature checks the X-Ask4Me-Signature header of a callback_url
+// request ("t=<unix>,v1=<hex HMAC-SHA256(secret, `${t}.${body}`)>"). Pass the
+// raw request body, not a re-serialized object. Returns true when the
+// signature matches and is at most toleranceSeconds old.
+export function verifySignature({ secret, body, signature, toleranceSeconds = 300, now = Date.now() } = {}) {
+  if (!secret || typeof signature !== "string" || body === undefined || body === null) return false;
+  const parts = {};
+  for (const item of signature.split(",")) {
+    const idx = item.indexOf("=");
+    if (idx > 0) parts[item.slice(0, idx).trim()] = item.slice(idx + 1).trim();
+  }
+  const t = Number(parts.t);
+  if (!Number.isInteger(t) || !parts.v1) return false;
+  if (toleranceSeconds > 0 && Math.abs(Math.floor(now / 1000) - t) > toleranceSeconds) return false;
+  const expected = createHmac("sha256", secret).update(`${t}.`).update(body).digest("hex");
+  const a = Buffer.from(expected, "utf8");
+  const b = Buffer.from(parts.v1, "utf8");
+  return a.length === b.length && timingSafeEqual(a, b);
+}
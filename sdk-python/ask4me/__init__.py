@@ -0,0 +1,4 @@
+from .client import Client, HTTPError, new_request_id
+from .tools import HumanInput, langchain_tools, llamaindex_tools
+
+__all__ = ["Client", "HTTPError", "HumanInput", "langchain_tools", "llamaindex_tools", "new_request_id"]
@@ -0,0 +1,128 @@
+"""Client for the operations in openapi.yaml (ask, getRequest, cancelRequest,
+ackRequest, postRequestEvent).
+
+Standard library only. ask() blocks until the person answers or the request
+expires; start() returns as soon as the request exists, and check() or
+wait() pick up the answer later by request ID.
+"""
+
+import base64
+import json
+import os
+import secrets
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+
+FINISHED = {"submitted", "expired", "cancelled", "notify_failed"}
+
+
+class HTTPError(Exception):
+    def __init__(self, status, body):
+        super().__init__(f"ask4me: HTTP {status}: {body.strip()}")
+        self.status = status
+        self.body = body
+
+
+def new_request_id():
+    raw = base64.b32encode(secrets.token_bytes(16)).decode().rstrip("=")
+    return "req_" + raw.lower()
+
+
+class Client:
+    def __init__(self, endpoint=None, api_key=None):
+        self.endpoint = (endpoint or os.environ.get("ASK4ME_SERVER", "")).rstrip("/")
+        self.api_key = api_key or os.environ.get("ASK4ME_API_KEY", "")
+        if not self.endpoint:
+            raise ValueError("endpoint is required (or set ASK4ME_SERVER)")
+
+    def _request(self, method, path, body=None, timeout=None):
+        data = None if body is None else json.dumps(body).encode()
+        req = urllib.request.Request(self.endpoint + path, data=data, method=method)
+        if self.api_key:
+            req.add_header("Authorization", "Bearer " + self.api_key)
+        if data is not None:
+            req.add_header("Content-Type", "application/json")
+        try:
+            return urllib.request.urlopen(req, timeout=timeout)
+        except urllib.error.HTTPError as e:
+            raise HTTPError(e.code, e.read(4096).decode("utf-8", "replace")) from None
+
+    def ask(self, ask, timeout=None):
+        """Create a request and wait for its final event (the Result schema)."""
+        ask = dict(ask)
+        ask.setdefault("request_id", new_request_id())
+        return self._wait(ask["request_id"], ask, timeout)
+
+    def wait(self, request_id, timeout=None):
+        """Wait for the final event of an existing request."""
+        return self._wait(request_id, None, timeout)
+
+    def _wait(self, request_id, ask, timeout):
+        deadline = None if timeout is None else time.monotonic() + timeout
+        backoff = 0.2
+        path = "/v1/ask?request_id=" + urllib.parse.quote(request_id)
+        while True:
+            left = None if deadline is None else max(0.1, deadline - time.monotonic())
+            try:
+                with self._request("POST", path, ask, timeout=left) as resp:
+                    return json.load(resp)
+            except HTTPError as e:
+                if e.status != 503:
+                    raise
+            except (OSError, ValueError):
+                # Restart or cut connection: resume with the request ID.
+                pass
+            if deadline is not None and time.monotonic() >= deadline:
+                raise TimeoutError("ask4me: no answer for " + request_id)
+            time.sleep(backoff)
+            backoff = min(2.0, backoff * 2)
+
+    def start(self, ask):
+        """Create a request without waiting; returns request_id, interaction_url and expires_at."""
+        ask = dict(ask)
+        ask.setdefault("request_id", new_request_id())
+        with self._request("POST", "/v1/ask?stream=true", ask, timeout=30) as resp:
+            for raw in resp:
+                line = raw.decode("utf-8", "replace").strip()
+                if not line.startswith("data:"):
+                    continue
+                try:
+                    ev = json.loads(line[5:].strip())
+                except ValueError:
+                    continue
+                if isinstance(ev, dict) and ev.get("type") == "request.created":
+                    # Closing the stream leaves the request open.
+                    data = ev.get("data") or {}
+                    return {
+                        "request_id": ev["request_id"],
+                        "interaction_url": data.get("interaction_url"),
+                        "expires_at": data.get("expires_at"),
+                    }
+        raise RuntimeError("ask4me: stream ended before request.created")
+
+    def check(self, request_id):
+        """A request's status and answer (the Request schema), without waiting."""
+        with self._request("GET", "/v1/requests/" + urllib.parse.quote(request_id), timeout=30) as resp:
+            return json.load(resp)
+
+    def cancel(self, request_id, reason=""):
+        path = "/v1/requests/" + urllib.parse.quote(request_id) + "/cancel"
+        with self._request("POST", path, {"reason": reason}, timeout=30) as resp:
+            return json.load(resp)
+
+    def ack(self, request_id, note=""):
+        """Tell the person who answered that the answer was received and acted on."""
+        path = "/v1/requests/" + urllib.parse.quote(request_id) + "/ack"
+        with self._request("POST", path, {"note": note}, timeout=30) as resp:
+            return json.load(resp)
+
+    def post_event(self, request_id, type, message="", data=None):
+        """Post a custom event such as "agent.still_working"; the open page shows message."""
+        body = {"type": type, "message": message}
+        if data is not None:
+            body["data"] = data
+        path = "/v1/requests/" + urllib.parse.quote(request_id) + "/events"
+        with self._request("POST", path, body, timeout=30) as resp:
+            return json.load(resp)
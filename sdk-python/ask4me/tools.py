@@ -0,0 +1,121 @@
+"""HumanInput tools for agent frameworks.
+
+human_input asks and blocks until the answer; human_input_start and
+human_input_check are the non-blocking pair. The tool input is the question,
+or JSON {"title", "body", "options": [button labels], "expires_in_seconds"}.
+
+langchain_tools() and llamaindex_tools() wrap the same functions for each
+framework, which are imported only when those are called.
+"""
+
+import asyncio
+import json
+
+from .client import FINISHED, Client
+
+DEFAULT_TITLE = "Question from your agent"
+
+
+def _ask_from_input(question, title, expires_in_seconds):
+    question = (question or "").strip()
+    if not question:
+        raise ValueError("empty question")
+    ask = {"title": title, "body": question}
+    if expires_in_seconds:
+        ask["expires_in_seconds"] = expires_in_seconds
+    if question.startswith("{"):
+        try:
+            parsed = json.loads(question)
+        except ValueError:
+            parsed = None
+        if isinstance(parsed, dict):
+            ask["title"] = parsed.get("title") or title
+            ask["body"] = parsed.get("body") or ""
+            if parsed.get("expires_in_seconds"):
+                ask["expires_in_seconds"] = int(parsed["expires_in_seconds"])
+            ask["mcd"] = _mcd(parsed.get("options") or [])
+            return ask
+    ask["mcd"] = _mcd([])
+    return ask
+
+
+def _mcd(options):
+    out = ""
+    labels = [str(o).strip().replace("[", "(").replace("]", ")").replace("\n", " ") for o in options]
+    labels = [o for o in labels if o]
+    if labels:
+        out = ":::buttons\n" + "".join(f"- [{o}]({o})\n" for o in labels) + ":::\n\n"
+    return out + ':::input name="answer" label="Answer" submit="Send"\n:::'
+
+
+def _answer_text(action, text):
+    if action and text:
+        return f"{action}: {text}"
+    return action or text or ""
+
+
+class HumanInput:
+    """The three tool functions bound to a client."""
+
+    def __init__(self, client=None, title=DEFAULT_TITLE, expires_in_seconds=None):
+        self.client = client or Client()
+        self.title = title
+        self.expires_in_seconds = expires_in_seconds
+
+    def ask(self, question):
+        res = self.client.ask(_ask_from_input(question, self.title, self.expires_in_seconds))
+        if res.get("last_event_type") not in ("user.submitted", "request.completed"):
+            return f"No answer: {res.get('last_event_type')}."
+        data = res.get("data") or {}
+        return _answer_text(data.get("action"), data.get("text"))
+
+    async def aask(self, question):
+        return await asyncio.to_thread(self.ask, question)
+
+    def start(self, question):
+        st = self.client.start(_ask_from_input(question, self.title, self.expires_in_seconds))
+        return "Question sent. Request ID: " + st["request_id"]
+
+    def check(self, request_id):
+        req = self.client.check(request_id.strip())
+        answer = req.get("answer")
+        if answer:
+            return _answer_text(answer.get("action"), answer.get("text"))
+        if req.get("status") in FINISHED:
+            return f"No answer: the request is {req['status']}."
+        return "Not answered yet."
+
+
+ASK_DESCRIPTION = (
+    "Ask a human a question and wait for the answer. Input: the question, "
+    'or JSON {"title": "...", "body": "...", "options": ["Yes", "No"]}.'
+)
+START_DESCRIPTION = (
+    "Send a question to a human without waiting. Returns a request ID to check later "
+    'with human_input_check. Input: the question, or JSON {"title": "...", "body": "...", "options": ["Yes", "No"]}.'
+)
+CHECK_DESCRIPTION = "Check whether a human answered a question sent with human_input_start. Input: the request ID."
+
+
+def langchain_tools(client=None, **kwargs):
+    """human_input, human_input_start and human_input_check as LangChain tools."""
+    from langchain_core.tools import StructuredTool
+
+    h = HumanInput(client, **kwargs)
+    return [
+        StructuredTool.from_function(func=h.ask, coroutine=h.aask, name="human_input", description=ASK_DESCRIPTION),
+        StructuredTool.from_function(func=h.start, name="human_input_start", description=START_DESCRIPTION),
+        StructuredTool.from_function(func=h.check, name="human_input_check", description=CHECK_DESCRIPTION),
+    ]
+
+
+def llamaindex_tools(client=None, **kwargs):
+    """The same tools as LlamaIndex FunctionTools."""
+    from llama_index.core.tools import FunctionTool
+
+    h = HumanInput(client, **kwargs)
+    return [
+        FunctionTool.from_defaults(fn=h.ask, async_fn=h.aask, name="human_input", description=ASK_DESCRIPTION),
+        FunctionTool.from_defaults(fn=h.start, name="human_input_start", description=START_DESCRIPTION),
+        FunctionTool.from_defaults(fn=h.check, name="human_input_check", description=CHECK_DESCRIPTION),
+    ]
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Full-text search. GET /v1/search?q=deploy+approval finds the requests
+// whose title, body or answer contain every word of q (as a prefix, so
+// "deploy" also finds "deployment"), newest first, in the shape of
+// GET /v1/requests. The index is the request_search table: an FTS5 table on
+// SQLite, a tsvector column on Postgres and a FULLTEXT index on MySQL,
+// which the store keeps up to date as requests are created and answered.
+//
+// Words are runs of letters and digits; everything else in q separates
+// them, so the query language of each backend never reaches it.
+
+const (
+	maxSearchTerms = 10
+	maxSearchLimit = 100
+)
+
+// searchTerms splits q into lowercase words.
+func searchTerms(q string) []string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return words[:min(len(words), maxSearchTerms)]
+}
+
+// indexRequest adds a new request to the search index.
+func indexRequest(ctx context.Context, ex execer, reqID, title, body string) error {
+	_, err := ex.ExecContext(ctx,
+		`INSERT INTO request_search(request_id,title,body,answer) VALUES(?,?,?,'')`, reqID, title, body)
+	return err
+}
+
+// indexAnswer records the answer of reqID in the search index.
+func (s *store) indexAnswer(ctx context.Context, reqID, action, text string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE request_search SET answer=? WHERE request_id=?`, strings.TrimSpace(action+" "+text), reqID)
+	return err
+}
+
+// handleSearch serves GET /v1/search?q=&status=&tenant=&limit=&before=.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	terms := searchTerms(q.Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "q must contain a word to search for", http.StatusBadRequest)
+		return
+	}
+	f := requestFilter{
+		Status: strings.TrimSpace(q.Get("status")),
+		Tenant: strings.ToLower(strings.TrimSpace(q.Get("tenant"))),
+		Search: terms,
+		Limit:  20,
+	}
+	if own := keyTenant(r.Context()); own != "" {
+		f.Tenant = own
+	}
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		f.Limit = min(v, maxSearchLimit)
+	}
+	if v, err := strconv.ParseInt(q.Get("before"), 10, 64); err == nil && v > 0 {
+		f.Before = v
+	}
+	list, err := s.db.listRequests(r.Context(), f)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		out = append(out, item.view())
+	}
+	resp := map[string]any{"q": strings.Join(terms, " "), "requests": out}
+	if len(list) == f.Limit {
+		resp["next_before"] = list[len(list)-1].CreatedAt
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
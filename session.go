@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Interaction sessions let the asker push follow-up questions to a page that
+// is already open. Every request belongs to a session (its own request_id by
+// default); an ask with session_id joins an existing one. Open pages listen on
+// /r/{id}/stream and are handed the follow-up's link via session.question
+// instead of a new push notification.
+//
+// A follow-up that was created before the current question was answered is
+// not lost either: submitting the answer leads straight to the oldest open
+// follow-up of the session (or thread), through a link minted for it then.
+//
+// The same stream keeps an open page current. It starts with page.state (the
+// request's status) and sends page.changed whenever something happens that
+// the page should be reloaded for: the request was answered on another
+// device, cancelled, forwarded or expired. Only the event type is passed on,
+// not its data. The asker's custom events arrive as page.progress with their
+// message (see progress.go).
+
+func sessionHubKey(sessionID string) string {
+	return "session:" + sessionID
+}
+
+// getSessionID returns the session a request belongs to, which is the
+// request's own id unless it was created as a follow-up.
+func (s *store) getSessionID(ctx context.Context, reqID string) (string, error) {
+	var sid sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT session_id FROM requests WHERE request_id=?`, reqID).Scan(&sid); err != nil {
+		return "", err
+	}
+	if !sid.Valid || sid.String == "" {
+		return reqID, nil
+	}
+	return sid.String, nil
+}
+
+// resolveSession validates askRequest.SessionID and maps it to the root
+// session id.
+func (s *server) resolveSession(ctx context.Context, ar *askRequest) error {
+	if ar.SessionID == "" {
+		return nil
+	}
+	if !isValidRequestID(ar.SessionID) {
+		return badAskError("invalid session_id")
+	}
+	sid, err := s.db.getSessionID(ctx, ar.SessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return badAskError("session_id not found")
+		}
+		return err
+	}
+	ar.SessionID = sid
+	return nil
+}
+
+// offerToSession hands a follow-up question to pages of the session that are
+// currently open. It reports false when nobody is listening, in which case the
+// caller falls back to a regular notification.
+func (s *server) offerToSession(ctx context.Context, requestID string, ar askRequest, interactionURL string) bool {
+	key := sessionHubKey(ar.SessionID)
+	if !s.hub.hasSubscribers(key) {
+		return false
+	}
+	b, _ := json.Marshal(map[string]any{
+		"request_id":      requestID,
+		"title":           ar.Title,
+		"interaction_url": interactionURL,
+	})
+	s.hub.publishTo(key, Event{
+		ID:        genID("evt_"),
+		Type:      "session.question",
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		RequestID: requestID,
+		Data:      json.RawMessage(b),
+	})
+	ev := s.mustNewEvent(ctx, requestID, "notify.sent", map[string]any{
+		"channel":    "session",
+		"session_id": ar.SessionID,
+	})
+	_ = s.persistTerminalAware(ctx, ev)
+	_ = s.db.updateRequestStatus(ctx, requestID, "delivered")
+	return true
+}
+
+// sendSessionNotification delivers a follow-up in-page when possible and
+// falls back to a regular push otherwise.
+func (s *server) sendSessionNotification(ctx context.Context, requestID string, ar askRequest, interactionURL string) error {
+	if s.offerToSession(ctx, requestID, ar, interactionURL) {
+		return nil
+	}
+	return s.sendNotification(ctx, requestID, ar, interactionURL)
+}
+
+// nextFollowUp returns the oldest request of reqID's session or thread that
+// still waits for a single answer.
+func (s *store) nextFollowUp(ctx context.Context, reqID string) (string, int64, bool, error) {
+	sid, err := s.getSessionID(ctx, reqID)
+	if err != nil {
+		return "", 0, false, err
+	}
+	var id string
+	var expiresAt int64
+	err = s.db.QueryRowContext(ctx,
+		`SELECT request_id, expires_at FROM requests
+		WHERE request_id<>? AND (session_id=? OR request_id=? OR parent_request_id=?)
+		AND status IN ('created','delivered') AND expires_at>? AND (responders_mode IS NULL OR responders_mode='')
+		ORDER BY created_at ASC, request_id ASC LIMIT 1`,
+		reqID, sid, sid, reqID, time.Now().Unix(),
+	).Scan(&id, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	return id, expiresAt, true, nil
+}
+
+// followUpURL mints a link to the next open follow-up of reqID, for the page
+// to go on to once reqID is answered.
+func (s *server) followUpURL(ctx context.Context, reqID string) (string, bool) {
+	next, expiresAt, ok, err := s.db.nextFollowUp(ctx, reqID)
+	if err != nil || !ok {
+		return "", false
+	}
+	tokenPlain := genToken()
+	if err := s.db.insertToken(ctx, next, sha256Hex(tokenPlain), "", time.Unix(expiresAt, 0)); err != nil {
+		return "", false
+	}
+	return s.makeInteractionURL(next, tokenPlain), true
+}
+
+// pageRefreshEvents are the request events that make an open page reload.
+var pageRefreshEvents = map[string]bool{
+	"user.submitted":      true,
+	"user.step_submitted": true,
+	"request.completed":   true,
+	"request.cancelled":   true,
+	"request.expired":     true,
+	"request.delegated":   true,
+	"answer.acknowledged": true,
+}
+
+// pageChange turns a request event into the page.changed event sent to the
+// page of responder, or reports false if that page need not reload. In
+// collect and quorum mode another responder's answer leaves this page as is.
+func pageChange(ev Event, responder string, multi bool) (Event, bool) {
+	if !pageRefreshEvents[ev.Type] {
+		return Event{}, false
+	}
+	if multi && (ev.Type == "user.submitted" || ev.Type == "user.step_submitted") {
+		var d struct {
+			Responder string `json:"responder"`
+		}
+		b, _ := json.Marshal(ev.Data)
+		if json.Unmarshal(b, &d) != nil || d.Responder != responder {
+			return Event{}, false
+		}
+	}
+	b, _ := json.Marshal(map[string]any{"reason": ev.Type})
+	return Event{ID: ev.ID, Type: "page.changed", RequestID: ev.RequestID, Data: json.RawMessage(b)}, true
+}
+
+// handleUserStream serves GET /r/{id}/stream, the interaction page's own SSE
+// feed. It carries session.question events for follow-ups in the session and
+// page.state / page.changed / page.claimed for the request itself.
+func (s *server) handleUserStream(w http.ResponseWriter, r *http.Request, requestID, status, responder string, multi bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	sid, err := s.db.getSessionID(ctx, requestID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	interval, buffer := s.streamTuning(ctx, requestID)
+	ch, unsub := s.hub.subscribeSize(sessionHubKey(sid), buffer)
+	defer unsub()
+	reqCh, reqUnsub := s.hub.subscribeSize(requestID, buffer)
+	defer reqUnsub()
+	terminal := s.terminalEventTypes(ctx, requestID)
+
+	sseInit(w)
+	sendState := func(status string) error {
+		state, _ := json.Marshal(map[string]any{"status": status})
+		return s.sendEvent(w, Event{ID: genID("evt_"), Type: "page.state", RequestID: requestID, Data: json.RawMessage(state)})
+	}
+	if err := sendState(status); err != nil {
+		return
+	}
+	pageID := r.URL.Query().Get("p")
+	if !multi {
+		if pe, ok := s.pageClaim(ctx, requestID, pageID, responder); ok {
+			if err := s.sendEvent(w, pe); err != nil {
+				return
+			}
+		}
+	}
+	// After dropped events the page may have missed a change: tell it the
+	// current status again.
+	resync := func(ev Event) error {
+		ev.RequestID = requestID
+		if err := s.sendEvent(w, ev); err != nil {
+			return err
+		}
+		if st, _, err := s.db.getRequestStatus(ctx, requestID); err == nil {
+			return sendState(st)
+		}
+		return nil
+	}
+
+	hb := time.NewTicker(interval)
+	defer hb.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.shutdown.stopping:
+			sendRestarting(w)
+			return
+		case <-hb.C:
+			if err := s.sendEvent(w, Event{Type: "heartbeat", RequestID: requestID, Data: json.RawMessage(`{}`)}); err != nil {
+				return
+			}
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if ev.Type == "events.dropped" {
+				if resync(ev) != nil {
+					return
+				}
+				continue
+			}
+			if err := s.sendEvent(w, ev); err != nil {
+				return
+			}
+		case ev, ok := <-reqCh:
+			if !ok {
+				return
+			}
+			if ev.Type == "events.dropped" {
+				if resync(ev) != nil {
+					return
+				}
+				continue
+			}
+			if isCustomEventType(ev.Type) {
+				if err := s.sendEvent(w, pageProgress(ev, terminal)); err != nil {
+					return
+				}
+				continue
+			}
+			if ev.Type == "user.claimed" && !multi {
+				if pe, ok := s.pageClaim(ctx, requestID, pageID, responder); ok {
+					if err := s.sendEvent(w, pe); err != nil {
+						return
+					}
+				}
+				continue
+			}
+			if pe, ok := pageChange(ev, responder, multi); ok {
+				if err := s.sendEvent(w, pe); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
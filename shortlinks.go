@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Short links: /s/{code} redirects to an interaction URL, for push channels
+// that truncate long links. With short_links on, notifications carry the
+// short form; API responses and events keep the full URL (plus short_url).
+//
+// The code is random and only its hash is stored, like tokens. The target URL
+// is sealed with AES-GCM under a key derived from the code, so the table alone
+// does not reveal the links, and a code that does not open its row is
+// rejected. A short link expires with its token, or after
+// short_link_ttl_seconds if that comes first.
+
+const shortCodeLen = 16
+
+func shortLinkKey(code string) []byte {
+	k := sha256.Sum256([]byte("ask4me-short-link:" + code))
+	return k[:]
+}
+
+func sealURL(code, target string) (string, error) {
+	block, err := aes.NewCipher(shortLinkKey(code))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(target), nil)), nil
+}
+
+func openURL(code, sealed string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(shortLinkKey(code))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < gcm.NonceSize() {
+		return "", errors.New("short link: truncated")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (s *store) insertShortLink(ctx context.Context, reqID, codeHash, sealed string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO short_links(code_hash,request_id,sealed,expires_at,created_at) VALUES(?,?,?,?,?)`,
+		codeHash, reqID, sealed, expiresAt.Unix(), time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *store) getShortLink(ctx context.Context, codeHash string) (sealed string, expiresAt int64, err error) {
+	err = s.db.QueryRowContext(ctx,
+		`SELECT sealed, expires_at FROM short_links WHERE code_hash=?`, codeHash,
+	).Scan(&sealed, &expiresAt)
+	return sealed, expiresAt, err
+}
+
+// shortenURL stores a short link to target. It lives until expiresAt, or
+// short_link_ttl_seconds after from if that is earlier.
+func (s *server) shortenURL(ctx context.Context, requestID, target string, from, expiresAt time.Time) (string, error) {
+	if ttl := s.cfg().ShortLinkTTLSeconds; ttl > 0 {
+		if until := from.Add(time.Duration(ttl) * time.Second); until.Before(expiresAt) {
+			expiresAt = until
+		}
+	}
+	code := strings.ToLower(genToken()[:shortCodeLen])
+	sealed, err := sealURL(code, target)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.insertShortLink(ctx, requestID, sha256Hex(code), sealed, expiresAt); err != nil {
+		return "", err
+	}
+	return s.cfg().pageBaseURL() + "/s/" + code, nil
+}
+
+// shortenLinks fills in ShortURL for every link when short_links is on.
+// Scheduled asks count the TTL from send_at.
+func (s *server) shortenLinks(ctx context.Context, requestID string, links []responderLink, sendAt, expiresAt time.Time) error {
+	if !s.cfg().ShortLinks {
+		return nil
+	}
+	from := time.Now()
+	if sendAt.After(from) {
+		from = sendAt
+	}
+	for i := range links {
+		short, err := s.shortenURL(ctx, requestID, links[i].URL, from, expiresAt)
+		if err != nil {
+			return err
+		}
+		links[i].ShortURL = short
+	}
+	return nil
+}
+
+// handleShortLink serves GET /s/{code}.
+func (s *server) handleShortLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/s/"), "/"))
+	if len(code) != shortCodeLen {
+		http.NotFound(w, r)
+		return
+	}
+	sealed, expiresAt, err := s.db.getShortLink(r.Context(), sha256Hex(code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if time.Now().Unix() > expiresAt {
+		http.Error(w, "this link has expired", http.StatusGone)
+		return
+	}
+	target, err := openURL(code, sealed)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	setPageSecurityHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// On SIGTERM or SIGINT the server shuts down in order:
+//
+//  1. /v1/ask answers 503 with Retry-After, so no new asks start here.
+//  2. Open SSE streams get a final ": server.restarting" comment and end, and
+//     nonStream waits answer 503; clients resume with request_id once the
+//     server is back.
+//  3. The listener closes once handlers return, the background loops stop,
+//     and due notifications and callbacks are sent. Whatever is not done
+//     within shutdown_timeout_seconds stays in the outbox for the next start.
+//  4. The database is closed.
+//
+// A second signal exits at once.
+
+const shutdownRetryAfter = 5
+
+var errServerStopping = errors.New("server is shutting down")
+
+type shutdownState struct {
+	once     sync.Once
+	stopping chan struct{}
+	// inflight counts outbox deliveries and callbacks still running.
+	inflight sync.WaitGroup
+}
+
+func newShutdownState() *shutdownState {
+	return &shutdownState{stopping: make(chan struct{})}
+}
+
+func (s *server) isStopping() bool {
+	select {
+	case <-s.shutdown.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// goInflight runs f in a goroutine that shutdown waits for.
+func (s *server) goInflight(f func()) {
+	s.shutdown.inflight.Add(1)
+	go func() {
+		defer s.shutdown.inflight.Done()
+		f()
+	}()
+}
+
+// refuseWhileStopping answers 503 once shutdown has begun.
+func (s *server) refuseWhileStopping(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isStopping() {
+			w.Header().Set("Retry-After", strconv.Itoa(shutdownRetryAfter))
+			http.Error(w, errServerStopping.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sendRestarting ends an SSE stream with a comment, which EventSource and the
+// SDK ignore before reconnecting.
+func sendRestarting(w http.ResponseWriter) {
+	_, _ = io.WriteString(w, ": server.restarting\n\n")
+	if fl, ok := w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// writeStopping answers a nonStream wait cut short by shutdown.
+func writeStopping(w http.ResponseWriter, requestID string) {
+	w.Header().Set("Retry-After", strconv.Itoa(shutdownRetryAfter))
+	w.Header().Set("X-Ask4Me-Request-Id", requestID)
+	writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+		"request_id": requestID,
+		"error":      errServerStopping.Error(),
+	})
+}
+
+// waitGroupTimeout waits for wg until ctx ends and reports whether it
+// finished.
+func waitGroupTimeout(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// gracefulShutdown runs steps 1-3 above. stopLoops cancels the background
+// loops and returns once they have exited.
+func (s *server) gracefulShutdown(httpSrvs []*http.Server, stopLoops func()) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg().ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	s.shutdown.once.Do(func() { close(s.shutdown.stopping) })
+	for _, hs := range httpSrvs {
+		if err := hs.Shutdown(ctx); err != nil {
+			slog.Warn("shutdown: http server", "error", err)
+		}
+	}
+	stopLoops()
+	// Send what is due now; rows that are not stay pending in the outbox.
+	s.drainOutbox(context.WithoutCancel(ctx))
+	if !waitGroupTimeout(ctx, &s.shutdown.inflight) {
+		slog.Warn("shutdown: deliveries still running, leaving them to the next start")
+	}
+	slog.Info("shutdown complete", "latency_ms", time.Since(start).Milliseconds())
+}
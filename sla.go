@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// SLA timers. expires_in_seconds says when an ask is dead; sla_seconds says
+// when it is late. An ask that is still open sla_seconds after it went out
+// (after send_at, for scheduled asks) gets a non-terminal
+// request.sla_breached event, so a waiting caller can tell "slow" from
+// "dead" and, say, page someone else or tell its user, while the ask stays
+// answerable until it expires. An answer (in collect and quorum mode: the
+// ask completing) stops the clock; acknowledging the ask does not.
+//
+// escalate_to names a contact or rotation to bring in on a breach: they get
+// a link of their own through their channels, like a forwarded ask, but the
+// original links keep working and whoever answers first wins. A rotation is
+// resolved to whoever is on call at the time of the breach.
+
+func normalizeSLA(ar *askRequest) error {
+	if ar.SLASeconds < 0 {
+		return badAskError("sla_seconds must be positive")
+	}
+	if ar.EscalateTo != "" && ar.SLASeconds == 0 {
+		return badAskError("escalate_to requires sla_seconds")
+	}
+	return nil
+}
+
+// checkSLA validates the SLA of an ask against its expiry and the contacts
+// directory, once both are known.
+func (s *server) checkSLA(ar askRequest, expiresIn int) error {
+	if ar.SLASeconds == 0 {
+		return nil
+	}
+	if ar.SLASeconds >= expiresIn {
+		return badAskError("sla_seconds must be shorter than the ask's expiry")
+	}
+	if ar.EscalateTo == "" {
+		return nil
+	}
+	if _, ok := s.cfg().rotation(ar.EscalateTo); !ok {
+		if _, ok := s.cfg().contact(ar.EscalateTo); !ok {
+			return badAskError("escalate_to must name a configured contact or rotation")
+		}
+	}
+	if ar.Responders != nil && isMultiAnswerMode(ar.Responders.Mode) {
+		return badAskError("escalate_to cannot be combined with collect or quorum responders")
+	}
+	return nil
+}
+
+// markSLABreached records the breach of a request that is still open. It
+// returns false when the request finished in time or the breach was
+// already recorded.
+func (s *store) markSLABreached(ctx context.Context, reqID string) (seconds int, escalateTo string, ok bool, err error) {
+	now := time.Now().Unix()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE requests SET sla_breached_at=? WHERE request_id=? AND sla_breached_at IS NULL AND sla_at<=?
+		 AND status IN ('created','delivered') AND NOT EXISTS (SELECT 1 FROM answers WHERE request_id=?)`,
+		now, reqID, now, reqID,
+	)
+	if err != nil {
+		return 0, "", false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, "", false, err
+	}
+	var sec sql.NullInt64
+	var to sql.NullString
+	err = s.db.QueryRowContext(ctx, `SELECT sla_seconds, escalate_to FROM requests WHERE request_id=?`, reqID).Scan(&sec, &to)
+	return int(sec.Int64), to.String, err == nil, err
+}
+
+// listSLAPending returns the SLA deadlines of open requests that have not
+// breached yet.
+func (s *store) listSLAPending(ctx context.Context) ([]pendingRow, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT request_id, sla_at FROM requests
+		 WHERE status IN ('created','delivered','scheduled') AND sla_at IS NOT NULL AND sla_breached_at IS NULL`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pendingRow
+	for rows.Next() {
+		var r pendingRow
+		var at int64
+		if err := rows.Scan(&r.RequestID, &at); err != nil {
+			return nil, err
+		}
+		r.ExpiresAt = time.Unix(at, 0)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// slaLoop waits for the SLA deadline of requestID and reports a breach.
+func (s *server) slaLoop(ctx context.Context, requestID string, slaAt time.Time) {
+	timer := time.NewTimer(time.Until(slaAt))
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+	seconds, escalateTo, ok, err := s.db.markSLABreached(ctx, requestID)
+	if err != nil {
+		slog.Error("sla: mark breached", "request_id", requestID, "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	data := map[string]any{"sla_seconds": seconds}
+	if escalateTo != "" {
+		if err := s.escalate(ctx, requestID, escalateTo, data); err != nil {
+			slog.Error("sla: escalate", "request_id", requestID, "escalate_to", escalateTo, "error", err)
+		}
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.sla_breached", data)
+	_ = s.persistTerminalAware(ctx, ev)
+}
+
+// escalate mints a link for the escalate_to contact (or whoever is on call
+// in that rotation) and pushes it to them, noting the escalation in data.
+func (s *server) escalate(ctx context.Context, requestID, name string, data map[string]any) error {
+	if rc, ok := s.cfg().rotation(name); ok {
+		contact, _, err := s.onCall(ctx, rc, time.Now())
+		if err != nil {
+			return err
+		}
+		data["rotation"], name = rc.Name, contact
+	}
+	contact, ok := s.cfg().contact(name)
+	if !ok {
+		return nil
+	}
+	_, expiresAt, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	ar, err := s.db.delegateAsk(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	token := genToken()
+	if err := s.db.insertToken(ctx, requestID, sha256Hex(token), contact.Name, time.Unix(expiresAt, 0)); err != nil {
+		return err
+	}
+	link := s.makeInteractionURL(requestID, token)
+	notifyURL := link
+	if s.cfg().ShortLinks {
+		if notifyURL, err = s.shortenURL(ctx, requestID, link, time.Now(), time.Unix(expiresAt, 0)); err != nil {
+			return err
+		}
+		data["short_url"] = notifyURL
+	}
+	data["escalated_to"] = contact.Name
+	data["interaction_url"] = link
+	go s.notifyDelegate(context.Background(), requestID, ar, contact, notifyURL)
+	return nil
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slack. With slack_signing_secret set, a Slack app becomes a place to
+// answer asks, not just to be notified: the /ask4me slash command lists the
+// pending requests, and so does the app's Home tab. Each request shows its
+// buttons, which answer at once; asks with a text input get a "Reply" button
+// that opens a dialog, and every ask has "Open page", which opens a fresh
+// interaction link (JSON Forms and multi-step asks are answered there).
+//
+// Answers take the same path as the page: user.submitted with "via":"slack"
+// and the Slack user name as responder, so an open page reloads, and an ask
+// answered on the page drops out of the list the next time it is shown (the
+// Home tab is rebuilt whenever it is opened and after each answer).
+//
+// Set the app's slash command URL to /slack/commands, its interactivity URL
+// to /slack/interactions and its event subscription URL (app_home_opened) to
+// /slack/events. Every call is checked against the signing secret. The Home
+// tab and reply dialogs need slack_bot_token. slack_allowed_users, a list of
+// Slack user IDs, limits who may answer; empty means anyone in the
+// workspace.
+
+const (
+	slackAPIBase   = "https://slack.com/api/"
+	slackTimeout   = 10 * time.Second
+	slackMaxSkew   = 5 * 60
+	slackListLimit = 20
+	slackMaxBody   = 1 << 20
+)
+
+var slackClient = &http.Client{Timeout: slackTimeout}
+
+func (c *Config) normalizeSlack() {
+	c.SlackSigningSecret = strings.TrimSpace(c.SlackSigningSecret)
+	c.SlackBotToken = strings.TrimSpace(c.SlackBotToken)
+	users := c.SlackAllowedUsers[:0]
+	for _, u := range c.SlackAllowedUsers {
+		if u = strings.TrimSpace(u); u != "" {
+			users = append(users, u)
+		}
+	}
+	c.SlackAllowedUsers = users
+}
+
+func (c Config) slackAllowed(userID string) bool {
+	if len(c.SlackAllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range c.SlackAllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySlackSignature checks a request signed with the app's signing
+// secret (v0 scheme).
+func verifySlackSignature(secret string, h http.Header, body []byte, now time.Time) bool {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || abs(int(now.Unix()-sec)) > slackMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(h.Get("X-Slack-Signature")))
+}
+
+// handleSlack serves the /slack/ routes.
+func (s *server) handleSlack(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg()
+	if cfg.SlackSigningSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == "/slack/open" {
+		s.handleSlackOpen(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, slackMaxBody))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !verifySlackSignature(cfg.SlackSigningSecret, r.Header, body, time.Now()) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/slack/commands":
+		s.handleSlackCommand(w, r, body)
+	case "/slack/interactions":
+		s.handleSlackInteraction(w, r, body)
+	case "/slack/events":
+		s.handleSlackEvent(w, r, body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleSlackCommand answers /ask4me with the pending requests, shown only
+// to the user who ran it.
+func (s *server) handleSlackCommand(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	userID := form.Get("user_id")
+	resp := map[string]any{"response_type": "ephemeral"}
+	switch {
+	case !s.cfg().slackAllowed(userID):
+		resp["text"] = "You are not allowed to answer requests here."
+	case strings.EqualFold(strings.TrimSpace(form.Get("text")), "help"):
+		resp["text"] = "`" + form.Get("command") + "` lists the requests waiting for an answer. Press a button to answer, *Reply* to write one, or *Open page* for the full page."
+	default:
+		resp["text"] = "Pending requests"
+		resp["blocks"] = s.slackPendingBlocks(r.Context(), form.Get("user_name"), "")
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type slackInteraction struct {
+	Type        string `json:"type"`
+	TriggerID   string `json:"trigger_id"`
+	ResponseURL string `json:"response_url"`
+	User        struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Container struct {
+		Type string `json:"type"`
+	} `json:"container"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	View struct {
+		CallbackID      string `json:"callback_id"`
+		PrivateMetadata string `json:"private_metadata"`
+		State           struct {
+			Values map[string]map[string]struct {
+				Value string `json:"value"`
+			} `json:"values"`
+		} `json:"state"`
+	} `json:"view"`
+}
+
+// slackAction is the value of an answer or reply button.
+type slackAction struct {
+	RequestID string `json:"r"`
+	Action    string `json:"a,omitempty"`
+}
+
+// slackReplyMeta is kept in the reply dialog to refresh the list it was
+// opened from.
+type slackReplyMeta struct {
+	RequestID   string `json:"r"`
+	Home        bool   `json:"h,omitempty"`
+	ResponseURL string `json:"u,omitempty"`
+}
+
+func (s *server) handleSlackInteraction(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var in slackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &in); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	allowed := s.cfg().slackAllowed(in.User.ID)
+	switch in.Type {
+	case "block_actions":
+		if len(in.Actions) == 0 {
+			break
+		}
+		act := in.Actions[0]
+		kind, _, _ := strings.Cut(act.ActionID, ":")
+		var a slackAction
+		if kind == "open" || json.Unmarshal([]byte(act.Value), &a) != nil {
+			break
+		}
+		home := in.Container.Type == "view"
+		if !allowed {
+			go s.slackRefresh(in.User.ID, in.User.Username, home, in.ResponseURL, "You are not allowed to answer requests here.")
+			break
+		}
+		switch kind {
+		case "answer":
+			err := s.answerRemote(r.Context(), a.RequestID, remoteAnswer{Action: a.Action, Responder: in.User.Username, Via: "slack"})
+			go s.slackRefresh(in.User.ID, in.User.Username, home, in.ResponseURL, s.slackAnswerNote(r.Context(), a.RequestID, err))
+		case "reply":
+			meta := slackReplyMeta{RequestID: a.RequestID, Home: home}
+			if !home {
+				meta.ResponseURL = in.ResponseURL
+			}
+			if err := s.slackOpenReply(r.Context(), in.TriggerID, meta); err != nil {
+				slog.Warn("slack: reply dialog", "request_id", a.RequestID, "error", err)
+			}
+		}
+	case "view_submission":
+		if in.View.CallbackID != "ask4me_reply" {
+			break
+		}
+		var meta slackReplyMeta
+		_ = json.Unmarshal([]byte(in.View.PrivateMetadata), &meta)
+		text := in.View.State.Values["reply"]["text"].Value
+		if !allowed {
+			writeJSON(w, http.StatusOK, slackViewError("You are not allowed to answer requests here."))
+			return
+		}
+		err := s.answerRemote(r.Context(), meta.RequestID, remoteAnswer{Text: text, Responder: in.User.Username, Via: "slack"})
+		if errors.Is(err, errAnswerInvalid) {
+			writeJSON(w, http.StatusOK, slackViewError(strings.TrimPrefix(err.Error(), errAnswerInvalid.Error()+": ")))
+			return
+		}
+		go s.slackRefresh(in.User.ID, in.User.Username, meta.Home, meta.ResponseURL, s.slackAnswerNote(r.Context(), meta.RequestID, err))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func slackViewError(msg string) map[string]any {
+	return map[string]any{
+		"response_action": "errors",
+		"errors":          map[string]string{"reply": msg},
+	}
+}
+
+// handleSlackEvent serves the Events API: the URL check and app_home_opened.
+func (s *server) handleSlackEvent(w http.ResponseWriter, r *http.Request, body []byte) {
+	var in struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Event     struct {
+			Type string `json:"type"`
+			User string `json:"user"`
+			Tab  string `json:"tab"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if in.Type == "url_verification" {
+		writeJSON(w, http.StatusOK, map[string]string{"challenge": in.Challenge})
+		return
+	}
+	if in.Type == "event_callback" && in.Event.Type == "app_home_opened" && in.Event.Tab == "home" {
+		go s.slackRefresh(in.Event.User, "", true, "", "")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// slackAnswerNote tells the user how their answer went.
+func (s *server) slackAnswerNote(ctx context.Context, requestID string, err error) string {
+	title := requestID
+	if req, e := s.db.getRequestSummary(ctx, requestID); e == nil {
+		title = req.Title
+	}
+	title = slackEscape(title)
+	switch {
+	case err == nil:
+		return ":white_check_mark: Answered *" + title + "*."
+	case errors.Is(err, errAnswerTaken), errors.Is(err, errAnswerNotOpen):
+		return ":information_source: *" + title + "* was already answered or is closed."
+	case errors.Is(err, errAnswerNotFound):
+		return ":warning: That request no longer exists."
+	case errors.Is(err, errAnswerInvalid):
+		return ":warning: " + slackEscape(strings.TrimPrefix(err.Error(), errAnswerInvalid.Error()+": ")) + "."
+	}
+	slog.Warn("slack: answer", "request_id", requestID, "error", err)
+	return ":warning: Could not record the answer, try again."
+}
+
+// slackRefresh shows the pending list again after an action: it republishes
+// the Home tab or replaces the slash command's message.
+func (s *server) slackRefresh(userID, userName string, home bool, responseURL, note string) {
+	ctx, cancel := context.WithTimeout(context.Background(), slackTimeout)
+	defer cancel()
+	var err error
+	switch {
+	case home:
+		blocks := []map[string]any{{
+			"type": "header",
+			"text": map[string]any{"type": "plain_text", "text": "Pending requests"},
+		}}
+		if s.cfg().slackAllowed(userID) {
+			blocks = append(blocks, s.slackPendingBlocks(ctx, userName, note)...)
+		} else {
+			blocks = append(blocks, slackSection("You are not allowed to answer requests here."))
+		}
+		err = s.slackAPI(ctx, "views.publish", map[string]any{
+			"user_id": userID,
+			"view":    map[string]any{"type": "home", "blocks": blocks},
+		})
+	case responseURL != "":
+		err = slackPost(ctx, responseURL, "", map[string]any{
+			"replace_original": true,
+			"text":             "Pending requests",
+			"blocks":           s.slackPendingBlocks(ctx, userName, note),
+		})
+	}
+	if err != nil {
+		slog.Warn("slack: refresh", "user", userID, "error", err)
+	}
+}
+
+// slackOpenReply opens the dialog for a text answer.
+func (s *server) slackOpenReply(ctx context.Context, triggerID string, meta slackReplyMeta) error {
+	req, err := s.db.getRequestSummary(ctx, meta.RequestID)
+	if err != nil {
+		return err
+	}
+	form, err := s.db.getRequestForm(ctx, meta.RequestID)
+	if err != nil {
+		return err
+	}
+	label, submit := "Answer", "Send"
+	if mcd, _ := form["mcd"].(string); mcd != "" {
+		if in := parseMCD(mcd).Input; in != nil {
+			label, submit = in.Label, in.Submit
+		}
+	}
+	b, _ := json.Marshal(meta)
+	return s.slackAPI(ctx, "views.open", map[string]any{
+		"trigger_id": triggerID,
+		"view": map[string]any{
+			"type":             "modal",
+			"callback_id":      "ask4me_reply",
+			"private_metadata": string(b),
+			"title":            map[string]any{"type": "plain_text", "text": "Ask4Me"},
+			"submit":           map[string]any{"type": "plain_text", "text": oneLine(submit, 24)},
+			"close":            map[string]any{"type": "plain_text", "text": "Cancel"},
+			"blocks": []map[string]any{
+				slackSection("*" + slackEscape(req.Title) + "*\n" + slackEscape(truncate(req.Body, 2000))),
+				{
+					"type":     "input",
+					"block_id": "reply",
+					"label":    map[string]any{"type": "plain_text", "text": oneLine(label, 2000)},
+					"element": map[string]any{
+						"type":      "plain_text_input",
+						"action_id": "text",
+						"multiline": true,
+					},
+				},
+			},
+		},
+	})
+}
+
+// slackPendingBlocks renders the pending requests as Block Kit blocks, with
+// note on top.
+func (s *server) slackPendingBlocks(ctx context.Context, userName, note string) []map[string]any {
+	var blocks []map[string]any
+	if note != "" {
+		blocks = append(blocks, slackSection(note))
+	}
+	list, err := s.db.pendingRequests(ctx, slackListLimit)
+	if err != nil {
+		return append(blocks, slackSection(":warning: Could not load the requests."))
+	}
+	if len(list) == 0 {
+		return append(blocks, slackSection("Nothing is waiting for an answer."))
+	}
+	for i, req := range list {
+		if i > 0 {
+			blocks = append(blocks, map[string]any{"type": "divider"})
+		}
+		text := "*" + slackEscape(req.Title) + "*"
+		if body := strings.TrimSpace(req.Body); body != "" {
+			text += "\n" + slackEscape(truncate(body, 500))
+		}
+		blocks = append(blocks, slackSection(text))
+		meta := fmt.Sprintf("<!date^%d^Expires {date_short_pretty} at {time}|Expires %s>", req.ExpiresAt, time.Unix(req.ExpiresAt, 0).UTC().Format(time.RFC3339))
+		if req.Priority != "" && req.Priority != priorityNormal {
+			meta = "*" + req.Priority + "* · " + meta
+		}
+		blocks = append(blocks, map[string]any{
+			"type":     "context",
+			"elements": []map[string]any{{"type": "mrkdwn", "text": meta}},
+		})
+		if buttons := s.slackButtons(ctx, req, userName); len(buttons) > 0 {
+			blocks = append(blocks, map[string]any{"type": "actions", "elements": buttons})
+		}
+	}
+	return blocks
+}
+
+// slackButtons are the answer buttons of one request, then Reply and Open
+// page.
+func (s *server) slackButtons(ctx context.Context, req requestSummary, userName string) []map[string]any {
+	form, err := s.db.getRequestForm(ctx, req.RequestID)
+	if err != nil {
+		return nil
+	}
+	var out []map[string]any
+	_, jsonForms := form["jsonforms_schema"]
+	_, steps := form["steps"]
+	if mcd, _ := form["mcd"].(string); !jsonForms && !steps {
+		spec := parseMCD(mcd)
+		for i, b := range spec.Buttons {
+			if i == 20 {
+				break
+			}
+			v, _ := json.Marshal(slackAction{RequestID: req.RequestID, Action: b.Value})
+			btn := map[string]any{
+				"type":      "button",
+				"action_id": "answer:" + strconv.Itoa(i),
+				"text":      map[string]any{"type": "plain_text", "text": oneLine(b.Label, 75)},
+				"value":     string(v),
+			}
+			if style := slackButtonStyle(b.Value); style != "" {
+				btn["style"] = style
+			}
+			out = append(out, btn)
+		}
+		if spec.Input != nil && s.cfg().SlackBotToken != "" {
+			v, _ := json.Marshal(slackAction{RequestID: req.RequestID})
+			out = append(out, map[string]any{
+				"type":      "button",
+				"action_id": "reply",
+				"text":      map[string]any{"type": "plain_text", "text": "Reply…"},
+				"value":     string(v),
+			})
+		}
+	}
+	responder := ""
+	if mode, _, err := s.db.getRespondersMode(ctx, req.RequestID); err == nil && isMultiAnswerMode(mode) {
+		if ok, _ := s.db.isResponder(ctx, req.RequestID, userName); !ok {
+			return out
+		}
+		responder = userName
+	}
+	out = append(out, map[string]any{
+		"type":      "button",
+		"action_id": "open",
+		"text":      map[string]any{"type": "plain_text", "text": "Open page"},
+		"url":       s.slackOpenURL(req.RequestID, responder, req.ExpiresAt),
+	})
+	return out
+}
+
+// slackButtonStyle colors the usual approve and deny buttons.
+func slackButtonStyle(value string) string {
+	switch strings.ToLower(value) {
+	case "approve", "approved", "yes", "ok", "allow", "accept", "confirm":
+		return "primary"
+	case "deny", "denied", "no", "reject", "decline", "block":
+		return "danger"
+	}
+	return ""
+}
+
+// slackOpenURL links to /slack/open, which hands out a fresh interaction
+// link for the request until it expires. The link is signed with the signing
+// secret, so only lists shown in Slack carry it.
+func (s *server) slackOpenURL(requestID, responder string, expiresAt int64) string {
+	q := url.Values{}
+	q.Set("r", requestID)
+	if responder != "" {
+		q.Set("u", responder)
+	}
+	q.Set("e", strconv.FormatInt(expiresAt, 10))
+	q.Set("sig", slackOpenSig(s.cfg().SlackSigningSecret, requestID, responder, expiresAt))
+	return s.cfg().pageBaseURL() + "/slack/open?" + q.Encode()
+}
+
+func slackOpenSig(secret, requestID, responder string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "open:%s:%s:%d", requestID, responder, expiresAt)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *server) handleSlackOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	requestID, responder := q.Get("r"), q.Get("u")
+	expiresAt, _ := strconv.ParseInt(q.Get("e"), 10, 64)
+	want := slackOpenSig(s.cfg().SlackSigningSecret, requestID, responder, expiresAt)
+	if !hmac.Equal([]byte(want), []byte(q.Get("sig"))) {
+		http.Error(w, "invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expiresAt {
+		http.Error(w, "this request has expired", http.StatusGone)
+		return
+	}
+	tokenPlain := genToken()
+	if err := s.db.insertToken(r.Context(), requestID, sha256Hex(tokenPlain), responder, time.Unix(expiresAt, 0)); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, s.makeInteractionURL(requestID, tokenPlain), http.StatusFound)
+}
+
+func slackSection(text string) map[string]any {
+	return map[string]any{
+		"type": "section",
+		"text": map[string]any{"type": "mrkdwn", "text": truncate(text, 3000)},
+	}
+}
+
+// slackEscape escapes the characters Slack's mrkdwn treats as markup.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// slackAPI calls a Slack Web API method with the bot token.
+func (s *server) slackAPI(ctx context.Context, method string, body any) error {
+	token := s.cfg().SlackBotToken
+	if token == "" {
+		return errors.New("slack_bot_token is not set")
+	}
+	return slackPost(ctx, slackAPIBase+method, token, body)
+}
+
+// slackPost posts JSON to the Web API or a response_url. The Web API answers
+// 200 with ok=false on errors; response_urls answer with plain text.
+func slackPost(ctx context.Context, endpoint, token string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("slack: %d %s", resp.StatusCode, truncate(strings.TrimSpace(string(rb)), 200))
+	}
+	var out struct {
+		OK    *bool  `json:"ok"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(rb, &out) == nil && out.OK != nil && !*out.OK {
+		return fmt.Errorf("slack: %s", out.Error)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Hub subscribers and SSE tuning. Publishing never blocks: every subscriber
+// (an SSE stream, a waiting POST /v1/ask) has its own ring buffer that a
+// goroutine drains into the subscriber's channel. When a slow client (a phone
+// on a bad network) lets the ring fill up, the oldest events make room for
+// the new ones, so the latest events, including the one that ends a request,
+// always get through. The gap is marked with an events.dropped event, with
+// the number of events lost, ahead of the events that follow it.
+//
+// On events.dropped the /v1/ask stream resends what was missed from the
+// database and a waiting ask checks the database for the final event; the
+// page stream resends page.state, and firehose consumers can refetch from
+// /v1/requests/{id}/events.
+//
+// The ring holds sse_buffer_size events (64 by default), and an ask can ask
+// for its own with buffer_size, as well as for its own heartbeat_seconds,
+// e.g. shorter for clients behind proxies that cut idle connections early.
+
+const (
+	defaultSSEBufferSize = 64
+	maxSSEBufferSize     = 4096
+	maxHeartbeatSeconds  = 300
+)
+
+func normalizeStreamTuning(ar *askRequest) error {
+	if ar.HeartbeatSeconds < 0 || ar.HeartbeatSeconds > maxHeartbeatSeconds {
+		return badAskError("heartbeat_seconds must be between 1 and 300")
+	}
+	if ar.BufferSize < 0 || ar.BufferSize > maxSSEBufferSize {
+		return badAskError("buffer_size must be between 1 and 4096")
+	}
+	return nil
+}
+
+func (s *store) getStreamTuning(ctx context.Context, reqID string) (heartbeatSeconds, bufferSize int, err error) {
+	var hb, buf sql.NullInt64
+	err = s.db.QueryRowContext(ctx, `SELECT heartbeat_seconds, buffer_size FROM requests WHERE request_id=?`, reqID).Scan(&hb, &buf)
+	return int(hb.Int64), int(buf.Int64), err
+}
+
+// streamTuning returns the heartbeat interval and subscriber buffer for
+// streams of requestID: the ask's own, or else the configured defaults.
+func (s *server) streamTuning(ctx context.Context, requestID string) (time.Duration, int) {
+	hb, buf, _ := s.db.getStreamTuning(ctx, requestID)
+	if hb <= 0 {
+		hb = s.cfg().SSEHeartbeatIntervalSeconds
+	}
+	return time.Duration(hb) * time.Second, buf
+}
+
+// subscriber is one hub subscription: a ring of pending events and the
+// goroutine that hands them to out.
+type subscriber struct {
+	out  chan Event
+	wake chan struct{}
+	done chan struct{}
+	// requestID is set on the events.dropped markers; it is empty for
+	// session and firehose subscriptions.
+	requestID string
+
+	mu      sync.Mutex
+	ring    []Event
+	head, n int
+	dropped int
+	stopped bool
+}
+
+func newSubscriber(size int, key string) *subscriber {
+	sub := &subscriber{
+		out:  make(chan Event),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		ring: make([]Event, size),
+	}
+	if isValidRequestID(key) {
+		sub.requestID = key
+	}
+	go sub.pump()
+	return sub
+}
+
+// push queues ev, dropping the oldest queued event when the ring is full.
+func (sub *subscriber) push(ev Event) {
+	sub.mu.Lock()
+	if sub.stopped {
+		sub.mu.Unlock()
+		return
+	}
+	if sub.n == len(sub.ring) {
+		sub.head = (sub.head + 1) % len(sub.ring)
+		sub.n--
+		sub.dropped++
+	}
+	sub.ring[(sub.head+sub.n)%len(sub.ring)] = ev
+	sub.n++
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next event to hand out: an events.dropped marker if events
+// were lost since the last one, else the oldest queued event.
+func (sub *subscriber) pop() (Event, bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.dropped > 0 {
+		b, _ := json.Marshal(map[string]any{"dropped": sub.dropped})
+		slog.Warn("hub subscriber dropped events", "request_id", sub.requestID, "dropped", sub.dropped)
+		sub.dropped = 0
+		return Event{Type: "events.dropped", RequestID: sub.requestID, Data: json.RawMessage(b)}, true
+	}
+	if sub.n == 0 {
+		return Event{}, false
+	}
+	ev := sub.ring[sub.head]
+	sub.ring[sub.head] = Event{}
+	sub.head = (sub.head + 1) % len(sub.ring)
+	sub.n--
+	return ev, true
+}
+
+func (sub *subscriber) pump() {
+	defer close(sub.out)
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-sub.wake:
+		}
+		for {
+			ev, ok := sub.pop()
+			if !ok {
+				break
+			}
+			select {
+			case sub.out <- ev:
+			case <-sub.done:
+				return
+			}
+		}
+	}
+}
+
+func (sub *subscriber) stop() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.stopped {
+		sub.stopped = true
+		close(sub.done)
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /v1/stats summarises the requests created in the last `days` days
+// (default 30, counted in whole days in `tz`, default the server's zone), of
+// one `tenant` if given (tenant keys always get their own):
+// counts by status and by day, deliveries by channel, time to the first
+// answer (median, p90 and a histogram) and the expiry rate, i.e. the share
+// of finished requests that expired. The answer times and expiry rate are
+// also broken down by the channels that reached each request and by its
+// tags, to show which channels get answered and which kinds of ask need a
+// longer expiry. metrics.go serves the same numbers to Prometheus.
+//
+// With stats_report_cron set, the same summary for the last
+// stats_report_days days (default 7) is pushed to the default notification
+// channel on that schedule. The next run is kept in the reports table so
+// that only one instance sends it and a restart does not repeat it.
+
+const (
+	defaultStatsDays       = 30
+	maxStatsDays           = 366
+	defaultStatsReportDays = 7
+	statsReportName        = "summary"
+)
+
+func (c *Config) normalizeStatsReport() error {
+	c.StatsReportCron = strings.TrimSpace(c.StatsReportCron)
+	c.StatsReportTimezone = strings.TrimSpace(c.StatsReportTimezone)
+	if c.StatsReportCron != "" {
+		spec, err := parseCron(c.StatsReportCron)
+		if err != nil {
+			return fmt.Errorf("invalid stats_report_cron: %w", err)
+		}
+		if spec.next(time.Now()).IsZero() {
+			return errors.New("stats_report_cron never fires")
+		}
+	}
+	if c.StatsReportTimezone != "" {
+		if _, err := time.LoadLocation(c.StatsReportTimezone); err != nil {
+			return fmt.Errorf("invalid stats_report_timezone %q", c.StatsReportTimezone)
+		}
+	}
+	if c.StatsReportDays <= 0 {
+		c.StatsReportDays = defaultStatsReportDays
+	}
+	c.StatsReportDays = min(c.StatsReportDays, maxStatsDays)
+	return nil
+}
+
+type dayStats struct {
+	Date     string `json:"date"`
+	Created  int    `json:"created"`
+	Answered int    `json:"answered"`
+	Expired  int    `json:"expired"`
+}
+
+// answerBuckets are the upper bounds, in seconds, of the time to answer
+// histograms: a minute, 5, 15 and 30 minutes, an hour, 4 hours and a day.
+var answerBuckets = []int64{60, 300, 900, 1800, 3600, 14400, 86400}
+
+// outcomeStats tallies how a group of requests went: all of them, the ones
+// sent through one channel or the ones with one tag.
+type outcomeStats struct {
+	Requests int
+	Answered int
+	Finished int
+	Expired  int
+	waits    []int64
+}
+
+func (o *outcomeStats) add(r *statsRequest) {
+	o.Requests++
+	if r.answered {
+		o.Answered++
+		o.waits = append(o.waits, r.wait)
+	}
+	if isTerminalStatus(r.status) {
+		o.Finished++
+	}
+	if r.status == "expired" {
+		o.Expired++
+	}
+}
+
+// quantiles returns the median and p90 time to answer, or nils when
+// nothing was answered.
+func (o *outcomeStats) quantiles() (median, p90 *int64) {
+	waits := o.waits
+	if len(waits) == 0 {
+		return nil, nil
+	}
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	m := waits[len(waits)/2]
+	if len(waits)%2 == 0 {
+		m = (waits[len(waits)/2-1] + m) / 2
+	}
+	p := waits[(len(waits)*9+9)/10-1]
+	return &m, &p
+}
+
+// expiryRate is the share of finished requests that expired, or nil when
+// none finished.
+func (o *outcomeStats) expiryRate() *float64 {
+	if o.Finished == 0 {
+		return nil
+	}
+	rate := float64(o.Expired) / float64(o.Finished)
+	return &rate
+}
+
+// histogram returns how many answers came within each of answerBuckets,
+// cumulatively, and the sum of all waits.
+func (o *outcomeStats) histogram() (counts []int, sum int64) {
+	counts = make([]int, len(answerBuckets))
+	for _, w := range o.waits {
+		sum += w
+		for i, le := range answerBuckets {
+			if w <= le {
+				counts[i]++
+			}
+		}
+	}
+	return counts, sum
+}
+
+func (o *outcomeStats) view() map[string]any {
+	median, p90 := o.quantiles()
+	counts, _ := o.histogram()
+	hist := make([]map[string]any, 0, len(counts)+1)
+	for i, n := range counts {
+		hist = append(hist, map[string]any{"le": strconv.FormatInt(answerBuckets[i], 10), "count": n})
+	}
+	hist = append(hist, map[string]any{"le": "+Inf", "count": o.Answered})
+	return map[string]any{
+		"requests":    o.Requests,
+		"expired":     o.Expired,
+		"expiry_rate": o.expiryRate(),
+		"time_to_answer": map[string]any{
+			"answered":       o.Answered,
+			"median_seconds": median,
+			"p90_seconds":    p90,
+			"histogram":      hist,
+		},
+	}
+}
+
+// channelStats counts the notifications sent through a channel and how the
+// requests they were for went.
+type channelStats struct {
+	Sent   int
+	Failed int
+	outcomeStats
+}
+
+// statsRequest is one request of the stats window.
+type statsRequest struct {
+	status   string
+	answered bool
+	wait     int64
+	channels []string
+}
+
+type requestStats struct {
+	From      time.Time
+	To        time.Time
+	Location  *time.Location
+	Total     int
+	ByStatus  map[string]int
+	ByDay     []dayStats
+	ByChannel map[string]*channelStats
+	ByTag     map[string]*outcomeStats
+	All       outcomeStats
+}
+
+// statsWindow returns the start of the day days-1 days before now, in loc.
+func statsWindow(now time.Time, days int, loc *time.Location) time.Time {
+	y, m, d := now.In(loc).Date()
+	return time.Date(y, m, d-(days-1), 0, 0, 0, 0, loc)
+}
+
+// requestStats summarises the requests of the last days days; a tenant
+// limits it to that tenant's.
+func (s *store) requestStats(ctx context.Context, days int, loc *time.Location, tenant string) (requestStats, error) {
+	return s.requestStatsSince(ctx, statsWindow(time.Now(), days, loc), loc, tenant)
+}
+
+// requestStatsSince summarises the requests created since from.
+func (s *store) requestStatsSince(ctx context.Context, from time.Time, loc *time.Location, tenant string) (requestStats, error) {
+	now := time.Now()
+	st := requestStats{
+		From:      from,
+		To:        now,
+		Location:  loc,
+		ByStatus:  map[string]int{},
+		ByChannel: map[string]*channelStats{},
+		ByTag:     map[string]*outcomeStats{},
+	}
+	byDay := map[string]*dayStats{}
+	y, m, d := from.In(loc).Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, loc); !day.After(now); day = day.AddDate(0, 0, 1) {
+		st.ByDay = append(st.ByDay, dayStats{Date: day.Format(time.DateOnly)})
+	}
+	for i := range st.ByDay {
+		byDay[st.ByDay[i].Date] = &st.ByDay[i]
+	}
+
+	tenantWhere, args := "", []any{from.Unix()}
+	if tenant != "" {
+		tenantWhere = " AND r.tenant = ?"
+		args = append(args, tenant)
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT r.request_id, r.status, r.created_at, fa.answered_at FROM requests r
+		 LEFT JOIN (SELECT request_id, MIN(created_at) AS answered_at FROM answers GROUP BY request_id) fa
+		 ON fa.request_id = r.request_id
+		 WHERE r.created_at >= ?`+tenantWhere,
+		args...,
+	)
+	if err != nil {
+		return requestStats{}, err
+	}
+	reqs := map[string]*statsRequest{}
+	for rows.Next() {
+		var id string
+		var createdAt int64
+		var answeredAt sql.NullInt64
+		r := &statsRequest{}
+		if err := rows.Scan(&id, &r.status, &createdAt, &answeredAt); err != nil {
+			rows.Close()
+			return requestStats{}, err
+		}
+		reqs[id] = r
+		st.Total++
+		st.ByStatus[r.status]++
+		day := byDay[time.Unix(createdAt, 0).In(loc).Format(time.DateOnly)]
+		if day != nil {
+			day.Created++
+		}
+		if answeredAt.Valid {
+			r.answered, r.wait = true, max(answeredAt.Int64-createdAt, 0)
+			if day != nil {
+				day.Answered++
+			}
+		}
+		if r.status == "expired" && day != nil {
+			day.Expired++
+		}
+		st.All.add(r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return requestStats{}, err
+	}
+
+	tagRows, err := s.db.QueryContext(ctx,
+		`SELECT t.request_id, t.tag FROM request_tags t JOIN requests r ON r.request_id = t.request_id
+		 WHERE r.created_at >= ?`+tenantWhere,
+		args...,
+	)
+	if err != nil {
+		return requestStats{}, err
+	}
+	for tagRows.Next() {
+		var id, tag string
+		if err := tagRows.Scan(&id, &tag); err != nil {
+			tagRows.Close()
+			return requestStats{}, err
+		}
+		r := reqs[id]
+		if r == nil {
+			continue
+		}
+		t := st.ByTag[tag]
+		if t == nil {
+			t = &outcomeStats{}
+			st.ByTag[tag] = t
+		}
+		t.add(r)
+	}
+	tagRows.Close()
+	if err := tagRows.Err(); err != nil {
+		return requestStats{}, err
+	}
+
+	evQuery := `SELECT request_id, type, payload_json, payload_encoding FROM events WHERE type IN ('notify.sent','notify.failed') AND created_at >= ?`
+	if tenant != "" {
+		evQuery = `SELECT e.request_id, e.type, e.payload_json, e.payload_encoding FROM events e JOIN requests r ON r.request_id = e.request_id
+		 WHERE e.type IN ('notify.sent','notify.failed') AND e.created_at >= ?` + tenantWhere
+	}
+	evRows, err := s.db.QueryContext(ctx, evQuery, args...)
+	if err != nil {
+		return requestStats{}, err
+	}
+	defer evRows.Close()
+	for evRows.Next() {
+		var id, typ, payload string
+		var encoding sql.NullString
+		if err := evRows.Scan(&id, &typ, &payload, &encoding); err != nil {
+			return requestStats{}, err
+		}
+		var data struct {
+			Channel string `json:"channel"`
+		}
+		_ = json.Unmarshal(decodeEventPayload(payload, encoding), &data)
+		if data.Channel == "" {
+			data.Channel = "unknown"
+		}
+		c := st.ByChannel[data.Channel]
+		if c == nil {
+			c = &channelStats{}
+			st.ByChannel[data.Channel] = c
+		}
+		if typ != "notify.sent" {
+			c.Failed++
+			continue
+		}
+		c.Sent++
+		// A request counts once for each channel that reached it, however
+		// many notifications (reminders, steps) went out there.
+		if r := reqs[id]; r != nil && !slices.Contains(r.channels, data.Channel) {
+			r.channels = append(r.channels, data.Channel)
+			c.add(r)
+		}
+	}
+	return st, evRows.Err()
+}
+
+func (st requestStats) view() map[string]any {
+	byChannel := make(map[string]any, len(st.ByChannel))
+	for name, c := range st.ByChannel {
+		v := c.view()
+		v["sent"], v["failed"] = c.Sent, c.Failed
+		byChannel[name] = v
+	}
+	byTag := make(map[string]any, len(st.ByTag))
+	for tag, t := range st.ByTag {
+		byTag[tag] = t.view()
+	}
+	all := st.All.view()
+	return map[string]any{
+		"from":     st.From.UTC().Format(time.RFC3339),
+		"to":       st.To.UTC().Format(time.RFC3339),
+		"timezone": st.Location.String(),
+		"requests": map[string]any{
+			"total":     st.Total,
+			"by_status": st.ByStatus,
+		},
+		"by_day":         st.ByDay,
+		"by_channel":     byChannel,
+		"by_tag":         byTag,
+		"time_to_answer": all["time_to_answer"],
+		"expiry_rate":    all["expiry_rate"],
+	}
+}
+
+func formatSeconds(secs int64) string {
+	return (time.Duration(secs) * time.Second).String()
+}
+
+// summary renders st as the body of a report notification.
+func (st requestStats) summary(days int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Last %d days: %d asks, %d answered", days, st.Total, st.All.Answered)
+	if n := st.ByStatus["expired"]; n > 0 {
+		fmt.Fprintf(&b, ", %d expired", n)
+	}
+	if n := st.ByStatus["cancelled"]; n > 0 {
+		fmt.Fprintf(&b, ", %d cancelled", n)
+	}
+	if n := st.ByStatus["notify_failed"]; n > 0 {
+		fmt.Fprintf(&b, ", %d not delivered", n)
+	}
+	b.WriteString(".")
+	if median, p90 := st.All.quantiles(); median != nil {
+		fmt.Fprintf(&b, "\n\nTime to answer: median %s, p90 %s.", formatSeconds(*median), formatSeconds(*p90))
+	}
+	if rate := st.All.expiryRate(); rate != nil {
+		fmt.Fprintf(&b, "\n\nExpiry rate: %.0f%% of finished asks.", *rate*100)
+	}
+	if len(st.ByChannel) > 0 {
+		names := make([]string, 0, len(st.ByChannel))
+		for name := range st.ByChannel {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString("\n\nNotifications:")
+		for _, name := range names {
+			c := st.ByChannel[name]
+			fmt.Fprintf(&b, "\n- %s: %d sent, %d failed", name, c.Sent, c.Failed)
+		}
+	}
+	return b.String()
+}
+
+// statsQuery reads the days and tenant of a stats call; tenant keys always
+// get their own tenant.
+func statsQuery(r *http.Request) (days int, tenant string, err error) {
+	q := r.URL.Query()
+	days = defaultStatsDays
+	if v := q.Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxStatsDays {
+			return 0, "", fmt.Errorf("days must be 1-%d", maxStatsDays)
+		}
+		days = n
+	}
+	tenant = strings.ToLower(strings.TrimSpace(q.Get("tenant")))
+	if own := keyTenant(r.Context()); own != "" {
+		tenant = own
+	}
+	return days, tenant, nil
+}
+
+// handleStats serves GET /v1/stats?days=&tz=.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	days, tenant, err := statsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	loc := time.Local
+	if tz := strings.TrimSpace(r.URL.Query().Get("tz")); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			http.Error(w, "invalid tz", http.StatusBadRequest)
+			return
+		}
+		loc = l
+	}
+	st, err := s.db.requestStats(r.Context(), days, loc, tenant)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := st.view()
+	out["days"] = days
+	if tenant != "" {
+		out["tenant"] = tenant
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// reportState reads the stored schedule of a report; ok=false means none.
+func (s *store) reportState(ctx context.Context, name string) (cronExpr string, nextRunAt int64, ok bool, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT cron, next_run_at FROM reports WHERE name=?`, name).Scan(&cronExpr, &nextRunAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, false, nil
+	}
+	return cronExpr, nextRunAt, err == nil, err
+}
+
+// scheduleReport (re)sets the next run of a report after its cron changed.
+func (s *store) scheduleReport(ctx context.Context, name, cronExpr string, next int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE reports SET cron=?, next_run_at=? WHERE name=?`, cronExpr, next, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO reports(name,cron,next_run_at,last_run_at) VALUES(?,?,?,0)`, name, cronExpr, next)
+	if err != nil && !isUniqueViolation(err) {
+		return err
+	}
+	return nil
+}
+
+// claimReportRun moves next_run_at forward; ok=false means another instance
+// already claimed this run.
+func (s *store) claimReportRun(ctx context.Context, name string, due, next int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE reports SET next_run_at=?, last_run_at=? WHERE name=? AND next_run_at=?`,
+		next, time.Now().Unix(), name, due,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (c *Config) statsReportLocation() *time.Location {
+	if c.StatsReportTimezone != "" {
+		if l, err := time.LoadLocation(c.StatsReportTimezone); err == nil {
+			return l
+		}
+	}
+	return time.Local
+}
+
+// runStatsReport sends the summary report when it is due. It runs on the
+// recurring schedule tick.
+func (s *server) runStatsReport(ctx context.Context) {
+	cfg := s.cfg()
+	if cfg.StatsReportCron == "" {
+		return
+	}
+	spec, err := parseCron(cfg.StatsReportCron)
+	if err != nil {
+		return
+	}
+	loc := cfg.statsReportLocation()
+	now := time.Now()
+	nextAfter := func(t time.Time) int64 { return spec.next(t.In(loc)).Unix() }
+
+	stored, due, ok, err := s.db.reportState(ctx, statsReportName)
+	if err != nil {
+		slog.Error("stats report", "error", err)
+		return
+	}
+	if !ok || stored != cfg.StatsReportCron {
+		if err := s.db.scheduleReport(ctx, statsReportName, cfg.StatsReportCron, nextAfter(now)); err != nil {
+			slog.Error("stats report", "error", err)
+		}
+		return
+	}
+	if due > now.Unix() {
+		return
+	}
+	if claimed, err := s.db.claimReportRun(ctx, statsReportName, due, nextAfter(now)); err != nil || !claimed {
+		return
+	}
+	st, err := s.db.requestStats(ctx, cfg.StatsReportDays, loc, "")
+	if err != nil {
+		slog.Error("stats report", "error", err)
+		return
+	}
+	ar := askRequest{Title: "Ask4Me summary", Body: st.summary(cfg.StatsReportDays)}
+	if _, err := s.deliverNotification(ctx, s.defaultNotifyTarget(), ar, ""); err != nil {
+		slog.Warn("stats report: notification failed", "error", err)
+		return
+	}
+	slog.Info("stats report sent", "days", cfg.StatsReportDays)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxSteps = 20
+
+// askStep is one page of a multi-step (wizard) ask. Title and Body default to
+// the request's own title and body.
+type askStep struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	MCD   string `json:"mcd"`
+}
+
+type stepAnswer struct {
+	Step        int
+	Action      string
+	Text        string
+	PayloadJSON sql.NullString
+	CreatedAt   int64
+}
+
+func normalizeSteps(ar *askRequest) error {
+	if len(ar.Steps) == 0 {
+		return nil
+	}
+	if len(ar.Steps) > maxSteps {
+		return badAskError(fmt.Sprintf("steps must have <= %d entries", maxSteps))
+	}
+	if ar.JsonForms != nil && len(strings.TrimSpace(string(ar.JsonForms.Schema))) > 0 {
+		return badAskError("steps cannot be combined with jsonforms")
+	}
+	if ar.Responders != nil {
+		return badAskError("steps cannot be combined with responders")
+	}
+	for i := range ar.Steps {
+		ar.Steps[i].Title = strings.TrimSpace(ar.Steps[i].Title)
+		ar.Steps[i].Body = strings.TrimSpace(ar.Steps[i].Body)
+		ar.Steps[i].MCD = strings.TrimSpace(ar.Steps[i].MCD)
+		if ar.Steps[i].MCD == "" {
+			ar.Steps[i].MCD = ":::buttons\n- [OK](ok)\n:::"
+		}
+	}
+	// The first step doubles as the request's MCD so notifications (and
+	// ServerChan action links) describe what the responder sees first.
+	ar.MCD = ar.Steps[0].MCD
+	return nil
+}
+
+// submitStep records the answer to the current step of a wizard request.
+// stepField is the step index posted by the page (empty when unknown, e.g.
+// action links). When the last step is answered it returns the combined
+// user.submitted payload and final=true. ok=false means the submission was
+// stale or a duplicate.
+func (s *server) submitStep(ctx context.Context, requestID string, steps []askStep, current int, stepField, action, text string, payloadJSON sql.NullString, payload any) (combined map[string]any, final bool, ok bool, err error) {
+	if v := strings.TrimSpace(stepField); v != "" {
+		n, convErr := strconv.Atoi(v)
+		if convErr != nil || n != current {
+			return nil, false, false, nil
+		}
+	}
+	if current < 0 || current >= len(steps) {
+		return nil, false, false, nil
+	}
+	if err := s.db.insertStepAnswer(ctx, requestID, current, action, text, payloadJSON); err != nil {
+		if isUniqueViolation(err) {
+			return nil, false, false, nil
+		}
+		return nil, false, false, err
+	}
+
+	evData := map[string]any{
+		"step":   current,
+		"steps":  len(steps),
+		"action": action,
+		"text":   text,
+	}
+	if payloadJSON.Valid {
+		evData["payload"] = payload
+	}
+	if steps[current].Title != "" {
+		evData["title"] = steps[current].Title
+	}
+	ev := s.mustNewEvent(ctx, requestID, "user.step_submitted", evData)
+	_ = s.persistTerminalAware(ctx, ev)
+
+	if current < len(steps)-1 {
+		if _, err := s.db.advanceStep(ctx, requestID, current); err != nil {
+			return nil, false, true, err
+		}
+		_ = s.db.deleteDrafts(ctx, requestID)
+		return nil, false, true, nil
+	}
+
+	answers, err := s.db.listStepAnswers(ctx, requestID)
+	if err != nil {
+		return nil, false, true, err
+	}
+	stepsData := make([]map[string]any, 0, len(answers))
+	for _, a := range answers {
+		d := map[string]any{
+			"step":   a.Step,
+			"action": a.Action,
+			"text":   a.Text,
+		}
+		if a.Step < len(steps) && steps[a.Step].Title != "" {
+			d["title"] = steps[a.Step].Title
+		}
+		if a.PayloadJSON.Valid {
+			d["payload"] = json.RawMessage(a.PayloadJSON.String)
+		}
+		stepsData = append(stepsData, d)
+	}
+	combined = map[string]any{
+		"action": action,
+		"text":   text,
+		"steps":  stepsData,
+	}
+	if payloadJSON.Valid {
+		combined["payload"] = payload
+	}
+	return combined, true, true, nil
+}
+
+// getSteps returns the wizard steps of a request (nil for plain asks) and the
+// index of the step currently shown to the responder.
+func (s *store) getSteps(ctx context.Context, reqID string) ([]askStep, int, error) {
+	var raw sql.NullString
+	var current sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT steps_json, current_step FROM requests WHERE request_id=?`, reqID).Scan(&raw, &current); err != nil {
+		return nil, 0, err
+	}
+	if !raw.Valid || strings.TrimSpace(raw.String) == "" {
+		return nil, 0, nil
+	}
+	var steps []askStep
+	if err := json.Unmarshal([]byte(raw.String), &steps); err != nil {
+		return nil, 0, err
+	}
+	return steps, int(current.Int64), nil
+}
+
+func (s *store) advanceStep(ctx context.Context, reqID string, from int) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE requests SET current_step=?, updated_at=? WHERE request_id=? AND current_step=?`,
+		from+1, time.Now().Unix(), reqID, from,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *store) insertStepAnswer(ctx context.Context, reqID string, step int, action, text string, payloadJSON sql.NullString) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO step_answers(request_id,step,action,text,payload_json,created_at) VALUES(?,?,?,?,?,?)`,
+		reqID, step, nullIfEmpty(action), nullIfEmpty(text), payloadJSON, time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *store) listStepAnswers(ctx context.Context, reqID string) ([]stepAnswer, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT step, action, text, payload_json, created_at FROM step_answers WHERE request_id=? ORDER BY step ASC`,
+		reqID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []stepAnswer
+	for rows.Next() {
+		var a stepAnswer
+		var action, text sql.NullString
+		if err := rows.Scan(&a.Step, &action, &text, &a.PayloadJSON, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.Action = action.String
+		a.Text = text.String
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Ask tags. tags label an ask with what it is about ("deploy", "billing"),
+// so that GET /v1/stats and /metrics can tell how fast each kind of ask is
+// answered and how often it expires. Tags are lowercased; an ask has at
+// most maxAskTags of them.
+
+const (
+	maxAskTags = 10
+	maxTagLen  = 64
+)
+
+var reTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+func normalizeTags(ar *askRequest) error {
+	if len(ar.Tags) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(ar.Tags))
+	for _, t := range ar.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if len(t) > maxTagLen || !reTag.MatchString(t) {
+			return badAskError("tags: " + truncate(t, maxTagLen) + " is not a tag (letters, digits, '.', '_' and '-')")
+		}
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxAskTags {
+		return badAskError("tags: at most 10 tags")
+	}
+	ar.Tags = out
+	return nil
+}
+
+// requestTags returns the tags of reqID in alphabetical order.
+func (s *store) requestTags(ctx context.Context, reqID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT tag FROM request_tags WHERE request_id=? ORDER BY tag`, reqID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telegram. Notifications can already go to Telegram through apprise
+// (tgram://); with telegram_bot_token set the bot also takes answers. Send
+// /pending to get each waiting ask as a message with its buttons, press one
+// to answer, or reply to the message (or to the apprise notification, which
+// carries the link) with text to answer an ask that has an input. JSON Forms
+// and multi-step asks link to their page.
+//
+// Answers take the same path as the page, with "via":"telegram" and the
+// Telegram username as responder, so whichever of the page and the bot
+// answers second is told the ask was already answered. Updates Telegram
+// resends are recognised by update_id and handled once.
+//
+// At start the server registers public_base_url (or base_url) +
+// /telegram/webhook as the bot's webhook, with a secret derived from the
+// token that every update must carry. Only the chats in
+// telegram_allowed_chats may answer; the bot tells any other chat its ID so
+// it can be added.
+
+const (
+	telegramAPIBase     = "https://api.telegram.org/bot"
+	telegramTimeout     = 10 * time.Second
+	telegramListLimit   = 10
+	telegramSeenUpdates = 1024
+)
+
+var telegramClient = &http.Client{Timeout: telegramTimeout}
+
+// reRequestID finds a request ID in a message, e.g. in an interaction URL.
+var reRequestID = regexp.MustCompile(`req_[a-z0-9]+`)
+
+func (c *Config) normalizeTelegram() {
+	c.TelegramBotToken = strings.TrimSpace(c.TelegramBotToken)
+	chats := c.TelegramAllowedChats[:0]
+	for _, id := range c.TelegramAllowedChats {
+		if id = strings.TrimSpace(id); id != "" {
+			chats = append(chats, id)
+		}
+	}
+	c.TelegramAllowedChats = chats
+}
+
+func (c Config) telegramAllowed(chatID int64) bool {
+	id := strconv.FormatInt(chatID, 10)
+	for _, v := range c.TelegramAllowedChats {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// telegramSecret is the webhook secret for token.
+func telegramSecret(token string) string {
+	sum := sha256.Sum256([]byte("ask4me-telegram:" + token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// telegramUpdates remembers recent update IDs so resent updates are skipped.
+type telegramUpdates struct {
+	mu   sync.Mutex
+	seen map[int64]struct{}
+	fifo []int64
+}
+
+func (t *telegramUpdates) first(id int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen == nil {
+		t.seen = map[int64]struct{}{}
+	}
+	if _, ok := t.seen[id]; ok {
+		return false
+	}
+	t.seen[id] = struct{}{}
+	t.fifo = append(t.fifo, id)
+	if len(t.fifo) > telegramSeenUpdates {
+		delete(t.seen, t.fifo[0])
+		t.fifo = t.fifo[1:]
+	}
+	return true
+}
+
+// telegramSetup registers the webhook. It runs once at start.
+func (s *server) telegramSetup(ctx context.Context) {
+	cfg := s.cfg()
+	if cfg.TelegramBotToken == "" {
+		return
+	}
+	err := s.telegramCall(ctx, "setWebhook", map[string]any{
+		"url":             cfg.pageBaseURL() + "/telegram/webhook",
+		"secret_token":    telegramSecret(cfg.TelegramBotToken),
+		"allowed_updates": []string{"message", "callback_query"},
+	}, nil)
+	if err == nil {
+		err = s.telegramCall(ctx, "setMyCommands", map[string]any{
+			"commands": []map[string]string{
+				{"command": "pending", "description": "List the requests waiting for an answer"},
+				{"command": "help", "description": "How to answer"},
+			},
+		}, nil)
+	}
+	if err != nil {
+		slog.Warn("telegram: webhook setup", "error", err)
+		return
+	}
+	slog.Info("telegram: webhook registered")
+}
+
+type telegramUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type telegramMessage struct {
+	MessageID int64         `json:"message_id"`
+	From      *telegramUser `json:"from"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text           string           `json:"text"`
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+}
+
+type telegramUpdate struct {
+	UpdateID      int64            `json:"update_id"`
+	Message       *telegramMessage `json:"message"`
+	CallbackQuery *struct {
+		ID      string           `json:"id"`
+		From    telegramUser     `json:"from"`
+		Message *telegramMessage `json:"message"`
+		Data    string           `json:"data"`
+	} `json:"callback_query"`
+}
+
+// handleTelegram serves POST /telegram/webhook.
+func (s *server) handleTelegram(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg()
+	if cfg.TelegramBotToken == "" || r.URL.Path != "/telegram/webhook" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(telegramSecret(cfg.TelegramBotToken))) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var u telegramUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&u); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if !s.telegram.first(u.UpdateID) {
+		return
+	}
+	// Telegram waits for the reply before sending the next update, so the
+	// bot's own calls are made after answering it.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*telegramTimeout)
+		defer cancel()
+		switch {
+		case u.CallbackQuery != nil:
+			s.telegramButton(ctx, u.CallbackQuery.ID, u.CallbackQuery.From, u.CallbackQuery.Message, u.CallbackQuery.Data)
+		case u.Message != nil:
+			s.telegramText(ctx, u.Message)
+		}
+	}()
+}
+
+func (s *server) telegramText(ctx context.Context, m *telegramMessage) {
+	chatID := m.Chat.ID
+	if !s.cfg().telegramAllowed(chatID) {
+		s.telegramSend(ctx, chatID, fmt.Sprintf("This chat (ID %d) may not answer requests. Add the ID to telegram_allowed_chats.", chatID), nil)
+		return
+	}
+	cmd := ""
+	if f := strings.Fields(m.Text); len(f) > 0 {
+		cmd, _, _ = strings.Cut(f[0], "@")
+	}
+	switch {
+	case cmd == "/pending":
+		s.telegramPending(ctx, chatID)
+	case m.ReplyToMessage != nil:
+		s.telegramReply(ctx, m)
+	default:
+		s.telegramSend(ctx, chatID, "Send /pending to list the requests waiting for an answer. Press a button to answer, or reply to a request's message with text.", nil)
+	}
+}
+
+// telegramPending sends each pending ask as its own message.
+func (s *server) telegramPending(ctx context.Context, chatID int64) {
+	list, err := s.db.pendingRequests(ctx, telegramListLimit)
+	if err != nil {
+		s.telegramSend(ctx, chatID, "Could not load the requests.", nil)
+		return
+	}
+	if len(list) == 0 {
+		s.telegramSend(ctx, chatID, "Nothing is waiting for an answer.", nil)
+		return
+	}
+	for _, req := range list {
+		text, keyboard := s.telegramAsk(ctx, req)
+		s.telegramSend(ctx, chatID, text, keyboard)
+	}
+}
+
+// telegramAsk renders one ask: its text, ending with the request ID that
+// replies are matched by, and its buttons.
+func (s *server) telegramAsk(ctx context.Context, req requestSummary) (string, [][]map[string]string) {
+	var b strings.Builder
+	b.WriteString(req.Title)
+	if body := strings.TrimSpace(req.Body); body != "" {
+		b.WriteString("\n\n" + truncate(body, 3000))
+	}
+	b.WriteString("\n\nExpires " + time.Unix(req.ExpiresAt, 0).UTC().Format("2006-01-02 15:04 UTC"))
+	if req.Priority != "" && req.Priority != priorityNormal {
+		b.WriteString(" · " + req.Priority)
+	}
+	var keyboard [][]map[string]string
+	var row []map[string]string
+	form, _ := s.db.getRequestForm(ctx, req.RequestID)
+	_, jsonForms := form["jsonforms_schema"]
+	_, steps := form["steps"]
+	if mcd, _ := form["mcd"].(string); !jsonForms && !steps {
+		spec := parseMCD(mcd)
+		for i, btn := range spec.Buttons {
+			row = append(row, map[string]string{"text": btn.Label, "callback_data": "a:" + req.RequestID + ":" + strconv.Itoa(i)})
+			if len(row) == 3 {
+				keyboard, row = append(keyboard, row), nil
+			}
+		}
+		if spec.Input != nil {
+			b.WriteString("\nReply to this message to answer: " + spec.Input.Label)
+		}
+	}
+	if len(row) > 0 {
+		keyboard = append(keyboard, row)
+	}
+	mode, _, _ := s.db.getRespondersMode(ctx, req.RequestID)
+	if !isMultiAnswerMode(mode) {
+		tokenPlain := genToken()
+		if err := s.db.insertToken(ctx, req.RequestID, sha256Hex(tokenPlain), "", time.Unix(req.ExpiresAt, 0)); err == nil {
+			link := s.makeInteractionURL(req.RequestID, tokenPlain)
+			if strings.HasPrefix(link, "https://") {
+				keyboard = append(keyboard, []map[string]string{{"text": "Open page", "url": link}})
+			} else {
+				b.WriteString("\n" + link)
+			}
+		}
+	}
+	b.WriteString("\nID: " + req.RequestID)
+	return b.String(), keyboard
+}
+
+// telegramButton answers an ask from an inline button.
+func (s *server) telegramButton(ctx context.Context, queryID string, from telegramUser, m *telegramMessage, data string) {
+	reply := func(text string) {
+		_ = s.telegramCall(ctx, "answerCallbackQuery", map[string]any{"callback_query_id": queryID, "text": text}, nil)
+	}
+	if m == nil || !s.cfg().telegramAllowed(m.Chat.ID) {
+		reply("This chat may not answer requests.")
+		return
+	}
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 || parts[0] != "a" || !isValidRequestID(parts[1]) {
+		reply("Unknown button.")
+		return
+	}
+	requestID := parts[1]
+	i, _ := strconv.Atoi(parts[2])
+	form, err := s.db.getRequestForm(ctx, requestID)
+	if err != nil {
+		reply("That request no longer exists.")
+		return
+	}
+	mcd, _ := form["mcd"].(string)
+	buttons := parseMCD(mcd).Buttons
+	if i < 0 || i >= len(buttons) {
+		reply("Unknown button.")
+		return
+	}
+	err = s.answerRemote(ctx, requestID, remoteAnswer{Action: buttons[i].Value, Responder: from.Username, Via: "telegram"})
+	note := telegramAnswerNote(err)
+	reply(note)
+	if err == nil || errors.Is(err, errAnswerTaken) || errors.Is(err, errAnswerNotOpen) {
+		text := m.Text + "\n\n" + note
+		if err == nil {
+			text = m.Text + "\n\n✅ " + buttons[i].Label
+			if from.Username != "" {
+				text += " (@" + from.Username + ")"
+			}
+		}
+		_ = s.telegramCall(ctx, "editMessageText", map[string]any{
+			"chat_id":    m.Chat.ID,
+			"message_id": m.MessageID,
+			"text":       text,
+		}, nil)
+	}
+}
+
+// telegramReply answers the ask a message replies to with the message text.
+func (s *server) telegramReply(ctx context.Context, m *telegramMessage) {
+	requestID := reRequestID.FindString(m.ReplyToMessage.Text)
+	if requestID == "" {
+		s.telegramSend(ctx, m.Chat.ID, "Reply to a request's message to answer it.", nil)
+		return
+	}
+	form, err := s.db.getRequestForm(ctx, requestID)
+	if err != nil {
+		s.telegramSend(ctx, m.Chat.ID, "That request no longer exists.", nil)
+		return
+	}
+	_, jsonForms := form["jsonforms_schema"]
+	mcd, _ := form["mcd"].(string)
+	if jsonForms || parseMCD(mcd).Input == nil {
+		s.telegramSend(ctx, m.Chat.ID, "This request does not take a text answer; use its buttons or its page.", nil)
+		return
+	}
+	responder := ""
+	if m.From != nil {
+		responder = m.From.Username
+	}
+	err = s.answerRemote(ctx, requestID, remoteAnswer{Text: m.Text, Responder: responder, Via: "telegram"})
+	s.telegramSend(ctx, m.Chat.ID, telegramAnswerNote(err), nil)
+}
+
+func telegramAnswerNote(err error) string {
+	switch {
+	case err == nil:
+		return "Answered."
+	case errors.Is(err, errAnswerTaken), errors.Is(err, errAnswerNotOpen):
+		return "Already answered or closed."
+	case errors.Is(err, errAnswerNotFound):
+		return "That request no longer exists."
+	case errors.Is(err, errAnswerInvalid):
+		return strings.TrimPrefix(err.Error(), errAnswerInvalid.Error()+": ")
+	}
+	slog.Warn("telegram: answer", "error", err)
+	return "Could not record the answer, try again."
+}
+
+func (s *server) telegramSend(ctx context.Context, chatID int64, text string, keyboard [][]map[string]string) {
+	msg := map[string]any{"chat_id": chatID, "text": text}
+	if len(keyboard) > 0 {
+		msg["reply_markup"] = map[string]any{"inline_keyboard": keyboard}
+	}
+	if err := s.telegramCall(ctx, "sendMessage", msg, nil); err != nil {
+		slog.Warn("telegram: send", "chat_id", chatID, "error", err)
+	}
+}
+
+// telegramCall calls a Bot API method and decodes its result into out.
+func (s *server) telegramCall(ctx context.Context, method string, body, out any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPIBase+s.cfg().TelegramBotToken+"/"+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		// The URL carries the token; keep it out of logs.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return fmt.Errorf("%s: %d", method, resp.StatusCode)
+	}
+	if !res.OK {
+		return fmt.Errorf("%s: %s", method, res.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(res.Result, out)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ask templates are named, stored ask payloads whose text fields may contain
+// {{variable}} placeholders. /v1/ask?template=<name>&vars=... instantiates
+// one; any field the caller sets overrides the template's.
+
+var templatePlaceholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+type askTemplate struct {
+	Name        string
+	Description string
+	AskJSON     string
+	CreatedAt   int64
+	UpdatedAt   int64
+}
+
+func isValidTemplateName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// templateVariables lists the placeholder names used in an ask template.
+func templateVariables(askJSON string) []string {
+	seen := map[string]struct{}{}
+	for _, m := range templatePlaceholderRe.FindAllStringSubmatch(askJSON, -1) {
+		seen[m[1]] = struct{}{}
+	}
+	out := make([]string, 0, len(seen))
+	for v := range seen {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (t askTemplate) view() map[string]any {
+	return map[string]any{
+		"name":        t.Name,
+		"description": t.Description,
+		"ask":         json.RawMessage(t.AskJSON),
+		"variables":   templateVariables(t.AskJSON),
+		"created_at":  unixOrNil(t.CreatedAt),
+		"updated_at":  unixOrNil(t.UpdatedAt),
+	}
+}
+
+// parseTemplateVars reads GET vars: either vars=<json object> or one
+// var.<name>=<value> parameter per variable.
+func parseTemplateVars(q url.Values) (map[string]string, error) {
+	vars := map[string]string{}
+	if raw := strings.TrimSpace(q.Get("vars")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &vars); err != nil {
+			return nil, badAskError("vars must be a JSON object of strings")
+		}
+	}
+	for k, v := range q {
+		if name, ok := strings.CutPrefix(k, "var."); ok && name != "" && len(v) > 0 {
+			vars[name] = v[0]
+		}
+	}
+	return vars, nil
+}
+
+// expandTemplate merges the named template under ar and fills placeholders
+// from ar.Vars.
+func (s *server) expandTemplate(ctx context.Context, ar askRequest) (askRequest, error) {
+	name := strings.TrimSpace(ar.Template)
+	t, err := s.db.getTemplate(ctx, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return askRequest{}, badAskError("template not found: " + name)
+		}
+		return askRequest{}, err
+	}
+
+	var merged map[string]any
+	if err := json.Unmarshal([]byte(t.AskJSON), &merged); err != nil {
+		return askRequest{}, err
+	}
+	callerJSON, err := json.Marshal(ar)
+	if err != nil {
+		return askRequest{}, err
+	}
+	var caller map[string]any
+	if err := json.Unmarshal(callerJSON, &caller); err != nil {
+		return askRequest{}, err
+	}
+	for k, v := range caller {
+		if k == "template" || k == "vars" || isZeroJSONValue(v) {
+			continue
+		}
+		merged[k] = v
+	}
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		return askRequest{}, err
+	}
+	var out askRequest
+	if err := json.Unmarshal(mergedJSON, &out); err != nil {
+		return askRequest{}, badAskError("invalid template: " + err.Error())
+	}
+	out.sendAt = ar.sendAt
+	out.scheduleID = ar.scheduleID
+
+	var missing []string
+	fill := func(s string) string {
+		return templatePlaceholderRe.ReplaceAllStringFunc(s, func(m string) string {
+			key := templatePlaceholderRe.FindStringSubmatch(m)[1]
+			if v, ok := ar.Vars[key]; ok {
+				return v
+			}
+			missing = append(missing, key)
+			return m
+		})
+	}
+	out.Title = fill(out.Title)
+	out.Body = fill(out.Body)
+	out.MCD = fill(out.MCD)
+	out.DefaultAction = fill(out.DefaultAction)
+	for i := range out.Steps {
+		out.Steps[i].Title = fill(out.Steps[i].Title)
+		out.Steps[i].Body = fill(out.Steps[i].Body)
+		out.Steps[i].MCD = fill(out.Steps[i].MCD)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return askRequest{}, badAskError("missing template vars: " + strings.Join(compactStrings(missing), ", "))
+	}
+	return out, nil
+}
+
+func isZeroJSONValue(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return x == ""
+	case float64:
+		return x == 0
+	case bool:
+		return !x
+	case []any:
+		return len(x) == 0
+	case map[string]any:
+		return len(x) == 0
+	}
+	return false
+}
+
+func compactStrings(in []string) []string {
+	out := in[:0]
+	for i, v := range in {
+		if i == 0 || v != in[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+const templateColumns = `name, description, ask_json, created_at, updated_at`
+
+func scanTemplate(row interface{ Scan(...any) error }) (askTemplate, error) {
+	var t askTemplate
+	var desc sql.NullString
+	if err := row.Scan(&t.Name, &desc, &t.AskJSON, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return askTemplate{}, err
+	}
+	t.Description = desc.String
+	return t, nil
+}
+
+func (s *store) getTemplate(ctx context.Context, name string) (askTemplate, error) {
+	return scanTemplate(s.db.QueryRowContext(ctx, `SELECT `+templateColumns+` FROM templates WHERE name=?`, name))
+}
+
+func (s *store) listTemplates(ctx context.Context) ([]askTemplate, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+templateColumns+` FROM templates ORDER BY name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []askTemplate
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) upsertTemplate(ctx context.Context, t askTemplate) error {
+	now := time.Now().Unix()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO templates(name,description,ask_json,created_at,updated_at) VALUES(?,?,?,?,?)
+		 ON CONFLICT(name) DO UPDATE SET description=excluded.description, ask_json=excluded.ask_json, updated_at=excluded.updated_at`,
+		t.Name, nullIfEmpty(t.Description), t.AskJSON, now, now,
+	)
+	return err
+}
+
+func (s *store) deleteTemplate(ctx context.Context, name string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM templates WHERE name=?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// validateTemplateAsk checks that a template body decodes as an ask and does
+// not nest another template.
+func validateTemplateAsk(raw json.RawMessage) error {
+	var ar askRequest
+	if err := json.Unmarshal(raw, &ar); err != nil {
+		return badAskError("invalid ask: " + err.Error())
+	}
+	if ar.Template != "" || len(ar.Vars) > 0 {
+		return badAskError("ask cannot reference another template")
+	}
+	if strings.TrimSpace(ar.SendAt) != "" {
+		return badAskError("ask.send_at is not allowed in a template")
+	}
+	return nil
+}
+
+// handleTemplates serves /v1/templates and /v1/templates/{name}.
+func (s *server) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/templates"), "/")
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.db.listTemplates(ctx)
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out := make([]map[string]any, 0, len(list))
+			for _, t := range list {
+				out = append(out, t.view())
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"templates": out})
+		case http.MethodPost:
+			s.saveTemplate(w, r, "")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if !isValidTemplateName(name) {
+		http.Error(w, "invalid template name", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		t, err := s.db.getTemplate(ctx, name)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, t.view())
+	case http.MethodPut:
+		s.saveTemplate(w, r, name)
+	case http.MethodDelete:
+		ok, err := s.db.deleteTemplate(ctx, name)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveTemplate handles POST /v1/templates (name in the body) and
+// PUT /v1/templates/{name}.
+func (s *server) saveTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	var in struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Ask         json.RawMessage `json:"ask"`
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil || json.Unmarshal(b, &in) != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		name = strings.TrimSpace(in.Name)
+	}
+	if !isValidTemplateName(name) {
+		http.Error(w, "name must be 1-64 letters, digits, _ or -", http.StatusBadRequest)
+		return
+	}
+	if len(in.Ask) == 0 {
+		http.Error(w, "ask is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateTemplateAsk(in.Ask); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	if _, err := s.db.getTemplate(r.Context(), name); errors.Is(err, sql.ErrNoRows) {
+		status = http.StatusCreated
+	}
+	t := askTemplate{Name: name, Description: strings.TrimSpace(in.Description), AskJSON: string(in.Ask)}
+	if err := s.db.upsertTemplate(r.Context(), t); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	saved, err := s.db.getTemplate(r.Context(), name)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, saved.view())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Tenants. One instance can serve several independent agents or people: each
+// entry of the `tenants` config section is a namespace with its own
+// notification channels and default expiry, and an API key with a tenant only
+// sees that tenant. Its asks are stamped with the tenant, /v1/requests and
+// /v1/stats only cover the tenant's requests, and another tenant's request,
+// bundle or attachment answers 404. Tenant keys cannot have the admin scope
+// and get 403 from the server-wide parts of the API (webhooks, templates,
+// schedules, export, outbox, API keys, push subscriptions, the firehose).
+//
+// Keys without a tenant keep seeing everything and may put an ask in a tenant
+// with its `tenant` field. A tenant without channels of its own notifies
+// through the server's.
+
+// TenantConfig is one entry of the `tenants` config section.
+type TenantConfig struct {
+	Name                    string   `yaml:"name"`
+	ServerChanSendKey       string   `yaml:"serverchan_sendkey"`
+	AppriseURLs             []string `yaml:"apprise_urls"`
+	DefaultExpiresInSeconds int      `yaml:"default_expires_in_seconds"`
+}
+
+func (t TenantConfig) hasChannels() bool {
+	return strings.TrimSpace(t.ServerChanSendKey) != "" || len(t.AppriseURLs) > 0
+}
+
+// isValidName checks the name of a tenant or rotation: lowercase letters,
+// digits, _ and -.
+func isValidName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateTenantConfigs checks the tenants config section; names are
+// lowercased in place.
+func validateTenantConfigs(c *Config) error {
+	seen := map[string]struct{}{}
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		t.Name = strings.ToLower(strings.TrimSpace(t.Name))
+		if !isValidName(t.Name) {
+			return fmt.Errorf("tenants %q: name must use only letters, digits, _ and -", t.Name)
+		}
+		if _, dup := seen[t.Name]; dup {
+			return fmt.Errorf("tenants: duplicate name %q", t.Name)
+		}
+		seen[t.Name] = struct{}{}
+		if t.DefaultExpiresInSeconds < 0 {
+			return fmt.Errorf("tenants %q: default_expires_in_seconds must not be negative", t.Name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) tenant(name string) (TenantConfig, bool) {
+	for _, t := range c.Tenants {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TenantConfig{}, false
+}
+
+// checkKeyTenant validates the tenant of an API key.
+func (c *Config) checkKeyTenant(tenant string, scopes []string) error {
+	if tenant == "" {
+		return nil
+	}
+	if _, ok := c.tenant(tenant); !ok {
+		return fmt.Errorf("unknown tenant %q", tenant)
+	}
+	for _, sc := range scopes {
+		if sc == scopeAdmin {
+			return errors.New("keys of a tenant cannot have the admin scope")
+		}
+	}
+	return nil
+}
+
+type apiKeyCtxKey struct{}
+
+func withAPIKey(r *http.Request, k apiKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, k))
+}
+
+// keyTenant returns the tenant of the API key that made the call, if any.
+func keyTenant(ctx context.Context) string {
+	k, _ := ctx.Value(apiKeyCtxKey{}).(apiKey)
+	return k.Tenant
+}
+
+// tenantPath reports whether tenant keys may call the endpoint.
+func tenantPath(r *http.Request) bool {
+	path := r.URL.Path
+	switch {
+	case path == "/v1/ask" || path == "/v1/hooks/agent" || path == "/v1/stats" || path == "/v1/search" || path == "/metrics":
+		return true
+	case path == "/v1/requests" || strings.HasPrefix(path, "/v1/requests/"):
+		return true
+	case path == "/v1/bundles" || strings.HasPrefix(path, "/v1/bundles/"):
+		return true
+	case path == "/v1/attachments" || strings.HasPrefix(path, "/v1/attachments/"):
+		return true
+	}
+	return false
+}
+
+func (s *store) getTenant(ctx context.Context, reqID string) (string, error) {
+	var tenant sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT tenant FROM requests WHERE request_id=?`, reqID).Scan(&tenant); err != nil {
+		return "", err
+	}
+	return tenant.String, nil
+}
+
+// visible reports whether the caller's key may see requestID. Unknown
+// requests are visible, so that callers answer 404 as usual.
+func (s *server) visible(ctx context.Context, requestID string) (bool, error) {
+	want := keyTenant(ctx)
+	if want == "" {
+		return true, nil
+	}
+	tenant, err := s.db.getTenant(ctx, requestID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return tenant == want, nil
+}
+
+// resolveTenant puts an ask made with a tenant key into its tenant and checks
+// the tenant named by other callers.
+func (s *server) resolveTenant(ctx context.Context, ar *askRequest) error {
+	ar.Tenant = strings.ToLower(strings.TrimSpace(ar.Tenant))
+	if own := keyTenant(ctx); own != "" {
+		if ar.Tenant != "" && ar.Tenant != own {
+			return badAskError("tenant does not match the API key")
+		}
+		ar.Tenant = own
+	}
+	if ar.Tenant == "" {
+		return nil
+	}
+	if _, ok := s.cfg().tenant(ar.Tenant); !ok {
+		return badAskError("unknown tenant")
+	}
+	return nil
+}
+
+// notifyTargetFor returns the channels for an ask without responder targets:
+// those of its `to` contact (see contacts.go) or its tenant, if they have
+// any, otherwise those of its priority. Browsers subscribed at /subscribe
+// belong to the server and are left out of contact and tenant channels.
+func (s *server) notifyTargetFor(ar askRequest) notifyTarget {
+	if target, ok := s.contactTarget(string(ar.To), ar.Priority); ok {
+		return target
+	}
+	if t, ok := s.cfg().tenant(ar.Tenant); ok && t.hasChannels() {
+		return notifyTarget{ServerChanSendKey: t.ServerChanSendKey, AppriseURLs: t.AppriseURLs}
+	}
+	return s.priorityNotifyTarget(ar.Priority)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threads link follow-up asks to the request they continue via
+// parent_request_id. The listing and detail APIs expose the chain, and the
+// interaction page shows the previous questions with their answers.
+
+const maxThreadDepth = 20
+
+type requestSummary struct {
+	RequestID       string
+	Title           string
+	Body            string
+	Status          string
+	CreatedAt       int64
+	UpdatedAt       int64
+	ExpiresAt       int64
+	ParentRequestID string
+	Priority        string
+	ScheduleID      string
+	Tenant          string
+	// SLABreachedAt is set once the ask outlived its sla_seconds, see
+	// sla.go.
+	SLABreachedAt int64
+	Answer        *answerSummary
+}
+
+type answerSummary struct {
+	Action        string
+	Text          string
+	Responder     string
+	ResponderName string
+	CreatedAt     int64
+	RedactedAt    int64
+}
+
+// view has the same keys for every request, absent values being null, so
+// that no-code tools can map its fields once.
+func (r requestSummary) view() map[string]any {
+	m := map[string]any{
+		"request_id":        r.RequestID,
+		"title":             r.Title,
+		"body":              r.Body,
+		"status":            r.Status,
+		"created_at":        unixOrNil(r.CreatedAt),
+		"updated_at":        unixOrNil(r.UpdatedAt),
+		"expires_at":        unixOrNil(r.ExpiresAt),
+		"parent_request_id": nullIfEmpty(r.ParentRequestID),
+		"priority":          nullIfEmpty(r.Priority),
+		"schedule_id":       nullIfEmpty(r.ScheduleID),
+		"tenant":            nullIfEmpty(r.Tenant),
+		"sla_breached_at":   unixOrNil(r.SLABreachedAt),
+		"answer":            nil,
+	}
+	if r.Answer != nil {
+		m["answer"] = map[string]any{
+			"action":         r.Answer.Action,
+			"text":           r.Answer.Text,
+			"responder":      r.Answer.Responder,
+			"responder_name": nullIfEmpty(r.Answer.ResponderName),
+			"answered_at":    unixOrNil(r.Answer.CreatedAt),
+			"redacted_at":    unixOrNil(r.Answer.RedactedAt),
+		}
+	}
+	return m
+}
+
+const requestSummarySelect = `SELECT r.request_id, r.title, r.body, r.status, r.created_at, r.updated_at, r.expires_at,
+	r.parent_request_id, r.priority, r.schedule_id, r.tenant, r.sla_breached_at, a.action, a.text, a.responder, a.responder_name, a.created_at, a.redacted_at, b.encoding, b.data
+	FROM requests r LEFT JOIN answers a ON a.request_id = r.request_id` + bodyJoin
+
+func scanRequestSummary(row interface{ Scan(...any) error }) (requestSummary, error) {
+	var r requestSummary
+	var parent, priority, scheduleID, tenant, action, text, responder, responderName sql.NullString
+	var answeredAt, redactedAt, slaBreachedAt sql.NullInt64
+	var bodyEncoding, bodyData sql.NullString
+	if err := row.Scan(&r.RequestID, &r.Title, &r.Body, &r.Status, &r.CreatedAt, &r.UpdatedAt, &r.ExpiresAt,
+		&parent, &priority, &scheduleID, &tenant, &slaBreachedAt, &action, &text, &responder, &responderName, &answeredAt, &redactedAt, &bodyEncoding, &bodyData); err != nil {
+		return requestSummary{}, err
+	}
+	r.Body = bodyText(r.Body, bodyEncoding, bodyData)
+	r.ParentRequestID = parent.String
+	r.Priority = priority.String
+	r.ScheduleID = scheduleID.String
+	r.Tenant = tenant.String
+	r.SLABreachedAt = slaBreachedAt.Int64
+	if answeredAt.Valid {
+		r.Answer = &answerSummary{Action: action.String, Text: text.String, Responder: responder.String, ResponderName: responderName.String, CreatedAt: answeredAt.Int64, RedactedAt: redactedAt.Int64}
+	}
+	return r, nil
+}
+
+func (s *store) getRequestSummary(ctx context.Context, reqID string) (requestSummary, error) {
+	return scanRequestSummary(s.db.QueryRowContext(ctx, requestSummarySelect+` WHERE r.request_id=?`, reqID))
+}
+
+type requestFilter struct {
+	Status          string
+	ParentRequestID string
+	Tenant          string
+	Before          int64
+	Since           *requestCursor
+	Limit           int
+	// Search holds the words of a full-text search, see search.go.
+	Search []string
+}
+
+// requestCursor is a position in the requests ordered by (updated_at,
+// request_id), written "<unix>" or "<unix>.<request_id>". Polling with
+// ?since= walks that order forwards, so every change is seen once.
+type requestCursor struct {
+	UpdatedAt int64
+	RequestID string
+}
+
+func (c requestCursor) String() string {
+	if c.RequestID == "" {
+		return strconv.FormatInt(c.UpdatedAt, 10)
+	}
+	return strconv.FormatInt(c.UpdatedAt, 10) + "." + c.RequestID
+}
+
+// parseRequestCursor also takes an RFC 3339 time.
+func parseRequestCursor(v string) (requestCursor, bool) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return requestCursor{UpdatedAt: t.Unix() - 1}, true
+	}
+	ts, id, _ := strings.Cut(v, ".")
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || n < 0 || (id != "" && !isValidRequestID(id)) {
+		return requestCursor{}, false
+	}
+	return requestCursor{UpdatedAt: n, RequestID: id}, true
+}
+
+// pendingRequests lists up to limit asks that are still waiting for an
+// answer, newest first.
+func (s *store) pendingRequests(ctx context.Context, limit int) ([]requestSummary, error) {
+	var out []requestSummary
+	now := time.Now().Unix()
+	for _, status := range []string{"delivered", "created"} {
+		list, err := s.listRequests(ctx, requestFilter{Status: status, Limit: limit})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list {
+			if item.ExpiresAt > now {
+				out = append(out, item)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt > out[j].CreatedAt })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *store) listRequests(ctx context.Context, f requestFilter) ([]requestSummary, error) {
+	var where []string
+	var args []any
+	if f.Status != "" {
+		where = append(where, "r.status=?")
+		args = append(args, f.Status)
+	}
+	if f.ParentRequestID != "" {
+		where = append(where, "r.parent_request_id=?")
+		args = append(args, f.ParentRequestID)
+	}
+	if f.Tenant != "" {
+		where = append(where, "r.tenant=?")
+		args = append(args, f.Tenant)
+	}
+	if f.Before > 0 {
+		where = append(where, "r.created_at<?")
+		args = append(args, f.Before)
+	}
+	if f.Since != nil {
+		where = append(where, "(r.updated_at>? OR (r.updated_at=? AND r.request_id>?))")
+		args = append(args, f.Since.UpdatedAt, f.Since.UpdatedAt, f.Since.RequestID)
+	}
+	if len(f.Search) > 0 {
+		cond, arg := s.db.dialect.searchMatch(f.Search)
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	q := requestSummarySelect
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	if f.Since != nil {
+		q += " ORDER BY r.updated_at ASC, r.request_id ASC LIMIT ?"
+	} else {
+		q += " ORDER BY r.created_at DESC, r.request_id DESC LIMIT ?"
+	}
+	args = append(args, f.Limit)
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []requestSummary
+	for rows.Next() {
+		r, err := scanRequestSummary(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// threadAncestors returns the requests r continues, oldest first.
+func (s *store) threadAncestors(ctx context.Context, r requestSummary) ([]requestSummary, error) {
+	var out []requestSummary
+	seen := map[string]struct{}{r.RequestID: {}}
+	parent := r.ParentRequestID
+	for parent != "" && len(out) < maxThreadDepth {
+		if _, loop := seen[parent]; loop {
+			break
+		}
+		seen[parent] = struct{}{}
+		p, err := s.getRequestSummary(ctx, parent)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				break
+			}
+			return nil, err
+		}
+		out = append(out, p)
+		parent = p.ParentRequestID
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// validateParent checks askRequest.ParentRequestID.
+func (s *server) validateParent(ctx context.Context, ar *askRequest) error {
+	ar.ParentRequestID = strings.TrimSpace(ar.ParentRequestID)
+	if ar.ParentRequestID == "" {
+		return nil
+	}
+	if !isValidRequestID(ar.ParentRequestID) {
+		return badAskError("invalid parent_request_id")
+	}
+	tenant, err := s.db.getTenant(ctx, ar.ParentRequestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return badAskError("parent_request_id not found")
+		}
+		return err
+	}
+	// A thread stays within its tenant.
+	if tenant != ar.Tenant {
+		return badAskError("parent_request_id not found")
+	}
+	return nil
+}
+
+// handleListRequests serves GET /v1/requests. Without since it pages back
+// from the newest ask with before; with since it returns what changed after
+// the cursor, oldest first, and next_since to poll with next.
+func (s *server) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	f := requestFilter{
+		Status:          strings.TrimSpace(q.Get("status")),
+		ParentRequestID: strings.TrimSpace(q.Get("parent_request_id")),
+		Tenant:          strings.ToLower(strings.TrimSpace(q.Get("tenant"))),
+		Limit:           50,
+	}
+	if own := keyTenant(r.Context()); own != "" {
+		f.Tenant = own
+	}
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		f.Limit = min(v, 500)
+	}
+	if v, err := strconv.ParseInt(q.Get("before"), 10, 64); err == nil && v > 0 {
+		f.Before = v
+	}
+	if v := strings.TrimSpace(q.Get("since")); v != "" {
+		c, ok := parseRequestCursor(v)
+		if !ok {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		f.Since = &c
+	}
+	list, err := s.db.listRequests(r.Context(), f)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		out = append(out, item.view())
+	}
+	resp := map[string]any{"requests": out}
+	switch {
+	case f.Since != nil:
+		next := *f.Since
+		if len(list) > 0 {
+			last := list[len(list)-1]
+			next = requestCursor{UpdatedAt: last.UpdatedAt, RequestID: last.RequestID}
+		}
+		resp["next_since"] = next.String()
+	case len(list) == f.Limit:
+		resp["next_before"] = list[len(list)-1].CreatedAt
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetRequest serves GET /v1/requests/{id} with the request's thread:
+// the ancestors it continues and its direct follow-ups.
+func (s *server) handleGetRequest(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	req, err := s.db.getRequestSummary(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ancestors, err := s.db.threadAncestors(ctx, req)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	children, err := s.db.listRequests(ctx, requestFilter{ParentRequestID: requestID, Limit: 100})
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	thread := make([]map[string]any, 0, len(ancestors))
+	for _, a := range ancestors {
+		thread = append(thread, a.view())
+	}
+	followUps := make([]map[string]any, 0, len(children))
+	for i := len(children) - 1; i >= 0; i-- {
+		followUps = append(followUps, children[i].view())
+	}
+	out := req.view()
+	out["thread"] = thread
+	out["follow_ups"] = followUps
+	form, err := s.db.getRequestForm(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	for k, v := range form {
+		out[k] = v
+	}
+	if n, err := s.db.getNotification(ctx, requestID); err == nil {
+		out["notification"] = n.view()
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if recipients, err := s.db.recipients(ctx, requestID); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	} else if recipients != nil {
+		views := make([]map[string]any, 0, len(recipients))
+		for _, rc := range recipients {
+			views = append(views, rc.view())
+		}
+		out["recipients"] = views
+	}
+	if s.blobs != nil {
+		attachments, err := s.db.listAttachments(ctx, requestID)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		out["attachments"] = attachmentViews(attachments, s.cfg().BaseURL)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// getRequestForm returns what a client needs to answer the request without
+// its page: mcd, jsonforms_schema and steps, each only when set.
+func (s *store) getRequestForm(ctx context.Context, reqID string) (map[string]any, error) {
+	var mcd, schema sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT mcd, jsonforms_schema_json FROM requests WHERE request_id=?`, reqID).Scan(&mcd, &schema)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	if strings.TrimSpace(mcd.String) != "" {
+		out["mcd"] = mcd.String
+	}
+	if strings.TrimSpace(schema.String) != "" {
+		out["jsonforms_schema"] = json.RawMessage(schema.String)
+	}
+	if steps, _, err := s.getSteps(ctx, reqID); err == nil && len(steps) > 0 {
+		out["steps"] = len(steps)
+	}
+	return out, nil
+}
+
+// pageThread returns the last few earlier questions of requestID's thread for
+// the interaction page.
+func (s *server) pageThread(ctx context.Context, requestID string) []threadItem {
+	const shown = 5
+	req, err := s.db.getRequestSummary(ctx, requestID)
+	if err != nil || req.ParentRequestID == "" {
+		return nil
+	}
+	ancestors, err := s.db.threadAncestors(ctx, req)
+	if err != nil {
+		return nil
+	}
+	if len(ancestors) > shown {
+		ancestors = ancestors[len(ancestors)-shown:]
+	}
+	out := make([]threadItem, 0, len(ancestors))
+	for _, a := range ancestors {
+		item := threadItem{Title: a.Title}
+		if a.Answer != nil {
+			parts := make([]string, 0, 2)
+			if a.Answer.Action != "" {
+				parts = append(parts, a.Answer.Action)
+			}
+			if a.Answer.Text != "" {
+				parts = append(parts, a.Answer.Text)
+			}
+			item.Answer = strings.Join(parts, " · ")
+		}
+		out = append(out, item)
+	}
+	return out
+}
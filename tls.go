@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Built-in HTTPS, so a VPS can serve interaction links (which carry bearer
+// tokens) without a reverse proxy:
+//
+//   - tls_mode: manual serves tls_cert_file / tls_key_file. The files are
+//     read again when they change, so renewing them needs no restart.
+//   - tls_mode: acme gets and renews certificates from Let's Encrypt (or
+//     acme_directory_url) for acme_domains, default base_url's host, and
+//     keeps them in acme_cache_dir. Validation uses TLS-ALPN on the HTTPS
+//     port itself; tls_http_addr (e.g. ":80") also answers HTTP-01 and
+//     redirects plain HTTP to HTTPS.
+
+const (
+	tlsModeOff    = "off"
+	tlsModeManual = "manual"
+	tlsModeACME   = "acme"
+)
+
+func (c *Config) normalizeTLS() error {
+	c.TLSMode = strings.ToLower(strings.TrimSpace(c.TLSMode))
+	switch c.TLSMode {
+	case "", tlsModeOff:
+		c.TLSMode = tlsModeOff
+	case tlsModeManual:
+		if strings.TrimSpace(c.TLSCertFile) == "" || strings.TrimSpace(c.TLSKeyFile) == "" {
+			return fmt.Errorf("tls_mode manual needs tls_cert_file and tls_key_file")
+		}
+	case tlsModeACME:
+		if len(c.ACMEDomains) == 0 {
+			if u, err := url.Parse(c.BaseURL); err == nil && u.Hostname() != "" {
+				c.ACMEDomains = []string{u.Hostname()}
+			}
+		}
+		if len(c.ACMEDomains) == 0 {
+			return fmt.Errorf("tls_mode acme needs acme_domains")
+		}
+		for _, d := range c.ACMEDomains {
+			if ip := net.ParseIP(d); ip != nil || d == "localhost" {
+				return fmt.Errorf("acme cannot issue certificates for %q", d)
+			}
+		}
+		if strings.TrimSpace(c.ACMECacheDir) == "" {
+			c.ACMECacheDir = "./acme-cache"
+		}
+	default:
+		return fmt.Errorf("unknown tls_mode %q (want off, manual or acme)", c.TLSMode)
+	}
+	if c.TLSMode != tlsModeOff && !strings.HasPrefix(c.BaseURL, "https://") {
+		slog.Warn("tls: base_url is not https, interaction links will not use TLS", "base_url", c.BaseURL)
+	}
+	return nil
+}
+
+// certReloader serves a certificate from disk and reloads it when either file
+// changes.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (l *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{l.certFile, l.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (l *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.modTime = l.latestModTime()
+	return nil
+}
+
+func (l *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.checked) > time.Minute {
+		l.checked = now
+		if l.latestModTime().After(l.modTime) {
+			if err := l.load(); err != nil {
+				slog.Error("tls: reload", "file", l.certFile, "error", err)
+			}
+		}
+	}
+	return l.cert, nil
+}
+
+// tlsSetup returns the TLS config for the main listener and, when
+// tls_http_addr is set, the handler for the plain HTTP one.
+func tlsSetup(cfg Config) (*tls.Config, http.Handler, error) {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if u, err := url.Parse(cfg.BaseURL); err == nil && u.Scheme == "https" && u.Host != "" {
+			host = u.Host
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	switch cfg.TLSMode {
+	case tlsModeManual:
+		l := &certReloader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}
+		if err := l.load(); err != nil {
+			return nil, nil, fmt.Errorf("load tls certificate: %w", err)
+		}
+		l.checked = time.Now()
+		return &tls.Config{GetCertificate: l.getCertificate, MinVersion: tls.VersionTLS12}, redirect, nil
+	case tlsModeACME:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Email:      cfg.ACMEEmail,
+		}
+		if cfg.ACMEDirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+		}
+		tc := m.TLSConfig()
+		tc.MinVersion = tls.VersionTLS12
+		return tc, m.HTTPHandler(redirect), nil
+	}
+	return nil, nil, nil
+}
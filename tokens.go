@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Interaction links can be made single-use with one_time_link:
+//
+//   - "open": the link is bound to the first browser that opens it (by a
+//     cookie); anyone else gets 410. Link previews in chat apps count as an
+//     open, so only use it where links are not unfurled.
+//   - "submit": the link stops working once an answer was submitted with it.
+//
+// Independently, POST /v1/requests/{id}/tokens/revoke disables a pending
+// request's links and .../tokens/rotate replaces them with fresh ones, e.g.
+// after a link leaked.
+
+const (
+	oneTimeLinkOpen   = "open"
+	oneTimeLinkSubmit = "submit"
+
+	bindCookiePrefix = "ask4me_bind_"
+)
+
+func normalizeOneTimeLink(ar *askRequest) error {
+	ar.OneTimeLink = strings.ToLower(strings.TrimSpace(ar.OneTimeLink))
+	switch ar.OneTimeLink {
+	case "", oneTimeLinkOpen, oneTimeLinkSubmit:
+		return nil
+	}
+	return badAskError("one_time_link must be open or submit")
+}
+
+func (s *store) getOneTimeLink(ctx context.Context, reqID string) (string, error) {
+	var v sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT one_time_link FROM requests WHERE request_id=?`, reqID).Scan(&v)
+	return v.String, err
+}
+
+type tokenRow struct {
+	Hash        string
+	Responder   string
+	DelegatedTo string
+	ExpiresAt   int64
+	UsedAt      int64
+	BoundHash   string
+}
+
+func (s *store) getTokenRow(ctx context.Context, reqID, tokenHash string) (tokenRow, error) {
+	t := tokenRow{Hash: tokenHash}
+	var responder, delegatedTo, bound sql.NullString
+	var usedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT responder, delegated_to, expires_at, used_at, bound_hash FROM tokens WHERE request_id=? AND token_hash=?`,
+		reqID, tokenHash,
+	).Scan(&responder, &delegatedTo, &t.ExpiresAt, &usedAt, &bound)
+	t.Responder = responder.String
+	t.DelegatedTo = delegatedTo.String
+	t.UsedAt = usedAt.Int64
+	t.BoundHash = bound.String
+	return t, err
+}
+
+// bindToken claims an unbound token for a browser. ok=false means another
+// browser was first.
+func (s *store) bindToken(ctx context.Context, reqID, tokenHash, boundHash string) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE tokens SET bound_hash=? WHERE request_id=? AND token_hash=? AND bound_hash IS NULL`,
+		boundHash, reqID, tokenHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// listOpenTokens returns a request's tokens that have not been used to
+// answer, revoked ones included.
+func (s *store) listOpenTokens(ctx context.Context, reqID string) ([]tokenRow, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT token_hash, responder, delegated_to, expires_at FROM tokens WHERE request_id=? AND used_at IS NULL ORDER BY created_at ASC`,
+		reqID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []tokenRow
+	for rows.Next() {
+		var t tokenRow
+		var responder, delegatedTo sql.NullString
+		if err := rows.Scan(&t.Hash, &responder, &delegatedTo, &t.ExpiresAt); err != nil {
+			return nil, err
+		}
+		t.Responder = responder.String
+		t.DelegatedTo = delegatedTo.String
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// replaceToken swaps old for a new token with the same responder, forward
+// and expiry, and moves its draft along.
+func (s *store) replaceToken(ctx context.Context, reqID string, old tokenRow, newHash string) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO tokens(request_id,token_hash,responder,delegated_to,expires_at,created_at) VALUES(?,?,?,?,?,?)`,
+		reqID, newHash, nullIfEmpty(old.Responder), nullIfEmpty(old.DelegatedTo), old.ExpiresAt, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `UPDATE drafts SET token_hash=? WHERE request_id=? AND token_hash=?`, newHash, reqID, old.Hash); err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM tokens WHERE request_id=? AND token_hash=?`, reqID, old.Hash)
+	return err
+}
+
+// revokeTokens disables the unused links of a request, or of one responder.
+func (s *store) revokeTokens(ctx context.Context, reqID, responder string) (int64, error) {
+	q := `UPDATE tokens SET revoked_at=? WHERE request_id=? AND used_at IS NULL AND revoked_at IS NULL`
+	args := []any{time.Now().Unix(), reqID}
+	if responder != "" {
+		q += ` AND responder=?`
+		args = append(args, responder)
+	}
+	res, err := s.db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// withLinks points a pending delivery at rotated links, matched by
+// responder name.
+func (d scheduledDelivery) withLinks(urls map[string]string) scheduledDelivery {
+	for i, l := range d.Links {
+		if u, ok := urls[l.Name]; ok {
+			d.Links[i].URL = u
+		}
+	}
+	if u, ok := urls[""]; ok {
+		d.InteractionURL = u
+	} else if len(d.Links) > 0 {
+		d.InteractionURL = d.Links[0].URL
+	}
+	return d
+}
+
+// relinkDeliveries rewrites the stored, not yet sent deliveries of reqID
+// (scheduled_asks and outbox) to use the rotated links. With resend, a
+// delivery that already went out is queued again.
+func (s *store) relinkDeliveries(ctx context.Context, reqID string, urls map[string]string, resend bool) (bool, error) {
+	var raw string
+	err := s.db.QueryRowContext(ctx, `SELECT payload_json FROM scheduled_asks WHERE request_id=?`, reqID).Scan(&raw)
+	if err == nil {
+		var d scheduledDelivery
+		if err := json.Unmarshal([]byte(raw), &d); err != nil {
+			return false, err
+		}
+		b, _ := json.Marshal(d.withLinks(urls))
+		_, err := s.db.ExecContext(ctx, `UPDATE scheduled_asks SET payload_json=? WHERE request_id=?`, string(b), reqID)
+		return false, err
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	var status string
+	err = s.db.QueryRowContext(ctx, `SELECT payload_json, status FROM outbox WHERE request_id=?`, reqID).Scan(&raw, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	var d scheduledDelivery
+	if err := json.Unmarshal([]byte(raw), &d); err != nil {
+		return false, err
+	}
+	b, _ := json.Marshal(d.withLinks(urls))
+	if resend && status == outboxStatusSent {
+		now := time.Now().Unix()
+		if _, err := s.db.ExecContext(ctx,
+			`UPDATE outbox SET payload_json=?, status=?, attempts=0, next_attempt_at=?, last_error=NULL, updated_at=? WHERE request_id=?`,
+			string(b), outboxStatusPending, now, now, reqID,
+		); err != nil {
+			return false, err
+		}
+		_, err := s.db.ExecContext(ctx,
+			`UPDATE requests SET status='created', updated_at=? WHERE request_id=? AND status='delivered'`,
+			now, reqID,
+		)
+		return err == nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE outbox SET payload_json=? WHERE request_id=?`, string(b), reqID)
+	return false, err
+}
+
+// checkLinkUse enforces one_time_link for a verified token. It writes the
+// response and returns false when the token may not be used.
+func (s *server) checkLinkUse(w http.ResponseWriter, r *http.Request, requestID, tokenHash string) bool {
+	mode, err := s.db.getOneTimeLink(r.Context(), requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if mode == "" {
+		return true
+	}
+	t, err := s.db.getTokenRow(r.Context(), requestID, tokenHash)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	switch mode {
+	case oneTimeLinkSubmit:
+		if t.UsedAt != 0 {
+			http.Error(w, "this link has already been used", http.StatusGone)
+			return false
+		}
+	case oneTimeLinkOpen:
+		cookieName := bindCookiePrefix + tokenHash[:16]
+		if t.BoundHash != "" {
+			if c, err := r.Cookie(cookieName); err == nil && sha256Hex(c.Value) == t.BoundHash {
+				return true
+			}
+			http.Error(w, "this link was already opened on another device", http.StatusGone)
+			return false
+		}
+		secret := genToken()
+		ok, err := s.db.bindToken(r.Context(), requestID, tokenHash, sha256Hex(secret))
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return false
+		}
+		if !ok {
+			http.Error(w, "this link was already opened on another device", http.StatusGone)
+			return false
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    secret,
+			Path:     s.cfg().PathPrefix + "/",
+			Expires:  time.Unix(t.ExpiresAt, 0),
+			HttpOnly: true,
+			Secure:   s.secureCookies(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return true
+}
+
+// handleTokens serves POST /v1/requests/{id}/tokens/rotate and
+// /v1/requests/{id}/tokens/revoke.
+func (s *server) handleTokens(w http.ResponseWriter, r *http.Request, requestID, action string) {
+	if action != "rotate" && action != "revoke" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var body struct {
+		Responder string `json:"responder"`
+		Notify    bool   `json:"notify"`
+	}
+	if b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16)); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		if err := json.Unmarshal(b, &body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	}
+	status, _, err := s.db.getRequestStatus(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if isTerminalStatus(status) {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"status":     status,
+			"error":      "request already finished",
+		})
+		return
+	}
+
+	if action == "revoke" {
+		responder := strings.TrimSpace(body.Responder)
+		n, err := s.db.revokeTokens(ctx, requestID, responder)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		data := map[string]any{"revoked": n}
+		if responder != "" {
+			data["responder"] = responder
+		}
+		ev := s.mustNewEvent(ctx, requestID, "request.tokens_revoked", data)
+		_ = s.persistTerminalAware(ctx, ev)
+		writeJSON(w, http.StatusOK, map[string]any{"request_id": requestID, "revoked": n})
+		return
+	}
+
+	tokens, err := s.db.listOpenTokens(ctx, requestID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(tokens) == 0 {
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"request_id": requestID,
+			"error":      "no unused links to rotate",
+		})
+		return
+	}
+	urls := map[string]string{}
+	var links []responderLink
+	for _, t := range tokens {
+		plain := genToken()
+		if err := s.db.replaceToken(ctx, requestID, t, sha256Hex(plain)); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		l := responderLink{Name: t.Responder, URL: s.makeInteractionURL(requestID, plain)}
+		if s.cfg().ShortLinks {
+			l.ShortURL, err = s.shortenURL(ctx, requestID, l.URL, time.Now(), time.Unix(t.ExpiresAt, 0))
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if t.DelegatedTo == "" {
+			urls[t.Responder] = l.notifyURL()
+		}
+		links = append(links, l)
+	}
+	resent, err := s.db.relinkDeliveries(ctx, requestID, urls, body.Notify)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if resent {
+		s.wakeOutbox()
+	}
+	data := map[string]any{
+		"interaction_url": links[0].URL,
+		"resent":          resent,
+	}
+	if links[0].ShortURL != "" {
+		data["short_url"] = links[0].ShortURL
+	}
+	if len(links) > 1 || links[0].Name != "" {
+		data["responders"] = responderLinksData(links)
+	}
+	ev := s.mustNewEvent(ctx, requestID, "request.tokens_rotated", data)
+	_ = s.persistTerminalAware(ctx, ev)
+	out := map[string]any{"request_id": requestID}
+	for k, v := range data {
+		out[k] = v
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Voice answers. Typing a long answer on a phone is slow; an ask with
+// voice_input shows a microphone button next to its text input. The page
+// records with the browser's MediaRecorder and attaches the recording to the
+// answer like any other upload (voice_input implies allow_uploads, so it
+// needs attachments_driver). With transcribe_url set, the page also sends
+// the recording to POST /r/{id}/transcribe, which hands it on to that URL
+// and fills the text input with the transcript for the responder to check
+// before sending.
+//
+// The transcription service gets the audio as the request body, with the
+// recording's Content-Type and X-Ask4Me-Request-Id, signed like callbacks
+// when webhook_secret is set, and answers {"text": "..."} with a 2xx.
+
+const transcribeTimeout = 30 * time.Second
+
+func normalizeVoiceInput(ar *askRequest) {
+	if ar.VoiceInput {
+		ar.AllowUploads = true
+	}
+}
+
+func (s *store) getVoiceInput(ctx context.Context, reqID string) (bool, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT voice_input FROM requests WHERE request_id=?`, reqID).Scan(&v); err != nil {
+		return false, err
+	}
+	return v.Int64 != 0, nil
+}
+
+var errNoTranscript = errors.New("transcription service returned no text")
+
+// transcribe sends audio to transcribe_url and returns the transcript.
+func (s *server) transcribe(ctx context.Context, requestID, contentType string, audio []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, transcribeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg().TranscribeURL, bytes.NewReader(audio))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "ask4me-transcribe")
+	req.Header.Set("X-Ask4Me-Request-Id", requestID)
+	if secret := s.cfg().WebhookSecret; secret != "" {
+		req.Header.Set(signatureHeader, signPayload(secret, time.Now(), audio))
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("transcription service answered %d", resp.StatusCode)
+	}
+	var res struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(res.Text)
+	if text == "" {
+		return "", errNoTranscript
+	}
+	return text, nil
+}
+
+// handleUserTranscribe serves POST /r/{id}/transcribe for the page's
+// microphone button. The body is the recording; the CSRF token comes in the
+// X-Ask4Me-CSRF header and was checked by handleUser. It answers
+// {"text": "..."}.
+func (s *server) handleUserTranscribe(w http.ResponseWriter, r *http.Request, requestID, status string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isTerminalStatus(status) {
+		http.Error(w, "closed", http.StatusGone)
+		return
+	}
+	voice, err := s.db.getVoiceInput(r.Context(), requestID)
+	if err != nil || !voice || s.cfg().TranscribeURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+	limit := s.cfg().AttachmentsMaxBytes
+	audio, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		http.Error(w, errAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(audio) == 0 {
+		http.Error(w, "empty recording", http.StatusBadRequest)
+		return
+	}
+	contentType := strings.TrimSpace(r.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(audio)
+	}
+	text, err := s.transcribe(r.Context(), requestID, contentType, audio)
+	if err != nil {
+		slog.Warn("transcribe", "request_id", requestID, "error", err)
+		http.Error(w, "transcription failed", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"text": text})
+}
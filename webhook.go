@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ask with callback_url gets its terminal event POSTed there as JSON (the
+// same object the SSE stream sends). With a secret (callback_secret on the
+// ask, else webhook_secret from the config) the request carries
+//
+//	X-Ask4Me-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256(secret, "<t>.<body>")>
+//
+// so the receiver can check it came from this server and is recent; see
+// verifySignature in sdk-js. Failed deliveries are retried a few times in
+// process and logged as callback.sent / callback.failed events.
+
+const (
+	callbackMaxAttempts = 3
+	callbackFirstRetry  = 5 * time.Second
+	callbackTimeout     = 10 * time.Second
+	signatureHeader     = "X-Ask4Me-Signature"
+)
+
+var callbackClient = &http.Client{Timeout: callbackTimeout}
+
+func normalizeCallback(ar *askRequest) error {
+	ar.CallbackURL = strings.TrimSpace(ar.CallbackURL)
+	ar.CallbackSecret = strings.TrimSpace(ar.CallbackSecret)
+	if ar.CallbackURL == "" {
+		if ar.CallbackSecret != "" {
+			return badAskError("callback_secret needs callback_url")
+		}
+		return nil
+	}
+	u, err := url.Parse(ar.CallbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return badAskError("callback_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+func (s *store) getCallback(ctx context.Context, reqID string) (callbackURL, secret string, err error) {
+	var u, sec sql.NullString
+	err = s.db.QueryRowContext(ctx, `SELECT callback_url, callback_secret FROM requests WHERE request_id=?`, reqID).Scan(&u, &sec)
+	return u.String, sec.String, err
+}
+
+// signPayload builds the X-Ask4Me-Signature value for body at t.
+func signPayload(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// setTerminal publishes a request's final event and hands it to the
+// callback, if the ask has one, and to the result push (see resultpush.go).
+func (s *server) setTerminal(ev Event) {
+	s.hub.setTerminal(ev)
+	s.goInflight(func() { s.sendCallback(ev) })
+	s.goInflight(func() { s.pushResult(ev) })
+}
+
+func (s *server) sendCallback(ev Event) {
+	ctx := context.Background()
+	callbackURL, secret, err := s.db.getCallback(ctx, ev.RequestID)
+	if err != nil || callbackURL == "" {
+		return
+	}
+	if secret == "" {
+		secret = s.cfg().WebhookSecret
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	delay := callbackFirstRetry
+	var lastErr error
+	for attempt := 1; attempt <= callbackMaxAttempts; attempt++ {
+		status, err := postCallback(ctx, callbackURL, secret, ev, body)
+		if err == nil {
+			done := s.mustNewEvent(ctx, ev.RequestID, "callback.sent", map[string]any{
+				"status":   status,
+				"attempts": attempt,
+			})
+			_ = s.persistTerminalAware(ctx, done)
+			return
+		}
+		lastErr = err
+		if attempt < callbackMaxAttempts {
+			time.Sleep(delay)
+			delay *= 4
+		}
+	}
+	slog.Warn("callback", "request_id", ev.RequestID, "event", ev.Type, "error", lastErr)
+	failed := s.mustNewEvent(ctx, ev.RequestID, "callback.failed", map[string]any{
+		"error":    lastErr.Error(),
+		"attempts": callbackMaxAttempts,
+	})
+	_ = s.persistTerminalAware(ctx, failed)
+}
+
+// postCallback makes one delivery attempt; any non-2xx answer is an error.
+// The signature is made fresh for each attempt.
+func postCallback(ctx context.Context, callbackURL, secret string, ev Event, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ask4me-callback")
+	req.Header.Set("X-Ask4Me-Event", ev.Type)
+	req.Header.Set("X-Ask4Me-Request-Id", ev.RequestID)
+	if secret != "" {
+		req.Header.Set(signatureHeader, signPayload(secret, time.Now(), body))
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("callback answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
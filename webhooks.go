@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook subscriptions, for no-code platforms (n8n, Zapier REST hooks) and
+// anything else that wants every ask's events rather than one callback_url
+// per ask. Each subscription gets the events it lists, POSTed and signed
+// like callbacks (its own secret, else webhook_secret). A receiver that
+// answers 410 Gone is unsubscribed, as REST hooks expect.
+//
+//	GET    /v1/webhooks            list
+//	POST   /v1/webhooks            subscribe (body: {"url", "events", "secret", "name"})
+//	GET    /v1/webhooks/{id}       show
+//	PATCH  /v1/webhooks/{id}       change url, events, secret or name
+//	DELETE /v1/webhooks/{id}       unsubscribe
+//	POST   /v1/webhooks/{id}/test  send a webhook.test event
+//
+// events defaults to the events that finish an ask; "*" means all of them.
+// The subscriptions are cached for webhookCacheTTL, so one added on another
+// instance starts within that time.
+
+const webhookCacheTTL = 30 * time.Second
+
+// defaultWebhookEvents are the events a subscription gets unless it lists
+// others.
+var defaultWebhookEvents = []string{"user.submitted", "request.completed", "request.expired", "request.cancelled", "notify.failed"}
+
+type webhookSub struct {
+	ID         string
+	URL        string
+	Secret     string
+	Events     []string
+	Name       string
+	CreatedAt  int64
+	LastStatus int64
+	LastError  string
+	LastSentAt int64
+}
+
+func (h webhookSub) view() map[string]any {
+	return map[string]any{
+		"id":           h.ID,
+		"url":          h.URL,
+		"events":       h.Events,
+		"name":         h.Name,
+		"has_secret":   h.Secret != "",
+		"created_at":   unixOrNil(h.CreatedAt),
+		"last_status":  nullIfZero(h.LastStatus),
+		"last_error":   nullIfEmpty(h.LastError),
+		"last_sent_at": unixOrNil(h.LastSentAt),
+	}
+}
+
+func (h webhookSub) wants(typ string) bool {
+	for _, e := range h.Events {
+		if e == "*" || e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+const webhookColumns = `id, url, secret, events, name, created_at, last_status, last_error, last_sent_at`
+
+func scanWebhook(row interface{ Scan(...any) error }) (webhookSub, error) {
+	var h webhookSub
+	var secret, lastError sql.NullString
+	var lastStatus, lastSent sql.NullInt64
+	var events string
+	if err := row.Scan(&h.ID, &h.URL, &secret, &events, &h.Name, &h.CreatedAt, &lastStatus, &lastError, &lastSent); err != nil {
+		return webhookSub{}, err
+	}
+	h.Secret, h.LastError = secret.String, lastError.String
+	h.LastStatus, h.LastSentAt = lastStatus.Int64, lastSent.Int64
+	h.Events = strings.Split(events, ",")
+	return h, nil
+}
+
+func (s *store) listWebhooks(ctx context.Context) ([]webhookSub, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY created_at ASC, id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []webhookSub
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) getWebhook(ctx context.Context, id string) (webhookSub, error) {
+	return scanWebhook(s.db.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id=?`, id))
+}
+
+func (s *store) insertWebhook(ctx context.Context, h webhookSub) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO webhooks(id,url,secret,events,name,created_at) VALUES(?,?,?,?,?,?)`,
+		h.ID, h.URL, nullIfEmpty(h.Secret), strings.Join(h.Events, ","), h.Name, h.CreatedAt,
+	)
+	return err
+}
+
+func (s *store) updateWebhook(ctx context.Context, h webhookSub) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE webhooks SET url=?, secret=?, events=?, name=? WHERE id=?`,
+		h.URL, nullIfEmpty(h.Secret), strings.Join(h.Events, ","), h.Name, h.ID,
+	)
+	return err
+}
+
+func (s *store) deleteWebhook(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id=?`, id)
+	return err
+}
+
+func (s *store) recordWebhookResult(ctx context.Context, id string, status int, errText string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE webhooks SET last_status=?, last_error=?, last_sent_at=? WHERE id=?`,
+		status, nullIfEmpty(errText), time.Now().Unix(), id,
+	)
+	return err
+}
+
+// webhookCache keeps the subscriptions so that events need no query.
+type webhookCache struct {
+	mu     sync.Mutex
+	list   []webhookSub
+	loaded time.Time
+}
+
+func (s *server) webhookSubs(ctx context.Context) []webhookSub {
+	c := &s.webhooks
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.loaded) < webhookCacheTTL {
+		return c.list
+	}
+	list, err := s.db.listWebhooks(ctx)
+	if err != nil {
+		return c.list
+	}
+	c.list, c.loaded = list, time.Now()
+	return list
+}
+
+func (s *server) forgetWebhooks() {
+	s.webhooks.mu.Lock()
+	s.webhooks.loaded = time.Time{}
+	s.webhooks.mu.Unlock()
+}
+
+// dispatchWebhooks sends ev to the subscriptions that want it.
+func (s *server) dispatchWebhooks(ctx context.Context, ev Event) {
+	for _, h := range s.webhookSubs(ctx) {
+		if h.wants(ev.Type) {
+			s.goInflight(func() { s.deliverWebhook(h, ev) })
+		}
+	}
+}
+
+// deliverWebhook posts ev to h, retrying like callbacks do.
+func (s *server) deliverWebhook(h webhookSub, ev Event) {
+	ctx := context.Background()
+	secret := h.Secret
+	if secret == "" {
+		secret = s.cfg().WebhookSecret
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	delay := callbackFirstRetry
+	var status int
+	for attempt := 1; attempt <= callbackMaxAttempts; attempt++ {
+		status, err = postCallback(ctx, h.URL, secret, ev, body)
+		if err == nil || status == http.StatusGone {
+			break
+		}
+		if attempt < callbackMaxAttempts {
+			time.Sleep(delay)
+			delay *= 4
+		}
+	}
+	if status == http.StatusGone {
+		slog.Info("webhook gone, unsubscribed", "webhook_id", h.ID)
+		_ = s.db.deleteWebhook(ctx, h.ID)
+		s.forgetWebhooks()
+		return
+	}
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+		slog.Warn("webhook", "webhook_id", h.ID, "request_id", ev.RequestID, "event", ev.Type, "error", err)
+	}
+	_ = s.db.recordWebhookResult(ctx, h.ID, status, errText)
+}
+
+// webhookInput is the body of POST and PATCH /v1/webhooks.
+type webhookInput struct {
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+	Secret *string  `json:"secret"`
+	Name   *string  `json:"name"`
+}
+
+// apply validates in and copies it onto h.
+func (in webhookInput) apply(h *webhookSub) string {
+	if in.URL != nil {
+		u, err := url.Parse(strings.TrimSpace(*in.URL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "url must be an absolute http(s) URL"
+		}
+		h.URL = u.String()
+	}
+	if in.Events != nil {
+		var events []string
+		for _, e := range in.Events {
+			e = strings.TrimSpace(e)
+			if e == "" {
+				continue
+			}
+			if strings.Contains(e, ",") {
+				return "invalid event " + e
+			}
+			events = append(events, e)
+		}
+		if len(events) == 0 {
+			return "events must not be empty"
+		}
+		h.Events = events
+	}
+	if in.Secret != nil {
+		h.Secret = strings.TrimSpace(*in.Secret)
+	}
+	if in.Name != nil {
+		h.Name = truncate(strings.TrimSpace(*in.Name), 255)
+	}
+	return ""
+}
+
+func (s *server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/webhooks"), "/")
+	ctx := r.Context()
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.db.listWebhooks(ctx)
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out := make([]map[string]any, 0, len(list))
+			for _, h := range list {
+				out = append(out, h.view())
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"webhooks": out})
+		case http.MethodPost:
+			var in webhookInput
+			if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if in.URL == nil {
+				http.Error(w, "url is required", http.StatusBadRequest)
+				return
+			}
+			h := webhookSub{ID: genID("hook_"), Events: defaultWebhookEvents, CreatedAt: time.Now().Unix()}
+			if msg := in.apply(&h); msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if err := s.db.insertWebhook(ctx, h); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			s.forgetWebhooks()
+			writeJSON(w, http.StatusCreated, h.view())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	h, err := s.db.getWebhook(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.view())
+	case action == "" && r.Method == http.MethodPatch:
+		var in webhookInput
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if msg := in.apply(&h); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if err := s.db.updateWebhook(ctx, h); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		s.forgetWebhooks()
+		writeJSON(w, http.StatusOK, h.view())
+	case action == "" && r.Method == http.MethodDelete:
+		if err := s.db.deleteWebhook(ctx, id); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		s.forgetWebhooks()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "test" && r.Method == http.MethodPost:
+		ev := s.mustNewEvent(ctx, "", "webhook.test", map[string]any{"webhook_id": h.ID})
+		secret := h.Secret
+		if secret == "" {
+			secret = s.cfg().WebhookSecret
+		}
+		body, _ := json.Marshal(ev)
+		status, err := postCallback(ctx, h.URL, secret, ev, body)
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+		_ = s.db.recordWebhookResult(ctx, h.ID, status, errText)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]any{"error": errText, "status": nullIfZero(int64(status))})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"sent": true, "status": status})
+	case action == "" || action == "test":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
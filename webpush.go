@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Web Push. A browser subscribes at /subscribe (with an API key that has the
+// admin scope) and from then on gets a notification for every ask sent to
+// the default channel or a priority channel, next to ServerChan or apprise.
+// With neither of those configured, subscribed browsers are the channel.
+// Clicking the notification opens the interaction page.
+//
+// Messages go straight to the browser's push service, encrypted for the
+// subscription (RFC 8291) and signed with a VAPID key (RFC 8292). The key is
+// web_push_vapid_private_key, or else one generated on first use and kept in
+// the database, so every instance signs with the same one. Subscriptions the
+// push service reports as gone (404/410) are deleted.
+//
+//	GET    /v1/push/subscriptions            list
+//	POST   /v1/push/subscriptions            add or update (body: PushSubscription JSON)
+//	DELETE /v1/push/subscriptions/{id}       remove
+//	POST   /v1/push/subscriptions/{id}/test  send a test notification
+
+const (
+	webPushTimeout      = 10 * time.Second
+	webPushDefaultTTL   = 24 * 60 * 60
+	webPushMaxTTL       = 28 * 24 * 60 * 60
+	webPushMaxBodyChars = 300
+	webPushRecordSize   = 4096
+)
+
+var webPushClient = &http.Client{Timeout: webPushTimeout}
+
+func (c *Config) normalizeWebPush() error {
+	c.WebPushSubject = strings.TrimSpace(c.WebPushSubject)
+	c.WebPushVAPIDPrivateKey = strings.TrimSpace(c.WebPushVAPIDPrivateKey)
+	if c.WebPushSubject != "" && !strings.HasPrefix(c.WebPushSubject, "mailto:") && !strings.HasPrefix(c.WebPushSubject, "https://") {
+		return fmt.Errorf("invalid web_push_subject %q (want mailto: or https:)", c.WebPushSubject)
+	}
+	c.vapidKey = nil
+	if c.WebPushVAPIDPrivateKey == "" {
+		return nil
+	}
+	k, err := parseVAPIDKey(c.WebPushVAPIDPrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid web_push_vapid_private_key: %w", err)
+	}
+	c.vapidKey = k
+	return nil
+}
+
+// parseVAPIDKey reads a raw P-256 private key in unpadded base64url, the
+// format web push tooling prints.
+func parseVAPIDKey(s string) (*ecdsa.PrivateKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), b)
+}
+
+func vapidPublicKey(k *ecdsa.PrivateKey) string {
+	pub, err := k.PublicKey.Bytes()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// vapidKeys caches the key kept in the database.
+type vapidKeys struct {
+	mu  sync.Mutex
+	key *ecdsa.PrivateKey
+}
+
+// vapidKey returns the configured VAPID key, or the stored one, generating
+// and storing it on first use.
+func (s *server) vapidKey(ctx context.Context) (*ecdsa.PrivateKey, error) {
+	if k := s.cfg().vapidKey; k != nil {
+		return k, nil
+	}
+	s.vapid.mu.Lock()
+	defer s.vapid.mu.Unlock()
+	if s.vapid.key != nil {
+		return s.vapid.key, nil
+	}
+	raw, err := s.db.getVAPIDKey(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		k, gerr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if gerr != nil {
+			return nil, gerr
+		}
+		b, gerr := k.Bytes()
+		if gerr != nil {
+			return nil, gerr
+		}
+		// Another instance may have stored its key first; use that one.
+		if err = s.db.insertVAPIDKey(ctx, base64.RawURLEncoding.EncodeToString(b)); err != nil && !isUniqueViolation(err) {
+			return nil, err
+		}
+		raw, err = s.db.getVAPIDKey(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, err := parseVAPIDKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("stored VAPID key: %w", err)
+	}
+	s.vapid.key = k
+	return k, nil
+}
+
+type pushSubscription struct {
+	ID         string
+	Endpoint   string
+	P256DH     string
+	Auth       string
+	Name       string
+	CreatedAt  int64
+	LastSentAt int64
+}
+
+func (p pushSubscription) view() map[string]any {
+	endpoint := p.Endpoint
+	if u, err := url.Parse(p.Endpoint); err == nil {
+		endpoint = u.Scheme + "://" + u.Host
+	}
+	return map[string]any{
+		"id":           p.ID,
+		"name":         p.Name,
+		"push_service": endpoint,
+		"created_at":   unixOrNil(p.CreatedAt),
+		"last_sent_at": unixOrNil(p.LastSentAt),
+	}
+}
+
+func (s *store) getVAPIDKey(ctx context.Context) (string, error) {
+	var raw string
+	err := s.db.QueryRowContext(ctx, `SELECT private_key FROM push_vapid_keys WHERE id=1`).Scan(&raw)
+	return raw, err
+}
+
+func (s *store) insertVAPIDKey(ctx context.Context, raw string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO push_vapid_keys(id,private_key,created_at) VALUES(1,?,?)`, raw, time.Now().Unix())
+	return err
+}
+
+const pushSubscriptionColumns = `id, endpoint, p256dh, auth, name, created_at, last_sent_at`
+
+func scanPushSubscription(row interface{ Scan(...any) error }) (pushSubscription, error) {
+	var p pushSubscription
+	err := row.Scan(&p.ID, &p.Endpoint, &p.P256DH, &p.Auth, &p.Name, &p.CreatedAt, &p.LastSentAt)
+	return p, err
+}
+
+func (s *store) listPushSubscriptions(ctx context.Context) ([]pushSubscription, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+pushSubscriptionColumns+` FROM push_subscriptions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pushSubscription
+	for rows.Next() {
+		p, err := scanPushSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) getPushSubscription(ctx context.Context, id string) (pushSubscription, error) {
+	return scanPushSubscription(s.db.QueryRowContext(ctx, `SELECT `+pushSubscriptionColumns+` FROM push_subscriptions WHERE id=?`, id))
+}
+
+// savePushSubscription stores p, or updates the keys and name of the
+// subscription with the same endpoint, and returns its id.
+func (s *store) savePushSubscription(ctx context.Context, p pushSubscription) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM push_subscriptions WHERE endpoint=?`, p.Endpoint).Scan(&id)
+	if err == nil {
+		_, err = s.db.ExecContext(ctx, `UPDATE push_subscriptions SET p256dh=?, auth=?, name=? WHERE id=?`, p.P256DH, p.Auth, p.Name, id)
+		return id, err
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO push_subscriptions(id,endpoint,p256dh,auth,name,created_at,last_sent_at) VALUES(?,?,?,?,?,?,0)`,
+		p.ID, p.Endpoint, p.P256DH, p.Auth, p.Name, time.Now().Unix(),
+	)
+	return p.ID, err
+}
+
+func (s *store) deletePushSubscription(ctx context.Context, id string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM push_subscriptions WHERE id=?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *store) markPushSent(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE push_subscriptions SET last_sent_at=? WHERE id=?`, time.Now().Unix(), id)
+	return err
+}
+
+func (s *store) countPushSubscriptions(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM push_subscriptions`).Scan(&n)
+	return n, err
+}
+
+// webPushMessage is what the service worker shows.
+type webPushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url,omitempty"`
+}
+
+// webPushError is a push service's refusal.
+type webPushError struct {
+	Status int
+	Body   string
+}
+
+func (e *webPushError) Error() string {
+	return fmt.Sprintf("push service answered %d: %s", e.Status, e.Body)
+}
+
+// gone reports whether the subscription no longer exists.
+func (e *webPushError) gone() bool {
+	return e.Status == http.StatusNotFound || e.Status == http.StatusGone
+}
+
+// sendWebPush delivers one encrypted message to sub.
+func (s *server) sendWebPush(ctx context.Context, key *ecdsa.PrivateKey, sub pushSubscription, msg webPushMessage, ttl int, urgency string) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	jwt, err := vapidJWT(key, endpoint.Scheme+"://"+endpoint.Host, s.webPushSubject())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "vapid t="+jwt+", k="+vapidPublicKey(key))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(ttl))
+	req.Header.Set("Urgency", urgency)
+	resp, err := webPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	out, _ := io.ReadAll(io.LimitReader(resp.Body, 2000))
+	return &webPushError{Status: resp.StatusCode, Body: strings.TrimSpace(string(out))}
+}
+
+func (s *server) webPushSubject() string {
+	if sub := s.cfg().WebPushSubject; sub != "" {
+		return sub
+	}
+	return strings.TrimRight(s.cfg().BaseURL, "/")
+}
+
+// vapidJWT signs the ES256 token that identifies this server to the push
+// service at aud.
+func vapidJWT(key *ecdsa.PrivateKey, aud, subject string) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": aud,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signing := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing))
+	r, sv, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	sv.FillBytes(sig[32:])
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// encryptWebPush encrypts payload for sub as one aes128gcm record
+// (RFC 8291 section 3.4).
+func encryptWebPush(sub pushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64URL(sub.P256DH)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	authSecret, err := decodeBase64URL(sub.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	shared, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prkKey, err := hkdf.Extract(sha256.New, shared, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(uaPublic) + string(asPublic)
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record: the payload, then the 0x02 last-record delimiter.
+	plain := append(append([]byte{}, payload...), 0x02)
+	if len(plain)+gcm.Overhead() > webPushRecordSize {
+		return nil, errors.New("web push payload too large")
+	}
+
+	out := make([]byte, 0, 16+4+1+len(asPublic)+len(plain)+gcm.Overhead())
+	out = append(out, salt...)
+	out = binary.BigEndian.AppendUint32(out, webPushRecordSize)
+	out = append(out, byte(len(asPublic)))
+	out = append(out, asPublic...)
+	return gcm.Seal(out, nonce, plain, nil), nil
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func webPushUrgency(priority string) string {
+	switch priority {
+	case priorityLow:
+		return "low"
+	case priorityHigh, priorityCritical:
+		return "high"
+	}
+	return "normal"
+}
+
+// webPushAll sends ar to every subscribed browser and returns how many took
+// it and how many did not, with the last error.
+func (s *server) webPushAll(ctx context.Context, ar askRequest, interactionURL string) (sent, failed int, lastErr error) {
+	subs, err := s.db.listPushSubscriptions(ctx)
+	if err != nil || len(subs) == 0 {
+		return 0, 0, err
+	}
+	key, err := s.vapidKey(ctx)
+	if err != nil {
+		return 0, len(subs), err
+	}
+	body := strings.TrimSpace(ar.Body)
+	if r := []rune(body); len(r) > webPushMaxBodyChars {
+		body = string(r[:webPushMaxBodyChars]) + "…"
+	}
+	if body == "" {
+		body = "Please respond."
+	}
+	ttl := webPushDefaultTTL
+	if ar.ExpiresInSeconds > 0 {
+		ttl = min(ar.ExpiresInSeconds, webPushMaxTTL)
+	}
+	msg := webPushMessage{Title: ar.Title, Body: body, URL: interactionURL}
+	urgency := webPushUrgency(ar.Priority)
+	for _, sub := range subs {
+		err := s.sendWebPush(ctx, key, sub, msg, ttl, urgency)
+		if err == nil {
+			sent++
+			_ = s.db.markPushSent(ctx, sub.ID)
+			continue
+		}
+		failed++
+		lastErr = err
+		var we *webPushError
+		if errors.As(err, &we) && we.gone() {
+			_, _ = s.db.deletePushSubscription(ctx, sub.ID)
+			slog.Info("web push subscription gone, removed", "subscription_id", sub.ID)
+			continue
+		}
+		slog.Warn("web push failed", "subscription_id", sub.ID, "error", err)
+	}
+	return sent, failed, lastErr
+}
+
+// webPushOnly notifies subscribed browsers when no other channel is set.
+func (s *server) webPushOnly(ctx context.Context, ar askRequest, interactionURL string) (map[string]any, error) {
+	sent, failed, err := s.webPushAll(ctx, ar, interactionURL)
+	if sent == 0 {
+		msg := "no browser took the web push"
+		if err != nil {
+			msg = err.Error()
+		}
+		return nil, &notifyError{fields: map[string]any{
+			"channel":         "webpush",
+			"error":           msg,
+			"web_push_failed": failed,
+		}}
+	}
+	return map[string]any{
+		"channel":         "webpush",
+		"web_push_sent":   sent,
+		"web_push_failed": failed,
+	}, nil
+}
+
+// alsoWebPush notifies subscribed browsers next to the main channel and
+// records the counts in its notify.sent or notify.failed payload.
+func (s *server) alsoWebPush(ctx context.Context, ar askRequest, interactionURL string, fields map[string]any, err error) {
+	sent, failed, _ := s.webPushAll(ctx, ar, interactionURL)
+	if sent+failed == 0 {
+		return
+	}
+	if err != nil {
+		var ne *notifyError
+		if !errors.As(err, &ne) {
+			return
+		}
+		fields = ne.fields
+	}
+	fields["web_push_sent"] = sent
+	fields["web_push_failed"] = failed
+}
+
+// hasWebPush reports whether any browser is subscribed.
+func (s *server) hasWebPush(ctx context.Context) bool {
+	n, err := s.db.countPushSubscriptions(ctx)
+	return err == nil && n > 0
+}
+
+func (s *server) handlePushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/push/subscriptions"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.db.listPushSubscriptions(r.Context())
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out := make([]map[string]any, 0, len(list))
+			for _, p := range list {
+				out = append(out, p.view())
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"subscriptions": out})
+		case http.MethodPost:
+			s.handleCreatePushSubscription(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	sub, err := s.db.getPushSubscription(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, sub.view())
+	case action == "" && r.Method == http.MethodDelete:
+		if _, err := s.db.deletePushSubscription(r.Context(), id); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "test" && r.Method == http.MethodPost:
+		key, err := s.vapidKey(r.Context())
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		msg := webPushMessage{Title: "Ask4Me", Body: "Browser notifications are on."}
+		if err := s.sendWebPush(r.Context(), key, sub, msg, 60, "normal"); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]any{"error": err.Error()})
+			return
+		}
+		_ = s.db.markPushSent(r.Context(), sub.ID)
+		writeJSON(w, http.StatusOK, map[string]any{"sent": true})
+	case action == "" || action == "test":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) handleCreatePushSubscription(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256DH string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(strings.TrimSpace(in.Endpoint))
+	if err != nil || u.Scheme != "https" || u.Host == "" || len(in.Endpoint) > 700 {
+		http.Error(w, "endpoint must be an https URL", http.StatusBadRequest)
+		return
+	}
+	sub := pushSubscription{
+		ID:       genID("push_"),
+		Endpoint: u.String(),
+		P256DH:   strings.TrimSpace(in.Keys.P256DH),
+		Auth:     strings.TrimSpace(in.Keys.Auth),
+		Name:     truncate(strings.TrimSpace(in.Name), 255),
+	}
+	if pub, err := decodeBase64URL(sub.P256DH); err != nil || len(pub) != 65 {
+		http.Error(w, "keys.p256dh must be a P-256 public key", http.StatusBadRequest)
+		return
+	}
+	if auth, err := decodeBase64URL(sub.Auth); err != nil || len(auth) < 16 {
+		http.Error(w, "keys.auth must be a 16-byte secret", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.vapidKey(r.Context()); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	id, err := s.db.savePushSubscription(r.Context(), sub)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	saved, err := s.db.getPushSubscription(r.Context(), id)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, saved.view())
+}
+
+var subscribeTpl = template.Must(template.New("subscribe").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width,initial-scale=1,viewport-fit=cover"/>
+  <title>Ask4Me notifications</title>
+  <link rel="manifest" href="manifest.webmanifest"/>
+  <style>
+    :root{color-scheme:light dark;--fg:#24292f;--muted:#57606a;--bg:#fff;--subtle:#f6f8fa;--border:#d0d7de;--ok-bg:#dafbe1;--ok-border:#2da44e;--err-bg:#ffebe9;--err-border:#d1242f;}
+    @media (prefers-color-scheme:dark){:root{--fg:#e6edf3;--muted:#8d96a0;--bg:#0d1117;--subtle:#161b22;--border:#30363d;--ok-bg:#12261e;--ok-border:#2ea043;--err-bg:#25171c;--err-border:#f85149;}}
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,sans-serif;max-width:720px;margin:32px auto;padding:0 max(16px,env(safe-area-inset-right)) 0 max(16px,env(safe-area-inset-left));color:var(--fg);background:var(--bg);}
+    p{color:var(--muted);}
+    .row{margin-top:16px;}
+    label{display:block;margin-bottom:8px;font-weight:600;}
+    input{width:100%;padding:10px;font-size:16px;border:1px solid var(--border);border-radius:10px;box-sizing:border-box;background:var(--bg);color:var(--fg);}
+    button{min-height:44px;padding:10px 16px;font-size:16px;border-radius:10px;border:1px solid var(--border);background:var(--bg);color:var(--fg);cursor:pointer;margin:6px 6px 0 0;}
+    button:hover{background:var(--subtle);}
+    .ok{padding:12px;border:1px solid var(--ok-border);border-radius:10px;background:var(--ok-bg);}
+    .err{padding:12px;border:1px solid var(--err-border);border-radius:10px;background:var(--err-bg);color:var(--fg);}
+  </style>
+</head>
+<body>
+  <h1>Browser notifications</h1>
+  <p>Get a notification on this device for every new ask. On iPhone and iPad, add this site to the home screen first and open it from there.</p>
+  <div class="row">
+    <label for="key">API key (admin scope)</label>
+    <input id="key" type="password" autocomplete="off"/>
+  </div>
+  <div class="row">
+    <button id="on" type="button">Turn on</button>
+    <button id="test" type="button">Send test</button>
+    <button id="off" type="button">Turn off</button>
+  </div>
+  <div id="status" class="row" role="status" aria-live="polite" style="display:none"></div>
+  <script>
+    (function () {
+      var VAPID = "{{.PublicKey}}";
+      var ID_KEY = "ask4me.push_id";
+      var elKey = document.getElementById("key");
+      var m = /[#&]key=([^&]+)/.exec(location.hash);
+      if (m) {
+        elKey.value = decodeURIComponent(m[1]);
+        history.replaceState(null, "", location.pathname);
+      }
+      function status(kind, text) {
+        var el = document.getElementById("status");
+        el.className = kind + " row";
+        el.textContent = text;
+        el.style.display = "block";
+      }
+      function api(method, path, body) {
+        return fetch(path, {
+          method: method,
+          headers: { "Authorization": "Bearer " + elKey.value.trim(), "Content-Type": "application/json" },
+          body: body ? JSON.stringify(body) : undefined
+        }).then(function (res) {
+          if (res.status === 204) return {};
+          return res.text().then(function (t) {
+            if (!res.ok) throw new Error(res.status === 401 || res.status === 403 ? "The API key was refused." : t.trim() || res.statusText);
+            return t ? JSON.parse(t) : {};
+          });
+        });
+      }
+      function appKey() {
+        var s = VAPID.replace(/-/g, "+").replace(/_/g, "/");
+        var raw = atob(s + "===".slice((s.length + 3) % 4));
+        var out = new Uint8Array(raw.length);
+        for (var i = 0; i < raw.length; i++) out[i] = raw.charCodeAt(i);
+        return out;
+      }
+      function registration() {
+        return navigator.serviceWorker.register("sw.js").then(function () { return navigator.serviceWorker.ready; });
+      }
+      function fail(err) { status("err", err && err.message ? err.message : String(err)); }
+      function needKey() {
+        if (elKey.value.trim()) return false;
+        status("err", "Enter an API key first.");
+        return true;
+      }
+      if (!("serviceWorker" in navigator) || !("PushManager" in window) || !window.Notification) {
+        status("err", "This browser does not support push notifications here.");
+        return;
+      }
+      if (localStorage.getItem(ID_KEY)) status("ok", "Notifications are on for this browser.");
+
+      document.getElementById("on").onclick = function () {
+        if (needKey()) return;
+        Notification.requestPermission().then(function (perm) {
+          if (perm !== "granted") throw new Error("Notifications are blocked for this site; allow them in the browser settings.");
+          return registration();
+        }).then(function (reg) {
+          return reg.pushManager.getSubscription().then(function (sub) {
+            return sub || reg.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: appKey() });
+          });
+        }).then(function (sub) {
+          var body = sub.toJSON();
+          body.name = navigator.userAgent.slice(0, 200);
+          return api("POST", "v1/push/subscriptions", body);
+        }).then(function (saved) {
+          localStorage.setItem(ID_KEY, saved.id);
+          status("ok", "Notifications are on for this browser.");
+        }).catch(fail);
+      };
+      document.getElementById("test").onclick = function () {
+        var id = localStorage.getItem(ID_KEY);
+        if (!id) { status("err", "Turn notifications on first."); return; }
+        if (needKey()) return;
+        api("POST", "v1/push/subscriptions/" + encodeURIComponent(id) + "/test").then(function () {
+          status("ok", "Test notification sent.");
+        }).catch(fail);
+      };
+      document.getElementById("off").onclick = function () {
+        var id = localStorage.getItem(ID_KEY);
+        if (needKey()) return;
+        (id ? api("DELETE", "v1/push/subscriptions/" + encodeURIComponent(id)) : Promise.resolve()).then(function () {
+          return registration();
+        }).then(function (reg) {
+          return reg.pushManager.getSubscription();
+        }).then(function (sub) {
+          localStorage.removeItem(ID_KEY);
+          if (sub) return sub.unsubscribe();
+        }).then(function () {
+          status("ok", "Notifications are off for this browser.");
+        }).catch(fail);
+      };
+    })();
+  </script>
+</body>
+</html>`))
+
+func (s *server) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := s.vapidKey(r.Context())
+	if err != nil {
+		slog.Error("web push: VAPID key", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setPageSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = subscribeTpl.Execute(w, map[string]any{"PublicKey": vapidPublicKey(key)})
+}
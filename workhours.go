@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weekly hours. Working hours are written as a list of "<days> HH:MM-HH:MM"
+// entries, such as "mon-fri 09:00-18:00" or "sat,sun 10:00-12:00", read in a
+// timezone. Day ranges may wrap ("fri-mon") and a span may end at 24:00, but
+// not cross midnight; use two entries for that. Contacts use them for their
+// working hours (contacts.go), the server for its business calendar
+// (businesshours.go).
+
+type minuteSpan struct{ from, to int }
+
+type weeklyHours struct {
+	loc  *time.Location
+	days [7][]minuteSpan
+}
+
+func parseWeeklyHours(entries []string, loc *time.Location) (*weeklyHours, error) {
+	wh := &weeklyHours{loc: loc}
+	for _, e := range entries {
+		days, span, ok := strings.Cut(strings.ToLower(strings.TrimSpace(e)), " ")
+		if !ok {
+			return nil, fmt.Errorf("%q: want <days> HH:MM-HH:MM", e)
+		}
+		set, err := parseDaySet(days)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", e, err)
+		}
+		from, to, ok := strings.Cut(strings.TrimSpace(span), "-")
+		if !ok {
+			return nil, fmt.Errorf("%q: want <days> HH:MM-HH:MM", e)
+		}
+		sp := minuteSpan{parseClock(from), parseClock(to)}
+		if sp.from < 0 || sp.to < 0 || sp.from >= sp.to {
+			return nil, fmt.Errorf("%q: the span must run from an earlier to a later time of day", e)
+		}
+		for d, on := range set {
+			if on {
+				wh.days[d] = append(wh.days[d], sp)
+			}
+		}
+	}
+	return wh, nil
+}
+
+// parseDaySet reads "mon-fri", "sat,sun" and the like.
+func parseDaySet(v string) ([7]bool, error) {
+	var set [7]bool
+	for part := range strings.SplitSeq(v, ",") {
+		a, b, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, ok1 := cronDayNames[a]
+		to, ok2 := from, true
+		if isRange {
+			to, ok2 = cronDayNames[b]
+		}
+		if !ok1 || !ok2 {
+			return set, errors.New("days must be names like mon, mon-fri or sat,sun")
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			set[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return set, nil
+}
+
+// parseClock reads HH:MM, up to 24:00, as minutes of the day; -1 means
+// invalid.
+func parseClock(v string) int {
+	h, m, ok := strings.Cut(strings.TrimSpace(v), ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || len(m) != 2 || hh < 0 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+		return -1
+	}
+	return hh*60 + mm
+}
+
+// contains reports whether t falls within the hours.
+func (wh *weeklyHours) contains(t time.Time) bool {
+	t = t.In(wh.loc)
+	minute := t.Hour()*60 + t.Minute()
+	for _, sp := range wh.days[t.Weekday()] {
+		if minute >= sp.from && minute < sp.to {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns t if it falls within the hours, otherwise when they next
+// begin. It returns the zero time for hours without any span.
+func (wh *weeklyHours) next(t time.Time) time.Time {
+	if wh.contains(t) {
+		return t
+	}
+	local := t.In(wh.loc)
+	y, m, d := local.Date()
+	for i := range 8 {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, wh.loc)
+		best := -1
+		for _, sp := range wh.days[day.Weekday()] {
+			if (best < 0 || sp.from < best) && (i > 0 || sp.from > local.Hour()*60+local.Minute()) {
+				best = sp.from
+			}
+		}
+		if best >= 0 {
+			return time.Date(y, m, d+i, best/60, best%60, 0, 0, wh.loc)
+		}
+	}
+	return time.Time{}
+}
+
+// maxCalendarDays bounds how far add looks ahead for working time.
+const maxCalendarDays = 3 * 366
+
+// add returns the time d of working time after t, skipping the days for
+// which skip (given midnight of the day) reports true. It returns the zero
+// time when the hours do not add up to d within maxCalendarDays.
+func (wh *weeklyHours) add(t time.Time, d time.Duration, skip func(time.Time) bool) time.Time {
+	local := t.In(wh.loc)
+	y, m, dd := local.Date()
+	for i := range maxCalendarDays {
+		day := time.Date(y, m, dd+i, 0, 0, 0, 0, wh.loc)
+		if skip != nil && skip(day) {
+			continue
+		}
+		for _, sp := range mergeSpans(wh.days[day.Weekday()]) {
+			from := time.Date(y, m, dd+i, sp.from/60, sp.from%60, 0, 0, wh.loc)
+			to := time.Date(y, m, dd+i, sp.to/60, sp.to%60, 0, 0, wh.loc)
+			if from.Before(t) {
+				from = t
+			}
+			if !to.After(from) {
+				continue
+			}
+			avail := to.Sub(from)
+			if d <= avail {
+				return from.Add(d)
+			}
+			d -= avail
+		}
+	}
+	return time.Time{}
+}
+
+// mergeSpans sorts the spans of a day and joins those that overlap.
+func mergeSpans(spans []minuteSpan) []minuteSpan {
+	out := slices.Clone(spans)
+	slices.SortFunc(out, func(a, b minuteSpan) int { return a.from - b.from })
+	merged := out[:0]
+	for _, sp := range out {
+		if n := len(merged); n > 0 && sp.from <= merged[n-1].to {
+			merged[n-1].to = max(merged[n-1].to, sp.to)
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
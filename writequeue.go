@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SQLite allows one writer at a time. File databases therefore get a pool of
+// read connections next to a single write connection, so long-lived SSE
+// handlers polling for events never hold up writers, and busy_timeout makes
+// the rare lock collision wait instead of failing. Events, by far the most
+// frequent write, go through eventWriter, which commits whatever inserts
+// piled up while the previous batch was being written in one transaction.
+
+const (
+	defaultSQLiteReadConns     = 8
+	defaultSQLiteBusyTimeoutMS = 5000
+	eventBatchMax              = 128
+)
+
+// sqliteDSN adds connection pragmas to a database path.
+func sqliteDSN(path string, busyTimeoutMS int, extra ...string) string {
+	q := url.Values{}
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeoutMS))
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	for _, kv := range extra {
+		k, v, _ := strings.Cut(kv, "=")
+		q.Add(k, v)
+	}
+	return path + "?" + q.Encode()
+}
+
+// openSQLiteReader opens the read pool for a file database.
+func openSQLiteReader(cfg Config) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", sqliteDSN(cfg.SQLitePath, cfg.SQLiteBusyTimeoutMS, "_pragma=query_only(1)"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.SQLiteReadConns)
+	db.SetMaxIdleConns(cfg.SQLiteReadConns)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect sqlite reader: %w", err)
+	}
+	return db, nil
+}
+
+type eventRow struct {
+	requestID string
+	eventID   string
+	typ       string
+	payload   string
+	encoding  sql.NullString
+	createdAt int64
+	done      chan error
+}
+
+type eventWriter struct {
+	db    *sql.DB
+	queue chan eventRow
+}
+
+func newEventWriter(db *sql.DB) *eventWriter {
+	w := &eventWriter{db: db, queue: make(chan eventRow, 4*eventBatchMax)}
+	go w.loop()
+	return w
+}
+
+// insert queues one event and waits until it is committed.
+func (w *eventWriter) insert(ctx context.Context, row eventRow) error {
+	row.done = make(chan error, 1)
+	select {
+	case w.queue <- row:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// Once queued the row will be written; report the real outcome.
+	return <-row.done
+}
+
+func (w *eventWriter) loop() {
+	for first := range w.queue {
+		batch := []eventRow{first}
+	fill:
+		for len(batch) < eventBatchMax {
+			select {
+			case row := <-w.queue:
+				batch = append(batch, row)
+			default:
+				break fill
+			}
+		}
+		w.flush(batch)
+	}
+}
+
+func (w *eventWriter) flush(batch []eventRow) {
+	err := w.write(batch)
+	if err != nil && len(batch) > 1 {
+		// Retry one by one so a single bad row cannot fail its neighbours.
+		for _, row := range batch {
+			row.done <- w.write([]eventRow{row})
+		}
+		return
+	}
+	for _, row := range batch {
+		row.done <- err
+	}
+}
+
+func (w *eventWriter) write(batch []eventRow) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO events(request_id,event_id,type,payload_json,payload_encoding,created_at) VALUES(?,?,?,?,?,?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range batch {
+		if _, err := stmt.Exec(row.requestID, row.eventID, row.typ, row.payload, row.encoding, row.createdAt); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}